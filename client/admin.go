@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"dead-drop/sdk"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+	"time"
+)
+
+const revokeFlag = "revoke"
+
+func setupAdminCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "admin",
+		Short: "Operate remote with an admin key: list and remove any object, inspect storage, collect garbage",
+		Long: "Operate remote through its admin api, without access to its host. The admin commands take an admin\n" +
+			"key of the default namespace, since they reach the objects and keys of every namespace.\n" +
+			"Keys are added and removed with add-key and rm-key.",
+	}
+
+	objectsCmd := &cobra.Command{
+		Use:   "objects",
+		Short: "Lists the objects of every key on remote",
+		Long: "Lists the objects of every key on remote, oldest first, with their size in bytes, when they were\n" +
+			"dropped and when they expire, and the key and namespace which dropped them.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			bindRemoteCmdFlags(cmd)
+
+			opts, err := listOptions(cmd)
+			if err != nil {
+				fmt.Printf("ERROR: %v\n", err)
+				os.Exit(1)
+			}
+
+			if err := adminObjects(opts); err != nil {
+				fmt.Printf("ERROR: Failed to list objects: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	setupListFilterFlags(objectsCmd)
+	objectsCmd.Flags().String(ownerFlag, "", "List only the objects of this key")
+
+	rmCmd := &cobra.Command{
+		Use:   "rm <oid>...",
+		Short: "Removes objects from remote, whichever key dropped them",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			bindRemoteCmdFlags(cmd)
+
+			for _, oid := range args {
+				if err := adminRm(oid); err != nil {
+					fmt.Printf("ERROR: Failed to remove object '%s': %v\n", oid, err)
+					os.Exit(1)
+				}
+
+				fmt.Printf("Removed %s\n", oid)
+			}
+		},
+	}
+
+	usageCmd := &cobra.Command{
+		Use:   "usage",
+		Short: "Shows the storage used on remote, by each key and namespace",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			bindRemoteCmdFlags(cmd)
+
+			if err := adminUsage(); err != nil {
+				fmt.Printf("ERROR: Failed to fetch usage: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	gcCmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Removes expired objects from remote now, rather than on its next expiry run",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			bindRemoteCmdFlags(cmd)
+
+			if err := adminGC(); err != nil {
+				fmt.Printf("ERROR: Failed to collect garbage: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	rotateSecretCmd := &cobra.Command{
+		Use:   "rotate-secret",
+		Short: "Rotates the secret remote signs tokens with",
+		Long: "Rotates the secret remote signs tokens with. Tokens signed with the old secret stay valid until they\n" +
+			"expire, unless --revoke is passed, which rejects every token issued before, e.g. after a leak.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			bindRemoteCmdFlags(cmd)
+			revoke, _ := cmd.Flags().GetBool(revokeFlag)
+
+			if err := adminRotateSecret(revoke); err != nil {
+				fmt.Printf("ERROR: Failed to rotate the token secret: %v\n", err)
+				os.Exit(1)
+			}
+
+			if revoke {
+				fmt.Printf("Rotated the token secret, and revoked every token issued before\n")
+			} else {
+				fmt.Printf("Rotated the token secret\n")
+			}
+		},
+	}
+	rotateSecretCmd.Flags().Bool(revokeFlag, false, "Reject every token issued before, rather than letting them expire")
+
+	keysCmd := &cobra.Command{
+		Use:   "keys",
+		Short: "Lists the authorized keys of every namespace on remote, with their roles",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			bindRemoteCmdFlags(cmd)
+
+			if err := adminKeys(); err != nil {
+				fmt.Printf("ERROR: Failed to list keys: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	for _, subCmd := range []*cobra.Command{objectsCmd, rmCmd, usageCmd, gcCmd, rotateSecretCmd, keysCmd} {
+		setupRemoteCmdFlags(subCmd)
+		cmd.AddCommand(subCmd)
+	}
+
+	return cmd
+}
+
+// adminObjects prints the objects of every key on the remote which opts select, fetching every page of the listing.
+func adminObjects(opts *sdk.ListOptions) error {
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	after := ""
+	for {
+		page, err := client.AdminObjects(context.Background(), after, 0, opts)
+		if err != nil {
+			return err
+		}
+
+		for _, object := range page.Objects {
+			owner := object.Owner
+			if owner == "" {
+				owner = "(anonymous)"
+			}
+			if object.Namespace != "" {
+				owner = object.Namespace + "/" + owner
+			}
+			fmt.Printf("%s  %12d  %s  %s  %s%s\n", object.Oid, object.Size, object.Created.Format(time.RFC3339),
+				object.Expires.Format(time.RFC3339), owner, formatLabels(object.Labels))
+		}
+		count += len(page.Objects)
+
+		if page.Next == "" {
+			break
+		}
+		after = page.Next
+	}
+
+	if count == 0 {
+		fmt.Printf("No objects\n")
+	}
+	return nil
+}
+
+func adminRm(oid string) error {
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	return client.AdminRemove(context.Background(), oid)
+}
+
+// adminUsage prints the storage used on the remote, and by each key and namespace, largest first.
+func adminUsage() error {
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	usage, err := client.AdminUsage(context.Background())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Objects: %d\n", usage.Objects)
+	fmt.Printf("Used:    %d bytes\n", usage.Bytes)
+	printUsages("Keys", usage.Keys, "(anonymous)")
+	printUsages("Namespaces", usage.Namespaces, "(default)")
+	return nil
+}
+
+func printUsages(title string, usages map[string]int64, unnamed string) {
+	if len(usages) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(usages))
+	for name := range usages {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if usages[names[i]] == usages[names[j]] {
+			return names[i] < names[j]
+		}
+		return usages[names[i]] > usages[names[j]]
+	})
+
+	fmt.Printf("%s:\n", title)
+	for _, name := range names {
+		label := name
+		if label == "" {
+			label = unnamed
+		}
+		fmt.Printf("  %-24s %12d bytes\n", label, usages[name])
+	}
+}
+
+func adminGC() error {
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	result, err := client.AdminGC(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d expired objects of %d bytes\n", result.Objects, result.Bytes)
+	return nil
+}
+
+func adminRotateSecret(revoke bool) error {
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	return client.AdminRotateSecret(context.Background(), revoke)
+}
+
+func adminKeys() error {
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	keys, err := client.AdminKeys(context.Background())
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys.Keys {
+		namespace := key.Namespace
+		if namespace == "" {
+			namespace = "(default)"
+		}
+		fmt.Printf("%-24s  %-10s  %s\n", key.KeyName, key.Role, namespace)
+	}
+	return nil
+}
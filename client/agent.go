@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"dead-drop/lib"
+	"dead-drop/sdk"
+	"encoding/pem"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+const sshAuthSockEnv = "SSH_AUTH_SOCK"
+
+func setupAgentKeyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "agent-key <public key path>",
+		Short: "Writes the public key of an ssh-agent key, to authorize it with add-key",
+		Long: "Writes the public key of a key held in the running ssh-agent, in the format add-key takes, so that\n" +
+			"the key can be authorized and then used with --ssh-agent. Only RSA and Ed25519 keys are supported.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			pubPath := args[0]
+
+			bindPFlag(cmd, agentKeyFlag)
+
+			if err := writeAgentKey(pubPath); err != nil {
+				fmt.Printf("ERROR: Failed to write agent key: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	setupAgentKeyFlag(cmd)
+
+	return cmd
+}
+
+func setupAgentKeyFlag(cmd *cobra.Command) {
+	cmd.PersistentFlags().String(agentKeyFlag, "",
+		"SHA256 fingerprint or comment of the ssh-agent key to use, if the agent holds more than one")
+}
+
+// agentSigner signs token requests with a key held in an ssh-agent.
+type agentSigner struct {
+	agent agent.ExtendedAgent
+	key   *agent.Key
+}
+
+func (signer *agentSigner) SignTokenRequest(data []byte) ([]byte, error) {
+	format := ssh.KeyAlgoED25519
+	var flags agent.SignatureFlags
+	if signer.key.Type() == ssh.KeyAlgoRSA {
+		format = ssh.SigAlgoRSASHA2512
+		flags = agent.SignatureFlagRsaSha512
+	}
+
+	signature, err := signer.agent.SignWithFlags(signer.key, data, flags)
+	if err != nil {
+		return nil, fmt.Errorf("ssh-agent failed to sign: %v", err)
+	}
+	// Old agents ignore the flags, and sign with SHA-1 instead.
+	if signature.Format != format {
+		return nil, fmt.Errorf("ssh-agent signed with %s instead of %s", signature.Format, format)
+	}
+	return signature.Blob, nil
+}
+
+// loadAgentAuthKey connects to the running ssh-agent, to authenticate with the key selected by the agent key flag.
+func loadAgentAuthKey(keyName string) (sdk.Option, error) {
+	sshAgent, key, err := selectAgentKey()
+	if err != nil {
+		return nil, err
+	}
+	return sdk.WithTokenSigner(keyName, &agentSigner{agent: sshAgent, key: key}), nil
+}
+
+func writeAgentKey(pubPath string) error {
+	_, key, err := selectAgentKey()
+	if err != nil {
+		return err
+	}
+
+	pubKeyBytes, err := encodeAgentKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(pubPath, pubKeyBytes, lib.PublicKeyPerms); err != nil {
+		return fmt.Errorf("failed to write public key: %v", err)
+	}
+	fmt.Printf("Wrote public key of %s to %s\n", agentKeyName(key), pubPath)
+
+	return nil
+}
+
+// selectAgentKey connects to the running ssh-agent, and returns the key selected by the agent key flag, or its only
+// RSA or Ed25519 key if the flag is empty.
+func selectAgentKey() (agent.ExtendedAgent, *agent.Key, error) {
+	socket := os.Getenv(sshAuthSockEnv)
+	if socket == "" {
+		return nil, nil, fmt.Errorf("no ssh-agent is running (%s is not set)", sshAuthSockEnv)
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error connecting to ssh-agent: %v", err)
+	}
+	sshAgent := agent.NewClient(conn)
+
+	keys, err := sshAgent.List()
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("error listing ssh-agent keys: %v", err)
+	}
+
+	key, err := findAgentKey(keys, viper.GetString(agentKeyFlag))
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return sshAgent, key, nil
+}
+
+func findAgentKey(keys []*agent.Key, selector string) (*agent.Key, error) {
+	var candidates []*agent.Key
+	for _, key := range keys {
+		if key.Type() != ssh.KeyAlgoRSA && key.Type() != ssh.KeyAlgoED25519 {
+			continue
+		}
+		if selector == "" || selector == ssh.FingerprintSHA256(key) || selector == key.Comment {
+			candidates = append(candidates, key)
+		}
+	}
+
+	switch {
+	case len(candidates) == 1:
+		return candidates[0], nil
+	case len(candidates) == 0 && selector != "":
+		return nil, fmt.Errorf("ssh-agent holds no RSA or Ed25519 key matching '%s'", selector)
+	case len(candidates) == 0:
+		return nil, fmt.Errorf("ssh-agent holds no RSA or Ed25519 keys")
+	default:
+		names := make([]string, 0, len(candidates))
+		for _, key := range candidates {
+			names = append(names, agentKeyName(key))
+		}
+		return nil, fmt.Errorf("ssh-agent holds several keys, select one with '%s': %s",
+			agentKeyFlag, strings.Join(names, ", "))
+	}
+}
+
+func agentKeyName(key *agent.Key) string {
+	if key.Comment == "" {
+		return ssh.FingerprintSHA256(key)
+	}
+	return fmt.Sprintf("%s (%s)", ssh.FingerprintSHA256(key), key.Comment)
+}
+
+// encodeAgentKey encodes the public key of an agent key as gen-key writes it.
+func encodeAgentKey(key *agent.Key) ([]byte, error) {
+	pubKey, err := ssh.ParsePublicKey(key.Blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse agent key: %v", err)
+	}
+	cryptoPubKey, ok := pubKey.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported agent key type '%s'", key.Type())
+	}
+
+	switch pubKey := cryptoPubKey.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(pubKey)}), nil
+	case ed25519.PublicKey:
+		return pem.EncodeToMemory(&pem.Block{Type: lib.Ed25519PublicKeyType, Bytes: pubKey}), nil
+	default:
+		return nil, fmt.Errorf("unsupported agent key type '%s'", key.Type())
+	}
+}
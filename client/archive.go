@@ -0,0 +1,237 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tarDirectory returns a reader of a tar archive of the tree under dir, which is written as it is read.
+// Regular files, directories and symlinks are archived with their permissions and modification times;
+// anything else (sockets, devices, ...) is skipped with a warning.
+func tarDirectory(dir string) io.ReadCloser {
+	pipeReader, pipeWriter := io.Pipe()
+
+	go func() {
+		archive := tar.NewWriter(pipeWriter)
+		err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(dir, filePath)
+			if err != nil {
+				return err
+			}
+			if rel == "." {
+				return nil
+			}
+			return addToTar(archive, filePath, filepath.ToSlash(rel), info)
+		})
+		if err == nil {
+			err = archive.Close()
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+
+	return pipeReader
+}
+
+func addToTar(archive *tar.Writer, filePath string, name string, info os.FileInfo) error {
+	link := ""
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		var err error
+		if link, err = os.Readlink(filePath); err != nil {
+			return err
+		}
+	case !info.Mode().IsRegular() && !info.IsDir():
+		fmt.Fprintf(os.Stderr, "WARN: Skipping '%s', which is neither a file, directory nor symlink\n", filePath)
+		return nil
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	// Owners mean nothing on the recipient's machine.
+	header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(archive, file)
+	return err
+}
+
+// extractTar extracts a tar archive into destDir, which must already exist.
+// The archive was made by whoever dropped the object, so entries are never written outside destDir: paths which
+// escape it are refused, and symlinks are created last, once nothing more will be written through them.
+func extractTar(r io.Reader, destDir string) error {
+	type deferredEntry struct {
+		name   string
+		path   string
+		header *tar.Header
+	}
+	var dirs, links []deferredEntry
+
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("error reading archive: %v", err)
+		}
+
+		name, err := archiveEntryPath(header.Name)
+		if err != nil {
+			return err
+		}
+		entryPath := filepath.Join(destDir, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(entryPath, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, deferredEntry{name, entryPath, header})
+		case tar.TypeReg, tar.TypeRegA:
+			if err := extractFile(archive, entryPath, header); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			links = append(links, deferredEntry{name, entryPath, header})
+		default:
+			fmt.Fprintf(os.Stderr, "WARN: Skipping archive entry '%s' of unsupported type\n", header.Name)
+		}
+	}
+
+	// Links are checked once they are all known, since whether a link stays inside depends on the links it goes through.
+	linkNames := make(map[string]bool)
+	for _, link := range links {
+		linkNames[filepath.ToSlash(link.name)] = true
+	}
+	for _, link := range links {
+		if !symlinkStaysInside(filepath.ToSlash(link.name), link.header.Linkname, linkNames) {
+			return fmt.Errorf("archive entry '%s' may link outside the destination", link.header.Name)
+		}
+	}
+
+	for _, link := range links {
+		if err := os.MkdirAll(filepath.Dir(link.path), 0700); err != nil {
+			return err
+		}
+		if err := os.Symlink(link.header.Linkname, link.path); err != nil {
+			return err
+		}
+	}
+
+	// Directory permissions and times are restored last, since writing their contents would undo them.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].header.FileInfo().Mode().Perm()); err != nil {
+			return err
+		}
+		restoreTimes(dirs[i].path, dirs[i].header)
+	}
+	return nil
+}
+
+func extractFile(r io.Reader, filePath string, header *tar.Header) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+		return err
+	}
+
+	// Files are created exclusively, so that a repeated entry can't overwrite one extracted earlier.
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, header.FileInfo().Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	restoreTimes(filePath, header)
+	return nil
+}
+
+func restoreTimes(filePath string, header *tar.Header) {
+	accessed := header.AccessTime
+	if accessed.IsZero() {
+		accessed = time.Now()
+	}
+	if err := os.Chtimes(filePath, accessed, header.ModTime); err != nil {
+		fmt.Fprintf(os.Stderr, "WARN: Failed to restore modification time of '%s': %v\n", filePath, err)
+	}
+}
+
+// archiveEntryPath returns the path of an archive entry relative to the destination, refusing paths which are
+// absolute or climb out of it.
+func archiveEntryPath(name string) (string, error) {
+	clean := path.Clean(strings.Replace(name, "\\", "/", -1))
+	if path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") ||
+		strings.ContainsRune(clean, 0) {
+		return "", fmt.Errorf("archive entry '%s' has an unsafe path", name)
+	}
+	return filepath.FromSlash(clean), nil
+}
+
+// symlinkStaysInside reports whether a symlink at name, relative to the destination, points inside the destination.
+// Paths through other links of the archive can't be followed without creating them, so links inside linked
+// directories, and targets which pass through a link, are treated as escaping.
+func symlinkStaysInside(name string, target string, linkNames map[string]bool) bool {
+	if path.IsAbs(target) || filepath.IsAbs(target) || strings.ContainsRune(target, 0) {
+		return false
+	}
+
+	parts := strings.Split(path.Dir(name), "/")
+	if parts[0] == "." {
+		parts = parts[:0]
+	}
+	for i := range parts {
+		if linkNames[strings.Join(parts[:i+1], "/")] {
+			return false
+		}
+	}
+
+	targetParts := strings.Split(strings.Replace(target, "\\", "/", -1), "/")
+	for i, part := range targetParts {
+		switch part {
+		case "", ".":
+		case "..":
+			if len(parts) == 0 {
+				return false
+			}
+			parts = parts[:len(parts)-1]
+		default:
+			parts = append(parts, part)
+			if i < len(targetParts)-1 && linkNames[strings.Join(parts, "/")] {
+				return false
+			}
+		}
+	}
+	return true
+}
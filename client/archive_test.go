@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTarRoundTrip(t *testing.T) {
+	src, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	modified := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.MkdirAll(filepath.Join(src, "docs", "drafts"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "docs", "plan.txt"), []byte("the plan"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(src, "docs", "plan.txt"), modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("docs", "plan.txt"), filepath.Join(src, "plan")); err != nil {
+		t.Fatal(err)
+	}
+
+	dest, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	archive := tarDirectory(src)
+	defer archive.Close()
+	if err := extractTar(archive, dest); err != nil {
+		t.Fatalf("extraction failed: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dest, "plan"))
+	if err != nil || string(data) != "the plan" {
+		t.Errorf("read %q through the extracted link (%v), expected %q", data, err, "the plan")
+	}
+	if info, err := os.Stat(filepath.Join(dest, "docs", "plan.txt")); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0640 || !info.ModTime().Equal(modified) {
+		t.Errorf("extracted file has mode %v and time %v, expected %v and %v", info.Mode().Perm(), info.ModTime(),
+			os.FileMode(0640), modified)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "docs", "drafts")); err != nil || !info.IsDir() ||
+		info.Mode().Perm() != 0750 {
+		t.Errorf("extracted directory is %v (%v), expected a directory of mode %v", info, err, os.FileMode(0750))
+	}
+}
+
+// archiveEntry is an entry of an archive built by a test, which is a symlink if link isn't empty.
+type archiveEntry struct {
+	name string
+	link string
+}
+
+func buildArchive(t *testing.T, entries []archiveEntry) []byte {
+	archive := new(bytes.Buffer)
+	writer := tar.NewWriter(archive)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0600, Typeflag: tar.TypeReg, Size: int64(len("data"))}
+		if entry.link != "" {
+			header = &tar.Header{Name: entry.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: entry.link}
+		}
+		if err := writer.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if entry.link == "" {
+			if _, err := writer.Write([]byte("data")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+func TestExtractTarRefusesEscapes(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		entries []archiveEntry
+	}{
+		{"parent path", []archiveEntry{{name: "../escaped"}}},
+		{"climbing path", []archiveEntry{{name: "docs/../../escaped"}}},
+		{"absolute path", []archiveEntry{{name: "/tmp/escaped"}}},
+		{"backslash path", []archiveEntry{{name: "..\\escaped"}}},
+		{"repeated file", []archiveEntry{{name: "plan.txt"}, {name: "plan.txt"}}},
+		{"absolute link", []archiveEntry{{name: "passwd", link: "/etc/passwd"}}},
+		{"parent link", []archiveEntry{{name: "up", link: ".."}}},
+		{"climbing link", []archiveEntry{{name: "docs/up", link: "../../escaped"}}},
+		{"link through a link", []archiveEntry{{name: "here", link: "."}, {name: "up", link: "here/.."}}},
+		{"link in a linked directory", []archiveEntry{{name: "docs", link: "."}, {name: "docs/up", link: ".."}}},
+	} {
+		parent, err := ioutil.TempDir("", "archive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dest := filepath.Join(parent, "dest")
+		if err := os.Mkdir(dest, 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := extractTar(bytes.NewReader(buildArchive(t, test.entries)), dest); err == nil {
+			t.Errorf("extracted an archive with a %s", test.name)
+		}
+		if _, err := os.Lstat(filepath.Join(parent, "escaped")); err == nil {
+			t.Errorf("archive with a %s wrote outside the destination", test.name)
+		}
+		os.RemoveAll(parent)
+	}
+}
+
+func TestExtractTarLinksInside(t *testing.T) {
+	dest, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	entries := []archiveEntry{
+		{name: "docs/plan.txt"},
+		{name: "docs/latest", link: "plan.txt"},
+		{name: "plan", link: "docs/./plan.txt"},
+	}
+	if err := extractTar(bytes.NewReader(buildArchive(t, entries)), dest); err != nil {
+		t.Fatalf("extraction of links inside the destination failed: %v", err)
+	}
+	for _, name := range []string{"plan", filepath.Join("docs", "latest")} {
+		if data, err := ioutil.ReadFile(filepath.Join(dest, name)); err != nil || string(data) != "data" {
+			t.Errorf("read %q through %s (%v), expected %q", data, name, err, "data")
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"dead-drop/lib"
+	"dead-drop/sdk"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"sync"
+	"time"
+)
+
+func setupBatchCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "batch <manifest>",
+		Short: "Run the drops and pulls listed in a manifest file",
+		Long: "Run the drops and pulls listed in a manifest file.\n\n" +
+			"The manifest (YAML, or JSON or TOML) lists operations, each either a drop of a file or directory,\n" +
+			"with drop options of its own, or a pull of an object to a destination:\n\n" +
+			"  operations:\n" +
+			"    - drop: ./report.pdf\n" +
+			"      note: Q3 figures\n" +
+			"      ttl: 24h\n" +
+			"    - pull: <object>\n" +
+			"      to: ./downloads/\n\n" +
+			"Operations run concurrently, with one token per remote, and a summary is printed at the end.\n" +
+			"Paths are relative to the current directory. The flags apply to every operation, which can set\n" +
+			"name, note, codec, cipher, ttl, burn, max-pulls, label and checksum on top of them.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			manifestPath := args[0]
+
+			bindDropFlags(cmd)
+			bindPullFlags(cmd)
+			bindPFlag(cmd, workersFlag)
+
+			operations, err := readBatchManifest(manifestPath)
+			if err != nil {
+				fmt.Printf("ERROR: Failed to read manifest '%s': %v\n", manifestPath, err)
+				os.Exit(1)
+			}
+
+			results, err := batch(operations)
+			if err != nil {
+				fmt.Printf("ERROR: Failed to run manifest '%s': %v\n", manifestPath, err)
+				os.Exit(1)
+			}
+
+			if failed := printBatchSummary(results); failed > 0 {
+				os.Exit(1)
+			}
+		},
+	}
+
+	setupDropFlags(cmd)
+	setupPullFlags(cmd)
+	cmd.PersistentFlags().Int(workersFlag, 4, "Number of operations to run at once")
+
+	return cmd
+}
+
+// batchOperation is an entry of a batch manifest: either a drop, or a pull to a destination.
+type batchOperation struct {
+	Drop string `mapstructure:"drop"`
+	Pull string `mapstructure:"pull"`
+	To   string `mapstructure:"to"`
+
+	// The drop options set on top of the drop flags.
+	Name     string        `mapstructure:"name"`
+	Note     string        `mapstructure:"note"`
+	Codec    []string      `mapstructure:"codec"`
+	Pad      bool          `mapstructure:"pad"`
+	Cipher   string        `mapstructure:"cipher"`
+	TTL      time.Duration `mapstructure:"ttl"`
+	Burn     bool          `mapstructure:"burn"`
+	MaxPulls int           `mapstructure:"max-pulls"`
+	Label    []string      `mapstructure:"label"`
+	Checksum string        `mapstructure:"checksum"`
+}
+
+func (op *batchOperation) String() string {
+	if op.Drop != "" {
+		return "drop " + op.Drop
+	}
+	return "pull " + op.Pull + " to " + op.To
+}
+
+func (op *batchOperation) check() error {
+	if (op.Drop == "") == (op.Pull == "") {
+		return fmt.Errorf("exactly one of 'drop' and 'pull' must be set")
+	}
+	if op.Drop != "" {
+		if op.To != "" {
+			return fmt.Errorf("'to' can't be set on drops")
+		}
+		if op.Drop == stdinPath {
+			return fmt.Errorf("drops can't read stdin")
+		}
+		if op.MaxPulls < 0 {
+			return fmt.Errorf("'max-pulls' can't be negative")
+		}
+		return nil
+	}
+
+	if op.To == "" {
+		return fmt.Errorf("'to' must be set on pulls")
+	}
+	if op.Name != "" || op.Note != "" || len(op.Codec) > 0 || op.Cipher != "" || op.TTL != 0 || op.Burn ||
+		op.MaxPulls != 0 || len(op.Label) > 0 || op.Checksum != "" {
+		return fmt.Errorf("drop options can't be set on pulls")
+	}
+	return nil
+}
+
+// dropOptions returns the drop options of the drop flags, with those set by the operation on top.
+func (op *batchOperation) dropOptions() sdk.DropOptions {
+	opts := *dropOptions()
+	if op.Name != "" {
+		opts.Name = op.Name
+	}
+	if op.Note != "" {
+		opts.Note = op.Note
+	}
+	if len(op.Codec) > 0 {
+		opts.Codecs = op.Codec
+	}
+	if op.Pad {
+		opts.Pad = true
+	}
+	if op.Cipher == cipherCtrHmac {
+		opts.Cipher = ""
+	} else if op.Cipher != "" {
+		opts.Cipher = op.Cipher
+	}
+	if op.TTL != 0 {
+		opts.TTL = op.TTL
+	}
+	if op.Burn {
+		opts.Burn = true
+	}
+	if op.MaxPulls != 0 {
+		opts.MaxPulls = op.MaxPulls
+	}
+	if len(op.Label) > 0 {
+		// The operation's labels are added to those of the flags, replacing any of the same key.
+		merged := make(map[string]string)
+		for key, value := range opts.Labels {
+			merged[key] = value
+		}
+		for key, value := range lib.SplitLabels(op.Label) {
+			merged[key] = value
+		}
+		opts.Labels = merged
+	}
+	if op.Checksum != "" {
+		opts.Checksum = op.Checksum
+	}
+	return opts
+}
+
+func readBatchManifest(path string) ([]batchOperation, error) {
+	manifest := viper.New()
+	manifest.SetConfigFile(path)
+	if err := manifest.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	var operations []batchOperation
+	if err := manifest.UnmarshalKey("operations", &operations); err != nil {
+		return nil, fmt.Errorf("error decoding operations: %v", err)
+	}
+	if len(operations) == 0 {
+		return nil, fmt.Errorf("no operations")
+	}
+	for i := range operations {
+		if err := operations[i].check(); err != nil {
+			return nil, fmt.Errorf("operation %d (%s): %v", i+1, &operations[i], err)
+		}
+	}
+	return operations, nil
+}
+
+// batchResult is the outcome of an operation: the reference it dropped, or the path it pulled to.
+type batchResult struct {
+	op     *batchOperation
+	result string
+	err    error
+}
+
+// batch runs operations with a pool of workers, and returns their results in order. Keys are loaded, and clients
+// created, once for all of them.
+func batch(operations []batchOperation) ([]batchResult, error) {
+	var drops, pulls bool
+	for _, op := range operations {
+		drops = drops || op.Drop != ""
+		pulls = pulls || op.Pull != ""
+	}
+
+	// The keys objects are dropped with decrypt them too, unless they are recipients' public keys, so a passphrase
+	// is only prompted for once.
+	var dropKeys, pullKeys encryptionKeys
+	var err error
+	if drops && !viper.GetBool(rawFlag) {
+		if dropKeys, err = loadKeys(true); err != nil {
+			return nil, err
+		}
+		defer dropKeys.Destroy()
+	}
+	if pulls {
+		if dropKeys != nil && len(viper.GetStringSlice(recipientFlag)) == 0 && viper.GetString(identityFlag) == "" {
+			pullKeys = dropKeys
+		} else {
+			if pullKeys, err = loadKeys(false); err != nil {
+				return nil, err
+			}
+			defer pullKeys.Destroy()
+		}
+	}
+
+	dropClients := newBatchClients(dropKeys)
+	pullClients := dropClients
+	if pullKeys != dropKeys {
+		pullClients = newBatchClients(pullKeys)
+	}
+
+	workers := viper.GetInt(workersFlag)
+	if workers < 1 {
+		return nil, fmt.Errorf("flag '%s' must be at least 1", workersFlag)
+	}
+
+	results := make([]batchResult, len(operations))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				op := &operations[i]
+				results[i] = batchResult{op: op}
+				if op.Drop != "" {
+					results[i].result, results[i].err = batchDrop(dropClients, op)
+				} else {
+					results[i].result, results[i].err = batchPull(pullClients, op)
+				}
+			}
+		}()
+	}
+	for i := range operations {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results, nil
+}
+
+func batchDrop(clients *batchClients, op *batchOperation) (string, error) {
+	client, err := clients.get("")
+	if err != nil {
+		return "", err
+	}
+
+	or, err := dropPath(context.Background(), client, op.Drop, op.dropOptions())
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := formatRef(or)
+	if err != nil {
+		return or.String(), fmt.Errorf("dropped as %s, but %v", or, err)
+	}
+	fmt.Printf("Dropped %s -> %s\n", op.Drop, ref)
+	return ref, nil
+}
+
+func batchPull(clients *batchClients, op *batchOperation) (string, error) {
+	or, err := sdk.ParseObjectReference(op.Pull)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := clients.get(or.Remote)
+	if err != nil {
+		return "", err
+	}
+
+	path, err := pullObject(context.Background(), client, or, op.To)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Pulled %s <- %s\n", path, op.Pull)
+	return path, nil
+}
+
+// printBatchSummary prints the failed operations and how many succeeded, and returns how many failed.
+func printBatchSummary(results []batchResult) int {
+	failed := 0
+	for _, result := range results {
+		if result.err != nil {
+			fmt.Printf("FAILED: %s: %v\n", result.op, result.err)
+			failed++
+		}
+	}
+	fmt.Printf("%d operations succeeded, %d failed\n", len(results)-failed, failed)
+	return failed
+}
+
+// batchClients creates a client for each remote operations use, once, so that they share its token.
+type batchClients struct {
+	keys    encryptionKeys
+	lock    sync.Mutex
+	clients map[string]*sdk.Client
+}
+
+func newBatchClients(keys encryptionKeys) *batchClients {
+	return &batchClients{keys: keys, clients: make(map[string]*sdk.Client)}
+}
+
+// get returns the client for a remote, or for the configured remote if it is empty.
+func (clients *batchClients) get(remote string) (*sdk.Client, error) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	if client, ok := clients.clients[remote]; ok {
+		return client, nil
+	}
+
+	// Progress lines from concurrent operations would be interleaved, so only results are printed.
+	opts := []sdk.Option{sdk.WithProgress(nil)}
+	if clients.keys != nil {
+		opts = append(opts, sdk.WithKeys(clients.keys))
+	}
+
+	var client *sdk.Client
+	var err error
+	if remote == "" {
+		client, err = newClient(opts...)
+	} else {
+		client, err = newRemoteClient(remote, opts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	clients.clients[remote] = client
+	return client, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+func setupCheckinCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "checkin",
+		Short: "Checks in with remote, holding the objects you dropped with --release-to",
+		Long: "Tells remote your key is still around, which holds the objects you dropped with --release-to for\n" +
+			"another --checkin-interval. Once you miss a check-in, they are released to the keys they name.\n" +
+			"Run it more often than the shortest interval, e.g. from cron.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			bindRemoteCmdFlags(cmd)
+
+			if err := checkin(); err != nil {
+				fmt.Printf("ERROR: Failed to check in: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	setupRemoteCmdFlags(cmd)
+
+	return cmd
+}
+
+func checkin() error {
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	payload, err := client.Checkin(context.Background())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Checked in %s at %s\n", payload.KeyName, payload.CheckedIn.Format(time.RFC3339))
+	return nil
+}
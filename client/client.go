@@ -1,46 +1,141 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
-	"crypto/sha512"
-	"crypto/tls"
 	"crypto/x509"
 	"dead-drop/lib"
-	"encoding/base64"
-	"encoding/json"
+	"dead-drop/sdk"
 	"encoding/pem"
 	"fmt"
 	"github.com/awnumar/memguard"
 	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"io"
 	"io/ioutil"
-	"net/http"
+	"mime"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
+	"time"
 )
 
 const remoteFlag = "remote"
 const privKeyFlag = "private-key"
 const encryptionKeyFlag = "encryption-key"
+const keyringFlag = "keyring"
 const keyNameFlag = "key-name"
 const insecureSkipVerifyFlag = "insecure-skip-verify"
+const caCertFlag = "ca-cert"
+const pinnedCertFlag = "pinned-cert-sha256"
+const clientCertFlag = "client-cert"
+const clientKeyFlag = "client-key"
+const proxyFlag = "proxy"
+const retriesFlag = "retries"
+const connectTimeoutFlag = "connect-timeout"
+const tlsTimeoutFlag = "tls-timeout"
+const responseTimeoutFlag = "response-timeout"
+const suffixOnConflictFlag = "suffix-on-conflict"
+const noteFlag = "note"
+const keyIdFlag = "id"
+const keyTtlFlag = "ttl"
+const recipientFlag = "recipient"
+const codecFlag = "codec"
+const resumeFlag = "resume"
+const nameFlag = "name"
+const forceFlag = "force"
+const passphraseFlag = "passphrase"
+const cipherFlag = "cipher"
+const identityFlag = "identity"
+const keyTypeFlag = "type"
+const ageFlag = "age"
+const rawFlag = "raw"
+const linkFlag = "link"
+const phraseFlag = "phrase"
+const objectTtlFlag = "ttl"
+const burnFlag = "burn"
+const maxPullsFlag = "max-pulls"
+const shareExpiresFlag = "expires"
+const anonymousFlag = "anonymous"
+const shareMaxUsesFlag = "max-uses"
+const journalFlag = "journal"
+const settleFlag = "settle"
+const removeFlag = "remove"
+const workersFlag = "workers"
+const checksumFlag = "checksum"
+const historyFlag = "history"
+const padFlag = "pad"
+const connectionsFlag = "connections"
+const sshAgentFlag = "ssh-agent"
+const agentKeyFlag = "agent-key"
+const pkcs11ModuleFlag = "pkcs11-module"
+const pkcs11TokenFlag = "pkcs11-token"
+const pkcs11KeyFlag = "pkcs11-key"
+const sinceFlag = "since"
+const untilFlag = "until"
+const minSizeFlag = "min-size"
+const maxSizeFlag = "max-size"
+const ownerFlag = "owner"
+const labelFlag = "label"
+const aliasFlag = "as"
+const releaseToFlag = "release-to"
+const checkinIntervalFlag = "checkin-interval"
+const releaseAtFlag = "release-at"
+const canaryFlag = "canary"
+const profileFlag = "profile"
+const keyRoleFlag = "role"
+const namespaceFlag = "namespace"
+const keyNamespaceFlag = "key-namespace"
+const sharesFlag = "shares"
+const thresholdFlag = "threshold"
+const counterpartyFlag = "counterparty"
+
+// envPrefix prefixes the environment variables which settings are read from, e.g. DEAD_KEY_NAME for key-name.
+const envPrefix = "DEAD"
+
+// profilesKey is the config file key holding the named profiles, which --profile selects.
+const profilesKey = "profiles"
+
+const openSSHPrivateKeyType = "OPENSSH PRIVATE KEY"
+
+// cipherCtrHmac is the --cipher name of AES-CTR and HMAC-SHA-256, which the sdk encrypts with when given no cipher.
+const cipherCtrHmac = "aes-ctr-hmac"
+
+// stdinPath is the file path which drops read from stdin.
+const stdinPath = "-"
+
+// Resumable pulls keep their partial downloads in this directory inside the config directory.
+const partialDirName = "partial"
 
 var confFile string
+var profile string
 var keyNameRegex = regexp.MustCompile(lib.KeyNameRegex)
 
 func main() {
-	cobra.OnInitialize(loadConfig)
-
-	var rootCmd = &cobra.Command{Use: "dead"}
-	rootCmd.AddCommand(setupDropCmd(), setupPullCmd(), setupAddKeyCmd(), setupKeyGenCmd())
+	var rootCmd = &cobra.Command{
+		Use: "dead",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			loadConfig(false)
+		},
+	}
+	rootCmd.AddCommand(setupDropCmd(), setupPullCmd(), setupAddKeyCmd(), setupKeyGenCmd(), setupKeyringCmd(),
+		setupSelfTestCmd(), setupAccessLogCmd(), setupLsCmd(), setupRmCmd(),
+		setupStatCmd(), setupCatCmd(), setupAgentKeyCmd(), setupPKCS11KeyCmd(), setupConfigCmd(), setupWatchCmd(),
+		setupSyncCmd(), setupBatchCmd(), setupVerifyCmd(),
+		setupKeychainCmd(), setupHistoryCmd(), setupQuotaCmd(), setupRmKeyCmd(), setupShareCmd(), setupAdminCmd(),
+		setupPhraseCmd(), setupVersionsCmd(), setupCheckinCmd(), setupKMSCmd(), setupKeyCmd())
 
 	rootCmd.PersistentFlags().StringVar(&confFile, "config", "",
 		"config file (default is "+filepath.Join("$HOME", lib.DefaultConfigDir, lib.DefaultConfigName)+".yml)")
+	rootCmd.PersistentFlags().StringVar(&profile, profileFlag, "",
+		"config file profile to use, overriding the settings outside profiles (default is the profile setting)")
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Printf("FATAL: Failed to execute command: %v\n", err)
@@ -48,7 +143,13 @@ func main() {
 	}
 }
 
-func loadConfig() {
+// loadConfig reads the config file, which must exist if it was passed with --config, unless missingOk is set.
+func loadConfig(missingOk bool) {
+	// Environment variables override the config file, but not flags.
+	viper.SetEnvPrefix(envPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv()
+
 	if confFile != "" {
 		viper.SetConfigFile(confFile)
 	} else {
@@ -57,12 +158,38 @@ func loadConfig() {
 		viper.SetConfigType(lib.DefaultConfigType)
 	}
 
+	// The default config file is optional, since everything can be set with flags or environment variables.
 	if err := viper.ReadInConfig(); err != nil {
+		_, notFound := err.(viper.ConfigFileNotFoundError)
+		if !notFound && !(missingOk && os.IsNotExist(err)) {
+			fmt.Printf("Error reading config file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := applyProfile(); err != nil {
 		fmt.Printf("Error reading config file: %v\n", err)
 		os.Exit(1)
 	}
 }
 
+// applyProfile merges the settings of the selected profile over the rest of the config file, so that they are still
+// overridden by flags.
+func applyProfile() error {
+	name := profile
+	if name == "" {
+		name = viper.GetString(profileFlag)
+	}
+	if name == "" {
+		return nil
+	}
+
+	if !viper.IsSet(profilesKey + "." + name) {
+		return fmt.Errorf("profile '%s' not found", name)
+	}
+	return viper.MergeConfigMap(viper.GetStringMap(profilesKey + "." + name))
+}
+
 func getStringFlag(flag string) (string, error) {
 	value := viper.GetString(flag)
 	if value == "" {
@@ -79,84 +206,378 @@ func bindPFlag(cmd *cobra.Command, flag string) {
 }
 
 func setupEncryptionFlags(cmd *cobra.Command) {
-	cmd.PersistentFlags().String(encryptionKeyFlag, "", "Encryption key")
+	cmd.PersistentFlags().String(encryptionKeyFlag, "",
+		"Encryption key file, "+keychainPrefix+"<name> for a key stored in the OS keychain with 'keychain store', or "+
+			kmsPrefix+"<path> for a key wrapped with 'kms wrap'")
+	cmd.PersistentFlags().String(keyringFlag, "",
+		"Keyring of encryption keys, used instead of the encryption key for drops, and for pulls of objects with a key id")
+	cmd.PersistentFlags().Bool(passphraseFlag, false,
+		"Derive the encryption key from a passphrase, which is prompted for on the terminal, instead of a key file")
 }
 
 func bindEncryptionFlags(cmd *cobra.Command) {
 	bindPFlag(cmd, encryptionKeyFlag)
+	bindPFlag(cmd, keyringFlag)
+	bindPFlag(cmd, passphraseFlag)
+}
+
+func setupIdentityFlag(cmd *cobra.Command) {
+	cmd.PersistentFlags().String(identityFlag, "",
+		"Private key (RSA or X25519) to pull objects encrypted to its public key with, besides the authentication key")
 }
 
 func setupRemoteCmdFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().String(remoteFlag, "", "Remote dead-drop host")
 	cmd.PersistentFlags().String(privKeyFlag, "",
-		"Private key to use for authentication (e.g. generated by keygen)")
+		"Private key to use for authentication (e.g. generated by gen-key, or an OpenSSH key like ~/.ssh/id_ed25519)")
 	cmd.PersistentFlags().String(keyNameFlag, "", "Key name to use for authentication")
+	cmd.PersistentFlags().String(namespaceFlag, "",
+		"Namespace of the remote to address requests to, which must be the authenticating key's")
 	cmd.PersistentFlags().Bool(insecureSkipVerifyFlag, false, "Skip tls certificate verification")
+	cmd.PersistentFlags().String(caCertFlag, "",
+		"CA certificates (PEM) to verify the server's tls certificate with, instead of the system roots")
+	cmd.PersistentFlags().StringSlice(pinnedCertFlag, nil,
+		"Base64 SHA-256 hash of the public key (SPKI) the server's tls certificate must have (repeatable)")
+	cmd.PersistentFlags().String(clientCertFlag, "", "tls client certificate (PEM) to present, e.g. to an mTLS proxy")
+	cmd.PersistentFlags().String(clientKeyFlag, "", "Private key (PEM) of the tls client certificate")
+	cmd.PersistentFlags().String(proxyFlag, "",
+		"Proxy to connect to the remote through, e.g. socks5://127.0.0.1:9050 for Tor, or http://proxy:3128")
+	cmd.PersistentFlags().Int(retriesFlag, sdk.DefaultRetryPolicy.MaxAttempts-1,
+		"Times to retry requests failing with network errors or 5xx responses, with exponential backoff")
+	cmd.PersistentFlags().Duration(connectTimeoutFlag, sdk.DefaultTimeouts.Dial,
+		"Time to wait to connect to the remote (or proxy), or 0 for no limit")
+	cmd.PersistentFlags().Duration(tlsTimeoutFlag, sdk.DefaultTimeouts.TLSHandshake,
+		"Time to wait for the tls handshake, or 0 for no limit")
+	cmd.PersistentFlags().Duration(responseTimeoutFlag, sdk.DefaultTimeouts.ResponseHeader,
+		"Time to wait for the remote to respond once a request is sent, or 0 for no limit")
+	cmd.PersistentFlags().Bool(sshAgentFlag, false,
+		"Authenticate with a key held in the running ssh-agent instead of the private key (see agent-key)")
+	setupAgentKeyFlag(cmd)
+	setupPKCS11Flags(cmd)
 }
 
 func bindRemoteCmdFlags(cmd *cobra.Command) {
 	bindPFlag(cmd, remoteFlag)
 	bindPFlag(cmd, privKeyFlag)
 	bindPFlag(cmd, keyNameFlag)
+	bindPFlag(cmd, namespaceFlag)
 	bindPFlag(cmd, insecureSkipVerifyFlag)
-
-	insecureSkipVerify := viper.GetBool(insecureSkipVerifyFlag)
-	if insecureSkipVerify {
-		fmt.Printf("WARN: Skipping tls certificate verification, be careful!\n")
-	}
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	bindPFlag(cmd, caCertFlag)
+	bindPFlag(cmd, pinnedCertFlag)
+	bindPFlag(cmd, clientCertFlag)
+	bindPFlag(cmd, clientKeyFlag)
+	bindPFlag(cmd, proxyFlag)
+	bindPFlag(cmd, retriesFlag)
+	bindPFlag(cmd, connectTimeoutFlag)
+	bindPFlag(cmd, tlsTimeoutFlag)
+	bindPFlag(cmd, responseTimeoutFlag)
+	bindPFlag(cmd, sshAgentFlag)
+	bindPFlag(cmd, agentKeyFlag)
+	bindPFlag(cmd, pkcs11ModuleFlag)
+	bindPFlag(cmd, pkcs11TokenFlag)
+	bindPFlag(cmd, pkcs11KeyFlag)
 }
 
 func setupDropCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "drop <file path>",
-		Short: "Drop a file to remote",
-		Args:  cobra.MinimumNArgs(1),
+		Use:   "drop <file path>...",
+		Short: "Drop files or directories to remote",
+		Long: "Drop files or directories to remote.\n\n" +
+			"If the file path is -, the object is read from stdin, e.g. 'pg_dump | dead drop -', and is streamed\n" +
+			"to remote as it is read. Directories are archived with tar (add --codec gzip to compress them),\n" +
+			"and extracted with their permissions and modification times when pulled.\n\n" +
+			"Several files are dropped concurrently, with one token, printing the reference of each as it is\n" +
+			"dropped and a summary at the end.",
+		Args: cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
+			bindDropFlags(cmd)
+			bindPFlag(cmd, nameFlag)
+			bindPFlag(cmd, workersFlag)
+			bindPFlag(cmd, releaseAtFlag)
+			bindPFlag(cmd, canaryFlag)
+
+			if _, err := releaseAt(); err != nil {
+				fmt.Printf("ERROR: %v\n", err)
+				os.Exit(1)
+			}
+
+			if len(args) > 1 {
+				if failed := dropFiles(args); failed > 0 {
+					os.Exit(1)
+				}
+				return
+			}
+
 			filePath := args[0]
+			or, err := drop(filePath)
+			if err != nil {
+				fmt.Printf("ERROR: Failed to drop file '%s': %v\n", filePath, err)
+				os.Exit(1)
+			}
+
+			ref, err := formatRef(or)
+			if err != nil {
+				fmt.Printf("ERROR: Dropped %s -> %s, but %v\n", filePath, or, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Dropped %s -> %s\n", filePath, ref)
+		},
+	}
+
+	setupDropFlags(cmd)
+	cmd.PersistentFlags().String(nameFlag, "",
+		"File name recorded for recipients (default is the base name of the file, or none when reading stdin)")
+	cmd.PersistentFlags().Int(workersFlag, 4, "Number of files to drop at once, when dropping several")
+	cmd.PersistentFlags().String(releaseAtFlag, "",
+		"RFC 3339 time before which remote refuses to let anyone pull the object, e.g. 2024-06-01T12:00:00Z")
+	cmd.PersistentFlags().Bool(canaryFlag, false,
+		"Drop a decoy object, any pull of which makes remote alert its operators, e.g. to detect a stolen key")
+
+	return cmd
+}
+
+// dropFiles drops several files concurrently, like a batch of drops, returning how many failed.
+func dropFiles(filePaths []string) int {
+	if viper.GetString(nameFlag) != "" {
+		fmt.Printf("ERROR: Flag '%s' can't be used when dropping several files\n", nameFlag)
+		return len(filePaths)
+	}
+	if viper.GetString(aliasFlag) != "" {
+		fmt.Printf("ERROR: Flag '%s' can't be used when dropping several files\n", aliasFlag)
+		return len(filePaths)
+	}
+
+	operations := make([]batchOperation, len(filePaths))
+	for i, filePath := range filePaths {
+		if filePath == stdinPath {
+			fmt.Printf("ERROR: Stdin can only be dropped on its own\n")
+			return len(filePaths)
+		}
+		operations[i].Drop = filePath
+	}
+
+	results, err := batch(operations)
+	if err != nil {
+		fmt.Printf("ERROR: Failed to drop files: %v\n", err)
+		return len(filePaths)
+	}
+	return printBatchSummary(results)
+}
+
+// setupDropFlags sets up the flags of commands which drop objects, which are bound by bindDropFlags.
+func setupDropFlags(cmd *cobra.Command) {
+	setupRemoteCmdFlags(cmd)
+	setupEncryptionFlags(cmd)
+	cmd.PersistentFlags().String(noteFlag, "", "Short note for recipients, encrypted along with the object")
+	cmd.PersistentFlags().StringSlice(codecFlag, nil,
+		"Codecs to apply to the object before encryption, in order (available: "+strings.Join(lib.CodecNames(), ", ")+")")
+	cmd.PersistentFlags().Bool(padFlag, false,
+		"Pad the object (after the codecs) so that its size reveals little about the size of the file")
+	cmd.PersistentFlags().String(cipherFlag, cipherCtrHmac,
+		"Cipher to encrypt the object with (available: "+
+			strings.Join(append([]string{cipherCtrHmac}, lib.CipherNames()...), ", ")+"); pull detects it")
+	cmd.PersistentFlags().StringSlice(recipientFlag, nil,
+		"Public key (RSA or X25519) to encrypt the object to, instead of the encryption key, keyring or passphrase;\n"+
+			"repeat it to let any of several recipients pull the object")
+	cmd.PersistentFlags().Bool(ageFlag, false,
+		"Encrypt the object as an age file to X25519 recipients or a passphrase, so it can be decrypted with age")
+	cmd.PersistentFlags().Bool(rawFlag, false,
+		"Drop a file which is already encrypted with age as it is, without any encryption keys")
+	cmd.PersistentFlags().Bool(linkFlag, false,
+		"Print a link naming the remote (e.g. dead://host:4444/<oid>#<checksum>), which pull accepts on its own")
+	cmd.PersistentFlags().Bool(phraseFlag, false,
+		"Print a phrase of words to read out (e.g. gecko-zebra-acid-yodel.lemon-tulip-ozone-vixen), which pull\n"+
+			"accepts; the remote must pick oids of words")
+	cmd.PersistentFlags().Duration(objectTtlFlag, 0,
+		"Time after which the remote deletes the object, e.g. 24h, if sooner than its own ttl (default is the remote's)")
+	cmd.PersistentFlags().Bool(burnFlag, false, "Have the remote destroy the object once it has been pulled")
+	cmd.PersistentFlags().Bool(anonymousFlag, false,
+		"Drop without an authentication key, to a remote which accepts anonymous drops, e.g. an inbox")
+	cmd.PersistentFlags().Int(maxPullsFlag, 0,
+		"Have the remote destroy the object once it has been pulled this many times (default is no limit)")
+	cmd.PersistentFlags().StringSlice(labelFlag, nil,
+		"Label to store with the object, e.g. env=prod, which ls can list objects by (repeatable);\n"+
+			"labels aren't encrypted, so they mustn't hold secrets")
+	cmd.PersistentFlags().String(aliasFlag, "",
+		"Alias to drop the object under as its next version; pull accepts the alias for the latest version, or\n"+
+			"<alias>@<version>; aliases aren't encrypted, so they mustn't hold secrets")
+	cmd.PersistentFlags().StringSlice(releaseToFlag, nil,
+		"Name of a key to release the object to if you don't check in for --checkin-interval (repeatable);\n"+
+			"until then, only your key can pull it")
+	cmd.PersistentFlags().Duration(checkinIntervalFlag, 0,
+		"Time after your last check-in, e.g. 168h, after which the object is released to the --release-to keys;\n"+
+			"it must be shorter than the object's ttl")
+	cmd.PersistentFlags().String(checksumFlag, sdk.ChecksumSHA256,
+		"Checksum algorithm of the object reference (available: "+strings.Join(lib.ChecksumNames(), ", ")+
+			"); references name it, unless it is "+sdk.ChecksumSHA256)
+
+	setupHistoryFlag(cmd)
+}
+
+func bindDropFlags(cmd *cobra.Command) {
+	bindRemoteCmdFlags(cmd)
+	bindEncryptionFlags(cmd)
+	bindPFlag(cmd, noteFlag)
+	bindPFlag(cmd, codecFlag)
+	bindPFlag(cmd, padFlag)
+	bindPFlag(cmd, cipherFlag)
+	bindPFlag(cmd, recipientFlag)
+	bindPFlag(cmd, ageFlag)
+	bindPFlag(cmd, rawFlag)
+	bindPFlag(cmd, linkFlag)
+	bindPFlag(cmd, phraseFlag)
+	bindPFlag(cmd, objectTtlFlag)
+	bindPFlag(cmd, burnFlag)
+	bindPFlag(cmd, anonymousFlag)
+	bindPFlag(cmd, maxPullsFlag)
+	bindPFlag(cmd, labelFlag)
+	bindPFlag(cmd, aliasFlag)
+	bindPFlag(cmd, releaseToFlag)
+	bindPFlag(cmd, checkinIntervalFlag)
+	bindPFlag(cmd, checksumFlag)
+	bindPFlag(cmd, historyFlag)
+}
+
+// formatRef formats the reference of a dropped object as it is printed: as a phrase or a link if the phrase or link
+// flag is set.
+func formatRef(or *sdk.ObjectReference) (string, error) {
+	if viper.GetBool(phraseFlag) {
+		phrase, err := or.Phrase()
+		if err != nil {
+			return "", fmt.Errorf("failed to make a phrase: %v", err)
+		}
+		return phrase, nil
+	}
+	if viper.GetBool(linkFlag) {
+		link, err := or.Link()
+		if err != nil {
+			return "", fmt.Errorf("failed to make a link: %v", err)
+		}
+		return link, nil
+	}
+	return or.String(), nil
+}
+
+func setupPullCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pull <object>... [destination path]",
+		Short: "Pull dropped objects from remote",
+		Long: "Pull dropped objects from remote.\n\n" +
+			"If the destination is a directory (or ends with a path separator), each object is saved inside it\n" +
+			"under its original file name, or its oid if no name was recorded when it was dropped. A single object\n" +
+			"pulled without a destination is saved in the current directory the same way.\n\n" +
+			"Files are given the permissions and modification time they had when dropped, if they were recorded.\n\n" +
+			"Objects dropped under an alias with --as are pulled by the alias for the latest version, e.g. release,\n" +
+			"or by the name of a version, e.g. release@2.",
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			objects := args
+			destPath := "." + string(os.PathSeparator)
+			if len(args) > 1 {
+				objects = args[:len(args)-1]
+				destPath = args[len(args)-1]
+			}
 
 			bindRemoteCmdFlags(cmd)
 			bindEncryptionFlags(cmd)
+			bindPullFlags(cmd)
+			bindPFlag(cmd, historyFlag)
+
+			if len(objects) > 1 {
+				isDir, err := isDirDestination(destPath)
+				if err != nil {
+					fmt.Printf("ERROR: Failed to check destination '%s': %v\n", destPath, err)
+					os.Exit(1)
+				}
+				if !isDir {
+					fmt.Printf("ERROR: Destination '%s' must be a directory when pulling multiple objects\n", destPath)
+					os.Exit(1)
+				}
+			}
 
-			or, err := drop(filePath)
+			// Keys are loaded once, so that a passphrase is only prompted for once.
+			keys, err := loadKeys(false)
 			if err != nil {
-				fmt.Printf("ERROR: Failed to drop file '%s': %v\n", filePath, err)
+				fmt.Printf("ERROR: Failed to load encryption keys: %v\n", err)
 				os.Exit(1)
 			}
+			defer keys.Destroy()
+
+			for _, object := range objects {
+				path, err := pull(object, destPath, keys)
+				if err != nil {
+					fmt.Printf("ERROR: Failed to pull object '%s': %v\n", object, err)
+					os.Exit(1)
+				}
 
-			fmt.Printf("Dropped %s -> %s\n", filePath, or)
+				fmt.Printf("Pulled %s <- %s\n", path, object)
+			}
 		},
 	}
 
 	setupRemoteCmdFlags(cmd)
 	setupEncryptionFlags(cmd)
+	setupPullFlags(cmd)
+	setupHistoryFlag(cmd)
 
 	return cmd
 }
 
-func setupPullCmd() *cobra.Command {
+// setupPullFlags sets up the flags of commands which pull objects to files, besides the remote and encryption flags.
+func setupPullFlags(cmd *cobra.Command) {
+	setupIdentityFlag(cmd)
+	cmd.PersistentFlags().Bool(suffixOnConflictFlag, false,
+		"Add a numeric suffix instead of failing when a file with the same name exists in the destination directory")
+	cmd.PersistentFlags().Bool(resumeFlag, true,
+		"Download objects to "+filepath.Join("$HOME", lib.DefaultConfigDir, partialDirName)+
+			" first, so that an interrupted pull resumes where it left off when run again")
+	cmd.PersistentFlags().Int(connectionsFlag, 4,
+		"Number of ranges to download large objects in at once, which speeds up pulls over high latency links")
+}
+
+func bindPullFlags(cmd *cobra.Command) {
+	bindPFlag(cmd, suffixOnConflictFlag)
+	bindPFlag(cmd, resumeFlag)
+	bindPFlag(cmd, identityFlag)
+	bindPFlag(cmd, connectionsFlag)
+}
+
+func setupCatCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "pull <object> <destination path>",
-		Short: "Pull a dropped object from remote",
-		Args:  cobra.MinimumNArgs(2),
+		Use:   "cat <oid>",
+		Short: "Pull a dropped object from remote, and write it to stdout",
+		Long: "Pull a dropped object from remote, and write it to stdout, e.g. 'dead cat <oid> | tar xz'.\n\n" +
+			"Everything else, including the object's note, is written to stderr. The object is streamed as it is\n" +
+			"verified, so if the pull fails the data already written must be discarded; the command then exits\n" +
+			"with status 1. Writing to a terminal is refused unless --force is given.",
+		Args: cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			object := args[0]
-			destPath := args[1]
 
 			bindRemoteCmdFlags(cmd)
 			bindEncryptionFlags(cmd)
+			bindPFlag(cmd, forceFlag)
+			bindPFlag(cmd, identityFlag)
+			bindPFlag(cmd, rawFlag)
 
-			if err := pull(object, destPath); err != nil {
-				fmt.Printf("ERROR: Failed to pull object '%s': %v\n", object, err)
+			if !viper.GetBool(forceFlag) && isTerminal(os.Stdout) {
+				fmt.Fprintf(os.Stderr, "ERROR: Refusing to write object to a terminal, pass --force to do so anyway\n")
 				os.Exit(1)
 			}
 
-			fmt.Printf("Pulled %s <- %s\n", destPath, object)
+			if err := cat(object); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: Failed to pull object '%s': %v\n", object, err)
+				os.Exit(1)
+			}
 		},
 	}
 
 	setupRemoteCmdFlags(cmd)
 	setupEncryptionFlags(cmd)
+	setupIdentityFlag(cmd)
+	cmd.PersistentFlags().Bool(forceFlag, false, "Write the object to stdout even if it is a terminal")
+	cmd.PersistentFlags().Bool(rawFlag, false,
+		"Write the object without decrypting it, e.g. 'dead cat --raw <oid> | age -d -i key.txt'")
 
 	return cmd
 }
@@ -171,6 +592,8 @@ func setupAddKeyCmd() *cobra.Command {
 			keyName := args[1]
 
 			bindRemoteCmdFlags(cmd)
+			bindPFlag(cmd, keyRoleFlag)
+			bindPFlag(cmd, keyNamespaceFlag)
 
 			if err := addKey(pubKeyPath, keyName); err != nil {
 				fmt.Printf("ERROR: Failed to add authorized key '%s': %v\n", pubKeyPath, err)
@@ -182,204 +605,1104 @@ func setupAddKeyCmd() *cobra.Command {
 	}
 
 	setupRemoteCmdFlags(cmd)
+	cmd.PersistentFlags().String(keyRoleFlag, "", "Role of the key: "+lib.KeyRoleReadOnly+", "+lib.KeyRoleWriteOnly+
+		" or "+lib.KeyRoleAdmin+", or empty for the remote's default role")
+	cmd.PersistentFlags().String(keyNamespaceFlag, "",
+		"Namespace to add the key to, or empty for the default namespace, or the namespace of the authenticating key")
 
 	return cmd
 }
 
-func setupKeyGenCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "gen-key <private key path> <public key path>",
-		Short: "Generates an RSA key-pair, for use authenticating requests",
-		Args:  cobra.MinimumNArgs(2),
+func setupRmKeyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rm-key <key name>",
+		Short: "Removes an authorized key from remote, revoking its tokens",
+		Long: "Removes an authorized key from remote, e.g. one which was compromised or whose owner left,\n" +
+			"so that it can't authenticate any more. Tokens already issued to it are revoked too.\n" +
+			"The last authorized key can't be removed.",
+		Args: cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			privPath := args[0]
-			pubPath := args[1]
+			keyName := args[0]
 
-			if err := keyGen(privPath, pubPath); err != nil {
-				fmt.Printf("ERROR: Failed to generate key-pair: %v\n", err)
+			bindRemoteCmdFlags(cmd)
+
+			if err := rmKey(keyName); err != nil {
+				fmt.Printf("ERROR: Failed to remove authorized key '%s': %v\n", keyName, err)
 				os.Exit(1)
 			}
+
+			fmt.Printf("Removed %s\n", keyName)
 		},
 	}
-}
 
-func checksum(data []byte) string {
-	checksumBytes := sha256.Sum256(data)
-	return base64.URLEncoding.EncodeToString(checksumBytes[:])
+	setupRemoteCmdFlags(cmd)
+
+	return cmd
 }
 
-func loadEncryptionKey(rawPath string) (*memguard.LockedBuffer, error) {
-	encryptionKeyPath, err := homedir.Expand(rawPath)
-	if err != nil {
-		return nil, fmt.Errorf("error locating encryption key: %v", err)
+func setupAccessLogCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "access-log <object>",
+		Short: "Shows when an object you dropped was pulled, and by which keys",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			object := args[0]
+
+			bindRemoteCmdFlags(cmd)
+
+			if err := accessLog(object); err != nil {
+				fmt.Printf("ERROR: Failed to fetch access log of '%s': %v\n", object, err)
+				os.Exit(1)
+			}
+		},
 	}
 
-	encryptionKeyReader, err := os.Open(encryptionKeyPath)
-	if err != nil {
-		return nil, fmt.Errorf("error reading encryption key '%s': %v", encryptionKeyPath, err)
+	setupRemoteCmdFlags(cmd)
+
+	return cmd
+}
+
+func setupLsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ls",
+		Short: "Lists the objects you dropped which are still on remote",
+		Long: "Lists the objects dropped with your key which are still on remote, oldest first,\n" +
+			"with their size in bytes and when they were dropped, e.g. 'dead ls --since 24h --min-size 1048576'.\n" +
+			"With --owner, lists the objects of another key instead, which takes an admin key.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			bindRemoteCmdFlags(cmd)
+
+			opts, err := listOptions(cmd)
+			if err != nil {
+				fmt.Printf("ERROR: %v\n", err)
+				os.Exit(1)
+			}
+
+			if opts.Owner != "" {
+				err = adminObjects(opts)
+			} else {
+				err = ls(opts)
+			}
+			if err != nil {
+				fmt.Printf("ERROR: Failed to list objects: %v\n", err)
+				os.Exit(1)
+			}
+		},
 	}
-	encryptionKey := memguard.NewBufferFromEntireReader(encryptionKeyReader)
 
-	return encryptionKey, nil
+	setupRemoteCmdFlags(cmd)
+	setupListFilterFlags(cmd)
+	cmd.Flags().String(ownerFlag, "", "List the objects of this key rather than your own, with an admin key")
+
+	return cmd
 }
 
-// TODO(shane) this function is quite long, try to split it up.
-func drop(filePath string) (*ObjectReference, error) {
-	remote, err := getStringFlag(remoteFlag)
-	if err != nil {
+// setupListFilterFlags adds the flags which filter listings of objects.
+func setupListFilterFlags(cmd *cobra.Command) {
+	cmd.Flags().String(sinceFlag, "",
+		"List objects dropped since this long ago, e.g. 24h, or since an RFC 3339 time, e.g. 2024-05-01T00:00:00Z")
+	cmd.Flags().String(untilFlag, "",
+		"List objects dropped before this long ago, e.g. 1h, or before an RFC 3339 time")
+	cmd.Flags().Int64(minSizeFlag, 0, "List objects of at least this many bytes")
+	cmd.Flags().Int64(maxSizeFlag, 0, "List objects of at most this many bytes (default is no limit)")
+	cmd.Flags().StringSlice(labelFlag, nil, "List objects dropped with this label, e.g. env=prod (repeatable)")
+}
+
+// listOptions returns the listing filter set by a command's flags.
+func listOptions(cmd *cobra.Command) (*sdk.ListOptions, error) {
+	opts := &sdk.ListOptions{}
+	var err error
+	if opts.Since, err = listTime(cmd, sinceFlag); err != nil {
 		return nil, err
 	}
-
-	encryptionKeyRawPath, err := getStringFlag(encryptionKeyFlag)
-	if err != nil {
+	if opts.Until, err = listTime(cmd, untilFlag); err != nil {
 		return nil, err
 	}
-
-	data, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("error reading file '%s': %v", filePath, err)
+	opts.MinSize, _ = cmd.Flags().GetInt64(minSizeFlag)
+	opts.MaxSize, _ = cmd.Flags().GetInt64(maxSizeFlag)
+	if opts.MinSize < 0 || opts.MaxSize < 0 {
+		return nil, fmt.Errorf("sizes can't be negative")
 	}
-
-	fmt.Printf("Encrypting object with AES-CTR + HMAC-SHA-265 ...\n")
-
-	encryptionKey, err := loadEncryptionKey(encryptionKeyRawPath)
-	if err != nil {
+	if flag := cmd.Flags().Lookup(ownerFlag); flag != nil {
+		opts.Owner = flag.Value.String()
+	}
+	entries, _ := cmd.Flags().GetStringSlice(labelFlag)
+	opts.Labels = labels(entries)
+	if err := lib.CheckLabels(opts.Labels); err != nil {
 		return nil, err
 	}
+	return opts, nil
+}
 
-	data, err = encrypt(encryptionKey, data)
-	if err != nil {
-		return nil, fmt.Errorf("error encrypting object: %v", err)
+// listTime parses a time flag given either as how long ago, e.g. 24h, or as an RFC 3339 time.
+func listTime(cmd *cobra.Command, flag string) (time.Time, error) {
+	value, _ := cmd.Flags().GetString(flag)
+	if value == "" {
+		return time.Time{}, nil
 	}
-
-	remoteUrl := fmt.Sprintf("%s/d", remote)
-
-	client := &http.Client{}
-
-	req, err := http.NewRequest("POST", remoteUrl, bytes.NewReader(data))
+	if ago, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-ago), nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
 	if err != nil {
-		return nil, fmt.Errorf("error building request: %v", err)
+		return time.Time{}, fmt.Errorf("invalid --%s '%s', which must be a duration like 24h or an RFC 3339 time",
+			flag, value)
 	}
+	return parsed, nil
+}
 
-	req.Header.Set("Content-Type", "application/octet-stream")
-
-	fmt.Printf("Uploading object ...\n")
+func setupQuotaCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "quota",
+		Short: "Shows how much of your storage quota on remote is used",
+		Long: "Shows how many bytes of objects dropped with your key are stored on remote, and your quota.\n" +
+			"Objects count against the quota until they are pulled, expire or are removed.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			bindRemoteCmdFlags(cmd)
 
-	resp, err := makeAuthenticatedRequest(client, req, remote)
-	if err != nil {
-		return nil, err
+			if err := quota(); err != nil {
+				fmt.Printf("ERROR: Failed to fetch quota: %v\n", err)
+				os.Exit(1)
+			}
+		},
 	}
 
-	oid, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %v", err)
-	}
+	setupRemoteCmdFlags(cmd)
 
-	or := &ObjectReference{
-		oid:      string(oid),
-		checksum: checksum(data),
-	}
-	return or, nil
+	return cmd
 }
 
-// TODO(shane) this function is quite long, try to split it up.
-func pull(object string, destPath string) error {
-	or, err := parseObjectReference(object)
-	if err != nil {
-		return err
-	}
+func setupRmCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rm <object>...",
+		Short: "Removes objects you dropped from remote",
+		Long: "Removes objects dropped with your key from remote, given their full reference or just their oid.\n" +
+			"Objects dropped with other keys can't be removed, and are reported as not found.",
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			bindRemoteCmdFlags(cmd)
 
-	remote, err := getStringFlag(remoteFlag)
-	if err != nil {
-		return err
-	}
+			for _, object := range args {
+				if err := rm(object); err != nil {
+					fmt.Printf("ERROR: Failed to remove object '%s': %v\n", object, err)
+					os.Exit(1)
+				}
 
-	encryptionKeyRawPath, err := getStringFlag(encryptionKeyFlag)
-	if err != nil {
-		return err
+				fmt.Printf("Removed %s\n", object)
+			}
+		},
 	}
 
-	remoteUrl := fmt.Sprintf("%s/d/%s", remote, or.oid)
+	setupRemoteCmdFlags(cmd)
 
-	client := &http.Client{}
+	return cmd
+}
 
-	req, err := http.NewRequest("GET", remoteUrl, nil)
-	if err != nil {
-		return fmt.Errorf("error building request: %v", err)
-	}
+func setupShareCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "share <object>",
+		Short: "Prints a url which fetches an object you dropped without dead-drop, e.g. with curl or a browser",
+		Long: "Has the remote create a url which fetches an object dropped with your key without authenticating, given\n" +
+			"its full reference or just its oid, and prints it. The url expires after --expires (at most when the\n" +
+			"object does), and after --max-uses requests if set; fetching it counts as a pull. It only fetches the\n" +
+			"encrypted object, so the recipient still needs its reference to decrypt it.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			object := args[0]
 
-	fmt.Printf("Downloading object ...\n")
+			bindRemoteCmdFlags(cmd)
+			bindPFlag(cmd, shareExpiresFlag)
+			bindPFlag(cmd, shareMaxUsesFlag)
 
-	resp, err := makeAuthenticatedRequest(client, req, remote)
-	if err != nil {
-		return err
+			if err := share(object); err != nil {
+				fmt.Printf("ERROR: Failed to share object '%s': %v\n", object, err)
+				os.Exit(1)
+			}
+		},
 	}
 
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("error reading response body: %v", err)
-	}
+	setupRemoteCmdFlags(cmd)
+	cmd.PersistentFlags().Duration(shareExpiresFlag, time.Hour, "Time after which the url stops working, e.g. 24h")
+	cmd.PersistentFlags().Int(shareMaxUsesFlag, 0, "Number of times the url can be fetched (default is no limit)")
 
-	fmt.Printf("Verifying checksum ...\n")
-	if checksum(data) != or.checksum {
-		return fmt.Errorf("object integrity compromised, discarding unsafe pull")
-	}
+	return cmd
+}
 
-	fmt.Printf("Decrypting object with AES-CTR + HMAC-SHA-265 ...\n")
+func setupStatCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stat <object>",
+		Short: "Shows the size, age and remaining ttl of an object on remote, without pulling it",
+		Long: "Shows the size, creation time and remaining ttl of an object on remote, without pulling it,\n" +
+			"given its full reference or just its oid. The number of pulls is only shown for objects you dropped.\n" +
+			"The object's note isn't shown, since it is encrypted along with the start of the object's data, which\n" +
+			"the remote only serves to pulls. Exits with status 1 if the object does not exist.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			object := args[0]
 
-	encryptionKey, err := loadEncryptionKey(encryptionKeyRawPath)
-	if err != nil {
-		return err
-	}
+			bindRemoteCmdFlags(cmd)
 
-	dataBuf, err := decrypt(encryptionKey, data)
-	if err != nil {
-		return fmt.Errorf("error decrypting object: %v", err)
+			if err := stat(object); err != nil {
+				fmt.Printf("ERROR: Failed to stat object '%s': %v\n", object, err)
+				os.Exit(1)
+			}
+		},
 	}
-	defer dataBuf.Destroy()
-	data = dataBuf.Bytes()
 
-	if err = ioutil.WriteFile(destPath, data, lib.ObjectPerms); err != nil {
-		return fmt.Errorf("error writing object to '%s': %v", destPath, err)
-	}
+	setupRemoteCmdFlags(cmd)
 
-	return nil
+	return cmd
 }
 
-func addKey(pubKeyPath string, keyName string) error {
-	remote, err := getStringFlag(remoteFlag)
-	if err != nil {
-		return err
+func setupVerifyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify <object>...",
+		Short: "Checks that remote objects match their references, without pulling them",
+		Long: "Checks that remote objects match their references, without pulling them.\n\n" +
+			"The remote computes the checksum of each object, which is compared with the checksum of its reference,\n" +
+			"so the object isn't downloaded, and the check doesn't count as a pull. Objects aren't decrypted, so this\n" +
+			"doesn't check the keys they were encrypted with. Exits with status 1 if any object doesn't match.",
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			bindRemoteCmdFlags(cmd)
+
+			failed := false
+			for _, object := range args {
+				if err := verify(object); err != nil {
+					fmt.Printf("ERROR: Failed to verify object '%s': %v\n", object, err)
+					failed = true
+				}
+			}
+			if failed {
+				os.Exit(1)
+			}
+		},
 	}
 
-	remoteUrl := fmt.Sprintf("%s/add-key", remote)
+	setupRemoteCmdFlags(cmd)
 
-	client := &http.Client{}
+	return cmd
+}
 
-	pubKeyBytes, err := ioutil.ReadFile(pubKeyPath)
-	if err != nil {
-		return fmt.Errorf("error reading public key '%s': %v", pubKeyPath, err)
-	}
+func setupKeyGenCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "gen-key <private key path> <public key path>",
+		Short: "Generates an RSA key-pair, for use authenticating requests",
+		Long: "Generates an RSA key-pair, for use authenticating requests, and as a recipient key.\n\n" +
+			"With --type ed25519, generates an Ed25519 key-pair instead, which is much faster to generate and\n" +
+			"authenticate with, but can't be used as a recipient key or to share keyring keys.\n" +
+			"With --type x25519, generates an X25519 key-pair instead, which can only be used as a recipient key.\n" +
+			"With --type age, generates an X25519 key-pair in the age format, for use with the age tool too.",
+		Args: cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			privPath := args[0]
+			pubPath := args[1]
 
-	payload := lib.AddKeyPayload{
-		Key:     pubKeyBytes,
-		KeyName: keyName,
+			bindPFlag(cmd, keyTypeFlag)
+
+			var err error
+			switch keyType := viper.GetString(keyTypeFlag); keyType {
+			case keyTypeRSA:
+				err = keyGen(privPath, pubPath)
+			case keyTypeEd25519:
+				err = ed25519KeyGen(privPath, pubPath)
+			case keyTypeX25519:
+				err = x25519KeyGen(privPath, pubPath)
+			case keyTypeAge:
+				err = ageKeyGen(privPath, pubPath)
+			default:
+				err = fmt.Errorf("unsupported key type '%s'", keyType)
+			}
+			if err != nil {
+				fmt.Printf("ERROR: Failed to generate key-pair: %v\n", err)
+				os.Exit(1)
+			}
+		},
 	}
 
-	body := new(bytes.Buffer)
-	if err := json.NewEncoder(body).Encode(payload); err != nil {
-		return err
-	}
+	cmd.PersistentFlags().String(keyTypeFlag, keyTypeRSA, "Key type, either rsa, ed25519, x25519 or age")
 
-	req, err := http.NewRequest("POST", remoteUrl, body)
-	if err != nil {
-		return fmt.Errorf("error building request: %v", err)
-	}
+	return cmd
+}
 
-	_, err = makeAuthenticatedRequest(client, req, remote)
+func setupSelfTestCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "selftest",
+		Short: "Checks encryption, decryption and checksums against known-answer test vectors",
+		Long: "Checks encryption, decryption, checksums and reference parsing against known-answer test vectors,\n" +
+			"to confirm this build works on this platform before trusting it with real material.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			failed := 0
+			for _, result := range sdk.SelfTest() {
+				if result.Err != nil {
+					failed++
+					fmt.Printf("FAIL %s: %v\n", result.Name, result.Err)
+				} else {
+					fmt.Printf("ok   %s\n", result.Name)
+				}
+			}
+
+			if failed > 0 {
+				fmt.Printf("ERROR: %d self test checks failed, do not use this build\n", failed)
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+func loadEncryptionKey(rawPath string) (*memguard.LockedBuffer, error) {
+	if strings.HasPrefix(rawPath, keychainPrefix) {
+		return loadKeychainKey(strings.TrimPrefix(rawPath, keychainPrefix))
+	}
+	if strings.HasPrefix(rawPath, kmsPrefix) {
+		return loadKMSKey(strings.TrimPrefix(rawPath, kmsPrefix))
+	}
+
+	encryptionKeyPath, err := homedir.Expand(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("error locating encryption key: %v", err)
+	}
+
+	encryptionKeyReader, err := os.Open(encryptionKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading encryption key '%s': %v", encryptionKeyPath, err)
+	}
+	defer encryptionKeyReader.Close()
+	encryptionKey := memguard.NewBufferFromEntireReader(encryptionKeyReader)
+
+	return encryptionKey, nil
+}
+
+// encryptionKeys are the sdk keys loaded from the encryption flags, which must be destroyed once used.
+type encryptionKeys interface {
+	sdk.Keys
+	Destroy()
+}
+
+// loadKeys loads the encryption keys specified by flags. If a passphrase is used, it is prompted for, twice if
+// dropping, since a mistyped passphrase on drop would make the object unrecoverable. Drops need a key, but pulls can
+// do without one, since objects encrypted to recipients are unwrapped with the authentication key or identity.
+func loadKeys(dropping bool) (encryptionKeys, error) {
+	if recipientPaths := viper.GetStringSlice(recipientFlag); dropping && len(recipientPaths) > 0 {
+		if viper.GetBool(passphraseFlag) {
+			return nil, fmt.Errorf("flag '%s' can't be combined with '%s'", recipientFlag, passphraseFlag)
+		}
+
+		recipients := make([]lib.Recipient, 0, len(recipientPaths))
+		for _, rawPath := range recipientPaths {
+			recipient, err := loadRecipient(rawPath)
+			if err != nil {
+				return nil, err
+			}
+			recipients = append(recipients, recipient)
+		}
+		return sdk.NewRecipientKeys(recipients...), nil
+	}
+
+	if viper.GetBool(passphraseFlag) {
+		if viper.GetString(encryptionKeyFlag) != "" || viper.GetString(keyringFlag) != "" {
+			return nil, fmt.Errorf("flag '%s' can't be combined with '%s' or '%s'",
+				passphraseFlag, encryptionKeyFlag, keyringFlag)
+		}
+
+		passphrase, err := promptPassphrase(dropping)
+		if err != nil {
+			return nil, err
+		}
+		return sdk.NewPassphraseKeys(passphrase), nil
+	}
+
+	keys := &sdk.KeySet{}
+
+	if rawPath := viper.GetString(encryptionKeyFlag); rawPath != "" {
+		encryptionKey, err := loadEncryptionKey(rawPath)
+		if err != nil {
+			return nil, err
+		}
+		keys.Key = encryptionKey
+	}
+
+	if rawPath := viper.GetString(keyringFlag); rawPath != "" {
+		keyringPath, err := homedir.Expand(rawPath)
+		if err != nil {
+			keys.Destroy()
+			return nil, fmt.Errorf("error locating keyring: %v", err)
+		}
+
+		keyring, err := sdk.LoadKeyring(keyringPath)
+		if err != nil {
+			keys.Destroy()
+			return nil, err
+		}
+		keys.Keyring = keyring
+	}
+
+	if rawPath := viper.GetString(identityFlag); rawPath != "" && !dropping {
+		identities, err := loadIdentity(rawPath)
+		if err != nil {
+			keys.Destroy()
+			return nil, err
+		}
+		keys.Identities = append(keys.Identities, identities...)
+	}
+
+	if dropping && keys.Key == nil && keys.Keyring == nil {
+		return nil, fmt.Errorf("flag '%s', '%s', '%s' or '%s' must be specified",
+			encryptionKeyFlag, keyringFlag, passphraseFlag, recipientFlag)
+	}
+
+	return keys, nil
+}
+
+// newClient builds an sdk client for the remote and authentication key specified by flags.
+func newClient(opts ...sdk.Option) (*sdk.Client, error) {
+	remote, err := getStringFlag(remoteFlag)
+	if err != nil {
+		return nil, err
+	}
+	return newRemoteClient(remote, opts...)
+}
+
+// newObjectClient creates a client for the remote holding an object: the remote named by its link, if it was given as
+// one, or else the configured remote.
+func newObjectClient(or *sdk.ObjectReference, opts ...sdk.Option) (*sdk.Client, error) {
+	if or.Remote == "" {
+		return newClient(opts...)
+	}
+	return newRemoteClient(or.Remote, opts...)
+}
+
+func newRemoteClient(remote string, opts ...sdk.Option) (*sdk.Client, error) {
+	httpClient, err := newHTTPClient(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	authKey, err := loadConfiguredAuthKey()
+	if err != nil {
+		return nil, err
+	}
+
+	retryPolicy := sdk.DefaultRetryPolicy
+	retryPolicy.MaxAttempts = viper.GetInt(retriesFlag) + 1
+
+	opts = append([]sdk.Option{
+		authKey,
+		sdk.WithHTTPClient(httpClient),
+		sdk.WithRetryPolicy(retryPolicy),
+		sdk.WithParallelDownloads(viper.GetInt(connectionsFlag)),
+		sdk.WithProgress(progressPrinter(os.Stdout)),
+		sdk.WithNamespace(viper.GetString(namespaceFlag)),
+	}, opts...)
+	return sdk.New(remote, opts...), nil
+}
+
+// loadConfiguredAuthKey loads the authentication key specified by flags, which anonymous drops go without.
+func loadConfiguredAuthKey() (sdk.Option, error) {
+	if viper.GetBool(anonymousFlag) {
+		return func(*sdk.Client) {}, nil
+	}
+
+	keyName, err := getStringFlag(keyNameFlag)
+	if err != nil {
+		return nil, err
+	}
+	if !keyNameRegex.MatchString(keyName) {
+		return nil, fmt.Errorf("invalid key name")
+	}
+
+	var authKey sdk.Option
+	if viper.GetBool(sshAgentFlag) {
+		authKey, err = loadAgentAuthKey(keyName)
+	} else if modulePath := viper.GetString(pkcs11ModuleFlag); modulePath != "" {
+		authKey, err = loadPKCS11AuthKey(keyName, modulePath)
+	} else {
+		var rawPrivKeyPath string
+		if rawPrivKeyPath, err = getStringFlag(privKeyFlag); err != nil {
+			return nil, err
+		}
+		authKey, err = loadAuthKey(keyName, rawPrivKeyPath)
+	}
+	return authKey, err
+}
+
+var stageMessages = map[sdk.Stage]string{
+	sdk.StageDerivingKey: "Deriving key from passphrase",
+	sdk.StageEncoding:    "Encoding object",
+	sdk.StageEncrypting:  "Encrypting object",
+	sdk.StageUploading:   "Uploading object",
+	sdk.StageDownloading: "Downloading object",
+	sdk.StageVerifying:   "Verifying checksum",
+	sdk.StageDecrypting:  "Decrypting object",
+	sdk.StageDecoding:    "Decoding object",
+}
+
+// printProgress prints a line as each stage of a drop or pull starts.
+// progressPrinter returns a progress callback which prints the start of each stage to w.
+func progressPrinter(w io.Writer) func(sdk.ProgressEvent) {
+	return func(event sdk.ProgressEvent) {
+		if event.Bytes != 0 {
+			return
+		}
+		if message, ok := stageMessages[event.Stage]; ok {
+			fmt.Fprintf(w, "%s ...\n", message)
+		}
+	}
+}
+
+func drop(filePath string) (*sdk.ObjectReference, error) {
+	opts := dropOptions()
+
+	client, keys, err := newDropClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil {
+		defer keys.Destroy()
+	}
+
+	// Stdin usually can't be rewound, so the sdk only retries the parts of the upload it still holds.
+	if filePath == stdinPath {
+		or, err := client.DropStream(context.Background(), os.Stdin, opts)
+		if err == nil {
+			recordHistory(historyDrop, or, filePath)
+		}
+		return or, err
+	}
+
+	return dropPath(context.Background(), client, filePath, *opts)
+}
+
+// dropOptions returns the drop options set by the drop flags.
+func dropOptions() *sdk.DropOptions {
+	opts := &sdk.DropOptions{
+		Name:     viper.GetString(nameFlag),
+		Note:     viper.GetString(noteFlag),
+		Codecs:   viper.GetStringSlice(codecFlag),
+		Pad:      viper.GetBool(padFlag),
+		Age:      viper.GetBool(ageFlag),
+		Raw:      viper.GetBool(rawFlag),
+		TTL:      viper.GetDuration(objectTtlFlag),
+		Burn:     viper.GetBool(burnFlag),
+		MaxPulls: viper.GetInt(maxPullsFlag),
+		Checksum: viper.GetString(checksumFlag),
+		Labels:   labels(viper.GetStringSlice(labelFlag)),
+		Alias:    viper.GetString(aliasFlag),
+
+		ReleaseTo:       viper.GetStringSlice(releaseToFlag),
+		CheckinInterval: viper.GetDuration(checkinIntervalFlag),
+
+		Anonymous: viper.GetBool(anonymousFlag),
+		Canary:    viper.GetBool(canaryFlag),
+	}
+	opts.ReleaseAt, _ = releaseAt()
+	if cipher := viper.GetString(cipherFlag); cipher != cipherCtrHmac {
+		opts.Cipher = cipher
+	}
+	return opts
+}
+
+// releaseAt parses the release time of a drop, or returns the zero time if it has none.
+func releaseAt() (time.Time, error) {
+	value := viper.GetString(releaseAtFlag)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --%s '%s', which must be an RFC 3339 time", releaseAtFlag, value)
+	}
+	return parsed, nil
+}
+
+// labels returns the labels of label flags, or nil if there are none.
+func labels(entries []string) map[string]string {
+	if len(entries) == 0 {
+		return nil
+	}
+	return lib.SplitLabels(entries)
+}
+
+// newDropClient creates a client to drop objects with, and the keys it encrypts them with, which must be destroyed.
+// Raw objects are already encrypted, so they don't need keys, and none are returned.
+func newDropClient(opts *sdk.DropOptions) (*sdk.Client, encryptionKeys, error) {
+	if opts.Raw {
+		client, err := newClient()
+		return client, nil, err
+	}
+
+	keys, err := loadKeys(true)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := newClient(sdk.WithKeys(keys))
+	if err != nil {
+		keys.Destroy()
+		return nil, nil, err
+	}
+	return client, keys, nil
+}
+
+// dropPath drops a file, or a directory as a tar archive, and records it in the history.
+func dropPath(
+	ctx context.Context,
+	client *sdk.Client,
+	filePath string,
+	opts sdk.DropOptions,
+) (*sdk.ObjectReference, error) {
+	or, err := dropPathStream(ctx, client, filePath, opts)
+	if err == nil {
+		recordHistory(historyDrop, or, filePath)
+	}
+	return or, err
+}
+
+func dropPathStream(
+	ctx context.Context,
+	client *sdk.Client,
+	filePath string,
+	opts sdk.DropOptions,
+) (*sdk.ObjectReference, error) {
+	if opts.Name == "" {
+		opts.Name = filepath.Base(filepath.Clean(filePath))
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file '%s': %v", filePath, err)
+	}
+	opts.Mode = info.Mode().Perm()
+	opts.Modified = info.ModTime()
+	if info.IsDir() {
+		// Directories are archived as they are uploaded, and extracted again when pulled.
+		opts.Format = lib.FormatTar
+		archive := tarDirectory(filePath)
+		defer archive.Close()
+		return client.DropStream(ctx, archive, &opts)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file '%s': %v", filePath, err)
+	}
+	defer file.Close()
+
+	if opts.MimeType == "" {
+		opts.MimeType = mime.TypeByExtension(filepath.Ext(opts.Name))
+	}
+	return client.DropStream(ctx, file, &opts)
+}
+
+func pull(object string, destPath string, keys encryptionKeys) (string, error) {
+	if isVersionName(object) {
+		return pullVersion(object, destPath, keys)
+	}
+
+	or, err := sdk.ParseObjectReference(object)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := newObjectClient(or, sdk.WithKeys(keys))
+	if err != nil {
+		return "", err
+	}
+	// Phrases are resolved first, so that the pull is checked against the whole checksum, which the history records.
+	if or, err = client.Resolve(context.Background(), or); err != nil {
+		return "", err
+	}
+
+	return pullObject(context.Background(), client, or, destPath)
+}
+
+// isVersionName returns whether an object is given by the name of an alias, e.g. release, or of a version of one, e.g.
+// release@2, rather than by a reference.
+func isVersionName(object string) bool {
+	if strings.Contains(object, "#") || sdk.IsPhrase(object) {
+		return false
+	}
+	if _, _, err := lib.ParseVersionName(object); err != nil {
+		return false
+	}
+	// Names can't be told from phrases of dashed words other than by whether they parse as one.
+	_, err := sdk.ParseObjectReference(object)
+	return err != nil
+}
+
+// pullVersion pulls a version of an alias given by its name, or its latest version, which the remote resolves.
+func pullVersion(name string, destPath string, keys encryptionKeys) (string, error) {
+	client, err := newClient(sdk.WithKeys(keys))
+	if err != nil {
+		return "", err
+	}
+	or, err := client.ResolveVersion(context.Background(), name)
+	if err != nil {
+		return "", err
+	}
+
+	return pullObject(context.Background(), client, or, destPath)
+}
+
+// pullObject pulls an object with a client holding the keys to decrypt it, and saves it to the destination path.
+func pullObject(ctx context.Context, client *sdk.Client, or *sdk.ObjectReference, destPath string) (string, error) {
+	var reader io.ReadCloser
+	var meta *sdk.ObjectMetadata
+	var err error
+	if viper.GetBool(resumeFlag) {
+		var home string
+		if home, err = homedir.Dir(); err != nil {
+			return "", err
+		}
+		partialDir := filepath.Join(home, lib.DefaultConfigDir, partialDirName)
+		reader, meta, err = client.PullResumable(ctx, or, partialDir)
+	} else {
+		reader, meta, err = client.PullStream(ctx, or)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	// Notices go to stderr, as with cat, so that they don't mix with output of a pull to stdout.
+	if meta.Note != "" {
+		fmt.Fprintf(os.Stderr, "Note: %s\n", meta.PrintableNote())
+	}
+	if meta.Burned {
+		fmt.Fprintf(os.Stderr, "The remote destroys the object after this pull\n")
+	}
+
+	var path string
+	switch meta.Format {
+	case "":
+		path, err = writeObject(destPath, meta, or.Oid, reader, viper.GetBool(suffixOnConflictFlag))
+	case lib.FormatTar:
+		path, err = writeTree(destPath, meta, or.Oid, reader, viper.GetBool(suffixOnConflictFlag))
+	default:
+		return "", fmt.Errorf("object has unsupported format '%s', try a newer client", meta.Format)
+	}
+	if err == nil {
+		recordHistory(historyPull, or, path)
+	}
+	return path, err
+}
+
+// cat streams the data of an object to stdout.
+func cat(object string) error {
+	or, err := sdk.ParseObjectReference(object)
+	if err != nil {
+		return err
+	}
+
+	if viper.GetBool(rawFlag) {
+		return catRaw(or)
+	}
+
+	keys, err := loadKeys(false)
+	if err != nil {
+		return err
+	}
+	defer keys.Destroy()
+
+	client, err := newObjectClient(or, sdk.WithKeys(keys), sdk.WithProgress(progressPrinter(os.Stderr)))
+	if err != nil {
+		return err
+	}
+
+	reader, meta, err := client.PullStream(context.Background(), or)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if meta.Note != "" {
+		fmt.Fprintf(os.Stderr, "Note: %s\n", meta.PrintableNote())
+	}
+	if meta.Burned {
+		fmt.Fprintf(os.Stderr, "The remote destroys the object after this pull\n")
+	}
+
+	_, err = io.Copy(os.Stdout, reader)
 	return err
 }
 
+// catRaw streams an object to stdout as it is stored, without decrypting it.
+func catRaw(or *sdk.ObjectReference) error {
+	client, err := newObjectClient(or, sdk.WithProgress(progressPrinter(os.Stderr)))
+	if err != nil {
+		return err
+	}
+
+	reader, err := client.PullRaw(context.Background(), or)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(os.Stdout, reader)
+	return err
+}
+
+// isTerminal reports whether a file is a terminal (or another character device, which objects are as unlikely to be
+// meant for).
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func addKey(pubKeyPath string, keyName string) error {
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	pubKeyBytes, err := ioutil.ReadFile(pubKeyPath)
+	if err != nil {
+		return fmt.Errorf("error reading public key '%s': %v", pubKeyPath, err)
+	}
+	if _, err := lib.ParseAuthorizedKey(pubKeyBytes); err != nil {
+		return fmt.Errorf("failed to parse public key '%s': %v", pubKeyPath, err)
+	}
+
+	return client.AddKeyWithOptions(context.Background(), pubKeyBytes, keyName, &sdk.AddKeyOptions{
+		Role:      viper.GetString(keyRoleFlag),
+		Namespace: viper.GetString(keyNamespaceFlag),
+	})
+}
+
+func rmKey(keyName string) error {
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	return client.RemoveKey(context.Background(), keyName)
+}
+
+// ls prints the objects dropped with the configured key which opts select, fetching every page of the listing.
+func ls(opts *sdk.ListOptions) error {
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	after := ""
+	for {
+		page, err := client.ListWithOptions(context.Background(), after, 0, opts)
+		if err != nil {
+			return err
+		}
+
+		for _, object := range page.Objects {
+			fmt.Printf("%s  %12d  %s%s\n", object.Oid, object.Size, object.Created.Format(time.RFC3339),
+				formatLabels(object.Labels))
+		}
+		count += len(page.Objects)
+
+		if page.Next == "" {
+			break
+		}
+		after = page.Next
+	}
+
+	if count == 0 {
+		fmt.Printf("No objects\n")
+	}
+	return nil
+}
+
+// quota prints the storage used by the client's key on the remote, and its quota.
+func quota() error {
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	usage, err := client.Quota(context.Background())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Key:    %s\n", usage.KeyName)
+	printQuotaUsage(usage.Used, usage.Quota)
+	if usage.Namespace != "" {
+		fmt.Printf("Namespace: %s\n", usage.Namespace)
+		printQuotaUsage(usage.NamespaceUsed, usage.NamespaceQuota)
+	}
+	return nil
+}
+
+func printQuotaUsage(used int64, quota int64) {
+	fmt.Printf("Used:   %d bytes\n", used)
+	if quota > 0 {
+		fmt.Printf("Quota:  %d bytes (%.1f%% used)\n", quota, float64(used)*100/float64(quota))
+	} else {
+		fmt.Printf("Quota:  unlimited\n")
+	}
+}
+
+// formatLabels formats the labels of an object as they are printed after it in listings, e.g. "  env=prod team=ci",
+// ordered by key.
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	formatted := ""
+	for _, key := range keys {
+		formatted += " " + key + "=" + labels[key]
+	}
+	if formatted != "" {
+		formatted = " " + formatted
+	}
+	return formatted
+}
+
+// objectRef parses an object given either as its full reference, its link, a phrase, or just its oid, in which case
+// the reference has no checksum.
+func objectRef(object string) (*sdk.ObjectReference, error) {
+	if !strings.Contains(object, "#") && !sdk.IsPhrase(object) {
+		return &sdk.ObjectReference{Oid: object}, nil
+	}
+	return sdk.ParseObjectReference(object)
+}
+
+// stat prints what the remote knows about an object, given either its full reference or just its oid.
+func stat(object string) error {
+	or, err := objectRef(object)
+	if err != nil {
+		return err
+	}
+
+	client, err := newObjectClient(or)
+	if err != nil {
+		return err
+	}
+
+	info, err := client.Stat(context.Background(), or.Oid)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Oid:       %s\n", info.Oid)
+	fmt.Printf("Size:      %d\n", info.Size)
+	fmt.Printf("Created:   %s\n", info.Created.Format(time.RFC3339))
+	fmt.Printf("Expires:   %s (in %s)\n", info.Expires.Format(time.RFC3339), info.Remaining.Round(time.Second))
+	if info.Pulls != nil {
+		fmt.Printf("Pulls:     %d\n", *info.Pulls)
+	}
+	if info.PullsLeft != nil {
+		fmt.Printf("Quota:     %d pulls left\n", *info.PullsLeft)
+	}
+	if info.Burn {
+		fmt.Printf("Burn:      destroyed by its next pull\n")
+	}
+	if info.ReleaseAt != nil {
+		fmt.Printf("Released:  %s\n", info.ReleaseAt.Format(time.RFC3339))
+	}
+	if len(info.Labels) > 0 {
+		fmt.Printf("Labels:    %s\n", strings.TrimSpace(formatLabels(info.Labels)))
+	}
+	return nil
+}
+
+// verify has the remote check that an object matches its reference.
+func verify(object string) error {
+	or, err := sdk.ParseObjectReference(object)
+	if err != nil {
+		return err
+	}
+
+	client, err := newObjectClient(or)
+	if err != nil {
+		return err
+	}
+
+	info, err := client.Verify(context.Background(), or)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Verified %s: %d bytes, %s checksum matches\n", or.Oid, info.Size, info.Algorithm)
+	return nil
+}
+
+// rm removes an object dropped with the configured key, given either its full reference or just its oid.
+func rm(object string) error {
+	or, err := objectRef(object)
+	if err != nil {
+		return err
+	}
+
+	client, err := newObjectClient(or)
+	if err != nil {
+		return err
+	}
+
+	return client.Remove(context.Background(), or.Oid)
+}
+
+// share prints a url which fetches an object without authenticating, given either its full reference or just its oid.
+func share(object string) error {
+	or, err := objectRef(object)
+	if err != nil {
+		return err
+	}
+
+	client, err := newObjectClient(or)
+	if err != nil {
+		return err
+	}
+
+	shared, err := client.Share(context.Background(), or.Oid, viper.GetDuration(shareExpiresFlag),
+		viper.GetInt(shareMaxUsesFlag))
+	if err != nil {
+		return err
+	}
+	fmt.Println(client.ShareURL(shared))
+	fmt.Fprintf(os.Stderr, "Expires %s\n", shared.Expires.Format(time.RFC3339))
+	return nil
+}
+
+// accessLog prints the pulls of an object, given either its full reference or just its oid.
+func accessLog(object string) error {
+	or, err := objectRef(object)
+	if err != nil {
+		return err
+	}
+
+	client, err := newObjectClient(or)
+	if err != nil {
+		return err
+	}
+
+	log, err := client.AccessLog(context.Background(), or.Oid)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Dropped %s by %s\n", log.Dropped.Format(time.RFC3339), log.Owner)
+	for _, pull := range log.Pulls {
+		line := fmt.Sprintf("Pulled  %s", pull.Time.Format(time.RFC3339))
+		if pull.KeyName != "" {
+			line += " by " + pull.KeyName
+		}
+		if pull.Offset > 0 {
+			line += fmt.Sprintf(" (resumed from byte %d)", pull.Offset)
+		}
+		fmt.Println(line)
+	}
+	if len(log.Pulls) == 0 {
+		fmt.Printf("Not pulled yet\n")
+	}
+
+	return nil
+}
+
 func keyGen(privPath string, pubPath string) error {
 	privKey, err := rsa.GenerateKey(rand.Reader, 4096)
 	if err != nil {
@@ -411,102 +1734,144 @@ func keyGen(privPath string, pubPath string) error {
 	return nil
 }
 
-func makeAuthenticatedRequest(client *http.Client, req *http.Request, remote string) (*http.Response, error) {
-	resp, err := makeAuthenticatedRequestInternal(client, req, remote)
+// loadAuthKey loads the private key to authenticate with, either an RSA or an Ed25519 key, as written by gen-key or
+// OpenSSH (e.g. ~/.ssh/id_ed25519). The key is held in memguard LockedBuffers, like the encryption key.
+func loadAuthKey(keyName string, rawPath string) (sdk.Option, error) {
+	privKeyPath, err := homedir.Expand(rawPath)
 	if err != nil {
-		return resp, fmt.Errorf("request failed: %v", err)
-	}
-	if resp.StatusCode != 200 {
-		return resp, fmt.Errorf("request failed with status: %s", resp.Status)
+		return nil, fmt.Errorf("error locating private key: %v\n", err)
 	}
 
-	return resp, nil
-}
-
-func makeAuthenticatedRequestInternal(client *http.Client, req *http.Request, remote string) (*http.Response, error) {
-	keyName, err := getStringFlag(keyNameFlag)
+	privKeyReader, err := os.Open(privKeyPath)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error reading private key '%s': %v", privKeyPath, err)
 	}
+	defer privKeyReader.Close()
+	privKeyBytes := memguard.NewBufferFromEntireReader(privKeyReader)
+	defer privKeyBytes.Destroy()
 
-	if !keyNameRegex.Match([]byte(keyName)) {
-		return nil, fmt.Errorf("invalid key name")
+	privKeyDer, _ := pem.Decode(privKeyBytes.Bytes())
+	if privKeyDer == nil {
+		return nil, fmt.Errorf("failed to decode pem bytes\n")
 	}
-
-	for i := 0; true; i++ {
-		token, err := authenticate(remote, keyName)
-		if err != nil {
-			return nil, fmt.Errorf("authentication failed: %v", err)
+	defer memguard.WipeBytes(privKeyDer.Bytes)
+	if privKeyDer.Type == lib.Ed25519PrivateKeyType {
+		if len(privKeyDer.Bytes) != ed25519.SeedSize {
+			return nil, fmt.Errorf("failed to parse private key: Ed25519 keys must be %d bytes", ed25519.SeedSize)
 		}
+		return sdk.WithSigningAuthKey(keyName, lockEd25519Key(ed25519.NewKeyFromSeed(privKeyDer.Bytes))), nil
+	}
+	if privKeyDer.Type == openSSHPrivateKeyType {
+		return loadOpenSSHAuthKey(keyName, privKeyBytes.Bytes())
+	}
+
+	privKey, err := lib.NewLockedRSAKey(memguard.NewBufferFromBytes(privKeyDer.Bytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v\n", err)
+	}
 
-		req.Header.Set("Authorization", token)
+	return sdk.WithAuthKey(keyName, privKey), nil
+}
 
-		resp, err := client.Do(req)
+// loadOpenSSHAuthKey parses an OpenSSH private key to authenticate with. Keys protected by a passphrase can't be
+// read, but can be authenticated with from an ssh-agent instead.
+func loadOpenSSHAuthKey(keyName string, privKeyBytes []byte) (sdk.Option, error) {
+	privKey, err := ssh.ParseRawPrivateKey(privKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse OpenSSH private key (use --%s for keys with a passphrase): %v",
+			sshAgentFlag, err)
+	}
+
+	switch privKey := privKey.(type) {
+	case *rsa.PrivateKey:
+		lockedKey, err := lib.LockRSAKey(privKey)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("failed to parse OpenSSH private key: %v", err)
 		}
-		if resp.StatusCode == http.StatusUnauthorized && i < 1 {
-			// If we get here it is because the JWT secret rotated between the two requests.
-			// This happens infrequently, so retrying will succeed.
-			continue
-		}
-
-		return resp, nil
+		return sdk.WithAuthKey(keyName, lockedKey), nil
+	case *ed25519.PrivateKey:
+		return sdk.WithSigningAuthKey(keyName, lockEd25519Key(*privKey)), nil
+	case ed25519.PrivateKey:
+		return sdk.WithSigningAuthKey(keyName, lockEd25519Key(privKey)), nil
+	default:
+		return nil, fmt.Errorf("unsupported OpenSSH private key type %T, use an RSA or Ed25519 key", privKey)
 	}
+}
 
-	// Unreachable.
-	return nil, nil
+// lockEd25519Key moves an Ed25519 key into a LockedBuffer, which backs the returned key.
+func lockEd25519Key(privKey ed25519.PrivateKey) ed25519.PrivateKey {
+	defer memguard.WipeBytes(privKey)
+	return ed25519.PrivateKey(memguard.NewBufferFromBytes(privKey).Bytes())
 }
 
-func authenticate(remote string, keyName string) (string, error) {
-	rawPrivKeyPath, err := getStringFlag(privKeyFlag)
-	if err != nil {
-		return "", err
-	}
-	privKeyPath, err := homedir.Expand(rawPrivKeyPath)
+// ed25519KeyGen writes a new Ed25519 key-pair, for use authenticating requests where RSA is too slow.
+func ed25519KeyGen(privPath string, pubPath string) error {
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
-		return "", fmt.Errorf("error locating private key: %v\n", err)
+		return fmt.Errorf("failed generating private key: %v", err)
 	}
 
-	remoteUrl := fmt.Sprintf("%s/token", remote)
+	privKeyBytes := pem.EncodeToMemory(&pem.Block{
+		Type:  lib.Ed25519PrivateKeyType,
+		Bytes: privKey.Seed(),
+	})
 
-	payload := lib.TokenRequestPayload{
-		KeyName: keyName,
+	if err := ioutil.WriteFile(privPath, privKeyBytes, lib.PrivateKeyPerms); err != nil {
+		return fmt.Errorf("failed to write private key: %v", err)
 	}
+	fmt.Printf("Wrote private key to %s\n", privPath)
 
-	body := new(bytes.Buffer)
-	if err := json.NewEncoder(body).Encode(payload); err != nil {
-		return "", err
+	pubKeyBytes := pem.EncodeToMemory(&pem.Block{
+		Type:  lib.Ed25519PublicKeyType,
+		Bytes: pubKey,
+	})
+
+	if err := ioutil.WriteFile(pubPath, pubKeyBytes, lib.PublicKeyPerms); err != nil {
+		return fmt.Errorf("failed to write public key: %v", err)
 	}
+	fmt.Printf("Wrote public key to %s\n", pubPath)
 
-	resp, err := http.Post(remoteUrl, "application/json", body)
+	return nil
+}
+
+// loadAuthorizedKey loads a public key in any format a remote authorizes, e.g. a counterparty's authentication key.
+func loadAuthorizedKey(rawPath string) (crypto.PublicKey, error) {
+	path, err := homedir.Expand(rawPath)
 	if err != nil {
-		return "", err
-	}
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("response status: %s\n", resp.Status)
+		return nil, fmt.Errorf("error locating public key: %v", err)
 	}
 
-	ciphertext, err := ioutil.ReadAll(resp.Body)
+	keyBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading public key '%s': %v", path, err)
+	}
 
-	privKeyBytes, err := ioutil.ReadFile(privKeyPath)
+	key, err := lib.ParseAuthorizedKey(keyBytes)
 	if err != nil {
-		return "", fmt.Errorf("error reading private key '%s': %v", privKeyPath, err)
+		return nil, fmt.Errorf("failed to parse public key '%s': %v", path, err)
 	}
+	return key, nil
+}
 
-	privKeyDer, _ := pem.Decode(privKeyBytes)
-	if privKeyDer == nil {
-		return "", fmt.Errorf("failed to decode pem bytes\n")
+func loadPublicKey(rawPath string) (*rsa.PublicKey, error) {
+	pubKeyPath, err := homedir.Expand(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("error locating public key: %v", err)
 	}
-	privKey, err := x509.ParsePKCS1PrivateKey(privKeyDer.Bytes)
+
+	pubKeyBytes, err := ioutil.ReadFile(pubKeyPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse private key: %v\n", err)
+		return nil, fmt.Errorf("error reading public key '%s': %v", pubKeyPath, err)
 	}
 
-	token, err := rsa.DecryptOAEP(sha512.New(), rand.Reader, privKey, ciphertext, []byte(lib.TokenCipherLabel))
+	pubKeyDer, _ := pem.Decode(pubKeyBytes)
+	if pubKeyDer == nil {
+		return nil, fmt.Errorf("failed to decode pem bytes")
+	}
+	pubKey, err := x509.ParsePKCS1PublicKey(pubKeyDer.Bytes)
 	if err != nil {
-		return "", fmt.Errorf("failed to decrypt authorization token: %v\n", err)
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
 	}
 
-	return string(token), nil
+	return pubKey, nil
 }
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"dead-drop/lib"
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configTemplate is the starter config file written by config init.
+const configTemplate = `# dead-drop client configuration, see the Configuration section of the README.
+# Uncomment and fill in the settings below, or set them with 'dead config set <key> <value>'.
+
+# remote: https://localhost:4444 # The address of the server.
+# key-name: root # The name of the authorized-key (public key) to use on the server.
+# private-key: ~/.dead-drop/private.pem # The private key to use when authenticating.
+# encryption-key: ~/.dead-drop/encryption.key # The key to use when locally encrypting and decrypting objects.
+# insecure-skip-verify: false # If true, tls certificate verification will be skipped.
+`
+
+type settingKind int
+
+const (
+	stringSetting settingKind = iota
+	boolSetting
+	intSetting
+	durationSetting
+	listSetting
+	pathSetting
+)
+
+// configSettings are the settings the client reads from the config file, which config set and validate accept.
+var configSettings = map[string]settingKind{
+	remoteFlag:             stringSetting,
+	privKeyFlag:            pathSetting,
+	keyNameFlag:            stringSetting,
+	insecureSkipVerifyFlag: boolSetting,
+	caCertFlag:             pathSetting,
+	pinnedCertFlag:         listSetting,
+	clientCertFlag:         pathSetting,
+	clientKeyFlag:          pathSetting,
+	proxyFlag:              stringSetting,
+	retriesFlag:            intSetting,
+	connectTimeoutFlag:     durationSetting,
+	tlsTimeoutFlag:         durationSetting,
+	responseTimeoutFlag:    durationSetting,
+	sshAgentFlag:           boolSetting,
+	agentKeyFlag:           stringSetting,
+	pkcs11ModuleFlag:       pathSetting,
+	pkcs11TokenFlag:        stringSetting,
+	pkcs11KeyFlag:          stringSetting,
+	encryptionKeyFlag:      pathSetting,
+	keyringFlag:            pathSetting,
+	passphraseFlag:         boolSetting,
+	identityFlag:           pathSetting,
+	recipientFlag:          listSetting,
+	counterpartyFlag:       listSetting,
+	codecFlag:              listSetting,
+	padFlag:                boolSetting,
+	cipherFlag:             stringSetting,
+	noteFlag:               stringSetting,
+	suffixOnConflictFlag:   boolSetting,
+	resumeFlag:             boolSetting,
+	connectionsFlag:        intSetting,
+	forceFlag:              boolSetting,
+	ageFlag:                boolSetting,
+	rawFlag:                boolSetting,
+	linkFlag:               boolSetting,
+	phraseFlag:             boolSetting,
+	objectTtlFlag:          durationSetting,
+	burnFlag:               boolSetting,
+	maxPullsFlag:           intSetting,
+	labelFlag:              listSetting,
+	aliasFlag:              stringSetting,
+	releaseToFlag:          listSetting,
+	checkinIntervalFlag:    durationSetting,
+	journalFlag:            pathSetting,
+	settleFlag:             durationSetting,
+	removeFlag:             boolSetting,
+	workersFlag:            intSetting,
+	checksumFlag:           stringSetting,
+	historyFlag:            boolSetting,
+	profileFlag:            stringSetting,
+}
+
+func setupConfigCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Creates, validates and edits the config file",
+		// The config file doesn't need to exist yet, even when passed with --config.
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			loadConfig(true)
+		},
+	}
+
+	initCmd := &cobra.Command{
+		Use:   "init",
+		Short: "Writes a starter config file",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			force, _ := cmd.Flags().GetBool(forceFlag)
+
+			path, err := initConfig(force)
+			if err != nil {
+				fmt.Printf("ERROR: Failed to write config file: %v\n", err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Wrote config file to %s\n", path)
+		},
+	}
+	initCmd.Flags().Bool(forceFlag, false, "Overwrite the config file if it exists")
+
+	getCmd := &cobra.Command{
+		Use:   "get <key>",
+		Short: "Prints the value of a setting, from flags, environment variables, the profile or the config file",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			key := args[0]
+
+			if !viper.IsSet(key) {
+				fmt.Printf("ERROR: '%s' is not set\n", key)
+				os.Exit(1)
+			}
+
+			fmt.Println(formatSetting(viper.Get(key)))
+		},
+	}
+
+	setCmd := &cobra.Command{
+		Use:   "set <key> <value>",
+		Short: "Sets a setting in the config file, or in the profile selected with --profile",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			key := args[0]
+			value := args[1]
+
+			path, err := setConfig(key, value)
+			if err != nil {
+				fmt.Printf("ERROR: Failed to set '%s': %v\n", key, err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Set %s in %s\n", key, path)
+		},
+	}
+
+	validateCmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Checks the config file for unknown settings, invalid values, and missing key files",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			path, problems, err := validateConfig()
+			if err != nil {
+				fmt.Printf("ERROR: Failed to validate config file: %v\n", err)
+				os.Exit(1)
+			}
+
+			for _, problem := range problems {
+				fmt.Printf("%s: %s\n", path, problem)
+			}
+			if len(problems) > 0 {
+				os.Exit(1)
+			}
+
+			fmt.Printf("%s is valid\n", path)
+		},
+	}
+
+	cmd.AddCommand(initCmd, getCmd, setCmd, validateCmd)
+
+	return cmd
+}
+
+// configPath returns the path of the config file, whether or not it exists.
+func configPath() (string, error) {
+	if confFile != "" {
+		return confFile, nil
+	}
+	if path := viper.ConfigFileUsed(); path != "" {
+		return path, nil
+	}
+
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", fmt.Errorf("error locating home directory: %v", err)
+	}
+	return filepath.Join(home, lib.DefaultConfigDir, lib.DefaultConfigName+"."+lib.DefaultConfigType), nil
+}
+
+func initConfig(force bool) (string, error) {
+	path, err := configPath()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(path); err == nil && !force {
+		return "", fmt.Errorf("%s already exists, pass --%s to overwrite it", path, forceFlag)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", fmt.Errorf("error creating config directory: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(configTemplate), lib.PrivateKeyPerms); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// readConfigFile reads just the config file, without the environment variables and flags which override it.
+func readConfigFile() (*viper.Viper, string, error) {
+	path, err := configPath()
+	if err != nil {
+		return nil, "", err
+	}
+
+	file := viper.New()
+	file.SetConfigFile(path)
+	if err := file.ReadInConfig(); err != nil {
+		if os.IsNotExist(err) {
+			return nil, "", fmt.Errorf("%s does not exist, create it with 'config init'", path)
+		}
+		return nil, "", fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return file, path, nil
+}
+
+// setConfig sets a setting in the config file, or in the selected profile. Comments in the file are not kept.
+func setConfig(key string, rawValue string) (string, error) {
+	value, err := parseSetting(key, rawValue)
+	if err != nil {
+		return "", err
+	}
+
+	file, path, err := readConfigFile()
+	if err != nil {
+		return "", err
+	}
+
+	if profile != "" {
+		key = profilesKey + "." + profile + "." + key
+	}
+	file.Set(key, value)
+
+	if err := file.WriteConfig(); err != nil {
+		return "", fmt.Errorf("error writing %s: %v", path, err)
+	}
+	return path, nil
+}
+
+// parseSetting parses and checks the value of a setting given on the command line.
+func parseSetting(key string, rawValue string) (interface{}, error) {
+	kind, ok := configSettings[key]
+	if !ok {
+		return nil, fmt.Errorf("unknown setting")
+	}
+
+	var value interface{} = rawValue
+	switch kind {
+	case boolSetting:
+		parsed, err := strconv.ParseBool(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not true or false", rawValue)
+		}
+		value = parsed
+	case intSetting:
+		parsed, err := strconv.Atoi(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a number", rawValue)
+		}
+		value = parsed
+	case durationSetting:
+		if _, err := time.ParseDuration(rawValue); err != nil {
+			return nil, fmt.Errorf("'%s' is not a duration such as 30s or 5m", rawValue)
+		}
+	case listSetting:
+		value = strings.Split(rawValue, ",")
+	}
+
+	if err := checkSetting(key, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// checkSetting checks the value of a known setting, including that the files named by path settings exist.
+func checkSetting(key string, value interface{}) error {
+	switch configSettings[key] {
+	case boolSetting:
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("'%v' is not true or false", value)
+		}
+	case intSetting:
+		if _, ok := value.(int); !ok {
+			return fmt.Errorf("'%v' is not a number", value)
+		}
+	case durationSetting:
+		if _, err := time.ParseDuration(fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("'%v' is not a duration such as 30s or 5m", value)
+		}
+	case pathSetting:
+		rawPath, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("'%v' is not a path", value)
+		}
+		if key == encryptionKeyFlag && strings.HasPrefix(rawPath, keychainPrefix) {
+			return checkKeychainName(strings.TrimPrefix(rawPath, keychainPrefix))
+		}
+		if key == encryptionKeyFlag {
+			rawPath = strings.TrimPrefix(rawPath, kmsPrefix)
+		}
+		path, err := homedir.Expand(rawPath)
+		if err != nil {
+			return fmt.Errorf("error locating '%s': %v", rawPath, err)
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("'%s' can't be read: %v", rawPath, err)
+		}
+	}
+
+	switch key {
+	case remoteFlag:
+		remote, err := url.Parse(fmt.Sprint(value))
+		if err != nil || remote.Scheme == "" || remote.Host == "" {
+			return fmt.Errorf("'%v' is not a URL such as https://localhost:4444", value)
+		}
+	case keyNameFlag:
+		if !keyNameRegex.MatchString(fmt.Sprint(value)) {
+			return fmt.Errorf("'%v' is not a valid key name", value)
+		}
+	}
+	return nil
+}
+
+// validateConfig checks every setting in the config file and its profiles, and returns the problems found.
+func validateConfig() (string, []string, error) {
+	file, path, err := readConfigFile()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var problems []string
+	check := func(prefix string, settings map[string]interface{}) {
+		for key, value := range settings {
+			if _, ok := configSettings[key]; !ok {
+				problems = append(problems, fmt.Sprintf("%s%s: unknown setting", prefix, key))
+			} else if err := checkSetting(key, value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s%s: %v", prefix, key, err))
+			}
+		}
+	}
+
+	settings := file.AllSettings()
+	profiles, _ := settings[profilesKey].(map[string]interface{})
+	if _, ok := settings[profilesKey]; ok && profiles == nil {
+		problems = append(problems, fmt.Sprintf("%s: not a map of profiles", profilesKey))
+	}
+	if name, ok := settings[profileFlag]; ok {
+		if _, ok := profiles[fmt.Sprint(name)]; !ok {
+			problems = append(problems, fmt.Sprintf("%s: profile '%v' not found", profileFlag, name))
+		}
+	}
+	delete(settings, profilesKey)
+	delete(settings, profileFlag)
+	check("", settings)
+
+	for name, profileSettings := range profiles {
+		profileSettings, ok := profileSettings.(map[string]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s.%s: not a map of settings", profilesKey, name))
+			continue
+		}
+		check(profilesKey+"."+name+".", profileSettings)
+	}
+
+	sort.Strings(problems)
+	return path, problems, nil
+}
+
+// formatSetting formats a setting as config set takes it, e.g. lists as comma separated values.
+func formatSetting(value interface{}) string {
+	switch value := value.(type) {
+	case []string:
+		return strings.Join(value, ",")
+	case []interface{}:
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ",")
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"dead-drop/lib"
+	"dead-drop/sdk"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const maxConflictSuffix = 1024
+
+// isDirDestination reports whether pulled objects should be placed inside destPath rather than written to it.
+// A trailing path separator marks a directory destination, which is created if it does not exist yet.
+func isDirDestination(destPath string) (bool, error) {
+	if strings.HasSuffix(destPath, string(os.PathSeparator)) || strings.HasSuffix(destPath, "/") {
+		if err := os.MkdirAll(destPath, 0770); err != nil {
+			return false, fmt.Errorf("error creating destination directory '%s': %v", destPath, err)
+		}
+		return true, nil
+	}
+
+	info, err := os.Stat(destPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return info.IsDir(), nil
+}
+
+// writeObject saves pulled object data, returning the path it was written to.
+// If destPath is a directory, the file name is taken from the object metadata, falling back to the oid.
+// The data is streamed to a new file, which is removed if reading fails, since it may then hold unverified data. An
+// existing file at destPath is only replaced once all of the data was read.
+func writeObject(
+	destPath string,
+	meta *sdk.ObjectMetadata,
+	oid string,
+	data io.Reader,
+	suffixOnConflict bool,
+) (string, error) {
+	isDir, err := isDirDestination(destPath)
+	if err != nil {
+		return "", err
+	}
+
+	if !isDir {
+		if err := replaceFile(destPath, data); err != nil {
+			return "", err
+		}
+	} else {
+		name := sanitizeFileName(meta.Name)
+		if name == "" {
+			name = oid
+		}
+
+		file, path, err := createInDir(destPath, name, suffixOnConflict)
+		if err != nil {
+			return "", err
+		}
+		if err := copyToFile(file, data, path); err != nil {
+			return "", err
+		}
+		destPath = path
+	}
+
+	if err := restoreFileInfo(destPath, meta); err != nil {
+		fmt.Printf("WARN: Failed to restore the permissions and modification time of '%s': %v\n", destPath, err)
+	}
+
+	return destPath, nil
+}
+
+// replaceFile streams data to a temporary file next to path, which is renamed over path once all of the data was read,
+// so that a pull which fails verification leaves an existing file at path as it was.
+func replaceFile(path string, data io.Reader) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".pull-")
+	if err != nil {
+		return fmt.Errorf("error writing object to '%s': %v", path, err)
+	}
+	if err := file.Chmod(lib.ObjectPerms); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return fmt.Errorf("error writing object to '%s': %v", path, err)
+	}
+	if err := copyToFile(file, data, path); err != nil {
+		return err
+	}
+
+	if err := os.Rename(file.Name(), path); err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("error writing object to '%s': %v", path, err)
+	}
+	return nil
+}
+
+// copyToFile streams data to a newly created file and closes it, removing it if that fails. Errors name the file as
+// path, which it is written to.
+func copyToFile(file *os.File, data io.Reader, path string) error {
+	_, err := io.Copy(file, data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if removeErr := os.Remove(file.Name()); removeErr != nil {
+			fmt.Printf("WARN: Failed to remove partially pulled object '%s': %v\n", file.Name(), removeErr)
+		}
+		return fmt.Errorf("error writing object to '%s': %v", path, err)
+	}
+	return nil
+}
+
+// restoreFileInfo gives a pulled file the permissions and modification time recorded in its metadata, like archive
+// entries are given theirs.
+func restoreFileInfo(path string, meta *sdk.ObjectMetadata) error {
+	if meta.Mode != 0 {
+		if err := os.Chmod(path, meta.Mode.Perm()); err != nil {
+			return err
+		}
+	}
+	if meta.Modified != nil {
+		if err := os.Chtimes(path, time.Now(), *meta.Modified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTree extracts a pulled directory tree, returning the directory it was extracted to.
+// If destPath is an existing directory (or ends with a path separator), the tree is extracted to a new directory
+// inside it, named like writeObject names files; otherwise destPath must not exist yet, and the tree becomes it.
+// The extracted tree is removed if reading fails, since it may then hold unverified data.
+func writeTree(
+	destPath string,
+	meta *sdk.ObjectMetadata,
+	oid string,
+	data io.Reader,
+	suffixOnConflict bool,
+) (string, error) {
+	isDir, err := isDirDestination(destPath)
+	if err != nil {
+		return "", err
+	}
+
+	path := destPath
+	if isDir {
+		name := sanitizeFileName(meta.Name)
+		if name == "" {
+			name = oid
+		}
+
+		if path, err = mkdirInDir(destPath, name, suffixOnConflict); err != nil {
+			return "", err
+		}
+	} else if err := os.Mkdir(destPath, 0770); err != nil {
+		return "", fmt.Errorf("error creating destination directory '%s': %v", destPath, err)
+	}
+
+	if err := extractTar(data, path); err != nil {
+		if removeErr := os.RemoveAll(path); removeErr != nil {
+			fmt.Printf("WARN: Failed to remove partially pulled tree '%s': %v\n", path, removeErr)
+		}
+		return "", fmt.Errorf("error extracting object to '%s': %v", path, err)
+	}
+
+	return path, nil
+}
+
+// createInDir exclusively creates name inside dir, never overwriting an existing file.
+// If suffixOnConflict is set, a numeric suffix is added to the name until a free one is found.
+func createInDir(dir string, name string, suffixOnConflict bool) (*os.File, string, error) {
+	var file *os.File
+	path, err := claimInDir(dir, name, suffixOnConflict, func(path string) error {
+		var err error
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, lib.ObjectPerms)
+		return err
+	})
+	return file, path, err
+}
+
+// mkdirInDir is createInDir for a directory.
+func mkdirInDir(dir string, name string, suffixOnConflict bool) (string, error) {
+	return claimInDir(dir, name, suffixOnConflict, func(path string) error {
+		return os.Mkdir(path, 0770)
+	})
+}
+
+// claimInDir calls create with the path of name inside dir, and with suffixed names while create reports that the
+// path exists if suffixOnConflict is set, returning the path which was created.
+func claimInDir(dir string, name string, suffixOnConflict bool, create func(string) error) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	for i := 0; i <= maxConflictSuffix; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		path := filepath.Join(dir, candidate)
+
+		err := create(path)
+		if err == nil {
+			return path, nil
+		}
+		if !os.IsExist(err) {
+			return "", fmt.Errorf("error creating '%s': %v", path, err)
+		}
+		if !suffixOnConflict {
+			return "", fmt.Errorf("'%s' already exists (use --%s to pick a free name)", path, suffixOnConflictFlag)
+		}
+	}
+
+	return "", fmt.Errorf("no free file name found for '%s' in '%s'", name, dir)
+}
+
+// sanitizeFileName reduces a sender-provided name to a single path element, returning "" if nothing usable remains.
+func sanitizeFileName(name string) string {
+	name = filepath.Base(filepath.Clean("/" + strings.Replace(name, "\\", "/", -1)))
+	if name == "." || name == ".." || name == "/" || name == string(os.PathSeparator) || strings.ContainsRune(name, 0) {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"dead-drop/lib"
+	"dead-drop/sdk"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The history is a file of one entry per line, each the base64 of a lib.Encrypt message of the entry's JSON, keyed
+// with a key derived from the encryption key, so that references can't be read from the file without it. Entries are
+// only recorded when an encryption key is configured, whatever the object was encrypted with.
+const historyName = "history"
+
+// historyLabel derives the history key from the encryption key, and is the authenticated header of each entry.
+const historyLabel = "dead-drop history"
+
+const historyDrop = "drop"
+const historyPull = "pull"
+
+// historyEntry records a drop or pull.
+type historyEntry struct {
+	Time      time.Time `json:"time"`
+	Op        string    `json:"op"`
+	Oid       string    `json:"oid"`
+	Checksum  string    `json:"checksum"`
+	Algorithm string    `json:"algorithm,omitempty"`
+	Remote    string    `json:"remote,omitempty"`
+	// Path is the file which was dropped, or the path the object was pulled to.
+	Path string `json:"path"`
+}
+
+// reference returns the object reference of the entry, as a link if the remote is known.
+func (entry *historyEntry) reference() string {
+	or := &sdk.ObjectReference{
+		Oid:       entry.Oid,
+		Checksum:  entry.Checksum,
+		Algorithm: entry.Algorithm,
+		Remote:    entry.Remote,
+	}
+	if or.Remote != "" {
+		if link, err := or.Link(); err == nil {
+			return link
+		}
+	}
+	return or.String()
+}
+
+func (entry *historyEntry) matches(term string) bool {
+	term = strings.ToLower(term)
+	for _, field := range []string{entry.Oid, entry.Remote, entry.Path, entry.reference()} {
+		if strings.Contains(strings.ToLower(field), term) {
+			return true
+		}
+	}
+	return false
+}
+
+func (entry *historyEntry) String() string {
+	arrow := "->"
+	if entry.Op == historyPull {
+		arrow = "<-"
+	}
+	return fmt.Sprintf("%s %-4s %s %s %s", entry.Time.Local().Format(time.RFC3339), entry.Op, entry.Path, arrow,
+		entry.reference())
+}
+
+// dropHistory appends entries to the history file, loading the history key once, since commands like batch record
+// many entries, from several goroutines.
+type dropHistory struct {
+	mutex sync.Mutex
+	key   *memguard.LockedBuffer
+	err   error
+}
+
+var history = &dropHistory{}
+
+func setupHistoryCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "List the objects dropped and pulled on this machine",
+		Long: "List the objects dropped and pulled on this machine, oldest first, from the history kept in " +
+			filepath.Join("$HOME", lib.DefaultConfigDir, historyName) + ".\n\n" +
+			"The history is encrypted with a key derived from the encryption key, and drops and pulls are only\n" +
+			"recorded when an encryption key is configured. Pass --history=false to drop or pull without recording.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			bindPFlag(cmd, encryptionKeyFlag)
+
+			if err := listHistory(""); err != nil {
+				fmt.Printf("ERROR: Failed to read the history: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.PersistentFlags().String(encryptionKeyFlag, "",
+		"Encryption key file the history is encrypted with, or "+keychainPrefix+"<name> for a key in the OS keychain")
+
+	searchCmd := &cobra.Command{
+		Use:   "search <term>",
+		Short: "List the history entries whose file path, oid, remote or reference contain a term",
+		Long: "List the history entries whose file path, oid, remote or reference contain a term, ignoring case,\n" +
+			"e.g. 'dead history search report.pdf'.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			bindPFlag(cmd, encryptionKeyFlag)
+
+			if err := listHistory(args[0]); err != nil {
+				fmt.Printf("ERROR: Failed to search the history: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.AddCommand(searchCmd)
+
+	return cmd
+}
+
+func setupHistoryFlag(cmd *cobra.Command) {
+	cmd.PersistentFlags().Bool(historyFlag, true,
+		"Record the object in the encrypted history (see the history command), if an encryption key is configured")
+}
+
+func historyPath() (string, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, lib.DefaultConfigDir, historyName), nil
+}
+
+// loadHistoryKey derives the key of the history from the encryption key.
+func loadHistoryKey() (*memguard.LockedBuffer, error) {
+	rawPath, err := getStringFlag(encryptionKeyFlag)
+	if err != nil {
+		return nil, fmt.Errorf("the history is encrypted with the encryption key: %v", err)
+	}
+
+	encryptionKey, err := loadEncryptionKey(rawPath)
+	if err != nil {
+		return nil, err
+	}
+	defer encryptionKey.Destroy()
+
+	mac := hmac.New(sha256.New, encryptionKey.Bytes())
+	mac.Write([]byte(historyLabel))
+	return memguard.NewBufferFromBytes(mac.Sum(nil)), nil
+}
+
+// recordHistory appends a drop or pull to the history, unless it is disabled or there is no encryption key to
+// encrypt it with. Failing to record it only warns, since the drop or pull itself succeeded.
+func recordHistory(op string, or *sdk.ObjectReference, path string) {
+	if !viper.GetBool(historyFlag) || viper.GetString(encryptionKeyFlag) == "" {
+		return
+	}
+
+	remote := or.Remote
+	if remote == "" {
+		remote = viper.GetString(remoteFlag)
+	}
+	if absPath, err := filepath.Abs(path); err == nil && path != stdinPath {
+		path = absPath
+	}
+
+	entry := &historyEntry{
+		Time:      time.Now().UTC(),
+		Op:        op,
+		Oid:       or.Oid,
+		Checksum:  or.Checksum,
+		Algorithm: or.Algorithm,
+		Remote:    remote,
+		Path:      path,
+	}
+	if err := history.record(entry); err != nil {
+		fmt.Printf("WARN: Failed to record the %s of %s in the history: %v\n", op, path, err)
+	}
+}
+
+func (history *dropHistory) record(entry *historyEntry) error {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	if history.key == nil && history.err == nil {
+		history.key, history.err = loadHistoryKey()
+	}
+	if history.err != nil {
+		return history.err
+	}
+
+	plaintext, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	defer memguard.WipeBytes(plaintext)
+
+	// Encrypt destroys the key it is given.
+	message, err := lib.Encrypt(memguard.NewBufferFromBytes(append([]byte{}, history.key.Bytes()...)),
+		[]byte(historyLabel), plaintext)
+	if err != nil {
+		return fmt.Errorf("error encrypting entry: %v", err)
+	}
+
+	path, err := historyPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, lib.PrivateKeyPerms)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteString(base64.StdEncoding.EncodeToString(message) + "\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readHistory decrypts the entries of the history, oldest first. Entries which don't decrypt with the key, e.g.
+// because they were recorded with another encryption key, are skipped, and counted.
+func readHistory(key *memguard.LockedBuffer) ([]*historyEntry, int, error) {
+	path, err := historyPath()
+	if err != nil {
+		return nil, 0, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	var entries []*historyEntry
+	skipped := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		entry, err := openHistoryEntry(key, line)
+		if err != nil {
+			skipped++
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, skipped, scanner.Err()
+}
+
+func openHistoryEntry(key *memguard.LockedBuffer, line string) (*historyEntry, error) {
+	message, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := lib.Decrypt(memguard.NewBufferFromBytes(append([]byte{}, key.Bytes()...)),
+		[]byte(historyLabel), message)
+	if err != nil {
+		return nil, err
+	}
+	defer plaintext.Destroy()
+
+	entry := &historyEntry{}
+	if err := json.Unmarshal(plaintext.Bytes(), entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// listHistory prints the history entries matching a term, or all of them if it is empty.
+func listHistory(term string) error {
+	key, err := loadHistoryKey()
+	if err != nil {
+		return err
+	}
+	defer key.Destroy()
+
+	entries, skipped, err := readHistory(key)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if term == "" || entry.matches(term) {
+			fmt.Println(entry)
+		}
+	}
+	if skipped > 0 {
+		fmt.Printf("WARN: Skipped %d entries which don't decrypt with the encryption key\n", skipped)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"dead-drop/lib"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// keyShareType is the PEM block type of key share files, which hold one share of an encryption key split with Shamir's
+// secret sharing, and headers describing the split.
+const keyShareType = "DEAD-DROP KEY SHARE"
+
+// Headers of key share files: the share's index, the threshold of shares recombining the key, a random id of the split
+// which its shares have in common, and a check value of the key, which detects wrong or corrupted shares.
+const keyShareIndexHeader = "Share"
+const keyShareThresholdHeader = "Threshold"
+const keyShareSplitHeader = "Split"
+const keyShareCheckHeader = "Key-Check"
+
+const keyShareCheckLabel = "dead-drop key share check"
+
+func setupKeyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "key",
+		Short: "Split encryption keys into shares and recombine them",
+		Long: "Split an encryption key into shares with Shamir's secret sharing, any threshold of which recombine it,\n" +
+			"while fewer reveal nothing about it, so that no single person or machine holds the complete key.",
+	}
+
+	splitCmd := &cobra.Command{
+		Use:   "split <key path> <share path prefix>",
+		Short: "Splits an encryption key into shares, written to <share path prefix>-<n>.share",
+		Long: "Splits an encryption key into shares, written to <share path prefix>-<n>.share, of which any\n" +
+			"threshold recombine the key with key combine.\n\n" +
+			"The key can also be keychain:<name> or kms:<path>. The key is left as it is; remove it once the shares\n" +
+			"are handed out.",
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			shares, _ := cmd.Flags().GetInt(sharesFlag)
+			threshold, _ := cmd.Flags().GetInt(thresholdFlag)
+			force, _ := cmd.Flags().GetBool(forceFlag)
+
+			paths, err := splitKey(args[0], args[1], shares, threshold, force)
+			if err != nil {
+				fmt.Printf("ERROR: Failed to split key: %v\n", err)
+				os.Exit(1)
+			}
+
+			for _, path := range paths {
+				fmt.Println(path)
+			}
+			fmt.Printf("Split key into %d shares, any %d of which recombine it\n", shares, threshold)
+		},
+	}
+	splitCmd.Flags().Int(sharesFlag, 5, "Number of shares to split the key into")
+	splitCmd.Flags().Int(thresholdFlag, 3, "Number of shares needed to recombine the key")
+	splitCmd.Flags().Bool(forceFlag, false, "Replace share files which exist")
+
+	combineCmd := &cobra.Command{
+		Use:   "combine <key path> <share path>...",
+		Short: "Recombines an encryption key from its shares",
+		Long: "Recombines an encryption key from at least the threshold of its shares, and writes it to a key file.\n\n" +
+			"Remove the key file once it is no longer needed, so that the complete key isn't left behind.",
+		Args: cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			force, _ := cmd.Flags().GetBool(forceFlag)
+
+			if err := combineKey(args[0], args[1:], force); err != nil {
+				fmt.Printf("ERROR: Failed to combine key: %v\n", err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Recombined key from %d shares into %s\n", len(args)-1, args[0])
+		},
+	}
+	combineCmd.Flags().Bool(forceFlag, false, "Replace the key file if it exists")
+
+	cmd.AddCommand(splitCmd, combineCmd)
+
+	return cmd
+}
+
+// keyCheck returns the check value of a key, which identifies it without revealing anything useful about a random key.
+func keyCheck(key []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(keyShareCheckLabel))
+	hash.Write(key)
+	return hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+// splitKey splits an encryption key into share files, returning their paths.
+func splitKey(rawKeyPath string, rawPrefix string, shares int, threshold int, force bool) ([]string, error) {
+	prefix, err := homedir.Expand(rawPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("error locating shares: %v", err)
+	}
+	paths := make([]string, shares)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("%s-%d.share", prefix, i+1)
+		if _, err := os.Stat(paths[i]); err == nil && !force {
+			return nil, fmt.Errorf("'%s' already exists, pass --%s to replace it", paths[i], forceFlag)
+		}
+	}
+
+	key, err := loadEncryptionKey(rawKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Destroy()
+	if key.Size() == 0 {
+		return nil, fmt.Errorf("key '%s' is empty", rawKeyPath)
+	}
+
+	split, err := lib.SplitSecret(key.Bytes(), shares, threshold)
+	if err != nil {
+		return nil, err
+	}
+	splitID := make([]byte, 8)
+	if _, err := rand.Read(splitID); err != nil {
+		return nil, fmt.Errorf("error generating split id: %v", err)
+	}
+
+	for i, share := range split {
+		block := &pem.Block{
+			Type: keyShareType,
+			Headers: map[string]string{
+				keyShareIndexHeader:     strconv.Itoa(int(share.X)),
+				keyShareThresholdHeader: strconv.Itoa(threshold),
+				keyShareSplitHeader:     hex.EncodeToString(splitID),
+				keyShareCheckHeader:     keyCheck(key.Bytes()),
+			},
+			Bytes: share.Y,
+		}
+		err := ioutil.WriteFile(paths[i], pem.EncodeToMemory(block), lib.PrivateKeyPerms)
+		memguard.WipeBytes(share.Y)
+		if err != nil {
+			return nil, fmt.Errorf("error writing share '%s': %v", paths[i], err)
+		}
+	}
+	return paths, nil
+}
+
+// readKeyShare reads a share file, returning the share and the headers of its block.
+func readKeyShare(rawPath string) (lib.SecretShare, map[string]string, error) {
+	path, err := homedir.Expand(rawPath)
+	if err != nil {
+		return lib.SecretShare{}, nil, fmt.Errorf("error locating share: %v", err)
+	}
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return lib.SecretShare{}, nil, fmt.Errorf("error reading share '%s': %v", path, err)
+	}
+	defer memguard.WipeBytes(encoded)
+
+	block, _ := pem.Decode(encoded)
+	if block == nil || block.Type != keyShareType {
+		return lib.SecretShare{}, nil, fmt.Errorf("'%s' is not a key share file", path)
+	}
+	index, err := strconv.Atoi(block.Headers[keyShareIndexHeader])
+	if err != nil || index < 1 || index > lib.MaxSecretShares {
+		return lib.SecretShare{}, nil, fmt.Errorf("'%s' has an invalid share index", path)
+	}
+	return lib.SecretShare{X: byte(index), Y: block.Bytes}, block.Headers, nil
+}
+
+// combineKey recombines an encryption key from share files, and writes it to a key file.
+func combineKey(rawKeyPath string, sharePaths []string, force bool) error {
+	keyPath, err := homedir.Expand(rawKeyPath)
+	if err != nil {
+		return fmt.Errorf("error locating key: %v", err)
+	}
+	if _, err := os.Stat(keyPath); err == nil && !force {
+		return fmt.Errorf("'%s' already exists, pass --%s to replace it", keyPath, forceFlag)
+	}
+
+	shares := make([]lib.SecretShare, 0, len(sharePaths))
+	defer func() {
+		for _, share := range shares {
+			memguard.WipeBytes(share.Y)
+		}
+	}()
+	var first map[string]string
+	for _, sharePath := range sharePaths {
+		share, headers, err := readKeyShare(sharePath)
+		if err != nil {
+			return err
+		}
+		shares = append(shares, share)
+		if first == nil {
+			first = headers
+		} else if headers[keyShareSplitHeader] != first[keyShareSplitHeader] ||
+			headers[keyShareCheckHeader] != first[keyShareCheckHeader] {
+			return fmt.Errorf("share '%s' is a share of another key than '%s'", sharePath, sharePaths[0])
+		}
+	}
+
+	threshold, err := strconv.Atoi(first[keyShareThresholdHeader])
+	if err != nil {
+		return fmt.Errorf("'%s' has an invalid threshold", sharePaths[0])
+	}
+	if len(shares) < threshold {
+		return fmt.Errorf("the key was split with a threshold of %d shares, but only %d were given", threshold,
+			len(shares))
+	}
+
+	key, err := lib.CombineShares(shares)
+	if err != nil {
+		return err
+	}
+	defer memguard.WipeBytes(key)
+	if subtle.ConstantTimeCompare([]byte(keyCheck(key)), []byte(first[keyShareCheckHeader])) != 1 {
+		return fmt.Errorf("the shares don't recombine the key they were split from, one of them may be corrupted")
+	}
+
+	return ioutil.WriteFile(keyPath, key, lib.PrivateKeyPerms)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"regexp"
+)
+
+// Encryption keys can be kept in the OS keychain (the macOS Keychain, Windows Credential Manager, or a Secret Service
+// such as GNOME Keyring or KWallet) instead of a file, by setting the encryption key to keychain:<name>.
+const keychainPrefix = "keychain:"
+
+// keychainService is the service keys are stored under, which the OS shows when it asks to allow access to them.
+const keychainService = "dead-drop"
+
+const keychainKeyLen = 32
+
+// Key names end up in the commands of keychain tools, so they are kept to characters which need no quoting.
+var keychainNameRegex = regexp.MustCompile("^[a-zA-Z0-9._-]+$")
+
+func setupKeychainCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "keychain",
+		Short: "Manage encryption keys stored in the OS keychain",
+		Long: "Manage encryption keys stored in the OS keychain: the macOS Keychain, Windows Credential Manager, or a\n" +
+			"Secret Service (e.g. GNOME Keyring or KWallet, through secret-tool) on Linux and BSD.\n\n" +
+			"Set the encryption key to keychain:<name> to use a stored key, e.g. --encryption-key keychain:work.",
+	}
+
+	storeCmd := &cobra.Command{
+		Use:   "store <name> [key path]",
+		Short: "Stores an encryption key file in the keychain, or a newly generated key if no path is given",
+		Long: "Stores an encryption key file in the keychain, or a newly generated key if no path is given.\n\n" +
+			"The key file is left as it is; remove it once the key is stored, unless it is kept as a backup.",
+		Args: cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			name := args[0]
+			var keyPath string
+			if len(args) > 1 {
+				keyPath = args[1]
+			}
+			force, _ := cmd.Flags().GetBool(forceFlag)
+
+			if err := storeKeychainKey(name, keyPath, force); err != nil {
+				fmt.Printf("ERROR: Failed to store key '%s' in the keychain: %v\n", name, err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Stored key in the keychain, use it with --%s %s%s\n", encryptionKeyFlag, keychainPrefix, name)
+		},
+	}
+	storeCmd.Flags().Bool(forceFlag, false, "Replace the key if the keychain already holds one with the name")
+
+	deleteCmd := &cobra.Command{
+		Use:   "delete <name>",
+		Short: "Deletes an encryption key from the keychain",
+		Long: "Deletes an encryption key from the keychain. Objects encrypted with it can't be pulled without\n" +
+			"another copy of the key.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			name := args[0]
+
+			if err := deleteKeychainKey(name); err != nil {
+				fmt.Printf("ERROR: Failed to delete key '%s' from the keychain: %v\n", name, err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Deleted key %s from the keychain\n", name)
+		},
+	}
+
+	cmd.AddCommand(storeCmd, deleteCmd)
+
+	return cmd
+}
+
+func checkKeychainName(name string) error {
+	if !keychainNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid keychain key name '%s', it may only contain letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+// loadKeychainKey loads an encryption key from the keychain.
+func loadKeychainKey(name string) (*memguard.LockedBuffer, error) {
+	if err := checkKeychainName(name); err != nil {
+		return nil, err
+	}
+
+	secret, err := keychainGet(name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key '%s' from the keychain: %v", name, err)
+	}
+	defer memguard.WipeBytes(secret)
+
+	key := make([]byte, base64.StdEncoding.DecodedLen(len(secret)))
+	defer memguard.WipeBytes(key)
+	n, err := base64.StdEncoding.Decode(key, secret)
+	if err != nil || n == 0 {
+		return nil, fmt.Errorf("keychain entry of key '%s' is not a dead-drop key", name)
+	}
+	return memguard.NewBufferFromBytes(key[:n]), nil
+}
+
+// storeKeychainKey stores the key of a key file, or a new random key if the path is empty, in the keychain.
+func storeKeychainKey(name string, rawPath string, force bool) error {
+	if err := checkKeychainName(name); err != nil {
+		return err
+	}
+
+	if !force {
+		if existing, err := keychainGet(name); err == nil {
+			memguard.WipeBytes(existing)
+			return fmt.Errorf("the keychain already holds a key with the name, pass --%s to replace it", forceFlag)
+		}
+	}
+
+	var key []byte
+	if rawPath == "" {
+		key = make([]byte, keychainKeyLen)
+		if _, err := rand.Read(key); err != nil {
+			return fmt.Errorf("error generating key: %v", err)
+		}
+	} else {
+		keyPath, err := homedir.Expand(rawPath)
+		if err != nil {
+			return fmt.Errorf("error locating key: %v", err)
+		}
+		if key, err = ioutil.ReadFile(keyPath); err != nil {
+			return fmt.Errorf("error reading key '%s': %v", keyPath, err)
+		}
+		if len(key) == 0 {
+			return fmt.Errorf("key '%s' is empty", keyPath)
+		}
+	}
+	defer memguard.WipeBytes(key)
+
+	secret := make([]byte, base64.StdEncoding.EncodedLen(len(key)))
+	defer memguard.WipeBytes(secret)
+	base64.StdEncoding.Encode(secret, key)
+
+	return keychainSet(name, secret)
+}
+
+func deleteKeychainKey(name string) error {
+	if err := checkKeychainName(name); err != nil {
+		return err
+	}
+	return keychainDelete(name)
+}
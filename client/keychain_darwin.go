@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"os/exec"
+)
+
+// The macOS Keychain is used through the security tool. Secrets are written through its interactive mode, so that
+// they never appear in the arguments of a process.
+const securityPath = "/usr/bin/security"
+
+// securityItemNotFound is the exit status of security when there is no such item.
+const securityItemNotFound = 44
+
+func keychainGet(name string) ([]byte, error) {
+	cmd := exec.Command(securityPath, "find-generic-password", "-s", keychainService, "-a", name, "-w")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, securityError(err)
+	}
+	return bytes.TrimRight(output, "\n"), nil
+}
+
+func keychainSet(name string, secret []byte) error {
+	prefix := fmt.Sprintf("add-generic-password -U -s %s -a %s -l %s -w ", keychainService, name, keychainService)
+	command := make([]byte, 0, len(prefix)+len(secret)+1)
+	command = append(append(append(command, prefix...), secret...), '\n')
+	defer memguard.WipeBytes(command)
+
+	cmd := exec.Command(securityPath, "-i")
+	cmd.Stdin = bytes.NewReader(command)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("security failed: %v: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+func keychainDelete(name string) error {
+	cmd := exec.Command(securityPath, "delete-generic-password", "-s", keychainService, "-a", name)
+	if err := cmd.Run(); err != nil {
+		return securityError(err)
+	}
+	return nil
+}
+
+func securityError(err error) error {
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == securityItemNotFound {
+		return fmt.Errorf("no such key in the keychain")
+	}
+	return fmt.Errorf("security failed: %v", err)
+}
@@ -0,0 +1,20 @@
+//go:build !darwin && !windows && !linux && !freebsd && !openbsd && !netbsd && !dragonfly
+// +build !darwin,!windows,!linux,!freebsd,!openbsd,!netbsd,!dragonfly
+
+package main
+
+import "fmt"
+
+var errKeychainUnsupported = fmt.Errorf("the OS keychain is not supported on this platform")
+
+func keychainGet(name string) ([]byte, error) {
+	return nil, errKeychainUnsupported
+}
+
+func keychainSet(name string, secret []byte) error {
+	return errKeychainUnsupported
+}
+
+func keychainDelete(name string) error {
+	return errKeychainUnsupported
+}
@@ -0,0 +1,74 @@
+//go:build linux || freebsd || openbsd || netbsd || dragonfly
+// +build linux freebsd openbsd netbsd dragonfly
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"os/exec"
+)
+
+// Secret Services (e.g. GNOME Keyring or KWallet) are used through secret-tool, from libsecret, which reads secrets
+// from stdin, so that they never appear in the arguments of a process.
+const secretToolName = "secret-tool"
+
+func secretTool(args ...string) (*exec.Cmd, error) {
+	path, err := exec.LookPath(secretToolName)
+	if err != nil {
+		return nil, fmt.Errorf("%s was not found, install libsecret's tools to use the keychain", secretToolName)
+	}
+	return exec.Command(path, args...), nil
+}
+
+func keychainGet(name string) ([]byte, error) {
+	cmd, err := secretTool("lookup", "service", keychainService, "account", name)
+	if err != nil {
+		return nil, err
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		// secret-tool exits with status 1 and no output if there is no such secret.
+		if stderr.Len() == 0 {
+			return nil, fmt.Errorf("no such key in the keychain")
+		}
+		return nil, fmt.Errorf("%s failed: %v: %s", secretToolName, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return output, nil
+}
+
+func keychainSet(name string, secret []byte) error {
+	cmd, err := secretTool("store", "--label", keychainService+" key "+name,
+		"service", keychainService, "account", name)
+	if err != nil {
+		return err
+	}
+
+	cmd.Stdin = bytes.NewReader(secret)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", secretToolName, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+func keychainDelete(name string) error {
+	// secret-tool succeeds whether or not there was a secret to clear.
+	secret, err := keychainGet(name)
+	if err != nil {
+		return err
+	}
+	memguard.WipeBytes(secret)
+
+	cmd, err := secretTool("clear", "service", keychainService, "account", name)
+	if err != nil {
+		return err
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", secretToolName, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"github.com/awnumar/memguard"
+	"syscall"
+	"unsafe"
+)
+
+// Windows Credential Manager is used through the advapi32 credential functions, with a generic credential for each
+// key, whose target name is prefixed with the service.
+var (
+	advapi32        = syscall.NewLazyDLL("advapi32.dll")
+	procCredReadW   = advapi32.NewProc("CredReadW")
+	procCredWriteW  = advapi32.NewProc("CredWriteW")
+	procCredDeleteW = advapi32.NewProc("CredDeleteW")
+	procCredFree    = advapi32.NewProc("CredFree")
+)
+
+const (
+	credTypeGeneric         = 1
+	credPersistLocalMachine = 2
+	errorNotFound           = syscall.Errno(1168)
+)
+
+// credential is the CREDENTIALW structure.
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+func credentialTarget(name string) (*uint16, error) {
+	return syscall.UTF16PtrFromString(keychainService + ":" + name)
+}
+
+func credentialError(call string, err error) error {
+	if err == errorNotFound {
+		return fmt.Errorf("no such key in the keychain")
+	}
+	return fmt.Errorf("%s failed: %v", call, err)
+}
+
+func keychainGet(name string) ([]byte, error) {
+	target, err := credentialTarget(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *credential
+	ret, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0,
+		uintptr(unsafe.Pointer(&cred)))
+	if ret == 0 {
+		return nil, credentialError("CredReadW", err)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+
+	blob := (*[1 << 20]byte)(unsafe.Pointer(cred.CredentialBlob))[:cred.CredentialBlobSize:cred.CredentialBlobSize]
+	secret := make([]byte, len(blob))
+	copy(secret, blob)
+	memguard.WipeBytes(blob)
+	return secret, nil
+}
+
+func keychainSet(name string, secret []byte) error {
+	target, err := credentialTarget(name)
+	if err != nil {
+		return err
+	}
+	user, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+
+	cred := credential{
+		Type:               credTypeGeneric,
+		TargetName:         target,
+		CredentialBlobSize: uint32(len(secret)),
+		CredentialBlob:     &secret[0],
+		Persist:            credPersistLocalMachine,
+		UserName:           user,
+	}
+	ret, _, err := procCredWriteW.Call(uintptr(unsafe.Pointer(&cred)), 0)
+	if ret == 0 {
+		return credentialError("CredWriteW", err)
+	}
+	return nil
+}
+
+func keychainDelete(name string) error {
+	target, err := credentialTarget(name)
+	if err != nil {
+		return err
+	}
+
+	ret, _, err := procCredDeleteW.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0)
+	if ret == 0 {
+		return credentialError("CredDeleteW", err)
+	}
+	return nil
+}
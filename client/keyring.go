@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"dead-drop/sdk"
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+func setupKeyringCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "keyring",
+		Short: "Manage keyrings of encryption keys, for rotating the shared encryption key",
+	}
+
+	addCmd := &cobra.Command{
+		Use:   "add <keyring path>",
+		Short: "Generates a new encryption key and adds it to a keyring, making it the current key for drops",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			keyringPath := args[0]
+
+			id, _ := cmd.Flags().GetString(keyIdFlag)
+			if id == "" {
+				id = time.Now().UTC().Format("20060102-150405")
+			}
+			ttl, _ := cmd.Flags().GetDuration(keyTtlFlag)
+
+			if err := addKeyringKey(keyringPath, id, ttl); err != nil {
+				fmt.Printf("ERROR: Failed to add key to keyring: %v\n", err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Added key %s to %s\n", id, keyringPath)
+		},
+	}
+	addCmd.Flags().String(keyIdFlag, "", "Id of the new key (default is the current UTC time)")
+	addCmd.Flags().Duration(keyTtlFlag, 0, "Time after which drops stop using the new key (default is never)")
+
+	listCmd := &cobra.Command{
+		Use:   "list <keyring path>",
+		Short: "Lists the keys in a keyring",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := listKeyring(args[0]); err != nil {
+				fmt.Printf("ERROR: Failed to list keyring: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	shareCmd := &cobra.Command{
+		Use:   "share <keyring path> <recipient public key path>",
+		Short: "Drops a keyring key wrapped to a counterparty's public key, for them to install with keyring sync",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			keyringPath := args[0]
+			recipientPath := args[1]
+
+			bindRemoteCmdFlags(cmd)
+			id, _ := cmd.Flags().GetString(keyIdFlag)
+
+			or, err := shareKeyringKey(keyringPath, id, recipientPath)
+			if err != nil {
+				fmt.Printf("ERROR: Failed to share keyring key: %v\n", err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Shared key -> %s\n", or)
+		},
+	}
+	setupRemoteCmdFlags(shareCmd)
+	shareCmd.Flags().String(keyIdFlag, "", "Id of the key to share (default is the current key)")
+
+	syncCmd := &cobra.Command{
+		Use:   "sync <keyring path> [object]...",
+		Short: "Pulls keys shared with keyring share by counterparties, and installs them in a keyring",
+		Long: "Pulls the keys which the counterparty keys have shared with the private key using keyring share,\n" +
+			"checks that they are signed by one of the counterparty keys, unwraps them with the private key, and installs\n" +
+			"them in a keyring, where they are only used for pulls.\n" +
+			"Objects can be given to pull those rather than every key shared; pass - as the only object to read object\n" +
+			"references from stdin, one per line.",
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			keyringPath := args[0]
+			objects := args[1:]
+
+			bindRemoteCmdFlags(cmd)
+			bindPFlag(cmd, counterpartyFlag)
+
+			if len(objects) == 1 && objects[0] == "-" {
+				var err error
+				if objects, err = readLines(os.Stdin); err != nil {
+					fmt.Printf("ERROR: Failed to read object references: %v\n", err)
+					os.Exit(1)
+				}
+			}
+
+			if err := syncKeyring(keyringPath, viper.GetStringSlice(counterpartyFlag), objects); err != nil {
+				fmt.Printf("ERROR: Failed to sync keyring: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	setupRemoteCmdFlags(syncCmd)
+	syncCmd.PersistentFlags().StringSlice(counterpartyFlag, nil,
+		"Public key of a counterparty (e.g. the one they authenticate with) to accept shared keys from (repeatable)")
+
+	cmd.AddCommand(addCmd, listCmd, shareCmd, syncCmd)
+
+	return cmd
+}
+
+func addKeyringKey(rawPath string, id string, ttl time.Duration) error {
+	path, err := homedir.Expand(rawPath)
+	if err != nil {
+		return fmt.Errorf("error locating keyring: %v", err)
+	}
+
+	return sdk.AddKeyringKey(path, id, ttl)
+}
+
+func loadKeyring(rawPath string) (*sdk.Keyring, error) {
+	path, err := homedir.Expand(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("error locating keyring: %v", err)
+	}
+
+	return sdk.LoadKeyring(path)
+}
+
+func listKeyring(rawPath string) error {
+	keyring, err := loadKeyring(rawPath)
+	if err != nil {
+		return err
+	}
+	defer keyring.Destroy()
+
+	current, _ := keyring.Current()
+
+	writer := bufio.NewWriter(os.Stdout)
+	for _, entry := range keyring.Entries() {
+		expires := "never"
+		if !entry.Expires().IsZero() {
+			expires = entry.Expires().Format(time.RFC3339)
+		}
+
+		status := ""
+		if entry == current {
+			status = " (current)"
+		} else if entry.IsExpired() {
+			status = " (expired)"
+		} else if entry.IsShared() {
+			status = " (shared)"
+		}
+
+		fmt.Fprintf(writer, "%s\texpires %s%s\n", entry.Id(), expires, status)
+	}
+	return writer.Flush()
+}
+
+func shareKeyringKey(keyringPath string, id string, recipientPath string) (*sdk.ObjectReference, error) {
+	client, err := newClient()
+	if err != nil {
+		return nil, err
+	}
+
+	recipient, err := loadPublicKey(recipientPath)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring, err := loadKeyring(keyringPath)
+	if err != nil {
+		return nil, err
+	}
+	defer keyring.Destroy()
+
+	fmt.Printf("Wrapping key to recipient public key ...\n")
+
+	return client.ShareKeyringKey(context.Background(), keyring, id, recipient)
+}
+
+// syncKeyring pulls keys shared with shareKeyringKey by the counterparties, or the given objects, checks that they are
+// signed by a counterparty, unwraps them with the private key, and installs them in the keyring.
+// Keys which are already installed are skipped.
+func syncKeyring(keyringPath string, counterpartyPaths []string, objects []string) error {
+	path, err := homedir.Expand(keyringPath)
+	if err != nil {
+		return fmt.Errorf("error locating keyring: %v", err)
+	}
+	if len(counterpartyPaths) == 0 {
+		return fmt.Errorf("no counterparty keys to accept shared keys from, pass --%s", counterpartyFlag)
+	}
+
+	counterparties := make([]crypto.PublicKey, len(counterpartyPaths))
+	for i, counterpartyPath := range counterpartyPaths {
+		if counterparties[i], err = loadAuthorizedKey(counterpartyPath); err != nil {
+			return err
+		}
+	}
+
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	refs := make([]*sdk.ObjectReference, 0, len(objects))
+	for _, object := range objects {
+		or, err := sdk.ParseObjectReference(object)
+		if err != nil {
+			return err
+		}
+		refs = append(refs, or)
+	}
+	if len(objects) == 0 {
+		for i, counterparty := range counterparties {
+			shared, err := client.SharedKeyringKeys(ctx, counterparty)
+			if err != nil {
+				return fmt.Errorf("error finding keys shared by '%s': %v", counterpartyPaths[i], err)
+			}
+			refs = append(refs, shared...)
+		}
+		if len(refs) == 0 {
+			fmt.Printf("No shared keys to install\n")
+		}
+	}
+
+	for _, or := range refs {
+		line, err := client.PullKeyringKey(ctx, or, counterparties...)
+		if err != nil {
+			return fmt.Errorf("error pulling '%s': %v", or, err)
+		}
+
+		id, installed, err := sdk.InstallKeyringLine(path, line)
+		if err != nil {
+			return err
+		}
+
+		if installed {
+			fmt.Printf("Installed key %s\n", id)
+		} else {
+			fmt.Printf("Key %s is already installed\n", id)
+		}
+	}
+
+	return nil
+}
+
+// readLines returns the non-blank lines of r, with surrounding whitespace removed.
+func readLines(r io.Reader) ([]string, error) {
+	lines := make([]string, 0)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, scanner.Err()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"dead-drop/lib"
+	"encoding/pem"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+)
+
+// Encryption keys can be kept wrapped by a key management service (AWS KMS or a Vault transit key) instead of in the
+// clear, by setting the encryption key to kms:<path> of a file written by 'kms wrap'. The key is unwrapped by the
+// service whenever it is loaded, so access to it can be granted, audited and revoked centrally.
+const kmsPrefix = "kms:"
+
+// kmsKeyType is the PEM block type of wrapped key files, which hold the key as the service wrapped it, and the url of
+// the service's key in kmsKeyManagerHeader.
+const kmsKeyType = "DEAD-DROP KMS WRAPPED KEY"
+const kmsKeyManagerHeader = "Key-Manager"
+
+const kmsKeyLen = 32
+
+func setupKMSCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "kms",
+		Short: "Manage encryption keys wrapped by AWS KMS or a Vault transit key",
+		Long: "Manage encryption keys wrapped by a key management service, so that only the wrapped key is ever\n" +
+			"stored, and the service decides who may use it. The service's key is given by url:\n" +
+			"  awskms://<region>/<key id, alias/<name> or arn>, with credentials in AWS_ACCESS_KEY_ID,\n" +
+			"    AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN\n" +
+			"  vault+https://<host>[:<port>]/<mount>/<key>, with the token in VAULT_TOKEN\n\n" +
+			"Set the encryption key to kms:<path> to use a wrapped key file, e.g. --encryption-key kms:~/work.kms.",
+	}
+
+	wrapCmd := &cobra.Command{
+		Use:   "wrap <key manager url> <wrapped key path> [key path]",
+		Short: "Wraps an encryption key file, or a newly generated key if no path is given, into a wrapped key file",
+		Long: "Wraps an encryption key file, or a newly generated key if no path is given, with a key of a key\n" +
+			"management service, and writes the wrapped key file.\n\n" +
+			"The key file is left as it is; remove it once the key is wrapped, unless it is kept as a backup.",
+		Args: cobra.RangeArgs(2, 3),
+		Run: func(cmd *cobra.Command, args []string) {
+			kmsURL, wrappedPath := args[0], args[1]
+			var keyPath string
+			if len(args) > 2 {
+				keyPath = args[2]
+			}
+			force, _ := cmd.Flags().GetBool(forceFlag)
+
+			if err := wrapKMSKey(kmsURL, wrappedPath, keyPath, force); err != nil {
+				fmt.Printf("ERROR: Failed to wrap key: %v\n", err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Wrapped key, use it with --%s %s%s\n", encryptionKeyFlag, kmsPrefix, wrappedPath)
+		},
+	}
+	wrapCmd.Flags().Bool(forceFlag, false, "Replace the wrapped key file if it exists")
+
+	cmd.AddCommand(wrapCmd)
+
+	return cmd
+}
+
+// loadKMSKey loads an encryption key from a wrapped key file, which the key management service it names unwraps.
+func loadKMSKey(rawPath string) (*memguard.LockedBuffer, error) {
+	wrappedPath, err := homedir.Expand(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("error locating wrapped key: %v", err)
+	}
+	encoded, err := ioutil.ReadFile(wrappedPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading wrapped key '%s': %v", wrappedPath, err)
+	}
+	block, _ := pem.Decode(encoded)
+	if block == nil || block.Type != kmsKeyType || block.Headers[kmsKeyManagerHeader] == "" {
+		return nil, fmt.Errorf("'%s' is not a wrapped key file", wrappedPath)
+	}
+
+	keyManager, err := lib.NewKeyManager(block.Headers[kmsKeyManagerHeader])
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lib.KeyManagerTimeout)
+	defer cancel()
+	key, err := keyManager.Decrypt(ctx, string(block.Bytes))
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping key '%s' with %s: %v", wrappedPath, keyManager, err)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("wrapped key '%s' is empty", wrappedPath)
+	}
+	return memguard.NewBufferFromBytes(key), nil
+}
+
+// wrapKMSKey wraps the key of a key file, or a new random key if the path is empty, with the key of a key management
+// service, and writes it to a wrapped key file.
+func wrapKMSKey(kmsURL string, rawWrappedPath string, rawKeyPath string, force bool) error {
+	keyManager, err := lib.NewKeyManager(kmsURL)
+	if err != nil {
+		return err
+	}
+	wrappedPath, err := homedir.Expand(rawWrappedPath)
+	if err != nil {
+		return fmt.Errorf("error locating wrapped key: %v", err)
+	}
+	if _, err := os.Stat(wrappedPath); err == nil && !force {
+		return fmt.Errorf("'%s' already exists, pass --%s to replace it", wrappedPath, forceFlag)
+	}
+
+	var key []byte
+	if rawKeyPath == "" {
+		key = make([]byte, kmsKeyLen)
+		if _, err := rand.Read(key); err != nil {
+			return fmt.Errorf("error generating key: %v", err)
+		}
+	} else {
+		keyPath, err := homedir.Expand(rawKeyPath)
+		if err != nil {
+			return fmt.Errorf("error locating key: %v", err)
+		}
+		if key, err = ioutil.ReadFile(keyPath); err != nil {
+			return fmt.Errorf("error reading key '%s': %v", keyPath, err)
+		}
+		if len(key) == 0 {
+			return fmt.Errorf("key '%s' is empty", keyPath)
+		}
+	}
+	defer memguard.WipeBytes(key)
+
+	ctx, cancel := context.WithTimeout(context.Background(), lib.KeyManagerTimeout)
+	defer cancel()
+	wrapped, err := keyManager.Encrypt(ctx, key)
+	if err != nil {
+		return fmt.Errorf("error wrapping key with %s: %v", keyManager, err)
+	}
+
+	block := &pem.Block{
+		Type:    kmsKeyType,
+		Headers: map[string]string{kmsKeyManagerHeader: kmsURL},
+		Bytes:   []byte(wrapped),
+	}
+	return ioutil.WriteFile(wrappedPath, pem.EncodeToMemory(block), lib.PrivateKeyPerms)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
+)
+
+// promptPassphrase reads a passphrase from the terminal without echoing it. It is read from the terminal itself rather
+// than stdin, which may be the object being dropped, and never from flags, which other users can see in the process
+// list. If confirm is set, the passphrase must be entered twice.
+func promptPassphrase(confirm bool) (*memguard.LockedBuffer, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("a terminal is needed to enter the passphrase: %v", err)
+	}
+	defer tty.Close()
+
+	passphrase, err := readPassphrase(tty, "Passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+
+	if confirm {
+		again, err := readPassphrase(tty, "Confirm passphrase: ")
+		if err != nil {
+			memguard.WipeBytes(passphrase)
+			return nil, err
+		}
+		match := bytes.Equal(passphrase, again)
+		memguard.WipeBytes(again)
+		if !match {
+			memguard.WipeBytes(passphrase)
+			return nil, fmt.Errorf("passphrases do not match")
+		}
+	}
+
+	return memguard.NewBufferFromBytes(passphrase), nil
+}
+
+func readPassphrase(tty *os.File, prompt string) ([]byte, error) {
+	fmt.Fprint(tty, prompt)
+	passphrase, err := terminal.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	if err != nil {
+		return nil, fmt.Errorf("error reading passphrase: %v", err)
+	}
+	return passphrase, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"dead-drop/sdk"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+)
+
+func setupPhraseCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "phrase <object>...",
+		Short: "Converts object references to phrases of words, and phrases back to references",
+		Long: "Converts object references to phrases of words to read out, e.g. over the phone, and phrases back to\n" +
+			"references. Phrases are the words of the oid, which the remote must pick with oid-alphabet: words, then\n" +
+			fmt.Sprintf("%d words of the start of the object's checksum, e.g.\n", sdk.PhraseChecksumWords) +
+			"gecko-zebra-acid-yodel.lemon-tulip-ozone-vixen. Their words can be separated by dashes or spaces, and\n" +
+			"only the first three letters of each are read.\n\n" +
+			"A phrase is converted back by having remote compute the object's checksum, which is checked against\n" +
+			"the phrase's, without pulling the object. Pull accepts phrases as they are.",
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			bindRemoteCmdFlags(cmd)
+			bindPFlag(cmd, linkFlag)
+
+			for _, object := range args {
+				converted, err := phrase(object)
+				if err != nil {
+					fmt.Printf("ERROR: Failed to convert object '%s': %v\n", object, err)
+					os.Exit(1)
+				}
+
+				fmt.Printf("%s\n", converted)
+			}
+		},
+	}
+
+	setupRemoteCmdFlags(cmd)
+	cmd.PersistentFlags().Bool(linkFlag, false, "Convert phrases to links naming the remote, rather than references")
+
+	return cmd
+}
+
+// phrase converts a reference to a phrase, or a phrase to the full reference of its object.
+func phrase(object string) (string, error) {
+	or, err := sdk.ParseObjectReference(object)
+	if err != nil {
+		return "", err
+	}
+	if !or.Partial {
+		return or.Phrase()
+	}
+
+	client, err := newObjectClient(or)
+	if err != nil {
+		return "", err
+	}
+	if or, err = client.Resolve(context.Background(), or); err != nil {
+		return "", err
+	}
+	if viper.GetBool(linkFlag) {
+		return or.Link()
+	}
+	return or.String(), nil
+}
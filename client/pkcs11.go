@@ -0,0 +1,448 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+/*
+#cgo linux LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdlib.h>
+
+// The subset of the PKCS #11 v2.40 API used to decrypt with a private key held on a token.
+typedef unsigned long CK_ULONG;
+typedef CK_ULONG CK_RV;
+typedef CK_ULONG CK_SLOT_ID;
+typedef CK_ULONG CK_SESSION_HANDLE;
+typedef CK_ULONG CK_OBJECT_HANDLE;
+typedef unsigned char CK_BYTE;
+
+typedef struct { CK_BYTE major; CK_BYTE minor; } CK_VERSION;
+
+typedef struct {
+	CK_BYTE label[32];
+	CK_BYTE manufacturerID[32];
+	CK_BYTE model[16];
+	CK_BYTE serialNumber[16];
+	CK_ULONG flags;
+	CK_ULONG ulMaxSessionCount;
+	CK_ULONG ulSessionCount;
+	CK_ULONG ulMaxRwSessionCount;
+	CK_ULONG ulRwSessionCount;
+	CK_ULONG ulMaxPinLen;
+	CK_ULONG ulMinPinLen;
+	CK_ULONG ulTotalPublicMemory;
+	CK_ULONG ulFreePublicMemory;
+	CK_ULONG ulTotalPrivateMemory;
+	CK_ULONG ulFreePrivateMemory;
+	CK_VERSION hardwareVersion;
+	CK_VERSION firmwareVersion;
+	CK_BYTE utcTime[16];
+} CK_TOKEN_INFO;
+
+typedef struct { CK_ULONG type; void *pValue; CK_ULONG ulValueLen; } CK_ATTRIBUTE;
+typedef struct { CK_ULONG mechanism; void *pParameter; CK_ULONG ulParameterLen; } CK_MECHANISM;
+typedef struct {
+	CK_ULONG hashAlg;
+	CK_ULONG mgf;
+	CK_ULONG source;
+	void *pSourceData;
+	CK_ULONG ulSourceDataLen;
+} CK_RSA_PKCS_OAEP_PARAMS;
+
+typedef CK_RV (*CK_FUNC)();
+
+// Functions are listed in the order of the standard, up to C_Decrypt; the rest are never called.
+typedef struct {
+	CK_VERSION version;
+	CK_RV (*C_Initialize)(void *);
+	CK_RV (*C_Finalize)(void *);
+	CK_FUNC C_GetInfo;
+	CK_FUNC C_GetFunctionList;
+	CK_RV (*C_GetSlotList)(CK_BYTE, CK_SLOT_ID *, CK_ULONG *);
+	CK_FUNC C_GetSlotInfo;
+	CK_RV (*C_GetTokenInfo)(CK_SLOT_ID, CK_TOKEN_INFO *);
+	CK_FUNC C_GetMechanismList;
+	CK_FUNC C_GetMechanismInfo;
+	CK_FUNC C_InitToken;
+	CK_FUNC C_InitPIN;
+	CK_FUNC C_SetPIN;
+	CK_RV (*C_OpenSession)(CK_SLOT_ID, CK_ULONG, void *, void *, CK_SESSION_HANDLE *);
+	CK_RV (*C_CloseSession)(CK_SESSION_HANDLE);
+	CK_FUNC C_CloseAllSessions;
+	CK_FUNC C_GetSessionInfo;
+	CK_FUNC C_GetOperationState;
+	CK_FUNC C_SetOperationState;
+	CK_RV (*C_Login)(CK_SESSION_HANDLE, CK_ULONG, CK_BYTE *, CK_ULONG);
+	CK_FUNC C_Logout;
+	CK_FUNC C_CreateObject;
+	CK_FUNC C_CopyObject;
+	CK_FUNC C_DestroyObject;
+	CK_FUNC C_GetObjectSize;
+	CK_RV (*C_GetAttributeValue)(CK_SESSION_HANDLE, CK_OBJECT_HANDLE, CK_ATTRIBUTE *, CK_ULONG);
+	CK_FUNC C_SetAttributeValue;
+	CK_RV (*C_FindObjectsInit)(CK_SESSION_HANDLE, CK_ATTRIBUTE *, CK_ULONG);
+	CK_RV (*C_FindObjects)(CK_SESSION_HANDLE, CK_OBJECT_HANDLE *, CK_ULONG, CK_ULONG *);
+	CK_RV (*C_FindObjectsFinal)(CK_SESSION_HANDLE);
+	CK_FUNC C_EncryptInit;
+	CK_FUNC C_Encrypt;
+	CK_FUNC C_EncryptUpdate;
+	CK_FUNC C_EncryptFinal;
+	CK_RV (*C_DecryptInit)(CK_SESSION_HANDLE, CK_MECHANISM *, CK_OBJECT_HANDLE);
+	CK_RV (*C_Decrypt)(CK_SESSION_HANDLE, CK_BYTE *, CK_ULONG, CK_BYTE *, CK_ULONG *);
+} CK_FUNCTION_LIST;
+
+#define CKR_OK 0x0UL
+#define CKR_USER_ALREADY_LOGGED_IN 0x100UL
+#define CKR_CRYPTOKI_ALREADY_INITIALIZED 0x191UL
+#define CKF_SERIAL_SESSION 0x4UL
+#define CKF_LOGIN_REQUIRED 0x4UL
+#define CKU_USER 1UL
+#define CKA_CLASS 0x0UL
+#define CKA_LABEL 0x3UL
+#define CKA_KEY_TYPE 0x100UL
+#define CKA_MODULUS 0x120UL
+#define CKA_PUBLIC_EXPONENT 0x122UL
+#define CKO_PRIVATE_KEY 0x3UL
+#define CKK_RSA 0x0UL
+#define CKM_RSA_PKCS_OAEP 0x9UL
+#define CKM_SHA512 0x270UL
+#define CKG_MGF1_SHA512 0x4UL
+#define CKZ_DATA_SPECIFIED 0x1UL
+
+static CK_RV dd_load(const char *path, void **module, CK_FUNCTION_LIST **functions) {
+	*module = dlopen(path, RTLD_NOW);
+	if (*module == NULL) {
+		return (CK_RV)-1;
+	}
+	CK_RV (*getFunctionList)(CK_FUNCTION_LIST **) = dlsym(*module, "C_GetFunctionList");
+	if (getFunctionList == NULL) {
+		dlclose(*module);
+		return (CK_RV)-1;
+	}
+	CK_RV rv = getFunctionList(functions);
+	if (rv != CKR_OK) {
+		dlclose(*module);
+		return rv;
+	}
+	rv = (*functions)->C_Initialize(NULL);
+	if (rv == CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		rv = CKR_OK;
+	}
+	if (rv != CKR_OK) {
+		dlclose(*module);
+	}
+	return rv;
+}
+
+static CK_RV dd_get_slots(CK_FUNCTION_LIST *f, CK_SLOT_ID *slots, CK_ULONG *count) {
+	return f->C_GetSlotList(1, slots, count);
+}
+
+static CK_RV dd_get_token_info(CK_FUNCTION_LIST *f, CK_SLOT_ID slot, CK_BYTE *label, CK_ULONG *flags) {
+	CK_TOKEN_INFO info;
+	CK_RV rv = f->C_GetTokenInfo(slot, &info);
+	if (rv == CKR_OK) {
+		for (int i = 0; i < 32; i++) {
+			label[i] = info.label[i];
+		}
+		*flags = info.flags;
+	}
+	return rv;
+}
+
+static CK_RV dd_open_session(CK_FUNCTION_LIST *f, CK_SLOT_ID slot, CK_SESSION_HANDLE *session) {
+	return f->C_OpenSession(slot, CKF_SERIAL_SESSION, NULL, NULL, session);
+}
+
+static CK_RV dd_login(CK_FUNCTION_LIST *f, CK_SESSION_HANDLE session, CK_BYTE *pin, CK_ULONG pinLen) {
+	CK_RV rv = f->C_Login(session, CKU_USER, pin, pinLen);
+	return rv == CKR_USER_ALREADY_LOGGED_IN ? CKR_OK : rv;
+}
+
+static CK_RV dd_find_keys(
+	CK_FUNCTION_LIST *f,
+	CK_SESSION_HANDLE session,
+	CK_BYTE *label,
+	CK_ULONG labelLen,
+	CK_OBJECT_HANDLE *keys,
+	CK_ULONG maxKeys,
+	CK_ULONG *count
+) {
+	CK_ULONG class = CKO_PRIVATE_KEY;
+	CK_ULONG keyType = CKK_RSA;
+	CK_ATTRIBUTE template[] = {
+		{CKA_CLASS, &class, sizeof(class)},
+		{CKA_KEY_TYPE, &keyType, sizeof(keyType)},
+		{CKA_LABEL, label, labelLen},
+	};
+	CK_RV rv = f->C_FindObjectsInit(session, template, labelLen > 0 ? 3 : 2);
+	if (rv != CKR_OK) {
+		return rv;
+	}
+	rv = f->C_FindObjects(session, keys, maxKeys, count);
+	f->C_FindObjectsFinal(session);
+	return rv;
+}
+
+static CK_RV dd_get_attribute(
+	CK_FUNCTION_LIST *f,
+	CK_SESSION_HANDLE session,
+	CK_OBJECT_HANDLE key,
+	CK_ULONG type,
+	CK_BYTE *value,
+	CK_ULONG *valueLen
+) {
+	CK_ATTRIBUTE attribute = {type, value, *valueLen};
+	CK_RV rv = f->C_GetAttributeValue(session, key, &attribute, 1);
+	*valueLen = attribute.ulValueLen;
+	return rv;
+}
+
+static CK_RV dd_decrypt_oaep(
+	CK_FUNCTION_LIST *f,
+	CK_SESSION_HANDLE session,
+	CK_OBJECT_HANDLE key,
+	CK_BYTE *label,
+	CK_ULONG labelLen,
+	CK_BYTE *in,
+	CK_ULONG inLen,
+	CK_BYTE *out,
+	CK_ULONG *outLen
+) {
+	CK_RSA_PKCS_OAEP_PARAMS params = {CKM_SHA512, CKG_MGF1_SHA512, CKZ_DATA_SPECIFIED, label, labelLen};
+	CK_MECHANISM mechanism = {CKM_RSA_PKCS_OAEP, &params, sizeof(params)};
+	CK_RV rv = f->C_DecryptInit(session, &mechanism, key);
+	if (rv != CKR_OK) {
+		return rv;
+	}
+	return f->C_Decrypt(session, in, inLen, out, outLen);
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"io"
+	"math/big"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+const maxPKCS11Slots = 32
+
+// pkcs11Key is an RSA private key held on a PKCS #11 token (e.g. a YubiKey through ykcs11), which decrypts RSA-OAEP
+// (SHA-512) ciphertexts on the token, so the key never leaves it.
+type pkcs11Key struct {
+	lock      sync.Mutex
+	functions *C.CK_FUNCTION_LIST
+	session   C.CK_SESSION_HANDLE
+	key       C.CK_OBJECT_HANDLE
+	publicKey *rsa.PublicKey
+}
+
+// openPKCS11Key loads a PKCS #11 module, and finds the RSA private key with the given label (or the only one, if the
+// label is empty) on the token with the given label (or the first token). The PIN is prompted for if the token needs
+// one.
+func openPKCS11Key(modulePath string, tokenLabel string, keyLabel string) (crypto.Decrypter, error) {
+	cPath := C.CString(modulePath)
+	defer C.free(unsafe.Pointer(cPath))
+
+	var module unsafe.Pointer
+	var functions *C.CK_FUNCTION_LIST
+	if rv := C.dd_load(cPath, &module, &functions); rv != C.CKR_OK {
+		if rv == ^C.CK_RV(0) {
+			return nil, fmt.Errorf("error loading PKCS #11 module '%s': %s", modulePath, dlError())
+		}
+		return nil, fmt.Errorf("error initializing PKCS #11 module '%s': %v", modulePath, pkcs11Error(rv))
+	}
+
+	slot, loginRequired, err := findPKCS11Token(functions, tokenLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &pkcs11Key{functions: functions}
+	if rv := C.dd_open_session(functions, slot, &key.session); rv != C.CKR_OK {
+		return nil, fmt.Errorf("error opening PKCS #11 session: %v", pkcs11Error(rv))
+	}
+
+	if loginRequired {
+		if err := key.login(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := key.findKey(keyLabel); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func findPKCS11Token(functions *C.CK_FUNCTION_LIST, tokenLabel string) (C.CK_SLOT_ID, bool, error) {
+	slots := make([]C.CK_SLOT_ID, maxPKCS11Slots)
+	count := C.CK_ULONG(len(slots))
+	if rv := C.dd_get_slots(functions, &slots[0], &count); rv != C.CKR_OK {
+		return 0, false, fmt.Errorf("error listing PKCS #11 slots: %v", pkcs11Error(rv))
+	}
+
+	for _, slot := range slots[:count] {
+		label := make([]byte, 32)
+		var flags C.CK_ULONG
+		if rv := C.dd_get_token_info(functions, slot, (*C.CK_BYTE)(&label[0]), &flags); rv != C.CKR_OK {
+			return 0, false, fmt.Errorf("error reading PKCS #11 token info: %v", pkcs11Error(rv))
+		}
+
+		// Token labels are padded with spaces.
+		if tokenLabel == "" || string(bytes.TrimRight(label, " ")) == tokenLabel {
+			return slot, flags&C.CKF_LOGIN_REQUIRED != 0, nil
+		}
+	}
+
+	if tokenLabel != "" {
+		return 0, false, fmt.Errorf("no PKCS #11 token labelled '%s' found", tokenLabel)
+	}
+	return 0, false, fmt.Errorf("no PKCS #11 token found")
+}
+
+func (key *pkcs11Key) login() error {
+	pin, err := promptPIN()
+	if err != nil {
+		return err
+	}
+	defer pin.Destroy()
+
+	pinBytes := pin.Bytes()
+	rv := C.dd_login(key.functions, key.session, (*C.CK_BYTE)(&pinBytes[0]), C.CK_ULONG(len(pinBytes)))
+	if rv != C.CKR_OK {
+		return fmt.Errorf("error logging in to PKCS #11 token: %v", pkcs11Error(rv))
+	}
+	return nil
+}
+
+func (key *pkcs11Key) findKey(label string) error {
+	var cLabel *C.CK_BYTE
+	if label != "" {
+		cLabel = (*C.CK_BYTE)(unsafe.Pointer(C.CString(label)))
+		defer C.free(unsafe.Pointer(cLabel))
+	}
+
+	keys := make([]C.CK_OBJECT_HANDLE, 2)
+	var count C.CK_ULONG
+	labelLen := C.CK_ULONG(len(label))
+	rv := C.dd_find_keys(key.functions, key.session, cLabel, labelLen, &keys[0], C.CK_ULONG(len(keys)), &count)
+	switch {
+	case rv != C.CKR_OK:
+		return fmt.Errorf("error finding PKCS #11 key: %v", pkcs11Error(rv))
+	case count == 0 && label != "":
+		return fmt.Errorf("no RSA private key labelled '%s' found on the PKCS #11 token", label)
+	case count == 0:
+		return fmt.Errorf("no RSA private key found on the PKCS #11 token")
+	case count > 1:
+		return fmt.Errorf("several RSA private keys found on the PKCS #11 token, select one by its label")
+	}
+	key.key = keys[0]
+
+	modulus, err := key.attribute(C.CKA_MODULUS)
+	if err != nil {
+		return err
+	}
+	exponent, err := key.attribute(C.CKA_PUBLIC_EXPONENT)
+	if err != nil {
+		return err
+	}
+	key.publicKey = &rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulus),
+		E: int(new(big.Int).SetBytes(exponent).Int64()),
+	}
+	return nil
+}
+
+func (key *pkcs11Key) attribute(attributeType C.CK_ULONG) ([]byte, error) {
+	var length C.CK_ULONG
+	if rv := C.dd_get_attribute(key.functions, key.session, key.key, attributeType, nil, &length); rv != C.CKR_OK {
+		return nil, fmt.Errorf("error reading PKCS #11 key: %v", pkcs11Error(rv))
+	}
+	if length == 0 {
+		return nil, fmt.Errorf("error reading PKCS #11 key: empty attribute")
+	}
+
+	value := make([]byte, length)
+	rv := C.dd_get_attribute(key.functions, key.session, key.key, attributeType, (*C.CK_BYTE)(&value[0]), &length)
+	if rv != C.CKR_OK {
+		return nil, fmt.Errorf("error reading PKCS #11 key: %v", pkcs11Error(rv))
+	}
+	return value[:length], nil
+}
+
+func (key *pkcs11Key) Public() crypto.PublicKey {
+	return key.publicKey
+}
+
+// Decrypt decrypts an RSA-OAEP ciphertext on the token. Only SHA-512, the hash dead-drop uses, is supported.
+func (key *pkcs11Key) Decrypt(rand io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	oaepOpts, ok := opts.(*rsa.OAEPOptions)
+	if !ok || oaepOpts.Hash != crypto.SHA512 || len(ciphertext) == 0 {
+		return nil, fmt.Errorf("PKCS #11 keys only decrypt RSA-OAEP (SHA-512)")
+	}
+
+	key.lock.Lock()
+	defer key.lock.Unlock()
+
+	// Append a byte, so that the label can be passed even if it is empty.
+	label := append(oaepOpts.Label, 0)
+	plaintext := make([]byte, len(ciphertext))
+	length := C.CK_ULONG(len(plaintext))
+	rv := C.dd_decrypt_oaep(
+		key.functions,
+		key.session,
+		key.key,
+		(*C.CK_BYTE)(&label[0]),
+		C.CK_ULONG(len(oaepOpts.Label)),
+		(*C.CK_BYTE)(&ciphertext[0]),
+		C.CK_ULONG(len(ciphertext)),
+		(*C.CK_BYTE)(&plaintext[0]),
+		&length,
+	)
+	if rv != C.CKR_OK {
+		memguard.WipeBytes(plaintext)
+		return nil, fmt.Errorf("PKCS #11 decryption failed: %v", pkcs11Error(rv))
+	}
+	if int(length) > len(plaintext) {
+		return nil, fmt.Errorf("PKCS #11 decryption failed: plaintext is longer than the ciphertext")
+	}
+	return plaintext[:length], nil
+}
+
+// promptPIN reads the PIN of a token from the terminal, as promptPassphrase does.
+func promptPIN() (*memguard.LockedBuffer, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("a terminal is needed to enter the token PIN: %v", err)
+	}
+	defer tty.Close()
+
+	pin, err := readPassphrase(tty, "Token PIN: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(pin) == 0 {
+		return nil, fmt.Errorf("empty PIN")
+	}
+	return memguard.NewBufferFromBytes(pin), nil
+}
+
+func dlError() string {
+	if message := C.dlerror(); message != nil {
+		return C.GoString(message)
+	}
+	return "not a PKCS #11 module"
+}
+
+func pkcs11Error(rv C.CK_RV) string {
+	return fmt.Sprintf("CKR 0x%x", uint64(rv))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"dead-drop/lib"
+	"dead-drop/sdk"
+	"encoding/pem"
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"os"
+)
+
+func setupPKCS11KeyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pkcs11-key <public key path>",
+		Short: "Writes the public key of an RSA key on a PKCS #11 token, to authorize it with add-key",
+		Long: "Writes the public key of an RSA key held on a PKCS #11 token (e.g. a YubiKey), in the format add-key\n" +
+			"takes, so that the key can be authorized and then used with --pkcs11-module.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			pubPath := args[0]
+
+			bindPFlag(cmd, pkcs11ModuleFlag)
+			bindPFlag(cmd, pkcs11TokenFlag)
+			bindPFlag(cmd, pkcs11KeyFlag)
+
+			if err := writePKCS11Key(pubPath); err != nil {
+				fmt.Printf("ERROR: Failed to write PKCS #11 key: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	setupPKCS11Flags(cmd)
+
+	return cmd
+}
+
+func setupPKCS11Flags(cmd *cobra.Command) {
+	cmd.PersistentFlags().String(pkcs11ModuleFlag, "",
+		"PKCS #11 module (e.g. libykcs11.so) of a token holding the RSA key to use instead of the private key")
+	cmd.PersistentFlags().String(pkcs11TokenFlag, "", "Label of the PKCS #11 token to use, if there are several")
+	cmd.PersistentFlags().String(pkcs11KeyFlag, "", "Label of the key on the PKCS #11 token, if it holds several")
+}
+
+// loadPKCS11AuthKey opens the RSA key on a PKCS #11 token selected by the pkcs11 flags, to decrypt tokens with.
+func loadPKCS11AuthKey(keyName string, modulePath string) (sdk.Option, error) {
+	key, err := openSelectedPKCS11Key(modulePath)
+	if err != nil {
+		return nil, err
+	}
+	return sdk.WithAuthKey(keyName, key), nil
+}
+
+func writePKCS11Key(pubPath string) error {
+	modulePath, err := getStringFlag(pkcs11ModuleFlag)
+	if err != nil {
+		return err
+	}
+
+	key, err := openSelectedPKCS11Key(modulePath)
+	if err != nil {
+		return err
+	}
+
+	pubKeyBytes := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PUBLIC KEY",
+		Bytes: x509.MarshalPKCS1PublicKey(key.Public().(*rsa.PublicKey)),
+	})
+
+	if err := ioutil.WriteFile(pubPath, pubKeyBytes, lib.PublicKeyPerms); err != nil {
+		return fmt.Errorf("failed to write public key: %v", err)
+	}
+	fmt.Printf("Wrote public key to %s\n", pubPath)
+
+	return nil
+}
+
+func openSelectedPKCS11Key(rawModulePath string) (crypto.Decrypter, error) {
+	modulePath, err := homedir.Expand(rawModulePath)
+	if err != nil {
+		return nil, fmt.Errorf("error locating PKCS #11 module: %v", err)
+	}
+	return openPKCS11Key(modulePath, viper.GetString(pkcs11TokenFlag), viper.GetString(pkcs11KeyFlag))
+}
@@ -0,0 +1,14 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"crypto"
+	"fmt"
+)
+
+// openPKCS11Key needs cgo to load the PKCS #11 module.
+func openPKCS11Key(modulePath string, tokenLabel string, keyLabel string) (crypto.Decrypter, error) {
+	return nil, fmt.Errorf("PKCS #11 is not supported by this build of dead-drop, it must be built with cgo")
+}
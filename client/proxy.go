@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/spf13/viper"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const socks5Version = 5
+
+// socks5Errors describes the reply codes of SOCKS5 CONNECT requests (RFC 1928).
+var socks5Errors = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// configureProxy routes the http transport through the proxy flag, if set. Hidden services (.onion remotes) can only
+// be reached through a SOCKS5 proxy such as Tor.
+func configureProxy(transport *http.Transport, dialTimeout time.Duration, remote string) error {
+	rawProxy := viper.GetString(proxyFlag)
+	if rawProxy == "" {
+		if remoteURL, err := url.Parse(remote); err == nil && strings.HasSuffix(remoteURL.Hostname(), ".onion") {
+			return fmt.Errorf("onion remotes can only be reached through Tor, e.g. with '--%s socks5://127.0.0.1:9050'",
+				proxyFlag)
+		}
+		return nil
+	}
+
+	proxyURL, err := url.Parse(rawProxy)
+	if err != nil {
+		return fmt.Errorf("invalid proxy: %v", err)
+	}
+
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		dialer := &socks5Dialer{proxyAddr: proxyURL.Host, dialer: &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}}
+		if proxyURL.User != nil {
+			dialer.username = proxyURL.User.Username()
+			dialer.password, _ = proxyURL.User.Password()
+		}
+		transport.Proxy = nil
+		transport.DialContext = dialer.DialContext
+	case "http", "https":
+		transport.Proxy = http.ProxyURL(proxyURL)
+	default:
+		return fmt.Errorf("unsupported proxy scheme '%s', use socks5, http or https", proxyURL.Scheme)
+	}
+	return nil
+}
+
+// socks5Dialer connects through a SOCKS5 proxy. Host names are always resolved by the proxy, so that lookups don't
+// leak around it, and so that Tor can reach .onion addresses.
+type socks5Dialer struct {
+	proxyAddr string
+	username  string
+	password  string
+	dialer    *net.Dialer
+}
+
+func (dialer *socks5Dialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("SOCKS5 proxies only support tcp, not %s", network)
+	}
+
+	conn, err := dialer.dialer.DialContext(ctx, "tcp", dialer.proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to SOCKS5 proxy: %v", err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := dialer.connect(conn, addr); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy failed to connect to %s: %v", addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// connect negotiates authentication with the proxy and asks it to connect to addr.
+func (dialer *socks5Dialer) connect(conn net.Conn, addr string) error {
+	host, rawPort, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(rawPort, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port '%s'", rawPort)
+	}
+
+	methods := []byte{0}
+	if dialer.username != "" {
+		methods = []byte{2}
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("not a SOCKS5 proxy")
+	}
+	switch reply[1] {
+	case 0:
+	case 2:
+		if err := dialer.authenticate(conn); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("no supported authentication method")
+	}
+
+	request := []byte{socks5Version, 1, 0}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		request = append(append(request, 1), ip.To4()...)
+	} else if ip != nil {
+		request = append(append(request, 4), ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long")
+		}
+		request = append(append(request, 3, byte(len(host))), host...)
+	}
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		if message, ok := socks5Errors[header[1]]; ok {
+			return fmt.Errorf("%s", message)
+		}
+		return fmt.Errorf("unknown error %d", header[1])
+	}
+
+	// Skip the address the proxy bound, which isn't needed.
+	var boundLen int
+	switch header[3] {
+	case 1:
+		boundLen = net.IPv4len
+	case 4:
+		boundLen = net.IPv6len
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		boundLen = int(length[0])
+	default:
+		return fmt.Errorf("invalid reply address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, boundLen+2))
+	return err
+}
+
+// authenticate authenticates with the proxy's username and password (RFC 1929).
+func (dialer *socks5Dialer) authenticate(conn net.Conn) error {
+	if len(dialer.username) > 255 || len(dialer.password) > 255 {
+		return fmt.Errorf("username or password too long")
+	}
+
+	request := append([]byte{1, byte(len(dialer.username))}, dialer.username...)
+	request = append(append(request, byte(len(dialer.password))), dialer.password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("authentication failed")
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/x509"
+	"dead-drop/lib"
+	"encoding/pem"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"github.com/mitchellh/go-homedir"
+	"io/ioutil"
+	"strings"
+)
+
+const keyTypeRSA = "rsa"
+const keyTypeEd25519 = "ed25519"
+const keyTypeX25519 = "x25519"
+const keyTypeAge = "age"
+
+// loadRecipient loads a recipient's public key, either an RSA public key as written by gen-key (e.g. their authorized
+// key), an X25519 public key as written by gen-key --type x25519, or an age public key ("age1...") or file holding one.
+func loadRecipient(rawPath string) (lib.Recipient, error) {
+	if strings.HasPrefix(rawPath, "age1") {
+		return lib.ParseAgeRecipient(rawPath)
+	}
+
+	keyBytes, err := readKeyFile(rawPath, "recipient public key")
+	if err != nil {
+		return nil, err
+	}
+	defer memguard.WipeBytes(keyBytes)
+
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return loadAgeRecipient(keyBytes)
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		pubKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key: %v", err)
+		}
+		return &lib.RSARecipient{Key: pubKey}, nil
+	case lib.X25519PublicKeyType:
+		return lib.NewX25519Recipient(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported public key type '%s'", block.Type)
+	}
+}
+
+// loadAgeRecipient parses the first age public key in a file, skipping blank lines and # comments.
+func loadAgeRecipient(keyBytes []byte) (lib.Recipient, error) {
+	for _, line := range strings.Split(string(keyBytes), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return lib.ParseAgeRecipient(line)
+		}
+	}
+	return nil, fmt.Errorf("failed to decode pem bytes")
+}
+
+// loadIdentity loads the private keys to pull objects encrypted to their public keys with: an RSA or X25519 key, or
+// the keys of an age identity file.
+func loadIdentity(rawPath string) ([]lib.Identity, error) {
+	keyBytes, err := readKeyFile(rawPath, "identity")
+	if err != nil {
+		return nil, err
+	}
+	defer memguard.WipeBytes(keyBytes)
+
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		ageIdentities, err := lib.ParseAgeIdentities(keyBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		identities := make([]lib.Identity, 0, len(ageIdentities))
+		for _, identity := range ageIdentities {
+			identities = append(identities, identity)
+		}
+		return identities, nil
+	}
+	defer memguard.WipeBytes(block.Bytes)
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %v", err)
+		}
+		return []lib.Identity{&lib.RSAIdentity{Key: privKey}}, nil
+	case lib.X25519PrivateKeyType:
+		identity, err := lib.NewX25519Identity(memguard.NewBufferFromBytes(block.Bytes))
+		if err != nil {
+			return nil, err
+		}
+		return []lib.Identity{identity}, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type '%s'", block.Type)
+	}
+}
+
+// readKeyFile reads a key file, whose bytes should be wiped once parsed.
+func readKeyFile(rawPath string, description string) ([]byte, error) {
+	path, err := homedir.Expand(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("error locating %s: %v", description, err)
+	}
+
+	keyBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s '%s': %v", description, path, err)
+	}
+	return keyBytes, nil
+}
+
+// x25519KeyGen writes a new X25519 key-pair, for use as a recipient key.
+func x25519KeyGen(privPath string, pubPath string) error {
+	identity := lib.GenerateX25519Identity()
+	defer identity.Destroy()
+
+	privKeyBytes := identity.EncodePEM()
+	defer memguard.WipeBytes(privKeyBytes)
+
+	if err := ioutil.WriteFile(privPath, privKeyBytes, lib.PrivateKeyPerms); err != nil {
+		return fmt.Errorf("failed to write private key: %v", err)
+	}
+	fmt.Printf("Wrote private key to %s\n", privPath)
+
+	if err := ioutil.WriteFile(pubPath, identity.Recipient().EncodePEM(), lib.PublicKeyPerms); err != nil {
+		return fmt.Errorf("failed to write public key: %v", err)
+	}
+	fmt.Printf("Wrote public key to %s\n", pubPath)
+
+	return nil
+}
+
+// ageKeyGen writes a new age identity file, and its public key, for use as a recipient key with the age tool too.
+func ageKeyGen(privPath string, pubPath string) error {
+	identity := lib.GenerateX25519Identity()
+	defer identity.Destroy()
+
+	privKeyBytes, err := identity.EncodeAge()
+	if err != nil {
+		return err
+	}
+	defer memguard.WipeBytes(privKeyBytes)
+
+	if err := ioutil.WriteFile(privPath, privKeyBytes, lib.PrivateKeyPerms); err != nil {
+		return fmt.Errorf("failed to write private key: %v", err)
+	}
+	fmt.Printf("Wrote private key to %s\n", privPath)
+
+	if err := ioutil.WriteFile(pubPath, []byte(identity.Recipient().String()+"\n"), lib.PublicKeyPerms); err != nil {
+		return fmt.Errorf("failed to write public key: %v", err)
+	}
+	fmt.Printf("Wrote public key to %s (%s)\n", pubPath, identity.Recipient())
+
+	return nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"dead-drop/sdk"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const syncManifestVersion = 1
+
+func setupSyncCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sync <dir> [manifest]",
+		Short: "Drop the files of a directory which changed since a manifest, and drop an updated manifest",
+		Long: "Drop the files of a directory which changed since a manifest, and drop an updated manifest.\n\n" +
+			"The manifest is an object listing the files of the directory, with their SHA-256 hashes and the\n" +
+			"references of the objects they were dropped as. Only files whose hash isn't in the previous manifest,\n" +
+			"or whose object the remote no longer has, are dropped; leave the manifest out to drop every file.\n" +
+			"The reference of the updated manifest is printed, to pass to the next sync.",
+		Args: cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			dir := args[0]
+			var manifest string
+			if len(args) > 1 {
+				manifest = args[1]
+			}
+
+			bindDropFlags(cmd)
+
+			or, err := syncDir(dir, manifest)
+			if err != nil {
+				fmt.Printf("ERROR: Failed to sync '%s': %v\n", dir, err)
+				os.Exit(1)
+			}
+
+			ref, err := formatRef(or)
+			if err != nil {
+				fmt.Printf("ERROR: Synced %s -> %s, but %v\n", dir, or, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Synced %s -> %s\n", dir, ref)
+		},
+	}
+
+	setupDropFlags(cmd)
+
+	return cmd
+}
+
+// syncManifest lists the files of a synced directory, and the objects they were dropped as.
+type syncManifest struct {
+	Version int         `json:"version"`
+	Files   []syncEntry `json:"files"`
+}
+
+type syncEntry struct {
+	// Path is relative to the synced directory, with / separators.
+	Path     string      `json:"path"`
+	Size     int64       `json:"size"`
+	Mode     os.FileMode `json:"mode"`
+	Modified time.Time   `json:"modified"`
+	SHA256   string      `json:"sha256"`
+	Object   string      `json:"object"`
+}
+
+// syncDir drops the files of a directory which changed since the manifest (which may be empty, to drop every file),
+// and then an updated manifest. Files are dropped to the remote the manifest names, if it is a link.
+func syncDir(dir string, manifest string) (*sdk.ObjectReference, error) {
+	opts := dropOptions()
+	if opts.Raw {
+		return nil, fmt.Errorf("flag '%s' can't be used to sync", rawFlag)
+	}
+
+	if info, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("not a directory")
+	}
+
+	var previousRef *sdk.ObjectReference
+	if manifest != "" {
+		var err error
+		if previousRef, err = sdk.ParseObjectReference(manifest); err != nil {
+			return nil, err
+		}
+	}
+
+	keys, err := loadKeys(true)
+	if err != nil {
+		return nil, err
+	}
+	defer keys.Destroy()
+
+	var client *sdk.Client
+	if previousRef != nil {
+		client, err = newObjectClient(previousRef, sdk.WithKeys(keys))
+	} else {
+		client, err = newClient(sdk.WithKeys(keys))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	previous := map[string]syncEntry{}
+	if previousRef != nil {
+		old, err := pullSyncManifest(previousRef, keys)
+		if err != nil {
+			return nil, fmt.Errorf("error pulling manifest: %v", err)
+		}
+		for _, entry := range old.Files {
+			previous[entry.Path] = entry
+		}
+	}
+
+	ctx := context.Background()
+	updated := &syncManifest{Version: syncManifestVersion}
+	var dropped, unchanged int
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Only regular files are synced; symlinks and other special files are skipped.
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		entry := syncEntry{
+			Path:     filepath.ToSlash(relPath),
+			Size:     info.Size(),
+			Mode:     info.Mode().Perm(),
+			Modified: info.ModTime().UTC(),
+		}
+		if entry.SHA256, err = hashFile(path); err != nil {
+			return err
+		}
+
+		if old, ok := previous[entry.Path]; ok && old.SHA256 == entry.SHA256 && objectExists(ctx, client, old.Object) {
+			entry.Object = old.Object
+			updated.Files = append(updated.Files, entry)
+			unchanged++
+			return nil
+		}
+
+		fileOpts := *opts
+		fileOpts.Name = filepath.Base(path)
+		or, err := dropPath(ctx, client, path, fileOpts)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Dropped %s -> %s\n", entry.Path, or)
+		entry.Object = or.String()
+		updated.Files = append(updated.Files, entry)
+		dropped++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	removed := len(previous)
+	for _, entry := range updated.Files {
+		if _, ok := previous[entry.Path]; ok {
+			removed--
+		}
+	}
+	fmt.Printf("%d files dropped, %d unchanged, %d removed\n", dropped, unchanged, removed)
+
+	return dropSyncManifest(ctx, client, updated, *opts)
+}
+
+// hashFile returns the hex SHA-256 hash of a file's content.
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading file '%s': %v", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("error reading file '%s': %v", path, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// objectExists reports whether the remote still has an object listed in a manifest, which it may have deleted since
+// it expired or was pulled. Objects which can't be stat'ed are dropped again.
+func objectExists(ctx context.Context, client *sdk.Client, object string) bool {
+	or, err := sdk.ParseObjectReference(object)
+	if err != nil {
+		return false
+	}
+	_, err = client.Stat(ctx, or.Oid)
+	return err == nil
+}
+
+// pullSyncManifest pulls and decodes a manifest. Drop keys which encrypt to recipients can't decrypt it, so the
+// encryption key, keyring or identity flags are loaded for pulls instead.
+func pullSyncManifest(or *sdk.ObjectReference, keys encryptionKeys) (*syncManifest, error) {
+	if len(viper.GetStringSlice(recipientFlag)) > 0 {
+		pullKeys, err := loadKeys(false)
+		if err != nil {
+			return nil, err
+		}
+		defer pullKeys.Destroy()
+		keys = pullKeys
+	}
+
+	client, err := newObjectClient(or, sdk.WithKeys(keys))
+	if err != nil {
+		return nil, err
+	}
+
+	reader, _, err := client.PullStream(context.Background(), or)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// The whole object is read before decoding it, since it is only verified once it has been read to the end.
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &syncManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %v", err)
+	}
+	if manifest.Version != syncManifestVersion {
+		return nil, fmt.Errorf("manifest has unsupported version %d, try a newer client", manifest.Version)
+	}
+	return manifest, nil
+}
+
+func dropSyncManifest(
+	ctx context.Context,
+	client *sdk.Client,
+	manifest *syncManifest,
+	opts sdk.DropOptions,
+) (*sdk.ObjectReference, error) {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error encoding manifest: %v", err)
+	}
+
+	opts.Name = "manifest.json"
+	return client.Drop(ctx, data, &opts)
+}
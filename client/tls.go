@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+	"io/ioutil"
+)
+
+// newTLSConfig builds the tls configuration of the http transport from the tls flags.
+func newTLSConfig() (*tls.Config, error) {
+	pins := viper.GetStringSlice(pinnedCertFlag)
+	tlsConfig := &tls.Config{InsecureSkipVerify: viper.GetBool(insecureSkipVerifyFlag)}
+	if tlsConfig.InsecureSkipVerify && len(pins) == 0 {
+		fmt.Printf("WARN: Skipping tls certificate verification, be careful!\n")
+	}
+
+	if rawPath := viper.GetString(caCertFlag); rawPath != "" {
+		rootCAs, err := loadCACerts(rawPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if len(pins) > 0 {
+		verifyPin, err := pinVerifier(pins)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.VerifyPeerCertificate = verifyPin
+	}
+
+	certPath, keyPath := viper.GetString(clientCertFlag), viper.GetString(clientKeyFlag)
+	if certPath != "" || keyPath != "" {
+		cert, err := loadClientCert(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// pinVerifier returns a tls peer certificate check which fails unless the SHA-256 hash of the server certificate's
+// public key is one of the pins. It runs after (and with insecure-skip-verify, instead of) the usual verification.
+func pinVerifier(pins []string) (func([][]byte, [][]*x509.Certificate) error, error) {
+	pinned := make(map[[sha256.Size]byte]bool, len(pins))
+	for _, pin := range pins {
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid %s '%s', expected a base64 SHA-256 hash", pinnedCertFlag, pin)
+		}
+		var key [sha256.Size]byte
+		copy(key[:], hash)
+		pinned[key] = true
+	}
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("server sent no certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse server certificate: %v", err)
+		}
+
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if !pinned[hash] {
+			return fmt.Errorf("server certificate public key %s does not match the %s pins",
+				base64.StdEncoding.EncodeToString(hash[:]), pinnedCertFlag)
+		}
+		return nil
+	}, nil
+}
+
+// loadClientCert loads the tls client certificate presented to servers (or proxies in front of them) which require one.
+func loadClientCert(rawCertPath string, rawKeyPath string) (tls.Certificate, error) {
+	if rawCertPath == "" || rawKeyPath == "" {
+		return tls.Certificate{}, fmt.Errorf("both '%s' and '%s' must be specified", clientCertFlag, clientKeyFlag)
+	}
+
+	certPath, err := homedir.Expand(rawCertPath)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error locating client certificate: %v", err)
+	}
+	keyPath, err := homedir.Expand(rawKeyPath)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error locating client key: %v", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error loading client certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// loadCACerts reads a PEM file of CA certificates, e.g. of a private CA, to trust instead of the system roots.
+func loadCACerts(rawPath string) (*x509.CertPool, error) {
+	path, err := homedir.Expand(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("error locating CA certificate: %v", err)
+	}
+
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA certificate '%s': %v", path, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		return nil, fmt.Errorf("no PEM certificates found in '%s'", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"dead-drop/sdk"
+	"github.com/spf13/viper"
+	"net/http"
+)
+
+// newHTTPClient builds the http client the sdk makes requests with, from the tls, proxy and timeout flags. Its
+// transport keeps connections alive, so that each token request and the request it authenticates share one.
+func newHTTPClient(remote string) (*http.Client, error) {
+	timeouts := sdk.Timeouts{
+		Dial:           viper.GetDuration(connectTimeoutFlag),
+		TLSHandshake:   viper.GetDuration(tlsTimeoutFlag),
+		ResponseHeader: viper.GetDuration(responseTimeoutFlag),
+	}
+	transport := sdk.NewTransport(timeouts)
+
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	if err := configureProxy(transport, timeouts.Dial, remote); err != nil {
+		return nil, err
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"dead-drop/lib"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+func setupVersionsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "versions <alias>",
+		Short: "Lists the versions of the objects dropped under an alias",
+		Long: "Lists the versions remote stores of the objects dropped under an alias with drop --as, oldest first,\n" +
+			"by the names pull accepts, e.g. release@2, with their oid, size in bytes and when they were dropped.\n" +
+			"Remote may only keep a number of the latest versions, removing older ones as new ones are dropped.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			bindRemoteCmdFlags(cmd)
+
+			if err := versions(args[0]); err != nil {
+				fmt.Printf("ERROR: Failed to list the versions of '%s': %v\n", args[0], err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	setupRemoteCmdFlags(cmd)
+
+	return cmd
+}
+
+func versions(alias string) error {
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	payload, err := client.Versions(context.Background(), alias)
+	if err != nil {
+		return err
+	}
+
+	for _, version := range payload.Versions {
+		fmt.Printf("%-24s  %s  %12d  %s\n", fmt.Sprintf("%s%s%d", payload.Alias, lib.VersionSeparator, version.Version),
+			version.Oid, version.Size, version.Created.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"dead-drop/lib"
+	"dead-drop/sdk"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const journalName = "journal"
+
+func setupWatchCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "watch <dir>",
+		Short: "Drop files as they appear in a directory, appending their references to a journal",
+		Long: "Drop files as they appear in a directory, appending their references to a journal.\n\n" +
+			"Runs until interrupted. Files are dropped once they have gone unchanged for the settle time, so that\n" +
+			"files which are still being written aren't, and are dropped again if they change. Files in the\n" +
+			"directory when watching starts are dropped too, unless the journal shows they already were.\n" +
+			"Hidden files and subdirectories are ignored.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			dir := args[0]
+
+			bindDropFlags(cmd)
+			bindPFlag(cmd, journalFlag)
+			bindPFlag(cmd, settleFlag)
+			bindPFlag(cmd, removeFlag)
+
+			if err := watch(dir); err != nil {
+				fmt.Printf("ERROR: Failed to watch '%s': %v\n", dir, err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	setupDropFlags(cmd)
+	cmd.PersistentFlags().String(journalFlag, "",
+		"File to append the references of dropped files to (default is "+
+			filepath.Join("$HOME", lib.DefaultConfigDir, journalName)+")")
+	cmd.PersistentFlags().Duration(settleFlag, 2*time.Second, "Time a file must go unchanged before it is dropped")
+	cmd.PersistentFlags().Bool(removeFlag, false,
+		"Remove files once they have been dropped and their references written to the journal")
+
+	return cmd
+}
+
+// dropWatcher drops the files of a directory as they settle.
+type dropWatcher struct {
+	dir     string
+	client  *sdk.Client
+	opts    sdk.DropOptions
+	journal *dropJournal
+	settle  time.Duration
+	remove  bool
+	// pending holds the files which changed since they were last dropped, and when they last changed.
+	pending map[string]time.Time
+}
+
+func watch(rawDir string) error {
+	dir, err := filepath.Abs(rawDir)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("not a directory")
+	}
+
+	journalPath := viper.GetString(journalFlag)
+	if journalPath == "" {
+		journalPath = filepath.Join("~", lib.DefaultConfigDir, journalName)
+	}
+	journal, err := openDropJournal(journalPath)
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+
+	opts := dropOptions()
+	client, keys, err := newDropClient(opts)
+	if err != nil {
+		return err
+	}
+	if keys != nil {
+		defer keys.Destroy()
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error starting watcher: %v", err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(dir); err != nil {
+		return fmt.Errorf("error watching directory: %v", err)
+	}
+
+	w := &dropWatcher{
+		dir:     dir,
+		client:  client,
+		opts:    *opts,
+		journal: journal,
+		settle:  viper.GetDuration(settleFlag),
+		remove:  viper.GetBool(removeFlag),
+		pending: make(map[string]time.Time),
+	}
+
+	// Files which were already there are picked up once they settle, like new ones.
+	files, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		w.pending[filepath.Join(dir, name)] = time.Now()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	fmt.Printf("Watching %s, journal %s\n", dir, journal.path)
+
+	ticker := time.NewTicker(w.pollInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return fmt.Errorf("watcher stopped")
+			}
+			w.handleEvent(event, time.Now())
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return fmt.Errorf("watcher stopped")
+			}
+			fmt.Printf("ERROR: Watcher error: %v\n", err)
+		case <-ticker.C:
+			w.dropSettled(time.Now())
+		case sig := <-signals:
+			fmt.Printf("Stopping on %v\n", sig)
+			return nil
+		}
+	}
+}
+
+func readDirNames(dir string) ([]string, error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.Readdirnames(-1)
+}
+
+// pollInterval is how often settled files are looked for, which bounds how late they are dropped.
+func (w *dropWatcher) pollInterval() time.Duration {
+	interval := w.settle / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	return interval
+}
+
+func (w *dropWatcher) handleEvent(event fsnotify.Event, now time.Time) {
+	if event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+		w.pending[event.Name] = now
+	} else if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		delete(w.pending, event.Name)
+	}
+}
+
+// dropSettled drops the pending files which have gone unchanged for the settle time.
+func (w *dropWatcher) dropSettled(now time.Time) {
+	for path, changed := range w.pending {
+		if now.Sub(changed) < w.settle {
+			continue
+		}
+		delete(w.pending, path)
+
+		if err := w.dropFile(path); err != nil {
+			fmt.Printf("ERROR: Failed to drop file '%s': %v\n", path, err)
+		}
+	}
+}
+
+// dropFile drops a file, unless it should be ignored or the journal shows it was already dropped as it is.
+func (w *dropWatcher) dropFile(path string) error {
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, ".") || path == w.journal.path {
+		return nil
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	modified := info.ModTime().UTC().Format(time.RFC3339Nano)
+	if w.journal.dropped(path, modified) {
+		return nil
+	}
+
+	or, err := dropPath(context.Background(), w.client, path, w.opts)
+	if err != nil {
+		return err
+	}
+	ref, err := formatRef(or)
+	if err != nil {
+		fmt.Printf("ERROR: Can't print the reference %s as configured: %v\n", or, err)
+		ref = or.String()
+	}
+
+	if err := w.journal.record(path, modified, ref); err != nil {
+		// The reference is still printed, but the file is kept, since the journal may be all that was looked at.
+		fmt.Printf("ERROR: Dropped %s -> %s, but failed to write the journal: %v\n", path, ref, err)
+		return nil
+	}
+	fmt.Printf("Dropped %s -> %s\n", path, ref)
+
+	if w.remove {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("dropped, but failed to remove the file: %v", err)
+		}
+	}
+	return nil
+}
+
+// dropJournal is an append-only log of the files dropped by watch, one per line:
+// <time dropped> <time the file was last modified> <reference> <path>.
+type dropJournal struct {
+	path string
+	file *os.File
+	// entries maps the paths of dropped files to when they were last modified, so that restarts don't drop them again.
+	entries map[string]string
+}
+
+func openDropJournal(rawPath string) (*dropJournal, error) {
+	path, err := homedir.Expand(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("error locating journal: %v", err)
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("error creating journal directory: %v", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, lib.PrivateKeyPerms)
+	if err != nil {
+		return nil, fmt.Errorf("error opening journal: %v", err)
+	}
+
+	journal := &dropJournal{path: path, file: file, entries: make(map[string]string)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 4)
+		if len(fields) == 4 {
+			journal.entries[fields[3]] = fields[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error reading journal: %v", err)
+	}
+	return journal, nil
+}
+
+func (journal *dropJournal) dropped(path string, modified string) bool {
+	return journal.entries[path] == modified
+}
+
+// record appends a dropped file to the journal, and syncs it, since it may hold the only copy of the reference.
+func (journal *dropJournal) record(path string, modified string, ref string) error {
+	line := fmt.Sprintf("%s %s %s %s\n", time.Now().UTC().Format(time.RFC3339), modified, ref, path)
+	if _, err := journal.file.WriteString(line); err != nil {
+		return err
+	}
+	if err := journal.file.Sync(); err != nil {
+		return err
+	}
+	journal.entries[path] = modified
+	return nil
+}
+
+func (journal *dropJournal) Close() error {
+	return journal.file.Close()
+}
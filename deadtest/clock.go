@@ -0,0 +1,47 @@
+package deadtest
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a server.Clock which only moves when advanced, so tests of expiry, embargoes and check-ins needn't wait for
+// them. Sleeps block until the clock is advanced past them, as the server's background jobs expect.
+type Clock struct {
+	lock  sync.Mutex
+	moved *sync.Cond
+	now   time.Time
+}
+
+// NewClock returns a clock at the current time, rounded down to the second so that times sent in RFC 3339 compare as
+// they were set.
+func NewClock() *Clock {
+	clock := &Clock{now: time.Now().Truncate(time.Second)}
+	clock.moved = sync.NewCond(&clock.lock)
+	return clock
+}
+
+// Now returns the time the clock was last advanced to.
+func (clock *Clock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.now
+}
+
+// Sleep blocks until the clock is advanced by d.
+func (clock *Clock) Sleep(d time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	until := clock.now.Add(d)
+	for clock.now.Before(until) {
+		clock.moved.Wait()
+	}
+}
+
+// Advance moves the clock forward by d, waking the sleeps which end by then.
+func (clock *Clock) Advance(d time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	clock.now = clock.now.Add(d)
+	clock.moved.Broadcast()
+}
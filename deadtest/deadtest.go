@@ -0,0 +1,126 @@
+// Package deadtest runs dead-drop servers in memory, for tests of programs which use the sdk. Servers are reached at
+// memory:// remotes whose requests are served in-process, so tests need no network, tls or server binary.
+package deadtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"dead-drop/lib"
+	"dead-drop/sdk"
+	"dead-drop/server"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+)
+
+// servers counts the servers started, to name their remotes.
+var servers uint64
+
+// Server is a dead-drop server which keeps objects, their metadata and authorized keys in memory. Only the parts of
+// uploads in progress are written to disk, in a temporary directory which Close removes.
+type Server struct {
+	// URL is the remote of the server, e.g. memory://deadtest-1, which clients using sdk transports reach.
+	URL     string
+	Objects *MemoryObjects
+	Metas   *MemoryMetas
+	Keys    *MemoryKeys
+
+	name    string
+	server  *server.Server
+	dataDir string
+}
+
+// NewServer starts a server with the default settings, panicking if it fails to, as httptest.NewServer does.
+func NewServer() *Server {
+	return NewServerWithSettings(nil)
+}
+
+// NewServerWithSettings starts a server with settings named as in the config file, e.g. "ttl-min", panicking if it
+// fails to.
+func NewServerWithSettings(settings map[string]interface{}) *Server {
+	return NewServerWithClock(settings, nil)
+}
+
+// NewServerWithClock starts a server with settings whose time is kept by a clock, e.g. a Clock advanced by the test,
+// panicking if it fails to. A nil clock is the system clock.
+func NewServerWithClock(settings map[string]interface{}, clock server.Clock) *Server {
+	dataDir, err := ioutil.TempDir("", "deadtest")
+	if err != nil {
+		panic(fmt.Sprintf("deadtest: failed to create data directory: %v", err))
+	}
+
+	shareKey := make([]byte, 32)
+	if _, err := rand.Read(shareKey); err != nil {
+		panic(fmt.Sprintf("deadtest: failed to generate share key: %v", err))
+	}
+	config := server.Config{
+		Settings: map[string]interface{}{
+			"data-dir":  dataDir,
+			"share-key": hex.EncodeToString(shareKey),
+		},
+		Store: NewMemoryObjects(),
+		Metas: NewMemoryMetas(),
+		Keys:  NewMemoryKeys(),
+		Clock: clock,
+	}
+	for name, value := range settings {
+		config.Settings[name] = value
+	}
+
+	deadDrop := server.New(config)
+	handler, err := deadDrop.Handler()
+	if err != nil {
+		os.RemoveAll(dataDir)
+		panic(fmt.Sprintf("deadtest: failed to start server: %v", err))
+	}
+
+	name := fmt.Sprintf("deadtest-%d", atomic.AddUint64(&servers, 1))
+	return &Server{
+		URL:     sdk.RegisterMemoryRemote(name, handler),
+		Objects: config.Store.(*MemoryObjects),
+		Metas:   config.Metas.(*MemoryMetas),
+		Keys:    config.Keys.(*MemoryKeys),
+		name:    name,
+		server:  deadDrop,
+		dataDir: dataDir,
+	}
+}
+
+// AuthorizeKey authorizes a new Ed25519 key under a name, returning its private key.
+func (srv *Server) AuthorizeKey(keyName string) (ed25519.PrivateKey, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	encoded := pem.EncodeToMemory(&pem.Block{Type: lib.Ed25519PublicKeyType, Bytes: publicKey})
+	if err := srv.Keys.AddKey(keyName, encoded); err != nil {
+		return nil, err
+	}
+	return privateKey, nil
+}
+
+// Client returns a client of the server which authenticates with a new key authorized under a name, and encrypts
+// with a new encryption key unless opts give it keys.
+func (srv *Server) Client(keyName string, opts ...sdk.Option) (*sdk.Client, error) {
+	authKey, err := srv.AuthorizeKey(keyName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to authorize key %s: %v", keyName, err)
+	}
+
+	defaults := []sdk.Option{
+		sdk.WithSigningAuthKey(keyName, authKey),
+		sdk.WithKeys(&sdk.KeySet{Key: memguard.NewBufferRandom(32)}),
+	}
+	return sdk.New(srv.URL, append(defaults, opts...)...), nil
+}
+
+// Close stops serving the server's remote, and removes its data directory.
+func (srv *Server) Close() {
+	sdk.UnregisterMemoryRemote(srv.name)
+	srv.server.Shutdown()
+	os.RemoveAll(srv.dataDir)
+}
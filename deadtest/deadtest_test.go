@@ -0,0 +1,1178 @@
+package deadtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"dead-drop/lib"
+	"dead-drop/sdk"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newClient returns a client of srv authenticating with a new key authorized under a name, failing the test if the key
+// can't be authorized.
+func newClient(t *testing.T, srv *Server, keyName string, opts ...sdk.Option) *sdk.Client {
+	client, err := srv.Client(keyName, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// withKey has a client encrypt with a copy of key, so that clients of several keys can decrypt each other's objects.
+func withKey(key []byte) sdk.Option {
+	return sdk.WithKeys(&sdk.KeySet{Key: memguard.NewBufferFromBytes(append([]byte{}, key...))})
+}
+
+func TestDropPull(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	client := newClient(t, srv, "alice")
+
+	ctx := context.Background()
+	data := []byte("the eagle has landed")
+	ref, err := client.Drop(ctx, data, &sdk.DropOptions{Note: "hello"})
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+	if meta, err := srv.Metas.Read(ref.Oid); err != nil || meta == nil || meta.Owner != "alice" {
+		t.Fatalf("expected metadata of an object owned by alice, found %v (%v)", meta, err)
+	}
+
+	pulled, metadata, err := client.Pull(ctx, ref)
+	if err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	if !bytes.Equal(pulled, data) {
+		t.Errorf("pulled %q, expected %q", pulled, data)
+	}
+	if metadata.Note != "hello" {
+		t.Errorf("pulled note %q, expected %q", metadata.Note, "hello")
+	}
+}
+
+func TestUnauthorizedKey(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	client := newClient(t, srv, "alice")
+	if err := srv.Keys.RemoveKey("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Drop(context.Background(), []byte("data"), nil); err == nil {
+		t.Errorf("dropped with a key which isn't authorized")
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	alice := newClient(t, srv, "alice")
+	admin := newClient(t, srv, "admin")
+
+	ctx := context.Background()
+	ref, err := alice.Drop(ctx, []byte("the eagle has landed"), nil)
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+
+	listing, err := admin.AdminObjects(ctx, "", 0, nil)
+	if err != nil {
+		t.Fatalf("listing failed: %v", err)
+	}
+	if len(listing.Objects) != 1 || listing.Objects[0].Oid != ref.Oid || listing.Objects[0].Owner != "alice" {
+		t.Fatalf("expected alice's object to be listed, found %+v", listing.Objects)
+	}
+
+	usage, err := admin.AdminUsage(ctx)
+	if err != nil {
+		t.Fatalf("usage failed: %v", err)
+	}
+	if usage.Objects != 1 || usage.Keys["alice"] != usage.Bytes || usage.Bytes == 0 {
+		t.Errorf("expected alice to use all %d bytes of 1 object, found %+v", usage.Bytes, usage)
+	}
+
+	if err := admin.AdminRemove(ctx, ref.Oid); err != nil {
+		t.Fatalf("removal failed: %v", err)
+	}
+	if _, _, err := alice.Pull(ctx, ref); err == nil {
+		t.Errorf("pulled an object the admin removed")
+	}
+
+	keys, err := admin.AdminKeys(ctx)
+	if err != nil {
+		t.Fatalf("listing keys failed: %v", err)
+	}
+	if len(keys.Keys) != 2 || keys.Keys[0].KeyName != "admin" || keys.Keys[1].KeyName != "alice" {
+		t.Errorf("expected the keys admin and alice, found %+v", keys.Keys)
+	}
+
+	if err := admin.AdminRotateSecret(ctx, true); err != nil {
+		t.Fatalf("rotating the secret failed: %v", err)
+	}
+	if _, err := admin.AdminGC(ctx); err != nil {
+		t.Errorf("gc after revoking tokens failed: %v", err)
+	}
+}
+
+// addClient returns a client of a new key which admin authorizes with opts.
+func addClient(t *testing.T, srv *Server, admin *sdk.Client, keyName string, opts *sdk.AddKeyOptions,
+	clientOpts ...sdk.Option) *sdk.Client {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := pem.EncodeToMemory(&pem.Block{Type: lib.Ed25519PublicKeyType, Bytes: publicKey})
+	if err := admin.AddKeyWithOptions(context.Background(), encoded, keyName, opts); err != nil {
+		t.Fatalf("adding key %s failed: %v", keyName, err)
+	}
+	return sdk.New(srv.URL, append([]sdk.Option{sdk.WithSigningAuthKey(keyName, privateKey)}, clientOpts...)...)
+}
+
+func TestRoles(t *testing.T) {
+	srv := NewServerWithSettings(map[string]interface{}{"destructive-read": false})
+	defer srv.Close()
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	admin := newClient(t, srv, "admin", withKey(key))
+	ctx := context.Background()
+	or, err := admin.Drop(ctx, []byte("roles"), nil)
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+	added, err := srv.Keys.Key("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		role   string
+		drop   bool
+		pull   bool
+		addKey bool
+	}{
+		{lib.KeyRoleReadOnly, false, true, false},
+		{lib.KeyRoleWriteOnly, true, false, false},
+		{lib.KeyRoleAdmin, true, true, true},
+	} {
+		client := addClient(t, srv, admin, test.role, &sdk.AddKeyOptions{Role: test.role}, withKey(key))
+
+		_, err := client.Drop(ctx, []byte("roles"), nil)
+		if (err == nil) != test.drop {
+			t.Errorf("drop of a %s key failed with %v, expected it to succeed: %t", test.role, err, test.drop)
+		}
+		_, _, err = client.Pull(ctx, or)
+		if (err == nil) != test.pull {
+			t.Errorf("pull of a %s key failed with %v, expected it to succeed: %t", test.role, err, test.pull)
+		}
+		err = client.AddKey(ctx, added, test.role+"-added")
+		if (err == nil) != test.addKey {
+			t.Errorf("add-key of a %s key failed with %v, expected it to succeed: %t", test.role, err, test.addKey)
+		}
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	srv := NewServerWithSettings(map[string]interface{}{"destructive-read": false})
+	defer srv.Close()
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	admin := newClient(t, srv, "admin", withKey(key))
+	alice := addClient(t, srv, admin, "alice", &sdk.AddKeyOptions{Namespace: "team-a"}, withKey(key),
+		sdk.WithNamespace("team-a"))
+	bob := addClient(t, srv, admin, "bob", &sdk.AddKeyOptions{Namespace: "team-b"}, withKey(key),
+		sdk.WithNamespace("team-b"))
+
+	ctx := context.Background()
+	or, err := alice.Drop(ctx, []byte("team-a only"), nil)
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+	if _, _, err := alice.Pull(ctx, or); err != nil {
+		t.Errorf("pull in the object's namespace failed: %v", err)
+	}
+
+	// Objects of other namespaces are answered as if there were no such object, to keys of the default namespace too.
+	for name, client := range map[string]*sdk.Client{"bob": bob, "admin": admin} {
+		if _, _, err := client.Pull(ctx, or); err == nil || !strings.Contains(err.Error(), "404") {
+			t.Errorf("%s pulled an object of another namespace: %v", name, err)
+		}
+	}
+
+	// Keys can't address other namespaces, nor add keys to them.
+	intruder := addClient(t, srv, admin, "mallory", &sdk.AddKeyOptions{Namespace: "team-b"}, withKey(key),
+		sdk.WithNamespace("team-a"))
+	if _, _, err := intruder.Pull(ctx, or); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("a key of team-b pulled through team-a: %v", err)
+	}
+	if _, err := intruder.Drop(ctx, []byte("intrusion"), nil); err == nil {
+		t.Errorf("a key of team-b dropped into team-a")
+	}
+	added, err := srv.Keys.Key("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.AddKeyWithOptions(ctx, added, "carol", &sdk.AddKeyOptions{Namespace: "team-b"}); err == nil {
+		t.Errorf("a key of team-a added a key to team-b")
+	}
+}
+
+func TestListFilters(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	client := newClient(t, srv, "alice")
+
+	ctx := context.Background()
+	small, err := client.Drop(ctx, []byte("small"), nil)
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+	large, err := client.Drop(ctx, bytes.Repeat([]byte("large"), 1000), nil)
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+
+	listing, err := client.ListWithOptions(ctx, "", 0, &sdk.ListOptions{MinSize: 1000})
+	if err != nil {
+		t.Fatalf("listing failed: %v", err)
+	}
+	if len(listing.Objects) != 1 || listing.Objects[0].Oid != large.Oid {
+		t.Errorf("expected only %s to be at least 1000 bytes, found %+v", large.Oid, listing.Objects)
+	}
+
+	listing, err = client.ListWithOptions(ctx, "", 0, &sdk.ListOptions{MaxSize: 1000})
+	if err != nil {
+		t.Fatalf("listing failed: %v", err)
+	}
+	if len(listing.Objects) != 1 || listing.Objects[0].Oid != small.Oid {
+		t.Errorf("expected only %s to be at most 1000 bytes, found %+v", small.Oid, listing.Objects)
+	}
+
+	listing, err = client.ListWithOptions(ctx, "", 1, &sdk.ListOptions{Since: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatalf("listing failed: %v", err)
+	}
+	if len(listing.Objects) != 1 || listing.Next == "" {
+		t.Errorf("expected a first page of 1 of 2 objects dropped in the last hour, found %+v", listing)
+	}
+
+	listing, err = client.ListWithOptions(ctx, "", 0, &sdk.ListOptions{Until: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatalf("listing failed: %v", err)
+	}
+	if len(listing.Objects) != 0 {
+		t.Errorf("expected no objects dropped over an hour ago, found %+v", listing.Objects)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	client := newClient(t, srv, "alice")
+
+	ctx := context.Background()
+	prod, err := client.Drop(ctx, []byte("prod"), &sdk.DropOptions{Labels: map[string]string{"env": "prod", "team": "ci"}})
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+	if _, err := client.Drop(ctx, []byte("dev"), &sdk.DropOptions{Labels: map[string]string{"env": "dev"}}); err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+	if _, err := client.Drop(ctx, []byte("bad"), &sdk.DropOptions{Labels: map[string]string{"Env": "x"}}); err == nil {
+		t.Errorf("dropped an object with an invalid label")
+	}
+
+	listing, err := client.ListWithOptions(ctx, "", 0, &sdk.ListOptions{Labels: map[string]string{"env": "prod"}})
+	if err != nil {
+		t.Fatalf("listing failed: %v", err)
+	}
+	if len(listing.Objects) != 1 || listing.Objects[0].Oid != prod.Oid || listing.Objects[0].Labels["team"] != "ci" {
+		t.Errorf("expected only %s to be labelled env=prod, found %+v", prod.Oid, listing.Objects)
+	}
+
+	info, err := client.Stat(ctx, prod.Oid)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if info.Labels["env"] != "prod" {
+		t.Errorf("expected stat to show the label env=prod, found %v", info.Labels)
+	}
+}
+
+func TestContentOids(t *testing.T) {
+	srv := NewServerWithSettings(map[string]interface{}{"oid-mode": "content"})
+	defer srv.Close()
+
+	alice := newClient(t, srv, "alice")
+	bob := newClient(t, srv, "bob")
+
+	ctx := context.Background()
+	data := []byte(lib.AgePrefix + "-> X25519 not really an age file")
+	ref, err := alice.Drop(ctx, data, &sdk.DropOptions{Raw: true})
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	if ref.Oid != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected the oid to be the SHA-256 of the data, found %s", ref.Oid)
+	}
+
+	again, err := alice.Drop(ctx, data, &sdk.DropOptions{Raw: true})
+	if err != nil {
+		t.Fatalf("dropping the same data again failed: %v", err)
+	}
+	if again.Oid != ref.Oid {
+		t.Errorf("expected the same data to be dropped as %s, found %s", ref.Oid, again.Oid)
+	}
+	if listing, err := alice.List(ctx, "", 0); err != nil || len(listing.Objects) != 1 {
+		t.Errorf("expected 1 stored object, found %+v (%v)", listing, err)
+	}
+
+	if _, err := bob.Drop(ctx, data, &sdk.DropOptions{Raw: true}); err == nil {
+		t.Errorf("dropped the same data as another key")
+	}
+
+	if _, err := alice.Verify(ctx, ref); err != nil {
+		t.Errorf("verify failed: %v", err)
+	}
+}
+
+func TestOidAlphabet(t *testing.T) {
+	srv := NewServerWithSettings(map[string]interface{}{"oid-alphabet": "words", "oid-length": 4})
+	defer srv.Close()
+
+	client := newClient(t, srv, "alice")
+
+	ref, err := client.Drop(context.Background(), []byte("the eagle has landed"), nil)
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+
+	words := make(map[string]bool, len(lib.Words))
+	for _, word := range lib.Words {
+		words[word] = true
+	}
+	split := strings.Split(ref.Oid, "-")
+	if len(split) != 4 || !words[split[0]] || !words[split[1]] || !words[split[2]] || !words[split[3]] {
+		t.Errorf("expected an oid of 4 words, found %s", ref.Oid)
+	}
+}
+
+func TestPhrases(t *testing.T) {
+	srv := NewServerWithSettings(map[string]interface{}{"oid-alphabet": "words", "oid-length": 4})
+	defer srv.Close()
+
+	client := newClient(t, srv, "alice")
+
+	ctx := context.Background()
+	data := []byte("the eagle has landed")
+	dropped, err := client.Drop(ctx, data, nil)
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+	phrase, err := dropped.Phrase()
+	if err != nil {
+		t.Fatalf("formatting the phrase failed: %v", err)
+	}
+
+	or, err := sdk.ParseObjectReference(strings.Replace(phrase, "-", " ", -1))
+	if err != nil {
+		t.Fatalf("parsing the phrase failed: %v", err)
+	}
+	resolved, err := client.Resolve(ctx, or)
+	if err != nil {
+		t.Fatalf("resolving the phrase failed: %v", err)
+	}
+	if resolved.String() != dropped.String() {
+		t.Errorf("resolved the phrase to %s, expected %s", resolved, dropped)
+	}
+
+	pulled, _, err := client.Pull(ctx, or)
+	if err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	if !bytes.Equal(pulled, data) {
+		t.Errorf("pulled %q, expected %q", pulled, data)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	srv := NewServerWithSettings(map[string]interface{}{"alias-versions": 2, "destructive-read": false})
+	defer srv.Close()
+
+	alice := newClient(t, srv, "alice")
+	bob := newClient(t, srv, "bob")
+
+	ctx := context.Background()
+	var dropped []*sdk.ObjectReference
+	for _, data := range []string{"first", "second", "third"} {
+		ref, err := alice.Drop(ctx, []byte(data), &sdk.DropOptions{Alias: "nightly"})
+		if err != nil {
+			t.Fatalf("drop failed: %v", err)
+		}
+		dropped = append(dropped, ref)
+	}
+
+	versions, err := alice.Versions(ctx, "nightly")
+	if err != nil {
+		t.Fatalf("listing versions failed: %v", err)
+	}
+	if len(versions.Versions) != 2 || versions.Versions[0].Version != 2 || versions.Versions[1].Version != 3 ||
+		versions.Versions[1].Oid != dropped[2].Oid {
+		t.Errorf("expected versions 2 and 3 to be kept, found %+v", versions.Versions)
+	}
+	if _, _, err := alice.Pull(ctx, dropped[0]); err == nil {
+		t.Errorf("pulled version 1, which should have been removed")
+	}
+
+	ref, err := alice.ResolveVersion(ctx, "nightly@2")
+	if err != nil {
+		t.Fatalf("resolving version 2 failed: %v", err)
+	}
+	if ref.String() != dropped[1].String() {
+		t.Errorf("resolved version 2 to %s, expected %s", ref, dropped[1])
+	}
+	pulled, _, err := alice.Pull(ctx, ref)
+	if err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	if string(pulled) != "second" {
+		t.Errorf("pulled %q, expected %q", pulled, "second")
+	}
+
+	if ref, err := alice.ResolveVersion(ctx, "nightly"); err != nil || ref.Oid != dropped[2].Oid {
+		t.Errorf("expected the latest version to be %s, found %v (%v)", dropped[2].Oid, ref, err)
+	}
+	if _, err := bob.Drop(ctx, []byte("fourth"), &sdk.DropOptions{Alias: "nightly"}); err == nil {
+		t.Errorf("dropped a version of an alias owned by another key")
+	}
+}
+
+func TestAliases(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	alice := newClient(t, srv, "alice")
+	bob := newClient(t, srv, "bob")
+
+	ctx := context.Background()
+	if _, err := alice.Drop(ctx, []byte("may"), &sdk.DropOptions{Alias: "release-2024-06"}); err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+	latest, err := alice.Drop(ctx, []byte("june"), &sdk.DropOptions{Alias: "release-2024-06"})
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+
+	resolved, err := bob.ResolveVersion(ctx, "release-2024-06")
+	if err != nil {
+		t.Fatalf("resolving the alias failed: %v", err)
+	}
+	if resolved.String() != latest.String() {
+		t.Errorf("resolved the alias to %s, expected the latest version %s", resolved, latest)
+	}
+
+	if _, err := bob.Version(ctx, "release-2024-06", 3); err == nil {
+		t.Errorf("resolved version 3 of an alias with 2 versions")
+	}
+	if _, err := bob.ResolveVersion(ctx, "release-2024-07"); err == nil {
+		t.Errorf("resolved an alias nothing was dropped under")
+	}
+}
+
+func TestDeadMansSwitch(t *testing.T) {
+	clock := NewClock()
+	srv := NewServerWithClock(map[string]interface{}{"destructive-read": false}, clock)
+	defer srv.Close()
+
+	// bob needs alice's encryption key to decrypt what is released to him.
+	key := []byte("0123456789abcdef0123456789abcdef")
+	alice := newClient(t, srv, "alice", withKey(key))
+	bob := newClient(t, srv, "bob", withKey(key))
+	carol := newClient(t, srv, "carol", withKey(key))
+
+	ctx := context.Background()
+	if _, err := alice.Drop(ctx, []byte("will"), &sdk.DropOptions{ReleaseTo: []string{"bob"}}); err == nil {
+		t.Errorf("dropped an object released to bob without a check-in interval")
+	}
+	or, err := alice.Drop(ctx, []byte("will"), &sdk.DropOptions{ReleaseTo: []string{"bob"}, CheckinInterval: time.Second})
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+	if _, err := alice.Checkin(ctx); err != nil {
+		t.Fatalf("check-in failed: %v", err)
+	}
+
+	if _, _, err := bob.Pull(ctx, or); err == nil || !strings.Contains(err.Error(), "held") {
+		t.Errorf("bob pulled the object before alice missed a check-in: %v", err)
+	}
+	if _, _, err := alice.Pull(ctx, or); err != nil {
+		t.Errorf("alice failed to pull her own held object: %v", err)
+	}
+
+	clock.Advance(time.Second)
+	if _, _, err := carol.Pull(ctx, or); err == nil {
+		t.Errorf("carol pulled an object which wasn't released to her")
+	}
+	data, _, err := bob.Pull(ctx, or)
+	if err != nil {
+		t.Fatalf("bob failed to pull the released object: %v", err)
+	}
+	if string(data) != "will" {
+		t.Errorf("pulled %q, expected %q", data, "will")
+	}
+}
+
+func TestEmbargo(t *testing.T) {
+	clock := NewClock()
+	srv := NewServerWithClock(map[string]interface{}{"destructive-read": false}, clock)
+	defer srv.Close()
+
+	client := newClient(t, srv, "alice")
+
+	ctx := context.Background()
+	if _, err := client.Drop(ctx, []byte("late"), &sdk.DropOptions{ReleaseAt: clock.Now().Add(48 * time.Hour)}); err == nil {
+		t.Errorf("dropped an object released after it expires")
+	}
+	releaseAt := clock.Now().Add(time.Second)
+	or, err := client.Drop(ctx, []byte("advisory"), &sdk.DropOptions{ReleaseAt: releaseAt})
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+
+	info, err := client.Stat(ctx, or.Oid)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if info.ReleaseAt == nil || info.ReleaseAt.Unix() != releaseAt.Unix() {
+		t.Errorf("stat has release time %v, expected %v", info.ReleaseAt, releaseAt)
+	}
+	if _, _, err := client.Pull(ctx, or); err == nil || !strings.Contains(err.Error(), "embargoed") {
+		t.Errorf("pulled the object before its release time: %v", err)
+	}
+
+	clock.Advance(time.Second)
+	data, _, err := client.Pull(ctx, or)
+	if err != nil {
+		t.Fatalf("pull after the release time failed: %v", err)
+	}
+	if string(data) != "advisory" {
+		t.Errorf("pulled %q, expected %q", data, "advisory")
+	}
+}
+
+func TestCanary(t *testing.T) {
+	events := make(chan map[string]string, 16)
+	hooks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		event := map[string]string{}
+		if err := json.NewDecoder(req.Body).Decode(&event); err == nil {
+			events <- event
+		}
+	}))
+	defer hooks.Close()
+
+	srv := NewServerWithSettings(map[string]interface{}{
+		"destructive-read": false,
+		"webhook-urls":     []string{hooks.URL},
+		"webhook-secret":   "secret",
+		"webhook-events":   []string{"canary_pulled"},
+	})
+	defer srv.Close()
+
+	client := newClient(t, srv, "alice")
+
+	ctx := context.Background()
+	plain, err := client.Drop(ctx, []byte("report"), nil)
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+	canary, err := client.Drop(ctx, []byte("credentials"), &sdk.DropOptions{Canary: true})
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+
+	if _, _, err := client.Pull(ctx, plain); err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	if _, _, err := client.Pull(ctx, canary); err != nil {
+		t.Fatalf("pull of the canary failed: %v", err)
+	}
+
+	select {
+	case event := <-events:
+		if event["event"] != "canary_pulled" || event["oid"] != canary.Oid || event["keyName"] != "alice" {
+			t.Errorf("unexpected webhook %v, expected a canary_pulled event of %s by alice", event, canary.Oid)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no webhook was sent for the pull of the canary")
+	}
+	select {
+	case event := <-events:
+		t.Errorf("unexpected webhook %v", event)
+	default:
+	}
+}
+
+func TestSealedAtRest(t *testing.T) {
+	srv := NewServerWithSettings(map[string]interface{}{
+		"destructive-read": false,
+		"at-rest-key":      "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+	})
+	defer srv.Close()
+
+	client := newClient(t, srv, "alice")
+
+	ctx := context.Background()
+	small := []byte("inline")
+	large := bytes.Repeat([]byte("stored in a file of its own "), 1024)
+	var refs []*sdk.ObjectReference
+	for _, data := range [][]byte{small, large} {
+		or, err := client.Drop(ctx, data, nil)
+		if err != nil {
+			t.Fatalf("drop failed: %v", err)
+		}
+		refs = append(refs, or)
+
+		pulled, _, err := client.Pull(ctx, or)
+		if err != nil {
+			t.Fatalf("pull failed: %v", err)
+		}
+		if !bytes.Equal(pulled, data) {
+			t.Errorf("pulled %d bytes which don't match the %d dropped", len(pulled), len(data))
+		}
+
+		meta, err := srv.Metas.Read(or.Oid)
+		if err != nil || meta == nil {
+			t.Fatalf("failed to read the stored metadata: %v", err)
+		}
+		if meta.Sealed == nil || meta.Owner == "alice" || meta.Data != nil {
+			t.Errorf("metadata of %s isn't sealed", or.Oid)
+		}
+	}
+
+	object, _, err := srv.Objects.Open(refs[1].Oid)
+	if err != nil {
+		t.Fatalf("failed to open the stored object: %v", err)
+	}
+	prefix := make([]byte, 8)
+	_, err = object.Read(prefix)
+	object.Close()
+	if err != nil || string(prefix) != "DDSEAL01" {
+		t.Errorf("stored object isn't sealed")
+	}
+
+	listing, err := client.List(ctx, "", 0)
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	if len(listing.Objects) != 2 {
+		t.Errorf("listed %d objects, expected the 2 sealed ones", len(listing.Objects))
+	}
+}
+
+// rawPull pulls an object through a url without the sdk, with a Range header unless byteRange is empty, returning the
+// status of the response, or 0 if the request failed. It may be called from other goroutines than the test's.
+func rawPull(t *testing.T, url string, byteRange string) int {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	resp, err := (&http.Client{Transport: sdk.NewTransport(sdk.DefaultTimeouts)}).Do(req)
+	if err != nil {
+		t.Errorf("pull of %s failed: %v", url, err)
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// sharedURL drops an object with a client and shares it, returning the url it can be pulled through and its size.
+func sharedURL(t *testing.T, client *sdk.Client, opts *sdk.DropOptions) (string, int64) {
+	ctx := context.Background()
+	or, err := client.Drop(ctx, []byte("for a limited number of pulls"), opts)
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+	info, err := client.Stat(ctx, or.Oid)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	share, err := client.Share(ctx, or.Oid, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("share failed: %v", err)
+	}
+	return client.ShareURL(share), info.Size
+}
+
+func TestMaxPulls(t *testing.T) {
+	srv := NewServerWithSettings(map[string]interface{}{"destructive-read": false})
+	defer srv.Close()
+
+	client := newClient(t, srv, "alice")
+
+	// Of pulls made at once, only one gets an object allowing one pull.
+	url, _ := sharedURL(t, client, &sdk.DropOptions{MaxPulls: 1})
+	statuses := make(chan int, 8)
+	for i := 0; i < cap(statuses); i++ {
+		go func() {
+			statuses <- rawPull(t, url, "")
+		}()
+	}
+	pulled := 0
+	for i := 0; i < cap(statuses); i++ {
+		if <-statuses == http.StatusOK {
+			pulled++
+		}
+	}
+	if pulled != 1 {
+		t.Errorf("%d concurrent pulls got an object allowing 1 pull", pulled)
+	}
+
+	// Ranges which stop short of the end are pulls too.
+	url, size := sharedURL(t, client, &sdk.DropOptions{MaxPulls: 2})
+	byteRange := fmt.Sprintf("bytes=0-%d", size-2)
+	for i := 0; i < 2; i++ {
+		if status := rawPull(t, url, byteRange); status != http.StatusPartialContent {
+			t.Fatalf("ranged pull %d responded with status %d", i+1, status)
+		}
+	}
+	if status := rawPull(t, url, byteRange); status != http.StatusNotFound {
+		t.Errorf("a third ranged pull of an object allowing 2 pulls responded with status %d", status)
+	}
+}
+
+func TestBurn(t *testing.T) {
+	for _, destructive := range []bool{false, true} {
+		srv := NewServerWithSettings(map[string]interface{}{"destructive-read": destructive})
+		client := newClient(t, srv, "alice")
+
+		// Burned objects, and every object of a destructive server, allow a single pull, even of a single byte.
+		opts := &sdk.DropOptions{Burn: !destructive}
+		url, _ := sharedURL(t, client, opts)
+		if status := rawPull(t, url, "bytes=0-0"); status != http.StatusPartialContent {
+			t.Errorf("ranged pull responded with status %d (destructive: %v)", status, destructive)
+		}
+		if status := rawPull(t, url, ""); status != http.StatusNotFound {
+			t.Errorf("pulled a burned object after a ranged pull (destructive: %v)", destructive)
+		}
+
+		url, _ = sharedURL(t, client, opts)
+		statuses := make(chan int, 8)
+		for i := 0; i < cap(statuses); i++ {
+			go func() {
+				statuses <- rawPull(t, url, "")
+			}()
+		}
+		pulled := 0
+		for i := 0; i < cap(statuses); i++ {
+			if <-statuses == http.StatusOK {
+				pulled++
+			}
+		}
+		if pulled != 1 {
+			t.Errorf("%d concurrent pulls got a burned object (destructive: %v)", pulled, destructive)
+		}
+		srv.Close()
+	}
+}
+
+func TestSharedURLs(t *testing.T) {
+	clock := NewClock()
+	srv := NewServerWithClock(map[string]interface{}{"destructive-read": false}, clock)
+	defer srv.Close()
+
+	alice := newClient(t, srv, "alice")
+	bob := newClient(t, srv, "bob")
+
+	ctx := context.Background()
+	or, err := alice.Drop(ctx, []byte("shared"), nil)
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+	other, err := alice.Drop(ctx, []byte("not shared"), nil)
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+	if _, err := bob.Share(ctx, or.Oid, time.Hour, 0); err == nil {
+		t.Errorf("bob shared an object alice dropped")
+	}
+
+	// Urls can't outlive their object, which expires after a day.
+	share, err := alice.Share(ctx, or.Oid, 48*time.Hour, 0)
+	if err != nil {
+		t.Fatalf("share failed: %v", err)
+	}
+	if share.Expires.After(clock.Now().Add(24 * time.Hour)) {
+		t.Errorf("shared url expires at %v, after its object", share.Expires)
+	}
+
+	share, err = alice.Share(ctx, or.Oid, 2*time.Second, 2)
+	if err != nil {
+		t.Fatalf("share failed: %v", err)
+	}
+	shared := alice.ShareURL(share)
+
+	// Urls whose object, expiry or uses were changed aren't genuine, and using them doesn't use the url.
+	for _, test := range []struct {
+		name  string
+		oid   string
+		param string
+		value string
+	}{
+		{"another object", other.Oid, "", ""},
+		{"a later expiry", or.Oid, "expires", strconv.FormatInt(share.Expires.Add(time.Hour).Unix(), 10)},
+		{"more uses", or.Oid, "uses", "3"},
+		{"no limit of uses", or.Oid, "uses", ""},
+		{"no signature", or.Oid, "sig", ""},
+	} {
+		changed, err := url.Parse(shared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := changed.Query()
+		if test.value != "" {
+			query.Set(test.param, test.value)
+		} else {
+			query.Del(test.param)
+		}
+		changed.Path = strings.Replace(changed.Path, or.Oid, test.oid, 1)
+		changed.RawQuery = query.Encode()
+		if status := rawPull(t, changed.String(), ""); status != http.StatusNotFound {
+			t.Errorf("shared url changed to %s responded with status %d", test.name, status)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if status := rawPull(t, shared, ""); status != http.StatusOK {
+			t.Fatalf("pull %d through a shared url responded with status %d", i+1, status)
+		}
+	}
+	if status := rawPull(t, shared, ""); status != http.StatusNotFound {
+		t.Errorf("a third pull through a url of 2 uses responded with status %d", status)
+	}
+
+	share, err = alice.Share(ctx, or.Oid, 2*time.Second, 0)
+	if err != nil {
+		t.Fatalf("share failed: %v", err)
+	}
+	if status := rawPull(t, alice.ShareURL(share), ""); status != http.StatusOK {
+		t.Errorf("pull through a shared url responded with status %d", status)
+	}
+	clock.Advance(2 * time.Second)
+	if status := rawPull(t, alice.ShareURL(share), ""); status != http.StatusNotFound {
+		t.Errorf("pull through an expired shared url responded with status %d", status)
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	srv := NewServerWithSettings(map[string]interface{}{"destructive-read": false})
+	defer srv.Close()
+
+	identities := map[string]*lib.X25519Identity{}
+	for _, name := range []string{"bob", "carol", "dave"} {
+		identities[name] = lib.GenerateX25519Identity()
+		defer identities[name].Destroy()
+	}
+	alice := newClient(t, srv, "alice",
+		sdk.WithKeys(sdk.NewRecipientKeys(identities["bob"].Recipient(), identities["carol"].Recipient())))
+
+	ctx := context.Background()
+	or, err := alice.Drop(ctx, []byte("for bob and carol"), nil)
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+
+	for name, identity := range identities {
+		client := newClient(t, srv, name, sdk.WithKeys(&sdk.KeySet{Identities: []lib.Identity{identity}}))
+		data, _, err := client.Pull(ctx, or)
+		if name == "dave" {
+			if err == nil {
+				t.Errorf("dave decrypted an object which wasn't encrypted to dave")
+			}
+		} else if err != nil || string(data) != "for bob and carol" {
+			t.Errorf("%s pulled %q (%v), expected %q", name, data, err, "for bob and carol")
+		}
+	}
+	if _, _, err := alice.Pull(ctx, or); err == nil {
+		t.Errorf("alice decrypted an object only encrypted to others")
+	}
+}
+
+func TestAnonymousDropPolicy(t *testing.T) {
+	srv := NewServerWithSettings(map[string]interface{}{"anonymous-drops": true})
+	defer srv.Close()
+
+	drop := func(header string, value string) int {
+		req, err := http.NewRequest("POST", srv.URL+"/anonymous/d", strings.NewReader("a tip"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(header, value)
+		resp, err := (&http.Client{Transport: sdk.NewTransport(sdk.DefaultTimeouts)}).Do(req)
+		if err != nil {
+			t.Fatalf("anonymous drop failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for header, value := range map[string]string{
+		lib.ObjectTTLHeader: "60",
+		lib.BurnHeader:      "true",
+		lib.MaxPullsHeader:  "2",
+	} {
+		if status := drop(header, value); status != http.StatusOK {
+			t.Errorf("anonymous drop with %s was refused with status %d", header, status)
+		}
+	}
+	for header, value := range map[string]string{
+		lib.LabelsHeader:    "case=1",
+		lib.AliasHeader:     "inbox",
+		lib.ReleaseAtHeader: time.Now().Add(time.Minute).Format(time.RFC3339),
+		lib.CanaryHeader:    "true",
+	} {
+		if status := drop(header, value); status != http.StatusBadRequest {
+			t.Errorf("anonymous drop with %s responded with status %d, expected 400", header, status)
+		}
+	}
+}
+
+func TestKeyringShare(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Alice shares keys signed with her Ed25519 key, to Bob's RSA key, which unwraps them.
+	aliceKey, err := srv.AuthorizeKey("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := sdk.New(srv.URL, sdk.WithSigningAuthKey("alice", aliceKey))
+	bobKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&bobKey.PublicKey)})
+	if err := srv.Keys.AddKey("bob", encoded); err != nil {
+		t.Fatal(err)
+	}
+	bob := sdk.New(srv.URL, sdk.WithAuthKey("bob", bobKey))
+	mallory := newClient(t, srv, "mallory")
+
+	alicePath := filepath.Join(dir, "alice.txt")
+	bobPath := filepath.Join(dir, "bob.txt")
+	if err := sdk.AddKeyringKey(alicePath, "rotated", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := sdk.AddKeyringKey(bobPath, "own", 0); err != nil {
+		t.Fatal(err)
+	}
+	aliceKeyring, err := sdk.LoadKeyring(alicePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aliceKeyring.Destroy()
+
+	ctx := context.Background()
+	if _, err := alice.ShareKeyringKey(ctx, aliceKeyring, "", &bobKey.PublicKey); err != nil {
+		t.Fatalf("failed to share key: %v", err)
+	}
+	forged, err := mallory.ShareKeyringKey(ctx, aliceKeyring, "", &bobKey.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to share key: %v", err)
+	}
+
+	// Keys shared by anyone but the counterparty are refused.
+	if _, err := bob.PullKeyringKey(ctx, forged, aliceKey.Public()); err == nil ||
+		!strings.Contains(err.Error(), "isn't signed") {
+		t.Fatalf("installed a key which the counterparty didn't sign: %v", err)
+	}
+
+	refs, err := bob.SharedKeyringKeys(ctx, aliceKey.Public())
+	if err != nil {
+		t.Fatalf("failed to find shared keys: %v", err)
+	}
+	if len(refs) != 1 {
+		t.Fatalf("found %d shared keys, expected 1", len(refs))
+	}
+	line, err := bob.PullKeyringKey(ctx, refs[0], aliceKey.Public())
+	if err != nil {
+		t.Fatalf("failed to pull shared key: %v", err)
+	}
+	if id, installed, err := sdk.InstallKeyringLine(bobPath, line); err != nil || !installed || id != "rotated" {
+		t.Fatalf("installed key %q (%v, %v), expected rotated", id, installed, err)
+	}
+	if refs, err := bob.SharedKeyringKeys(ctx, aliceKey.Public()); err != nil || len(refs) != 0 {
+		t.Fatalf("found %d shared keys after pulling them (%v), expected none", len(refs), err)
+	}
+
+	// The installed key pulls objects dropped with it, but doesn't become the key Bob drops with.
+	bobKeyring, err := sdk.LoadKeyring(bobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bobKeyring.Destroy()
+	if current, err := bobKeyring.Current(); err != nil || current.Id() != "own" {
+		t.Fatalf("current key is %v (%v), expected own", current, err)
+	}
+	if entry, err := bobKeyring.Lookup("rotated"); err != nil || !entry.IsShared() {
+		t.Fatalf("installed key isn't marked as shared: %v", err)
+	}
+
+	dropper := sdk.New(srv.URL, sdk.WithSigningAuthKey("alice", aliceKey), sdk.WithKeys(&sdk.KeySet{Keyring: aliceKeyring}))
+	ref, err := dropper.Drop(ctx, []byte("after the rotation"), nil)
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+	puller := sdk.New(srv.URL, sdk.WithAuthKey("bob", bobKey), sdk.WithKeys(&sdk.KeySet{Keyring: bobKeyring}))
+	if data, _, err := puller.Pull(ctx, ref); err != nil || string(data) != "after the rotation" {
+		t.Fatalf("pulled %q (%v) with the installed key", data, err)
+	}
+}
+
+// sessionless makes a remote look like it has no upload sessions, so that drops are made in a single request, whose
+// body is chunked unless sized buffers it to send its length.
+type sessionless struct {
+	transport http.RoundTripper
+	sized     bool
+}
+
+func (remote *sessionless) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/d/session") {
+		return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody, Request: req}, nil
+	}
+	if req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/d") && remote.sized {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+	return remote.transport.RoundTrip(req)
+}
+
+func TestDropQuota(t *testing.T) {
+	srv := NewServerWithSettings(map[string]interface{}{"quota-bytes": 4096})
+	defer srv.Close()
+
+	sized := newClient(t, srv, "alice", sdk.WithHTTPClient(&http.Client{
+		Transport: &sessionless{transport: sdk.NewTransport(sdk.DefaultTimeouts), sized: true},
+	}))
+	chunked := newClient(t, srv, "bob", sdk.WithHTTPClient(&http.Client{
+		Transport: &sessionless{transport: sdk.NewTransport(sdk.DefaultTimeouts)},
+	}))
+
+	ctx := context.Background()
+	for name, client := range map[string]*sdk.Client{"sized": sized, "chunked": chunked} {
+		if _, err := client.Drop(ctx, make([]byte, 1024), nil); err != nil {
+			t.Fatalf("%s drop within quota failed: %v", name, err)
+		}
+	}
+
+	// Sized drops over quota are refused before their body is read, and chunked ones once it reaches the quota.
+	_, err := sized.Drop(ctx, make([]byte, 4096), nil)
+	if err == nil || !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), "over quota") {
+		t.Errorf("sized drop over quota wasn't refused with 403: %v", err)
+	}
+	_, err = chunked.Drop(ctx, make([]byte, 4096), nil)
+	if err == nil || !strings.Contains(err.Error(), "413") || !strings.Contains(err.Error(), "over quota") {
+		t.Errorf("chunked drop over quota wasn't refused with 413: %v", err)
+	}
+	if quota, err := chunked.Quota(ctx); err != nil || quota.Used > 2048 {
+		t.Errorf("refused drop counts against the quota: %+v (%v)", quota, err)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	srv := NewServerWithSettings(map[string]interface{}{
+		"quota-bytes":      4096,
+		"key-quotas":       []string{"carol=0", "dave=8192"},
+		"namespace-quotas": []string{"team-a=4096"},
+	})
+	defer srv.Close()
+
+	admin := newClient(t, srv, "admin")
+	alice := newClient(t, srv, "alice")
+	erin := addClient(t, srv, admin, "erin", &sdk.AddKeyOptions{Namespace: "team-a"}, sdk.WithNamespace("team-a"),
+		sdk.WithKeys(&sdk.KeySet{Key: memguard.NewBufferRandom(32)}))
+	frank := addClient(t, srv, admin, "frank", &sdk.AddKeyOptions{Namespace: "team-a"}, sdk.WithNamespace("team-a"),
+		sdk.WithKeys(&sdk.KeySet{Key: memguard.NewBufferRandom(32)}))
+
+	// Drops go through upload sessions, whose objects count against the quota of their key, and of its namespace:
+	// frank's drop fits the key's own quota, but not what erin left of team-a's.
+	ctx := context.Background()
+	first := make(map[string]*sdk.ObjectReference)
+	for _, test := range []struct {
+		name    string
+		client  *sdk.Client
+		quota   int64
+		sizes   []int
+		refused bool
+	}{
+		{"alice", alice, 4096, []int{2000, 2500}, true},
+		{"carol", newClient(t, srv, "carol"), 0, []int{8192, 8192}, false},
+		{"dave", newClient(t, srv, "dave"), 8192, []int{2500, 2500}, false},
+		{"erin", erin, 4096, []int{2000}, false},
+		{"frank", frank, 4096, []int{2500}, true},
+	} {
+		for i, size := range test.sizes {
+			or, err := test.client.Drop(ctx, make([]byte, size), nil)
+			refused := err != nil && strings.Contains(err.Error(), "over quota")
+			if expected := test.refused && i == len(test.sizes)-1; refused != expected || (err != nil && !refused) {
+				t.Errorf("%s's drop %d of %d bytes failed with %v, expected it to be refused: %t", test.name, i+1,
+					size, err, expected)
+			}
+			if i == 0 && err == nil {
+				first[test.name] = or
+			}
+		}
+
+		quota, err := test.client.Quota(ctx)
+		if err != nil || quota.Quota != test.quota || (test.quota > 0 && quota.Used > test.quota) {
+			t.Errorf("%s has %+v (%v), expected a quota of %d", test.name, quota, err, test.quota)
+		}
+	}
+
+	// Removing an object makes room for others.
+	if err := alice.Remove(ctx, first["alice"].Oid); err != nil {
+		t.Fatalf("removal failed: %v", err)
+	}
+	if _, err := alice.Drop(ctx, make([]byte, 2500), nil); err != nil {
+		t.Errorf("drop after removing an object failed: %v", err)
+	}
+}
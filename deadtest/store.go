@@ -0,0 +1,244 @@
+package deadtest
+
+import (
+	"bytes"
+	"dead-drop/server"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// MemoryObjects is a server.ObjectStore which keeps objects in memory.
+type MemoryObjects struct {
+	lock    sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data   []byte
+	stored time.Time
+}
+
+// memoryObjectReader reads an object from memory.
+type memoryObjectReader struct {
+	*bytes.Reader
+}
+
+func (memoryObjectReader) Close() error {
+	return nil
+}
+
+func NewMemoryObjects() *MemoryObjects {
+	return &MemoryObjects{objects: make(map[string]memoryObject)}
+}
+
+func (store *MemoryObjects) Put(oid string, data io.Reader) error {
+	contents, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.objects[oid] = memoryObject{data: contents, stored: time.Now()}
+	return nil
+}
+
+func (store *MemoryObjects) Open(oid string) (server.ObjectReader, int64, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	object, ok := store.objects[oid]
+	if !ok {
+		return nil, 0, os.ErrNotExist
+	}
+	return memoryObjectReader{bytes.NewReader(object.data)}, int64(len(object.data)), nil
+}
+
+func (store *MemoryObjects) Stat(oid string) (int64, time.Time, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	object, ok := store.objects[oid]
+	if !ok {
+		return 0, time.Time{}, os.ErrNotExist
+	}
+	return int64(len(object.data)), object.stored, nil
+}
+
+func (store *MemoryObjects) Remove(oid string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, ok := store.objects[oid]; !ok {
+		return os.ErrNotExist
+	}
+	delete(store.objects, oid)
+	return nil
+}
+
+func (store *MemoryObjects) List(fn func(oid string, stored time.Time)) error {
+	store.lock.RLock()
+	objects := make(map[string]time.Time, len(store.objects))
+	for oid, object := range store.objects {
+		objects[oid] = object.stored
+	}
+	store.lock.RUnlock()
+
+	for oid, stored := range objects {
+		fn(oid, stored)
+	}
+	return nil
+}
+
+// MemoryMetas is a server.MetaStore which keeps metadata in memory. Metadata is copied in and out as json, like the
+// stores of servers, so that the server can't change what is stored without writing it.
+type MemoryMetas struct {
+	lock  sync.RWMutex
+	metas map[string][]byte
+}
+
+func NewMemoryMetas() *MemoryMetas {
+	return &MemoryMetas{metas: make(map[string][]byte)}
+}
+
+func (store *MemoryMetas) Read(oid string) (*server.ObjectMeta, error) {
+	store.lock.RLock()
+	data, ok := store.metas[oid]
+	store.lock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+
+	meta := &server.ObjectMeta{}
+	return meta, json.Unmarshal(data, meta)
+}
+
+func (store *MemoryMetas) Write(oid string, meta *server.ObjectMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.metas[oid] = data
+	return nil
+}
+
+func (store *MemoryMetas) Remove(oid string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete(store.metas, oid)
+	return nil
+}
+
+func (store *MemoryMetas) Each(fn func(oid string, meta *server.ObjectMeta)) error {
+	store.lock.RLock()
+	oids := make([]string, 0, len(store.metas))
+	for oid := range store.metas {
+		oids = append(oids, oid)
+	}
+	store.lock.RUnlock()
+
+	for _, oid := range oids {
+		meta, err := store.Read(oid)
+		if err != nil || meta == nil {
+			continue
+		}
+		fn(oid, meta)
+	}
+	return nil
+}
+
+// MemoryKeys is a server.KeyStore which keeps authorized keys in memory.
+type MemoryKeys struct {
+	lock       sync.RWMutex
+	keys       map[string][]byte
+	attributes map[string]map[string]string
+}
+
+func NewMemoryKeys() *MemoryKeys {
+	return &MemoryKeys{keys: make(map[string][]byte), attributes: make(map[string]map[string]string)}
+}
+
+func (store *MemoryKeys) Key(keyName string) ([]byte, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	key, ok := store.keys[keyName]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return key, nil
+}
+
+func (store *MemoryKeys) Keys() (map[string][]byte, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	keys := make(map[string][]byte, len(store.keys))
+	for keyName, key := range store.keys {
+		keys[keyName] = key
+	}
+	return keys, nil
+}
+
+func (store *MemoryKeys) AddKey(keyName string, key []byte) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.keys[keyName] = key
+	return nil
+}
+
+func (store *MemoryKeys) RemoveKey(keyName string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete(store.keys, keyName)
+	return nil
+}
+
+func (store *MemoryKeys) Attribute(keyName string, attribute string) (string, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.attributes[attribute][keyName], nil
+}
+
+func (store *MemoryKeys) SetAttribute(keyName string, attribute string, value string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if value == "" {
+		delete(store.attributes[attribute], keyName)
+		return nil
+	}
+	if store.attributes[attribute] == nil {
+		store.attributes[attribute] = make(map[string]string)
+	}
+	store.attributes[attribute][keyName] = value
+	return nil
+}
+
+func (store *MemoryKeys) Attributes(attribute string) (map[string]string, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	values := make(map[string]string, len(store.attributes[attribute]))
+	for keyName, value := range store.attributes[attribute] {
+		values[keyName] = value
+	}
+	return values, nil
+}
+
+func (store *MemoryKeys) String() string {
+	return "memory"
+}
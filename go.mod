@@ -5,10 +5,16 @@ go 1.12
 require (
 	github.com/awnumar/memguard v0.18.2
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/google/logger v1.0.1
 	github.com/gorilla/mux v1.7.3
+	github.com/lib/pq v1.10.0
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/viper v1.4.0
 	github.com/urfave/negroni v1.0.0
+	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4
+	google.golang.org/grpc v1.56.3
+	google.golang.org/protobuf v1.30.0
 )
@@ -0,0 +1,379 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+	"sort"
+)
+
+// Objects with a Cipher in their header are encrypted with an AEAD instead of AES-CTR and HMAC-SHA-256.
+// They are always chunked, and their encrypted message is laid out as:
+//
+//	salt (16 bytes) | chunk 0 | chunk 1 | ... | final chunk
+//
+// where each chunk is the AEAD sealing of the next ChunkSize bytes of plaintext (the final chunk may be shorter),
+// with the header as additional data and the nonce:
+//
+//	zero (7 bytes) | chunk index (uint32 BE) | final flag (1 byte)
+//
+// The AEAD key is HMAC-SHA-256(key, "dead-drop " | cipher name | salt), so every object has its own key, and the
+// nonces never repeat under it. As with chunked AES-CTR objects, the nonce stops chunks being reordered or dropped.
+const CipherAES256GCM = "aes-256-gcm"
+
+// CipherChaCha20Poly1305 is a fast choice for machines without AES instructions, e.g. ARM boards and older VMs.
+const CipherChaCha20Poly1305 = "chacha20poly1305"
+
+const aeadSaltLen = 16
+const aeadNonceLen = 12
+
+// Chunk indexes are 32 bits, which bounds objects to 4 billion chunks, or 256 TiB at the default chunk size.
+const maxAeadChunks = 1 << 32
+
+var ciphers = map[string]func(key []byte) (cipher.AEAD, error){
+	CipherAES256GCM: func(key []byte) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	},
+	CipherChaCha20Poly1305: chacha20poly1305.New,
+}
+
+// CipherNames returns the names of the AEAD ciphers objects can be encrypted with, sorted.
+func CipherNames() []string {
+	names := make([]string, 0, len(ciphers))
+	for name := range ciphers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckCipher returns an error if name is not a supported cipher. The empty name is AES-CTR and HMAC-SHA-256.
+func CheckCipher(name string) error {
+	if _, ok := ciphers[name]; name != "" && !ok {
+		return fmt.Errorf("unsupported cipher '%s'", name)
+	}
+	return nil
+}
+
+// newObjectAEAD derives the AEAD of an object from the shared key, which is destroyed.
+func newObjectAEAD(cipherName string, key *memguard.LockedBuffer, salt []byte) (cipher.AEAD, error) {
+	defer key.Destroy()
+
+	newAEAD, ok := ciphers[cipherName]
+	if !ok {
+		return nil, fmt.Errorf("unsupported cipher '%s'", cipherName)
+	}
+
+	mac := hmac.New(sha256.New, key.Bytes())
+	mac.Write([]byte("dead-drop " + cipherName))
+	mac.Write(salt)
+	subkey := memguard.NewBufferFromBytes(mac.Sum(nil))
+	defer subkey.Destroy()
+
+	return newAEAD(subkey.Bytes())
+}
+
+func aeadNonce(index uint64, final bool) []byte {
+	nonce := make([]byte, aeadNonceLen)
+	binary.BigEndian.PutUint32(nonce[7:], uint32(index))
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// NewObjectEncryptWriter returns the writer which encrypts the plaintext of an object as its header specifies:
+// with the header's AEAD cipher if it has one, and AES-CTR and HMAC-SHA-256 otherwise. The key is destroyed, and
+// headerBytes is the encoded header, which is authenticated but not written.
+func NewObjectEncryptWriter(
+	key *memguard.LockedBuffer,
+	header *ObjectHeader,
+	headerBytes []byte,
+	w io.Writer,
+) (io.WriteCloser, error) {
+	if header.Cipher == "" {
+		return NewEncryptWriter(key, headerBytes, w, header.ChunkSize)
+	}
+
+	salt := make([]byte, aeadSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		key.Destroy()
+		return nil, err
+	}
+	return newSealWriterWithSalt(key, header.Cipher, headerBytes, salt, w, header.ChunkSize)
+}
+
+// NewObjectDecryptReader returns the reader of the plaintext of an object written by NewObjectEncryptWriter,
+// given its header. The key is destroyed. As with NewDecryptReader, an object is only authentic once the reader
+// returns io.EOF, and closing the reader does not close r.
+func NewObjectDecryptReader(
+	key *memguard.LockedBuffer,
+	header *ObjectHeader,
+	headerBytes []byte,
+	r io.Reader,
+) (io.ReadCloser, error) {
+	if header.Cipher == "" {
+		return NewDecryptReader(key, headerBytes, r, header.ChunkSize)
+	}
+	return newOpenReader(key, header.Cipher, headerBytes, r, header.ChunkSize)
+}
+
+// newSealWriterWithSalt is the AEAD case of NewObjectEncryptWriter with a chosen salt, which like encryptWithIV is
+// only called directly for test vectors.
+func newSealWriterWithSalt(
+	key *memguard.LockedBuffer,
+	cipherName string,
+	header []byte,
+	salt []byte,
+	w io.Writer,
+	chunkSize int,
+) (io.WriteCloser, error) {
+	if len(salt) != aeadSaltLen {
+		key.Destroy()
+		return nil, fmt.Errorf("salt must be %d bytes", aeadSaltLen)
+	}
+	if err := checkChunkSize(chunkSize); err != nil {
+		key.Destroy()
+		return nil, err
+	}
+
+	aead, err := newObjectAEAD(cipherName, key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(salt); err != nil {
+		return nil, err
+	}
+
+	return newSealWriter(aead, header, aeadNonce, w, chunkSize), nil
+}
+
+// newSealWriter returns a writer which seals the plaintext written to it in chunks of chunkSize bytes, with the header
+// as additional data and the nonces returned by nonce. The final chunk is only sealed on Close.
+func newSealWriter(
+	aead cipher.AEAD,
+	header []byte,
+	nonce func(index uint64, final bool) []byte,
+	w io.Writer,
+	chunkSize int,
+) *sealWriter {
+	plaintext := memguard.NewBuffer(chunkSize)
+	plaintext.Melt()
+
+	return &sealWriter{
+		w:          w,
+		aead:       aead,
+		header:     header,
+		nonce:      nonce,
+		plaintext:  plaintext,
+		ciphertext: make([]byte, 0, chunkSize+aead.Overhead()),
+	}
+}
+
+type sealWriter struct {
+	w          io.Writer
+	aead       cipher.AEAD
+	header     []byte
+	nonce      func(index uint64, final bool) []byte
+	plaintext  *memguard.LockedBuffer
+	ciphertext []byte
+	pending    int
+	index      uint64
+	err        error
+	closed     bool
+}
+
+func (writer *sealWriter) Write(p []byte) (int, error) {
+	if writer.closed {
+		return 0, fmt.Errorf("write to closed encrypt writer")
+	}
+
+	written := 0
+	for writer.err == nil && written < len(p) {
+		// As in encryptWriter, a full chunk is only sealed once more plaintext shows it isn't the final one.
+		if writer.pending == writer.plaintext.Size() {
+			writer.err = writer.flush(false)
+			continue
+		}
+
+		n := copy(writer.plaintext.Bytes()[writer.pending:], p[written:])
+		writer.pending += n
+		written += n
+	}
+	return written, writer.err
+}
+
+// Close seals the final chunk, and destroys the plaintext.
+func (writer *sealWriter) Close() error {
+	if writer.closed {
+		return writer.err
+	}
+	writer.closed = true
+
+	if writer.err == nil {
+		writer.err = writer.flush(true)
+	}
+
+	writer.plaintext.Destroy()
+	return writer.err
+}
+
+func (writer *sealWriter) flush(final bool) error {
+	if writer.index >= maxAeadChunks {
+		return fmt.Errorf("object is too large")
+	}
+
+	nonce := writer.nonce(writer.index, final)
+	ciphertext := writer.aead.Seal(writer.ciphertext[:0], nonce, writer.plaintext.Bytes()[:writer.pending], writer.header)
+	if _, err := writer.w.Write(ciphertext); err != nil {
+		return err
+	}
+
+	writer.index++
+	writer.pending = 0
+	return nil
+}
+
+func newOpenReader(
+	key *memguard.LockedBuffer,
+	cipherName string,
+	header []byte,
+	r io.Reader,
+	chunkSize int,
+) (io.ReadCloser, error) {
+	if err := checkChunkSize(chunkSize); err != nil {
+		key.Destroy()
+		return nil, err
+	}
+
+	salt := make([]byte, aeadSaltLen)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		key.Destroy()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("message too short")
+		}
+		return nil, err
+	}
+
+	aead, err := newObjectAEAD(cipherName, key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return newOpenReaderWithAEAD(aead, header, aeadNonce, r, chunkSize), nil
+}
+
+// newOpenReaderWithAEAD returns the reader of the plaintext sealed by newSealWriter with the same arguments.
+func newOpenReaderWithAEAD(
+	aead cipher.AEAD,
+	header []byte,
+	nonce func(index uint64, final bool) []byte,
+	r io.Reader,
+	chunkSize int,
+) *openReader {
+	plaintext := memguard.NewBuffer(chunkSize)
+	plaintext.Melt()
+
+	return &openReader{
+		r:         bufio.NewReader(r),
+		aead:      aead,
+		header:    header,
+		nonce:     nonce,
+		chunk:     make([]byte, chunkSize+aead.Overhead()),
+		plaintext: plaintext,
+	}
+}
+
+type openReader struct {
+	r         *bufio.Reader
+	aead      cipher.AEAD
+	header    []byte
+	nonce     func(index uint64, final bool) []byte
+	chunk     []byte
+	plaintext *memguard.LockedBuffer
+	start     int
+	end       int
+	index     uint64
+	final     bool
+	err       error
+}
+
+func (reader *openReader) Read(p []byte) (int, error) {
+	for reader.start == reader.end {
+		if reader.err != nil {
+			return 0, reader.err
+		}
+		if reader.final {
+			return 0, io.EOF
+		}
+		reader.err = reader.readChunk()
+	}
+
+	n := copy(p, reader.plaintext.Bytes()[reader.start:reader.end])
+	reader.start += n
+	return n, nil
+}
+
+func (reader *openReader) readChunk() error {
+	n, err := io.ReadFull(reader.r, reader.chunk)
+	switch err {
+	case nil:
+		// A full chunk is the final one if nothing follows it.
+		if _, err := reader.r.Peek(1); err == io.EOF {
+			reader.final = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		reader.final = true
+	case io.EOF:
+		return fmt.Errorf("message is truncated")
+	default:
+		return err
+	}
+
+	if n < reader.aead.Overhead() {
+		return fmt.Errorf("message is truncated")
+	}
+	if reader.index >= maxAeadChunks {
+		return fmt.Errorf("message is too long")
+	}
+
+	nonce := reader.nonce(reader.index, reader.final)
+	plaintext, err := reader.aead.Open(reader.plaintext.Bytes()[:0], nonce, reader.chunk[:n], reader.header)
+	if err != nil {
+		return fmt.Errorf("bad signature")
+	}
+	// Writers only leave the final chunk empty when there is no plaintext at all.
+	if len(plaintext) == 0 && reader.index > 0 {
+		return fmt.Errorf("message has an empty final chunk")
+	}
+
+	reader.start = 0
+	reader.end = len(plaintext)
+	reader.index++
+	return nil
+}
+
+// Close destroys the plaintext.
+func (reader *openReader) Close() error {
+	reader.plaintext.Destroy()
+	reader.start, reader.end = 0, 0
+	if reader.err == nil {
+		reader.err = fmt.Errorf("read from closed decrypt reader")
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"bytes"
+	"github.com/awnumar/memguard"
+	"io/ioutil"
+	"testing"
+)
+
+// aeadTagLen is the overhead of a chunk of both ciphers.
+const aeadTagLen = 16
+
+func encryptAEAD(t *testing.T, key []byte, header *ObjectHeader, plaintext []byte) []byte {
+	message := new(bytes.Buffer)
+	writer, err := NewObjectEncryptWriter(memguard.NewBufferFromBytes(append([]byte(nil), key...)), header,
+		[]byte("header"), message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write in odd sizes, so that writes straddle chunks.
+	for start := 0; start < len(plaintext); start += 7 {
+		end := start + 7
+		if end > len(plaintext) {
+			end = len(plaintext)
+		}
+		if _, err := writer.Write(plaintext[start:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return message.Bytes()
+}
+
+func decryptAEAD(key []byte, header *ObjectHeader, headerBytes []byte, message []byte) ([]byte, error) {
+	reader, err := NewObjectDecryptReader(memguard.NewBufferFromBytes(append([]byte(nil), key...)), header,
+		headerBytes, bytes.NewReader(message))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+func TestAEADRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	otherKey := bytes.Repeat([]byte{0x43}, 32)
+
+	for _, cipherName := range CipherNames() {
+		header := &ObjectHeader{Cipher: cipherName, ChunkSize: 16}
+		for _, size := range []int{0, 1, 15, 16, 17, 32, 100} {
+			plaintext := bytes.Repeat([]byte{0x07}, size)
+			message := encryptAEAD(t, key, header, plaintext)
+
+			decrypted, err := decryptAEAD(key, header, []byte("header"), message)
+			if err != nil {
+				t.Errorf("%s, %d bytes: %v", cipherName, size, err)
+			} else if !bytes.Equal(decrypted, plaintext) {
+				t.Errorf("%s, %d bytes: decrypted plaintext does not match", cipherName, size)
+			}
+
+			if _, err := decryptAEAD(key, header, []byte("other"), message); err == nil {
+				t.Errorf("%s, %d bytes: message was decrypted with a different header", cipherName, size)
+			}
+			if _, err := decryptAEAD(otherKey, header, []byte("header"), message); err == nil {
+				t.Errorf("%s, %d bytes: message was decrypted with a different key", cipherName, size)
+			}
+			for _, otherCipher := range append(CipherNames(), "") {
+				if otherCipher == cipherName {
+					continue
+				}
+				other := &ObjectHeader{Cipher: otherCipher, ChunkSize: 16}
+				if _, err := decryptAEAD(key, other, []byte("header"), message); err == nil {
+					t.Errorf("%s, %d bytes: message was decrypted as %q", cipherName, size, otherCipher)
+				}
+			}
+		}
+	}
+}
+
+func TestAEADRejectsTruncatedAndReordered(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	const chunkSize = 16
+	const chunkLen = chunkSize + aeadTagLen
+
+	for _, cipherName := range CipherNames() {
+		header := &ObjectHeader{Cipher: cipherName, ChunkSize: chunkSize}
+		message := encryptAEAD(t, key, header, bytes.Repeat([]byte{0x07}, 3*chunkSize))
+
+		// Cutting the message at a chunk boundary leaves a valid chunk which isn't marked final.
+		truncated := message[:aeadSaltLen+2*chunkLen]
+		if _, err := decryptAEAD(key, header, []byte("header"), truncated); err == nil {
+			t.Errorf("%s: truncated message was decrypted", cipherName)
+		}
+
+		reordered := append([]byte(nil), message...)
+		copy(reordered[aeadSaltLen:], message[aeadSaltLen+chunkLen:aeadSaltLen+2*chunkLen])
+		copy(reordered[aeadSaltLen+chunkLen:], message[aeadSaltLen:aeadSaltLen+chunkLen])
+		if _, err := decryptAEAD(key, header, []byte("header"), reordered); err == nil {
+			t.Errorf("%s: reordered message was decrypted", cipherName)
+		}
+
+		tampered := append([]byte(nil), message...)
+		tampered[aeadSaltLen+chunkLen] ^= 1
+		if _, err := decryptAEAD(key, header, []byte("header"), tampered); err == nil {
+			t.Errorf("%s: tampered message was decrypted", cipherName)
+		}
+
+		if _, err := decryptAEAD(key, header, []byte("header"), append(message, 0)); err == nil {
+			t.Errorf("%s: message with trailing data was decrypted", cipherName)
+		}
+	}
+
+	if err := CheckCipher("rot13"); err == nil {
+		t.Errorf("an unknown cipher was accepted")
+	}
+}
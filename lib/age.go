@@ -0,0 +1,567 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Objects can also be encrypted in the age format (https://age-encryption.org/v1), so that they can be decrypted
+// offline with the age tool, and files encrypted by age can be pulled like any other object. An age file is laid out as:
+//
+//	"age-encryption.org/v1" | stanzas, one per recipient | "---" MAC | nonce (16 bytes) | payload
+//
+// where each stanza wraps a random 16 byte file key to a recipient, the MAC is HMAC-SHA-256 of the header under
+// HKDF-SHA-256(file key, "header"), and the payload is the data sealed with ChaCha20-Poly1305 in 64 KiB chunks under
+// HKDF-SHA-256(file key, nonce, "payload"). Age files only hold data, so they have no dead-drop header or metadata.
+//
+// Age X25519 recipients are the same keys as X25519Recipient, written as "age1..." instead of PEM, and passphrases
+// are supported with scrypt stanzas.
+const AgePrefix = "age-encryption.org/v1\n"
+
+const ageFileKeyLen = 16
+const ageNonceLen = 16
+const ageChunkSize = 64 * 1024
+const ageColumns = 64
+
+// Age keys are bech32 encoded with these human readable parts.
+const ageRecipientHrp = "age"
+const ageIdentityHrp = "AGE-SECRET-KEY-"
+
+const ageX25519Label = "age-encryption.org/v1/X25519"
+const ageScryptLabel = "age-encryption.org/v1/scrypt"
+
+// The scrypt work factor (log2 of N) of passphrase stanzas, and the largest accepted, as in the age tool.
+const ageScryptWorkFactor = 18
+const maxAgeScryptWorkFactor = 22
+
+// Bound header lines for the same reason as the header size.
+const maxAgeLineLen = 1024
+
+var ageBase64 = base64.RawStdEncoding.Strict()
+
+type ageStanza struct {
+	Type string
+	Args []string
+	Body []byte
+}
+
+// AgeRecipient is a recipient which can be written to age files.
+type AgeRecipient interface {
+	wrapAgeFileKey(fileKey []byte) (*ageStanza, error)
+}
+
+// AgeIdentity is an identity which can read age files.
+type AgeIdentity interface {
+	// unwrapAgeFileKey returns the file key wrapped to this identity in one of the stanzas, or an error if none was.
+	unwrapAgeFileKey(stanzas []*ageStanza) ([]byte, error)
+}
+
+// IsAge reports whether an object starts like an age file.
+func IsAge(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, []byte(AgePrefix))
+}
+
+// ParseAgeRecipient parses an "age1..." X25519 recipient.
+func ParseAgeRecipient(s string) (*X25519Recipient, error) {
+	hrp, publicKey, err := bech32Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed age recipient: %v", err)
+	}
+	if hrp != ageRecipientHrp {
+		return nil, fmt.Errorf("malformed age recipient: unexpected type '%s'", hrp)
+	}
+	return NewX25519Recipient(publicKey)
+}
+
+// ParseAgeIdentities parses an age identity file, which holds one "AGE-SECRET-KEY-1..." key per line, along with
+// blank lines and # comments.
+func ParseAgeIdentities(data []byte) ([]*X25519Identity, error) {
+	identities := make([]*X25519Identity, 0, 1)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		hrp, privateKey, err := bech32Decode(line)
+		if err != nil || hrp != strings.ToLower(ageIdentityHrp) {
+			memguard.WipeBytes(privateKey)
+			destroyIdentities(identities)
+			return nil, fmt.Errorf("malformed age identity")
+		}
+
+		identity, err := NewX25519Identity(memguard.NewBufferFromBytes(privateKey))
+		if err != nil {
+			destroyIdentities(identities)
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no age identities found")
+	}
+	return identities, nil
+}
+
+func destroyIdentities(identities []*X25519Identity) {
+	for _, identity := range identities {
+		identity.Destroy()
+	}
+}
+
+// String encodes the recipient as "age1...".
+func (recipient *X25519Recipient) String() string {
+	encoded, _ := bech32Encode(ageRecipientHrp, recipient.publicKey[:])
+	return encoded
+}
+
+// EncodeAge encodes the private key as an age identity file, with the public key in a comment.
+// The returned bytes should be wiped once written.
+func (identity *X25519Identity) EncodeAge() ([]byte, error) {
+	encoded, err := bech32Encode(ageIdentityHrp, identity.privateKey.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return []byte("# public key: " + identity.recipient.String() + "\n" + encoded + "\n"), nil
+}
+
+func (recipient *X25519Recipient) wrapAgeFileKey(fileKey []byte) (*ageStanza, error) {
+	ephemeral := memguard.NewBufferRandom(x25519KeyLen)
+	defer ephemeral.Destroy()
+
+	var ephemeralPublic [x25519KeyLen]byte
+	scalarBaseMult(&ephemeralPublic, ephemeral)
+
+	wrapKey, err := ageX25519WrapKey(ephemeral, &recipient.publicKey, ephemeralPublic[:], recipient.publicKey[:])
+	if err != nil {
+		return nil, err
+	}
+	defer wrapKey.Destroy()
+
+	body, err := ageSealFileKey(wrapKey, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return &ageStanza{Type: "X25519", Args: []string{ageBase64.EncodeToString(ephemeralPublic[:])}, Body: body}, nil
+}
+
+func (identity *X25519Identity) unwrapAgeFileKey(stanzas []*ageStanza) ([]byte, error) {
+	for _, stanza := range stanzas {
+		if stanza.Type != "X25519" {
+			continue
+		}
+		if len(stanza.Args) != 1 {
+			return nil, fmt.Errorf("malformed X25519 stanza")
+		}
+		ephemeralPublic, err := ageBase64.DecodeString(stanza.Args[0])
+		if err != nil || len(ephemeralPublic) != x25519KeyLen {
+			return nil, fmt.Errorf("malformed X25519 stanza")
+		}
+
+		var ephemeralKey [x25519KeyLen]byte
+		copy(ephemeralKey[:], ephemeralPublic)
+		wrapKey, err := ageX25519WrapKey(identity.privateKey, &ephemeralKey, ephemeralPublic, identity.recipient.publicKey[:])
+		if err != nil {
+			continue
+		}
+
+		fileKey, err := ageOpenFileKey(wrapKey, stanza.Body)
+		wrapKey.Destroy()
+		if err == nil {
+			return fileKey, nil
+		}
+	}
+	return nil, fmt.Errorf("no stanza for this identity")
+}
+
+func ageX25519WrapKey(
+	privateKey *memguard.LockedBuffer,
+	publicKey *[x25519KeyLen]byte,
+	ephemeralPublic []byte,
+	recipientPublic []byte,
+) (*memguard.LockedBuffer, error) {
+	var scalar, shared [x25519KeyLen]byte
+	copy(scalar[:], privateKey.Bytes())
+	curve25519.ScalarMult(&shared, &scalar, publicKey)
+	defer memguard.WipeBytes(scalar[:])
+	defer memguard.WipeBytes(shared[:])
+
+	if bytes.Equal(shared[:], make([]byte, x25519KeyLen)) {
+		return nil, fmt.Errorf("invalid X25519 public key")
+	}
+
+	salt := append(append([]byte{}, ephemeralPublic...), recipientPublic...)
+	return ageHKDF(shared[:], salt, ageX25519Label)
+}
+
+// AgeScryptRecipient writes age files which are decrypted with a passphrase. It must be the only recipient of a file.
+type AgeScryptRecipient struct {
+	passphrase *memguard.LockedBuffer
+}
+
+// NewAgeScryptRecipient borrows the passphrase, which must outlive the recipient.
+func NewAgeScryptRecipient(passphrase *memguard.LockedBuffer) *AgeScryptRecipient {
+	return &AgeScryptRecipient{passphrase: passphrase}
+}
+
+func (recipient *AgeScryptRecipient) wrapAgeFileKey(fileKey []byte) (*ageStanza, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	wrapKey, err := ageScryptWrapKey(recipient.passphrase, salt, ageScryptWorkFactor)
+	if err != nil {
+		return nil, err
+	}
+	defer wrapKey.Destroy()
+
+	body, err := ageSealFileKey(wrapKey, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{ageBase64.EncodeToString(salt), strconv.Itoa(ageScryptWorkFactor)}
+	return &ageStanza{Type: "scrypt", Args: args, Body: body}, nil
+}
+
+// AgeScryptIdentity reads age files encrypted with a passphrase.
+type AgeScryptIdentity struct {
+	passphrase *memguard.LockedBuffer
+}
+
+// NewAgeScryptIdentity borrows the passphrase, which must outlive the identity.
+func NewAgeScryptIdentity(passphrase *memguard.LockedBuffer) *AgeScryptIdentity {
+	return &AgeScryptIdentity{passphrase: passphrase}
+}
+
+func (identity *AgeScryptIdentity) unwrapAgeFileKey(stanzas []*ageStanza) ([]byte, error) {
+	for _, stanza := range stanzas {
+		if stanza.Type != "scrypt" {
+			continue
+		}
+		// Passphrases are meant for a single person, so files sharing them with other recipients are refused.
+		if len(stanzas) != 1 {
+			return nil, fmt.Errorf("scrypt stanza must be the only stanza")
+		}
+		if len(stanza.Args) != 2 {
+			return nil, fmt.Errorf("malformed scrypt stanza")
+		}
+
+		salt, err := ageBase64.DecodeString(stanza.Args[0])
+		if err != nil || len(salt) != 16 {
+			return nil, fmt.Errorf("malformed scrypt stanza")
+		}
+		workFactor, err := strconv.Atoi(stanza.Args[1])
+		if err != nil || strconv.Itoa(workFactor) != stanza.Args[1] || workFactor <= 0 {
+			return nil, fmt.Errorf("malformed scrypt stanza")
+		}
+		if workFactor > maxAgeScryptWorkFactor {
+			return nil, fmt.Errorf("scrypt work factor %d is too large", workFactor)
+		}
+
+		wrapKey, err := ageScryptWrapKey(identity.passphrase, salt, workFactor)
+		if err != nil {
+			return nil, err
+		}
+		defer wrapKey.Destroy()
+
+		fileKey, err := ageOpenFileKey(wrapKey, stanza.Body)
+		if err != nil {
+			return nil, fmt.Errorf("incorrect passphrase")
+		}
+		return fileKey, nil
+	}
+	return nil, fmt.Errorf("file was not encrypted with a passphrase")
+}
+
+func ageScryptWrapKey(passphrase *memguard.LockedBuffer, salt []byte, workFactor int) (*memguard.LockedBuffer, error) {
+	key, err := scrypt.Key(passphrase.Bytes(), append([]byte(ageScryptLabel), salt...), 1<<uint(workFactor), 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	return memguard.NewBufferFromBytes(key), nil
+}
+
+func ageSealFileKey(wrapKey *memguard.LockedBuffer, fileKey []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(wrapKey.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), fileKey, nil), nil
+}
+
+func ageOpenFileKey(wrapKey *memguard.LockedBuffer, body []byte) ([]byte, error) {
+	if len(body) != ageFileKeyLen+chacha20poly1305.Overhead {
+		return nil, fmt.Errorf("malformed stanza body")
+	}
+
+	aead, err := chacha20poly1305.New(wrapKey.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, aead.NonceSize()), body, nil)
+}
+
+func ageHKDF(secret []byte, salt []byte, info string) (*memguard.LockedBuffer, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	return memguard.NewBufferFromBytes(key), nil
+}
+
+// agePayloadNonce is the STREAM nonce of age payload chunks: an 11 byte counter and the final flag.
+func agePayloadNonce(index uint64, final bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], index)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// NewAgeEncryptWriter returns a writer which encrypts the data written to it as an age file to the recipients.
+// The file is only complete once the writer is closed, and closing it does not close w.
+func NewAgeEncryptWriter(recipients []AgeRecipient, w io.Writer) (io.WriteCloser, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients")
+	}
+
+	fileKey := memguard.NewBufferRandom(ageFileKeyLen)
+	defer fileKey.Destroy()
+
+	header := bytes.NewBufferString(AgePrefix)
+	for _, recipient := range recipients {
+		if _, ok := recipient.(*AgeScryptRecipient); ok && len(recipients) > 1 {
+			return nil, fmt.Errorf("a passphrase must be the only recipient")
+		}
+
+		stanza, err := recipient.wrapAgeFileKey(fileKey.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("error wrapping key to recipient: %v", err)
+		}
+		writeAgeStanza(header, stanza)
+	}
+
+	header.WriteString("---")
+	mac, err := ageHeaderMAC(fileKey, header.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	header.WriteString(" " + ageBase64.EncodeToString(mac) + "\n")
+
+	nonce := make([]byte, ageNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header.Write(nonce)
+
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+
+	aead, err := agePayloadAEAD(fileKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return newSealWriter(aead, nil, agePayloadNonce, w, ageChunkSize), nil
+}
+
+func writeAgeStanza(w *bytes.Buffer, stanza *ageStanza) {
+	w.WriteString("-> " + stanza.Type)
+	for _, arg := range stanza.Args {
+		w.WriteString(" " + arg)
+	}
+	w.WriteString("\n")
+
+	// The body is wrapped into full lines, followed by a final line which is shorter (and may be empty).
+	body := ageBase64.EncodeToString(stanza.Body)
+	for len(body) >= ageColumns {
+		w.WriteString(body[:ageColumns] + "\n")
+		body = body[ageColumns:]
+	}
+	w.WriteString(body + "\n")
+}
+
+func ageHeaderMAC(fileKey *memguard.LockedBuffer, header []byte) ([]byte, error) {
+	macKey, err := ageHKDF(fileKey.Bytes(), nil, "header")
+	if err != nil {
+		return nil, err
+	}
+	defer macKey.Destroy()
+
+	mac := hmac.New(sha256.New, macKey.Bytes())
+	mac.Write(header)
+	return mac.Sum(nil), nil
+}
+
+func agePayloadAEAD(fileKey *memguard.LockedBuffer, nonce []byte) (cipher.AEAD, error) {
+	payloadKey, err := ageHKDF(fileKey.Bytes(), nonce, "payload")
+	if err != nil {
+		return nil, err
+	}
+	defer payloadKey.Destroy()
+
+	return chacha20poly1305.New(payloadKey.Bytes())
+}
+
+// NewAgeDecryptReader returns a reader of the data of an age file, unwrapping its file key with whichever identity it
+// was encrypted to. As with NewDecryptReader, the data is only authentic once the reader returns io.EOF, and closing
+// the reader does not close r.
+func NewAgeDecryptReader(identities []AgeIdentity, r io.Reader) (io.ReadCloser, error) {
+	reader := bufio.NewReader(r)
+
+	stanzas, header, mac, err := readAgeHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var fileKey *memguard.LockedBuffer
+	var unwrapErr error
+	for _, identity := range identities {
+		key, err := identity.unwrapAgeFileKey(stanzas)
+		if err == nil {
+			fileKey = memguard.NewBufferFromBytes(key)
+			break
+		}
+		unwrapErr = err
+	}
+	if fileKey == nil {
+		if len(identities) == 1 && unwrapErr != nil {
+			return nil, fmt.Errorf("age file could not be decrypted: %v", unwrapErr)
+		}
+		return nil, fmt.Errorf("age file was not encrypted to any of your keys")
+	}
+	defer fileKey.Destroy()
+
+	expected, err := ageHeaderMAC(fileKey, header)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, expected) {
+		return nil, fmt.Errorf("bad age header MAC")
+	}
+
+	nonce := make([]byte, ageNonceLen)
+	if _, err := io.ReadFull(reader, nonce); err != nil {
+		return nil, fmt.Errorf("age file is truncated")
+	}
+
+	aead, err := agePayloadAEAD(fileKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return newOpenReaderWithAEAD(aead, nil, agePayloadNonce, reader, ageChunkSize), nil
+}
+
+// readAgeHeader parses the stanzas and MAC of an age header, also returning the header bytes the MAC covers.
+func readAgeHeader(r *bufio.Reader) ([]*ageStanza, []byte, []byte, error) {
+	header := new(bytes.Buffer)
+
+	line, err := readAgeLine(r, header)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if line+"\n" != AgePrefix {
+		return nil, nil, nil, fmt.Errorf("not an age file")
+	}
+
+	var stanzas []*ageStanza
+	for {
+		line, err := readAgeLine(r, header)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if strings.HasPrefix(line, "--- ") {
+			mac, err := ageBase64.DecodeString(line[len("--- "):])
+			if err != nil || len(mac) != sha256.Size || len(stanzas) == 0 {
+				return nil, nil, nil, fmt.Errorf("malformed age header")
+			}
+			// The MAC covers the header up to and including "---".
+			covered := header.Bytes()[:header.Len()-len(line)-1+len("---")]
+			return stanzas, covered, mac, nil
+		}
+
+		if !strings.HasPrefix(line, "-> ") {
+			return nil, nil, nil, fmt.Errorf("malformed age header")
+		}
+		args := strings.Split(line[len("-> "):], " ")
+		for _, arg := range args {
+			if arg == "" {
+				return nil, nil, nil, fmt.Errorf("malformed age header")
+			}
+		}
+
+		body, err := readAgeBody(r, header)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		stanzas = append(stanzas, &ageStanza{Type: args[0], Args: args[1:], Body: body})
+		if header.Len() > maxHeaderLen {
+			return nil, nil, nil, fmt.Errorf("age header too large")
+		}
+	}
+}
+
+func readAgeBody(r *bufio.Reader, header *bytes.Buffer) ([]byte, error) {
+	var body []byte
+	for {
+		line, err := readAgeLine(r, header)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) > ageColumns {
+			return nil, fmt.Errorf("malformed age header")
+		}
+
+		decoded, err := ageBase64.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("malformed age header")
+		}
+		body = append(body, decoded...)
+
+		if len(line) < ageColumns {
+			return body, nil
+		}
+	}
+}
+
+// readAgeLine reads a line of the header into header, returning it without its newline.
+func readAgeLine(r *bufio.Reader, header *bytes.Buffer) (string, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return "", fmt.Errorf("age header is truncated")
+		} else if err != nil {
+			return "", err
+		}
+
+		header.WriteByte(b)
+		if b == '\n' {
+			return string(line), nil
+		}
+		// Header lines are printable ASCII.
+		if b < 0x20 || b > 0x7e || len(line) >= maxAgeLineLen {
+			return "", fmt.Errorf("malformed age header")
+		}
+		line = append(line, b)
+	}
+}
@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"bytes"
+	"github.com/awnumar/memguard"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readTestdata(t *testing.T, name string) []byte {
+	contents, err := ioutil.ReadFile(filepath.Join("testdata", "age", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+func decryptAge(identities []AgeIdentity, file []byte) ([]byte, error) {
+	reader, err := NewAgeDecryptReader(identities, bytes.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+func TestAgeVectors(t *testing.T) {
+	plaintext := readTestdata(t, "plaintext.txt")
+
+	keyFile := readTestdata(t, "x25519.key")
+	identities, err := ParseAgeIdentities(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destroyIdentities(identities)
+	comment := strings.SplitN(string(keyFile), "\n", 2)[0]
+	if recipient := "# public key: " + identities[0].Recipient().String(); recipient != comment {
+		t.Errorf("identity has the recipient %q, expected %q", recipient, comment)
+	}
+
+	passphrase := memguard.NewBufferFromBytes([]byte("dead-drop age vector passphrase"))
+	defer passphrase.Destroy()
+
+	for _, test := range []struct {
+		name     string
+		identity AgeIdentity
+	}{
+		{"x25519.age", identities[0]},
+		{"scrypt.age", NewAgeScryptIdentity(passphrase)},
+	} {
+		file := readTestdata(t, test.name)
+		if !IsAge(file) {
+			t.Errorf("%s: not recognized as an age file", test.name)
+		}
+		decrypted, err := decryptAge([]AgeIdentity{test.identity}, file)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("%s: decrypted data does not match", test.name)
+		}
+
+		// Changes to the stanzas or the payload are detected.
+		stanza := bytes.Index(file, []byte("\n-> ")) + len("\n-> ")
+		for _, offset := range []int{stanza, len(file) - 1} {
+			changed := append([]byte(nil), file...)
+			changed[offset] ^= 1
+			if _, err := decryptAge([]AgeIdentity{test.identity}, changed); err == nil {
+				t.Errorf("%s: file changed at byte %d was decrypted", test.name, offset)
+			}
+		}
+	}
+}
+
+func TestAgeRoundTrip(t *testing.T) {
+	alice := GenerateX25519Identity()
+	defer alice.Destroy()
+	bob := GenerateX25519Identity()
+	defer bob.Destroy()
+	mallory := GenerateX25519Identity()
+	defer mallory.Destroy()
+
+	// Parsed recipients are the identities' own.
+	recipient, err := ParseAgeRecipient(bob.Recipient().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipients := []AgeRecipient{alice.Recipient(), recipient}
+
+	for _, size := range []int{0, 1, ageChunkSize, ageChunkSize + 1, 2*ageChunkSize + 7} {
+		plaintext := bytes.Repeat([]byte{0x07}, size)
+		file := new(bytes.Buffer)
+		writer, err := NewAgeEncryptWriter(recipients, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, identity := range []*X25519Identity{alice, bob} {
+			decrypted, err := decryptAge([]AgeIdentity{mallory, identity}, file.Bytes())
+			if err != nil {
+				t.Errorf("%d bytes: %v", size, err)
+			} else if !bytes.Equal(decrypted, plaintext) {
+				t.Errorf("%d bytes: decrypted data does not match", size)
+			}
+		}
+		if _, err := decryptAge([]AgeIdentity{mallory}, file.Bytes()); err == nil {
+			t.Errorf("%d bytes: file was decrypted by another identity", size)
+		}
+		if _, err := decryptAge([]AgeIdentity{alice}, file.Bytes()[:file.Len()-1]); err == nil {
+			t.Errorf("%d bytes: truncated file was decrypted", size)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package lib
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// AliasHeader carries the alias an object is dropped under, which makes it the next version of the objects dropped
+// under the alias before.
+const AliasHeader = "X-Object-Alias"
+
+// Aliases match AliasRegex. Like labels, servers store them in the clear, so they mustn't hold anything secret.
+const AliasRegex = "^[a-z0-9][a-z0-9._-]{0,62}$"
+
+// LatestVersion stands for the version number of the latest version of an alias, e.g. in /alias/release/latest.
+const LatestVersion = "latest"
+
+// VersionSeparator separates an alias from a version number in the names of versions, e.g. release@2.
+const VersionSeparator = "@"
+
+var aliasRegex = regexp.MustCompile(AliasRegex)
+
+// CheckAlias returns an error unless alias is valid.
+func CheckAlias(alias string) error {
+	if !aliasRegex.MatchString(alias) {
+		return fmt.Errorf("invalid alias '%s', which must be up to 63 lowercase letters, digits, '.', '_' or '-'",
+			alias)
+	}
+	return nil
+}
+
+// ParseVersionName parses the name of a version of an alias, e.g. release@2, returning the alias and the version
+// number, which is 0 for names without one, e.g. release, which name the latest version.
+func ParseVersionName(name string) (string, int, error) {
+	alias, rawVersion := name, ""
+	if split := strings.SplitN(name, VersionSeparator, 2); len(split) == 2 {
+		alias, rawVersion = split[0], split[1]
+	}
+	if err := CheckAlias(alias); err != nil {
+		return "", 0, err
+	}
+	if rawVersion == "" {
+		return alias, 0, nil
+	}
+
+	version, err := strconv.Atoi(rawVersion)
+	if err != nil || version <= 0 {
+		return "", 0, fmt.Errorf("invalid version '%s', which must be a positive number", rawVersion)
+	}
+	return alias, version, nil
+}
@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"math/big"
+)
+
+// ParseAuthorizedKey parses the public key of an authorized key, which is either a PEM encoded RSA or Ed25519 key as
+// written by gen-key, or an OpenSSH public key (e.g. ~/.ssh/id_ed25519.pub). It returns an *rsa.PublicKey or an
+// ed25519.PublicKey.
+func ParseAuthorizedKey(keyBytes []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return parseOpenSSHAuthorizedKey(keyBytes)
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case Ed25519PublicKeyType:
+		if len(block.Bytes) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Ed25519 public keys must be %d bytes", ed25519.PublicKeySize)
+		}
+		return ed25519.PublicKey(block.Bytes), nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type '%s'", block.Type)
+	}
+}
+
+func parseOpenSSHAuthorizedKey(keyBytes []byte) (crypto.PublicKey, error) {
+	sshKey, _, _, _, err := ssh.ParseAuthorizedKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("not a PEM or OpenSSH public key: %v", err)
+	}
+
+	cryptoKey, ok := sshKey.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported OpenSSH key type '%s'", sshKey.Type())
+	}
+
+	switch key := cryptoKey.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return key, nil
+	case ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported OpenSSH key type '%s', use an RSA or Ed25519 key", sshKey.Type())
+	}
+}
+
+// LockedRSAKey is an RSA private key held in a memguard LockedBuffer as PKCS #1 DER, which decrypts RSA-OAEP
+// ciphertexts, e.g. the tokens of a remote, and signs. The key is parsed for each decryption or signature, and the
+// parsed key wiped after it.
+type LockedRSAKey struct {
+	der       *memguard.LockedBuffer
+	publicKey *rsa.PublicKey
+}
+
+// NewLockedRSAKey takes ownership of a PKCS #1 DER encoded RSA private key, which is destroyed by Destroy.
+func NewLockedRSAKey(der *memguard.LockedBuffer) (*LockedRSAKey, error) {
+	privateKey, err := x509.ParsePKCS1PrivateKey(der.Bytes())
+	if err != nil {
+		der.Destroy()
+		return nil, err
+	}
+	defer wipeRSAKey(privateKey)
+
+	publicKey := privateKey.PublicKey
+	return &LockedRSAKey{der: der, publicKey: &publicKey}, nil
+}
+
+// LockRSAKey moves a parsed RSA private key into a LockedRSAKey, wiping the parsed key.
+func LockRSAKey(privateKey *rsa.PrivateKey) (*LockedRSAKey, error) {
+	der := x509.MarshalPKCS1PrivateKey(privateKey)
+	defer memguard.WipeBytes(der)
+	wipeRSAKey(privateKey)
+
+	return NewLockedRSAKey(memguard.NewBufferFromBytes(der))
+}
+
+func (key *LockedRSAKey) Public() crypto.PublicKey {
+	return key.publicKey
+}
+
+// Decrypt decrypts RSA-OAEP ciphertexts, as *rsa.PrivateKey does. The returned plaintext should be wiped once used.
+func (key *LockedRSAKey) Decrypt(rand io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	privateKey, err := x509.ParsePKCS1PrivateKey(key.der.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer wipeRSAKey(privateKey)
+
+	return privateKey.Decrypt(rand, ciphertext, opts)
+}
+
+// Sign signs a digest with RSA PKCS #1 v1.5 or PSS, as *rsa.PrivateKey does, e.g. a shared keyring key.
+func (key *LockedRSAKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	privateKey, err := x509.ParsePKCS1PrivateKey(key.der.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer wipeRSAKey(privateKey)
+
+	return privateKey.Sign(rand, digest, opts)
+}
+
+func (key *LockedRSAKey) Destroy() {
+	key.der.Destroy()
+}
+
+// wipeRSAKey zeroes the private values of a parsed RSA key. Values the rsa package derives and keeps internally can't
+// be reached, so this narrows how long the key is left in ordinary memory rather than ruling it out.
+func wipeRSAKey(key *rsa.PrivateKey) {
+	values := []*big.Int{key.D, key.Precomputed.Dp, key.Precomputed.Dq, key.Precomputed.Qinv}
+	values = append(values, key.Primes...)
+	for _, crt := range key.Precomputed.CRTValues {
+		values = append(values, crt.Exp, crt.Coeff, crt.R)
+	}
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+		words := value.Bits()
+		for i := range words {
+			words[i] = 0
+		}
+		value.SetInt64(0)
+	}
+}
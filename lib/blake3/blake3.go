@@ -0,0 +1,259 @@
+// Package blake3 implements the BLAKE3 hash function with 32 byte digests, following its reference implementation
+// (https://github.com/BLAKE3-team/BLAKE3/blob/master/reference_impl/reference_impl.rs). Only plain hashing is
+// implemented, not the keyed and key derivation modes, or longer outputs.
+package blake3
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// Size is the size of a BLAKE3 checksum in bytes.
+const Size = 32
+
+// BlockSize is the block size of BLAKE3 in bytes.
+const BlockSize = 64
+
+const (
+	chunkLen = 1024
+
+	chunkStart = 1 << 0
+	chunkEnd   = 1 << 1
+	parent     = 1 << 2
+	root       = 1 << 3
+)
+
+var iv = [8]uint32{0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A, 0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19}
+
+var msgPermutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func g(state *[16]uint32, a, b, c, d int, mx, my uint32) {
+	state[a] += state[b] + mx
+	state[d] = bits.RotateLeft32(state[d]^state[a], -16)
+	state[c] += state[d]
+	state[b] = bits.RotateLeft32(state[b]^state[c], -12)
+	state[a] += state[b] + my
+	state[d] = bits.RotateLeft32(state[d]^state[a], -8)
+	state[c] += state[d]
+	state[b] = bits.RotateLeft32(state[b]^state[c], -7)
+}
+
+func round(state *[16]uint32, m *[16]uint32) {
+	// Columns.
+	g(state, 0, 4, 8, 12, m[0], m[1])
+	g(state, 1, 5, 9, 13, m[2], m[3])
+	g(state, 2, 6, 10, 14, m[4], m[5])
+	g(state, 3, 7, 11, 15, m[6], m[7])
+	// Diagonals.
+	g(state, 0, 5, 10, 15, m[8], m[9])
+	g(state, 1, 6, 11, 12, m[10], m[11])
+	g(state, 2, 7, 8, 13, m[12], m[13])
+	g(state, 3, 4, 9, 14, m[14], m[15])
+}
+
+func permute(m *[16]uint32) {
+	var permuted [16]uint32
+	for i := range permuted {
+		permuted[i] = m[msgPermutation[i]]
+	}
+	*m = permuted
+}
+
+func compress(cv *[8]uint32, block *[16]uint32, counter uint64, blockLen uint32, flags uint32) [16]uint32 {
+	state := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		iv[0], iv[1], iv[2], iv[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	m := *block
+
+	for i := 0; i < 7; i++ {
+		round(&state, &m)
+		if i < 6 {
+			permute(&m)
+		}
+	}
+
+	for i := 0; i < 8; i++ {
+		state[i] ^= state[i+8]
+		state[i+8] ^= cv[i]
+	}
+	return state
+}
+
+func first8(words [16]uint32) [8]uint32 {
+	var cv [8]uint32
+	copy(cv[:], words[:8])
+	return cv
+}
+
+func blockWords(block *[BlockSize]byte) [16]uint32 {
+	var words [16]uint32
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(block[4*i:])
+	}
+	return words
+}
+
+// output is the state just before the final compression of a node, which can produce either its chaining value or,
+// if it is the root node, the checksum.
+type output struct {
+	inputCV  [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o *output) chainingValue() [8]uint32 {
+	return first8(compress(&o.inputCV, &o.block, o.counter, o.blockLen, o.flags))
+}
+
+func (o *output) rootBytes(b []byte) []byte {
+	words := compress(&o.inputCV, &o.block, 0, o.blockLen, o.flags|root)
+	var sum [Size]byte
+	for i := 0; i < Size/4; i++ {
+		binary.LittleEndian.PutUint32(sum[4*i:], words[i])
+	}
+	return append(b, sum[:]...)
+}
+
+func parentOutput(left [8]uint32, right [8]uint32) output {
+	o := output{inputCV: iv, blockLen: BlockSize, flags: parent}
+	copy(o.block[:8], left[:])
+	copy(o.block[8:], right[:])
+	return o
+}
+
+// chunkState hashes the blocks of a 1 KiB chunk of the input.
+type chunkState struct {
+	cv               [8]uint32
+	chunkCounter     uint64
+	block            [BlockSize]byte
+	blockLen         int
+	blocksCompressed int
+}
+
+func newChunkState(chunkCounter uint64) chunkState {
+	return chunkState{cv: iv, chunkCounter: chunkCounter}
+}
+
+func (cs *chunkState) len() int {
+	return BlockSize*cs.blocksCompressed + cs.blockLen
+}
+
+func (cs *chunkState) startFlag() uint32 {
+	if cs.blocksCompressed == 0 {
+		return chunkStart
+	}
+	return 0
+}
+
+func (cs *chunkState) update(input []byte) {
+	for len(input) > 0 {
+		// The last block of a chunk is compressed by output, with the chunk end flag, so a full block is only
+		// compressed here once more input follows it.
+		if cs.blockLen == BlockSize {
+			words := blockWords(&cs.block)
+			cs.cv = first8(compress(&cs.cv, &words, cs.chunkCounter, BlockSize, cs.startFlag()))
+			cs.blocksCompressed++
+			cs.block = [BlockSize]byte{}
+			cs.blockLen = 0
+		}
+
+		n := copy(cs.block[cs.blockLen:], input)
+		cs.blockLen += n
+		input = input[n:]
+	}
+}
+
+func (cs *chunkState) output() output {
+	return output{
+		inputCV:  cs.cv,
+		block:    blockWords(&cs.block),
+		counter:  cs.chunkCounter,
+		blockLen: uint32(cs.blockLen),
+		flags:    cs.startFlag() | chunkEnd,
+	}
+}
+
+// digest is an incremental BLAKE3 hasher. The chaining values of complete subtrees are kept on a stack, which is
+// merged as chunks complete: a subtree is complete when the number of chunks has a trailing 0 bit for it.
+type digest struct {
+	chunk   chunkState
+	cvStack [54][8]uint32
+	cvCount int
+}
+
+// New returns a hash.Hash computing the BLAKE3 checksum.
+func New() hash.Hash {
+	d := &digest{}
+	d.Reset()
+	return d
+}
+
+// Sum256 returns the BLAKE3 checksum of data.
+func Sum256(data []byte) [Size]byte {
+	d := &digest{}
+	d.Reset()
+	d.Write(data)
+	var sum [Size]byte
+	d.Sum(sum[:0])
+	return sum
+}
+
+func (d *digest) Reset() {
+	d.chunk = newChunkState(0)
+	d.cvCount = 0
+}
+
+func (d *digest) Size() int {
+	return Size
+}
+
+func (d *digest) BlockSize() int {
+	return BlockSize
+}
+
+func (d *digest) addChunkChainingValue(cv [8]uint32, totalChunks uint64) {
+	for totalChunks&1 == 0 {
+		d.cvCount--
+		parentNode := parentOutput(d.cvStack[d.cvCount], cv)
+		cv = parentNode.chainingValue()
+		totalChunks >>= 1
+	}
+	d.cvStack[d.cvCount] = cv
+	d.cvCount++
+}
+
+func (d *digest) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// A full chunk is only finished once more input follows it, since the last chunk is the root if it is the only
+		// one.
+		if d.chunk.len() == chunkLen {
+			chunkOutput := d.chunk.output()
+			totalChunks := d.chunk.chunkCounter + 1
+			d.addChunkChainingValue(chunkOutput.chainingValue(), totalChunks)
+			d.chunk = newChunkState(totalChunks)
+		}
+
+		take := chunkLen - d.chunk.len()
+		if take > len(p) {
+			take = len(p)
+		}
+		d.chunk.update(p[:take])
+		p = p[take:]
+	}
+	return n, nil
+}
+
+// Sum appends the checksum of the data written so far to b, without changing the state of the hasher.
+func (d *digest) Sum(b []byte) []byte {
+	o := d.chunk.output()
+	for i := d.cvCount - 1; i >= 0; i-- {
+		o = parentOutput(d.cvStack[i], o.chainingValue())
+	}
+	return o.rootBytes(b)
+}
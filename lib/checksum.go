@@ -0,0 +1,45 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"dead-drop/lib/blake3"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"sort"
+)
+
+// Checksum algorithms of objects, which references name, and the server can compute to verify stored objects.
+const (
+	ChecksumSHA256 = "sha256"
+	ChecksumBLAKE3 = "blake3"
+)
+
+var checksumHashes = map[string]func() hash.Hash{
+	ChecksumSHA256: sha256.New,
+	ChecksumBLAKE3: blake3.New,
+}
+
+// ChecksumNames returns the names of the checksum algorithms, sorted.
+func ChecksumNames() []string {
+	names := make([]string, 0, len(checksumHashes))
+	for name := range checksumHashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewChecksumHash returns a hash computing checksums with the named algorithm.
+func NewChecksumHash(algorithm string) (hash.Hash, error) {
+	newHash, ok := checksumHashes[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported checksum algorithm '%s'", algorithm)
+	}
+	return newHash(), nil
+}
+
+// EncodeChecksum formats the checksum of an object as it appears in references.
+func EncodeChecksum(sum []byte) string {
+	return base64.URLEncoding.EncodeToString(sum)
+}
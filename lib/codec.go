@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+const CodecNameRegex = "^[a-z0-9][a-z0-9.-]{0,31}$"
+
+// Codec is a transform applied to object data before it is encrypted (e.g. compression), and reversed after it
+// is decrypted. The names of the codecs used for an object are recorded in its header, so any client with the same
+// codecs registered can pull it.
+type Codec interface {
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecNameRegex = regexp.MustCompile(CodecNameRegex)
+
+var codecsLock sync.RWMutex
+var codecs = make(map[string]Codec)
+
+func init() {
+	RegisterCodec("gzip", gzipCodec{})
+	RegisterCodec(CodecPadme, padmeCodec{})
+}
+
+// RegisterCodec makes a codec available by name. It panics if the name is invalid or already registered,
+// since this is a programming error.
+func RegisterCodec(name string, codec Codec) {
+	if !codecNameRegex.MatchString(name) {
+		panic(fmt.Sprintf("invalid codec name '%s'", name))
+	}
+	if codec == nil {
+		panic(fmt.Sprintf("codec '%s' is nil", name))
+	}
+
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	if _, ok := codecs[name]; ok {
+		panic(fmt.Sprintf("codec '%s' is already registered", name))
+	}
+	codecs[name] = codec
+}
+
+func LookupCodec(name string) (Codec, error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("codec '%s' is not registered", name)
+	}
+	return codec, nil
+}
+
+// CodecNames returns the names of all registered codecs, in sorted order.
+func CodecNames() []string {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// EncodeWithCodecs applies the named codecs to data, in order.
+func EncodeWithCodecs(names []string, data []byte) ([]byte, error) {
+	encoded := new(bytes.Buffer)
+	writer, err := NewEncodeWriter(names, encoded)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return encoded.Bytes(), nil
+}
+
+// DecodeWithCodecs reverses EncodeWithCodecs, given the same codec names.
+func DecodeWithCodecs(names []string, data []byte) ([]byte, error) {
+	reader, err := NewDecodeReader(names, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	data, err = ioutil.ReadAll(reader)
+	if closeErr := reader.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// NewEncodeWriter returns a writer which applies the named codecs, in order, to the data written to it, and writes
+// the result to w. It must be closed to flush the codecs, which does not close w.
+func NewEncodeWriter(names []string, w io.Writer) (io.WriteCloser, error) {
+	chain := &codecChain{}
+	for i := len(names) - 1; i >= 0; i-- {
+		codec, err := LookupCodec(names[i])
+		if err != nil {
+			chain.Close()
+			return nil, err
+		}
+
+		writer, err := codec.NewWriter(w)
+		if err != nil {
+			chain.Close()
+			return nil, fmt.Errorf("codec '%s' failed: %v", names[i], err)
+		}
+		w = writer
+		// The first codec is outermost, and must be closed first so that it flushes into the next one.
+		chain.closers = append([]codecCloser{{names[i], writer}}, chain.closers...)
+	}
+
+	chain.Writer = w
+	return chain, nil
+}
+
+// NewDecodeReader returns a reader which reverses NewEncodeWriter, given the same codec names.
+// Closing it closes the codecs, but not r.
+func NewDecodeReader(names []string, r io.Reader) (io.ReadCloser, error) {
+	chain := &codecChain{}
+	for i := len(names) - 1; i >= 0; i-- {
+		codec, err := LookupCodec(names[i])
+		if err != nil {
+			chain.Close()
+			return nil, err
+		}
+
+		reader, err := codec.NewReader(r)
+		if err != nil {
+			chain.Close()
+			return nil, fmt.Errorf("codec '%s' failed: %v", names[i], err)
+		}
+		r = reader
+		chain.closers = append([]codecCloser{{names[i], reader}}, chain.closers...)
+	}
+
+	chain.Reader = r
+	return chain, nil
+}
+
+// codecChain is the writer or reader of a stack of codecs, which closes them outermost first.
+type codecChain struct {
+	io.Writer
+	io.Reader
+	closers []codecCloser
+}
+
+type codecCloser struct {
+	name   string
+	closer io.Closer
+}
+
+func (chain *codecChain) Close() error {
+	var err error
+	for _, closer := range chain.closers {
+		if closeErr := closer.closer.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("codec '%s' failed: %v", closer.name, closeErr)
+		}
+	}
+	chain.closers = nil
+	return err
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, gzip.BestCompression)
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
@@ -1,5 +1,10 @@
 package lib
 
+import (
+	"strconv"
+	"time"
+)
+
 const ObjectPerms = 0660
 const PrivateKeyPerms = 0600
 const PublicKeyPerms = 0660
@@ -10,13 +15,273 @@ const DefaultConfigType = "yml"
 
 const TokenCipherLabel = "token"
 
+// PEM block types of Ed25519 authentication key files, which hold the raw 32 byte seed and public key.
+const Ed25519PrivateKeyType = "ED25519 PRIVATE KEY"
+const Ed25519PublicKeyType = "ED25519 PUBLIC KEY"
+
+// MaxTokenRequestSkew bounds how far the timestamp of a signed token request without a challenge may be from the
+// server's clock.
+const MaxTokenRequestSkew = 30 * time.Second
+
 const KeyNameRegex = "^[a-zA-Z0-9_-]{1,64}$"
 
+// Roles of authorized keys, which limit what their tokens can be used for. Read-only keys can only pull objects, and
+// write-only keys can only drop objects and manage their own drops. Admin keys can do both, and add and remove keys.
+const KeyRoleReadOnly = "read-only"
+const KeyRoleWriteOnly = "write-only"
+const KeyRoleAdmin = "admin"
+
+// UploadSessionHeader carries the upload session a drop belongs to, making retries of the drop idempotent.
+const UploadSessionHeader = "X-Upload-Session"
+
+// ObjectTTLHeader carries the number of seconds after which a dropped object should expire, if sooner than the
+// server's ttl.
+const ObjectTTLHeader = "X-Object-TTL"
+
+// BurnHeader is "true" on drops of objects to be destroyed after their first pull, whether or not the server destroys
+// every object it sends. Pull responses carry it when they are the object's last pull, which destroys it once sent.
+const BurnHeader = "X-Burn-After-Reading"
+
+// MaxPullsHeader carries the number of times a dropped object may be pulled before it is destroyed. Every pull counts,
+// ranged or not, from when it starts.
+const MaxPullsHeader = "X-Max-Pulls"
+
+// ReleaseToHeader carries the names of the keys, separated by commas, a dropped object is released to if the key which
+// dropped it doesn't check in for the number of seconds in CheckinIntervalHeader. Until then, only the key which
+// dropped it may pull it.
+const ReleaseToHeader = "X-Release-To"
+const CheckinIntervalHeader = "X-Checkin-Interval"
+
+// ReleaseAtHeader carries the time, in RFC 3339, before which a dropped object can't be pulled, even by the key which
+// dropped it.
+const ReleaseAtHeader = "X-Release-At"
+
+// CanaryHeader is "true" on drops of decoy objects, any pull of which raises an alert on the server, e.g. to detect a
+// compromised key.
+const CanaryHeader = "X-Canary"
+
+// TokenRequestPayload requests a token for an authorized key, answering a challenge (see TokenChallengePayload). RSA
+// keys are sent the token encrypted with RSA-OAEP, unless they sign the request; Ed25519 keys can't decrypt, so they
+// always sign it. Signed requests (see TokenChallengeData) are sent the token as it is. Signatures are Ed25519, or RSA
+// PKCS #1 v1.5 with SHA-512, which keys held in an ssh-agent can make too.
+// Requests without a Nonce are made by clients older than challenges, which sign TokenSignedData instead, and are only
+// accepted by servers configured to.
 type TokenRequestPayload struct {
+	KeyName   string
+	Nonce     string `json:",omitempty"`
+	Timestamp int64  `json:",omitempty"`
+	Signature []byte `json:",omitempty"`
+	// Scope is one of the TokenScope scopes the token is limited to, or empty for a token with every permission of the
+	// key's role. Oid further limits the token to requests about one object.
+	Scope string `json:",omitempty"`
+	Oid   string `json:",omitempty"`
+	// TTL is the number of seconds the token should be valid for, if less than the server's token ttl.
+	TTL int64 `json:",omitempty"`
+}
+
+// Scopes of tokens, which limit them to one kind of operation, so that a leaked token grants as little as possible.
+// Pull tokens can only pull objects and read what the server knows about them, drop tokens can only drop objects and
+// manage the key's drops, and admin tokens can only add and remove keys.
+const TokenScopePull = "pull"
+const TokenScopeDrop = "drop"
+const TokenScopeAdmin = "admin"
+
+// TokenChallengePayload requests a challenge for a token request of KeyName, and carries the challenge's Nonce in the
+// response. Each challenge can be answered once, within MaxTokenChallengeAge.
+type TokenChallengePayload struct {
 	KeyName string
+	Nonce   string `json:",omitempty"`
+}
+
+// MaxTokenChallengeAge bounds how long after it was issued a challenge can be answered.
+const MaxTokenChallengeAge = 30 * time.Second
+
+// TokenChallengeData is the data signed by a token request answering a challenge, which covers what the token is
+// requested for, so that it can't be changed in transit.
+func TokenChallengeData(payload *TokenRequestPayload) []byte {
+	return []byte("dead-drop token challenge " + payload.KeyName + " " + payload.Nonce + " " + payload.Scope + " " +
+		payload.Oid + " " + strconv.FormatInt(payload.TTL, 10))
+}
+
+// TokenSignedData is the data signed by a token request for keyName, made at timestamp (in unix seconds), by clients
+// older than challenges.
+func TokenSignedData(keyName string, timestamp int64) []byte {
+	return []byte("dead-drop token " + keyName + " " + strconv.FormatInt(timestamp, 10))
 }
 
 type AddKeyPayload struct {
 	Key     []byte
 	KeyName string
+	// Role is one of the KeyRole roles, or empty for the server's default role.
+	Role string `json:",omitempty"`
+	// Namespace is the namespace to add the key to, or empty for the default namespace. Keys of other namespaces
+	// can only add keys to their own namespace, which is the one keys they add are in.
+	Namespace string `json:",omitempty"`
+}
+
+// RemoveKeyPayload names an authorized key to remove, which also revokes the tokens issued to it.
+type RemoveKeyPayload struct {
+	KeyName string
+}
+
+// AccessRecord is a single pull of an object. KeyName is empty if the server does not record requesters.
+// Offset is the byte the pull started from, which is only set for pulls resuming an interrupted one.
+type AccessRecord struct {
+	Time    time.Time
+	KeyName string `json:",omitempty"`
+	Offset  int64  `json:",omitempty"`
+}
+
+// CompleteUploadPayload finishes a multipart upload made of parts numbered from 0 to Parts - 1.
+type CompleteUploadPayload struct {
+	Parts int
+}
+
+// ObjectStatPayload describes an object without its data. Remaining is how long is left until the object expires,
+// by the server's clock. Pulls is only included for the key which dropped the object, if the server keeps access logs.
+type ObjectStatPayload struct {
+	Oid       string
+	Size      int64
+	Created   time.Time
+	Expires   time.Time
+	Remaining time.Duration
+	Pulls     *int `json:",omitempty"`
+	// Burn is set if the object is destroyed by its next pull.
+	Burn bool `json:",omitempty"`
+	// PullsLeft is how many more times the object may be pulled, if it was dropped with a maximum.
+	PullsLeft *int `json:",omitempty"`
+	// Labels are the labels the object was dropped with, which only the key which dropped it is sent.
+	Labels map[string]string `json:",omitempty"`
+	// ReleaseAt is the time before which the object can't be pulled, if it was dropped with one.
+	ReleaseAt *time.Time `json:",omitempty"`
+}
+
+// ObjectChecksumPayload is the checksum of a stored object as the server computed it, encoded as in references.
+type ObjectChecksumPayload struct {
+	Oid       string
+	Size      int64
+	Algorithm string
+	Checksum  string
+}
+
+// ShareRequestPayload asks for a url which pulls an object without authenticating, for TTL seconds (at most until the
+// object expires) and at most MaxUses times, or any number of times if it is 0.
+type ShareRequestPayload struct {
+	TTL     int64
+	MaxUses int `json:",omitempty"`
+}
+
+// SharePayload is a url which pulls an object without authenticating, given as its path on the server.
+type SharePayload struct {
+	Oid     string
+	Path    string
+	Expires time.Time
+	MaxUses int `json:",omitempty"`
+}
+
+type AccessLogPayload struct {
+	Oid     string
+	Owner   string
+	Dropped time.Time
+	Pulls   []AccessRecord
+}
+
+// ObjectSummary describes an object in a listing.
+type ObjectSummary struct {
+	Oid     string
+	Size    int64
+	Created time.Time
+	Labels  map[string]string `json:",omitempty"`
+}
+
+// AliasPayload lists the stored versions of the objects dropped under an alias, oldest first.
+type AliasPayload struct {
+	Alias    string
+	Versions []AliasVersion
+}
+
+// AliasVersion describes a version of an alias: the object dropped as it.
+type AliasVersion struct {
+	Version int
+	Oid     string
+	Size    int64
+	Created time.Time
+}
+
+// CheckinPayload is the time a key checked in, which holds the objects it dropped for other keys (see ReleaseToHeader)
+// for another check-in interval.
+type CheckinPayload struct {
+	KeyName   string
+	CheckedIn time.Time
+}
+
+// QuotaPayload is the bytes of object data a key stores, and its quota, which is 0 if it has none.
+type QuotaPayload struct {
+	KeyName string
+	Used    int64
+	Quota   int64
+	// Namespace is the namespace of the key, with the bytes stored in it and its quota, unless it is the default one.
+	Namespace      string `json:",omitempty"`
+	NamespaceUsed  int64  `json:",omitempty"`
+	NamespaceQuota int64  `json:",omitempty"`
+}
+
+// ListObjectsPayload is a page of a listing of objects. Next is the cursor of the following page,
+// or empty if this is the last one.
+type ListObjectsPayload struct {
+	Objects []ObjectSummary
+	Next    string `json:",omitempty"`
+}
+
+// AdminObjectSummary describes an object in an admin listing, which lists the objects of every key.
+type AdminObjectSummary struct {
+	Oid string
+	// Owner is the key which dropped the object, which is empty for anonymous drops.
+	Owner     string `json:",omitempty"`
+	Namespace string `json:",omitempty"`
+	Size      int64
+	Created   time.Time
+	Expires   time.Time
+	Labels    map[string]string `json:",omitempty"`
+}
+
+// AdminObjectsPayload is a page of an admin listing of objects. Next is the cursor of the following page,
+// or empty if this is the last one.
+type AdminObjectsPayload struct {
+	Objects []AdminObjectSummary
+	Next    string `json:",omitempty"`
+}
+
+// UsagePayload is the storage used on a server: the number of objects stored and the bytes of their data, and the
+// bytes stored by each key and in each namespace by name. Anonymous drops are stored by the key of no name, and the
+// default namespace is the namespace of no name.
+type UsagePayload struct {
+	Objects    int
+	Bytes      int64
+	Keys       map[string]int64
+	Namespaces map[string]int64
+}
+
+// GCPayload is what a garbage collection removed: the number of expired objects, and the bytes of their data.
+type GCPayload struct {
+	Objects int
+	Bytes   uint64
+}
+
+// RotateSecretPayload rotates the secret tokens are signed with. Unless Revoke is set, tokens signed with the
+// replaced secret stay valid until they expire.
+type RotateSecretPayload struct {
+	Revoke bool `json:",omitempty"`
+}
+
+// KeySummary describes an authorized key in a listing of keys.
+type KeySummary struct {
+	KeyName   string
+	Role      string
+	Namespace string `json:",omitempty"`
+}
+
+// KeysPayload lists the authorized keys of a server, by name.
+type KeysPayload struct {
+	Keys []KeySummary
 }
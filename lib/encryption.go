@@ -1,18 +1,38 @@
-package main
+package lib
 
 import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
-	"dead-drop/client/ghash"
+	"dead-drop/lib/ghash"
 	"fmt"
 	"github.com/awnumar/memguard"
 )
 
 const ivLength = aes.BlockSize
 
-func encrypt(key *memguard.LockedBuffer, data []byte) ([]byte, error) {
+// Encrypt returns the signed ciphertext of data with AES-CTR and HMAC-SHA-256, using keys derived from key, which is destroyed.
+// The header is authenticated by the signature, but not included in the result.
+func Encrypt(key *memguard.LockedBuffer, header []byte, data []byte) ([]byte, error) {
+	iv := make([]byte, ivLength)
+	if _, err := rand.Read(iv); err != nil {
+		key.Destroy()
+		return nil, err
+	}
+
+	return encryptWithIV(key, header, iv, data)
+}
+
+// encryptWithIV is Encrypt with a chosen IV. Reusing an IV with the same key leaks the plaintext,
+// so it is only called directly to reproduce known-answer test vectors.
+func encryptWithIV(key *memguard.LockedBuffer, header []byte, iv []byte, data []byte) ([]byte, error) {
+	if len(iv) != ivLength {
+		key.Destroy()
+		return nil, fmt.Errorf("iv must be %d bytes", ivLength)
+	}
+
 	encryptionKey, hmacKey := splitKeyHash(key)
 
 	block, err := aes.NewCipher(encryptionKey.Bytes())
@@ -20,19 +40,19 @@ func encrypt(key *memguard.LockedBuffer, data []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	ciphertext := memguard.NewBufferRandom(ivLength + len(data))
+	ciphertext := memguard.NewBuffer(ivLength + len(data))
 	defer ciphertext.Destroy()
 
-	iv := ciphertext.Bytes()[:ivLength]
-	stream := cipher.NewCTR(block, iv)
-
 	ciphertext.Melt()
+	copy(ciphertext.Bytes(), iv)
+	stream := cipher.NewCTR(block, iv)
 	stream.XORKeyStream(ciphertext.Bytes()[ivLength:], data)
 	ciphertext.Freeze()
 
 	encryptionKey.Destroy()
 
 	hash := hmac.New(sha256.New, hmacKey.Bytes())
+	hash.Write(header)
 	hash.Write(ciphertext.Bytes())
 	signature := hash.Sum(nil)
 	hmacKey.Destroy()
@@ -41,14 +61,22 @@ func encrypt(key *memguard.LockedBuffer, data []byte) ([]byte, error) {
 	return message, nil
 }
 
-func decrypt(key *memguard.LockedBuffer, message []byte) (*memguard.LockedBuffer, error) {
+// Decrypt verifies and decrypts a message produced by Encrypt, given the same header. The key is destroyed.
+func Decrypt(key *memguard.LockedBuffer, header []byte, message []byte) (*memguard.LockedBuffer, error) {
 	encryptionKey, hmacKey := splitKeyHash(key)
 
+	if len(message) < sha256.Size+ivLength {
+		encryptionKey.Destroy()
+		hmacKey.Destroy()
+		return nil, fmt.Errorf("message too short")
+	}
+
 	signature := message[:sha256.Size]
 	ciphertext := message[sha256.Size:]
 
 	hash := hmac.New(sha256.New, hmacKey.Bytes())
-	hash.Write([]byte(ciphertext))
+	hash.Write(header)
+	hash.Write(ciphertext)
 	expectedSignature := hash.Sum(nil)
 	hmacKey.Destroy()
 
@@ -75,6 +103,7 @@ func decrypt(key *memguard.LockedBuffer, message []byte) (*memguard.LockedBuffer
 	return data, nil
 }
 
+// splitKeyHash derives the AES and HMAC keys from the shared key, destroying it.
 func splitKeyHash(keyBuf *memguard.LockedBuffer) (*memguard.LockedBuffer, *memguard.LockedBuffer) {
 	sum := ghash.Sum256(keyBuf)
 	defer sum.Destroy()
@@ -0,0 +1,271 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// An object is laid out as:
+//
+//	"DEAD" | version (1 byte) | header length (uint32 BE) | header JSON | encrypted message
+//
+// where the encrypted message is produced by Encrypt (or NewEncryptWriter, for chunked objects) from the plaintext
+// built by SealEnvelope (or WriteEnvelope):
+//
+//	metadata length (uint32 BE) | metadata JSON | data
+//
+// Objects without the magic prefix were dropped before headers existed, and are treated as having an empty header.
+// Version 1 objects are encrypted with AES-CTR and HMAC-SHA-256, and version 2 objects with the AEAD cipher named in
+// their header. The version is part of the authenticated header, so an object can't be passed off as the other.
+const headerMagic = "DEAD"
+const headerVersion = 1
+const aeadHeaderVersion = 2
+const headerPrefixLen = len(headerMagic) + 1 + 4
+
+// Bound the header size for the same reason as the metadata size. It leaves room for the wrapped keys of dozens of
+// recipients, the largest of which (RSA-4096) take about 700 bytes each.
+const maxHeaderLen = 64 * 1024
+
+// The metadata length prefix is a big-endian uint32.
+const metadataLenSize = 4
+
+// Bound the metadata size so that a corrupt length prefix can't trigger huge allocations.
+const maxMetadataLen = 64 * 1024
+
+// Notes are meant for a line or two of context, not as a side channel for data.
+const maxNoteLen = 1024
+
+// ObjectMetadata is stored alongside the object data, and is encrypted with it,
+// so it is never visible to the server.
+type ObjectMetadata struct {
+	Name string `json:",omitempty"`
+	Note string `json:",omitempty"`
+	// Format is how the data is packaged: empty for a single file, or FormatTar for a directory tree.
+	Format string `json:",omitempty"`
+	// Mode holds the permissions of the original file, and Modified the time it was last modified, which pulls
+	// restore. They are unset for data which wasn't read from a file.
+	Mode     os.FileMode `json:",omitempty"`
+	Modified *time.Time  `json:",omitempty"`
+	// MimeType is the media type of the data, e.g. guessed from the file name's extension when dropped.
+	MimeType string `json:",omitempty"`
+	// Burned is set by pulls which destroyed the object on the server. It is not part of the encrypted metadata.
+	Burned bool `json:"-"`
+}
+
+// FormatTar marks objects whose data is a tar archive of a directory tree, which is extracted when pulled.
+const FormatTar = "tar"
+
+// PrintableNote strips control characters from the note, since it is sender-controlled
+// and will be written straight to the recipient's terminal.
+func (meta *ObjectMetadata) PrintableNote() string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsPrint(r) || r == ' ' {
+			return r
+		}
+		return -1
+	}, meta.Note)
+}
+
+// ObjectHeader is stored in plaintext at the start of the object, and is authenticated along with the ciphertext.
+// It only holds what is needed to decrypt the object, since it is visible to the server.
+type ObjectHeader struct {
+	// Kind is empty for regular objects, and marks objects with special contents that can't be pulled as files.
+	Kind  string `json:",omitempty"`
+	KeyId string `json:",omitempty"`
+	// Codecs lists the lib codecs applied to the object data before encryption, in the order they were applied.
+	Codecs []string `json:",omitempty"`
+	// ChunkSize is set for objects encrypted in chunks by NewEncryptWriter, and zero for objects encrypted by Encrypt.
+	ChunkSize int `json:",omitempty"`
+	// Kdf is set for objects encrypted with a key derived from a passphrase, rather than a key file or keyring key.
+	Kdf *KdfParams `json:",omitempty"`
+	// Cipher names the AEAD cipher of version 2 objects, and is empty for AES-CTR and HMAC-SHA-256.
+	Cipher string `json:",omitempty"`
+	// Recipients is set for objects encrypted to public keys, and holds the object's random key wrapped to each of them.
+	Recipients []*WrappedKey `json:",omitempty"`
+}
+
+// EncodeHeader serializes the header, including its magic and version prefix.
+func EncodeHeader(header *ObjectHeader) ([]byte, error) {
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if len(headerBytes) > maxHeaderLen {
+		return nil, fmt.Errorf("object header too large")
+	}
+	if header.Cipher != "" && header.ChunkSize == 0 {
+		return nil, fmt.Errorf("objects encrypted with %s must be chunked", header.Cipher)
+	}
+
+	encoded := make([]byte, headerPrefixLen+len(headerBytes))
+	copy(encoded, headerMagic)
+	encoded[len(headerMagic)] = headerVersion
+	if header.Cipher != "" {
+		encoded[len(headerMagic)] = aeadHeaderVersion
+	}
+	binary.BigEndian.PutUint32(encoded[len(headerMagic)+1:], uint32(len(headerBytes)))
+	copy(encoded[headerPrefixLen:], headerBytes)
+
+	return encoded, nil
+}
+
+// DecodeHeader splits an object into its parsed header, the raw header bytes, and the remaining encrypted message.
+// The raw header bytes are nil for legacy objects, and must be passed to Decrypt as they were read.
+func DecodeHeader(object []byte) (*ObjectHeader, []byte, []byte, error) {
+	header, headerBytes, _, err := ReadHeader(bytes.NewReader(object))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return header, headerBytes, object[len(headerBytes):], nil
+}
+
+// ReadHeader is DecodeHeader for an object read from r, returning a reader of the encrypted message in its place.
+func ReadHeader(r io.Reader) (*ObjectHeader, []byte, io.Reader, error) {
+	magic := make([]byte, len(headerMagic))
+	n, err := io.ReadFull(r, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, nil, nil, err
+	}
+	if string(magic[:n]) != headerMagic {
+		return &ObjectHeader{}, nil, io.MultiReader(bytes.NewReader(magic[:n]), r), nil
+	}
+
+	prefix := make([]byte, headerPrefixLen)
+	copy(prefix, magic)
+	if _, err := io.ReadFull(r, prefix[len(headerMagic):]); err != nil {
+		return nil, nil, nil, headerReadErr(err)
+	}
+
+	version := prefix[len(headerMagic)]
+	if version != headerVersion && version != aeadHeaderVersion {
+		return nil, nil, nil, fmt.Errorf("unsupported object format version %d", version)
+	}
+
+	headerLen := binary.BigEndian.Uint32(prefix[len(headerMagic)+1:])
+	if headerLen > maxHeaderLen {
+		return nil, nil, nil, fmt.Errorf("malformed object header")
+	}
+
+	headerBytes := make([]byte, headerPrefixLen+int(headerLen))
+	copy(headerBytes, prefix)
+	if _, err := io.ReadFull(r, headerBytes[headerPrefixLen:]); err != nil {
+		return nil, nil, nil, headerReadErr(err)
+	}
+
+	header := &ObjectHeader{}
+	if err := json.Unmarshal(headerBytes[headerPrefixLen:], header); err != nil {
+		return nil, nil, nil, fmt.Errorf("malformed object header: %v", err)
+	}
+	if (version == aeadHeaderVersion) != (header.Cipher != "") || (header.Cipher != "" && header.ChunkSize == 0) {
+		return nil, nil, nil, fmt.Errorf("malformed object header")
+	}
+
+	return header, headerBytes, r, nil
+}
+
+// headerReadErr reports an object which ends inside its header as malformed, and passes on other read errors.
+func headerReadErr(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("malformed object header")
+	}
+	return err
+}
+
+// SealEnvelope prefixes data with its serialized metadata, producing the plaintext to be encrypted.
+func SealEnvelope(meta *ObjectMetadata, data []byte) ([]byte, error) {
+	prefix, err := envelopePrefix(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, len(prefix)+len(data))
+	copy(plaintext, prefix)
+	copy(plaintext[len(prefix):], data)
+
+	return plaintext, nil
+}
+
+// WriteEnvelope writes the serialized metadata which starts the plaintext, to be followed by the object data.
+func WriteEnvelope(w io.Writer, meta *ObjectMetadata) error {
+	prefix, err := envelopePrefix(meta)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(prefix)
+	return err
+}
+
+func envelopePrefix(meta *ObjectMetadata) ([]byte, error) {
+	if len(meta.Note) > maxNoteLen {
+		return nil, fmt.Errorf("note is longer than %d bytes", maxNoteLen)
+	}
+
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	if len(metaBytes) > maxMetadataLen {
+		return nil, fmt.Errorf("object metadata too large")
+	}
+
+	prefix := make([]byte, metadataLenSize+len(metaBytes))
+	binary.BigEndian.PutUint32(prefix, uint32(len(metaBytes)))
+	copy(prefix[metadataLenSize:], metaBytes)
+
+	return prefix, nil
+}
+
+// OpenEnvelope splits decrypted plaintext into its metadata and data.
+// The returned data slice aliases plaintext.
+func OpenEnvelope(plaintext []byte) (*ObjectMetadata, []byte, error) {
+	reader := bytes.NewReader(plaintext)
+	meta, err := ReadEnvelope(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return meta, plaintext[len(plaintext)-reader.Len():], nil
+}
+
+// ReadEnvelope reads the serialized metadata from the start of decrypted plaintext, leaving r at the object data.
+func ReadEnvelope(r io.Reader) (*ObjectMetadata, error) {
+	lenBytes := make([]byte, metadataLenSize)
+	if _, err := io.ReadFull(r, lenBytes); err != nil {
+		return nil, envelopeReadErr(err)
+	}
+
+	metaLen := binary.BigEndian.Uint32(lenBytes)
+	if metaLen > maxMetadataLen {
+		return nil, fmt.Errorf("malformed object envelope")
+	}
+
+	metaBytes := make([]byte, metaLen)
+	if _, err := io.ReadFull(r, metaBytes); err != nil {
+		return nil, envelopeReadErr(err)
+	}
+
+	meta := &ObjectMetadata{}
+	if err := json.Unmarshal(metaBytes, meta); err != nil {
+		return nil, fmt.Errorf("malformed object metadata: %v", err)
+	}
+
+	return meta, nil
+}
+
+// envelopeReadErr reports a plaintext which ends inside the metadata as malformed, and passes on other read errors,
+// e.g. failed decryption.
+func envelopeReadErr(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("malformed object envelope")
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func loadGoldenVectors(t *testing.T) []*TestVector {
+	paths, err := filepath.Glob(filepath.Join("testdata", "vectors", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no golden test vectors found")
+	}
+
+	vectors := make([]*TestVector, 0, len(paths))
+	for _, path := range paths {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vector := &TestVector{}
+		if err := json.Unmarshal(contents, vector); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		vectors = append(vectors, vector)
+	}
+	return vectors
+}
+
+func TestGoldenVectors(t *testing.T) {
+	for _, vector := range loadGoldenVectors(t) {
+		if err := vector.Verify(); err != nil {
+			t.Errorf("%s: %v", vector.Name, err)
+		}
+
+		object, err := vector.ObjectBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(object)
+		if base64.URLEncoding.EncodeToString(sum[:]) != vector.Checksum {
+			t.Errorf("%s: checksum does not match", vector.Name)
+		}
+	}
+}
+
+func TestBuiltinVectorsMatchGolden(t *testing.T) {
+	golden := make(map[string]*TestVector)
+	for _, vector := range loadGoldenVectors(t) {
+		golden[vector.Name] = vector
+	}
+
+	for _, vector := range TestVectors() {
+		if !reflect.DeepEqual(vector, golden[vector.Name]) {
+			t.Errorf("built in vector %q does not match its golden file", vector.Name)
+		}
+	}
+}
+
+func TestDecodeHeaderRejectsMalformed(t *testing.T) {
+	for _, object := range []string{
+		"DEAD",
+		"DEAD\x02\x00\x00\x00\x02{}",
+		"DEAD\x01\xff\xff\xff\xff{}",
+		"DEAD\x01\x00\x00\x00\x03{}",
+		"DEAD\x01\x00\x00\x00\x02[]",
+	} {
+		if _, _, _, err := DecodeHeader([]byte(object)); err == nil {
+			t.Errorf("malformed header %q was accepted", object)
+		}
+	}
+}
+
+func TestOpenEnvelopeRejectsMalformed(t *testing.T) {
+	for _, plaintext := range []string{
+		"",
+		"\x00\x00\x00",
+		"\xff\xff\xff\xff{}",
+		"\x00\x00\x00\x03{}",
+		"\x00\x00\x00\x02[]",
+	} {
+		if _, _, err := OpenEnvelope([]byte(plaintext)); err == nil {
+			t.Errorf("malformed envelope %q was accepted", plaintext)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+//go:build gofuzz
+// +build gofuzz
+
+package lib
+
+import (
+	"bytes"
+	"github.com/awnumar/memguard"
+)
+
+// Fuzz targets for go-fuzz, e.g.
+//
+//   go-fuzz-build -func FuzzDecodeHeader dead-drop/lib && go-fuzz -bin lib-fuzz.zip -workdir fuzz
+//
+// The objects in testdata/vectors make a good seed corpus.
+
+// fuzzVector provides the key for FuzzDecrypt, so that mutations of its object reach the decryption code.
+var fuzzVector = TestVectors()[0]
+
+func FuzzDecodeHeader(data []byte) int {
+	header, headerBytes, message, err := DecodeHeader(data)
+	if err != nil {
+		return 0
+	}
+	if len(headerBytes)+len(message) != len(data) {
+		panic("decoded header and message do not cover the object")
+	}
+	if headerBytes != nil {
+		if _, err := EncodeHeader(header); err != nil {
+			panic(err)
+		}
+	}
+	return 1
+}
+
+func FuzzOpenEnvelope(data []byte) int {
+	meta, rest, err := OpenEnvelope(data)
+	if err != nil {
+		return 0
+	}
+	if len(rest) > len(data) {
+		panic("envelope data is longer than the plaintext")
+	}
+	meta.PrintableNote()
+	return 1
+}
+
+// FuzzDecrypt runs whole objects through decoding and decryption. Only the unmodified test vector should
+// ever decrypt, so anything else that does is a forgery.
+func FuzzDecrypt(data []byte) int {
+	header, headerBytes, message, err := DecodeHeader(data)
+	if err != nil {
+		return 0
+	}
+
+	key, err := fuzzVector.decodeHex("key", fuzzVector.Key)
+	if err != nil {
+		panic(err)
+	}
+	plaintext, err := decryptMessage(memguard.NewBufferFromBytes(key), header, headerBytes, message)
+	if err != nil {
+		return 0
+	}
+	defer plaintext.Destroy()
+
+	if object, _ := fuzzVector.ObjectBytes(); !bytes.Equal(data, object) {
+		panic("modified object was decrypted")
+	}
+
+	if _, _, err := OpenEnvelope(plaintext.Bytes()); err != nil {
+		panic("authenticated plaintext is malformed")
+	}
+	return 1
+}
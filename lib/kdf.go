@@ -0,0 +1,65 @@
+package lib
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/argon2"
+)
+
+// KdfArgon2id derives keys from passphrases with Argon2id.
+const KdfArgon2id = "argon2id"
+
+// Argon2id parameters for new objects, following the second recommendation of RFC 9106 (64 MiB, 3 passes),
+// which takes well under a second on current machines.
+const argon2Time = 3
+const argon2MemoryKiB = 64 * 1024
+const argon2Threads = 4
+const kdfSaltLen = 16
+
+// Bound the cost of deriving a key, since the parameters are in the header, which is sent by the server.
+const maxArgon2Time = 16
+const maxArgon2MemoryKiB = 1024 * 1024
+
+const derivedKeyLen = 32
+
+// KdfParams records how the key of an object was derived from a passphrase. They are stored in the object header,
+// so the passphrase is all a recipient needs to derive the key again.
+type KdfParams struct {
+	Name    string
+	Salt    []byte
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// NewKdfParams returns the parameters for deriving the key of a new object, with a fresh random salt.
+func NewKdfParams() (*KdfParams, error) {
+	salt := make([]byte, kdfSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return &KdfParams{
+		Name:    KdfArgon2id,
+		Salt:    salt,
+		Time:    argon2Time,
+		Memory:  argon2MemoryKiB,
+		Threads: argon2Threads,
+	}, nil
+}
+
+// DeriveKey derives an encryption key from a passphrase, which is not destroyed.
+func DeriveKey(passphrase *memguard.LockedBuffer, params *KdfParams) (*memguard.LockedBuffer, error) {
+	if params.Name != KdfArgon2id {
+		return nil, fmt.Errorf("unsupported key derivation function '%s'", params.Name)
+	}
+	if len(params.Salt) < kdfSaltLen || params.Time == 0 || params.Time > maxArgon2Time ||
+		params.Memory < 8*uint32(params.Threads) || params.Memory > maxArgon2MemoryKiB || params.Threads == 0 {
+		return nil, fmt.Errorf("invalid key derivation parameters")
+	}
+
+	// NewBufferFromBytes wipes the derived key once it is copied into the guarded buffer.
+	key := argon2.IDKey(passphrase.Bytes(), params.Salt, params.Time, params.Memory, params.Threads, derivedKeyLen)
+	return memguard.NewBufferFromBytes(key), nil
+}
@@ -0,0 +1,290 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KeyManager wraps and unwraps keys with a key held by a key management service, which never leaves it, so that the
+// keys are only ever stored wrapped.
+type KeyManager interface {
+	// Encrypt wraps a key, returning it as the service returned it.
+	Encrypt(ctx context.Context, plaintext []byte) (string, error)
+	// Decrypt unwraps a key wrapped by the service, given as the service returned it.
+	Decrypt(ctx context.Context, ciphertext string) ([]byte, error)
+	// String describes the service and key, for the log.
+	String() string
+}
+
+// KeyManagerTimeout bounds requests to key management services.
+const KeyManagerTimeout = 30 * time.Second
+
+// NewKeyManager returns the key manager of a url naming a service and key:
+//   - vault+https://<host>[:<port>]/<mount>/<key> for a key of a Vault transit secrets engine, authenticated with the
+//     token in VAULT_TOKEN (vault+http:// for plain http).
+//   - awskms://<region>/<key> for an AWS KMS key, given by its id, alias (alias/<name>) or arn, authenticated with the
+//     credentials in AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN. An endpoint query parameter
+//     replaces the region's endpoint, e.g. for a VPC endpoint.
+func NewKeyManager(rawURL string) (KeyManager, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key manager url '%s': %v", rawURL, err)
+	}
+
+	switch parsed.Scheme {
+	case "vault+https", "vault+http":
+		path := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+		if parsed.Host == "" || len(path) != 2 || path[0] == "" || path[1] == "" {
+			return nil, fmt.Errorf("invalid Vault transit url '%s', which must be %s://<host>/<mount>/<key>",
+				rawURL, parsed.Scheme)
+		}
+		token := os.Getenv("VAULT_TOKEN")
+		if token == "" {
+			return nil, fmt.Errorf("no Vault token in VAULT_TOKEN")
+		}
+		return &vaultTransit{
+			addr:   strings.TrimPrefix(parsed.Scheme, "vault+") + "://" + parsed.Host,
+			mount:  path[0],
+			key:    path[1],
+			token:  token,
+			client: &http.Client{Timeout: KeyManagerTimeout},
+		}, nil
+	case "awskms":
+		keyID := strings.TrimPrefix(parsed.Path, "/")
+		if parsed.Host == "" || keyID == "" {
+			return nil, fmt.Errorf("invalid AWS KMS url '%s', which must be awskms://<region>/<key>", rawURL)
+		}
+		kms := &awsKMS{
+			region:       parsed.Host,
+			keyID:        keyID,
+			endpoint:     parsed.Query().Get("endpoint"),
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			client:       &http.Client{Timeout: KeyManagerTimeout},
+		}
+		if kms.endpoint == "" {
+			kms.endpoint = fmt.Sprintf("https://kms.%s.amazonaws.com", kms.region)
+		}
+		if kms.accessKey == "" || kms.secretKey == "" {
+			return nil, fmt.Errorf("no AWS credentials in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		return kms, nil
+	default:
+		return nil, fmt.Errorf("unknown key manager '%s' in url '%s'", parsed.Scheme, rawURL)
+	}
+}
+
+// vaultTransit wraps and unwraps with a key of a Vault transit secrets engine, which never leaves Vault.
+type vaultTransit struct {
+	addr   string
+	mount  string
+	key    string
+	token  string
+	client *http.Client
+}
+
+// vaultResponse is the response of a transit operation, of which only the field of the operation is set.
+type vaultResponse struct {
+	Data struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+func (vault *vaultTransit) Encrypt(ctx context.Context, plaintext []byte) (string, error) {
+	payload, err := vault.do(ctx, "encrypt",
+		map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)})
+	if err != nil {
+		return "", err
+	}
+	return payload.Data.Ciphertext, nil
+}
+
+func (vault *vaultTransit) Decrypt(ctx context.Context, ciphertext string) ([]byte, error) {
+	payload, err := vault.do(ctx, "decrypt", map[string]string{"ciphertext": ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(payload.Data.Plaintext)
+}
+
+// do makes a request of a transit operation with the key.
+func (vault *vaultTransit) do(ctx context.Context, operation string, request map[string]string) (*vaultResponse,
+	error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/v1/%s/%s/%s", vault.addr, vault.mount, operation, vault.key),
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", vault.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := vault.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error reaching Vault: %v", err)
+	}
+	defer resp.Body.Close()
+
+	payload := &vaultResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(payload); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("error decoding Vault response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault refused to %s with status %d: %s", operation, resp.StatusCode,
+			strings.Join(payload.Errors, "; "))
+	}
+	return payload, nil
+}
+
+func (vault *vaultTransit) String() string {
+	return fmt.Sprintf("Vault transit key %s/%s at %s", vault.mount, vault.key, vault.addr)
+}
+
+// awsKMS wraps and unwraps with an AWS KMS key, which never leaves KMS. Wrapped keys are its ciphertext blobs, in
+// base64.
+type awsKMS struct {
+	region       string
+	keyID        string
+	endpoint     string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+const awsTimeFormat = "20060102T150405Z"
+const awsDateFormat = "20060102"
+
+func (kms *awsKMS) Encrypt(ctx context.Context, plaintext []byte) (string, error) {
+	var resp struct{ CiphertextBlob string }
+	err := kms.do(ctx, "Encrypt", map[string]string{
+		"KeyId":     kms.keyID,
+		"Plaintext": base64.StdEncoding.EncodeToString(plaintext),
+	}, &resp)
+	return resp.CiphertextBlob, err
+}
+
+func (kms *awsKMS) Decrypt(ctx context.Context, ciphertext string) ([]byte, error) {
+	var resp struct{ Plaintext string }
+	if err := kms.do(ctx, "Decrypt", map[string]string{"KeyId": kms.keyID, "CiphertextBlob": ciphertext},
+		&resp); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
+
+// do makes a request of a KMS action, decoding its response into resp.
+func (kms *awsKMS) do(ctx context.Context, action string, request map[string]string, resp interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", kms.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	kms.sign(req, body, time.Now().UTC())
+
+	httpResp, err := kms.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error reaching AWS KMS: %v", err)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		var kmsErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(io.LimitReader(httpResp.Body, 64*1024)).Decode(&kmsErr)
+		return fmt.Errorf("AWS KMS refused to %s with status %d: %s %s", strings.ToLower(action),
+			httpResp.StatusCode, kmsErr.Type, kmsErr.Message)
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return fmt.Errorf("error decoding AWS KMS response: %v", err)
+	}
+	return nil
+}
+
+// sign adds an AWS signature version 4 of the request and its body.
+func (kms *awsKMS) sign(req *http.Request, body []byte, now time.Time) {
+	req.Header.Set("X-Amz-Date", now.Format(awsTimeFormat))
+	if kms.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", kms.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host, "content-type": req.Header.Get("Content-Type")}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		"/",
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scopeParts := []string{now.Format(awsDateFormat), kms.region, "kms", "aws4_request"}
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format(awsTimeFormat),
+		strings.Join(scopeParts, "/"),
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + kms.secretKey)
+	for _, part := range scopeParts {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		kms.accessKey, strings.Join(scopeParts, "/"), signedHeaders, hex.EncodeToString(mac.Sum(nil))))
+}
+
+func (kms *awsKMS) String() string {
+	return fmt.Sprintf("AWS KMS key %s in %s", kms.keyID, kms.region)
+}
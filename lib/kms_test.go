@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// fakeWrap stands in for a service's encryption, which only has to be reversible.
+func fakeWrap(plaintext []byte) string {
+	return "wrapped:" + base64.StdEncoding.EncodeToString(plaintext)
+}
+
+func fakeUnwrap(ciphertext string) string {
+	return strings.TrimPrefix(ciphertext, "wrapped:")
+}
+
+func testKeyManagerRoundTrip(t *testing.T, keyManager KeyManager) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	wrapped, err := keyManager.Encrypt(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Failed to wrap with %s: %v", keyManager, err)
+	}
+	if bytes.Contains([]byte(wrapped), key) {
+		t.Fatalf("Wrapped key %q contains the key", wrapped)
+	}
+	unwrapped, err := keyManager.Decrypt(context.Background(), wrapped)
+	if err != nil {
+		t.Fatalf("Failed to unwrap with %s: %v", keyManager, err)
+	}
+	if !bytes.Equal(unwrapped, key) {
+		t.Fatalf("Unwrapped %q, expected %q", unwrapped, key)
+	}
+}
+
+func TestVaultTransit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		var request map[string]string
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+		}
+		resp := &vaultResponse{}
+		switch req.URL.Path {
+		case "/v1/transit/encrypt/deadd":
+			plaintext, _ := base64.StdEncoding.DecodeString(request["plaintext"])
+			resp.Data.Ciphertext = "vault:v1:" + fakeWrap(plaintext)
+		case "/v1/transit/decrypt/deadd":
+			resp.Data.Plaintext = fakeUnwrap(strings.TrimPrefix(request["ciphertext"], "vault:v1:"))
+		default:
+			t.Errorf("Unexpected request of %s", req.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	defer os.Setenv("VAULT_TOKEN", os.Getenv("VAULT_TOKEN"))
+	os.Setenv("VAULT_TOKEN", "token")
+	keyManager, err := NewKeyManager("vault+" + server.URL + "/transit/deadd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKeyManagerRoundTrip(t, keyManager)
+
+	os.Setenv("VAULT_TOKEN", "wrong")
+	keyManager, err = NewKeyManager("vault+" + server.URL + "/transit/deadd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyManager.Decrypt(context.Background(), "vault:v1:wrapped:"); err == nil ||
+		!strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("Expected Vault's refusal, got %v", err)
+	}
+}
+
+func TestAWSKMS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") ||
+			!strings.Contains(auth, "/us-east-1/kms/aws4_request, ") ||
+			!strings.Contains(auth, "SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target,") {
+			t.Errorf("Unexpected authorization %q", auth)
+		}
+		if req.Header.Get("X-Amz-Security-Token") != "session" {
+			t.Errorf("Missing session token")
+		}
+		var request map[string]string
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+		}
+		if request["KeyId"] != "alias/deadd" {
+			t.Errorf("Unexpected key %q", request["KeyId"])
+		}
+		switch req.Header.Get("X-Amz-Target") {
+		case "TrentService.Encrypt":
+			plaintext, _ := base64.StdEncoding.DecodeString(request["Plaintext"])
+			blob := base64.StdEncoding.EncodeToString([]byte(fakeWrap(plaintext)))
+			_ = json.NewEncoder(w).Encode(map[string]string{"CiphertextBlob": blob})
+		case "TrentService.Decrypt":
+			blob, _ := base64.StdEncoding.DecodeString(request["CiphertextBlob"])
+			if !strings.HasPrefix(string(blob), "wrapped:") {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"__type":"InvalidCiphertextException","message":"bad blob"}`))
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]string{"Plaintext": fakeUnwrap(string(blob))})
+		default:
+			t.Errorf("Unexpected target %q", req.Header.Get("X-Amz-Target"))
+		}
+	}))
+	defer server.Close()
+
+	for name, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKID",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"AWS_SESSION_TOKEN":     "session",
+	} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+	keyManager, err := NewKeyManager("awskms://us-east-1/alias/deadd?endpoint=" + server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKeyManagerRoundTrip(t, keyManager)
+
+	if _, err := keyManager.Decrypt(context.Background(), base64.StdEncoding.EncodeToString([]byte("junk"))); err == nil ||
+		!strings.Contains(err.Error(), "InvalidCiphertextException") {
+		t.Fatalf("Expected KMS's refusal, got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package lib
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// LabelsHeader carries the labels of a dropped object, encoded by FormatLabels.
+const LabelsHeader = "X-Object-Labels"
+
+// Objects have at most MaxLabels labels, whose keys match LabelKeyRegex and whose values are at most
+// MaxLabelValueLen bytes of UTF-8. Servers store labels in the clear so that objects can be listed by them, so they
+// mustn't hold anything secret.
+const MaxLabels = 16
+const MaxLabelValueLen = 128
+const LabelKeyRegex = "^[a-z0-9][a-z0-9._-]{0,62}$"
+
+var labelKeyRegex = regexp.MustCompile(LabelKeyRegex)
+
+// SplitLabels returns the labels of entries of the form <key>=<value>, e.g. env=prod. Entries without a value, e.g.
+// env, are labels with an empty value. Later entries replace earlier ones of the same key.
+func SplitLabels(entries []string) map[string]string {
+	labels := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		labels[strings.TrimSpace(parts[0])] = parts[1]
+	}
+	return labels
+}
+
+// CheckLabels returns an error unless labels are valid.
+func CheckLabels(labels map[string]string) error {
+	if len(labels) > MaxLabels {
+		return fmt.Errorf("objects may have at most %d labels", MaxLabels)
+	}
+	for key, value := range labels {
+		if !labelKeyRegex.MatchString(key) {
+			return fmt.Errorf("invalid label key '%s', which must be up to 63 lowercase letters, digits, '.', '_' "+
+				"or '-'", key)
+		}
+		if len(value) > MaxLabelValueLen || !utf8.ValidString(value) {
+			return fmt.Errorf("invalid value of label %s, which must be up to %d bytes of UTF-8", key,
+				MaxLabelValueLen)
+		}
+	}
+	return nil
+}
+
+// FormatLabels encodes labels as a url query ordered by key, e.g. env=prod&team=ci.
+func FormatLabels(labels map[string]string) string {
+	values := url.Values{}
+	for key, value := range labels {
+		values.Set(key, value)
+	}
+	return values.Encode()
+}
+
+// ParseLabels decodes labels encoded by FormatLabels, returning an error unless they are valid.
+func ParseLabels(encoded string) (map[string]string, error) {
+	values, err := url.ParseQuery(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid labels: %v", err)
+	}
+
+	labels := make(map[string]string, len(values))
+	for key, value := range values {
+		if len(value) != 1 {
+			return nil, fmt.Errorf("label %s is set more than once", key)
+		}
+		labels[key] = value[0]
+	}
+	if err := CheckLabels(labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
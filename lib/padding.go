@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// CodecPadme pads object data to one of a small set of lengths before encryption, so that the length of an object
+// reveals little about the length of its data. It must be the last codec, since compressing the padding would undo it.
+//
+// Padmé (Nikitin et al., "Reducing Metadata Leakage from Encrypted Files and Communication with PURBs") rounds a
+// length L up to a multiple of 2^(E-S), where E is floor(log2 L) and S is floor(log2 E) + 1, which leaks
+// O(log log L) bits of the length for at most 12% overhead. The data is followed by a 0x80 byte and then zeros up to
+// the padded length of the data and marker, so the padding is found from the end, without a length prefix.
+const CodecPadme = "padme"
+
+const padMarker = 0x80
+
+const padBufferSize = 32 * 1024
+
+// PadmeLen returns the length the Padmé scheme pads a length to.
+func PadmeLen(length int64) int64 {
+	if length < 2 {
+		return length
+	}
+	e := bits.Len64(uint64(length)) - 1
+	s := bits.Len64(uint64(e))
+	mask := int64(1)<<uint(e-s) - 1
+	return (length + mask) &^ mask
+}
+
+type padmeCodec struct{}
+
+func (padmeCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return &padWriter{w: w}, nil
+}
+
+func (padmeCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return &unpadReader{r: r, buf: make([]byte, padBufferSize)}, nil
+}
+
+// padWriter counts the data written through it, and writes the marker and padding when closed.
+type padWriter struct {
+	w      io.Writer
+	length int64
+	closed bool
+}
+
+func (writer *padWriter) Write(p []byte) (int, error) {
+	n, err := writer.w.Write(p)
+	writer.length += int64(n)
+	return n, err
+}
+
+func (writer *padWriter) Close() error {
+	if writer.closed {
+		return nil
+	}
+	writer.closed = true
+
+	if _, err := writer.w.Write([]byte{padMarker}); err != nil {
+		return err
+	}
+
+	zeros := make([]byte, padBufferSize)
+	for padding := PadmeLen(writer.length+1) - writer.length - 1; padding > 0; {
+		n := int64(len(zeros))
+		if padding < n {
+			n = padding
+		}
+		if _, err := writer.w.Write(zeros[:n]); err != nil {
+			return err
+		}
+		padding -= n
+	}
+	return nil
+}
+
+// unpadReader strips the padding from the end of padded data as it is read. A marker and the zeros after it are
+// held back until a byte other than zero shows they were data, so only a count of zeros is held, however many there
+// are.
+type unpadReader struct {
+	r   io.Reader
+	buf []byte
+	in  []byte
+	err error
+	// held is set when a marker has been read, which is followed by heldZeros zeros so far.
+	held      bool
+	heldZeros int64
+	// emitMarker and emitZeros are a held marker and zeros which turned out to be data, still to be returned.
+	emitMarker bool
+	emitZeros  int64
+}
+
+func (reader *unpadReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if reader.emitMarker {
+			p[n] = padMarker
+			n++
+			reader.emitMarker = false
+			continue
+		}
+		if reader.emitZeros > 0 {
+			k := int64(len(p) - n)
+			if reader.emitZeros < k {
+				k = reader.emitZeros
+			}
+			for i := int64(0); i < k; i++ {
+				p[n] = 0
+				n++
+			}
+			reader.emitZeros -= k
+			continue
+		}
+
+		if len(reader.in) == 0 {
+			// Return what is ready rather than blocking on more input.
+			if reader.err != nil || n > 0 {
+				break
+			}
+			var m int
+			m, reader.err = reader.r.Read(reader.buf)
+			reader.in = reader.buf[:m]
+			continue
+		}
+
+		b := reader.in[0]
+		switch {
+		case reader.held && b == 0:
+			reader.heldZeros++
+		case reader.held:
+			// The held marker and zeros were data; return them before looking at b again.
+			reader.emitMarker = true
+			reader.emitZeros = reader.heldZeros
+			reader.held = false
+			reader.heldZeros = 0
+			continue
+		case b == padMarker:
+			reader.held = true
+		default:
+			p[n] = b
+			n++
+		}
+		reader.in = reader.in[1:]
+	}
+
+	if n > 0 {
+		return n, nil
+	}
+	if reader.err == io.EOF && !reader.held {
+		return 0, fmt.Errorf("padded data has no padding")
+	}
+	return 0, reader.err
+}
+
+func (reader *unpadReader) Close() error {
+	return nil
+}
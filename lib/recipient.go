@@ -0,0 +1,279 @@
+package lib
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Objects can be encrypted to recipients' public keys instead of a shared key. Each such object is encrypted with a
+// fresh random key, which is wrapped to every recipient in the Recipients of its header, so whoever holds one of the
+// matching private keys can unwrap it and decrypt the object. Wrapped keys don't say who they are for, so the server
+// can't tell who an object is meant for; recipients try their private keys against each of them instead.
+//
+// RSA keys, such as the keys clients authenticate with, wrap the object key with RSA-OAEP (SHA-512). X25519 keys wrap it
+// with ChaCha20-Poly1305 under HMAC-SHA-256(X25519(ephemeral, recipient), "dead-drop x25519" | ephemeral public key |
+// recipient public key), where the ephemeral key is generated for each wrapping, and the nonce is zero.
+const RecipientRSA = "rsa-oaep"
+const RecipientX25519 = "x25519"
+
+// ObjectKeyLen is the length of the random keys objects encrypted to recipients are encrypted with.
+const ObjectKeyLen = 32
+
+const objectKeyCipherLabel = "object-key"
+
+// PEM block types of X25519 key files, which hold the raw 32 byte keys.
+const X25519PrivateKeyType = "X25519 PRIVATE KEY"
+const X25519PublicKeyType = "X25519 PUBLIC KEY"
+
+const x25519KeyLen = 32
+
+// WrappedKey is an object key wrapped to a single recipient.
+type WrappedKey struct {
+	Type string
+	// Ephemeral is the ephemeral public key of X25519 wrapped keys.
+	Ephemeral []byte `json:",omitempty"`
+	Key       []byte
+}
+
+// Recipient is a public key which object keys can be wrapped to.
+type Recipient interface {
+	WrapKey(key *memguard.LockedBuffer) (*WrappedKey, error)
+}
+
+// Identity is a private key which unwraps the object keys wrapped to its recipient.
+type Identity interface {
+	// UnwrapKey returns the unwrapped key, or an error if the key was not wrapped to this identity.
+	UnwrapKey(wrapped *WrappedKey) (*memguard.LockedBuffer, error)
+}
+
+// NewObjectKey generates the random key of an object encrypted to recipients.
+func NewObjectKey() *memguard.LockedBuffer {
+	return memguard.NewBufferRandom(ObjectKeyLen)
+}
+
+// RSARecipient wraps object keys to an RSA public key.
+type RSARecipient struct {
+	Key *rsa.PublicKey
+}
+
+func (recipient *RSARecipient) WrapKey(key *memguard.LockedBuffer) (*WrappedKey, error) {
+	wrapped, err := rsa.EncryptOAEP(sha512.New(), rand.Reader, recipient.Key, key.Bytes(), []byte(objectKeyCipherLabel))
+	if err != nil {
+		return nil, err
+	}
+	return &WrappedKey{Type: RecipientRSA, Key: wrapped}, nil
+}
+
+// RSAIdentity unwraps object keys with an RSA private key, e.g. an *rsa.PrivateKey.
+type RSAIdentity struct {
+	Key crypto.Decrypter
+}
+
+func (identity *RSAIdentity) UnwrapKey(wrapped *WrappedKey) (*memguard.LockedBuffer, error) {
+	if wrapped.Type != RecipientRSA {
+		return nil, fmt.Errorf("key is not wrapped with %s", RecipientRSA)
+	}
+
+	key, err := identity.Key.Decrypt(rand.Reader, wrapped.Key, &rsa.OAEPOptions{
+		Hash:  crypto.SHA512,
+		Label: []byte(objectKeyCipherLabel),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("key is not wrapped to this identity")
+	}
+	defer memguard.WipeBytes(key)
+	return memguard.NewBufferFromBytes(key), nil
+}
+
+// X25519Recipient wraps object keys to an X25519 public key.
+type X25519Recipient struct {
+	publicKey [x25519KeyLen]byte
+}
+
+// NewX25519Recipient parses a raw X25519 public key.
+func NewX25519Recipient(publicKey []byte) (*X25519Recipient, error) {
+	if len(publicKey) != x25519KeyLen {
+		return nil, fmt.Errorf("X25519 public keys must be %d bytes", x25519KeyLen)
+	}
+
+	recipient := &X25519Recipient{}
+	copy(recipient.publicKey[:], publicKey)
+	return recipient, nil
+}
+
+// EncodePEM encodes the public key as a PEM block of type X25519PublicKeyType.
+func (recipient *X25519Recipient) EncodePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: X25519PublicKeyType, Bytes: recipient.publicKey[:]})
+}
+
+func (recipient *X25519Recipient) WrapKey(key *memguard.LockedBuffer) (*WrappedKey, error) {
+	ephemeral := memguard.NewBufferRandom(x25519KeyLen)
+	defer ephemeral.Destroy()
+
+	var ephemeralPublic [x25519KeyLen]byte
+	scalarBaseMult(&ephemeralPublic, ephemeral)
+
+	wrapKey, err := x25519WrapKey(ephemeral, &recipient.publicKey, ephemeralPublic[:], recipient.publicKey[:])
+	if err != nil {
+		return nil, err
+	}
+	defer wrapKey.Destroy()
+
+	aead, err := chacha20poly1305.New(wrapKey.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return &WrappedKey{
+		Type:      RecipientX25519,
+		Ephemeral: ephemeralPublic[:],
+		Key:       aead.Seal(nil, make([]byte, aead.NonceSize()), key.Bytes(), nil),
+	}, nil
+}
+
+// X25519Identity unwraps object keys with an X25519 private key.
+type X25519Identity struct {
+	privateKey *memguard.LockedBuffer
+	recipient  *X25519Recipient
+}
+
+// GenerateX25519Identity generates a new X25519 private key.
+func GenerateX25519Identity() *X25519Identity {
+	identity, _ := NewX25519Identity(memguard.NewBufferRandom(x25519KeyLen))
+	return identity
+}
+
+// NewX25519Identity takes ownership of a raw X25519 private key, which is destroyed by Destroy.
+func NewX25519Identity(privateKey *memguard.LockedBuffer) (*X25519Identity, error) {
+	if privateKey.Size() != x25519KeyLen {
+		privateKey.Destroy()
+		return nil, fmt.Errorf("X25519 private keys must be %d bytes", x25519KeyLen)
+	}
+
+	recipient := &X25519Recipient{}
+	scalarBaseMult(&recipient.publicKey, privateKey)
+	return &X25519Identity{privateKey: privateKey, recipient: recipient}, nil
+}
+
+// ParseX25519Identity parses a PEM encoded X25519 private key, as written by EncodePEM.
+func ParseX25519Identity(pemBytes []byte) (*X25519Identity, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != X25519PrivateKeyType {
+		return nil, fmt.Errorf("not a PEM encoded X25519 private key")
+	}
+	defer memguard.WipeBytes(block.Bytes)
+
+	return NewX25519Identity(memguard.NewBufferFromBytes(block.Bytes))
+}
+
+// EncodePEM encodes the private key as a PEM block of type X25519PrivateKeyType.
+// The returned bytes should be wiped once written.
+func (identity *X25519Identity) EncodePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: X25519PrivateKeyType, Bytes: identity.privateKey.Bytes()})
+}
+
+// Recipient returns the public key of the identity.
+func (identity *X25519Identity) Recipient() *X25519Recipient {
+	return identity.recipient
+}
+
+func (identity *X25519Identity) UnwrapKey(wrapped *WrappedKey) (*memguard.LockedBuffer, error) {
+	if wrapped.Type != RecipientX25519 {
+		return nil, fmt.Errorf("key is not wrapped with %s", RecipientX25519)
+	}
+	if len(wrapped.Ephemeral) != x25519KeyLen {
+		return nil, fmt.Errorf("malformed wrapped key")
+	}
+
+	var ephemeralPublic [x25519KeyLen]byte
+	copy(ephemeralPublic[:], wrapped.Ephemeral)
+
+	recipientPublic := identity.recipient.publicKey[:]
+	wrapKey, err := x25519WrapKey(identity.privateKey, &ephemeralPublic, wrapped.Ephemeral, recipientPublic)
+	if err != nil {
+		return nil, err
+	}
+	defer wrapKey.Destroy()
+
+	aead, err := chacha20poly1305.New(wrapKey.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := aead.Open(nil, make([]byte, aead.NonceSize()), wrapped.Key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("key is not wrapped to this identity")
+	}
+	return memguard.NewBufferFromBytes(key), nil
+}
+
+func (identity *X25519Identity) Destroy() {
+	identity.privateKey.Destroy()
+}
+
+// x25519WrapKey derives the key which wraps an object key from the shared secret of a private and public key.
+func x25519WrapKey(
+	privateKey *memguard.LockedBuffer,
+	publicKey *[x25519KeyLen]byte,
+	ephemeralPublic []byte,
+	recipientPublic []byte,
+) (*memguard.LockedBuffer, error) {
+	var scalar, shared [x25519KeyLen]byte
+	copy(scalar[:], privateKey.Bytes())
+	curve25519.ScalarMult(&shared, &scalar, publicKey)
+	defer memguard.WipeBytes(scalar[:])
+	defer memguard.WipeBytes(shared[:])
+
+	// Low order public keys give an all-zero secret, which would make the wrapping key public.
+	if bytes.Equal(shared[:], make([]byte, x25519KeyLen)) {
+		return nil, fmt.Errorf("invalid X25519 public key")
+	}
+
+	mac := hmac.New(sha256.New, shared[:])
+	mac.Write([]byte("dead-drop " + RecipientX25519))
+	mac.Write(ephemeralPublic)
+	mac.Write(recipientPublic)
+	return memguard.NewBufferFromBytes(mac.Sum(nil)), nil
+}
+
+func scalarBaseMult(dst *[x25519KeyLen]byte, privateKey *memguard.LockedBuffer) {
+	var scalar [x25519KeyLen]byte
+	copy(scalar[:], privateKey.Bytes())
+	curve25519.ScalarBaseMult(dst, &scalar)
+	memguard.WipeBytes(scalar[:])
+}
+
+// WrapObjectKey wraps an object key to each recipient, in order.
+func WrapObjectKey(key *memguard.LockedBuffer, recipients []Recipient) ([]*WrappedKey, error) {
+	wrapped := make([]*WrappedKey, 0, len(recipients))
+	for _, recipient := range recipients {
+		wrappedKey, err := recipient.WrapKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("error wrapping key to recipient: %v", err)
+		}
+		wrapped = append(wrapped, wrappedKey)
+	}
+	return wrapped, nil
+}
+
+// UnwrapObjectKey unwraps an object key with whichever identity it was wrapped to.
+func UnwrapObjectKey(wrapped []*WrappedKey, identities []Identity) (*memguard.LockedBuffer, error) {
+	for _, wrappedKey := range wrapped {
+		for _, identity := range identities {
+			if key, err := identity.UnwrapKey(wrappedKey); err == nil {
+				return key, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("object was not encrypted to any of your keys")
+}
@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/awnumar/memguard"
+	"testing"
+)
+
+func TestWrapObjectKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x25519Identity := GenerateX25519Identity()
+	defer x25519Identity.Destroy()
+	otherX25519Identity := GenerateX25519Identity()
+	defer otherX25519Identity.Destroy()
+
+	for _, test := range []struct {
+		name      string
+		recipient Recipient
+		identity  Identity
+		other     Identity
+	}{
+		{RecipientRSA, &RSARecipient{Key: &rsaKey.PublicKey}, &RSAIdentity{Key: rsaKey},
+			&RSAIdentity{Key: otherRSAKey}},
+		{RecipientX25519, x25519Identity.Recipient(), x25519Identity, otherX25519Identity},
+	} {
+		key := NewObjectKey()
+		wrapped, err := WrapObjectKey(key, []Recipient{test.recipient})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		unwrapped, err := UnwrapObjectKey(wrapped, []Identity{test.other, test.identity})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else {
+			if !bytes.Equal(unwrapped.Bytes(), key.Bytes()) {
+				t.Errorf("%s: unwrapped key does not match", test.name)
+			}
+			unwrapped.Destroy()
+		}
+		if _, err := UnwrapObjectKey(wrapped, []Identity{test.other}); err == nil {
+			t.Errorf("%s: key was unwrapped by another identity", test.name)
+		}
+
+		wrapped[0].Key[len(wrapped[0].Key)-1] ^= 1
+		if _, err := UnwrapObjectKey(wrapped, []Identity{test.identity}); err == nil {
+			t.Errorf("%s: tampered key was unwrapped", test.name)
+		}
+		key.Destroy()
+	}
+}
+
+func TestX25519Identity(t *testing.T) {
+	identity := GenerateX25519Identity()
+	defer identity.Destroy()
+
+	encoded := identity.EncodePEM()
+	parsed, err := ParseX25519Identity(encoded)
+	memguard.WipeBytes(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parsed.Destroy()
+	if !bytes.Equal(parsed.Recipient().publicKey[:], identity.Recipient().publicKey[:]) {
+		t.Errorf("parsed identity has another public key")
+	}
+
+	// Low order ephemeral keys would make the wrapping key public.
+	key := NewObjectKey()
+	defer key.Destroy()
+	wrapped, err := identity.Recipient().WrapKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped.Ephemeral = make([]byte, x25519KeyLen)
+	if _, err := identity.UnwrapKey(wrapped); err == nil {
+		t.Errorf("key wrapped with a low order ephemeral key was unwrapped")
+	}
+
+	if _, err := NewX25519Recipient(make([]byte, 31)); err == nil {
+		t.Errorf("a 31 byte public key was accepted")
+	}
+	if _, err := ParseX25519Identity(identity.Recipient().EncodePEM()); err == nil {
+		t.Errorf("a public key was parsed as a private key")
+	}
+}
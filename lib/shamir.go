@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/awnumar/memguard"
+)
+
+// MaxSecretShares bounds the number of shares a secret can be split into, since shares are points of GF(2^8) other
+// than 0.
+const MaxSecretShares = 255
+
+// SecretShare is a share of a secret split with SplitSecret: the value at X of a random polynomial over GF(2^8), of
+// which the secret is the value at 0, for each byte of the secret.
+type SecretShare struct {
+	X byte
+	Y []byte
+}
+
+// SplitSecret splits a secret into shares with Shamir's secret sharing, any threshold of which can recombine it with
+// CombineShares, while fewer reveal nothing about it but its length.
+func SplitSecret(secret []byte, shares int, threshold int) ([]SecretShare, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("can't split an empty secret")
+	}
+	if threshold < 2 || threshold > shares || shares > MaxSecretShares {
+		return nil, fmt.Errorf("invalid threshold of %d of %d shares, which must be at least 2 of at most %d",
+			threshold, shares, MaxSecretShares)
+	}
+
+	// Each byte of the secret is the constant term of its own polynomial, whose other coefficients are random.
+	coefficients := make([]byte, len(secret)*(threshold-1))
+	if _, err := rand.Read(coefficients); err != nil {
+		return nil, fmt.Errorf("error generating polynomials: %v", err)
+	}
+	defer memguard.WipeBytes(coefficients)
+
+	result := make([]SecretShare, shares)
+	for i := range result {
+		x := byte(i + 1)
+		y := make([]byte, len(secret))
+		for b := range secret {
+			// Horner's method, from the highest coefficient down to the secret.
+			poly := coefficients[b*(threshold-1) : (b+1)*(threshold-1)]
+			var value byte
+			for c := len(poly) - 1; c >= 0; c-- {
+				value = gfMul(value, x) ^ poly[c]
+			}
+			y[b] = gfMul(value, x) ^ secret[b]
+		}
+		result[i] = SecretShare{X: x, Y: y}
+	}
+	return result, nil
+}
+
+// CombineShares recombines a secret from shares made by SplitSecret. Given fewer shares than the threshold the secret
+// was split with, or shares of different secrets, it returns garbage rather than an error, which callers must detect.
+func CombineShares(shares []SecretShare) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, fmt.Errorf("at least 2 shares are needed")
+	}
+	seen := make(map[byte]bool, len(shares))
+	for _, share := range shares {
+		if share.X == 0 || seen[share.X] {
+			return nil, fmt.Errorf("invalid or duplicate share %d", share.X)
+		}
+		if len(share.Y) != len(shares[0].Y) || len(share.Y) == 0 {
+			return nil, fmt.Errorf("shares are of secrets of different lengths")
+		}
+		seen[share.X] = true
+	}
+
+	// Lagrange interpolation at 0, where the basis polynomial of share i is the product of xj / (xj - xi) over the
+	// other shares j. Subtraction is xor in GF(2^8).
+	secret := make([]byte, len(shares[0].Y))
+	for i, share := range shares {
+		basis := byte(1)
+		for j, other := range shares {
+			if i != j {
+				basis = gfMul(basis, gfMul(other.X, gfInv(other.X^share.X)))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(share.Y[b], basis)
+		}
+	}
+	return secret, nil
+}
+
+// gfMul multiplies in GF(2^8) with the polynomial of AES, x^8 + x^4 + x^3 + x + 1, without branching on its operands.
+func gfMul(a byte, b byte) byte {
+	var product byte
+	for i := 0; i < 8; i++ {
+		product ^= -(b & 1) & a
+		b >>= 1
+		a = (a << 1) ^ (-(a >> 7) & 0x1b)
+	}
+	return product
+}
+
+// gfInv inverts a non-zero element of GF(2^8), as a^254.
+func gfInv(a byte) byte {
+	result := a
+	for i := 0; i < 6; i++ {
+		result = gfMul(gfMul(result, result), a)
+	}
+	return gfMul(result, result)
+}
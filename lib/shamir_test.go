@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if product := gfMul(byte(a), gfInv(byte(a))); product != 1 {
+			t.Fatalf("%d * %d^-1 = %d", a, a, product)
+		}
+	}
+}
+
+func TestSplitSecret(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	shares, err := SplitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 5 {
+		t.Fatalf("Split into %d shares, expected 5", len(shares))
+	}
+
+	// Every set of 3 shares, in any order, recombines the secret.
+	for i := range shares {
+		for j := range shares {
+			for k := range shares {
+				if i == j || j == k || i == k {
+					continue
+				}
+				combined, err := CombineShares([]SecretShare{shares[i], shares[j], shares[k]})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(combined, secret) {
+					t.Fatalf("Shares %d, %d and %d combined to %q", i, j, k, combined)
+				}
+			}
+		}
+	}
+
+	combined, err := CombineShares(shares[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(combined, secret) {
+		t.Fatal("2 shares of a threshold of 3 combined to the secret")
+	}
+
+	if _, err := CombineShares([]SecretShare{shares[0], shares[0], shares[1]}); err == nil {
+		t.Fatal("Combined duplicate shares")
+	}
+	if _, err := SplitSecret(secret, 2, 3); err == nil {
+		t.Fatal("Split with a threshold above the number of shares")
+	}
+	if _, err := SplitSecret(secret, 256, 2); err == nil {
+		t.Fatal("Split into more than 255 shares")
+	}
+}
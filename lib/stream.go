@@ -0,0 +1,301 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"io"
+)
+
+// Chunked objects are encrypted as a stream, so neither side has to hold the whole object in memory.
+// Their header has a ChunkSize, and their encrypted message is laid out as:
+//
+//	IV | chunk 0 | chunk 1 | ... | final chunk
+//
+// where each chunk is the AES-CTR ciphertext of the next ChunkSize bytes of plaintext (the final chunk may be shorter),
+// followed by its signature:
+//
+//	HMAC(header | IV | chunk index (uint64 BE) | final flag (1 byte) | chunk ciphertext)
+//
+// The counter runs on across chunks, so the ciphertext is the same as for a whole object with the same IV.
+// The index stops chunks from being reordered, and the final flag stops the object from being truncated.
+const DefaultChunkSize = 64 * 1024
+
+// Bound the chunk size, since the header is sent by the server and chunks are buffered whole.
+const maxChunkSize = 16 * 1024 * 1024
+
+const chunkTagLen = sha256.Size
+
+func checkChunkSize(chunkSize int) error {
+	if chunkSize <= 0 || chunkSize > maxChunkSize {
+		return fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	return nil
+}
+
+func chunkTag(hmacKey []byte, header []byte, iv []byte, index uint64, final bool, ciphertext []byte) []byte {
+	position := make([]byte, 9)
+	binary.BigEndian.PutUint64(position, index)
+	if final {
+		position[8] = 1
+	}
+
+	hash := hmac.New(sha256.New, hmacKey)
+	hash.Write(header)
+	hash.Write(iv)
+	hash.Write(position)
+	hash.Write(ciphertext)
+	return hash.Sum(nil)
+}
+
+// NewEncryptWriter returns a writer which encrypts the plaintext written to it in chunks of chunkSize bytes, writing
+// the encrypted message to w. The key is destroyed, and the header is authenticated but not written.
+// The writer must be closed to write the final chunk, which does not close w.
+func NewEncryptWriter(key *memguard.LockedBuffer, header []byte, w io.Writer, chunkSize int) (io.WriteCloser, error) {
+	iv := make([]byte, ivLength)
+	if _, err := rand.Read(iv); err != nil {
+		key.Destroy()
+		return nil, err
+	}
+
+	return newEncryptWriterWithIV(key, header, iv, w, chunkSize)
+}
+
+// newEncryptWriterWithIV is NewEncryptWriter with a chosen IV, which like encryptWithIV is only for test vectors.
+func newEncryptWriterWithIV(
+	key *memguard.LockedBuffer,
+	header []byte,
+	iv []byte,
+	w io.Writer,
+	chunkSize int,
+) (io.WriteCloser, error) {
+	if len(iv) != ivLength {
+		key.Destroy()
+		return nil, fmt.Errorf("iv must be %d bytes", ivLength)
+	}
+	if err := checkChunkSize(chunkSize); err != nil {
+		key.Destroy()
+		return nil, err
+	}
+
+	encryptionKey, hmacKey := splitKeyHash(key)
+	defer encryptionKey.Destroy()
+
+	block, err := aes.NewCipher(encryptionKey.Bytes())
+	if err != nil {
+		hmacKey.Destroy()
+		return nil, err
+	}
+
+	if _, err := w.Write(iv); err != nil {
+		hmacKey.Destroy()
+		return nil, err
+	}
+
+	plaintext := memguard.NewBuffer(chunkSize)
+	plaintext.Melt()
+
+	return &encryptWriter{
+		w:          w,
+		stream:     cipher.NewCTR(block, iv),
+		hmacKey:    hmacKey,
+		header:     header,
+		iv:         iv,
+		plaintext:  plaintext,
+		ciphertext: make([]byte, chunkSize),
+	}, nil
+}
+
+type encryptWriter struct {
+	w          io.Writer
+	stream     cipher.Stream
+	hmacKey    *memguard.LockedBuffer
+	header     []byte
+	iv         []byte
+	plaintext  *memguard.LockedBuffer
+	ciphertext []byte
+	pending    int
+	index      uint64
+	err        error
+	closed     bool
+}
+
+func (writer *encryptWriter) Write(p []byte) (int, error) {
+	if writer.closed {
+		return 0, fmt.Errorf("write to closed encrypt writer")
+	}
+
+	written := 0
+	for writer.err == nil && written < len(p) {
+		// A full chunk is only written once more plaintext arrives, since until then it may be the final one.
+		if writer.pending == len(writer.ciphertext) {
+			writer.err = writer.flush(false)
+			continue
+		}
+
+		n := copy(writer.plaintext.Bytes()[writer.pending:], p[written:])
+		writer.pending += n
+		written += n
+	}
+	return written, writer.err
+}
+
+// Close writes the final chunk, and destroys the keys.
+func (writer *encryptWriter) Close() error {
+	if writer.closed {
+		return writer.err
+	}
+	writer.closed = true
+
+	if writer.err == nil {
+		writer.err = writer.flush(true)
+	}
+
+	writer.hmacKey.Destroy()
+	writer.plaintext.Destroy()
+	return writer.err
+}
+
+func (writer *encryptWriter) flush(final bool) error {
+	ciphertext := writer.ciphertext[:writer.pending]
+	writer.stream.XORKeyStream(ciphertext, writer.plaintext.Bytes()[:writer.pending])
+	tag := chunkTag(writer.hmacKey.Bytes(), writer.header, writer.iv, writer.index, final, ciphertext)
+
+	if _, err := writer.w.Write(ciphertext); err != nil {
+		return err
+	}
+	if _, err := writer.w.Write(tag); err != nil {
+		return err
+	}
+
+	writer.index++
+	writer.pending = 0
+	return nil
+}
+
+// NewDecryptReader returns a reader of the plaintext of an encrypted message produced by NewEncryptWriter,
+// given the same header and chunk size. The key is destroyed.
+// Each chunk is verified before any of its plaintext is returned, but an object is only authentic once the reader
+// returns io.EOF; on any other error, whatever was read from it must be discarded.
+// Closing the reader destroys the plaintext it holds, but does not close r.
+func NewDecryptReader(key *memguard.LockedBuffer, header []byte, r io.Reader, chunkSize int) (io.ReadCloser, error) {
+	if err := checkChunkSize(chunkSize); err != nil {
+		key.Destroy()
+		return nil, err
+	}
+
+	encryptionKey, hmacKey := splitKeyHash(key)
+	defer encryptionKey.Destroy()
+
+	iv := make([]byte, ivLength)
+	if _, err := io.ReadFull(r, iv); err != nil {
+		hmacKey.Destroy()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("message too short")
+		}
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(encryptionKey.Bytes())
+	if err != nil {
+		hmacKey.Destroy()
+		return nil, err
+	}
+
+	plaintext := memguard.NewBuffer(chunkSize)
+	plaintext.Melt()
+
+	return &decryptReader{
+		r:         bufio.NewReader(r),
+		stream:    cipher.NewCTR(block, iv),
+		hmacKey:   hmacKey,
+		header:    header,
+		iv:        iv,
+		chunk:     make([]byte, chunkSize+chunkTagLen),
+		plaintext: plaintext,
+	}, nil
+}
+
+type decryptReader struct {
+	r         *bufio.Reader
+	stream    cipher.Stream
+	hmacKey   *memguard.LockedBuffer
+	header    []byte
+	iv        []byte
+	chunk     []byte
+	plaintext *memguard.LockedBuffer
+	start     int
+	end       int
+	index     uint64
+	final     bool
+	err       error
+}
+
+func (reader *decryptReader) Read(p []byte) (int, error) {
+	for reader.start == reader.end {
+		if reader.err != nil {
+			return 0, reader.err
+		}
+		if reader.final {
+			return 0, io.EOF
+		}
+		reader.err = reader.readChunk()
+	}
+
+	n := copy(p, reader.plaintext.Bytes()[reader.start:reader.end])
+	reader.start += n
+	return n, nil
+}
+
+func (reader *decryptReader) readChunk() error {
+	n, err := io.ReadFull(reader.r, reader.chunk)
+	switch err {
+	case nil:
+		// A full chunk is the final one if nothing follows it.
+		if _, err := reader.r.Peek(1); err == io.EOF {
+			reader.final = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		reader.final = true
+	case io.EOF:
+		return fmt.Errorf("message is truncated")
+	default:
+		return err
+	}
+
+	if n < chunkTagLen {
+		return fmt.Errorf("message is truncated")
+	}
+
+	ciphertext := reader.chunk[:n-chunkTagLen]
+	tag := reader.chunk[n-chunkTagLen : n]
+	expectedTag := chunkTag(reader.hmacKey.Bytes(), reader.header, reader.iv, reader.index, reader.final, ciphertext)
+	if !hmac.Equal(tag, expectedTag) {
+		return fmt.Errorf("bad signature")
+	}
+
+	reader.stream.XORKeyStream(reader.plaintext.Bytes()[:len(ciphertext)], ciphertext)
+	reader.start = 0
+	reader.end = len(ciphertext)
+	reader.index++
+	return nil
+}
+
+// Close destroys the plaintext and keys.
+func (reader *decryptReader) Close() error {
+	reader.hmacKey.Destroy()
+	reader.plaintext.Destroy()
+	reader.start, reader.end = 0, 0
+	if reader.err == nil {
+		reader.err = fmt.Errorf("read from closed decrypt reader")
+	}
+	return nil
+}
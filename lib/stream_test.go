@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"bytes"
+	"github.com/awnumar/memguard"
+	"io/ioutil"
+	"testing"
+)
+
+func encryptChunked(t *testing.T, key []byte, header []byte, plaintext []byte, chunkSize int) []byte {
+	message := new(bytes.Buffer)
+	writer, err := NewEncryptWriter(memguard.NewBufferFromBytes(append([]byte(nil), key...)), header, message, chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write in odd sizes, so that writes straddle chunks.
+	for start := 0; start < len(plaintext); start += 7 {
+		end := start + 7
+		if end > len(plaintext) {
+			end = len(plaintext)
+		}
+		if _, err := writer.Write(plaintext[start:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return message.Bytes()
+}
+
+func decryptChunked(key []byte, header []byte, message []byte, chunkSize int) ([]byte, error) {
+	reader, err := NewDecryptReader(memguard.NewBufferFromBytes(append([]byte(nil), key...)), header,
+		bytes.NewReader(message), chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+func TestChunkedRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	header := []byte("header")
+
+	for _, size := range []int{0, 1, 15, 16, 17, 32, 100} {
+		plaintext := bytes.Repeat([]byte{0x07}, size)
+		message := encryptChunked(t, key, header, plaintext, 16)
+
+		decrypted, err := decryptChunked(key, header, message, 16)
+		if err != nil {
+			t.Errorf("%d bytes: %v", size, err)
+		} else if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("%d bytes: decrypted plaintext does not match", size)
+		}
+
+		if _, err := decryptChunked(key, []byte("other"), message, 16); err == nil {
+			t.Errorf("%d bytes: message was decrypted with a different header", size)
+		}
+	}
+}
+
+func TestChunkedRejectsTruncatedAndReordered(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	const chunkSize = 16
+	const chunkLen = chunkSize + chunkTagLen
+
+	message := encryptChunked(t, key, nil, bytes.Repeat([]byte{0x07}, 3*chunkSize), chunkSize)
+
+	// Cutting the message at a chunk boundary leaves a valid chunk which isn't marked final.
+	truncated := message[:ivLength+2*chunkLen]
+	if _, err := decryptChunked(key, nil, truncated, chunkSize); err == nil {
+		t.Errorf("truncated message was decrypted")
+	}
+
+	reordered := append([]byte(nil), message...)
+	copy(reordered[ivLength:], message[ivLength+chunkLen:ivLength+2*chunkLen])
+	copy(reordered[ivLength+chunkLen:], message[ivLength:ivLength+chunkLen])
+	if _, err := decryptChunked(key, nil, reordered, chunkSize); err == nil {
+		t.Errorf("reordered message was decrypted")
+	}
+
+	if _, err := decryptChunked(key, nil, append(message, 0), chunkSize); err == nil {
+		t.Errorf("message with trailing data was decrypted")
+	}
+}
@@ -0,0 +1,293 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"io"
+	"io/ioutil"
+)
+
+// TestVector is a known-answer test for the object format. The expected object was computed independently
+// from the format description, so a match shows an implementation agrees with every other one.
+// Binary fields are hex encoded, matching the golden files in testdata/vectors.
+type TestVector struct {
+	Name string
+	Key  string
+	IV   string
+	// Header is nil for a legacy object, which has no header.
+	Header *ObjectHeader `json:",omitempty"`
+	Meta   ObjectMetadata
+	Data   string
+	Object string
+	// Checksum is the checksum of Object, as used in object references.
+	Checksum string
+}
+
+// TestVectors returns the known-answer test vectors built into this package, for self tests of a build.
+func TestVectors() []*TestVector {
+	return []*TestVector{
+		{
+			Name:   "object with header and metadata",
+			Key:    "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+			IV:     "a0a1a2a3a4a5a6a7a8a9aaabacadaeaf",
+			Header: &ObjectHeader{KeyId: "2019-q3"},
+			Meta:   ObjectMetadata{Name: "hello.txt", Note: "see you at noon"},
+			Data:   "68656c6c6f2c20646561642064726f700a",
+			Object: "4445414401000000137b224b65794964223a22323031392d7133227dc6fe9bac62a094b6a8389a1ed4101f01c8498ebe4d5c7738" +
+				"cbe669c8d743b247a0a1a2a3a4a5a6a7a8a9aaabacadaeafb79d73a274cd1836ce68f4586ae615e9133f1f6e075d622f6cf6f58b30" +
+				"db9782701834c4b1025d9b7fc540adc5c9948f0cb4913bbe582e2b238f3259e63f00fa83af",
+			Checksum: "NR4t31dZljhjjqnN-AgmLEltTZh-W2pBQk8O3DSnLLQ=",
+		},
+		{
+			Name: "legacy object without header",
+			Key:  "fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0efeeedecebeae9e8e7e6e5e4e3e2e1e0",
+			IV:   "00000000000000000000000000000000",
+			Data: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" +
+				"202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f",
+			Object: "d2b4df40a5c12b58d109ae5f1a3a65dbf09770f39f6d79987c138d9853a303b400000000000000000000000000000000dde319e2" +
+				"6261b4d86bcd6426c00833358edf7d8f41cbc7c4fde3fa58a20fd9c080e219b528082571a8b26e157f4abc82c0b5ce8d06d9eb97" +
+				"3b3adb14feac5cb9940cea9e7daf",
+			Checksum: "YplW1h7Qo1NRvngCpClwA0dVT5GzzNjT_ve1YqT6E8I=",
+		},
+		{
+			Name:   "chunked object",
+			Key:    "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f",
+			IV:     "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf",
+			Header: &ObjectHeader{ChunkSize: 16},
+			Meta:   ObjectMetadata{Name: "chunks.bin"},
+			Data:   "404142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f6061626364656667",
+			Object: "4445414401000000107b224368756e6b53697a65223a31367dc0c1c2c3c4c5c6c7c8c9cacbcccdcecf0834f30159ef17022f99b0" +
+				"3f1d1c78b72fd5770e19388a62ae2d2644f7274b59405704ea536088acc47adc2e39c5156b18a0feaf95f72d769f0fc100ea8e2c" +
+				"d41399551856fe88fe6f2bf1f03455803592fbfbbaae1e4e6594fa1f9da20658b94b56c1b5ffaaab36ef60d48a8dd9daa9b9d5f7" +
+				"9f54290e7fd8032d8d0e63f08f0bcd57f863790d972f9543be9f80c2e9fa4c49ae45e6ef4fd3542bcb9fcb8ef2b6cec2eee1223c" +
+				"e2dee7efe4c408ad9e9e2c4a2a72f65279c3f30130dda2959375730ab904b96dfbd17d30e778c90f5a4cb9e80917a59d0ea27459" +
+				"02bcce8992f5",
+			Checksum: "PlWTjS3jRAvsKWAW-AWkORVZX1YXpJyGk3w5gBdB-Qo=",
+		},
+		{
+			Name:   "aes-256-gcm object",
+			Key:    "606162636465666768696a6b6c6d6e6f707172737475767778797a7b7c7d7e7f",
+			IV:     "e0e1e2e3e4e5e6e7e8e9eaebecedeeef",
+			Header: &ObjectHeader{ChunkSize: 16, Cipher: CipherAES256GCM},
+			Meta:   ObjectMetadata{Name: "gcm.bin"},
+			Data:   "808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9fa0a1a2a3a4a5a6a7",
+			Object: "4445414402000000277b224368756e6b53697a65223a31362c22436970686572223a226165732d3235362d67636d227de0e1e2e3" +
+				"e4e5e6e7e8e9eaebecedeeef35282b78d914f56dce829851c6793d5c55202f74037918105948711d21a046b4adaef13518751128" +
+				"dcc9ebc63b503581053ab7b09f9e1a72c12ba0077744a699fd0b7fd50fe429099e5fb7c0f0613a91a5daf5c84d313acea936fb35" +
+				"2341d1b5dc36de226f8a7bd541278e6f81034629a12fb8198f7f43ad4eb24f016c2d",
+			Checksum: "OfcqTwKgO-rJ6qPPs2vjpRy20llhkISfU4nuRvTehEA=",
+		},
+		{
+			Name:   "chacha20poly1305 object",
+			Key:    "a0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3b4b5b6b7b8b9babbbcbdbebf",
+			IV:     "d0d1d2d3d4d5d6d7d8d9dadbdcdddedf",
+			Header: &ObjectHeader{ChunkSize: 16, Cipher: CipherChaCha20Poly1305},
+			Meta:   ObjectMetadata{Name: "chacha.bin"},
+			Data:   "c0c1c2c3c4c5c6c7c8c9cacbcccdcecfd0d1d2d3d4d5d6d7d8d9dadbdcdddedfe0e1e2e3e4e5e6e7",
+			Object: "44454144020000002c7b224368756e6b53697a65223a31362c22436970686572223a226368616368613230706f6c793133303522" +
+				"7dd0d1d2d3d4d5d6d7d8d9dadbdcdddedf443f8ac053932299dff07f72d3f1cfb4f0c13c9cf36cb021cba53077c9db15a9051811" +
+				"509415563d0b7cb2dc77f8732c3520a2a78ee29f428e5c00003c3f494dd88b0dded260276c6711d31dfcdfb7fd872553d015f929" +
+				"0871251c38096fc92214ebe52fab4c452064edf2621c7377a655f5cd232a56d1ee8f47ab6be20b4dc0b348578e6f0b5e40193229" +
+				"e27bb956067c",
+			Checksum: "A7xw4fUoZkDAbtD0WraJxDAgNEgw2fpVTfm7V_nozdw=",
+		},
+	}
+}
+
+// ObjectBytes decodes the expected object.
+func (vector *TestVector) ObjectBytes() ([]byte, error) {
+	return vector.decodeHex("object", vector.Object)
+}
+
+// Verify checks that encrypting the vector's data reproduces its object exactly, that decrypting the object
+// recovers the header, metadata and data, and that modifying any byte of the object makes it fail to decrypt.
+func (vector *TestVector) Verify() error {
+	if err := vector.verifyEncrypt(); err != nil {
+		return fmt.Errorf("encrypt: %v", err)
+	}
+	if err := vector.verifyDecrypt(); err != nil {
+		return fmt.Errorf("decrypt: %v", err)
+	}
+	if err := vector.verifyTampered(); err != nil {
+		return fmt.Errorf("tamper: %v", err)
+	}
+	return nil
+}
+
+func (vector *TestVector) decodeHex(field string, value string) ([]byte, error) {
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("bad test vector %s: %v", field, err)
+	}
+	return decoded, nil
+}
+
+func (vector *TestVector) loadKey() (*memguard.LockedBuffer, error) {
+	key, err := vector.decodeHex("key", vector.Key)
+	if err != nil {
+		return nil, err
+	}
+	return memguard.NewBufferFromBytes(key), nil
+}
+
+func (vector *TestVector) verifyEncrypt() error {
+	iv, err := vector.decodeHex("iv", vector.IV)
+	if err != nil {
+		return err
+	}
+	data, err := vector.decodeHex("data", vector.Data)
+	if err != nil {
+		return err
+	}
+	expected, err := vector.ObjectBytes()
+	if err != nil {
+		return err
+	}
+
+	var header []byte
+	if vector.Header != nil {
+		if header, err = EncodeHeader(vector.Header); err != nil {
+			return err
+		}
+	}
+
+	plaintext, err := SealEnvelope(&vector.Meta, data)
+	if err != nil {
+		return err
+	}
+
+	key, err := vector.loadKey()
+	if err != nil {
+		return err
+	}
+
+	var message []byte
+	if vector.Header != nil && vector.Header.ChunkSize > 0 {
+		buf := new(bytes.Buffer)
+		var writer io.WriteCloser
+		if vector.Header.Cipher != "" {
+			// AEAD objects have a salt where AES-CTR objects have an IV.
+			writer, err = newSealWriterWithSalt(key, vector.Header.Cipher, header, iv, buf, vector.Header.ChunkSize)
+		} else {
+			writer, err = newEncryptWriterWithIV(key, header, iv, buf, vector.Header.ChunkSize)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(plaintext); err != nil {
+			writer.Close()
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		message = buf.Bytes()
+	} else if message, err = encryptWithIV(key, header, iv, plaintext); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(append(header, message...), expected) {
+		return fmt.Errorf("encrypted object does not match the test vector")
+	}
+	return nil
+}
+
+func (vector *TestVector) verifyDecrypt() error {
+	expectedData, err := vector.decodeHex("data", vector.Data)
+	if err != nil {
+		return err
+	}
+	object, err := vector.ObjectBytes()
+	if err != nil {
+		return err
+	}
+
+	header, headerBytes, message, err := DecodeHeader(object)
+	if err != nil {
+		return err
+	}
+	if vector.Header == nil {
+		if headerBytes != nil {
+			return fmt.Errorf("legacy object was decoded with a header")
+		}
+	} else if header.Kind != vector.Header.Kind || header.KeyId != vector.Header.KeyId ||
+		len(header.Codecs) != len(vector.Header.Codecs) || header.ChunkSize != vector.Header.ChunkSize ||
+		header.Cipher != vector.Header.Cipher {
+		return fmt.Errorf("decoded header does not match the test vector")
+	}
+
+	key, err := vector.loadKey()
+	if err != nil {
+		return err
+	}
+	plaintext, err := decryptMessage(key, header, headerBytes, message)
+	if err != nil {
+		return err
+	}
+	defer plaintext.Destroy()
+
+	meta, data, err := OpenEnvelope(plaintext.Bytes())
+	if err != nil {
+		return err
+	}
+	if *meta != vector.Meta {
+		return fmt.Errorf("decrypted metadata does not match the test vector")
+	}
+	if !bytes.Equal(data, expectedData) {
+		return fmt.Errorf("decrypted data does not match the test vector")
+	}
+	return nil
+}
+
+// verifyTampered flips each byte of the object in turn, and checks that the result never decrypts.
+func (vector *TestVector) verifyTampered() error {
+	object, err := vector.ObjectBytes()
+	if err != nil {
+		return err
+	}
+
+	for i := range object {
+		object[i] ^= 0x01
+
+		if header, headerBytes, message, err := DecodeHeader(object); err == nil {
+			key, err := vector.loadKey()
+			if err != nil {
+				return err
+			}
+			if plaintext, err := decryptMessage(key, header, headerBytes, message); err == nil {
+				plaintext.Destroy()
+				return fmt.Errorf("object with byte %d modified was decrypted", i)
+			}
+		}
+
+		object[i] ^= 0x01
+	}
+	return nil
+}
+
+// decryptMessage decrypts a whole message in memory, whether or not it is chunked, and whatever its cipher.
+func decryptMessage(
+	key *memguard.LockedBuffer,
+	header *ObjectHeader,
+	headerBytes []byte,
+	message []byte,
+) (*memguard.LockedBuffer, error) {
+	if header.ChunkSize == 0 {
+		return Decrypt(key, headerBytes, message)
+	}
+
+	reader, err := NewObjectDecryptReader(key, header, headerBytes, bytes.NewReader(message))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	plaintext, err := ioutil.ReadAll(reader)
+	if err != nil {
+		memguard.WipeBytes(plaintext)
+		return nil, err
+	}
+	return memguard.NewBufferFromBytes(plaintext), nil
+}
@@ -0,0 +1,337 @@
+// The gRPC API of dead-drop, served alongside the HTTP API when grpc-addr is set. Calls are authenticated with a
+// token from the HTTP API's /token, sent as "authorization" metadata, and name the protocol version they speak as
+// "dead-drop-protocol" metadata, which Negotiate picks.
+//
+// Regenerate the Go stubs with `make proto` after changing this file.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v3.21.12
+// source: deaddrop.proto
+
+package rpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	DeadDrop_Negotiate_FullMethodName = "/deaddrop.v1.DeadDrop/Negotiate"
+	DeadDrop_Drop_FullMethodName      = "/deaddrop.v1.DeadDrop/Drop"
+	DeadDrop_Pull_FullMethodName      = "/deaddrop.v1.DeadDrop/Pull"
+	DeadDrop_Stat_FullMethodName      = "/deaddrop.v1.DeadDrop/Stat"
+	DeadDrop_Remove_FullMethodName    = "/deaddrop.v1.DeadDrop/Remove"
+)
+
+// DeadDropClient is the client API for DeadDrop service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type DeadDropClient interface {
+	// Negotiate returns the newest protocol version both the client and the server support. It is the only call
+	// which needs neither a token nor a protocol version.
+	Negotiate(ctx context.Context, in *NegotiateRequest, opts ...grpc.CallOption) (*NegotiateResponse, error)
+	// Drop stores an object streamed from the client: a first message with the policy, followed by messages of data.
+	Drop(ctx context.Context, opts ...grpc.CallOption) (DeadDrop_DropClient, error)
+	// Pull streams an object to the client, starting at offset to resume an interrupted pull.
+	Pull(ctx context.Context, in *PullRequest, opts ...grpc.CallOption) (DeadDrop_PullClient, error)
+	// Stat describes an object without pulling it.
+	Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error)
+	// Remove destroys an object dropped by the caller's key.
+	Remove(ctx context.Context, in *RemoveRequest, opts ...grpc.CallOption) (*RemoveResponse, error)
+}
+
+type deadDropClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDeadDropClient(cc grpc.ClientConnInterface) DeadDropClient {
+	return &deadDropClient{cc}
+}
+
+func (c *deadDropClient) Negotiate(ctx context.Context, in *NegotiateRequest, opts ...grpc.CallOption) (*NegotiateResponse, error) {
+	out := new(NegotiateResponse)
+	err := c.cc.Invoke(ctx, DeadDrop_Negotiate_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *deadDropClient) Drop(ctx context.Context, opts ...grpc.CallOption) (DeadDrop_DropClient, error) {
+	stream, err := c.cc.NewStream(ctx, &DeadDrop_ServiceDesc.Streams[0], DeadDrop_Drop_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &deadDropDropClient{stream}
+	return x, nil
+}
+
+type DeadDrop_DropClient interface {
+	Send(*DropRequest) error
+	CloseAndRecv() (*DropResponse, error)
+	grpc.ClientStream
+}
+
+type deadDropDropClient struct {
+	grpc.ClientStream
+}
+
+func (x *deadDropDropClient) Send(m *DropRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *deadDropDropClient) CloseAndRecv() (*DropResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(DropResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *deadDropClient) Pull(ctx context.Context, in *PullRequest, opts ...grpc.CallOption) (DeadDrop_PullClient, error) {
+	stream, err := c.cc.NewStream(ctx, &DeadDrop_ServiceDesc.Streams[1], DeadDrop_Pull_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &deadDropPullClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type DeadDrop_PullClient interface {
+	Recv() (*PullResponse, error)
+	grpc.ClientStream
+}
+
+type deadDropPullClient struct {
+	grpc.ClientStream
+}
+
+func (x *deadDropPullClient) Recv() (*PullResponse, error) {
+	m := new(PullResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *deadDropClient) Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error) {
+	out := new(StatResponse)
+	err := c.cc.Invoke(ctx, DeadDrop_Stat_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *deadDropClient) Remove(ctx context.Context, in *RemoveRequest, opts ...grpc.CallOption) (*RemoveResponse, error) {
+	out := new(RemoveResponse)
+	err := c.cc.Invoke(ctx, DeadDrop_Remove_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeadDropServer is the server API for DeadDrop service.
+// All implementations must embed UnimplementedDeadDropServer
+// for forward compatibility
+type DeadDropServer interface {
+	// Negotiate returns the newest protocol version both the client and the server support. It is the only call
+	// which needs neither a token nor a protocol version.
+	Negotiate(context.Context, *NegotiateRequest) (*NegotiateResponse, error)
+	// Drop stores an object streamed from the client: a first message with the policy, followed by messages of data.
+	Drop(DeadDrop_DropServer) error
+	// Pull streams an object to the client, starting at offset to resume an interrupted pull.
+	Pull(*PullRequest, DeadDrop_PullServer) error
+	// Stat describes an object without pulling it.
+	Stat(context.Context, *StatRequest) (*StatResponse, error)
+	// Remove destroys an object dropped by the caller's key.
+	Remove(context.Context, *RemoveRequest) (*RemoveResponse, error)
+	mustEmbedUnimplementedDeadDropServer()
+}
+
+// UnimplementedDeadDropServer must be embedded to have forward compatible implementations.
+type UnimplementedDeadDropServer struct {
+}
+
+func (UnimplementedDeadDropServer) Negotiate(context.Context, *NegotiateRequest) (*NegotiateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Negotiate not implemented")
+}
+func (UnimplementedDeadDropServer) Drop(DeadDrop_DropServer) error {
+	return status.Errorf(codes.Unimplemented, "method Drop not implemented")
+}
+func (UnimplementedDeadDropServer) Pull(*PullRequest, DeadDrop_PullServer) error {
+	return status.Errorf(codes.Unimplemented, "method Pull not implemented")
+}
+func (UnimplementedDeadDropServer) Stat(context.Context, *StatRequest) (*StatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stat not implemented")
+}
+func (UnimplementedDeadDropServer) Remove(context.Context, *RemoveRequest) (*RemoveResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Remove not implemented")
+}
+func (UnimplementedDeadDropServer) mustEmbedUnimplementedDeadDropServer() {}
+
+// UnsafeDeadDropServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DeadDropServer will
+// result in compilation errors.
+type UnsafeDeadDropServer interface {
+	mustEmbedUnimplementedDeadDropServer()
+}
+
+func RegisterDeadDropServer(s grpc.ServiceRegistrar, srv DeadDropServer) {
+	s.RegisterService(&DeadDrop_ServiceDesc, srv)
+}
+
+func _DeadDrop_Negotiate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(NegotiateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeadDropServer).Negotiate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DeadDrop_Negotiate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeadDropServer).Negotiate(ctx, req.(*NegotiateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DeadDrop_Drop_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(DeadDropServer).Drop(&deadDropDropServer{stream})
+}
+
+type DeadDrop_DropServer interface {
+	SendAndClose(*DropResponse) error
+	Recv() (*DropRequest, error)
+	grpc.ServerStream
+}
+
+type deadDropDropServer struct {
+	grpc.ServerStream
+}
+
+func (x *deadDropDropServer) SendAndClose(m *DropResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *deadDropDropServer) Recv() (*DropRequest, error) {
+	m := new(DropRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _DeadDrop_Pull_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(PullRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DeadDropServer).Pull(m, &deadDropPullServer{stream})
+}
+
+type DeadDrop_PullServer interface {
+	Send(*PullResponse) error
+	grpc.ServerStream
+}
+
+type deadDropPullServer struct {
+	grpc.ServerStream
+}
+
+func (x *deadDropPullServer) Send(m *PullResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _DeadDrop_Stat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeadDropServer).Stat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DeadDrop_Stat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeadDropServer).Stat(ctx, req.(*StatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DeadDrop_Remove_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeadDropServer).Remove(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DeadDrop_Remove_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeadDropServer).Remove(ctx, req.(*RemoveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// DeadDrop_ServiceDesc is the grpc.ServiceDesc for DeadDrop service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var DeadDrop_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "deaddrop.v1.DeadDrop",
+	HandlerType: (*DeadDropServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Negotiate",
+			Handler:    _DeadDrop_Negotiate_Handler,
+		},
+		{
+			MethodName: "Stat",
+			Handler:    _DeadDrop_Stat_Handler,
+		},
+		{
+			MethodName: "Remove",
+			Handler:    _DeadDrop_Remove_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Drop",
+			Handler:       _DeadDrop_Drop_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Pull",
+			Handler:       _DeadDrop_Pull_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "deaddrop.proto",
+}
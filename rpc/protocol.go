@@ -0,0 +1,11 @@
+// Package rpc holds the gRPC API of dead-drop, whose stubs are generated from deaddrop.proto.
+package rpc
+
+// ProtocolVersion is the newest version of the gRPC protocol, which clients name in the metadata of their calls.
+const ProtocolVersion = 1
+
+// ProtocolMetadataKey carries the protocol version a call speaks, as agreed with Negotiate.
+const ProtocolMetadataKey = "dead-drop-protocol"
+
+// AuthorizationMetadataKey carries the token a call is authenticated with, as the HTTP API's Authorization header does.
+const AuthorizationMetadataKey = "authorization"
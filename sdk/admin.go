@@ -0,0 +1,137 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"dead-drop/lib"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// The admin api operates the whole remote, across keys and namespaces, and takes an admin key of the default namespace.
+
+// AdminObjects fetches a page of the objects of every key on the remote which opts select, or of every object if opts
+// is nil, oldest first, starting after the cursor of an earlier page ("" for the first page). A limit of 0 uses the
+// remote's default page size. The Next field of the result is the cursor of the following page, or "" if this is the
+// last one.
+func (client *Client) AdminObjects(ctx context.Context, after string, limit int, opts *ListOptions) (
+	*lib.AdminObjectsPayload, error) {
+	query := opts.query(after, limit)
+
+	req, err := http.NewRequest("GET", client.url("/admin/objects?%s", query.Encode()), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := client.makeAuthenticatedRequest(ctx, adminScope, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	payload := &lib.AdminObjectsPayload{}
+	if err := json.NewDecoder(resp.Body).Decode(payload); err != nil {
+		return nil, fmt.Errorf("error decoding object listing: %v", err)
+	}
+	return payload, nil
+}
+
+// AdminRemove removes an object from the remote, whichever key dropped it.
+func (client *Client) AdminRemove(ctx context.Context, oid string) error {
+	req, err := http.NewRequest("DELETE", client.url("/admin/objects/%s", url.PathEscape(oid)), nil)
+	if err != nil {
+		return fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := client.makeAuthenticatedRequest(ctx, adminScope, req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// AdminUsage fetches the storage used on the remote, in total and by each key and namespace.
+func (client *Client) AdminUsage(ctx context.Context) (*lib.UsagePayload, error) {
+	req, err := http.NewRequest("GET", client.url("/admin/usage"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := client.makeAuthenticatedRequest(ctx, adminScope, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	payload := &lib.UsagePayload{}
+	if err := json.NewDecoder(resp.Body).Decode(payload); err != nil {
+		return nil, fmt.Errorf("error decoding usage: %v", err)
+	}
+	return payload, nil
+}
+
+// AdminGC has the remote remove its expired objects now, rather than on its next expiry run. Remotes refuse while
+// their clock guard pauses garbage collection.
+func (client *Client) AdminGC(ctx context.Context) (*lib.GCPayload, error) {
+	req, err := http.NewRequest("POST", client.url("/admin/gc"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := client.makeAuthenticatedRequest(ctx, adminScope, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	payload := &lib.GCPayload{}
+	if err := json.NewDecoder(resp.Body).Decode(payload); err != nil {
+		return nil, fmt.Errorf("error decoding gc result: %v", err)
+	}
+	return payload, nil
+}
+
+// AdminRotateSecret has the remote sign tokens with a new secret. Tokens signed with the old secret stay valid until
+// they expire, unless revoke is set, which rejects every token issued before, this client's included.
+func (client *Client) AdminRotateSecret(ctx context.Context, revoke bool) error {
+	body, err := json.Marshal(lib.RotateSecretPayload{Revoke: revoke})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", client.url("/admin/rotate-secret"), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := client.makeAuthenticatedRequest(ctx, adminScope, req)
+	if err != nil {
+		return err
+	}
+	if revoke {
+		client.tokens.reset()
+	}
+	return resp.Body.Close()
+}
+
+// AdminKeys lists the authorized keys of every namespace on the remote, with their roles.
+func (client *Client) AdminKeys(ctx context.Context) (*lib.KeysPayload, error) {
+	req, err := http.NewRequest("GET", client.url("/admin/keys"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := client.makeAuthenticatedRequest(ctx, adminScope, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	payload := &lib.KeysPayload{}
+	if err := json.NewDecoder(resp.Body).Decode(payload); err != nil {
+		return nil, fmt.Errorf("error decoding keys: %v", err)
+	}
+	return payload, nil
+}
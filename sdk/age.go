@@ -0,0 +1,120 @@
+package sdk
+
+import (
+	"context"
+	"dead-drop/lib"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// ageRecipients returns the recipients to encrypt age objects to: the X25519 recipients of RecipientKeys, or the
+// passphrase of PassphraseKeys. Age files have no key ids, so shared keys and keyrings can't be used.
+func (client *Client) ageRecipients() ([]lib.AgeRecipient, error) {
+	switch keys := client.keys.(type) {
+	case *RecipientKeys:
+		if len(keys.recipients) == 0 {
+			return nil, fmt.Errorf("no recipients configured")
+		}
+
+		recipients := make([]lib.AgeRecipient, 0, len(keys.recipients))
+		for _, recipient := range keys.recipients {
+			ageRecipient, ok := recipient.(lib.AgeRecipient)
+			if !ok {
+				return nil, fmt.Errorf("age objects can only be encrypted to X25519 recipients")
+			}
+			recipients = append(recipients, ageRecipient)
+		}
+		return recipients, nil
+	case *PassphraseKeys:
+		return []lib.AgeRecipient{lib.NewAgeScryptRecipient(keys.passphrase)}, nil
+	default:
+		return nil, fmt.Errorf("age objects can only be encrypted to recipients or with a passphrase")
+	}
+}
+
+// ageIdentities returns the identities to decrypt age objects with: the X25519 Identities of a KeySet, or the
+// passphrase of PassphraseKeys.
+func (client *Client) ageIdentities() ([]lib.AgeIdentity, error) {
+	var identities []lib.AgeIdentity
+	switch keys := client.keys.(type) {
+	case *KeySet:
+		for _, identity := range keys.Identities {
+			if ageIdentity, ok := identity.(lib.AgeIdentity); ok {
+				identities = append(identities, ageIdentity)
+			}
+		}
+	case *PassphraseKeys:
+		identities = append(identities, lib.NewAgeScryptIdentity(keys.passphrase))
+	}
+
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("object is an age file, pull it with an X25519 identity or its passphrase")
+	}
+	return identities, nil
+}
+
+// encryptAge writes the data read from r as an age file.
+func encryptAge(w io.Writer, recipients []lib.AgeRecipient, r io.Reader) error {
+	encryptWriter, err := lib.NewAgeEncryptWriter(recipients, w)
+	if err != nil {
+		return fmt.Errorf("error encrypting object: %v", err)
+	}
+	defer encryptWriter.Close()
+
+	if _, err := io.Copy(encryptWriter, r); err != nil {
+		return fmt.Errorf("error reading object: %v", err)
+	}
+	if err := encryptWriter.Close(); err != nil {
+		return fmt.Errorf("error encrypting object: %v", err)
+	}
+	return nil
+}
+
+// copyAge copies an age file read from r as it is, failing if it is not an age file.
+func copyAge(w io.Writer, r io.Reader) error {
+	prefix := make([]byte, len(lib.AgePrefix))
+	n, err := io.ReadFull(r, prefix)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return fmt.Errorf("error reading object: %v", err)
+	}
+	if !lib.IsAge(prefix[:n]) {
+		return fmt.Errorf("only age files can be dropped raw")
+	}
+
+	if _, err := w.Write(prefix); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("error reading object: %v", err)
+	}
+	return nil
+}
+
+// openAge decrypts an age object as it is read from object, which verifies its checksum.
+// The object is closed along with the returned reader, or on error.
+func (client *Client) openAge(object io.ReadCloser) (io.ReadCloser, *ObjectMetadata, error) {
+	identities, err := client.ageIdentities()
+	if err != nil {
+		object.Close()
+		return nil, nil, err
+	}
+
+	if _, ok := client.keys.(*PassphraseKeys); ok {
+		client.stage(StageDerivingKey, -1)
+	}
+	plaintext, err := lib.NewAgeDecryptReader(identities, object)
+	if err != nil {
+		object.Close()
+		return nil, nil, err
+	}
+
+	client.stage(StageDecrypting, -1)
+	return &pullReader{data: ioutil.NopCloser(plaintext), plaintext: plaintext, object: object}, &ObjectMetadata{}, nil
+}
+
+// PullRaw pulls an object from the remote without decrypting it, e.g. to decrypt an age object with the age tool.
+// As with PullStream, the object is only verified once the reader returns io.EOF.
+func (client *Client) PullRaw(ctx context.Context, or *ObjectReference) (io.ReadCloser, error) {
+	return client.openDownload(ctx, or)
+}
@@ -0,0 +1,88 @@
+package sdk
+
+import (
+	"context"
+	"dead-drop/lib"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Versions fetches the stored versions of the objects dropped under an alias (see DropOptions.Alias) in this client's
+// namespace, oldest first.
+func (client *Client) Versions(ctx context.Context, alias string) (*lib.AliasPayload, error) {
+	if err := lib.CheckAlias(alias); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", client.url("/alias/%s", url.PathEscape(alias)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := client.makeAuthenticatedRequest(ctx, pullScope(""), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	payload := &lib.AliasPayload{}
+	if err := json.NewDecoder(resp.Body).Decode(payload); err != nil {
+		return nil, fmt.Errorf("error decoding alias versions: %v", err)
+	}
+	return payload, nil
+}
+
+// Version has the remote resolve a version of an alias in this client's namespace to the object dropped as it, given
+// the version's number, or 0 for the latest version.
+func (client *Client) Version(ctx context.Context, alias string, number int) (*lib.AliasVersion, error) {
+	if err := lib.CheckAlias(alias); err != nil {
+		return nil, err
+	}
+	version := lib.LatestVersion
+	if number > 0 {
+		version = strconv.Itoa(number)
+	}
+
+	req, err := http.NewRequest("GET", client.url("/alias/%s/%s", url.PathEscape(alias), version), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := client.makeAuthenticatedRequest(ctx, pullScope(""), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	payload := &lib.AliasVersion{}
+	if err := json.NewDecoder(resp.Body).Decode(payload); err != nil {
+		return nil, fmt.Errorf("error decoding alias version: %v", err)
+	}
+	return payload, nil
+}
+
+// ResolveVersion returns the reference of a version of an alias given by its name, e.g. release@2, or of its latest
+// version for names without a version number, e.g. release, which the remote resolves when it is asked, so that
+// recipients can pull the latest version by a name which stays the same.
+//
+// The reference's checksum is the one the remote computes for the object, so unlike references returned by drops,
+// pulling it doesn't check that the remote holds the object which was dropped: only decrypting it does.
+func (client *Client) ResolveVersion(ctx context.Context, name string) (*ObjectReference, error) {
+	alias, number, err := lib.ParseVersionName(name)
+	if err != nil {
+		return nil, err
+	}
+	version, err := client.Version(ctx, alias, number)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := client.Checksum(ctx, version.Oid, ChecksumSHA256)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectReference{Oid: version.Oid, Checksum: payload.Checksum, Remote: client.remote}, nil
+}
@@ -0,0 +1,859 @@
+// Package sdk implements the dead-drop client operations, for use by the dead CLI and other Go programs
+// which embed dead-drop instead of shelling out to it.
+//
+// A Client is made by New from a remote and Options, e.g. WithAuthKey for the key which authenticates to the remote
+// and WithKeys for the keys which encrypt and decrypt objects:
+//
+//	client := sdk.New("https://localhost:4444",
+//		sdk.WithAuthKey("root", privateKey),
+//		sdk.WithKeys(&sdk.KeySet{Key: encryptionKey}),
+//	)
+//	ref, err := client.Drop(ctx, data, &sdk.DropOptions{Name: "report.pdf"})
+//
+// Every operation which makes requests takes a context, which cancels them. The package never prints or exits: all
+// failures are returned as errors, progress is reported to the callback of WithProgress and diagnostic messages to
+// the Logger of WithLogger, and both are discarded by default.
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"dead-drop/lib"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var keyNameRegex = regexp.MustCompile(lib.KeyNameRegex)
+
+// Client performs authenticated operations against a single remote.
+type Client struct {
+	remote     string
+	keyName    string
+	authKey    crypto.Decrypter
+	authSigner TokenSigner
+	keys       Keys
+	httpClient *http.Client
+	progress   func(ProgressEvent)
+	logger     Logger
+	retry      RetryPolicy
+	tokens     tokenCache
+	// tokenLock is held while requesting a token, so that concurrent requests of a scope share the token.
+	tokenLock sync.Mutex
+	// tokenTTL is how long the tokens requested are valid, see WithTokenTTL.
+	tokenTTL time.Duration
+	// namespace is the namespace requests are addressed to, see WithNamespace.
+	namespace string
+	// connections is the number of ranges large objects are downloaded in at once, see WithParallelDownloads.
+	connections int
+}
+
+type Option func(*Client)
+
+// WithAuthKey sets the authorized key used to authenticate with the remote. The private key must be able to
+// decrypt RSA-OAEP ciphertexts, e.g. an *rsa.PrivateKey.
+func WithAuthKey(keyName string, key crypto.Decrypter) Option {
+	return func(client *Client) {
+		client.keyName = keyName
+		client.authKey = key
+	}
+}
+
+// WithSigningAuthKey sets the authorized key used to authenticate with the remote to a key which signs token requests
+// instead of decrypting tokens, either an Ed25519 key (e.g. an ed25519.PrivateKey) or an *rsa.PrivateKey.
+func WithSigningAuthKey(keyName string, key crypto.Signer) Option {
+	return WithTokenSigner(keyName, &cryptoTokenSigner{key: key})
+}
+
+// TokenSigner signs token requests, for authentication keys which can only sign, e.g. keys held in an ssh-agent.
+type TokenSigner interface {
+	// SignTokenRequest signs data with Ed25519, or with RSA PKCS #1 v1.5 and SHA-512, as lib.TokenRequestPayload says.
+	SignTokenRequest(data []byte) ([]byte, error)
+}
+
+// WithTokenSigner sets the authorized key used to authenticate with the remote to a key which signs token requests.
+func WithTokenSigner(keyName string, signer TokenSigner) Option {
+	return func(client *Client) {
+		client.keyName = keyName
+		client.authSigner = signer
+	}
+}
+
+type cryptoTokenSigner struct {
+	key crypto.Signer
+}
+
+func (signer *cryptoTokenSigner) SignTokenRequest(data []byte) ([]byte, error) {
+	if _, ok := signer.key.Public().(*rsa.PublicKey); ok {
+		digest := sha512.Sum512(data)
+		return signer.key.Sign(rand.Reader, digest[:], crypto.SHA512)
+	}
+	return signer.key.Sign(rand.Reader, data, crypto.Hash(0))
+}
+
+// WithKeys sets the keys used to encrypt and decrypt objects.
+func WithKeys(keys Keys) Option {
+	return func(client *Client) {
+		client.keys = keys
+	}
+}
+
+// WithHTTPClient sets the http client used for all requests, e.g. to configure tls. Its transport should keep
+// connections alive, like the ones created by NewTransport.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(client *Client) {
+		client.httpClient = httpClient
+	}
+}
+
+// WithTokenTTL requests tokens valid for at most ttl, rounded up to a second, rather than the remote's token ttl.
+func WithTokenTTL(ttl time.Duration) Option {
+	return func(client *Client) {
+		client.tokenTTL = ttl
+	}
+}
+
+// WithNamespace addresses requests to a namespace of the remote, under /ns/<namespace>. The remote scopes requests to
+// the namespace of the authenticating key either way, and refuses those addressed to another namespace.
+func WithNamespace(namespace string) Option {
+	return func(client *Client) {
+		client.namespace = namespace
+	}
+}
+
+// New creates a client for the remote at the given base url (e.g. https://localhost:4444).
+func New(remote string, opts ...Option) *Client {
+	client := &Client{
+		remote:     remote,
+		httpClient: &http.Client{Transport: defaultTransport},
+		retry:      DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(client)
+	}
+	return client
+}
+
+func (client *Client) url(format string, args ...interface{}) string {
+	path := fmt.Sprintf(format, args...)
+	// Tokens are issued, anonymous drops made and the server administered outside of namespaces.
+	if client.namespace != "" && !strings.HasPrefix(path, "/token") && !strings.HasPrefix(path, "/anonymous") &&
+		!strings.HasPrefix(path, "/admin") {
+		return client.remote + "/ns/" + url.PathEscape(client.namespace) + path
+	}
+	return client.remote + path
+}
+
+// makeAuthenticatedRequest makes a request with a token of the given scope, returning an error unless it succeeds.
+func (client *Client) makeAuthenticatedRequest(
+	ctx context.Context,
+	scope tokenScope,
+	req *http.Request,
+) (*http.Response, error) {
+	resp, err := client.makeAuthenticatedRequestInternal(ctx, scope, req)
+	return checkResponse(resp, err)
+}
+
+// makeAnonymousRequest makes a request without authenticating, e.g. an anonymous drop, returning an error unless it
+// succeeds.
+func (client *Client) makeAnonymousRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
+	req = req.WithContext(ctx)
+	resp, err := client.withRetries(ctx, req, func() (*http.Response, error) {
+		return client.httpClient.Do(req)
+	})
+	return checkResponse(resp, err)
+}
+
+// checkResponse returns an error for a failed request, or one the remote answered with a status other than 200.
+func checkResponse(resp *http.Response, err error) (*http.Response, error) {
+	if err != nil {
+		return resp, fmt.Errorf("request failed: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorMessage))
+		resp.Body.Close()
+		return resp, &responseError{
+			status:  resp.Status,
+			code:    resp.StatusCode,
+			message: strings.TrimSpace(string(message)),
+		}
+	}
+
+	return resp, nil
+}
+
+// Responses to failed requests are included in their errors up to this length, since some explain the failure, e.g.
+// drops refused for being over quota.
+const maxErrorMessage = 512
+
+// responseError is the error of a request which the remote answered with a status other than 200.
+type responseError struct {
+	status  string
+	code    int
+	message string
+}
+
+func (err *responseError) Error() string {
+	if err.message == "" {
+		return fmt.Sprintf("request failed with status: %s", err.status)
+	}
+	return fmt.Sprintf("request failed with status: %s: %s", err.status, err.message)
+}
+
+// refused returns whether err is the remote refusing a request with a client error, which would be refused again if
+// it were repeated.
+func refused(err error) bool {
+	respErr, ok := err.(*responseError)
+	return ok && respErr.code >= 400 && respErr.code < 500 && respErr.code != http.StatusConflict
+}
+
+func (client *Client) makeAuthenticatedRequestInternal(
+	ctx context.Context,
+	scope tokenScope,
+	req *http.Request,
+) (*http.Response, error) {
+	if client.authKey == nil && client.authSigner == nil {
+		return nil, fmt.Errorf("no authentication key configured")
+	}
+	if !keyNameRegex.MatchString(client.keyName) {
+		return nil, fmt.Errorf("invalid key name")
+	}
+
+	req = req.WithContext(ctx)
+	return client.withRetries(ctx, req, func() (*http.Response, error) {
+		return client.makeAuthenticatedAttempt(ctx, scope, req)
+	})
+}
+
+// makeAuthenticatedAttempt authenticates with a token of the given scope and makes a request.
+func (client *Client) makeAuthenticatedAttempt(
+	ctx context.Context,
+	scope tokenScope,
+	req *http.Request,
+) (*http.Response, error) {
+	token, err := client.token(ctx, scope)
+	if err != nil {
+		return nil, &authError{err: err}
+	}
+
+	req.Header.Set("Authorization", token)
+
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		// The remote keeps validating tokens until they expire, so a rejected token was revoked, or issued before the
+		// remote restarted, and the next request needs a new one.
+		client.tokens.clear(scope, token)
+	}
+	return resp, nil
+}
+
+// token returns a token of a scope to authenticate a request with, which is the cached one if it hasn't expired.
+func (client *Client) token(ctx context.Context, scope tokenScope) (string, error) {
+	client.tokenLock.Lock()
+	defer client.tokenLock.Unlock()
+
+	if token := client.tokens.get(scope); token != "" {
+		return token, nil
+	}
+
+	client.logf("requesting %s token for key %s", scope.scope, client.keyName)
+	requested := time.Now()
+	token, err := client.authenticate(ctx, scope)
+	if err != nil {
+		return "", err
+	}
+	client.tokens.put(scope, token, requested)
+	return token, nil
+}
+
+func (client *Client) authenticate(ctx context.Context, scope tokenScope) (string, error) {
+	nonce, err := client.tokenChallenge(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	payload := lib.TokenRequestPayload{
+		KeyName: client.keyName,
+		Nonce:   nonce,
+		Scope:   scope.scope,
+		Oid:     scope.oid,
+	}
+	if client.tokenTTL > 0 {
+		payload.TTL = int64((client.tokenTTL + time.Second - 1) / time.Second)
+	}
+	if client.authSigner != nil {
+		signature, err := client.authSigner.SignTokenRequest(lib.TokenChallengeData(&payload))
+		if err != nil {
+			return "", fmt.Errorf("failed to sign token request: %v", err)
+		}
+		payload.Signature = signature
+	}
+
+	resp, err := client.postTokenRequest(ctx, "/token", payload)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	ciphertext, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if client.authSigner != nil {
+		return string(ciphertext), nil
+	}
+
+	token, err := client.authKey.Decrypt(rand.Reader, ciphertext, &rsa.OAEPOptions{
+		Hash:  crypto.SHA512,
+		Label: []byte(lib.TokenCipherLabel),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt authorization token: %v", err)
+	}
+	defer memguard.WipeBytes(token)
+
+	return string(token), nil
+}
+
+// tokenChallenge asks the remote for a challenge to answer in a token request, which it can only be used for once.
+func (client *Client) tokenChallenge(ctx context.Context) (string, error) {
+	resp, err := client.postTokenRequest(ctx, "/token/challenge", lib.TokenChallengePayload{KeyName: client.keyName})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	payload := lib.TokenChallengePayload{}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return "", fmt.Errorf("error decoding token challenge: %v", err)
+	}
+	if payload.Nonce == "" {
+		return "", fmt.Errorf("remote sent an empty token challenge")
+	}
+	return payload.Nonce, nil
+}
+
+// postTokenRequest posts a request of the token flow, which is made before there is a token to authenticate it with,
+// returning an error unless it succeeds.
+func (client *Client) postTokenRequest(ctx context.Context, path string, payload interface{}) (*http.Response, error) {
+	body := new(bytes.Buffer)
+	if err := json.NewEncoder(body).Encode(payload); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", client.url("%s", path), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, &statusError{
+			status:     resp.Status,
+			code:       resp.StatusCode,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+	return resp, nil
+}
+
+// AddKey authorizes a public key on the remote under the given key name, with the remote's default role.
+func (client *Client) AddKey(ctx context.Context, pubKey []byte, keyName string) error {
+	return client.AddKeyWithRole(ctx, pubKey, keyName, "")
+}
+
+// AddKeyWithRole authorizes a public key on the remote under the given key name, with one of the lib.KeyRole roles,
+// or the remote's default role if role is empty. Adding keys takes an admin key.
+func (client *Client) AddKeyWithRole(ctx context.Context, pubKey []byte, keyName string, role string) error {
+	return client.AddKeyWithOptions(ctx, pubKey, keyName, &AddKeyOptions{Role: role})
+}
+
+// AddKeyOptions are the attributes of an added key.
+type AddKeyOptions struct {
+	// Role is one of the lib.KeyRole roles, or empty for the remote's default role.
+	Role string
+	// Namespace is the namespace to add the key to, or empty for the default namespace. Keys of other namespaces can
+	// only add keys to their own, which keys they add are in whether or not it is given.
+	Namespace string
+}
+
+// AddKeyWithOptions authorizes a public key on the remote under the given key name, with the given attributes.
+// Adding keys takes an admin key.
+func (client *Client) AddKeyWithOptions(ctx context.Context, pubKey []byte, keyName string, opts *AddKeyOptions) error {
+	if opts == nil {
+		opts = &AddKeyOptions{}
+	}
+	payload := lib.AddKeyPayload{
+		Key:       pubKey,
+		KeyName:   keyName,
+		Role:      opts.Role,
+		Namespace: opts.Namespace,
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", client.url("/add-key"), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := client.makeAuthenticatedRequest(ctx, adminScope, req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// RemoveKey removes an authorized key from the remote, which revokes the tokens issued to it, so that it can't
+// authenticate any more. The remote refuses to remove its last authorized key.
+func (client *Client) RemoveKey(ctx context.Context, keyName string) error {
+	body, err := json.Marshal(lib.RemoveKeyPayload{KeyName: keyName})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", client.url("/remove-key"), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := client.makeAuthenticatedRequest(ctx, adminScope, req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// ShareKeyringKey drops a keyring key wrapped to a counterparty's public key, and signed with the authentication key,
+// so that they can install it with PullKeyringKey once they have checked the signature. It is dropped under the alias
+// KeyringShareAlias returns for the two keys, where SharedKeyringKeys finds it. If id is empty, the current key is
+// shared.
+func (client *Client) ShareKeyringKey(
+	ctx context.Context,
+	keyring *Keyring,
+	id string,
+	recipient *rsa.PublicKey,
+) (*ObjectReference, error) {
+	signer, err := client.keyringSigner()
+	if err != nil {
+		return nil, err
+	}
+	alias, err := KeyringShareAlias(signer.Public(), recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	var entry *KeyringEntry
+	if id == "" {
+		entry, err = keyring.Current()
+	} else {
+		entry, err = keyring.Lookup(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	line := entry.line()
+	defer line.Destroy()
+
+	ciphertext, err := rsa.EncryptOAEP(sha512.New(), rand.Reader, recipient, line.Bytes(), []byte(keyringCipherLabel))
+	if err != nil {
+		return nil, fmt.Errorf("error wrapping key: %v", err)
+	}
+
+	message, err := sealKeyringKey(signer, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := lib.EncodeHeader(&lib.ObjectHeader{Kind: keyringKeyKind})
+	if err != nil {
+		return nil, fmt.Errorf("error building object header: %v", err)
+	}
+
+	object := append(header, message...)
+	return client.upload(ctx, bytesSource(object), int64(len(object)), &DropOptions{Alias: alias})
+}
+
+// keyringSigner returns the authentication key as a signer of shared keyring keys, whose public key counterparties
+// check their signature with.
+func (client *Client) keyringSigner() (crypto.Signer, error) {
+	if signer, ok := client.authSigner.(*cryptoTokenSigner); ok {
+		return signer.key, nil
+	}
+	if signer, ok := client.authKey.(crypto.Signer); ok {
+		return signer, nil
+	}
+	return nil, fmt.Errorf("keyring keys can only be shared by an RSA or Ed25519 authentication key which can sign")
+}
+
+// SharedKeyringKeys returns the references of the keys which the holder of the sharer key has shared with this
+// client's authentication key, and which are still stored, for PullKeyringKey.
+func (client *Client) SharedKeyringKeys(ctx context.Context, sharer crypto.PublicKey) ([]*ObjectReference, error) {
+	if client.authKey == nil {
+		return nil, fmt.Errorf("shared keyring keys can only be pulled with an RSA authentication key")
+	}
+	alias, err := KeyringShareAlias(sharer, client.authKey.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := client.Versions(ctx, alias)
+	if respErr, ok := err.(*responseError); ok && respErr.code == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Like ResolveVersion, this trusts the checksums the remote computes, since PullKeyringKey checks the signature.
+	refs := make([]*ObjectReference, 0, len(versions.Versions))
+	for _, version := range versions.Versions {
+		payload, err := client.Checksum(ctx, version.Oid, ChecksumSHA256)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, &ObjectReference{Oid: version.Oid, Checksum: payload.Checksum, Remote: client.remote})
+	}
+	return refs, nil
+}
+
+// PullKeyringKey pulls a key shared with ShareKeyringKey, checks that it is signed by one of the sharers' keys, and
+// unwraps it with the authentication key. The returned keyring line can be installed with InstallKeyringLine.
+func (client *Client) PullKeyringKey(
+	ctx context.Context,
+	or *ObjectReference,
+	sharers ...crypto.PublicKey,
+) (*memguard.LockedBuffer, error) {
+	if client.authKey == nil {
+		return nil, fmt.Errorf("shared keyring keys can only be pulled with an RSA authentication key")
+	}
+	if len(sharers) == 0 {
+		return nil, fmt.Errorf("no counterparty keys to check shared keyring keys with")
+	}
+
+	data, err := client.download(ctx, or)
+	if err != nil {
+		return nil, err
+	}
+
+	header, _, message, err := lib.DecodeHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if header.Kind != keyringKeyKind {
+		return nil, fmt.Errorf("object is not a signed shared keyring key")
+	}
+
+	ciphertext, err := openKeyringKey(message, sharers)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := client.authKey.Decrypt(rand.Reader, ciphertext, &rsa.OAEPOptions{
+		Hash:  crypto.SHA512,
+		Label: []byte(keyringCipherLabel),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping key: %v", err)
+	}
+	defer memguard.WipeBytes(plaintext)
+
+	return memguard.NewBufferFromBytes(plaintext), nil
+}
+
+// Stat describes an object without downloading it, or counting as a pull. The number of pulls is only included for
+// objects dropped with this client's authentication key, if the remote keeps access logs.
+func (client *Client) Stat(ctx context.Context, oid string) (*lib.ObjectStatPayload, error) {
+	req, err := http.NewRequest("GET", client.url("/d/%s/stat", oid), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := client.makeAuthenticatedRequest(ctx, pullScope(oid), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	payload := &lib.ObjectStatPayload{}
+	if err := json.NewDecoder(resp.Body).Decode(payload); err != nil {
+		return nil, fmt.Errorf("error decoding object stat: %v", err)
+	}
+	return payload, nil
+}
+
+// Checksum has the remote compute the checksum of a stored object with an algorithm, e.g. ChecksumSHA256, without
+// downloading it or counting as a pull.
+func (client *Client) Checksum(ctx context.Context, oid string, algorithm string) (*lib.ObjectChecksumPayload, error) {
+	query := url.Values{}
+	query.Set("algorithm", algorithm)
+	req, err := http.NewRequest("GET", client.url("/d/%s/checksum?%s", oid, query.Encode()), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := client.makeAuthenticatedRequest(ctx, pullScope(oid), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	payload := &lib.ObjectChecksumPayload{}
+	if err := json.NewDecoder(resp.Body).Decode(payload); err != nil {
+		return nil, fmt.Errorf("error decoding object checksum: %v", err)
+	}
+	return payload, nil
+}
+
+// Verify checks that the remote still holds the object a reference was dropped as, by having it compute the checksum
+// of the object, which is compared with the reference's. Unlike pulling the object, this doesn't check that it
+// decrypts.
+func (client *Client) Verify(ctx context.Context, or *ObjectReference) (*lib.ObjectChecksumPayload, error) {
+	payload, err := client.Checksum(ctx, or.Oid, or.algorithm())
+	if err != nil {
+		return nil, err
+	}
+	sum, err := base64.URLEncoding.DecodeString(payload.Checksum)
+	if payload.Algorithm != or.algorithm() || err != nil || !or.matches(sum) {
+		return payload, fmt.Errorf("object integrity compromised, the remote's copy does not match the reference")
+	}
+	return payload, nil
+}
+
+// Resolve returns the full reference of an object given by a phrase, with the checksum the remote computes for it,
+// once it is checked against the phrase's. Other references are returned as they are.
+func (client *Client) Resolve(ctx context.Context, or *ObjectReference) (*ObjectReference, error) {
+	if !or.Partial {
+		return or, nil
+	}
+
+	payload, err := client.Verify(ctx, or)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectReference{
+		Oid:       or.Oid,
+		Checksum:  payload.Checksum,
+		Algorithm: or.Algorithm,
+		Remote:    client.remote,
+	}, nil
+}
+
+// Remove destroys an object dropped with this client's authentication key. Objects dropped with other keys are
+// reported as not found.
+func (client *Client) Remove(ctx context.Context, oid string) error {
+	req, err := http.NewRequest("DELETE", client.url("/d/%s", oid), nil)
+	if err != nil {
+		return fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := client.makeAuthenticatedRequest(ctx, dropScope(oid), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// AccessLog fetches the pulls of an object dropped with this client's authentication key. Requester key names are
+// only included if the remote records them. Access logs outlive destroyed objects for a retention period set by the remote.
+func (client *Client) AccessLog(ctx context.Context, oid string) (*lib.AccessLogPayload, error) {
+	req, err := http.NewRequest("GET", client.url("/d/%s/access-log", oid), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := client.makeAuthenticatedRequest(ctx, dropScope(oid), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	payload := &lib.AccessLogPayload{}
+	if err := json.NewDecoder(resp.Body).Decode(payload); err != nil {
+		return nil, fmt.Errorf("error decoding access log: %v", err)
+	}
+	return payload, nil
+}
+
+// Share has the remote create a url which pulls an object dropped with this client's authentication key without
+// authenticating, valid for ttl (at most until the object expires) and maxUses requests, or any number if it is 0.
+// The url only fetches the encrypted object, e.g. with curl or a browser; its reference is still needed to decrypt it.
+func (client *Client) Share(ctx context.Context, oid string, ttl time.Duration, maxUses int) (*lib.SharePayload, error) {
+	body, err := json.Marshal(lib.ShareRequestPayload{
+		TTL:     int64((ttl + time.Second - 1) / time.Second),
+		MaxUses: maxUses,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", client.url("/d/%s/share", oid), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.makeAuthenticatedRequest(ctx, dropScope(oid), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	payload := &lib.SharePayload{}
+	if err := json.NewDecoder(resp.Body).Decode(payload); err != nil {
+		return nil, fmt.Errorf("error decoding shared url: %v", err)
+	}
+	return payload, nil
+}
+
+// ShareURL returns the full url of a shared object on this client's remote.
+func (client *Client) ShareURL(share *lib.SharePayload) string {
+	return client.remote + share.Path
+}
+
+// Quota fetches how many bytes of objects are stored with this client's authentication key, and its quota, which is 0
+// if it has none. Drops which would take the key over its quota are refused.
+func (client *Client) Quota(ctx context.Context) (*lib.QuotaPayload, error) {
+	req, err := http.NewRequest("GET", client.url("/quota"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := client.makeAuthenticatedRequest(ctx, dropScope(""), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	payload := &lib.QuotaPayload{}
+	if err := json.NewDecoder(resp.Body).Decode(payload); err != nil {
+		return nil, fmt.Errorf("error decoding quota: %v", err)
+	}
+	return payload, nil
+}
+
+// Checkin tells the remote this client's authentication key is still around, which holds the objects dropped with it
+// for other keys (see DropOptions.ReleaseTo) for another check-in interval.
+func (client *Client) Checkin(ctx context.Context) (*lib.CheckinPayload, error) {
+	req, err := http.NewRequest("POST", client.url("/checkin"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := client.makeAuthenticatedRequest(ctx, dropScope(""), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	payload := &lib.CheckinPayload{}
+	if err := json.NewDecoder(resp.Body).Decode(payload); err != nil {
+		return nil, fmt.Errorf("error decoding check-in: %v", err)
+	}
+	return payload, nil
+}
+
+// List fetches a page of the objects dropped with this client's authentication key, oldest first, starting after the
+// cursor of an earlier page ("" for the first page). A limit of 0 uses the remote's default page size.
+// The Next field of the result is the cursor of the following page, or "" if this is the last one.
+func (client *Client) List(ctx context.Context, after string, limit int) (*lib.ListObjectsPayload, error) {
+	return client.ListWithOptions(ctx, after, limit, nil)
+}
+
+// ListOptions filter listings of objects. Zero fields select every object.
+type ListOptions struct {
+	// Since and Until select the objects dropped from Since, and before Until.
+	Since time.Time
+	Until time.Time
+	// MinSize and MaxSize select objects by their size in bytes. A MaxSize of 0 doesn't limit the size.
+	MinSize int64
+	MaxSize int64
+	// Owner selects the objects dropped with a key, in admin listings.
+	Owner string
+	// Labels select the objects dropped with every one of these labels.
+	Labels map[string]string
+}
+
+// query encodes the options, with the cursor and limit of a page, as the query of a listing request.
+func (opts *ListOptions) query(after string, limit int) url.Values {
+	query := url.Values{}
+	if after != "" {
+		query.Set("after", after)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if opts == nil {
+		return query
+	}
+
+	if !opts.Since.IsZero() {
+		query.Set("since", opts.Since.UTC().Format(time.RFC3339Nano))
+	}
+	if !opts.Until.IsZero() {
+		query.Set("until", opts.Until.UTC().Format(time.RFC3339Nano))
+	}
+	if opts.MinSize > 0 {
+		query.Set("min-size", strconv.FormatInt(opts.MinSize, 10))
+	}
+	if opts.MaxSize > 0 {
+		query.Set("max-size", strconv.FormatInt(opts.MaxSize, 10))
+	}
+	if opts.Owner != "" {
+		query.Set("owner", opts.Owner)
+	}
+	for key, value := range opts.Labels {
+		query.Add("label", key+"="+value)
+	}
+	return query
+}
+
+// ListWithOptions is List, listing only the objects which opts select, or every object if opts is nil.
+func (client *Client) ListWithOptions(ctx context.Context, after string, limit int, opts *ListOptions) (
+	*lib.ListObjectsPayload, error) {
+	query := opts.query(after, limit)
+
+	req, err := http.NewRequest("GET", client.url("/d?%s", query.Encode()), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := client.makeAuthenticatedRequest(ctx, dropScope(""), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	payload := &lib.ListObjectsPayload{}
+	if err := json.NewDecoder(resp.Body).Decode(payload); err != nil {
+		return nil, fmt.Errorf("error decoding object listing: %v", err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,381 @@
+package sdk
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"dead-drop/lib"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/ed25519"
+	"os"
+	"regexp"
+	"time"
+)
+
+// Keyring files hold one key per line, as "<key id> <expiry> <base64 key>", where expiry is an RFC 3339
+// timestamp or "-" for keys that never expire. Blank lines and lines starting with '#' are ignored.
+// Drops use the last unexpired key in the file, while pulls may use any key, so that objects dropped
+// before a rotation can still be pulled.
+// Keys installed from a counterparty's share end with a fourth field, "shared", and are only used for pulls,
+// until the marker is removed from their line.
+const keyringNoExpiry = "-"
+const keyringKeySize = 32
+const keyringSharedMarker = "shared"
+
+// Keys are shared between counterparties as objects of this kind, holding a keyring line encrypted
+// with RSA-OAEP to the recipient's public key, and signed by the sharer's authentication key: the
+// message is the signature's length as 2 big-endian bytes, the signature, and the ciphertext.
+const keyringKeyKind = "signed-keyring-key"
+const keyringCipherLabel = "keyring"
+const keyringSignatureLabel = "dead-drop shared keyring key\x00"
+
+// Shared keys are dropped under an alias naming the sharer's and recipient's keys by their fingerprint,
+// so that the recipient finds them without being handed their references.
+const keyringShareAliasPrefix = "keyring."
+
+var keyIdRegex = regexp.MustCompile(lib.KeyNameRegex)
+
+type KeyringEntry struct {
+	id         string
+	expires    time.Time
+	encodedKey []byte
+	shared     bool
+}
+
+func (entry *KeyringEntry) Id() string {
+	return entry.id
+}
+
+// Expires returns the time after which the key is no longer used for drops, or the zero time if it never expires.
+func (entry *KeyringEntry) Expires() time.Time {
+	return entry.expires
+}
+
+func (entry *KeyringEntry) IsExpired() bool {
+	return !entry.expires.IsZero() && entry.expires.Before(time.Now())
+}
+
+// IsShared returns whether the key was installed from a counterparty's share, and is only used for pulls.
+func (entry *KeyringEntry) IsShared() bool {
+	return entry.shared
+}
+
+func (entry *KeyringEntry) expiresString() string {
+	if entry.expires.IsZero() {
+		return keyringNoExpiry
+	}
+	return entry.expires.UTC().Format(time.RFC3339)
+}
+
+// Key decodes the entry's key into a new buffer, which is owned (and destroyed) by the caller.
+func (entry *KeyringEntry) Key() (*memguard.LockedBuffer, error) {
+	decoded := memguard.NewBuffer(base64.StdEncoding.DecodedLen(len(entry.encodedKey)))
+	defer decoded.Destroy()
+
+	decoded.Melt()
+	n, err := base64.StdEncoding.Decode(decoded.Bytes(), entry.encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("malformed key '%s': %v", entry.id, err)
+	}
+
+	return memguard.NewBufferFromBytes(decoded.Bytes()[:n]), nil
+}
+
+// line encodes the entry as a keyring line (without a trailing newline), in a buffer owned by the caller.
+func (entry *KeyringEntry) line() *memguard.LockedBuffer {
+	prefix := fmt.Sprintf("%s %s ", entry.id, entry.expiresString())
+
+	line := memguard.NewBuffer(len(prefix) + len(entry.encodedKey))
+	line.Melt()
+	copy(line.Bytes(), prefix)
+	copy(line.Bytes()[len(prefix):], entry.encodedKey)
+	line.Freeze()
+
+	return line
+}
+
+// Keyring is a parsed keyring file, held in guarded memory until it is destroyed.
+type Keyring struct {
+	buf     *memguard.LockedBuffer
+	entries []*KeyringEntry
+}
+
+func LoadKeyring(path string) (*Keyring, error) {
+	reader, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keyring '%s': %v", path, err)
+	}
+	defer reader.Close()
+
+	keyring := &Keyring{
+		buf: memguard.NewBufferFromEntireReader(reader),
+	}
+
+	ids := make(map[string]bool)
+	for i, line := range bytes.Split(keyring.buf.Bytes(), []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		entry, err := parseKeyringLine(line)
+		if err != nil {
+			keyring.Destroy()
+			return nil, fmt.Errorf("malformed keyring '%s' on line %d: %v", path, i+1, err)
+		}
+		if ids[entry.id] {
+			keyring.Destroy()
+			return nil, fmt.Errorf("malformed keyring '%s' on line %d: duplicate key id '%s'", path, i+1, entry.id)
+		}
+		ids[entry.id] = true
+
+		keyring.entries = append(keyring.entries, entry)
+	}
+
+	return keyring, nil
+}
+
+// loadKeyringIfExists loads the keyring at path, or returns an empty keyring if there is no such file yet.
+func loadKeyringIfExists(path string) (*Keyring, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return &Keyring{buf: memguard.NewBuffer(1)}, nil
+	}
+	return LoadKeyring(path)
+}
+
+func parseKeyringLine(line []byte) (*KeyringEntry, error) {
+	fields := bytes.Fields(line)
+	if len(fields) != 3 && len(fields) != 4 {
+		return nil, fmt.Errorf("expected 3 or 4 fields, found %d", len(fields))
+	}
+
+	entry := &KeyringEntry{
+		id:         string(fields[0]),
+		encodedKey: fields[2],
+		shared:     len(fields) == 4,
+	}
+
+	if entry.shared && string(fields[3]) != keyringSharedMarker {
+		return nil, fmt.Errorf("unknown marker '%s'", fields[3])
+	}
+
+	if !keyIdRegex.Match(fields[0]) {
+		return nil, fmt.Errorf("invalid key id")
+	}
+
+	if string(fields[1]) != keyringNoExpiry {
+		expires, err := time.Parse(time.RFC3339, string(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry: %v", err)
+		}
+		entry.expires = expires
+	}
+
+	return entry, nil
+}
+
+// Entries returns the keyring entries in file order.
+func (keyring *Keyring) Entries() []*KeyringEntry {
+	return keyring.entries
+}
+
+// Current returns the key that new drops should be encrypted with, which is never a shared key.
+func (keyring *Keyring) Current() (*KeyringEntry, error) {
+	for i := len(keyring.entries) - 1; i >= 0; i-- {
+		if !keyring.entries[i].IsExpired() && !keyring.entries[i].shared {
+			return keyring.entries[i], nil
+		}
+	}
+	return nil, fmt.Errorf("keyring has no unexpired keys")
+}
+
+func (keyring *Keyring) Lookup(id string) (*KeyringEntry, error) {
+	for _, entry := range keyring.entries {
+		if entry.id == id {
+			return entry, nil
+		}
+	}
+	return nil, fmt.Errorf("key '%s' not found in keyring", id)
+}
+
+func (keyring *Keyring) Destroy() {
+	keyring.buf.Destroy()
+}
+
+// AddKeyringKey appends a new random key to the keyring at path, creating the keyring if it doesn't exist.
+// A ttl of zero means the key never expires.
+func AddKeyringKey(path string, id string, ttl time.Duration) error {
+	if !keyIdRegex.MatchString(id) {
+		return fmt.Errorf("invalid key id '%s'", id)
+	}
+
+	keyring, err := loadKeyringIfExists(path)
+	if err != nil {
+		return err
+	}
+	_, err = keyring.Lookup(id)
+	keyring.Destroy()
+	if err == nil {
+		return fmt.Errorf("key '%s' already exists in keyring", id)
+	}
+
+	expires := keyringNoExpiry
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).UTC().Format(time.RFC3339)
+	}
+
+	key := memguard.NewBufferRandom(keyringKeySize)
+	defer key.Destroy()
+
+	return appendKeyringLine(path, id, expires, key, false)
+}
+
+// InstallKeyringLine adds a keyring line shared by a counterparty to the keyring at path, marked as shared so
+// that it is only used for pulls, destroying the line buffer. It returns the id of the key, and whether it
+// was newly installed.
+func InstallKeyringLine(path string, line *memguard.LockedBuffer) (string, bool, error) {
+	defer line.Destroy()
+
+	entry, err := parseKeyringLine(bytes.TrimSpace(line.Bytes()))
+	if err != nil {
+		return "", false, fmt.Errorf("malformed keyring line: %v", err)
+	}
+
+	keyring, err := loadKeyringIfExists(path)
+	if err != nil {
+		return "", false, err
+	}
+	existing, err := keyring.Lookup(entry.id)
+	if err == nil {
+		same := subtle.ConstantTimeCompare(existing.encodedKey, entry.encodedKey) == 1
+		keyring.Destroy()
+		if !same {
+			return "", false, fmt.Errorf("a different key with id '%s' already exists in the keyring", entry.id)
+		}
+		return entry.id, false, nil
+	}
+	keyring.Destroy()
+
+	key, err := entry.Key()
+	if err != nil {
+		return "", false, err
+	}
+	defer key.Destroy()
+
+	if err := appendKeyringLine(path, entry.id, entry.expiresString(), key, true); err != nil {
+		return "", false, err
+	}
+
+	return entry.id, true, nil
+}
+
+func appendKeyringLine(path string, id string, expires string, key *memguard.LockedBuffer, shared bool) error {
+	prefix := fmt.Sprintf("%s %s ", id, expires)
+	suffix := "\n"
+	if shared {
+		suffix = " " + keyringSharedMarker + suffix
+	}
+
+	encodedLen := base64.StdEncoding.EncodedLen(key.Size())
+	line := memguard.NewBuffer(len(prefix) + encodedLen + len(suffix))
+	defer line.Destroy()
+
+	line.Melt()
+	copy(line.Bytes(), prefix)
+	base64.StdEncoding.Encode(line.Bytes()[len(prefix):], key.Bytes())
+	copy(line.Bytes()[len(prefix)+encodedLen:], suffix)
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, lib.PrivateKeyPerms)
+	if err != nil {
+		return fmt.Errorf("error opening keyring '%s': %v", path, err)
+	}
+
+	_, err = file.Write(line.Bytes())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing keyring '%s': %v", path, err)
+	}
+
+	return nil
+}
+
+// KeyringShareAlias returns the alias that keys shared by the holder of the sharer key with the holder of the
+// recipient key are dropped under.
+func KeyringShareAlias(sharer crypto.PublicKey, recipient crypto.PublicKey) (string, error) {
+	sharerFingerprint, err := keyringFingerprint(sharer)
+	if err != nil {
+		return "", err
+	}
+	recipientFingerprint, err := keyringFingerprint(recipient)
+	if err != nil {
+		return "", err
+	}
+	return keyringShareAliasPrefix + sharerFingerprint + "." + recipientFingerprint, nil
+}
+
+func keyringFingerprint(key crypto.PublicKey) (string, error) {
+	var encoded []byte
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		encoded = x509.MarshalPKCS1PublicKey(key)
+	case ed25519.PublicKey:
+		encoded = key
+	default:
+		return "", fmt.Errorf("unsupported public key type %T, use an RSA or Ed25519 key", key)
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// sealKeyringKey signs a wrapped keyring line, returning the message of a shared key.
+func sealKeyringKey(signer crypto.Signer, ciphertext []byte) ([]byte, error) {
+	signature, err := (&cryptoTokenSigner{key: signer}).SignTokenRequest(keyringSignedData(ciphertext))
+	if err != nil {
+		return nil, fmt.Errorf("error signing key: %v", err)
+	}
+
+	message := make([]byte, 2, 2+len(signature)+len(ciphertext))
+	binary.BigEndian.PutUint16(message, uint16(len(signature)))
+	message = append(message, signature...)
+	return append(message, ciphertext...), nil
+}
+
+// openKeyringKey checks that the message of a shared key is signed by one of the sharers, returning the wrapped
+// keyring line.
+func openKeyringKey(message []byte, sharers []crypto.PublicKey) ([]byte, error) {
+	if len(message) < 2 || len(message)-2 < int(binary.BigEndian.Uint16(message)) {
+		return nil, fmt.Errorf("malformed shared keyring key")
+	}
+	signature := message[2 : 2+binary.BigEndian.Uint16(message)]
+	ciphertext := message[2+len(signature):]
+
+	data := keyringSignedData(ciphertext)
+	for _, sharer := range sharers {
+		switch sharer := sharer.(type) {
+		case *rsa.PublicKey:
+			digest := sha512.Sum512(data)
+			if rsa.VerifyPKCS1v15(sharer, crypto.SHA512, digest[:], signature) == nil {
+				return ciphertext, nil
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(sharer, data, signature) {
+				return ciphertext, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("shared keyring key isn't signed by any of the counterparty keys")
+}
+
+func keyringSignedData(ciphertext []byte) []byte {
+	return append([]byte(keyringSignatureLabel), ciphertext...)
+}
@@ -0,0 +1,61 @@
+package sdk
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+)
+
+func TestSealKeyringKey(t *testing.T) {
+	sharer, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext := []byte("wrapped keyring line")
+	message, err := sealKeyringKey(sharer, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := openKeyringKey(message, []crypto.PublicKey{other.Public(), sharer.Public()})
+	if err != nil || !bytes.Equal(opened, ciphertext) {
+		t.Fatalf("opened %q (%v), expected %q", opened, err, ciphertext)
+	}
+	if _, err := openKeyringKey(message, []crypto.PublicKey{other.Public()}); err == nil {
+		t.Fatal("opened a key signed by another key")
+	}
+
+	message[len(message)-1] ^= 1
+	if _, err := openKeyringKey(message, []crypto.PublicKey{sharer.Public()}); err == nil {
+		t.Fatal("opened a modified key")
+	}
+	if _, err := openKeyringKey(message[:3], []crypto.PublicKey{sharer.Public()}); err == nil {
+		t.Fatal("opened a truncated key")
+	}
+}
+
+func TestParseSharedKeyringLine(t *testing.T) {
+	entry, err := parseKeyringLine([]byte("rotated - a2V5 shared"))
+	if err != nil || !entry.IsShared() {
+		t.Fatalf("parsed %v (%v), expected a shared key", entry, err)
+	}
+	if _, err := parseKeyringLine([]byte("rotated - a2V5 current")); err == nil {
+		t.Fatal("parsed a line with an unknown marker")
+	}
+
+	keyring := &Keyring{entries: []*KeyringEntry{{id: "own"}, entry}}
+	if current, err := keyring.Current(); err != nil || current.Id() != "own" {
+		t.Fatalf("current key is %v (%v), expected own", current, err)
+	}
+	keyring.entries = keyring.entries[1:]
+	if current, err := keyring.Current(); err == nil {
+		t.Fatalf("current key is the shared key %v", current.Id())
+	}
+}
@@ -0,0 +1,81 @@
+package sdk
+
+import (
+	"dead-drop/lib"
+	"fmt"
+	"github.com/awnumar/memguard"
+)
+
+// Keys provides the symmetric keys used to encrypt and decrypt objects.
+// Returned buffers are owned (and destroyed) by the caller.
+type Keys interface {
+	// DropKey returns the key new objects should be encrypted with, and its key id (or "" if it has none).
+	DropKey() (*memguard.LockedBuffer, string, error)
+	// PullKey returns the key with the given id, where "" is the key for objects dropped without a key id.
+	PullKey(id string) (*memguard.LockedBuffer, error)
+}
+
+// KeySet combines a single encryption key and a keyring, either of which may be nil.
+// Drops use the current keyring key if there is a keyring, and the encryption key otherwise.
+// Identities are the private keys to pull objects encrypted to recipients with (see RecipientKeys).
+type KeySet struct {
+	Key        *memguard.LockedBuffer
+	Keyring    *Keyring
+	Identities []lib.Identity
+}
+
+func (keys *KeySet) DropKey() (*memguard.LockedBuffer, string, error) {
+	if keys.Keyring == nil {
+		key, err := keys.PullKey("")
+		return key, "", err
+	}
+
+	entry, err := keys.Keyring.Current()
+	if err != nil {
+		return nil, "", err
+	}
+
+	key, err := entry.Key()
+	return key, entry.id, err
+}
+
+func (keys *KeySet) PullKey(id string) (*memguard.LockedBuffer, error) {
+	if id == "" {
+		if keys.Key == nil {
+			return nil, fmt.Errorf("no encryption key available")
+		}
+		return copyBuffer(keys.Key), nil
+	}
+
+	if keys.Keyring == nil {
+		return nil, fmt.Errorf("object was encrypted with keyring key '%s', but no keyring is available", id)
+	}
+
+	entry, err := keys.Keyring.Lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Key()
+}
+
+func (keys *KeySet) Destroy() {
+	if keys.Key != nil {
+		keys.Key.Destroy()
+	}
+	if keys.Keyring != nil {
+		keys.Keyring.Destroy()
+	}
+	for _, identity := range keys.Identities {
+		if identity, ok := identity.(interface{ Destroy() }); ok {
+			identity.Destroy()
+		}
+	}
+}
+
+func copyBuffer(buf *memguard.LockedBuffer) *memguard.LockedBuffer {
+	dup := memguard.NewBuffer(buf.Size())
+	dup.Melt()
+	copy(dup.Bytes(), buf.Bytes())
+	dup.Freeze()
+	return dup
+}
@@ -0,0 +1,70 @@
+package sdk
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// MemoryScheme is the scheme of in-memory remotes, e.g. memory://test, whose requests are served in-process by the
+// handler registered under the remote's name, without a network. They let tests, such as those of the deadtest
+// package, exercise clients against a real server. Transports created by NewTransport reach them.
+const MemoryScheme = "memory"
+
+// memoryRemoteAddr is the address requests to in-memory remotes appear to come from.
+const memoryRemoteAddr = "127.0.0.1:0"
+
+var memoryRemotes = struct {
+	sync.RWMutex
+	handlers map[string]http.Handler
+}{handlers: make(map[string]http.Handler)}
+
+// RegisterMemoryRemote serves the in-memory remote of a name with handler, replacing any it was served with, and
+// returns the remote's url.
+func RegisterMemoryRemote(name string, handler http.Handler) string {
+	memoryRemotes.Lock()
+	defer memoryRemotes.Unlock()
+
+	memoryRemotes.handlers[name] = handler
+	return MemoryScheme + "://" + name
+}
+
+// UnregisterMemoryRemote stops serving the in-memory remote of a name, whose requests fail from then on.
+func UnregisterMemoryRemote(name string) {
+	memoryRemotes.Lock()
+	defer memoryRemotes.Unlock()
+
+	delete(memoryRemotes.handlers, name)
+}
+
+// memoryTransport serves requests to in-memory remotes with their handlers. Responses are buffered whole, which
+// suits the objects of tests.
+type memoryTransport struct{}
+
+func (memoryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+
+	memoryRemotes.RLock()
+	handler := memoryRemotes.handlers[req.URL.Host]
+	memoryRemotes.RUnlock()
+	if handler == nil {
+		return nil, fmt.Errorf("no in-memory remote %s", req.URL.Host)
+	}
+
+	served := req.Clone(req.Context())
+	served.Host = req.URL.Host
+	served.RemoteAddr = memoryRemoteAddr
+	served.RequestURI = req.URL.RequestURI()
+	if served.Body == nil {
+		served.Body = http.NoBody
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, served)
+	resp := recorder.Result()
+	resp.Request = req
+	return resp, nil
+}
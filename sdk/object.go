@@ -0,0 +1,198 @@
+package sdk
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"dead-drop/lib"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"net/url"
+	"strings"
+)
+
+const refSeparator = "#"
+
+// Checksum algorithms of object references. References name their algorithm before the checksum, e.g.
+// <oid>#blake3:<checksum>, except SHA-256 references, which can leave it out, as they did before references named
+// their algorithm.
+const (
+	ChecksumSHA256 = lib.ChecksumSHA256
+	ChecksumBLAKE3 = lib.ChecksumBLAKE3
+)
+
+const algorithmSeparator = ":"
+
+// Links are references which embed the remote, e.g. dead://localhost:4444/<oid>#<checksum>. dead:// links are to
+// https remotes, and dead+http:// links to plain http ones.
+const (
+	linkScheme     = "dead"
+	linkHTTPScheme = "dead+http"
+)
+
+// ObjectMetadata is the metadata encrypted along with an object's data.
+type ObjectMetadata = lib.ObjectMetadata
+
+// ObjectHeader is the plaintext header at the start of an object.
+type ObjectHeader = lib.ObjectHeader
+
+// ObjectReference identifies a dropped object, and carries the checksum used to verify it when pulled.
+type ObjectReference struct {
+	Oid      string
+	Checksum string
+	// Algorithm is the checksum algorithm named by the reference, or "" for SHA-256 references which don't name it.
+	Algorithm string
+	// Remote is the base url of the remote holding the object, if known: references parsed from links and returned by
+	// drops have one, but it is not part of their String form.
+	Remote string
+	// Partial is set for references parsed from phrases, whose Checksum is only the start of the object's checksum.
+	Partial bool
+}
+
+// ParseObjectReference parses either a plain reference (<oid>#<checksum>), a link which also names the remote, or a
+// phrase.
+func ParseObjectReference(input string) (*ObjectReference, error) {
+	if strings.HasPrefix(input, linkScheme+"://") || strings.HasPrefix(input, linkHTTPScheme+"://") {
+		return parseLink(input)
+	}
+	if isPhrase(input) {
+		return ParsePhrase(input)
+	}
+
+	split := strings.SplitN(input, refSeparator, 2)
+	if len(split) != 2 {
+		return nil, fmt.Errorf("malformed object reference")
+	}
+
+	or := &ObjectReference{Oid: split[0]}
+	if err := or.parseChecksum(split[1]); err != nil {
+		return nil, err
+	}
+	return or, nil
+}
+
+func parseLink(input string) (*ObjectReference, error) {
+	link, err := url.Parse(input)
+	if err != nil {
+		return nil, fmt.Errorf("malformed object link: %v", err)
+	}
+	if link.Host == "" || link.Fragment == "" || link.RawQuery != "" || link.User != nil {
+		return nil, fmt.Errorf("malformed object link")
+	}
+
+	slash := strings.LastIndex(link.Path, "/")
+	if slash < 0 || slash == len(link.Path)-1 {
+		return nil, fmt.Errorf("malformed object link")
+	}
+
+	scheme := "https"
+	if link.Scheme == linkHTTPScheme {
+		scheme = "http"
+	}
+	remote := url.URL{Scheme: scheme, Host: link.Host, Path: link.Path[:slash]}
+
+	or := &ObjectReference{Oid: link.Path[slash+1:], Remote: remote.String()}
+	if err := or.parseChecksum(link.Fragment); err != nil {
+		return nil, err
+	}
+	return or, nil
+}
+
+// parseChecksum parses the checksum of a reference, and the algorithm it names, if any.
+func (or *ObjectReference) parseChecksum(input string) error {
+	split := strings.SplitN(input, algorithmSeparator, 2)
+	if len(split) == 1 {
+		or.Checksum = input
+		return nil
+	}
+
+	if _, err := lib.NewChecksumHash(split[0]); err != nil {
+		return fmt.Errorf("%v, try a newer client", err)
+	}
+	or.Algorithm = split[0]
+	or.Checksum = split[1]
+	return nil
+}
+
+// taggedChecksum formats the checksum of a reference as it appears in it, after the algorithm if it names one.
+func (or *ObjectReference) taggedChecksum() string {
+	if or.Algorithm == "" {
+		return or.Checksum
+	}
+	return or.Algorithm + algorithmSeparator + or.Checksum
+}
+
+// newHash returns a hash computing checksums with the algorithm of the reference.
+func (or *ObjectReference) newHash() (hash.Hash, error) {
+	return newChecksumHash(or.Algorithm)
+}
+
+func (or *ObjectReference) String() string {
+	if or.Partial {
+		if phrase, err := or.Phrase(); err == nil {
+			return phrase
+		}
+	}
+	return fmt.Sprintf("%s%s%s", or.Oid, refSeparator, or.taggedChecksum())
+}
+
+// Link formats the reference as a link which also names its remote, so that it can be pulled with nothing else.
+func (or *ObjectReference) Link() (string, error) {
+	if or.Partial {
+		return "", fmt.Errorf("references parsed from phrases must be resolved before they are made links")
+	}
+	if or.Remote == "" {
+		return "", fmt.Errorf("the remote of the object is not known")
+	}
+	remote, err := url.Parse(or.Remote)
+	if err != nil {
+		return "", fmt.Errorf("invalid remote: %v", err)
+	}
+
+	link := url.URL{Host: remote.Host, Path: strings.TrimSuffix(remote.Path, "/") + "/" + or.Oid}
+	switch remote.Scheme {
+	case "https":
+		link.Scheme = linkScheme
+	case "http":
+		link.Scheme = linkHTTPScheme
+	default:
+		return "", fmt.Errorf("remote '%s' is not an http or https url", or.Remote)
+	}
+	return link.String() + refSeparator + or.taggedChecksum(), nil
+}
+
+// matches returns whether a checksum computed with the reference's algorithm matches the reference's, as far as it
+// has it.
+func (or *ObjectReference) matches(sum []byte) bool {
+	if or.Partial {
+		prefix, err := base64.URLEncoding.DecodeString(or.Checksum)
+		return err == nil && len(prefix) <= len(sum) && bytes.Equal(prefix, sum[:len(prefix)])
+	}
+	return encodeChecksum(sum) == or.Checksum
+}
+
+// algorithm returns the checksum algorithm of the reference, which is SHA-256 if it doesn't name one.
+func (or *ObjectReference) algorithm() string {
+	if or.Algorithm == "" {
+		return ChecksumSHA256
+	}
+	return or.Algorithm
+}
+
+// newChecksumHash returns a hash computing checksums with an algorithm, or SHA-256 if it is "".
+func newChecksumHash(algorithm string) (hash.Hash, error) {
+	if algorithm == "" {
+		algorithm = ChecksumSHA256
+	}
+	return lib.NewChecksumHash(algorithm)
+}
+
+func checksum(data []byte) string {
+	checksumBytes := sha256.Sum256(data)
+	return encodeChecksum(checksumBytes[:])
+}
+
+// encodeChecksum formats the checksum of an object as it appears in references.
+func encodeChecksum(sum []byte) string {
+	return lib.EncodeChecksum(sum)
+}
@@ -0,0 +1,192 @@
+package sdk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Resumable downloads of objects at least this large are split into ranges fetched at once, when enabled with
+// WithParallelDownloads. Smaller objects download quickly enough over a single connection.
+const parallelDownloadMinSize = 32 * 1024 * 1024
+
+// The last bytes of an object are left to the connection which finishes the download, which reports whether the remote
+// destroyed the object.
+const parallelDownloadTailSize = downloadStepSize
+
+// WithParallelDownloads makes PullResumable fetch large objects in n ranges at once, which is much faster on links
+// with high latency, e.g. far from the remote. Values below 2 download over a single connection, the default.
+func WithParallelDownloads(n int) Option {
+	return func(client *Client) {
+		client.connections = n
+	}
+}
+
+// downloadParallel downloads all but the end of an encoded object into file in ranges fetched at once, returning the
+// offset up to which the partial download is complete, which is saved. It returns 0 if the object is too small to
+// split, or the remote can't be asked for its size; either way the rest is left to downloadRange.
+func (client *Client) downloadParallel(
+	ctx context.Context,
+	or *ObjectReference,
+	file *os.File,
+	path string,
+) (int64, error) {
+	stat, err := client.Stat(ctx, or.Oid)
+	if err != nil {
+		client.logf("downloading %s over a single connection, since its size is unknown: %v", or.Oid, err)
+		return 0, nil
+	}
+	if stat.Size < parallelDownloadMinSize {
+		return 0, nil
+	}
+	// The remote counts every range as a pull, so objects it allows a limited number of pulls are pulled in one.
+	if stat.Burn || stat.PullsLeft != nil {
+		client.logf("downloading %s over a single connection, since its pulls are limited", or.Oid)
+		return 0, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	end := stat.Size - parallelDownloadTailSize
+	rangeSize := (end + int64(client.connections) - 1) / int64(client.connections)
+	progress := &parallelProgress{client: client, total: stat.Size}
+	client.stage(StageDownloading, stat.Size)
+
+	var starts []int64
+	for start := int64(0); start < end; start += rangeSize {
+		starts = append(starts, start)
+	}
+	errs := make([]error, len(starts))
+	var wg sync.WaitGroup
+	for i, start := range starts {
+		rangeEnd := start + rangeSize
+		if rangeEnd > end {
+			rangeEnd = end
+		}
+
+		wg.Add(1)
+		go func(i int, start int64, rangeEnd int64) {
+			defer wg.Done()
+			if errs[i] = client.downloadSection(ctx, or, file, start, rangeEnd, progress); errs[i] != nil {
+				cancel()
+			}
+		}(i, start, rangeEnd)
+	}
+	wg.Wait()
+
+	// The partial download is only complete up to the first range which failed.
+	offset := end
+	var firstErr error
+	for i, err := range errs {
+		if err != nil {
+			offset = starts[i]
+			firstErr = err
+			break
+		}
+	}
+
+	if offset > 0 {
+		if err := file.Sync(); err != nil {
+			return 0, fmt.Errorf("error writing partial download: %v", err)
+		}
+		if err := writePartialOffset(path, offset); err != nil {
+			return 0, fmt.Errorf("error writing partial download: %v", err)
+		}
+	}
+	if firstErr != nil {
+		client.logf("parallel download of %s failed at byte %d, resuming over a single connection: %v",
+			or.Oid, offset, firstErr)
+	}
+	return offset, nil
+}
+
+// downloadSection fetches the bytes of an encoded object from start up to end into the same bytes of file.
+func (client *Client) downloadSection(
+	ctx context.Context,
+	or *ObjectReference,
+	file *os.File,
+	start int64,
+	end int64,
+	progress *parallelProgress,
+) error {
+	req, err := http.NewRequest("GET", client.url("/d/%s", or.Oid), nil)
+	if err != nil {
+		return fmt.Errorf("error building request: %v", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+
+	// Use the internal request, since 206 is the expected status here.
+	resp, err := client.makeAuthenticatedRequestInternal(ctx, pullScope(or.Oid), req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("remote does not support ranged requests, responding with status: %s", resp.Status)
+	}
+	contentRange := resp.Header.Get("Content-Range")
+	if !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-%d/", start, end-1)) {
+		return fmt.Errorf("remote sent unexpected range '%s'", contentRange)
+	}
+
+	body := &progressCounter{reader: resp.Body, progress: progress}
+	written, err := io.Copy(&sectionWriter{file: file, offset: start}, body)
+	if err != nil {
+		return fmt.Errorf("error reading response body: %v", err)
+	}
+	if written != end-start {
+		return fmt.Errorf("remote sent %d bytes of a %d byte range", written, end-start)
+	}
+	return nil
+}
+
+// sectionWriter writes sequentially to a file from an offset, without moving the file's own offset, so that several
+// can write to the same file at once.
+type sectionWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (writer *sectionWriter) Write(p []byte) (int, error) {
+	n, err := writer.file.WriteAt(p, writer.offset)
+	writer.offset += int64(n)
+	return n, err
+}
+
+// parallelProgress reports the bytes read by all the ranges of a download as the progress of one stage.
+type parallelProgress struct {
+	client *Client
+	mutex  sync.Mutex
+	total  int64
+	bytes  int64
+}
+
+func (progress *parallelProgress) add(n int) {
+	if progress.client.progress == nil {
+		return
+	}
+
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	progress.bytes += int64(n)
+	progress.client.progress(ProgressEvent{Stage: StageDownloading, Bytes: progress.bytes, Total: progress.total})
+}
+
+type progressCounter struct {
+	reader   io.Reader
+	progress *parallelProgress
+}
+
+func (counter *progressCounter) Read(p []byte) (int, error) {
+	n, err := counter.reader.Read(p)
+	if n > 0 {
+		counter.progress.add(n)
+	}
+	return n, err
+}
@@ -0,0 +1,75 @@
+package sdk
+
+import (
+	"dead-drop/lib"
+	"fmt"
+	"github.com/awnumar/memguard"
+)
+
+// PassphraseKeys derive the key of each object from a passphrase with Argon2id, using a fresh salt for every drop,
+// which is recorded in the object header. Recipients then only need the passphrase, rather than a shared key file.
+type PassphraseKeys struct {
+	passphrase *memguard.LockedBuffer
+}
+
+// NewPassphraseKeys takes ownership of the passphrase, which is destroyed by Destroy.
+func NewPassphraseKeys(passphrase *memguard.LockedBuffer) *PassphraseKeys {
+	return &PassphraseKeys{passphrase: passphrase}
+}
+
+// DropKey always fails, since passphrase keys depend on the salt in each object's header.
+// Clients derive the keys of the objects they drop themselves.
+func (keys *PassphraseKeys) DropKey() (*memguard.LockedBuffer, string, error) {
+	return nil, "", fmt.Errorf("passphrase keys are derived for each object")
+}
+
+// PullKey always fails, since it is only used for objects which were not dropped with a passphrase.
+func (keys *PassphraseKeys) PullKey(id string) (*memguard.LockedBuffer, error) {
+	return nil, fmt.Errorf("object was not dropped with a passphrase, pull it with its encryption key or keyring")
+}
+
+func (keys *PassphraseKeys) Destroy() {
+	keys.passphrase.Destroy()
+}
+
+// dropKey returns the key to encrypt a new object with, and records how to find it again in the header.
+func (client *Client) dropKey(header *lib.ObjectHeader) (*memguard.LockedBuffer, error) {
+	if keys, ok := client.keys.(*RecipientKeys); ok {
+		return client.recipientDropKey(keys, header)
+	}
+	if keys, ok := client.keys.(*PassphraseKeys); ok {
+		params, err := lib.NewKdfParams()
+		if err != nil {
+			return nil, err
+		}
+		header.Kdf = params
+
+		client.stage(StageDerivingKey, -1)
+		return lib.DeriveKey(keys.passphrase, params)
+	}
+
+	key, keyId, err := client.keys.DropKey()
+	header.KeyId = keyId
+	return key, err
+}
+
+// pullKey returns the key an object was encrypted with, given its header.
+func (client *Client) pullKey(header *lib.ObjectHeader) (*memguard.LockedBuffer, error) {
+	if len(header.Recipients) > 0 {
+		return client.recipientPullKey(header)
+	}
+	if client.keys == nil {
+		return nil, fmt.Errorf("no encryption keys configured")
+	}
+	if header.Kdf == nil {
+		return client.keys.PullKey(header.KeyId)
+	}
+
+	keys, ok := client.keys.(*PassphraseKeys)
+	if !ok {
+		return nil, fmt.Errorf("object was dropped with a passphrase, pull it with the passphrase instead")
+	}
+
+	client.stage(StageDerivingKey, -1)
+	return lib.DeriveKey(keys.passphrase, header.Kdf)
+}
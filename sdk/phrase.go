@@ -0,0 +1,131 @@
+package sdk
+
+import (
+	"dead-drop/lib"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Phrases are references to objects with oids of words (of servers with oid-alphabet: words) which can be read out,
+// e.g. over the phone: the words of the oid, then PhraseChecksumWords words of the start of the object's checksum,
+// e.g. gecko-zebra-acid-yodel.lemon-tulip-ozone-vixen. Pulls of phrases check the object's checksum only as far as the
+// phrase has it.
+const PhraseChecksumWords = 4
+
+const (
+	phraseWordSeparator     = "-"
+	phraseChecksumSeparator = "."
+	// phraseChecksumBytes of the checksum are in the checksum words, after a bit which is set for BLAKE3 checksums.
+	phraseChecksumBytes = 5
+)
+
+// Phrase formats the reference as a phrase, returning an error unless its oid is made of words.
+func (or *ObjectReference) Phrase() (string, error) {
+	oidWords := strings.Split(or.Oid, phraseWordSeparator)
+	for _, word := range oidWords {
+		if index, ok := lib.WordIndex(word); !ok || lib.Words[index] != word {
+			return "", fmt.Errorf("oid %s isn't made of words, which the remote picks with oid-alphabet: words", or.Oid)
+		}
+	}
+
+	sum, err := base64.URLEncoding.DecodeString(or.Checksum)
+	if err != nil || len(sum) < phraseChecksumBytes {
+		return "", fmt.Errorf("malformed checksum")
+	}
+	value := uint64(0)
+	switch or.algorithm() {
+	case ChecksumSHA256:
+	case ChecksumBLAKE3:
+		value = 1
+	default:
+		return "", fmt.Errorf("phrases can't have %s checksums", or.Algorithm)
+	}
+	for _, b := range sum[:phraseChecksumBytes] {
+		value = value<<8 | uint64(b)
+	}
+
+	checksumWords := make([]string, PhraseChecksumWords)
+	for i := len(checksumWords) - 1; i >= 0; i-- {
+		checksumWords[i] = lib.Words[value%uint64(len(lib.Words))]
+		value /= uint64(len(lib.Words))
+	}
+	return strings.Join(oidWords, phraseWordSeparator) + phraseChecksumSeparator +
+		strings.Join(checksumWords, phraseWordSeparator), nil
+}
+
+// isPhrase returns whether input is words separated as in phrases, so that it is parsed as a phrase. Inputs without a
+// checksum separator or spaces may be oids of words instead, which is up to the caller.
+func isPhrase(input string) bool {
+	separated := false
+	for _, r := range input {
+		if isPhraseSeparator(r) || string(r) == phraseChecksumSeparator {
+			separated = true
+		} else if !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return separated
+}
+
+// IsPhrase returns whether input can only be a phrase, rather than an oid of words, since it separates the checksum
+// words or has spaces.
+func IsPhrase(input string) bool {
+	return isPhrase(input) && strings.ContainsAny(input, phraseChecksumSeparator+" \t")
+}
+
+// ParsePhrase parses a phrase, whose words may be separated by dashes or spaces and are matched by their first three
+// letters. Its checksum words may be separated from the oid by a dot, and are otherwise its last ones. The reference
+// is Partial, with only the start of the object's checksum.
+func ParsePhrase(input string) (*ObjectReference, error) {
+	var words []string
+	if split := strings.SplitN(input, phraseChecksumSeparator, 2); len(split) == 2 {
+		words = strings.FieldsFunc(split[0], isPhraseSeparator)
+		checksumWords := strings.FieldsFunc(split[1], isPhraseSeparator)
+		if len(checksumWords) != PhraseChecksumWords {
+			return nil, fmt.Errorf("malformed phrase, which must end with %d checksum words", PhraseChecksumWords)
+		}
+		words = append(words, checksumWords...)
+	} else {
+		words = strings.FieldsFunc(input, isPhraseSeparator)
+	}
+	if len(words) <= PhraseChecksumWords {
+		return nil, fmt.Errorf("malformed phrase, which must have the words of the oid and %d checksum words",
+			PhraseChecksumWords)
+	}
+
+	for i, word := range words {
+		index, ok := lib.WordIndex(word)
+		if !ok {
+			return nil, fmt.Errorf("unknown word '%s' in phrase", word)
+		}
+		words[i] = lib.Words[index]
+	}
+
+	oidWords, checksumWords := words[:len(words)-PhraseChecksumWords], words[len(words)-PhraseChecksumWords:]
+	value := uint64(0)
+	for _, word := range checksumWords {
+		index, _ := lib.WordIndex(word)
+		value = value*uint64(len(lib.Words)) + uint64(index)
+	}
+	if value>>(8*phraseChecksumBytes) > 1 {
+		return nil, fmt.Errorf("invalid checksum words in phrase, one of which may have been misheard")
+	}
+
+	or := &ObjectReference{Oid: strings.Join(oidWords, phraseWordSeparator), Partial: true}
+	if value>>(8*phraseChecksumBytes) == 1 {
+		or.Algorithm = ChecksumBLAKE3
+	}
+	sum := make([]byte, phraseChecksumBytes)
+	for i := len(sum) - 1; i >= 0; i-- {
+		sum[i] = byte(value)
+		value >>= 8
+	}
+	or.Checksum = encodeChecksum(sum)
+	return or, nil
+}
+
+func isPhraseSeparator(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune(phraseWordSeparator, r)
+}
@@ -0,0 +1,93 @@
+package sdk
+
+import (
+	"io"
+)
+
+// Stage is a step of a drop or pull, in the order they start. Streamed drops and pulls run their stages at once,
+// so a stage starting does not mean the previous one has finished.
+type Stage string
+
+const (
+	// StageDerivingKey is only run for passphrase keys, before encrypting or decrypting an object.
+	StageDerivingKey Stage = "deriving-key"
+	StageEncoding    Stage = "encoding"
+	StageEncrypting  Stage = "encrypting"
+	StageUploading   Stage = "uploading"
+	StageDownloading Stage = "downloading"
+	StageVerifying   Stage = "verifying"
+	StageDecrypting  Stage = "decrypting"
+	StageDecoding    Stage = "decoding"
+)
+
+// ProgressEvent reports that an operation entered a stage (with Bytes zero), or transferred more bytes in it.
+type ProgressEvent struct {
+	Stage Stage
+	// Bytes is the number of bytes processed so far in the stage.
+	Bytes int64
+	// Total is the number of bytes the stage will process, or -1 if it is unknown.
+	Total int64
+}
+
+// Logger receives diagnostic messages about the client's state, e.g. retries. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// WithProgress registers a callback for progress events. It is called synchronously from the goroutine
+// running the operation, so it should return quickly.
+func WithProgress(callback func(ProgressEvent)) Option {
+	return func(client *Client) {
+		client.progress = callback
+	}
+}
+
+// WithLogger sets a logger for diagnostic messages, which are discarded by default.
+func WithLogger(logger Logger) Option {
+	return func(client *Client) {
+		client.logger = logger
+	}
+}
+
+func (client *Client) stage(stage Stage, total int64) {
+	if client.progress != nil {
+		client.progress(ProgressEvent{Stage: stage, Bytes: 0, Total: total})
+	}
+}
+
+func (client *Client) logf(format string, args ...interface{}) {
+	if client.logger != nil {
+		client.logger.Printf(format, args...)
+	}
+}
+
+// progressReader reports the bytes read through it as progress in a stage.
+type progressReader struct {
+	reader   io.Reader
+	client   *Client
+	stage    Stage
+	total    int64
+	progress int64
+}
+
+func (client *Client) newProgressReader(reader io.Reader, stage Stage, total int64) io.Reader {
+	client.stage(stage, total)
+	if client.progress == nil {
+		return reader
+	}
+	return &progressReader{
+		reader: reader,
+		client: client,
+		stage:  stage,
+		total:  total,
+	}
+}
+
+func (reader *progressReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	if n > 0 {
+		reader.progress += int64(n)
+		reader.client.progress(ProgressEvent{Stage: reader.stage, Bytes: reader.progress, Total: reader.total})
+	}
+	return n, err
+}
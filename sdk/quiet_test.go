@@ -0,0 +1,64 @@
+package sdk
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Programs embedding the sdk own their output and lifetime, so it must never print or exit.
+func TestNeverPrintsOrExits(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forbidden := map[string]func(name string) bool{
+		"fmt":     func(name string) bool { return strings.HasPrefix(name, "Print") },
+		"os":      func(name string) bool { return name == "Exit" || name == "Stdout" || name == "Stderr" },
+		"syscall": func(name string) bool { return name == "Exit" },
+		"runtime": func(name string) bool { return name == "Goexit" },
+		"log":     func(name string) bool { return true },
+	}
+
+	fileSet := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fileSet, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Packages are matched by path, whatever name they are imported as.
+		imports := map[string]string{}
+		for _, spec := range file.Imports {
+			path, _ := strconv.Unquote(spec.Path.Value)
+			local := filepath.Base(path)
+			if spec.Name != nil {
+				local = spec.Name.Name
+			}
+			imports[local] = path
+		}
+
+		ast.Inspect(file, func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.SelectorExpr:
+				if pkg, ok := node.X.(*ast.Ident); ok && pkg.Obj == nil {
+					if isForbidden, ok := forbidden[imports[pkg.Name]]; ok && isForbidden(node.Sel.Name) {
+						t.Errorf("%s uses %s.%s", fileSet.Position(node.Pos()), imports[pkg.Name], node.Sel.Name)
+					}
+				}
+			case *ast.CallExpr:
+				fun, ok := node.Fun.(*ast.Ident)
+				if ok && fun.Obj == nil && (fun.Name == "print" || fun.Name == "println") {
+					t.Errorf("%s uses the %s builtin", fileSet.Position(node.Pos()), fun.Name)
+				}
+			}
+			return true
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package sdk
+
+import (
+	"dead-drop/lib"
+	"fmt"
+	"github.com/awnumar/memguard"
+)
+
+// RecipientKeys encrypt each object with a fresh random key, which is wrapped to the recipients' public keys in the
+// object header, so senders and recipients never share a key. Recipients pull such objects with the Identities of
+// their KeySet; the client's authentication key is always tried too, so objects can be dropped for anyone by their
+// authorized public key.
+type RecipientKeys struct {
+	recipients []lib.Recipient
+}
+
+func NewRecipientKeys(recipients ...lib.Recipient) *RecipientKeys {
+	return &RecipientKeys{recipients: recipients}
+}
+
+// DropKey always fails, since every object gets its own key.
+func (keys *RecipientKeys) DropKey() (*memguard.LockedBuffer, string, error) {
+	return nil, "", fmt.Errorf("recipient keys are generated for each object")
+}
+
+// PullKey always fails, since it is only used for objects which were not encrypted to recipients.
+func (keys *RecipientKeys) PullKey(id string) (*memguard.LockedBuffer, error) {
+	return nil, fmt.Errorf("object was not encrypted to a recipient, pull it with its encryption key, keyring or passphrase")
+}
+
+func (keys *RecipientKeys) Destroy() {}
+
+// recipientDropKey generates the key of a new object, and wraps it to the recipients in the header.
+func (client *Client) recipientDropKey(keys *RecipientKeys, header *lib.ObjectHeader) (*memguard.LockedBuffer, error) {
+	if len(keys.recipients) == 0 {
+		return nil, fmt.Errorf("no recipients configured")
+	}
+
+	key := lib.NewObjectKey()
+	wrapped, err := lib.WrapObjectKey(key, keys.recipients)
+	if err != nil {
+		key.Destroy()
+		return nil, err
+	}
+	header.Recipients = wrapped
+	return key, nil
+}
+
+// recipientPullKey unwraps the key of an object encrypted to recipients with the client's identities.
+func (client *Client) recipientPullKey(header *lib.ObjectHeader) (*memguard.LockedBuffer, error) {
+	var identities []lib.Identity
+	if keys, ok := client.keys.(*KeySet); ok {
+		identities = append(identities, keys.Identities...)
+	}
+	if client.authKey != nil {
+		identities = append(identities, &lib.RSAIdentity{Key: client.authKey})
+	}
+	return lib.UnwrapObjectKey(header.Recipients, identities)
+}
@@ -0,0 +1,239 @@
+package sdk
+
+import (
+	"context"
+	"crypto/sha256"
+	"dead-drop/lib"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resumable downloads are written to disk in steps of this size. The offset is saved after each step, once the step
+// has been synced, so that it never claims more of the object than was written.
+const downloadStepSize = 1024 * 1024
+
+const maxDownloadAttempts = 5
+const downloadRetryDelay = time.Second
+
+const partialFileExt = ".part"
+const partialOffsetExt = ".offset"
+
+// PullResumable is PullStream for pulls which should survive network failures. The encoded object is first
+// downloaded into dir, resuming from wherever an earlier attempt to pull the same reference left off, and dropped
+// connections are resumed in place a few times before giving up. The download is then verified and decrypted from
+// disk as the returned reader is read, and removed when the reader is closed after being read to the end.
+// The remote must support ranged requests for downloads to resume; otherwise they start over. Large objects are
+// downloaded in several ranges at once if the client was created WithParallelDownloads.
+func (client *Client) PullResumable(
+	ctx context.Context,
+	or *ObjectReference,
+	dir string,
+) (io.ReadCloser, *ObjectMetadata, error) {
+	hash, err := or.newHash()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, fmt.Errorf("error creating partial download directory '%s': %v", dir, err)
+	}
+	path := filepath.Join(dir, client.partialName(or))
+
+	burned, err := client.downloadPartial(ctx, or, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(path + partialFileExt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading partial download: %v", err)
+	}
+	object := &downloadReader{
+		client:   client,
+		body:     file,
+		reader:   file,
+		hash:     hash,
+		expected: or,
+	}
+
+	reader, meta, err := client.openObject(object)
+	if err != nil {
+		removePartial(path, object)
+		return nil, nil, err
+	}
+	meta.Burned = burned
+	return &partialReader{ReadCloser: reader, object: object, path: path}, meta, nil
+}
+
+// partialName names the partial download of a reference, which is unique to the remote, object and checksum.
+func (client *Client) partialName(or *ObjectReference) string {
+	sum := sha256.Sum256([]byte(client.remote + "\n" + or.Oid + "\n" + or.taggedChecksum()))
+	return hex.EncodeToString(sum[:16])
+}
+
+// downloadPartial downloads the rest of an encoded object into the partial download at path, returning whether the
+// remote destroyed the object once it was downloaded.
+func (client *Client) downloadPartial(ctx context.Context, or *ObjectReference, path string) (bool, error) {
+	file, err := os.OpenFile(path+partialFileExt, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return false, fmt.Errorf("error writing partial download: %v", err)
+	}
+	defer file.Close()
+
+	offset := readPartialOffset(path)
+	if info, err := file.Stat(); err != nil || info.Size() < offset {
+		offset = 0
+	}
+	// Anything past the saved offset may not have been synced, so is downloaded again.
+	if err := file.Truncate(offset); err != nil {
+		return false, fmt.Errorf("error writing partial download: %v", err)
+	}
+	if offset > 0 {
+		client.logf("resuming download of %s from byte %d", or.Oid, offset)
+	}
+	if offset == 0 && client.connections > 1 {
+		if offset, err = client.downloadParallel(ctx, or, file, path); err != nil {
+			return false, err
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		var complete, burned bool
+		complete, burned, offset, err = client.downloadRange(ctx, or, file, path, offset)
+		if err == nil && complete {
+			return burned, nil
+		}
+		if ctx.Err() != nil || attempt == maxDownloadAttempts {
+			return false, fmt.Errorf("download interrupted after %d bytes, pull again to resume: %v", offset, err)
+		}
+
+		client.logf("download of %s interrupted at byte %d (attempt %d of %d), resuming: %v",
+			or.Oid, offset, attempt, maxDownloadAttempts, err)
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(time.Duration(attempt) * downloadRetryDelay):
+		}
+	}
+}
+
+// downloadRange downloads an encoded object from offset into file, returning whether the download is complete, whether
+// the remote destroyed the object once it was sent, and the offset it reached.
+func (client *Client) downloadRange(
+	ctx context.Context,
+	or *ObjectReference,
+	file *os.File,
+	path string,
+	offset int64,
+) (bool, bool, int64, error) {
+	req, err := http.NewRequest("GET", client.url("/d/%s", or.Oid), nil)
+	if err != nil {
+		return false, false, offset, fmt.Errorf("error building request: %v", err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	// Use the internal request, since 206 and 416 are expected statuses here.
+	resp, err := client.makeAuthenticatedRequestInternal(ctx, pullScope(or.Oid), req)
+	if err != nil {
+		return false, false, offset, fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// The remote sent the whole object, either because it was asked to or because it can't send ranges.
+		offset = 0
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return false, false, offset, fmt.Errorf("remote sent unexpected range '%s'", resp.Header.Get("Content-Range"))
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Everything up to the offset was downloaded before, and there is nothing more.
+		return true, false, offset, nil
+	default:
+		return false, false, offset, fmt.Errorf("request failed with status: %s", resp.Status)
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return false, false, offset, err
+	}
+	if err := file.Truncate(offset); err != nil {
+		return false, false, offset, err
+	}
+	burned := resp.Header.Get(lib.BurnHeader) == "true"
+
+	body := client.newProgressReader(resp.Body, StageDownloading, resp.ContentLength)
+	for {
+		written, err := io.CopyN(file, body, downloadStepSize)
+		if written > 0 {
+			if syncErr := file.Sync(); syncErr != nil {
+				return false, false, offset, fmt.Errorf("error writing partial download: %v", syncErr)
+			}
+			offset += written
+			if writeErr := writePartialOffset(path, offset); writeErr != nil {
+				return false, false, offset, fmt.Errorf("error writing partial download: %v", writeErr)
+			}
+		}
+
+		if err == io.EOF {
+			return true, burned, offset, nil
+		} else if err != nil {
+			return false, false, offset, fmt.Errorf("error reading response body: %v", err)
+		}
+	}
+}
+
+func readPartialOffset(path string) int64 {
+	data, err := ioutil.ReadFile(path + partialOffsetExt)
+	if err != nil {
+		return 0
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || offset < 0 {
+		return 0
+	}
+	return offset
+}
+
+func writePartialOffset(path string, offset int64) error {
+	// Write the offset under a temporary name, so that a crash can't leave it half written.
+	tmpPath := path + partialOffsetExt + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(strconv.FormatInt(offset, 10)), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path+partialOffsetExt)
+}
+
+// removePartial removes a partial download once it has been read to the end, whether or not it was intact,
+// since either way there is nothing left to resume.
+func removePartial(path string, object *downloadReader) {
+	object.Close()
+	if !object.ended {
+		return
+	}
+	os.Remove(path + partialFileExt)
+	os.Remove(path + partialOffsetExt)
+}
+
+// partialReader reads a pull from a partial download, which it removes when closed if it was read to the end.
+type partialReader struct {
+	io.ReadCloser
+	object *downloadReader
+	path   string
+}
+
+func (reader *partialReader) Close() error {
+	err := reader.ReadCloser.Close()
+	removePartial(reader.path, reader.object)
+	return err
+}
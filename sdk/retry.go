@@ -0,0 +1,219 @@
+package sdk
+
+import (
+	"context"
+	"dead-drop/lib"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy controls how requests which fail with transient errors (connection failures, timeouts and 5xx
+// responses) are retried, with exponential backoff and full jitter: the delay before retry n is random, up to
+// InitialDelay * 2^(n-1), capped at MaxDelay. Requests which the remote rate limited (429) are retried after the delay
+// it asks for in Retry-After instead, if it does.
+//
+// Only requests which can safely be repeated are retried: idempotent methods, drops made in an upload session (which
+// the remote deduplicates), and requests which never reached the remote.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request is made before giving up, including the first. Values below 1 are
+	// treated as 1, which disables retries.
+	MaxAttempts  int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of clients created without WithRetryPolicy.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  4,
+	InitialDelay: 500 * time.Millisecond,
+	MaxDelay:     10 * time.Second,
+}
+
+// WithRetryPolicy sets how requests failing with transient errors are retried.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(client *Client) {
+		client.retry = policy
+	}
+}
+
+var jitter = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// delay returns how long to wait before the given retry (counting from 1).
+func (policy RetryPolicy) delay(retry int) time.Duration {
+	ceiling := policy.InitialDelay
+	for i := 1; i < retry && ceiling < policy.MaxDelay; i++ {
+		ceiling *= 2
+	}
+	if ceiling > policy.MaxDelay {
+		ceiling = policy.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+
+	jitter.Lock()
+	defer jitter.Unlock()
+	return time.Duration(jitter.Int63n(int64(ceiling) + 1))
+}
+
+// statusError is the error of a request which failed with an http status, so that it can be told apart from network
+// errors.
+type statusError struct {
+	status string
+	code   int
+	// retryAfter is how long the remote asked to wait before retrying, or 0 if it didn't.
+	retryAfter time.Duration
+}
+
+func (err *statusError) Error() string {
+	return fmt.Sprintf("response status: %s", err.status)
+}
+
+// authError is the error of a request which failed to authenticate, and so was never sent.
+type authError struct {
+	err error
+}
+
+func (err *authError) Error() string {
+	return fmt.Sprintf("authentication failed: %v", err.err)
+}
+
+// retryable returns whether a request failing with err (or resp) should be retried, if attempts remain.
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		// Rate limited requests were refused before they were processed.
+		return true
+	}
+	if err == nil && resp.StatusCode < 500 {
+		return false
+	}
+	if err != nil && !isTransient(err) {
+		return false
+	}
+	if err != nil && notSent(err) {
+		return true
+	}
+
+	switch req.Method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		return true
+	default:
+		return req.Header.Get(lib.UploadSessionHeader) != ""
+	}
+}
+
+// isTransient returns whether err is a network error or 5xx response which may not happen again.
+func isTransient(err error) bool {
+	for {
+		switch cause := err.(type) {
+		case *statusError:
+			return cause.code >= 500 || cause.code == http.StatusTooManyRequests
+		case *authError:
+			err = cause.err
+		case *url.Error:
+			err = cause.Err
+		case *net.OpError:
+			err = cause.Err
+		case *os.SyscallError:
+			err = cause.Err
+		case syscall.Errno:
+			return cause == syscall.ECONNRESET || cause == syscall.ECONNREFUSED || cause == syscall.EPIPE ||
+				cause.Timeout() || cause.Temporary()
+		case net.Error:
+			return cause.Timeout() || cause.Temporary()
+		default:
+			return err == io.EOF || err == io.ErrUnexpectedEOF
+		}
+	}
+}
+
+// notSent returns whether err happened while authenticating or connecting, so that the request never reached the
+// remote.
+func notSent(err error) bool {
+	if _, ok := err.(*authError); ok {
+		return true
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// withRetries makes a request with attempt, retrying it as the client's retry policy allows.
+func (client *Client) withRetries(
+	ctx context.Context,
+	req *http.Request,
+	attempt func() (*http.Response, error),
+) (*http.Response, error) {
+	for try := 1; ; try++ {
+		resp, err := attempt()
+		if try >= client.retry.MaxAttempts || ctx.Err() != nil || !retryable(req, resp, err) {
+			return resp, err
+		}
+
+		reason := fmt.Sprint(err)
+		if err == nil {
+			reason = "response status: " + resp.Status
+			resp.Body.Close()
+		}
+		// The transport closes the body of requests it sent, or tried to.
+		if _, unsent := err.(*authError); !unsent && req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		delay := client.retry.delay(try)
+		if wait := retryAfter(resp, err); wait > 0 {
+			delay = wait
+		}
+		client.logf("%s %s failed (attempt %d of %d), retrying in %v: %s",
+			req.Method, req.URL.Path, try, client.retry.MaxAttempts, delay, reason)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryAfter returns how long the remote asked to wait before retrying a rate limited request, or 0 if it didn't.
+func retryAfter(resp *http.Response, err error) time.Duration {
+	if authErr, ok := err.(*authError); ok {
+		err = authErr.err
+	}
+	if statusErr, ok := err.(*statusError); ok {
+		return statusErr.retryAfter
+	}
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return 0
+	}
+	return parseRetryAfter(resp.Header.Get("Retry-After"))
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds or an http date.
+func parseRetryAfter(header string) time.Duration {
+	if seconds, err := strconv.ParseUint(header, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(time.Now()) {
+		return time.Until(date)
+	}
+	return 0
+}
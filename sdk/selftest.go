@@ -0,0 +1,193 @@
+package sdk
+
+import (
+	"bytes"
+	"dead-drop/lib"
+	"dead-drop/lib/blake3"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// blake3Vectors are BLAKE3 checksums from the official test vectors, of inputs of the given lengths whose bytes count
+// up from 0 modulo 251. They cover inputs within one chunk, and over several.
+var blake3Vectors = []struct {
+	length int
+	sum    string
+}{
+	{0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+	{1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+	{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+	{1025, "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+	{2049, "5f4d72f40d7a5f82b15ca2b2e44b1de3c2ef86c426c95c1af0b6879522563030"},
+	{3072, "b98cb0ff3623be03326b373de6b9095218513e64f1ee2edd2525c7ad1e5cffd2"},
+}
+
+// SelfTestResult is the outcome of a single self test check.
+type SelfTestResult struct {
+	Name string
+	Err  error
+}
+
+// SelfTest checks encryption, decryption, checksums, reference parsing and codecs on the current build and platform
+// against the lib known-answer test vectors. It does not touch the network or any keys.
+func SelfTest() []SelfTestResult {
+	results := make([]SelfTestResult, 0)
+	check := func(name string, err error) {
+		results = append(results, SelfTestResult{Name: name, Err: err})
+	}
+
+	for _, vector := range lib.TestVectors() {
+		check(vector.Name, vector.Verify())
+		check(fmt.Sprintf("checksum %s", vector.Name), checkChecksum(vector))
+	}
+
+	check("blake3 checksums", checkBLAKE3())
+	check("object reference parsing", checkObjectReference())
+	check("phrase round trip", checkPhrase())
+	for _, name := range lib.CodecNames() {
+		check(fmt.Sprintf("%s codec round trip", name), checkCodec(name))
+	}
+
+	return results
+}
+
+func checkChecksum(vector *lib.TestVector) error {
+	object, err := vector.ObjectBytes()
+	if err != nil {
+		return err
+	}
+
+	if checksum(object) != vector.Checksum {
+		return fmt.Errorf("checksum does not match the test vector")
+	}
+	return nil
+}
+
+func checkBLAKE3() error {
+	for _, vector := range blake3Vectors {
+		input := make([]byte, vector.length)
+		for i := range input {
+			input[i] = byte(i % 251)
+		}
+
+		sum := blake3.Sum256(input)
+		if hex.EncodeToString(sum[:]) != vector.sum {
+			return fmt.Errorf("checksum of %d bytes does not match the test vector", vector.length)
+		}
+
+		// Hashing in pieces which don't line up with blocks or chunks must give the same checksum.
+		hash := blake3.New()
+		for offset := 0; offset < len(input); offset += 100 {
+			end := offset + 100
+			if end > len(input) {
+				end = len(input)
+			}
+			hash.Write(input[offset:end])
+		}
+		if hex.EncodeToString(hash.Sum(nil)) != vector.sum {
+			return fmt.Errorf("incremental checksum of %d bytes does not match the test vector", vector.length)
+		}
+	}
+	return nil
+}
+
+func checkObjectReference() error {
+	const input = "9b1fd8e2-0c34-4a7e-a4d5-3f8c10f2b7a1#NR4t31dZljhjjqnN-AgmLEltTZh-W2pBQk8O3DSnLLQ="
+
+	or, err := ParseObjectReference(input)
+	if err != nil {
+		return err
+	}
+	if or.Oid != "9b1fd8e2-0c34-4a7e-a4d5-3f8c10f2b7a1" || or.Checksum != "NR4t31dZljhjjqnN-AgmLEltTZh-W2pBQk8O3DSnLLQ=" {
+		return fmt.Errorf("parsed reference does not match")
+	}
+	if or.String() != input {
+		return fmt.Errorf("formatted reference does not match")
+	}
+
+	if _, err := ParseObjectReference("9b1fd8e2-0c34-4a7e-a4d5-3f8c10f2b7a1"); err == nil {
+		return fmt.Errorf("reference without a checksum was accepted")
+	}
+
+	const link = "dead://localhost:4444/9b1fd8e2-0c34-4a7e-a4d5-3f8c10f2b7a1#NR4t31dZljhjjqnN-AgmLEltTZh-W2pBQk8O3DSnLLQ="
+	if or, err = ParseObjectReference(link); err != nil {
+		return err
+	}
+	if or.String() != input || or.Remote != "https://localhost:4444" {
+		return fmt.Errorf("parsed link does not match")
+	}
+	if formatted, err := or.Link(); err != nil || formatted != link {
+		return fmt.Errorf("formatted link does not match")
+	}
+
+	const tagged = "9b1fd8e2-0c34-4a7e-a4d5-3f8c10f2b7a1#blake3:NR4t31dZljhjjqnN-AgmLEltTZh-W2pBQk8O3DSnLLQ="
+	if or, err = ParseObjectReference(tagged); err != nil {
+		return err
+	}
+	if or.Algorithm != ChecksumBLAKE3 || or.Checksum != "NR4t31dZljhjjqnN-AgmLEltTZh-W2pBQk8O3DSnLLQ=" {
+		return fmt.Errorf("parsed reference with a checksum algorithm does not match")
+	}
+	if or.String() != tagged {
+		return fmt.Errorf("formatted reference with a checksum algorithm does not match")
+	}
+	if _, err := ParseObjectReference("9b1fd8e2-0c34-4a7e-a4d5-3f8c10f2b7a1#md5:AAAA"); err == nil {
+		return fmt.Errorf("reference with an unknown checksum algorithm was accepted")
+	}
+	return nil
+}
+
+func checkPhrase() error {
+	const input = "gecko-zebra-acid-yodel#blake3:NR4t31dZljhjjqnN-AgmLEltTZh-W2pBQk8O3DSnLLQ="
+
+	or, err := ParseObjectReference(input)
+	if err != nil {
+		return err
+	}
+	phrase, err := or.Phrase()
+	if err != nil {
+		return err
+	}
+
+	// Phrases are read by the first three letters of their words, separated by dashes or spaces.
+	parsed, err := ParseObjectReference(strings.ToUpper(strings.Replace(phrase, "-", " ", -1)))
+	if err != nil {
+		return err
+	}
+	if parsed.Oid != or.Oid || parsed.Algorithm != ChecksumBLAKE3 || !parsed.Partial {
+		return fmt.Errorf("parsed phrase does not match")
+	}
+	sum, _ := base64.URLEncoding.DecodeString(or.Checksum)
+	if !parsed.matches(sum) {
+		return fmt.Errorf("checksum of parsed phrase does not match")
+	}
+	if parsed.String() != phrase {
+		return fmt.Errorf("formatted phrase does not match")
+	}
+
+	if _, err := (&ObjectReference{Oid: "nidavyihdlxwbbda", Checksum: or.Checksum}).Phrase(); err == nil {
+		return fmt.Errorf("phrase of an oid which isn't made of words was formatted")
+	}
+	return nil
+}
+
+// checkCodec round trips data through a codec. Codec output is not pinned, since compressors may change between
+// Go releases without breaking compatibility.
+func checkCodec(name string) error {
+	data := bytes.Repeat([]byte("dead drop "), 100)
+
+	encoded, err := lib.EncodeWithCodecs([]string{name}, data)
+	if err != nil {
+		return err
+	}
+	decoded, err := lib.DecodeWithCodecs([]string{name}, encoded)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(decoded, data) {
+		return fmt.Errorf("decoded data does not match")
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+package sdk
+
+import "testing"
+
+func TestSelfTest(t *testing.T) {
+	for _, result := range SelfTest() {
+		if result.Err != nil {
+			t.Errorf("%s: %v", result.Name, result.Err)
+		}
+	}
+}
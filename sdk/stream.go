@@ -0,0 +1,281 @@
+package sdk
+
+import (
+	"dead-drop/lib"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"hash"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// objectStream is the encoded object read from a stream of data, which is encoded and encrypted by a goroutine as
+// the object is read.
+type objectStream struct {
+	*io.PipeReader
+	lock   sync.Mutex
+	closed bool
+	done   chan struct{}
+	// err is the error which stopped the object being produced, unless it was stopped by closing the stream.
+	err error
+}
+
+func (client *Client) newObjectStream(r io.Reader, opts *DropOptions) (*objectStream, error) {
+	var produce func(w io.Writer) error
+	switch {
+	case opts.Raw:
+		produce = func(w io.Writer) error {
+			return copyAge(w, r)
+		}
+	case opts.Age:
+		recipients, err := client.ageRecipients()
+		if err != nil {
+			return nil, err
+		}
+		produce = func(w io.Writer) error {
+			return encryptAge(w, recipients, r)
+		}
+	default:
+		objectHeader := &lib.ObjectHeader{
+			Codecs:    opts.codecs(),
+			ChunkSize: lib.DefaultChunkSize,
+			Cipher:    opts.Cipher,
+		}
+		encryptionKey, err := client.dropKey(objectHeader)
+		if err != nil {
+			return nil, err
+		}
+
+		header, err := lib.EncodeHeader(objectHeader)
+		if err != nil {
+			encryptionKey.Destroy()
+			return nil, fmt.Errorf("error building object header: %v", err)
+		}
+		produce = func(w io.Writer) error {
+			return encryptObject(w, encryptionKey, objectHeader, header, r, opts)
+		}
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	stream := &objectStream{
+		PipeReader: pipeReader,
+		done:       make(chan struct{}),
+	}
+
+	go func() {
+		defer close(stream.done)
+
+		err := produce(pipeWriter)
+
+		stream.lock.Lock()
+		if !stream.closed {
+			stream.err = err
+		}
+		stream.lock.Unlock()
+
+		pipeWriter.CloseWithError(err)
+	}()
+
+	return stream, nil
+}
+
+// Close stops the goroutine producing the object, and waits for it to finish reading the data.
+func (stream *objectStream) Close() error {
+	stream.lock.Lock()
+	stream.closed = true
+	stream.lock.Unlock()
+
+	stream.PipeReader.Close()
+	<-stream.done
+	return nil
+}
+
+// encryptObject writes the encoded header, and then the data read from r as an encrypted message. The key is destroyed.
+func encryptObject(
+	w io.Writer,
+	key *memguard.LockedBuffer,
+	objectHeader *lib.ObjectHeader,
+	header []byte,
+	r io.Reader,
+	opts *DropOptions,
+) error {
+	if _, err := w.Write(header); err != nil {
+		key.Destroy()
+		return err
+	}
+
+	encryptWriter, err := lib.NewObjectEncryptWriter(key, objectHeader, header, w)
+	if err != nil {
+		return fmt.Errorf("error encrypting object: %v", err)
+	}
+	defer encryptWriter.Close()
+
+	meta := &lib.ObjectMetadata{
+		Name:     opts.Name,
+		Note:     opts.Note,
+		Format:   opts.Format,
+		Mode:     opts.Mode.Perm(),
+		MimeType: opts.MimeType,
+	}
+	if !opts.Modified.IsZero() {
+		modified := opts.Modified.UTC()
+		meta.Modified = &modified
+	}
+	if err := lib.WriteEnvelope(encryptWriter, meta); err != nil {
+		return fmt.Errorf("error building object envelope: %v", err)
+	}
+
+	encodeWriter, err := lib.NewEncodeWriter(objectHeader.Codecs, encryptWriter)
+	if err != nil {
+		return fmt.Errorf("error encoding object: %v", err)
+	}
+	defer encodeWriter.Close()
+
+	if _, err := io.Copy(encodeWriter, r); err != nil {
+		return fmt.Errorf("error reading object: %v", err)
+	}
+	if err := encodeWriter.Close(); err != nil {
+		return fmt.Errorf("error encoding object: %v", err)
+	}
+	if err := encryptWriter.Close(); err != nil {
+		return fmt.Errorf("error encrypting object: %v", err)
+	}
+	return nil
+}
+
+// uploadBody is the body of an upload request, which computes the checksum of the object as it is sent.
+// The http client may still be reading it when the response arrives, so it is locked.
+type uploadBody struct {
+	lock   sync.Mutex
+	reader io.Reader
+	closer io.Closer
+	hash   hash.Hash
+	size   int64
+	sent   int64
+	eof    bool
+}
+
+func (client *Client) newUploadBody(source objectSource, size int64, algorithm string) (*uploadBody, error) {
+	hash, err := newChecksumHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := source()
+	if err != nil {
+		return nil, err
+	}
+
+	return &uploadBody{
+		reader: client.newProgressReader(object, StageUploading, size),
+		closer: object,
+		hash:   hash,
+		size:   size,
+	}, nil
+}
+
+func (body *uploadBody) Read(p []byte) (int, error) {
+	body.lock.Lock()
+	defer body.lock.Unlock()
+
+	n, err := body.reader.Read(p)
+	body.hash.Write(p[:n])
+	body.sent += int64(n)
+	if err == io.EOF {
+		body.eof = true
+	}
+	return n, err
+}
+
+func (body *uploadBody) Close() error {
+	return body.closer.Close()
+}
+
+// checksum returns the checksum of the object, or "" if it has not been fully sent.
+func (body *uploadBody) checksum() string {
+	body.lock.Lock()
+	defer body.lock.Unlock()
+
+	if !body.eof && (body.size < 0 || body.sent != body.size) {
+		return ""
+	}
+	return encodeChecksum(body.hash.Sum(nil))
+}
+
+// downloadReader reads an object from the remote. At the end of the object, it returns an error instead of io.EOF if
+// the object doesn't match the checksum of its reference.
+type downloadReader struct {
+	client   *Client
+	body     io.ReadCloser
+	reader   io.Reader
+	hash     hash.Hash
+	expected *ObjectReference
+	size     int64
+	ended    bool
+	err      error
+	// burned is set if the remote destroys the object once it has been downloaded.
+	burned bool
+}
+
+func (object *downloadReader) Read(p []byte) (int, error) {
+	if object.err != nil {
+		return 0, object.err
+	}
+
+	n, err := object.reader.Read(p)
+	object.hash.Write(p[:n])
+	object.size += int64(n)
+
+	switch {
+	case err == io.EOF:
+		object.ended = true
+		object.client.stage(StageVerifying, object.size)
+		if !object.expected.matches(object.hash.Sum(nil)) {
+			err = fmt.Errorf("object integrity compromised, discarding unsafe pull")
+		}
+	case err != nil:
+		err = fmt.Errorf("error reading response body: %v", err)
+	}
+
+	object.err = err
+	return n, err
+}
+
+func (object *downloadReader) Close() error {
+	return object.body.Close()
+}
+
+// pullReader reads the data of a streamed pull. When the data ends, it reads out the rest of the object, so that the
+// end of the encrypted message and the checksum of the object are verified before it returns io.EOF.
+type pullReader struct {
+	data      io.ReadCloser
+	plaintext io.ReadCloser
+	object    io.ReadCloser
+	err       error
+}
+
+func (reader *pullReader) Read(p []byte) (int, error) {
+	if reader.err != nil {
+		return 0, reader.err
+	}
+
+	n, err := reader.data.Read(p)
+	if err == io.EOF {
+		if _, drainErr := io.Copy(ioutil.Discard, reader.plaintext); drainErr != nil {
+			err = drainErr
+		} else if _, drainErr := io.Copy(ioutil.Discard, reader.object); drainErr != nil {
+			err = drainErr
+		}
+	}
+
+	reader.err = err
+	return n, err
+}
+
+// Close destroys the decrypted data, and stops the download.
+func (reader *pullReader) Close() error {
+	reader.data.Close()
+	reader.plaintext.Close()
+	return reader.object.Close()
+}
@@ -0,0 +1,119 @@
+package sdk
+
+import (
+	"dead-drop/lib"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenExpiryMargin is how long before its expiry a cached token stops being used, to allow for the time it takes
+// requests to reach the remote.
+const tokenExpiryMargin = time.Second
+
+// tokenScope is what a token is requested for: one of the lib.TokenScope scopes, and optionally one object. Clients
+// request the narrowest scope each request needs, so that a leaked token grants as little as possible.
+type tokenScope struct {
+	scope string
+	oid   string
+}
+
+// pullScope is the scope of requests reading an object, and dropScope that of requests dropping objects, or managing
+// one when oid isn't empty.
+func pullScope(oid string) tokenScope {
+	return tokenScope{scope: lib.TokenScopePull, oid: oid}
+}
+
+func dropScope(oid string) tokenScope {
+	return tokenScope{scope: lib.TokenScopeDrop, oid: oid}
+}
+
+var adminScope = tokenScope{scope: lib.TokenScopeAdmin}
+
+// tokenCache keeps the last token issued to a client for each scope, so that requests made in quick succession (e.g.
+// the parts of an upload, or the ranges of a download) don't each request and decrypt a token of their own.
+type tokenCache struct {
+	lock   sync.Mutex
+	tokens map[tokenScope]cachedToken
+}
+
+type cachedToken struct {
+	token   string
+	expires time.Time
+}
+
+// get returns the cached token of a scope, or "" if there is none or it is about to expire.
+func (cache *tokenCache) get(scope tokenScope) string {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cached, ok := cache.tokens[scope]
+	if !ok || !time.Now().Before(cached.expires) {
+		return ""
+	}
+	return cached.token
+}
+
+// put caches a token of a scope requested at the given time, for as long as the remote said it is valid. Its expiry
+// is measured from when it was requested rather than compared with the remote's clock, which may differ from ours.
+// Expired tokens are forgotten, since tokens scoped to objects are rarely used again.
+func (cache *tokenCache) put(scope tokenScope, token string, requested time.Time) {
+	lifetime, ok := tokenLifetime(token)
+	if !ok || lifetime <= tokenExpiryMargin {
+		return
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	now := time.Now()
+	for cachedScope, cached := range cache.tokens {
+		if !now.Before(cached.expires) {
+			delete(cache.tokens, cachedScope)
+		}
+	}
+	if cache.tokens == nil {
+		cache.tokens = make(map[tokenScope]cachedToken)
+	}
+	cache.tokens[scope] = cachedToken{token: token, expires: requested.Add(lifetime - tokenExpiryMargin)}
+}
+
+// clear forgets the cached token of a scope if it is the given one, e.g. once the remote rejected it.
+func (cache *tokenCache) clear(scope tokenScope, token string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.tokens[scope].token == token {
+		delete(cache.tokens, scope)
+	}
+}
+
+// reset forgets every cached token, e.g. once the remote revoked them all.
+func (cache *tokenCache) reset() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.tokens = nil
+}
+
+// tokenLifetime reads how long a token is valid from its (unverified) iat and exp claims.
+func tokenLifetime(token string) (time.Duration, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, false
+	}
+
+	var claims struct {
+		IssuedAt  int64 `json:"iat"`
+		ExpiresAt int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.IssuedAt == 0 || claims.ExpiresAt == 0 {
+		return 0, false
+	}
+	return time.Duration(claims.ExpiresAt-claims.IssuedAt) * time.Second, true
+}
@@ -0,0 +1,724 @@
+package sdk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"dead-drop/lib"
+	"encoding/json"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Objects of unknown size, or larger than a part, are uploaded in parts of this size. Each part is buffered in memory,
+// so that if sending it fails, it can be sent again without starting the upload over.
+const uploadPartSize = 8 * 1024 * 1024
+
+const maxPartAttempts = 5
+const partRetryDelay = time.Second
+
+var errPartsUnsupported = fmt.Errorf("remote does not support multipart uploads")
+
+// DropOptions control how an object is dropped. The zero value is a valid set of options.
+type DropOptions struct {
+	// Name is the original file name of the object, which recipients may use when saving it.
+	Name string
+	// Note is a short note for recipients.
+	Note string
+	// Codecs are the names of lib codecs to apply to the object before encryption, in order.
+	Codecs []string
+	// Pad pads the object data with lib.CodecPadme after the codecs, so that the object's length reveals little about
+	// the length of its data.
+	Pad bool
+	// Format is how the data is packaged, e.g. lib.FormatTar, which tells recipients how to save it.
+	Format string
+	// Mode and Modified are the permissions and modification time of the original file, which recipients may restore
+	// when saving it. A zero Mode or Modified is left out.
+	Mode     os.FileMode
+	Modified time.Time
+	// MimeType is the media type of the object data, e.g. "text/plain; charset=utf-8".
+	MimeType string
+	// Cipher is the lib AEAD cipher to encrypt the object with, e.g. lib.CipherAES256GCM. It is empty for AES-CTR and
+	// HMAC-SHA-256, which every version of the client can pull.
+	Cipher string
+	// Age encrypts the object as an age file instead, which can be decrypted offline with the age tool. Age objects are
+	// encrypted to X25519 recipients or a passphrase, and have no metadata (Name, Note, Mode, Modified, MimeType and
+	// Format), Codecs, padding or Cipher.
+	Age bool
+	// Raw drops data which is already an age file as it is, e.g. a file encrypted with the age tool.
+	Raw bool
+	// TTL asks the remote to expire the object after this long, if that is sooner than its own ttl. Zero leaves the
+	// object to the remote's ttl. It is rounded up to whole seconds.
+	TTL time.Duration
+	// Burn asks the remote to destroy the object once it has been pulled, even if it keeps other objects until they
+	// expire.
+	Burn bool
+	// MaxPulls asks the remote to destroy the object once it has been pulled this many times, unless it is 0.
+	MaxPulls int
+	// Labels are stored with the object by the remote, so that the objects dropped with this client's key can be
+	// listed by them (see ListOptions). Unlike the Note, they aren't encrypted.
+	Labels map[string]string
+	// Alias drops the object as the next version of the objects dropped under the alias with this client's key, which
+	// can be pulled by name (see ResolveVersion). The remote may only keep a number of the latest versions, removing
+	// older ones as new ones are dropped. Like Labels, it isn't encrypted.
+	Alias string
+	// ReleaseTo holds the object for the named keys, which may only pull it once this client's key hasn't checked in
+	// (see Checkin) for CheckinInterval, which must be shorter than the object's ttl. Until then, only this client's key
+	// may pull it. The interval is rounded up to whole seconds.
+	ReleaseTo       []string
+	CheckinInterval time.Duration
+	// ReleaseAt asks the remote to refuse pulls of the object before this time, even by this client's key, e.g. for an
+	// embargoed release. It must be before the object expires. A zero ReleaseAt allows pulls straight away.
+	ReleaseAt time.Time
+	// Canary drops a decoy object, any pull of which makes the remote raise an alert, e.g. to detect a compromised key.
+	// Whoever pulls it can't tell it from other objects.
+	Canary bool
+	// Checksum is the checksum algorithm of the object's reference, e.g. ChecksumBLAKE3. It is empty for SHA-256,
+	// which every version of the client can verify.
+	Checksum string
+	// Anonymous drops the object without authenticating, to remotes which accept anonymous drops, e.g. inboxes whose
+	// submitters have no key. The client needs no authentication key, and the object is dropped in a single request.
+	Anonymous bool
+}
+
+// checksumAlgorithm returns the algorithm references to objects dropped with the options name: none for SHA-256, so
+// that older clients can pull them.
+func (opts *DropOptions) checksumAlgorithm() string {
+	if opts == nil || opts.Checksum == ChecksumSHA256 {
+		return ""
+	}
+	return opts.Checksum
+}
+
+// codecs returns the codecs the object data is encoded with: the Codecs, followed by the padding codec if Pad is set.
+func (opts *DropOptions) codecs() []string {
+	if !opts.Pad {
+		return opts.Codecs
+	}
+	return append(append([]string{}, opts.Codecs...), lib.CodecPadme)
+}
+
+// DropStream encodes and encrypts the data read from r as it is uploaded, so objects of any size are dropped in
+// constant memory. If r is an io.Seeker, it is rewound from its current position to retry a failed upload;
+// otherwise a failed upload is not retried.
+func (client *Client) DropStream(ctx context.Context, r io.Reader, opts *DropOptions) (*ObjectReference, error) {
+	if opts == nil {
+		opts = &DropOptions{}
+	}
+	if client.keys == nil && !opts.Raw {
+		return nil, fmt.Errorf("no encryption keys configured")
+	}
+	if err := lib.CheckCipher(opts.Cipher); err != nil {
+		return nil, err
+	}
+	if (opts.Age || opts.Raw) && (opts.Note != "" || len(opts.codecs()) > 0 || opts.Format != "" || opts.Cipher != "") {
+		return nil, fmt.Errorf("age objects can't have a note, codecs, padding, format or cipher")
+	}
+	if opts.Age && opts.Raw {
+		return nil, fmt.Errorf("raw objects are already age files")
+	}
+	if opts.TTL < 0 {
+		return nil, fmt.Errorf("negative ttl")
+	}
+	if opts.MaxPulls < 0 {
+		return nil, fmt.Errorf("negative maximum number of pulls")
+	}
+	if err := lib.CheckLabels(opts.Labels); err != nil {
+		return nil, err
+	}
+	if opts.Alias != "" {
+		if err := lib.CheckAlias(opts.Alias); err != nil {
+			return nil, err
+		}
+		if opts.Anonymous {
+			return nil, fmt.Errorf("anonymous objects can't have an alias")
+		}
+	}
+	if len(opts.ReleaseTo) > 0 || opts.CheckinInterval != 0 {
+		if len(opts.ReleaseTo) == 0 || opts.CheckinInterval <= 0 {
+			return nil, fmt.Errorf("objects released to other keys need both the keys and a positive check-in interval")
+		}
+		for _, keyName := range opts.ReleaseTo {
+			if !keyNameRegex.MatchString(keyName) {
+				return nil, fmt.Errorf("invalid key name '%s'", keyName)
+			}
+		}
+		if opts.Anonymous {
+			return nil, fmt.Errorf("anonymous objects can't be released to other keys")
+		}
+	}
+	if opts.Anonymous && (len(opts.Labels) > 0 || !opts.ReleaseAt.IsZero() || opts.Canary) {
+		return nil, fmt.Errorf("anonymous objects can't have labels, a release time or be canaries")
+	}
+
+	seeker, seekable := r.(io.Seeker)
+	start := int64(0)
+	if seekable {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seekable = false
+		}
+	}
+
+	var stream *objectStream
+	source := func() (io.ReadCloser, error) {
+		if stream != nil {
+			stream.Close()
+			if !seekable {
+				return nil, fmt.Errorf("object can't be read again to retry the upload")
+			}
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, fmt.Errorf("error rewinding object to retry the upload: %v", err)
+			}
+		}
+
+		var err error
+		stream, err = client.newObjectStream(r, opts)
+		return stream, err
+	}
+
+	if len(opts.codecs()) > 0 {
+		client.stage(StageEncoding, -1)
+	}
+	if !opts.Raw {
+		client.stage(StageEncrypting, -1)
+	}
+
+	or, err := client.upload(ctx, source, -1, opts)
+	if stream != nil {
+		stream.Close()
+		if stream.err != nil {
+			// The upload failed because the object couldn't be produced, which is the more useful error.
+			return nil, stream.err
+		}
+	}
+	return or, err
+}
+
+// Drop is DropStream for data which is already in memory.
+func (client *Client) Drop(ctx context.Context, data []byte, opts *DropOptions) (*ObjectReference, error) {
+	return client.DropStream(ctx, bytes.NewReader(data), opts)
+}
+
+// PullStream pulls an object from the remote, and returns a reader of its data along with its metadata.
+// Chunked objects are downloaded, verified, decrypted and decoded as the reader is read, in constant memory; objects
+// dropped before chunking are buffered in (guarded) memory, since they can only be verified once fully downloaded.
+// Every chunk is authenticated before its data is returned, but the object as a whole is only verified once the reader
+// returns io.EOF, so on any other error whatever was read must be discarded.
+// The reader must be closed, which destroys the decrypted data.
+func (client *Client) PullStream(ctx context.Context, or *ObjectReference) (io.ReadCloser, *ObjectMetadata, error) {
+	object, err := client.openDownload(ctx, or)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reader, meta, err := client.openObject(object)
+	if err == nil {
+		meta.Burned = object.burned
+	}
+	return reader, meta, err
+}
+
+// openObject verifies and decrypts an encoded object as it is read from object, which verifies its checksum.
+// The object is closed along with the returned reader, or on error.
+func (client *Client) openObject(object io.ReadCloser) (io.ReadCloser, *ObjectMetadata, error) {
+	buffered := bufio.NewReader(object)
+	object = &readCloser{Reader: buffered, Closer: object}
+	if prefix, _ := buffered.Peek(len(lib.AgePrefix)); lib.IsAge(prefix) {
+		return client.openAge(object)
+	}
+
+	header, headerBytes, message, err := lib.ReadHeader(object)
+	if err != nil {
+		object.Close()
+		return nil, nil, err
+	}
+	if header.Kind != "" {
+		object.Close()
+		return nil, nil, fmt.Errorf("object is a %s, not a regular object", header.Kind)
+	}
+
+	encryptionKey, err := client.pullKey(header)
+	if err != nil {
+		object.Close()
+		return nil, nil, err
+	}
+
+	if header.ChunkSize == 0 {
+		defer object.Close()
+		return client.decryptWhole(encryptionKey, header, headerBytes, message)
+	}
+
+	client.stage(StageDecrypting, -1)
+	plaintext, err := lib.NewObjectDecryptReader(encryptionKey, header, headerBytes, message)
+	if err != nil {
+		object.Close()
+		return nil, nil, fmt.Errorf("error decrypting object: %v", err)
+	}
+
+	meta, err := lib.ReadEnvelope(plaintext)
+	if err != nil {
+		plaintext.Close()
+		object.Close()
+		return nil, nil, err
+	}
+
+	if len(header.Codecs) > 0 {
+		client.stage(StageDecoding, -1)
+	}
+	data, err := lib.NewDecodeReader(header.Codecs, plaintext)
+	if err != nil {
+		plaintext.Close()
+		object.Close()
+		return nil, nil, fmt.Errorf("error decoding object: %v", err)
+	}
+
+	return &pullReader{data: data, plaintext: plaintext, object: object}, meta, nil
+}
+
+// decryptWhole decrypts an object which was encrypted whole by lib.Encrypt, buffering it in memory.
+func (client *Client) decryptWhole(
+	encryptionKey *memguard.LockedBuffer,
+	header *lib.ObjectHeader,
+	headerBytes []byte,
+	message io.Reader,
+) (io.ReadCloser, *ObjectMetadata, error) {
+	messageBytes, err := ioutil.ReadAll(message)
+	if err != nil {
+		encryptionKey.Destroy()
+		return nil, nil, err
+	}
+
+	client.stage(StageDecrypting, int64(len(messageBytes)))
+	dataBuf, err := lib.Decrypt(encryptionKey, headerBytes, messageBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decrypting object: %v", err)
+	}
+
+	meta, data, err := lib.OpenEnvelope(dataBuf.Bytes())
+	if err != nil {
+		dataBuf.Destroy()
+		return nil, nil, err
+	}
+
+	if len(header.Codecs) > 0 {
+		client.stage(StageDecoding, int64(len(data)))
+		data, err = lib.DecodeWithCodecs(header.Codecs, data)
+		dataBuf.Destroy()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error decoding object: %v", err)
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), meta, nil
+	}
+
+	return &bufferReadCloser{Reader: bytes.NewReader(data), buf: dataBuf}, meta, nil
+}
+
+// Pull is PullStream for objects which should be read fully into memory.
+func (client *Client) Pull(ctx context.Context, or *ObjectReference) ([]byte, *ObjectMetadata, error) {
+	reader, meta, err := client.PullStream(ctx, or)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	return data, meta, err
+}
+
+// objectSource produces an encoded object to upload. It is called again to retry an upload, and fails if the object
+// can't be produced again.
+type objectSource func() (io.ReadCloser, error)
+
+// bytesSource is the source of an object which is already in memory.
+func bytesSource(data []byte) objectSource {
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+// upload stores an encoded object of the given size (or -1 if unknown) on the remote, returning its reference.
+// The upload is made in an upload session, so that if the response is lost, the oid can be recovered from the session
+// rather than dropping a duplicate object.
+func (client *Client) upload(
+	ctx context.Context,
+	source objectSource,
+	size int64,
+	opts *DropOptions,
+) (*ObjectReference, error) {
+	algorithm := opts.checksumAlgorithm()
+	if _, err := newChecksumHash(algorithm); err != nil {
+		return nil, err
+	}
+
+	if opts.Anonymous {
+		oid, sum, err := client.postObject(ctx, source, size, "", opts)
+		if err != nil {
+			return nil, err
+		}
+		client.logf("uploaded %s anonymously", oid)
+		return &ObjectReference{Oid: oid, Checksum: sum, Algorithm: algorithm, Remote: client.remote}, nil
+	}
+
+	session, err := client.createUploadSession(ctx)
+	if err != nil {
+		// Remotes without upload sessions still accept plain drops.
+		client.logf("upload sessions unavailable, dropping without one: %v", err)
+		session = ""
+	}
+
+	if session != "" && (size < 0 || size > uploadPartSize) {
+		oid, sum, err := client.uploadParts(ctx, source, session, opts)
+		if err != errPartsUnsupported {
+			if err != nil {
+				return nil, err
+			}
+			client.logf("uploaded %s", oid)
+			return &ObjectReference{Oid: oid, Checksum: sum, Algorithm: algorithm, Remote: client.remote}, nil
+		}
+		client.logf("multipart uploads unavailable, dropping in a single request")
+	}
+
+	oid, sum, err := client.postObject(ctx, source, size, session, opts)
+	if err != nil && session != "" && ctx.Err() == nil && !refused(err) {
+		client.logf("drop failed, checking upload session %s: %v", session, err)
+
+		recovered, stored, recoverErr := client.recoverUpload(ctx, session)
+		switch {
+		case recoverErr != nil:
+			client.logf("failed to check upload session: %v", recoverErr)
+		case stored && sum == "":
+			client.logf("upload session holds object %s, but it was not fully sent", recovered)
+		case stored:
+			client.logf("recovered oid %s from upload session", recovered)
+			oid, err = recovered, nil
+		default:
+			client.logf("nothing was stored, retrying drop")
+			oid, sum, err = client.postObject(ctx, source, size, session, opts)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	or := &ObjectReference{
+		Oid:       oid,
+		Checksum:  sum,
+		Algorithm: algorithm,
+		Remote:    client.remote,
+	}
+	client.logf("uploaded %s", or.Oid)
+	return or, nil
+}
+
+// postObject uploads an object, returning its oid, and its checksum if the whole object was sent (even if the upload
+// failed afterwards).
+func (client *Client) postObject(
+	ctx context.Context,
+	source objectSource,
+	size int64,
+	session string,
+	opts *DropOptions,
+) (string, string, error) {
+	body, err := client.newUploadBody(source, size, opts.checksumAlgorithm())
+	if err != nil {
+		return "", "", err
+	}
+
+	path := "/d"
+	if opts.Anonymous {
+		path = "/anonymous/d"
+	}
+	req, err := http.NewRequest("POST", client.url("%s", path), body)
+	if err != nil {
+		body.Close()
+		return "", "", fmt.Errorf("error building request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if session != "" {
+		req.Header.Set(lib.UploadSessionHeader, session)
+	}
+	setDropPolicy(req, opts)
+	req.ContentLength = size
+	req.GetBody = func() (io.ReadCloser, error) {
+		body.Close()
+		if body, err = client.newUploadBody(source, size, opts.checksumAlgorithm()); err != nil {
+			return nil, err
+		}
+		return body, nil
+	}
+
+	var resp *http.Response
+	if opts.Anonymous {
+		resp, err = client.makeAnonymousRequest(ctx, req)
+	} else {
+		resp, err = client.makeAuthenticatedRequest(ctx, dropScope(""), req)
+	}
+	if err != nil {
+		return "", body.checksum(), err
+	}
+	defer resp.Body.Close()
+
+	oid, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", body.checksum(), fmt.Errorf("error reading response body: %v", err)
+	}
+
+	sum := body.checksum()
+	if sum == "" {
+		return "", "", fmt.Errorf("remote accepted the object before it was fully sent")
+	}
+	return string(oid), sum, nil
+}
+
+// uploadParts uploads an object in parts, retrying each part on its own, and then has the remote assemble them,
+// returning the oid and checksum of the object.
+func (client *Client) uploadParts(
+	ctx context.Context,
+	source objectSource,
+	session string,
+	opts *DropOptions,
+) (string, string, error) {
+	hash, err := newChecksumHash(opts.checksumAlgorithm())
+	if err != nil {
+		return "", "", err
+	}
+
+	object, err := source()
+	if err != nil {
+		return "", "", err
+	}
+	defer object.Close()
+
+	reader := client.newProgressReader(object, StageUploading, -1)
+	part := make([]byte, uploadPartSize)
+	parts := 0
+
+	for {
+		n, readErr := io.ReadFull(reader, part)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return "", "", fmt.Errorf("error reading object: %v", readErr)
+		}
+		if n == 0 && parts > 0 {
+			break
+		}
+
+		hash.Write(part[:n])
+		resp, err := client.retryPart(ctx, fmt.Sprintf("upload of part %d", parts), func() (*http.Response, error) {
+			req, err := http.NewRequest("PUT", client.url("/d/session/%s/parts/%d", session, parts), bytes.NewReader(part[:n]))
+			if err != nil {
+				return nil, fmt.Errorf("error building request: %v", err)
+			}
+			req.Header.Set("Content-Type", "application/octet-stream")
+			return client.makeAuthenticatedRequest(ctx, dropScope(""), req)
+		})
+		if err != nil {
+			if parts == 0 && resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed) {
+				return "", "", errPartsUnsupported
+			}
+			return "", "", err
+		}
+		resp.Body.Close()
+		parts++
+
+		if readErr != nil {
+			break
+		}
+	}
+
+	body, err := json.Marshal(lib.CompleteUploadPayload{Parts: parts})
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := client.retryPart(ctx, "completing upload", func() (*http.Response, error) {
+		req, err := http.NewRequest("POST", client.url("/d/session/%s/complete", session), bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("error building request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		setDropPolicy(req, opts)
+		return client.makeAuthenticatedRequest(ctx, dropScope(""), req)
+	})
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	oid, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", fmt.Errorf("error reading response body: %v", err)
+	}
+	return string(oid), encodeChecksum(hash.Sum(nil)), nil
+}
+
+// setDropPolicy asks the remote to destroy the object a request drops as the drop options say, if they are set.
+func setDropPolicy(req *http.Request, opts *DropOptions) {
+	if opts == nil {
+		return
+	}
+	if opts.TTL > 0 {
+		seconds := (opts.TTL + time.Second - 1) / time.Second
+		req.Header.Set(lib.ObjectTTLHeader, strconv.FormatInt(int64(seconds), 10))
+	}
+	if opts.Burn {
+		req.Header.Set(lib.BurnHeader, "true")
+	}
+	if opts.MaxPulls > 0 {
+		req.Header.Set(lib.MaxPullsHeader, strconv.Itoa(opts.MaxPulls))
+	}
+	if len(opts.Labels) > 0 {
+		req.Header.Set(lib.LabelsHeader, lib.FormatLabels(opts.Labels))
+	}
+	if opts.Alias != "" {
+		req.Header.Set(lib.AliasHeader, opts.Alias)
+	}
+	if len(opts.ReleaseTo) > 0 {
+		seconds := (opts.CheckinInterval + time.Second - 1) / time.Second
+		req.Header.Set(lib.ReleaseToHeader, strings.Join(opts.ReleaseTo, ","))
+		req.Header.Set(lib.CheckinIntervalHeader, strconv.FormatInt(int64(seconds), 10))
+	}
+	if !opts.ReleaseAt.IsZero() {
+		req.Header.Set(lib.ReleaseAtHeader, opts.ReleaseAt.UTC().Format(time.RFC3339))
+	}
+	if opts.Canary {
+		req.Header.Set(lib.CanaryHeader, "true")
+	}
+}
+
+// retryPart makes a request of a multipart upload until it succeeds, or fails with a client error other than a
+// conflict (e.g. the remote is still assembling the parts of an earlier attempt to complete the upload),
+// or fails maxPartAttempts times.
+func (client *Client) retryPart(
+	ctx context.Context,
+	what string,
+	request func() (*http.Response, error),
+) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := request()
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil || attempt == maxPartAttempts ||
+			(resp != nil && resp.StatusCode < 500 && resp.StatusCode != http.StatusConflict) {
+			return resp, err
+		}
+
+		client.logf("%s failed (attempt %d of %d), retrying: %v", what, attempt, maxPartAttempts, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(attempt) * partRetryDelay):
+		}
+	}
+}
+
+func (client *Client) createUploadSession(ctx context.Context) (string, error) {
+	req, err := http.NewRequest("POST", client.url("/d/session"), nil)
+	if err != nil {
+		return "", fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := client.makeAuthenticatedRequest(ctx, dropScope(""), req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	session, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading response body: %v", err)
+	}
+	return string(session), nil
+}
+
+// recoverUpload checks whether an object was stored in an upload session, returning its oid if so.
+func (client *Client) recoverUpload(ctx context.Context, session string) (string, bool, error) {
+	req, err := http.NewRequest("GET", client.url("/d/session/%s", session), nil)
+	if err != nil {
+		return "", false, fmt.Errorf("error building request: %v", err)
+	}
+
+	// Use the internal request, since 204 is an expected status here.
+	resp, err := client.makeAuthenticatedRequestInternal(ctx, dropScope(""), req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		oid, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return "", false, fmt.Errorf("error reading response body: %v", err)
+		}
+		return string(oid), true, nil
+	case http.StatusNoContent:
+		return "", false, nil
+	default:
+		return "", false, fmt.Errorf("request failed with status: %s", resp.Status)
+	}
+}
+
+// download fetches an encoded object from the remote, and verifies it against its reference.
+func (client *Client) download(ctx context.Context, or *ObjectReference) ([]byte, error) {
+	object, err := client.openDownload(ctx, or)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	return ioutil.ReadAll(object)
+}
+
+// openDownload starts fetching an encoded object from the remote, returning a reader which verifies it against its
+// reference once it has been read to the end.
+func (client *Client) openDownload(ctx context.Context, or *ObjectReference) (*downloadReader, error) {
+	hash, err := or.newHash()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", client.url("/d/%s", or.Oid), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %v", err)
+	}
+
+	resp, err := client.makeAuthenticatedRequest(ctx, pullScope(or.Oid), req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &downloadReader{
+		client:   client,
+		body:     resp.Body,
+		reader:   client.newProgressReader(resp.Body, StageDownloading, resp.ContentLength),
+		hash:     hash,
+		expected: or,
+		burned:   resp.Header.Get(lib.BurnHeader) == "true",
+	}, nil
+}
+
+// readCloser closes a reader which wraps another.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// bufferReadCloser reads from a guarded buffer, and destroys it when closed.
+type bufferReadCloser struct {
+	*bytes.Reader
+	buf *memguard.LockedBuffer
+}
+
+func (reader *bufferReadCloser) Close() error {
+	reader.buf.Destroy()
+	return nil
+}
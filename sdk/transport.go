@@ -0,0 +1,51 @@
+package sdk
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// Timeouts bound the phases of each request which don't depend on the size of the object, so that a remote which
+// stops responding fails the request instead of hanging it. Transfers themselves are never timed out; zero values
+// disable a timeout.
+type Timeouts struct {
+	// Dial bounds connecting to the remote (or proxy).
+	Dial time.Duration
+	// TLSHandshake bounds the tls handshake.
+	TLSHandshake time.Duration
+	// ResponseHeader bounds the wait for the response once the request is sent, which includes the remote storing or
+	// assembling an uploaded object.
+	ResponseHeader time.Duration
+}
+
+// DefaultTimeouts are the timeouts of clients created without WithHTTPClient.
+var DefaultTimeouts = Timeouts{
+	Dial:           30 * time.Second,
+	TLSHandshake:   15 * time.Second,
+	ResponseHeader: 5 * time.Minute,
+}
+
+// defaultTransport is shared by clients created without WithHTTPClient, so that they reuse connections.
+var defaultTransport = NewTransport(DefaultTimeouts)
+
+// NewTransport creates an http transport with the given timeouts, which keeps connections alive so that the token
+// request and the request it authenticates share one. The proxy is taken from the environment, as with
+// http.DefaultTransport. In-memory remotes are served in-process.
+func NewTransport(timeouts Timeouts) *http.Transport {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   timeouts.Dial,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   timeouts.TLSHandshake,
+		ResponseHeaderTimeout: timeouts.ResponseHeader,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   8,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	transport.RegisterProtocol(MemoryScheme, memoryTransport{})
+	return transport
+}
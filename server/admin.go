@@ -0,0 +1,244 @@
+package server
+
+import (
+	"dead-drop/lib"
+	"encoding/json"
+	"fmt"
+	"github.com/google/logger"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// adminRoutes registers the endpoints of the admin api on a router, which operate the whole server on behalf of admin
+// keys of the default namespace, so that admins needn't reach its data directory.
+func (handler *Handler) adminRoutes(router *mux.Router) {
+	router.Handle("/admin/objects", handler.admin(handler.handleAdminObjects)).Methods("GET")
+	router.Handle("/admin/objects/{oid}", handler.admin(handler.handleAdminRemove)).Methods("DELETE")
+	router.Handle("/admin/usage", handler.admin(handler.handleAdminUsage)).Methods("GET")
+	router.Handle("/admin/gc", handler.admin(handler.handleAdminGC)).Methods("POST")
+	router.Handle("/admin/rotate-secret", handler.admin(handler.handleAdminRotateSecret)).Methods("POST")
+	router.Handle("/admin/keys", handler.admin(handler.handleAdminKeys)).Methods("GET")
+}
+
+// admin authenticates requests to the admin api, which take admin keys of the default namespace, since they reach
+// the objects and keys of every namespace.
+func (handler *Handler) admin(h http.HandlerFunc) http.Handler {
+	return handler.limitIP(handler.requireActive(handler.authenticate(handler.requireRole(permissionAdmin,
+		handler.requireScope(permissionAdmin, handler.requireDefaultNamespace(handler.limitKey(h)))))))
+}
+
+// requireDefaultNamespace refuses requests of keys of namespaces other than the default one.
+func (handler *Handler) requireDefaultNamespace(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		keyName, namespace := requestKeyName(req), requestKeyNamespace(req)
+		if namespace != "" {
+			logger.Warningf("Refused admin request of key %s of namespace %s", keyName, namespace)
+			handler.audit(req, auditAuthFailure, keyName, "", "key of namespace "+namespace+" refused admin api")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = fmt.Fprintf(w, "key %s is in namespace %s, and only keys of the default namespace may use the "+
+				"admin api", keyName, namespace)
+			return
+		}
+
+		h(w, req)
+	}
+}
+
+// handleAdminObjects lists the objects of every key which the request's filter selects, in pages of up to the
+// requested limit.
+func (handler *Handler) handleAdminObjects(w http.ResponseWriter, req *http.Request) {
+	limit, filter, ok := parseListRequest(req)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	objects, next, err := handler.db.allObjects(filter, req.URL.Query().Get("after"), limit)
+	if err == InvalidCursorErr {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	payload := lib.AdminObjectsPayload{
+		Objects: objects,
+		Next:    next,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		logger.Errorf("Failed to write admin listing response: %v", err)
+	}
+}
+
+// handleAdminRemove removes an object whichever key dropped it.
+func (handler *Handler) handleAdminRemove(w http.ResponseWriter, req *http.Request) {
+	oid := mux.Vars(req)["oid"]
+	if !handler.db.destroyObject(oid) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	logger.Infof("Removed object %s on request of admin key %s", oid, requestKeyName(req))
+	handler.audit(req, auditObjectRemoved, requestKeyName(req), oid, "removed by admin")
+}
+
+// handleAdminUsage reports the storage used by the objects of every key and namespace.
+func (handler *Handler) handleAdminUsage(w http.ResponseWriter, req *http.Request) {
+	count, _ := handler.db.stats()
+	keys, namespaces := handler.db.quotas.snapshot()
+
+	payload := lib.UsagePayload{
+		Objects:    count,
+		Bytes:      handler.db.storedBytes(),
+		Keys:       keys,
+		Namespaces: namespaces,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		logger.Errorf("Failed to write usage response: %v", err)
+	}
+}
+
+// handleAdminGC removes expired objects now, rather than on the expiry job's next run. It is refused while the clock
+// guard pauses garbage collection, since the clock can't be trusted to tell which objects expired.
+func (handler *Handler) handleAdminGC(w http.ResponseWriter, req *http.Request) {
+	if !handler.db.clockGuard.allowGC() {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = io.WriteString(w, "garbage collection is paused until the clock is trusted again")
+		return
+	}
+
+	objects, bytes := handler.db.expire()
+	logger.Infof("Garbage collected %d objects of %d bytes on request of admin key %s", objects, bytes,
+		requestKeyName(req))
+	handler.audit(req, auditGCForced, requestKeyName(req), "", fmt.Sprintf("%d objects of %d bytes", objects, bytes))
+
+	payload := lib.GCPayload{
+		Objects: objects,
+		Bytes:   bytes,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		logger.Errorf("Failed to write gc response: %v", err)
+	}
+}
+
+// handleAdminRotateSecret replaces the secret tokens are signed with, and with Revoke, rejects every token issued
+// before, including the requesting key's.
+func (handler *Handler) handleAdminRotateSecret(w http.ResponseWriter, req *http.Request) {
+	var payload lib.RotateSecretPayload
+	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil && err != io.EOF {
+		logger.Errorf("Failed to decode payload: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	detail := "rotated"
+	if payload.Revoke {
+		handler.auth.revokeSecrets()
+		detail = "revoked"
+	} else {
+		handler.auth.rotateSecret()
+	}
+	logger.Infof("Token secret %s on request of admin key %s", detail, requestKeyName(req))
+	handler.audit(req, auditSecretRotated, requestKeyName(req), "", detail)
+}
+
+// handleAdminKeys lists the authorized keys of every namespace, with their roles.
+func (handler *Handler) handleAdminKeys(w http.ResponseWriter, req *http.Request) {
+	keys, err := handler.auth.keySummaries()
+	if err != nil {
+		logger.Errorf("Failed to list authorized keys: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(lib.KeysPayload{Keys: keys}); err != nil {
+		logger.Errorf("Failed to write keys response: %v", err)
+	}
+}
+
+// keySummaries describes every authorized key, ordered by name.
+func (auth *Authenticator) keySummaries() ([]lib.KeySummary, error) {
+	keys, err := auth.authorizedKeys()
+	if err != nil {
+		return nil, err
+	}
+	roles, err := auth.keyRoles()
+	if err != nil {
+		return nil, err
+	}
+	namespaces, err := auth.keyNamespaces()
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]lib.KeySummary, 0, len(keys))
+	for keyName := range keys {
+		role := roles[keyName]
+		if role == "" {
+			role = auth.defaultKeyRole
+		}
+		summaries = append(summaries, lib.KeySummary{
+			KeyName:   keyName,
+			Role:      role,
+			Namespace: namespaces[keyName],
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].KeyName < summaries[j].KeyName
+	})
+	return summaries, nil
+}
+
+// allObjects lists the stored objects of every key which a filter selects, oldest first, starting after the cursor of
+// an earlier page. It returns at most limit objects, and the cursor of the next page, or "" if there are no more.
+func (db *Database) allObjects(filter listFilter, after string, limit int) ([]lib.AdminObjectSummary, string, error) {
+	afterCreated, afterOid, err := parseListCursor(after)
+	if err != nil {
+		return nil, "", err
+	}
+	afterCreated, afterOid = filter.start(afterCreated, afterOid)
+
+	summaries := make([]lib.AdminObjectSummary, 0)
+	for _, oi := range db.objects() {
+		if afterOid != "" && !listedAfter(oi.created, oi.oid, afterCreated, afterOid) {
+			continue
+		}
+		if filter.ended(oi.created) {
+			break
+		}
+
+		meta, err := db.objectMeta(oi.oid)
+		if err != nil {
+			return nil, "", err
+		} else if meta == nil {
+			// The object was removed since it was listed.
+			continue
+		}
+		size, err := db.objectSize(oi.oid, meta)
+		if err != nil || !filter.matches(meta.Owner, oi.created, size, meta.Labels) {
+			continue
+		}
+
+		if len(summaries) == limit {
+			last := summaries[len(summaries)-1]
+			return summaries, listCursor(last.Created, last.Oid), nil
+		}
+		summaries = append(summaries, lib.AdminObjectSummary{
+			Oid:       oi.oid,
+			Owner:     meta.Owner,
+			Namespace: meta.Namespace,
+			Size:      size,
+			Created:   oi.created,
+			Expires:   oi.expires,
+			Labels:    meta.Labels,
+		})
+	}
+	return summaries, "", nil
+}
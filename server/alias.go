@@ -0,0 +1,177 @@
+package server
+
+import (
+	"sort"
+	"sync"
+)
+
+const AliasOwnedErr = Error("the alias has versions dropped by another key")
+const AnonymousAliasErr = Error("anonymous drops can't have an alias")
+
+// aliasName is an alias of a namespace. Aliases of different namespaces are unrelated.
+type aliasName struct {
+	namespace string
+	alias     string
+}
+
+// aliasVersion is a stored object dropped under an alias, and its version number.
+type aliasVersion struct {
+	version int
+	oid     string
+}
+
+// aliasHistory is the stored versions of an alias, oldest first. The key which dropped them owns the alias until every
+// one of them is removed, and version numbers aren't reused until then.
+type aliasHistory struct {
+	owner    string
+	versions []aliasVersion
+	// last is the latest version number given, and pending counts the versions given which are still being stored.
+	last    int
+	pending int
+}
+
+// aliases indexes the stored objects dropped under an alias by their version.
+type aliases struct {
+	lock      sync.Mutex
+	histories map[aliasName]*aliasHistory
+	// retain is how many versions of an alias are kept, or 0 to keep every one until it is removed.
+	retain int
+}
+
+func newAliases(retain int) *aliases {
+	return &aliases{histories: make(map[aliasName]*aliasHistory), retain: retain}
+}
+
+// indexAliases indexes the versions of the stored objects which were dropped under an alias.
+func indexAliases(objectMap map[string]bool, metas metaStore, retain int) (*aliases, error) {
+	aliases := newAliases(retain)
+	err := metas.each(func(oid string, meta *ObjectMeta) {
+		if meta.Alias != "" && objectMap[oid] {
+			aliases.record(meta.Namespace, meta.Alias, meta.Owner, meta.Version, oid)
+		}
+	})
+	return aliases, err
+}
+
+// reserve gives the next version number of an alias to an object the named key of a namespace is dropping, returning
+// AliasOwnedErr if another key owns the alias. The object must then be added, or the version cancelled.
+func (aliases *aliases) reserve(namespace string, alias string, owner string) (int, error) {
+	if owner == "" {
+		return 0, AnonymousAliasErr
+	}
+
+	aliases.lock.Lock()
+	defer aliases.lock.Unlock()
+
+	name := aliasName{namespace, alias}
+	history := aliases.histories[name]
+	if history == nil {
+		history = &aliasHistory{owner: owner}
+		aliases.histories[name] = history
+	} else if history.owner != owner {
+		return 0, AliasOwnedErr
+	}
+
+	history.last++
+	history.pending++
+	return history.last, nil
+}
+
+// cancel gives up a version reserved for an object which wasn't stored.
+func (aliases *aliases) cancel(namespace string, alias string) {
+	aliases.lock.Lock()
+	defer aliases.lock.Unlock()
+
+	name := aliasName{namespace, alias}
+	if history := aliases.histories[name]; history != nil {
+		history.pending--
+		aliases.forgetIfEmpty(name, history)
+	}
+}
+
+// add indexes a stored object as the version of an alias reserved for it, returning the oids of the versions which
+// are no longer retained, which the caller must remove.
+func (aliases *aliases) add(namespace string, alias string, version int, oid string) []string {
+	aliases.lock.Lock()
+	defer aliases.lock.Unlock()
+
+	history := aliases.histories[aliasName{namespace, alias}]
+	history.pending--
+	history.insert(aliasVersion{version: version, oid: oid})
+
+	if aliases.retain == 0 || len(history.versions) <= aliases.retain {
+		return nil
+	}
+	var pruned []string
+	for _, old := range history.versions[:len(history.versions)-aliases.retain] {
+		pruned = append(pruned, old.oid)
+	}
+	history.versions = append([]aliasVersion{}, history.versions[len(history.versions)-aliases.retain:]...)
+	return pruned
+}
+
+// record indexes a stored object as a version of an alias which was given to it before, e.g. by the primary it was
+// replicated from.
+func (aliases *aliases) record(namespace string, alias string, owner string, version int, oid string) {
+	aliases.lock.Lock()
+	defer aliases.lock.Unlock()
+
+	name := aliasName{namespace, alias}
+	history := aliases.histories[name]
+	if history == nil {
+		history = &aliasHistory{owner: owner}
+		aliases.histories[name] = history
+	}
+	history.insert(aliasVersion{version: version, oid: oid})
+	if version > history.last {
+		history.last = version
+	}
+}
+
+// remove drops a removed object from the versions of its alias.
+func (aliases *aliases) remove(namespace string, alias string, oid string) {
+	aliases.lock.Lock()
+	defer aliases.lock.Unlock()
+
+	name := aliasName{namespace, alias}
+	history := aliases.histories[name]
+	if history == nil {
+		return
+	}
+	for i, version := range history.versions {
+		if version.oid == oid {
+			history.versions = append(history.versions[:i:i], history.versions[i+1:]...)
+			break
+		}
+	}
+	aliases.forgetIfEmpty(name, history)
+}
+
+// versions returns the stored versions of an alias, oldest first.
+func (aliases *aliases) versions(namespace string, alias string) []aliasVersion {
+	aliases.lock.Lock()
+	defer aliases.lock.Unlock()
+
+	history := aliases.histories[aliasName{namespace, alias}]
+	if history == nil {
+		return nil
+	}
+	return append([]aliasVersion{}, history.versions...)
+}
+
+// forgetIfEmpty drops the history of an alias with no versions left, so that any key may drop under it again.
+func (aliases *aliases) forgetIfEmpty(name aliasName, history *aliasHistory) {
+	if len(history.versions) == 0 && history.pending == 0 {
+		delete(aliases.histories, name)
+	}
+}
+
+// insert adds a version to the history, in order of version number.
+func (history *aliasHistory) insert(version aliasVersion) {
+	i := sort.Search(len(history.versions), func(i int) bool {
+		return history.versions[i].version >= version.version
+	})
+	history.versions = append(history.versions, aliasVersion{})
+	copy(history.versions[i+1:], history.versions[i:])
+	history.versions[i] = version
+}
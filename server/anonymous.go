@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"github.com/google/logger"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+const AnonymousPolicyErr = Error("anonymous drops may only set a ttl, burn or a maximum of pulls")
+
+// anonymousDrops configures drops without a key, e.g. for an inbox whose submitters have none. Anonymously dropped
+// objects have no owner, so they count against the quota of objects of no key, and can't be listed or removed, only
+// pulled by keys of their namespace.
+type anonymousDrops struct {
+	// maxBytes caps the size of each object.
+	maxBytes  int64
+	namespace string
+	// limiter limits the anonymous drops made from each IP address, or is nil if they aren't limited.
+	limiter *rateLimiter
+}
+
+// handleAnonymousDrop stores an object dropped without authenticating. Objects over the size cap are refused before
+// their body is read if it has a Content-Length, and once it reaches the cap otherwise.
+func (handler *Handler) handleAnonymousDrop(w http.ResponseWriter, req *http.Request) {
+	anonymous := handler.anonymous
+	if rateLimited(w, anonymous.limiter, remoteIP(req)) {
+		return
+	}
+
+	policy, ok := requestDropPolicy(req)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !policy.allowsAnonymous() {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(w, AnonymousPolicyErr.Error())
+		return
+	}
+
+	if req.ContentLength > anonymous.maxBytes {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_, _ = fmt.Fprintf(w, "anonymous drops are limited to %d bytes", anonymous.maxBytes)
+		return
+	}
+	if req.ContentLength > 0 {
+		if err := handler.db.checkQuota("", anonymous.namespace, req.ContentLength); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = io.WriteString(w, err.Error())
+			return
+		}
+	}
+	limit := anonymous.maxBytes
+	if remaining, limited := handler.db.quotaRemaining("", anonymous.namespace); limited && remaining < limit {
+		limit = remaining
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, limit)
+
+	bytes, err := ioutil.ReadAll(req.Body)
+	if err != nil && int64(len(bytes)) >= limit {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_, _ = fmt.Fprintf(w, "the object exceeds the %d bytes anonymous drops may store", limit)
+		return
+	} else if err != nil {
+		logger.Errorf("Failed to read object body: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	oid, err := handler.db.drop(bytes, "", anonymous.namespace, policy)
+	if dropRefused(err) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = io.WriteString(w, err.Error())
+		return
+	} else if err != nil {
+		logger.Errorf("Failed to store object: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	handler.audit(req, auditObjectDropped, "", oid, "anonymous, "+strconv.Itoa(len(bytes))+" bytes")
+
+	if _, err := io.WriteString(w, oid); err != nil {
+		logger.Errorf("Failed to write object response: %v", err)
+	}
+}
+
+// allowsAnonymous returns whether a drop policy only sets how the object is destroyed, which is all anonymous drops
+// may set. Every anonymous object has the same owner of no key, so any submitter could otherwise drop new versions of
+// another's alias, which removes the older ones, and labels, releases and canaries only make sense for an owner.
+func (policy dropPolicy) allowsAnonymous() bool {
+	return len(policy.labels) == 0 && policy.alias == "" && len(policy.releaseTo) == 0 && policy.checkinInterval == 0 &&
+		policy.releaseAt.IsZero() && !policy.canary
+}
@@ -0,0 +1,471 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"dead-drop/lib"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/google/logger"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// Data sealed at rest starts with this magic, followed by the nonce and the data key wrapped by the master key.
+const sealedMagic = "DDSEAL01"
+const sealedNonceLen = 12
+const sealedDataKeyLen = 32
+const sealedHeaderLen = len(sealedMagic) + sealedNonceLen + sealedDataKeyLen + 16
+
+// Owners of sealed metadata are recorded under this prefix, followed by a pseudonym of their name.
+const sealedOwnerPrefix = "sealed:"
+
+// atRestSealer seals object data and metadata with a key of their own, which is wrapped by a master key and stored
+// along with them, so that a copy of the storage alone reveals neither the client's ciphertext nor metadata.
+// Objects are encrypted with AES-256-CTR, which can be read from any offset, so that pulls can resume; they are
+// already authenticated by the clients which encrypted them. Metadata is encrypted with AES-256-GCM.
+type atRestSealer struct {
+	wrap cipher.AEAD
+	// ownerKey keys the pseudonyms which owners are recorded under, so that the objects of a key can still be found.
+	ownerKey []byte
+}
+
+// newAtRestSealer returns the sealer of a 32 byte master key.
+func newAtRestSealer(masterKey []byte) (*atRestSealer, error) {
+	if len(masterKey) != 32 {
+		return nil, fmt.Errorf("the master key must be 32 bytes, not %d", len(masterKey))
+	}
+	block, err := aes.NewCipher(deriveAtRestKey(masterKey, "wrap"))
+	if err != nil {
+		return nil, err
+	}
+	wrap, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &atRestSealer{wrap: wrap, ownerKey: deriveAtRestKey(masterKey, "owner")}, nil
+}
+
+// newAtRestSealerFromConfig returns the sealer of the configured master key, given in base64, or wrapped by a key
+// manager if one is configured, or nil if no key is configured.
+func newAtRestSealerFromConfig(encodedKey string, keyManagerURL string) (*atRestSealer, error) {
+	if encodedKey == "" {
+		if keyManagerURL != "" {
+			return nil, fmt.Errorf("%s is set without %s", atRestKMSFlag, atRestKeyFlag)
+		}
+		return nil, nil
+	}
+
+	var masterKey []byte
+	var err error
+	if keyManagerURL == "" {
+		masterKey, err = base64.StdEncoding.DecodeString(encodedKey)
+	} else {
+		var keyManager lib.KeyManager
+		if keyManager, err = lib.NewKeyManager(keyManagerURL); err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), lib.KeyManagerTimeout)
+		defer cancel()
+		if masterKey, err = keyManager.Decrypt(ctx, encodedKey); err != nil {
+			return nil, fmt.Errorf("failed to unwrap the master key with %s: %v", keyManager, err)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", atRestKeyFlag, err)
+	}
+	return newAtRestSealer(masterKey)
+}
+
+func deriveAtRestKey(masterKey []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte("dead-drop at rest " + purpose))
+	return mac.Sum(nil)
+}
+
+// newDataKey generates the data key of an object, returning it and the header to store before the data it seals,
+// which binds the key to the object's oid.
+func (sealer *atRestSealer) newDataKey(oid string) ([]byte, []byte, error) {
+	dataKey := make([]byte, sealedDataKeyLen)
+	nonce := make([]byte, sealedNonceLen)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	header := append([]byte(sealedMagic), nonce...)
+	return dataKey, sealer.wrap.Seal(header, nonce, dataKey, []byte(oid)), nil
+}
+
+// dataKey unwraps the data key of an object from the header stored before its data.
+func (sealer *atRestSealer) dataKey(oid string, header []byte) ([]byte, error) {
+	if !isSealed(header) || len(header) < sealedHeaderLen {
+		return nil, fmt.Errorf("object %s isn't sealed", oid)
+	}
+	nonce, wrapped := header[len(sealedMagic):len(sealedMagic)+sealedNonceLen], header[len(sealedMagic)+sealedNonceLen:]
+	dataKey, err := sealer.wrap.Open(nil, nonce, wrapped[:sealedHeaderLen-len(sealedMagic)-sealedNonceLen], []byte(oid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap the data key of object %s: it was sealed with another key", oid)
+	}
+	return dataKey, nil
+}
+
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(sealedMagic))
+}
+
+// dataStream returns the keystream of a data key from an offset of the data.
+func dataStream(dataKey []byte, offset int64) (cipher.Stream, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	// Each data key seals a single object, so the counter starts at 0.
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(offset/aes.BlockSize))
+	stream := cipher.NewCTR(block, iv)
+	skip := make([]byte, offset%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+	return stream, nil
+}
+
+// owner returns the pseudonym an owner is recorded under, which is the same for every object of the owner.
+func (sealer *atRestSealer) owner(keyName string) string {
+	if keyName == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, sealer.ownerKey)
+	mac.Write([]byte(keyName))
+	return sealedOwnerPrefix + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// sealedObjectStore seals the data of objects before storing it in another store. Objects stored before sealing was
+// configured are read as they are.
+type sealedObjectStore struct {
+	store  objectStore
+	sealer *atRestSealer
+}
+
+func (store *sealedObjectStore) put(oid string, data []byte) error {
+	dataKey, header, err := store.sealer.newDataKey(oid)
+	if err != nil {
+		return err
+	}
+	stream, err := dataStream(dataKey, 0)
+	if err != nil {
+		return err
+	}
+
+	sealed := make([]byte, len(header)+len(data))
+	copy(sealed, header)
+	stream.XORKeyStream(sealed[len(header):], data)
+	return store.store.put(oid, sealed)
+}
+
+// putFile seals the file into another one beside it, which the store takes.
+func (store *sealedObjectStore) putFile(oid string, path string) error {
+	dataKey, header, err := store.sealer.newDataKey(oid)
+	if err != nil {
+		return err
+	}
+	stream, err := dataStream(dataKey, 0)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	sealedPath := path + ".sealed"
+	out, err := os.OpenFile(sealedPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, lib.ObjectPerms)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(header)
+	if err == nil {
+		_, err = io.Copy(cipher.StreamWriter{S: stream, W: out}, in)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(sealedPath)
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		os.Remove(sealedPath)
+		return err
+	}
+	return store.store.putFile(oid, sealedPath)
+}
+
+func (store *sealedObjectStore) open(oid string) (ObjectReader, int64, error) {
+	object, size, err := store.store.open(oid)
+	if err != nil {
+		return nil, 0, err
+	}
+	header := make([]byte, sealedHeaderLen)
+	n, err := io.ReadFull(object, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		object.Close()
+		return nil, 0, err
+	}
+	if !isSealed(header[:n]) {
+		// Objects stored before sealing was configured.
+		if _, err := object.Seek(0, io.SeekStart); err != nil {
+			object.Close()
+			return nil, 0, err
+		}
+		return object, size, nil
+	}
+
+	dataKey, err := store.sealer.dataKey(oid, header[:n])
+	if err != nil {
+		object.Close()
+		return nil, 0, err
+	}
+	return &sealedObject{object: object, dataKey: dataKey, size: size - int64(sealedHeaderLen)},
+		size - int64(sealedHeaderLen), nil
+}
+
+// stat reads the start of the object, to tell whether it is sealed.
+func (store *sealedObjectStore) stat(oid string) (int64, time.Time, error) {
+	_, modified, err := store.store.stat(oid)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	object, size, err := store.open(oid)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	object.Close()
+	return size, modified, nil
+}
+
+func (store *sealedObjectStore) remove(oid string) error {
+	return store.store.remove(oid)
+}
+
+func (store *sealedObjectStore) list(fn func(oid string, modified time.Time)) error {
+	return store.store.list(fn)
+}
+
+func (store *sealedObjectStore) ping(ctx context.Context) error {
+	return store.store.ping(ctx)
+}
+
+func (store *sealedObjectStore) String() string {
+	return store.store.String() + ", sealed"
+}
+
+// sealedObject decrypts a sealed object as it is read, from wherever it is sought to.
+type sealedObject struct {
+	object  ObjectReader
+	dataKey []byte
+	size    int64
+	offset  int64
+	// stream is the keystream from the offset, or nil if it must be started again after a seek.
+	stream cipher.Stream
+}
+
+func (object *sealedObject) Read(p []byte) (int, error) {
+	if object.stream == nil {
+		stream, err := dataStream(object.dataKey, object.offset)
+		if err != nil {
+			return 0, err
+		}
+		object.stream = stream
+	}
+
+	n, err := object.object.Read(p)
+	object.stream.XORKeyStream(p[:n], p[:n])
+	object.offset += int64(n)
+	return n, err
+}
+
+func (object *sealedObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += object.offset
+	case io.SeekEnd:
+		offset += object.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek to negative offset %d", offset)
+	}
+
+	if _, err := object.object.Seek(int64(sealedHeaderLen)+offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	object.offset = offset
+	object.stream = nil
+	return offset, nil
+}
+
+func (object *sealedObject) Close() error {
+	return object.object.Close()
+}
+
+// sealedMetaStore seals metadata before storing it in another store. Only the creation time of objects is left in the
+// clear, and a pseudonym of their owner, which stores list objects by. Metadata stored before sealing was configured
+// is read as it is, and sealed when it is next written.
+type sealedMetaStore struct {
+	metas  metaStore
+	sealer *atRestSealer
+}
+
+func (store *sealedMetaStore) seal(oid string, meta *ObjectMeta) (*ObjectMeta, error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, header, err := store.sealer.newDataKey(oid)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each data key seals a single version of the metadata, so the nonce is always 0.
+	return &ObjectMeta{
+		Owner:   store.sealer.owner(meta.Owner),
+		Created: meta.Created,
+		Sealed:  aead.Seal(header, make([]byte, aead.NonceSize()), data, nil),
+	}, nil
+}
+
+func (store *sealedMetaStore) unseal(oid string, sealed *ObjectMeta) (*ObjectMeta, error) {
+	if sealed == nil || sealed.Sealed == nil {
+		return sealed, nil
+	}
+	dataKey, err := store.sealer.dataKey(oid, sealed.Sealed)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	data, err := aead.Open(nil, make([]byte, aead.NonceSize()), sealed.Sealed[sealedHeaderLen:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unseal the metadata of object %s: %v", oid, err)
+	}
+
+	meta := &ObjectMeta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// unsealing calls fn with the unsealed metadata given to the returned function, skipping metadata which can't be
+// unsealed.
+func (store *sealedMetaStore) unsealing(fn func(oid string, meta *ObjectMeta)) func(oid string, meta *ObjectMeta) {
+	return func(oid string, sealed *ObjectMeta) {
+		meta, err := store.unseal(oid, sealed)
+		if err != nil {
+			logger.Warningf("Skipping unreadable metadata of object %s: %v", oid, err)
+			return
+		}
+		fn(oid, meta)
+	}
+}
+
+func (store *sealedMetaStore) read(oid string) (*ObjectMeta, error) {
+	sealed, err := store.metas.read(oid)
+	if err != nil {
+		return nil, err
+	}
+	return store.unseal(oid, sealed)
+}
+
+func (store *sealedMetaStore) write(oid string, meta *ObjectMeta) error {
+	sealed, err := store.seal(oid, meta)
+	if err != nil {
+		return err
+	}
+	return store.metas.write(oid, sealed)
+}
+
+func (store *sealedMetaStore) remove(oid string) error {
+	return store.metas.remove(oid)
+}
+
+func (store *sealedMetaStore) each(fn func(oid string, meta *ObjectMeta)) error {
+	return store.metas.each(store.unsealing(fn))
+}
+
+// owned lists the objects recorded under the owner's pseudonym, and those whose metadata isn't sealed yet.
+func (store *sealedMetaStore) owned(owner string, afterCreated time.Time, afterOid string, limit int) ([]listedMeta,
+	error) {
+	var owned []listedMeta
+	for _, recorded := range []string{store.sealer.owner(owner), owner} {
+		listed, err := store.metas.owned(recorded, afterCreated, afterOid, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range listed {
+			meta, err := store.unseal(entry.oid, entry.meta)
+			if err != nil {
+				logger.Warningf("Skipping unreadable metadata of object %s: %v", entry.oid, err)
+				continue
+			}
+			owned = append(owned, listedMeta{oid: entry.oid, meta: meta})
+		}
+		if owner == "" {
+			break
+		}
+	}
+
+	sort.Slice(owned, func(i, j int) bool {
+		return listedAfter(owned[j].meta.Created, owned[j].oid, owned[i].meta.Created, owned[i].oid)
+	})
+	if len(owned) > limit {
+		owned = owned[:limit]
+	}
+	return owned, nil
+}
+
+func (store *sealedMetaStore) createdBefore(before time.Time, fn func(oid string, meta *ObjectMeta)) error {
+	return store.metas.createdBefore(before, store.unsealing(fn))
+}
+
+func (store *sealedMetaStore) ping(ctx context.Context) error {
+	return store.metas.ping(ctx)
+}
+
+// Close closes the store the metadata is sealed into, if it can be closed.
+func (store *sealedMetaStore) Close() error {
+	if closer, ok := store.metas.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (store *sealedMetaStore) String() string {
+	return store.metas.String() + ", sealed"
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSealedObjectSeek(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atrest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sealer, err := newAtRestSealer(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &sealedObjectStore{store: newFileStore(dir), sealer: sealer}
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err := store.put("oid", data); err != nil {
+		t.Fatal(err)
+	}
+
+	object, size, err := store.open("oid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer object.Close()
+	if size != int64(len(data)) {
+		t.Errorf("opened %d bytes, expected %d", size, len(data))
+	}
+	for _, offset := range []int64{0, 37, 512, 999} {
+		if _, err := object.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		rest, err := ioutil.ReadAll(object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rest, data[offset:]) {
+			t.Errorf("read from offset %d doesn't match the data", offset)
+		}
+	}
+
+	other, err := newAtRestSealer(bytes.Repeat([]byte{8}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := (&sealedObjectStore{store: newFileStore(dir), sealer: other}).open("oid"); err == nil {
+		t.Errorf("opened an object sealed with another key")
+	}
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/logger"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Kinds of audited event.
+const auditTokenIssued = "token_issued"
+const auditAuthFailure = "auth_failure"
+const auditObjectDropped = "object_dropped"
+const auditObjectPulled = "object_pulled"
+const auditObjectRemoved = "object_removed"
+const auditObjectShared = "object_shared"
+const auditKeyAdded = "key_added"
+const auditKeyRemoved = "key_removed"
+const auditSecretRotated = "secret_rotated"
+const auditGCForced = "gc_forced"
+const auditKeyCheckedIn = "key_checked_in"
+const auditCanaryPulled = "canary_pulled"
+
+// auditEvent is a line of the audit log.
+type auditEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// KeyName is the key which made the request, or which a token was requested for.
+	KeyName string `json:"keyName,omitempty"`
+	IP      string `json:"ip,omitempty"`
+	Oid     string `json:"oid,omitempty"`
+	// Detail is specific to the kind of event, e.g. why authentication failed, or the name of an added key.
+	Detail string `json:"detail,omitempty"`
+}
+
+// auditLog appends security relevant events to a file of their own as lines of json, apart from the application log.
+// The file is rotated once it reaches its maximum size, keeping a number of the previous files as <path>.1, <path>.2
+// and so on, newest first. Its methods do nothing on a nil auditLog.
+type auditLog struct {
+	mutex    sync.Mutex
+	path     string
+	maxBytes int64
+	backups  int
+	file     *os.File
+	size     int64
+	closed   bool
+	clock    Clock
+}
+
+// newAuditLog opens the audit log at path, or returns nil if path is empty, which disables it.
+func newAuditLog(path string, maxBytes int64, backups int, clock Clock) (*auditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	audit := &auditLog{path: path, maxBytes: maxBytes, backups: backups, clock: clock}
+	if err := audit.open(); err != nil {
+		return nil, err
+	}
+	return audit, nil
+}
+
+func (audit *auditLog) open() error {
+	file, err := os.OpenFile(audit.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	audit.file = file
+	audit.size = info.Size()
+	return nil
+}
+
+// record appends an event to the log, timestamped now. Failures are reported in the application log.
+func (audit *auditLog) record(event auditEvent) {
+	if audit == nil {
+		return
+	}
+
+	event.Time = audit.clock.Now().UTC()
+	line, err := json.Marshal(event)
+	if err != nil {
+		logger.Errorf("Failed to encode audit event: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+
+	if audit.closed {
+		return
+	}
+	if audit.maxBytes > 0 && audit.size > 0 && audit.size+int64(len(line)) > audit.maxBytes {
+		if err := audit.rotate(); err != nil {
+			logger.Errorf("Failed to rotate audit log: %v", err)
+		}
+	}
+	if audit.file == nil {
+		if err := audit.open(); err != nil {
+			logger.Errorf("Failed to open audit log: %v", err)
+			return
+		}
+	}
+
+	n, err := audit.file.Write(line)
+	audit.size += int64(n)
+	if err != nil {
+		logger.Errorf("Failed to write audit log: %v", err)
+	}
+}
+
+// close flushes the log to disk and closes it. Events recorded afterwards are dropped.
+func (audit *auditLog) close() {
+	if audit == nil {
+		return
+	}
+
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+
+	audit.closed = true
+	if audit.file == nil {
+		return
+	}
+	if err := audit.file.Sync(); err != nil {
+		logger.Errorf("Failed to flush audit log: %v", err)
+	}
+	audit.file.Close()
+	audit.file = nil
+}
+
+// rotate moves the current file to <path>.1, after shifting the older files along and removing the oldest.
+func (audit *auditLog) rotate() error {
+	if audit.file != nil {
+		if err := audit.file.Close(); err != nil {
+			return err
+		}
+		audit.file = nil
+	}
+
+	if audit.backups <= 0 {
+		return os.Remove(audit.path)
+	}
+	for i := audit.backups - 1; i >= 1; i-- {
+		older := fmt.Sprintf("%s.%d", audit.path, i)
+		if err := os.Rename(older, fmt.Sprintf("%s.%d", audit.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(audit.path, audit.path+".1")
+}
+
+// audit records an event of a request in the audit log, and sends webhooks for it if it is an object event.
+func (handler *Handler) audit(req *http.Request, event string, keyName string, oid string, detail string) {
+	handler.auditFrom(remoteIP(req), event, keyName, oid, detail)
+}
+
+// auditFrom is audit for a request from an IP address which wasn't made over HTTP, e.g. a gRPC call.
+func (handler *Handler) auditFrom(ip string, event string, keyName string, oid string, detail string) {
+	handler.auditLog.record(auditEvent{
+		Event:   event,
+		KeyName: keyName,
+		IP:      ip,
+		Oid:     oid,
+		Detail:  detail,
+	})
+	handler.db.webhooks.notify(event, keyName, oid, detail)
+}
@@ -1,41 +1,80 @@
-package main
+package server
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha512"
-	"crypto/x509"
 	"dead-drop/lib"
-	"encoding/pem"
+	"encoding/hex"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/google/logger"
-	"github.com/mitchellh/go-homedir"
-	"io/ioutil"
-	"path/filepath"
+	"golang.org/x/crypto/ed25519"
 	"sync"
 	"time"
 )
 
 const UnauthorizedErr = Error("math: square root of negative number")
+const LastKeyErr = Error("the last authorized key can't be removed")
 
 type Authenticator struct {
-	secret            []byte
-	secretLock        sync.RWMutex
-	authorizedKeysDir string
+	// secrets holds the secret tokens are signed with, which is the last one, and the secrets it replaced which tokens
+	// signed with them may still be valid for, oldest first.
+	secrets    []tokenSecret
+	secretLock sync.RWMutex
+	keys       KeyStore
+	tokenTTL   time.Duration
+	// defaultKeyRole is the role of keys which weren't added with one.
+	defaultKeyRole string
+	clock          Clock
+	// revoked holds when keys were removed, so that tokens issued to them before then are rejected until they expire.
+	revoked     map[string]time.Time
+	revokedLock sync.Mutex
+	challenges  *challenges
+	// legacyTokenRequests accepts token requests which don't answer a challenge, from clients older than challenges.
+	legacyTokenRequests bool
 }
 
-func newAuthenticator(authorizedKeysDirPath string) *Authenticator {
-	authorizedKeysDir, err := homedir.Expand(authorizedKeysDirPath)
-	if err != nil {
-		logger.Fatalf("Failed to expand authorized keys file path: %v", err)
-	}
+// tokenClaims are what a token says of the key it was issued to, and what it may be used for.
+type tokenClaims struct {
+	keyName   string
+	role      string
+	namespace string
+	// scope and oid are what the token was limited to, if it was requested with a scope.
+	scope string
+	oid   string
+}
 
-	logger.Infof("Starting authenticator with authorized-keys directory %s", authorizedKeysDir)
+// tokenSecret is a secret tokens are signed with, which they name by its id in their kid header.
+type tokenSecret struct {
+	id  string
+	key []byte
+	// replaced is when a newer secret started signing tokens, or zero for the current secret.
+	replaced time.Time
+}
+
+// Tokens are signed with a secret which is replaced this often. Replaced secrets keep validating the tokens they
+// signed until those expire, so rotating doesn't reject tokens issued just before.
+const secretRotationInterval = 16 * time.Second
+
+func newAuthenticator(keys KeyStore, tokenTTL time.Duration, defaultKeyRole string, legacyTokenRequests bool,
+	clock Clock) *Authenticator {
+	logger.Infof("Starting authenticator with authorized keys in %s", keys)
+	if tokenTTL < time.Second {
+		tokenTTL = time.Second
+	}
 
 	authenticator := &Authenticator{
-		secret:            newSecret(),
-		authorizedKeysDir: authorizedKeysDir,
+		secrets:        []tokenSecret{newTokenSecret()},
+		keys:           keys,
+		tokenTTL:       tokenTTL,
+		defaultKeyRole: defaultKeyRole,
+		clock:          clock,
+		revoked:        make(map[string]time.Time),
+		challenges:     newChallenges(clock),
+
+		legacyTokenRequests: legacyTokenRequests,
 	}
 
 	go authenticator.secretRotator()
@@ -44,61 +83,239 @@ func newAuthenticator(authorizedKeysDirPath string) *Authenticator {
 }
 
 func (auth *Authenticator) secretRotator() {
-	const rotationSeconds = 16
-
 	for {
-		time.Sleep(rotationSeconds * time.Second)
+		auth.clock.Sleep(secretRotationInterval)
 
-		auth.secretLock.Lock()
-		auth.secret = newSecret()
-		auth.secretLock.Unlock()
+		auth.rotateSecret()
 	}
 }
 
-func (auth *Authenticator) generateToken(pkeyBytes []byte) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.MapClaims{
-		"ran": auth.randomClaim(),
-		"exp": time.Now().Add(time.Second).Unix(),
-	})
+// rotateSecret signs tokens with a new secret from now on, and forgets the replaced secrets whose tokens have all
+// expired.
+func (auth *Authenticator) rotateSecret() {
+	auth.secretLock.Lock()
+	defer auth.secretLock.Unlock()
 
-	auth.secretLock.RLock()
-	signedToken, err := token.SignedString(auth.secret)
-	if err != nil {
-		return "", err
+	now := auth.clock.Now()
+	auth.secrets[len(auth.secrets)-1].replaced = now
+
+	// Tokens are issued with their times in seconds, so a token may outlive its secret by up to a second more.
+	retained := auth.secrets[:0]
+	for _, secret := range auth.secrets {
+		if now.Sub(secret.replaced) <= auth.tokenTTL+time.Second {
+			retained = append(retained, secret)
+		}
 	}
-	auth.secretLock.RUnlock()
+	auth.secrets = append(retained, newTokenSecret())
+}
 
-	pkeyDer, _ := pem.Decode(pkeyBytes)
-	if pkeyDer == nil {
-		logger.Errorf("Failed to decode pem bytes")
-		return "", UnauthorizedErr
+// revokeSecrets signs tokens with a new secret from now on, and forgets every other secret, so that every token issued
+// before is rejected, e.g. after a secret may have leaked.
+func (auth *Authenticator) revokeSecrets() {
+	auth.secretLock.Lock()
+	defer auth.secretLock.Unlock()
+
+	auth.secrets = []tokenSecret{newTokenSecret()}
+}
+
+// signingSecret returns the secret new tokens are signed with.
+func (auth *Authenticator) signingSecret() tokenSecret {
+	auth.secretLock.RLock()
+	defer auth.secretLock.RUnlock()
+
+	return auth.secrets[len(auth.secrets)-1]
+}
+
+// verifyingSecret returns the key of the secret with an id, or nil if there is none, e.g. because the tokens it
+// signed have all expired.
+func (auth *Authenticator) verifyingSecret(id string) []byte {
+	auth.secretLock.RLock()
+	defer auth.secretLock.RUnlock()
+
+	for _, secret := range auth.secrets {
+		if secret.id == id {
+			return secret.key
+		}
 	}
-	pkey, err := x509.ParsePKCS1PublicKey(pkeyDer.Bytes)
+	return nil
+}
+
+// ready returns whether the token secret has been initialized, so that tokens can be issued and validated.
+func (auth *Authenticator) ready() bool {
+	auth.secretLock.RLock()
+	defer auth.secretLock.RUnlock()
+
+	return len(auth.secrets) > 0 && len(auth.secrets[len(auth.secrets)-1].key) > 0
+}
+
+// generateToken issues a token to the key which requested it, which carries the key's role and namespace, and the
+// scope it was requested for. Signed requests are sent it as it is, once their signature is verified, and other
+// requests are sent it encrypted to their RSA key.
+func (auth *Authenticator) generateToken(payload *lib.TokenRequestPayload, pkeyBytes []byte,
+	role string, namespace string) (string, error) {
+	publicKey, err := lib.ParseAuthorizedKey(pkeyBytes)
 	if err != nil {
 		logger.Errorf("Failed to parse public key: %v", err)
 		return "", UnauthorizedErr
 	}
+	rsaKey, _ := publicKey.(*rsa.PublicKey)
+
+	// Ed25519 keys must sign their requests, which RSA keys may do instead of decrypting the token.
+	if rsaKey == nil || payload.Signature != nil {
+		if err := auth.verifyTokenRequest(payload, publicKey); err != nil {
+			logger.Errorf("Rejected token request for %s: %v", payload.KeyName, err)
+			return "", UnauthorizedErr
+		}
+		rsaKey = nil
+	}
+
+	ttl := auth.tokenTTL
+	if requested := time.Duration(payload.TTL) * time.Second; payload.TTL > 0 && requested < ttl {
+		ttl = requested
+	}
+
+	// Clients cache tokens for exp - iat, so that they don't depend on their clock matching the server's.
+	now := auth.clock.Now()
+	claims := jwt.MapClaims{
+		"ran":  auth.randomClaim(),
+		"sub":  payload.KeyName,
+		"role": role,
+		"ns":   namespace,
+		"iat":  now.Unix(),
+		"exp":  now.Add(ttl).Unix(),
+	}
+	if payload.Scope != "" {
+		claims["scope"] = payload.Scope
+	}
+	if payload.Oid != "" {
+		claims["oid"] = payload.Oid
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
+
+	secret := auth.signingSecret()
+	token.Header["kid"] = secret.id
+	signedToken, err := token.SignedString(secret.key)
+	if err != nil {
+		return "", err
+	}
 
-	ciphertext, err := rsa.EncryptOAEP(sha512.New(), rand.Reader, pkey, []byte(signedToken), []byte(lib.TokenCipherLabel))
+	if rsaKey == nil {
+		return signedToken, nil
+	}
+	ciphertext, err := rsa.EncryptOAEP(sha512.New(), rand.Reader, rsaKey, []byte(signedToken), []byte(lib.TokenCipherLabel))
 	return string(ciphertext), err
 }
 
-func (auth *Authenticator) validateToken(tokenString string) bool {
-	auth.secretLock.RLock()
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+// answerChallenge uses up the challenge a token request answers. Requests which don't answer one are only accepted
+// from legacy clients, if the server is configured to.
+func (auth *Authenticator) answerChallenge(payload *lib.TokenRequestPayload) error {
+	if payload.Nonce == "" {
+		if !auth.legacyTokenRequests {
+			return fmt.Errorf("token request without a challenge")
+		}
+		return nil
+	}
+	if !auth.challenges.redeem(payload.KeyName, payload.Nonce) {
+		return fmt.Errorf("token request answered an unknown or expired challenge")
+	}
+	return nil
+}
+
+// verifyTokenRequest checks the signature of a signed token request over the challenge it answers, or for legacy
+// requests, that it was made recently.
+func (auth *Authenticator) verifyTokenRequest(payload *lib.TokenRequestPayload, publicKey crypto.PublicKey) error {
+	data := lib.TokenChallengeData(payload)
+	if payload.Nonce == "" {
+		data = lib.TokenSignedData(payload.KeyName, payload.Timestamp)
+	}
+	switch publicKey := publicKey.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(publicKey, data, payload.Signature) {
+			return fmt.Errorf("bad signature")
+		}
+	case *rsa.PublicKey:
+		digest := sha512.Sum512(data)
+		if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA512, digest[:], payload.Signature); err != nil {
+			return fmt.Errorf("bad signature")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type")
+	}
+
+	if payload.Nonce != "" {
+		return nil
+	}
+	skew := auth.clock.Now().Sub(time.Unix(payload.Timestamp, 0))
+	if skew > lib.MaxTokenRequestSkew || skew < -lib.MaxTokenRequestSkew {
+		return fmt.Errorf("request timestamp is %v from the server clock", skew)
+	}
+	return nil
+}
+
+// validateToken returns the claims of a token about the key it was issued to, and whether the token is valid.
+func (auth *Authenticator) validateToken(tokenString string) (tokenClaims, bool) {
+	// Expiry is checked against the server clock below, rather than the jwt package's.
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+
+	token, err := parser.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 
-		return auth.secret, nil
+		id, _ := token.Header["kid"].(string)
+		key := auth.verifyingSecret(id)
+		if key == nil {
+			return nil, fmt.Errorf("unknown secret id: %q", id)
+		}
+		return key, nil
 	})
-	auth.secretLock.RUnlock()
 	if err != nil {
+		return tokenClaims{}, false
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || !claims.VerifyExpiresAt(auth.clock.Now().Unix(), true) {
+		return tokenClaims{}, false
+	}
+
+	keyName, _ := claims["sub"].(string)
+	if auth.isRevoked(keyName, claims) {
+		return tokenClaims{}, false
+	}
+	role, _ := claims["role"].(string)
+	namespace, _ := claims["ns"].(string)
+	scope, _ := claims["scope"].(string)
+	oid, _ := claims["oid"].(string)
+	return tokenClaims{keyName: keyName, role: role, namespace: namespace, scope: scope, oid: oid}, true
+}
+
+// isRevoked returns whether a token was issued to a key before it was removed. Tokens are issued with the time in
+// seconds, so tokens issued in the second a key was removed are rejected too.
+func (auth *Authenticator) isRevoked(keyName string, claims jwt.MapClaims) bool {
+	auth.revokedLock.Lock()
+	defer auth.revokedLock.Unlock()
+
+	revoked, ok := auth.revoked[keyName]
+	if !ok {
 		return false
 	}
+	issued, ok := claims["iat"].(float64)
+	return !ok || int64(issued) <= revoked.Unix()
+}
+
+// revokeTokens rejects the tokens issued to a key until now. Revocations are forgotten once every token they could
+// apply to has expired.
+func (auth *Authenticator) revokeTokens(keyName string) {
+	auth.revokedLock.Lock()
+	defer auth.revokedLock.Unlock()
 
-	_, ok := token.Claims.(jwt.MapClaims)
-	return ok && token.Valid
+	now := auth.clock.Now()
+	for name, revoked := range auth.revoked {
+		if now.Sub(revoked) > auth.tokenTTL+time.Second {
+			delete(auth.revoked, name)
+		}
+	}
+	auth.revoked[keyName] = now
 }
 
 func (auth *Authenticator) randomClaim() string {
@@ -118,20 +335,73 @@ func (auth *Authenticator) randomClaim() string {
 }
 
 func (auth *Authenticator) getAuthorizedKey(keyName string) ([]byte, error) {
-	return ioutil.ReadFile(filepath.Join(auth.authorizedKeysDir, keyName))
+	return auth.keys.Key(keyName)
+}
+
+// authorizedKeys returns every authorized key by name, for replication.
+func (auth *Authenticator) authorizedKeys() (map[string][]byte, error) {
+	return auth.keys.Keys()
 }
 
 func (auth *Authenticator) addAuthorizedKey(key []byte, keyName string) error {
-	return ioutil.WriteFile(filepath.Join(auth.authorizedKeysDir, keyName), key, lib.PublicKeyPerms)
+	return auth.keys.AddKey(keyName, key)
+}
+
+// keyAttribute returns an attribute of an authorized key, or defaultValue if the key doesn't have it.
+func (auth *Authenticator) keyAttribute(keyName string, attribute string, defaultValue string) (string, error) {
+	value, err := auth.keys.Attribute(keyName, attribute)
+	if err != nil {
+		return "", err
+	} else if value == "" {
+		return defaultValue, nil
+	}
+	return value, nil
+}
+
+// setKeyAttribute sets an attribute of an authorized key, or removes it if value is empty.
+func (auth *Authenticator) setKeyAttribute(keyName string, attribute string, value string) error {
+	return auth.keys.SetAttribute(keyName, attribute, value)
+}
+
+// keyAttributes returns an attribute of every key which has it, by key name.
+func (auth *Authenticator) keyAttributes(attribute string) (map[string]string, error) {
+	return auth.keys.Attributes(attribute)
+}
+
+// removeAuthorizedKey removes an authorized key and its attributes, and revokes the tokens issued to it, returning
+// false if there is no such key, or LastKeyErr if it is the only one, since the server couldn't be used without one.
+func (auth *Authenticator) removeAuthorizedKey(keyName string) (bool, error) {
+	keys, err := auth.authorizedKeys()
+	if err != nil {
+		return false, err
+	}
+	if _, ok := keys[keyName]; !ok {
+		return false, nil
+	}
+	if len(keys) == 1 {
+		return false, LastKeyErr
+	}
+
+	if err := auth.keys.RemoveKey(keyName); err != nil {
+		return false, err
+	}
+	auth.revokeTokens(keyName)
+	for _, attribute := range []string{keyRoleAttribute, keyNamespaceAttribute, keyCheckinAttribute} {
+		if err := auth.setKeyAttribute(keyName, attribute, ""); err != nil {
+			logger.Errorf("Failed to remove attribute %s of removed key %s: %v", attribute, keyName, err)
+		}
+	}
+	return true, nil
 }
 
-func newSecret() []byte {
+func newTokenSecret() tokenSecret {
 	const length = 64
+	const idLength = 8
 
-	bytes := make([]byte, length)
+	bytes := make([]byte, length+idLength)
 	if _, err := rand.Read(bytes); err != nil {
 		logger.Fatalf("Failed to generate random secret: %v", err)
 	}
 
-	return bytes
+	return tokenSecret{id: hex.EncodeToString(bytes[length:]), key: bytes[:length]}
 }
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"crypto/rand"
+	"dead-drop/lib"
+	"encoding/hex"
+	"encoding/pem"
+	"golang.org/x/crypto/ed25519"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestServer returns a server with a data directory of its own, and a function shutting it down and removing it.
+func newTestServer(t *testing.T) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := New(Config{Settings: map[string]interface{}{
+		dataDirFlag:   dir,
+		keysDirFlag:   filepath.Join(dir, "keys"),
+		metaStoreFlag: metaStoreFile,
+		shareKeyFlag:  hex.EncodeToString(make([]byte, 32)),
+	}})
+	if server.err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(server.err)
+	}
+	return server, func() {
+		server.Shutdown()
+		os.RemoveAll(dir)
+	}
+}
+
+// testToken returns a token issued by auth for a request of a new key, with a role and namespace.
+func testToken(t *testing.T, auth *Authenticator, payload *lib.TokenRequestPayload, role string,
+	namespace string) string {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload.Nonce = "nonce"
+	payload.Signature = ed25519.Sign(privateKey, lib.TokenChallengeData(payload))
+	encoded := pem.EncodeToMemory(&pem.Block{Type: lib.Ed25519PublicKeyType, Bytes: publicKey})
+	token, err := auth.generateToken(payload, encoded, role, namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestTokenPermissions(t *testing.T) {
+	server, shutdown := newTestServer(t)
+	defer shutdown()
+	auth := server.handler.auth
+
+	admin, readOnly, writeOnly := lib.KeyRoleAdmin, lib.KeyRoleReadOnly, lib.KeyRoleWriteOnly
+	pull, drop := lib.TokenScopePull, lib.TokenScopeDrop
+
+	// No object is stored, so requests allowed to reach one are answered with 404.
+	for _, test := range []struct {
+		name      string
+		method    string
+		path      string
+		role      string
+		namespace string
+		scope     string
+		oid       string
+		status    int
+	}{
+		{"unscoped pull", "GET", "/d/abc/stat", admin, "", "", "", http.StatusNotFound},
+		{"pull of the token's object", "GET", "/d/abc/stat", admin, "", pull, "abc", http.StatusNotFound},
+		{"pull of another object", "GET", "/d/abc/stat", admin, "", pull, "xyz", http.StatusForbidden},
+		{"pull with a drop token", "GET", "/d/abc/stat", admin, "", drop, "", http.StatusForbidden},
+		{"list with a drop token", "GET", "/d", admin, "", drop, "", http.StatusOK},
+		{"list with a pull token", "GET", "/d", admin, "", pull, "", http.StatusForbidden},
+		{"list with an object's token", "GET", "/d", admin, "", drop, "abc", http.StatusForbidden},
+		{"remove-key with a drop token", "POST", "/remove-key", admin, "", drop, "", http.StatusForbidden},
+		{"pull of a read-only key", "GET", "/d/abc/stat", readOnly, "", "", "", http.StatusNotFound},
+		{"list of a read-only key", "GET", "/d", readOnly, "", "", "", http.StatusForbidden},
+		{"pull of a write-only key", "GET", "/d/abc/stat", writeOnly, "", "", "", http.StatusForbidden},
+		{"list of a write-only key", "GET", "/d", writeOnly, "", "", "", http.StatusOK},
+		{"remove-key of a write-only key", "POST", "/remove-key", writeOnly, "", "", "", http.StatusForbidden},
+		{"list of the key's namespace", "GET", "/ns/team-a/d", admin, "team-a", "", "", http.StatusOK},
+		{"list of another namespace", "GET", "/ns/team-b/d", admin, "team-a", "", "", http.StatusForbidden},
+		{"list of a namespace by a key of none", "GET", "/ns/team-b/d", admin, "", "", "", http.StatusForbidden},
+	} {
+		token := testToken(t, auth, &lib.TokenRequestPayload{KeyName: "alice", Scope: test.scope, Oid: test.oid},
+			test.role, test.namespace)
+		req := httptest.NewRequest(test.method, test.path, nil)
+		req.Header.Set("Authorization", token)
+		resp := httptest.NewRecorder()
+		server.router.ServeHTTP(resp, req)
+		if resp.Code != test.status {
+			t.Errorf("%s was answered with %d, expected %d", test.name, resp.Code, test.status)
+		}
+	}
+}
+
+func TestRevokedTokens(t *testing.T) {
+	server, shutdown := newTestServer(t)
+	defer shutdown()
+	auth := server.handler.auth
+
+	alice := testToken(t, auth, &lib.TokenRequestPayload{KeyName: "alice"}, lib.KeyRoleAdmin, "")
+	bob := testToken(t, auth, &lib.TokenRequestPayload{KeyName: "bob"}, lib.KeyRoleAdmin, "")
+	valid := func(name string, token string, expected bool) {
+		if _, ok := auth.validateToken(token); ok != expected {
+			t.Errorf("%s token is valid: %t, expected %t", name, ok, expected)
+		}
+	}
+	valid("alice's", alice, true)
+	valid("a forged", alice[:strings.LastIndex(alice, ".")]+bob[strings.LastIndex(bob, "."):], false)
+
+	// Removing a key revokes the tokens issued to it, and only those.
+	auth.revokeTokens("alice")
+	valid("alice's revoked", alice, false)
+	valid("bob's", bob, true)
+
+	// Revoking the secrets revokes every token.
+	auth.revokeSecrets()
+	valid("bob's revoked", bob, false)
+	carol := testToken(t, auth, &lib.TokenRequestPayload{KeyName: "carol"}, lib.KeyRoleAdmin, "")
+	valid("a new", carol, true)
+}
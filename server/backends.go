@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ObjectStore keeps the data of objects by oid, for servers embedded with storage of their own. Stores which also
+// have a Ping(ctx context.Context) error method are checked by the readiness endpoint.
+type ObjectStore interface {
+	// Put stores the data of an object, read from data to its end.
+	Put(oid string, data io.Reader) error
+	// Open opens an object for reading, returning its size.
+	Open(oid string) (ObjectReader, int64, error)
+	// Stat returns the size of an object, and when it was stored.
+	Stat(oid string) (int64, time.Time, error)
+	Remove(oid string) error
+	// List calls fn with every stored object, and when it was stored.
+	List(fn func(oid string, stored time.Time)) error
+}
+
+// MetaStore keeps the metadata of objects by oid, for servers embedded with storage of their own. Stores which also
+// have a Ping(ctx context.Context) error method are checked by the readiness endpoint.
+type MetaStore interface {
+	// Read returns the metadata of an object, or nil if there is none.
+	Read(oid string) (*ObjectMeta, error)
+	Write(oid string, meta *ObjectMeta) error
+	// Remove removes the metadata of an object, if there is any.
+	Remove(oid string) error
+	// Each calls fn with the metadata of every object.
+	Each(fn func(oid string, meta *ObjectMeta)) error
+}
+
+// pinger is implemented by embedded stores which can check that they can be reached.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+func pingStore(ctx context.Context, store interface{}) error {
+	if pinger, ok := store.(pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// embeddedObjectStore adapts an ObjectStore given to an embedded server.
+type embeddedObjectStore struct {
+	store ObjectStore
+}
+
+func (store *embeddedObjectStore) put(oid string, data []byte) error {
+	return store.store.Put(oid, bytes.NewReader(data))
+}
+
+func (store *embeddedObjectStore) putFile(oid string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = store.store.Put(oid, file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (store *embeddedObjectStore) open(oid string) (ObjectReader, int64, error) {
+	return store.store.Open(oid)
+}
+
+func (store *embeddedObjectStore) stat(oid string) (int64, time.Time, error) {
+	return store.store.Stat(oid)
+}
+
+func (store *embeddedObjectStore) remove(oid string) error {
+	return store.store.Remove(oid)
+}
+
+func (store *embeddedObjectStore) list(fn func(oid string, modified time.Time)) error {
+	return store.store.List(fn)
+}
+
+func (store *embeddedObjectStore) ping(ctx context.Context) error {
+	return pingStore(ctx, store.store)
+}
+
+func (store *embeddedObjectStore) String() string {
+	return fmt.Sprintf("embedded object store %T", store.store)
+}
+
+// embeddedMetaStore adapts a MetaStore given to an embedded server. Listings read the metadata of every object, as
+// they do in the metadata directory.
+type embeddedMetaStore struct {
+	store MetaStore
+}
+
+func (store *embeddedMetaStore) read(oid string) (*ObjectMeta, error) {
+	return store.store.Read(oid)
+}
+
+func (store *embeddedMetaStore) write(oid string, meta *ObjectMeta) error {
+	return store.store.Write(oid, meta)
+}
+
+func (store *embeddedMetaStore) remove(oid string) error {
+	return store.store.Remove(oid)
+}
+
+func (store *embeddedMetaStore) each(fn func(oid string, meta *ObjectMeta)) error {
+	return store.store.Each(fn)
+}
+
+func (store *embeddedMetaStore) owned(owner string, afterCreated time.Time, afterOid string, limit int) ([]listedMeta,
+	error) {
+	return scanOwned(store.store.Each, owner, afterCreated, afterOid, limit)
+}
+
+func (store *embeddedMetaStore) createdBefore(before time.Time, fn func(oid string, meta *ObjectMeta)) error {
+	return scanCreatedBefore(store.store.Each, before, fn)
+}
+
+func (store *embeddedMetaStore) ping(ctx context.Context) error {
+	return pingStore(ctx, store.store)
+}
+
+func (store *embeddedMetaStore) String() string {
+	return fmt.Sprintf("embedded metadata store %T", store.store)
+}
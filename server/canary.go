@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/logger"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// canaryAlert is a pull of a canary object, with what is known of who made it.
+type canaryAlert struct {
+	Time      time.Time
+	Oid       string
+	KeyName   string
+	IP        string
+	UserAgent string
+}
+
+// detail describes the requester of a canary pull, as audit events and webhooks carry it.
+func (alert *canaryAlert) detail() string {
+	return fmt.Sprintf("from %s with user agent %q", alert.IP, alert.UserAgent)
+}
+
+// Canary alerts are queued up to this many, beyond which they are discarded until the queue drains.
+const canaryMailQueueLen = 256
+
+// canaryMailer emails alerts of canary pulls through an SMTP server, in the background. Its methods do nothing on a
+// nil canaryMailer, which disables them.
+type canaryMailer struct {
+	addr  string
+	auth  smtp.Auth
+	from  string
+	to    []string
+	queue chan canaryAlert
+}
+
+// newCanaryMailer starts emailing canary alerts from an address to others through the SMTP server at addr, e.g.
+// smtp.example.com:587, or returns nil if addr is empty. The server is authenticated with PLAIN auth if a username is
+// given, which net/smtp only sends over TLS (or to localhost).
+func newCanaryMailer(addr string, username string, password string, from string, to []string) (*canaryMailer,
+	error) {
+	if addr == "" {
+		return nil, nil
+	}
+	if from == "" || len(to) == 0 {
+		return nil, fmt.Errorf("canary emails need an address to send from and addresses to send to")
+	}
+
+	mailer := &canaryMailer{
+		addr:  addr,
+		from:  from,
+		to:    to,
+		queue: make(chan canaryAlert, canaryMailQueueLen),
+	}
+	if username != "" {
+		host := addr
+		if i := strings.LastIndex(addr, ":"); i >= 0 {
+			host = addr[:i]
+		}
+		mailer.auth = smtp.PlainAuth("", username, password, host)
+	}
+	go mailer.sendJob()
+	return mailer, nil
+}
+
+// notify queues an email of a canary alert.
+func (mailer *canaryMailer) notify(alert canaryAlert) {
+	if mailer == nil {
+		return
+	}
+
+	select {
+	case mailer.queue <- alert:
+	default:
+		logger.Errorf("Discarding canary email of object %s, since too many are queued", alert.Oid)
+	}
+}
+
+func (mailer *canaryMailer) sendJob() {
+	for alert := range mailer.queue {
+		if err := smtp.SendMail(mailer.addr, mailer.auth, mailer.from, mailer.to, mailer.message(alert)); err != nil {
+			logger.Errorf("Failed to email canary alert of object %s: %v", alert.Oid, err)
+		}
+	}
+}
+
+// message formats the email of a canary alert.
+func (mailer *canaryMailer) message(alert canaryAlert) []byte {
+	keyName := alert.KeyName
+	if keyName == "" {
+		keyName = "(none)"
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", mailer.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(mailer.to, ", "))
+	fmt.Fprintf(&msg, "Date: %s\r\n", alert.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Subject: dead-drop canary object %s was pulled\r\n", alert.Oid)
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "Canary object %s was pulled, which may mean the key which pulled it is compromised.\r\n\r\n",
+		alert.Oid)
+	fmt.Fprintf(&msg, "Time:       %s\r\n", alert.Time.Format(time.RFC3339))
+	fmt.Fprintf(&msg, "Key:        %s\r\n", keyName)
+	fmt.Fprintf(&msg, "IP address: %s\r\n", alert.IP)
+	fmt.Fprintf(&msg, "User agent: %s\r\n", alert.UserAgent)
+	return msg.Bytes()
+}
+
+// alertCanary raises an alert if an object is a canary, which is being pulled by the named key (or through a shared
+// url) from an IP address and user agent, before the pull is checked against the object's policy: any attempt to pull
+// a canary is suspect, whether or not it succeeds.
+func (handler *Handler) alertCanary(oid string, keyName string, ip string, userAgent string) {
+	meta, err := handler.db.objectMeta(oid)
+	if err != nil || meta == nil || !meta.Canary {
+		return
+	}
+
+	alert := canaryAlert{
+		Time:      handler.db.clock.Now().UTC(),
+		Oid:       oid,
+		KeyName:   keyName,
+		IP:        ip,
+		UserAgent: userAgent,
+	}
+	logger.Warningf("Canary object %s pulled by key '%s' %s", oid, keyName, alert.detail())
+	handler.auditFrom(ip, auditCanaryPulled, keyName, oid, alert.detail())
+	handler.canaryMailer.notify(alert)
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"crypto/rand"
+	"dead-drop/lib"
+	"encoding/base64"
+	"github.com/google/logger"
+	"sync"
+	"time"
+)
+
+// Token requests answer a challenge: a nonce the server issued for the key shortly before, which the request uses up.
+// Captured token requests can't be replayed, and the server only signs or encrypts a token for a requester which asked
+// for a challenge first.
+const challengeTTL = lib.MaxTokenChallengeAge
+
+// Challenges are issued for any key name, so that they don't reveal which keys exist, which bounds how many may be
+// outstanding at once, and how many may be outstanding for each IP address, so that one requester can't take them all.
+const maxChallenges = 64 * 1024
+const maxChallengesPerIP = 16
+
+const challengeNonceLen = 32
+
+const ChallengesExhaustedErr = Error("too many token challenges are outstanding")
+const IPChallengesExhaustedErr = Error("too many token challenges are outstanding for the IP address")
+
+// challenges holds the challenges issued and not yet answered, by nonce, and the number outstanding for each IP
+// address. Every challenge lives for challengeTTL, so queue holds them in the order they expire, which lets expired
+// ones be removed without going through all of them. Answered challenges are left in queue until they expire.
+type challenges struct {
+	lock   sync.Mutex
+	clock  Clock
+	issued map[string]issuedChallenge
+	perIP  map[string]int
+	queue  []queuedChallenge
+}
+
+type issuedChallenge struct {
+	keyName string
+	ip      string
+	expires time.Time
+}
+
+type queuedChallenge struct {
+	nonce   string
+	expires time.Time
+}
+
+func newChallenges(clock Clock) *challenges {
+	return &challenges{clock: clock, issued: make(map[string]issuedChallenge), perIP: make(map[string]int)}
+}
+
+// issue returns a new challenge for a key, requested from an IP address, or an error if too many are outstanding.
+func (challenges *challenges) issue(keyName string, ip string) (string, error) {
+	bytes := make([]byte, challengeNonceLen)
+	if _, err := rand.Read(bytes); err != nil {
+		logger.Fatalf("Failed to generate random challenge: %v", err)
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(bytes)
+
+	challenges.lock.Lock()
+	defer challenges.lock.Unlock()
+
+	now := challenges.clock.Now()
+	challenges.expire(now)
+	if challenges.perIP[ip] >= maxChallengesPerIP {
+		return "", IPChallengesExhaustedErr
+	}
+	if len(challenges.issued) >= maxChallenges {
+		return "", ChallengesExhaustedErr
+	}
+
+	expires := now.Add(challengeTTL)
+	challenges.issued[nonce] = issuedChallenge{keyName: keyName, ip: ip, expires: expires}
+	challenges.perIP[ip]++
+	challenges.queue = append(challenges.queue, queuedChallenge{nonce: nonce, expires: expires})
+	return nonce, nil
+}
+
+// redeem uses up a challenge, returning whether it was issued for the key and hasn't expired.
+func (challenges *challenges) redeem(keyName string, nonce string) bool {
+	challenges.lock.Lock()
+	defer challenges.lock.Unlock()
+
+	challenge, ok := challenges.issued[nonce]
+	if !ok {
+		return false
+	}
+	challenges.remove(nonce, challenge)
+	return challenge.keyName == keyName && challenges.clock.Now().Before(challenge.expires)
+}
+
+// expire removes the challenges which expired by now. The lock must be held.
+func (challenges *challenges) expire(now time.Time) {
+	for len(challenges.queue) > 0 && !now.Before(challenges.queue[0].expires) {
+		nonce := challenges.queue[0].nonce
+		challenges.queue = challenges.queue[1:]
+		if challenge, ok := challenges.issued[nonce]; ok {
+			challenges.remove(nonce, challenge)
+		}
+	}
+}
+
+// remove removes an outstanding challenge. The lock must be held.
+func (challenges *challenges) remove(nonce string, challenge issuedChallenge) {
+	delete(challenges.issued, nonce)
+	if challenges.perIP[challenge.ip] <= 1 {
+		delete(challenges.perIP, challenge.ip)
+	} else {
+		challenges.perIP[challenge.ip]--
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a Clock which only moves when advanced.
+type testClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (clock *testClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.now
+}
+
+func (clock *testClock) Sleep(d time.Duration) {
+	clock.advance(d)
+}
+
+func (clock *testClock) advance(d time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+func TestChallengesPerIP(t *testing.T) {
+	clock := newTestClock()
+	challenges := newChallenges(clock)
+
+	var nonces []string
+	for i := 0; i < maxChallengesPerIP; i++ {
+		nonce, err := challenges.issue("alice", "192.0.2.1")
+		if err != nil {
+			t.Fatalf("challenge %d was refused: %v", i, err)
+		}
+		nonces = append(nonces, nonce)
+	}
+	if _, err := challenges.issue("alice", "192.0.2.1"); err != IPChallengesExhaustedErr {
+		t.Fatalf("issued more than %d challenges to one IP address: %v", maxChallengesPerIP, err)
+	}
+	if _, err := challenges.issue("alice", "192.0.2.2"); err != nil {
+		t.Fatalf("another IP address was refused a challenge: %v", err)
+	}
+
+	// Answering a challenge makes room for another.
+	if !challenges.redeem("alice", nonces[0]) {
+		t.Fatalf("failed to redeem a challenge")
+	}
+	if challenges.redeem("alice", nonces[0]) {
+		t.Fatalf("redeemed a challenge twice")
+	}
+	if _, err := challenges.issue("alice", "192.0.2.1"); err != nil {
+		t.Fatalf("challenge was refused after one was answered: %v", err)
+	}
+
+	// So do challenges expiring, which are removed.
+	clock.advance(challengeTTL)
+	if challenges.redeem("alice", nonces[1]) {
+		t.Fatalf("redeemed an expired challenge")
+	}
+	if _, err := challenges.issue("alice", "192.0.2.1"); err != nil {
+		t.Fatalf("challenge was refused after the others expired: %v", err)
+	}
+	if len(challenges.issued) != 1 || len(challenges.queue) != 1 || challenges.perIP["192.0.2.1"] != 1 {
+		t.Errorf("expired challenges weren't removed: %d outstanding, %d queued", len(challenges.issued),
+			len(challenges.queue))
+	}
+}
+
+func TestChallengesLimit(t *testing.T) {
+	clock := newTestClock()
+	challenges := newChallenges(clock)
+
+	for i := 0; i < maxChallenges; i++ {
+		if _, err := challenges.issue("alice", fmt.Sprintf("ip-%d", i)); err != nil {
+			t.Fatalf("challenge %d was refused: %v", i, err)
+		}
+	}
+	if _, err := challenges.issue("alice", "192.0.2.1"); err != ChallengesExhaustedErr {
+		t.Fatalf("issued more than %d challenges: %v", maxChallenges, err)
+	}
+
+	clock.advance(challengeTTL)
+	if _, err := challenges.issue("alice", "192.0.2.1"); err != nil {
+		t.Fatalf("challenge was refused after the others expired: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"dead-drop/lib"
+	"encoding/json"
+	"github.com/google/logger"
+	"net/http"
+	"time"
+)
+
+// The time a key last checked in is kept in an attribute of this name, in RFC 3339.
+const keyCheckinAttribute = "checkin"
+
+const HeldObjectErr = Error("the object is held until the key which dropped it misses a check-in")
+const AnonymousReleaseErr = Error("anonymous drops can't be released to other keys")
+const ReleaseAfterExpiryErr = Error("the object would expire before its check-in interval could pass")
+
+// checkin records that a key checked in at a time.
+func (auth *Authenticator) checkin(keyName string, at time.Time) error {
+	return auth.setKeyAttribute(keyName, keyCheckinAttribute, at.UTC().Format(time.RFC3339Nano))
+}
+
+// lastCheckin returns the time a key last checked in, or the zero time if it never has.
+func (auth *Authenticator) lastCheckin(keyName string) (time.Time, error) {
+	value, err := auth.keyAttribute(keyName, keyCheckinAttribute, "")
+	if err != nil || value == "" {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// keyCheckins returns the times keys last checked in by name, for replication. Keys which never checked in are left
+// out.
+func (auth *Authenticator) keyCheckins() (map[string]string, error) {
+	return auth.keyAttributes(keyCheckinAttribute)
+}
+
+// releases returns when an object held for other keys is released to them, unless its owner checks in before, given
+// the time its owner last checked in.
+func (meta *ObjectMeta) releases(lastCheckin time.Time) time.Time {
+	if lastCheckin.Before(meta.Created) {
+		lastCheckin = meta.Created
+	}
+	return lastCheckin.Add(meta.CheckinInterval)
+}
+
+// releasedTo returns whether an object may be pulled by the named key of a namespace. Objects which are held for other
+// keys may always be pulled by their owner, but only by the keys they are released to once their owner has missed a
+// check-in, which are refused with HeldObjectErr until then. They can't be pulled by other keys at all, and false is
+// returned for them. Other objects may be pulled by any key.
+func (handler *Handler) releasedTo(oid string, keyName string, namespace string) (bool, error) {
+	meta, err := handler.db.objectMeta(oid)
+	if err != nil {
+		return false, err
+	}
+	if meta == nil || len(meta.ReleaseTo) == 0 || meta.ownedBy(keyName, namespace) {
+		return true, nil
+	}
+
+	for _, releaseTo := range meta.ReleaseTo {
+		if releaseTo != keyName {
+			continue
+		}
+		lastCheckin, err := handler.auth.lastCheckin(meta.Owner)
+		if err != nil {
+			logger.Errorf("Failed to read the last check-in of key %s: %v", meta.Owner, err)
+			return false, err
+		}
+		if handler.db.clock.Now().Before(meta.releases(lastCheckin)) {
+			return false, HeldObjectErr
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// handleCheckin records that the requesting key checked in, which holds the objects it dropped for other keys for
+// another check-in interval.
+func (handler *Handler) handleCheckin(w http.ResponseWriter, req *http.Request) {
+	keyName := requestKeyName(req)
+	now := handler.db.clock.Now()
+	if err := handler.auth.checkin(keyName, now); err != nil {
+		logger.Errorf("Failed to record the check-in of key %s: %v", keyName, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	handler.audit(req, auditKeyCheckedIn, keyName, "", "")
+
+	payload := lib.CheckinPayload{
+		KeyName:   keyName,
+		CheckedIn: now,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		logger.Errorf("Failed to write check-in response: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/logger"
+	"net"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for expiry, tokens, and background jobs, so tests can control time
+// and GC can be guarded against clock misconfiguration.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// ClockGuard detects jumps of the wall clock, which would otherwise make GC expire every object at once (or none).
+// It compares the wall clock against the monotonic time elapsed since a baseline, and optionally against an NTP server.
+// Once a jump is detected, GC stays paused until the clock is back in line, or an NTP check confirms it is right.
+type ClockGuard struct {
+	lock          sync.Mutex
+	clock         Clock
+	baseline      time.Time
+	maxJump       time.Duration
+	ntpServer     string
+	ntpMaxOffset  time.Duration
+	lastNtpCheck  time.Time
+	ntpCheckEvery time.Duration
+}
+
+func newClockGuard(clock Clock, maxJump time.Duration, ntpServer string, ntpMaxOffset time.Duration) *ClockGuard {
+	return &ClockGuard{
+		clock:         clock,
+		baseline:      clock.Now(),
+		maxJump:       maxJump,
+		ntpServer:     ntpServer,
+		ntpMaxOffset:  ntpMaxOffset,
+		ntpCheckEvery: time.Hour,
+	}
+}
+
+// allowGC reports whether the clock can be trusted enough to expire objects.
+func (guard *ClockGuard) allowGC() bool {
+	if guard == nil {
+		return true
+	}
+
+	guard.lock.Lock()
+	defer guard.lock.Unlock()
+
+	now := guard.clock.Now()
+
+	if guard.ntpServer != "" && (guard.lastNtpCheck.IsZero() || now.Sub(guard.lastNtpCheck) > guard.ntpCheckEvery) {
+		offset, err := ntpOffset(guard.ntpServer, guard.clock)
+		if err != nil {
+			logger.Warningf("Failed to check the clock against %s: %v", guard.ntpServer, err)
+		} else {
+			guard.lastNtpCheck = now
+			if absDuration(offset) > guard.ntpMaxOffset {
+				logger.Errorf("Clock is off by %s according to %s, pausing expiry", offset, guard.ntpServer)
+				return false
+			}
+			// The clock is right, so whatever happened to it before is now the baseline.
+			guard.baseline = now
+			return true
+		}
+	}
+
+	if guard.maxJump <= 0 {
+		return true
+	}
+
+	// Sub uses the monotonic readings of both times, while Round(0) strips them to compare wall clocks.
+	elapsed := now.Sub(guard.baseline)
+	wallElapsed := now.Round(0).Sub(guard.baseline.Round(0))
+	if jump := wallElapsed - elapsed; absDuration(jump) > guard.maxJump {
+		logger.Errorf("Wall clock jumped by %s since startup, pausing expiry until it is corrected", jump)
+		return false
+	}
+	return true
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// ntpEpochOffset is the number of seconds between the NTP epoch (1900) and the unix epoch.
+const ntpEpochOffset = 2208988800
+
+// ntpOffset queries an NTP server with a minimal SNTP request, returning how far the server's clock is ahead of ours.
+func ntpOffset(server string, clock Clock) (time.Duration, error) {
+	conn, err := net.DialTimeout("udp", server, 5*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return 0, err
+	}
+
+	// LI = 0, version = 4, mode = 3 (client).
+	request := make([]byte, 48)
+	request[0] = 0x23
+
+	sent := clock.Now()
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+
+	response := make([]byte, 48)
+	n, err := conn.Read(response)
+	if err != nil {
+		return 0, err
+	}
+	received := clock.Now()
+	if n < 48 {
+		return 0, fmt.Errorf("short ntp response")
+	}
+
+	// The transmit timestamp is at offset 40, as 32 bits of seconds and 32 bits of fraction.
+	seconds := binary.BigEndian.Uint32(response[40:])
+	fraction := binary.BigEndian.Uint32(response[44:])
+	if seconds == 0 {
+		return 0, fmt.Errorf("ntp server sent no time")
+	}
+	nanos := (int64(fraction) * 1e9) >> 32
+	serverTime := time.Unix(int64(seconds)-ntpEpochOffset, nanos)
+
+	// Assume the response took half the round trip to arrive.
+	midpoint := sent.Add(received.Sub(sent) / 2)
+	return serverTime.Sub(midpoint), nil
+}
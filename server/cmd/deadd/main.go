@@ -0,0 +1,114 @@
+package main
+
+import (
+	"dead-drop/lib"
+	"dead-drop/server"
+	"github.com/google/logger"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+var confFile string
+
+func main() {
+	if greeting := server.Greeting(); greeting != "" {
+		println(greeting)
+	}
+	log := logger.Init("Logger", true, true, ioutil.Discard)
+	defer log.Close()
+
+	cobra.OnInitialize(loadConfig)
+
+	var rootCmd = &cobra.Command{
+		Use: "deadd",
+		Run: func(cmd *cobra.Command, args []string) {
+			startServer()
+		},
+	}
+	rootCmd.PersistentFlags().StringVar(&confFile, "config", "",
+		"config file (default is "+filepath.Join("~", lib.DefaultConfigDir, lib.DefaultConfigName)+".yml)")
+
+	rootCmd.AddCommand(setupPromoteCmd())
+
+	if err := rootCmd.Execute(); err != nil {
+		logger.Fatalf("Failed to execute command: %v", err)
+	}
+}
+
+func setupPromoteCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "promote <standby url>",
+		Short: "Promotes a standby server to primary, fencing the old primary",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := server.PromoteStandby(config(), args[0]); err != nil {
+				logger.Fatalf("Failed to promote standby: %v", err)
+			}
+			logger.Infof("Promoted %s to primary", args[0])
+		},
+	}
+}
+
+func loadConfig() {
+	if confFile != "" {
+		viper.SetConfigFile(confFile)
+		logger.Infof("Loading configuration from %s", confFile)
+	} else {
+		dir := filepath.Join("$HOME", lib.DefaultConfigDir)
+		viper.AddConfigPath(dir)
+		viper.SetConfigName(lib.DefaultConfigName)
+		viper.SetConfigType(lib.DefaultConfigType)
+		logger.Infof(
+			"Searching for configuration at %s.%s\n",
+			filepath.Join(dir, lib.DefaultConfigName),
+			lib.DefaultConfigType,
+		)
+	}
+
+	err := viper.ReadInConfig()
+	if err != nil {
+		switch err.(type) {
+		case viper.ConfigFileNotFoundError:
+			logger.Info("No config file found, using the default configuration")
+			break
+		default:
+			logger.Warningf("Failed to load config file: %v", err)
+		}
+	} else {
+		logger.Infof("Successfully loaded configuration")
+	}
+}
+
+// config returns the server config of the config file, whose settings left out take their defaults.
+func config() server.Config {
+	return server.Config{Settings: viper.AllSettings()}
+}
+
+func startServer() {
+	deadd := server.New(config())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- deadd.ListenAndServe()
+	}()
+
+	select {
+	case err := <-served:
+		logger.Fatalf("Failed to start server: %v", err)
+	case sig := <-signals:
+		logger.Infof("Received %v, shutting down", sig)
+		deadd.Shutdown()
+		if err := <-served; err != http.ErrServerClosed {
+			logger.Errorf("Failed to shut down server: %v", err)
+		}
+	}
+}
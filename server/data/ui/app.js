@@ -0,0 +1,359 @@
+// The web interface of dead-drop. Objects are encrypted and decrypted here with WebCrypto, in the format of lib
+// (see lib/envelope.go, lib/stream.go and lib/aead.go):
+//
+//   "DEAD" | version (1 byte) | header length (uint32 BE) | header JSON | encrypted message
+//
+// where the encrypted message decrypts to: metadata length (uint32 BE) | metadata JSON | data.
+"use strict";
+
+const headerMagic = "DEAD";
+const headerVersion = 1;
+const aeadHeaderVersion = 2;
+const headerPrefixLen = headerMagic.length + 1 + 4;
+const maxHeaderLen = 64 * 1024;
+const maxMetadataLen = 64 * 1024;
+const chunkSize = 64 * 1024;
+const maxChunkSize = 16 * 1024 * 1024;
+const ivLen = 16;
+const chunkTagLen = 32;
+const aeadSaltLen = 16;
+const aeadTagLen = 16;
+const cipherAES256GCM = "aes-256-gcm";
+const padMarker = 0x80;
+
+const encoder = new TextEncoder();
+const decoder = new TextDecoder("utf-8", {fatal: true});
+
+let key = null;
+
+function $(id) {
+  return document.getElementById(id);
+}
+
+function status(id, message, isError) {
+  const output = $(id);
+  output.textContent = message;
+  output.className = isError ? "error" : "";
+}
+
+function concat(...parts) {
+  const length = parts.reduce((sum, part) => sum + part.length, 0);
+  const joined = new Uint8Array(length);
+  let offset = 0;
+  for (const part of parts) {
+    joined.set(part, offset);
+    offset += part.length;
+  }
+  return joined;
+}
+
+function hex(bytes) {
+  return Array.from(new Uint8Array(bytes), b => b.toString(16).padStart(2, "0")).join("");
+}
+
+async function sha256(data) {
+  return new Uint8Array(await crypto.subtle.digest("SHA-256", data));
+}
+
+async function hmacSHA256(keyBytes, ...parts) {
+  const hmacKey = await crypto.subtle.importKey("raw", keyBytes, {name: "HMAC", hash: "SHA-256"}, false, ["sign"]);
+  return new Uint8Array(await crypto.subtle.sign("HMAC", hmacKey, concat(...parts)));
+}
+
+// aeadKey derives the AES-GCM key of an object from the shared key and the object's salt.
+async function aeadKey(cipherName, salt, usage) {
+  const subkey = await hmacSHA256(key, encoder.encode("dead-drop " + cipherName), salt);
+  return crypto.subtle.importKey("raw", subkey, "AES-GCM", false, [usage]);
+}
+
+function aeadNonce(index, final) {
+  const nonce = new Uint8Array(12);
+  new DataView(nonce.buffer).setUint32(7, index);
+  nonce[11] = final ? 1 : 0;
+  return nonce;
+}
+
+// splitChunks splits an encrypted message into its chunks of chunkSize bytes of ciphertext and a tag each. The final
+// chunk may be shorter, and is only empty if there is no plaintext.
+function splitChunks(message, chunkSize, tagLen) {
+  const chunks = [];
+  let offset = 0;
+  while (message.length - offset > chunkSize + tagLen) {
+    chunks.push({data: message.subarray(offset, offset + chunkSize + tagLen), final: false});
+    offset += chunkSize + tagLen;
+  }
+  if (message.length - offset < tagLen) {
+    throw new Error("the object is truncated");
+  }
+  chunks.push({data: message.subarray(offset), final: true});
+  return chunks;
+}
+
+function encodeHeader(header) {
+  const headerBytes = encoder.encode(JSON.stringify(header));
+  const prefix = new Uint8Array(headerPrefixLen);
+  prefix.set(encoder.encode(headerMagic));
+  prefix[headerMagic.length] = header.Cipher ? aeadHeaderVersion : headerVersion;
+  new DataView(prefix.buffer).setUint32(headerMagic.length + 1, headerBytes.length);
+  return concat(prefix, headerBytes);
+}
+
+function decodeHeader(object) {
+  if (object.length < headerPrefixLen || decoder.decode(object.subarray(0, headerMagic.length)) !== headerMagic) {
+    throw new Error("objects dropped before headers existed can only be pulled with the cli");
+  }
+  const version = object[headerMagic.length];
+  if (version !== headerVersion && version !== aeadHeaderVersion) {
+    throw new Error("unsupported object format version " + version);
+  }
+  const headerLen = new DataView(object.buffer, object.byteOffset).getUint32(headerMagic.length + 1);
+  if (headerLen > maxHeaderLen || object.length < headerPrefixLen + headerLen) {
+    throw new Error("malformed object header");
+  }
+  const headerBytes = object.subarray(0, headerPrefixLen + headerLen);
+  const header = JSON.parse(decoder.decode(headerBytes.subarray(headerPrefixLen)));
+  if ((version === aeadHeaderVersion) !== Boolean(header.Cipher) || (header.Cipher && !header.ChunkSize)) {
+    throw new Error("malformed object header");
+  }
+  return {header, headerBytes, message: object.subarray(headerBytes.length)};
+}
+
+function sealEnvelope(metadata, data) {
+  const metadataBytes = encoder.encode(JSON.stringify(metadata));
+  if (metadataBytes.length > maxMetadataLen) {
+    throw new Error("object metadata too large");
+  }
+  const prefix = new Uint8Array(4);
+  new DataView(prefix.buffer).setUint32(0, metadataBytes.length);
+  return concat(prefix, metadataBytes, data);
+}
+
+function openEnvelope(plaintext) {
+  if (plaintext.length < 4) {
+    throw new Error("malformed object envelope");
+  }
+  const metadataLen = new DataView(plaintext.buffer, plaintext.byteOffset).getUint32(0);
+  if (metadataLen > maxMetadataLen || plaintext.length < 4 + metadataLen) {
+    throw new Error("malformed object envelope");
+  }
+  const metadata = JSON.parse(decoder.decode(plaintext.subarray(4, 4 + metadataLen)));
+  return {metadata, data: plaintext.subarray(4 + metadataLen)};
+}
+
+// encryptObject encrypts the plaintext with AES-256-GCM, in chunks like lib's seal writer.
+async function encryptObject(plaintext) {
+  const header = {ChunkSize: chunkSize, Cipher: cipherAES256GCM};
+  const headerBytes = encodeHeader(header);
+  const salt = crypto.getRandomValues(new Uint8Array(aeadSaltLen));
+  const aesKey = await aeadKey(cipherAES256GCM, salt, "encrypt");
+
+  const parts = [headerBytes, salt];
+  const chunks = Math.max(1, Math.ceil(plaintext.length / chunkSize));
+  for (let index = 0; index < chunks; index++) {
+    const chunk = plaintext.subarray(index * chunkSize, (index + 1) * chunkSize);
+    const params = {name: "AES-GCM", iv: aeadNonce(index, index === chunks - 1), additionalData: headerBytes};
+    parts.push(new Uint8Array(await crypto.subtle.encrypt(params, aesKey, chunk)));
+  }
+  return concat(...parts);
+}
+
+async function decryptAEAD(header, headerBytes, message) {
+  if (header.Cipher !== cipherAES256GCM) {
+    throw new Error("objects encrypted with " + header.Cipher + " can only be pulled with the cli");
+  }
+  if (message.length < aeadSaltLen) {
+    throw new Error("the object is truncated");
+  }
+  const aesKey = await aeadKey(header.Cipher, message.subarray(0, aeadSaltLen), "decrypt");
+
+  const parts = [];
+  const chunks = splitChunks(message.subarray(aeadSaltLen), header.ChunkSize, aeadTagLen);
+  for (let index = 0; index < chunks.length; index++) {
+    const params = {name: "AES-GCM", iv: aeadNonce(index, chunks[index].final), additionalData: headerBytes};
+    try {
+      parts.push(new Uint8Array(await crypto.subtle.decrypt(params, aesKey, chunks[index].data)));
+    } catch (e) {
+      throw new Error("decryption failed: the key is wrong or the object was tampered with");
+    }
+  }
+  return concat(...parts);
+}
+
+// decryptChunked decrypts an AES-CTR and HMAC-SHA-256 object, checking the tags of every chunk before decrypting.
+async function decryptChunked(header, headerBytes, message) {
+  if (message.length < ivLen) {
+    throw new Error("the object is truncated");
+  }
+  const keyHash = await sha256(key);
+  const hmacKey = keyHash.subarray(16);
+  const iv = message.subarray(0, ivLen);
+
+  const ciphertexts = [];
+  const chunks = splitChunks(message.subarray(ivLen), header.ChunkSize, chunkTagLen);
+  for (let index = 0; index < chunks.length; index++) {
+    const data = chunks[index].data;
+    const ciphertext = data.subarray(0, data.length - chunkTagLen);
+    const position = new Uint8Array(9);
+    new DataView(position.buffer).setBigUint64(0, BigInt(index));
+    position[8] = chunks[index].final ? 1 : 0;
+    const tag = await hmacSHA256(hmacKey, headerBytes, iv, position, ciphertext);
+    if (hex(tag) !== hex(data.subarray(data.length - chunkTagLen))) {
+      throw new Error("decryption failed: the key is wrong or the object was tampered with");
+    }
+    ciphertexts.push(ciphertext);
+  }
+
+  // The counter runs on across chunks, and over the whole IV as Go's does.
+  const aesKey = await crypto.subtle.importKey("raw", keyHash.subarray(0, 16), "AES-CTR", false, ["decrypt"]);
+  const params = {name: "AES-CTR", counter: iv, length: 128};
+  return new Uint8Array(await crypto.subtle.decrypt(params, aesKey, concat(...ciphertexts)));
+}
+
+async function decodeData(codecs, data) {
+  for (const codec of (codecs || []).slice().reverse()) {
+    if (codec === "padme") {
+      let end = data.length;
+      while (end > 0 && data[end - 1] === 0) {
+        end--;
+      }
+      if (end === 0 || data[end - 1] !== padMarker) {
+        throw new Error("malformed padding");
+      }
+      data = data.subarray(0, end - 1);
+    } else if (codec === "gzip") {
+      const stream = new Blob([data]).stream().pipeThrough(new DecompressionStream("gzip"));
+      data = new Uint8Array(await new Response(stream).arrayBuffer());
+    } else {
+      throw new Error("objects encoded with " + codec + " can only be pulled with the cli");
+    }
+  }
+  return data;
+}
+
+async function decryptObject(object) {
+  const {header, headerBytes, message} = decodeHeader(object);
+  if (header.Kind || header.KeyId || header.Kdf || header.Recipients) {
+    throw new Error("objects encrypted with keyrings, passphrases or to recipients can only be pulled with the cli");
+  }
+  if (!header.ChunkSize || header.ChunkSize > maxChunkSize) {
+    throw new Error("objects dropped before chunking can only be pulled with the cli");
+  }
+
+  const plaintext = header.Cipher ?
+    await decryptAEAD(header, headerBytes, message) :
+    await decryptChunked(header, headerBytes, message);
+  const {metadata, data} = openEnvelope(plaintext);
+  return {metadata, data: await decodeData(header.Codecs, data)};
+}
+
+function save(name, data, type) {
+  const link = document.createElement("a");
+  link.href = URL.createObjectURL(new Blob([data], {type: type || "application/octet-stream"}));
+  link.download = name;
+  link.click();
+  setTimeout(() => URL.revokeObjectURL(link.href), 60000);
+}
+
+async function loadKey(file) {
+  key = new Uint8Array(await file.arrayBuffer());
+  if (key.length === 0) {
+    key = null;
+    throw new Error("the key file is empty");
+  }
+}
+
+async function drop() {
+  if (!key) {
+    throw new Error("load or generate a key file first");
+  }
+  const file = $("drop-file").files[0];
+  if (!file) {
+    throw new Error("choose a file to drop");
+  }
+
+  const metadata = {Name: file.name};
+  if ($("drop-note").value) {
+    metadata.Note = $("drop-note").value;
+  }
+  if (file.type) {
+    metadata.MimeType = file.type;
+  }
+  if (file.lastModified) {
+    metadata.Modified = new Date(file.lastModified).toISOString();
+  }
+
+  status("drop-status", "Encrypting...");
+  const object = await encryptObject(sealEnvelope(metadata, new Uint8Array(await file.arrayBuffer())));
+
+  const headers = {"Content-Type": "application/octet-stream"};
+  const ttlHours = parseInt($("drop-ttl").value, 10);
+  if (ttlHours > 0) {
+    headers["X-Object-TTL"] = String(ttlHours * 3600);
+  }
+  if ($("drop-burn").checked) {
+    headers["X-Burn-After-Reading"] = "true";
+  }
+
+  status("drop-status", "Dropping...");
+  const resp = await fetch("../anonymous/d", {method: "POST", headers, body: object});
+  if (resp.status === 404 || resp.status === 405) {
+    throw new Error("this server doesn't accept anonymous drops");
+  } else if (!resp.ok) {
+    throw new Error("the server refused the drop (" + resp.status + "): " + await resp.text());
+  }
+  const oid = await resp.text();
+  status("drop-status", "Dropped. Send the recipient the reference " + oid + "#" + hex(await sha256(object)) +
+    " and, separately, the key file.");
+}
+
+async function pull() {
+  if (!key) {
+    throw new Error("load the key file first");
+  }
+  const shared = new URL($("pull-url").value, location.href);
+  if (shared.origin !== location.origin || !shared.pathname.includes("/s/")) {
+    throw new Error("only urls shared from this server can be pulled here");
+  }
+
+  status("pull-status", "Pulling...");
+  const resp = await fetch(shared.pathname + shared.search, {cache: "no-store"});
+  if (!resp.ok) {
+    throw new Error("the server refused the pull (" + resp.status + "): " + await resp.text());
+  }
+  const object = new Uint8Array(await resp.arrayBuffer());
+
+  const checksum = shared.hash.slice(1).replace(/^sha256:/, "");
+  if (checksum && checksum !== hex(await sha256(object))) {
+    throw new Error("the object doesn't match the checksum of the url");
+  }
+
+  status("pull-status", "Decrypting...");
+  const {metadata, data} = await decryptObject(object);
+  if (metadata.Format) {
+    throw new Error("directories can only be pulled with the cli");
+  }
+  const name = (metadata.Name || "object").replace(/.*[\/\\]/, "") || "object";
+  save(name, data, metadata.MimeType);
+
+  let message = "Pulled " + name + ".";
+  if (metadata.Note) {
+    message += " Note: " + metadata.Note;
+  }
+  status("pull-status", message);
+}
+
+function run(statusId, action) {
+  return () => action().catch(e => status(statusId, "Error: " + e.message, true));
+}
+
+$("key-file").addEventListener("change", run("key-status", async () => {
+  await loadKey($("key-file").files[0]);
+  status("key-status", "Key loaded.");
+}));
+$("key-generate").addEventListener("click", run("key-status", async () => {
+  key = crypto.getRandomValues(new Uint8Array(32));
+  save("dead-drop.key", key);
+  status("key-status", "Key generated and saved as dead-drop.key. Share it with the recipient out of band.");
+}));
+$("drop").addEventListener("click", run("drop-status", drop));
+$("pull").addEventListener("click", run("pull-status", pull));
@@ -1,15 +1,23 @@
-package main
+package server
 
 import (
+	"bytes"
 	"container/heap"
-	"crypto/rand"
+	"crypto/sha256"
 	"dead-drop/lib"
+	"encoding/hex"
+	"fmt"
 	"github.com/google/logger"
 	"github.com/mitchellh/go-homedir"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,38 +25,95 @@ import (
 const heapCleanThresholdNumber = 4096
 const heapCleanThresholdPercent = 0.5
 
-func initDatabase(dataDirPath string, ttlMin uint, destructiveRead bool) *Database {
+const InvalidCursorErr = Error("invalid listing cursor")
+
+func initDatabase(
+	dataDirPath string,
+	ttlMin uint,
+	expiryInterval time.Duration,
+	destructiveRead bool,
+	accessLogRetentionMin uint,
+	logRequesters bool,
+	inlineThreshold int,
+	oids *oidScheme,
+	aliasVersions int,
+	store objectStore,
+	metas metaStore,
+	sealer *atRestSealer,
+	quotas *quotas,
+	clock Clock,
+	clockGuard *ClockGuard,
+	webhooks *webhooks,
+) (*Database, error) {
 	dataDir, err := createDataDir(dataDirPath)
 	if err != nil {
-		logger.Fatalf("Failed to create data directory: %v", err)
+		return nil, fmt.Errorf("failed to create data directory: %v", err)
 	}
 
-	logger.Infof("Starting database with data directory %s", dataDir)
+	if metas == nil {
+		if metas, err = newFileMetaStore(filepath.Join(dataDir, metaDirName)); err != nil {
+			return nil, fmt.Errorf("failed to create metadata directory: %v", err)
+		}
+	}
+
+	if store == nil {
+		store = newFileStore(dataDir)
+	}
+	if sealer != nil {
+		store = &sealedObjectStore{store: store, sealer: sealer}
+		metas = &sealedMetaStore{metas: metas, sealer: sealer}
+	}
+	if quotas == nil {
+		quotas = newQuotas(0, nil, nil)
+	}
+	logger.Infof("Starting database with data directory %s, storing objects in %s and metadata in %s, with oids of %s",
+		dataDir, store, metas, oids)
 
 	objectMap := make(map[string]bool)
 	expHeap := &ExpirationHeap{}
-	if err = indexDataDir(objectMap, expHeap, &dataDir); err != nil {
-		logger.Fatalf("Failed to index data directory: %v", err)
+	ttl := time.Duration(ttlMin) * time.Minute
+	if err = indexObjects(objectMap, expHeap, store, metas, quotas, ttl); err != nil {
+		return nil, fmt.Errorf("failed to index stored objects: %v", err)
+	}
+	if err = indexInlineObjects(objectMap, expHeap, metas, quotas, ttl); err != nil {
+		return nil, fmt.Errorf("failed to index inline objects: %v", err)
+	}
+	aliases, err := indexAliases(objectMap, metas, aliasVersions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to index the versions of aliases: %v", err)
 	}
 	heap.Init(expHeap)
 
 	lock := &sync.RWMutex{}
 
 	db := &Database{
-		lock:             lock,
-		objectMap:        objectMap,
-		expHeap:          expHeap,
-		heapCleanCond:    sync.NewCond(lock),
-		dirtyHeapBlocks:  0,
-		heapCleanPending: false,
-		dataDir:          dataDir,
-		ttlMin:           ttlMin,
-		destructiveRead:  destructiveRead,
+		lock:                  lock,
+		objectMap:             objectMap,
+		expHeap:               expHeap,
+		heapCleanCond:         sync.NewCond(lock),
+		dirtyHeapBlocks:       0,
+		heapCleanPending:      false,
+		dataDir:               dataDir,
+		metas:                 metas,
+		ttlMin:                ttlMin,
+		expiryInterval:        expiryInterval,
+		destructiveRead:       destructiveRead,
+		accessLogRetentionMin: accessLogRetentionMin,
+		logRequesters:         logRequesters,
+		inlineThreshold:       inlineThreshold,
+		oids:                  oids,
+		store:                 store,
+		quotas:                quotas,
+		clock:                 clock,
+		clockGuard:            clockGuard,
+		webhooks:              webhooks,
+		aliases:               aliases,
+		claimedPulls:          make(map[string]int),
 	}
 
 	go db.expiryJob()
 
-	return db
+	return db, nil
 }
 
 func createDataDir(path string) (string, error) {
@@ -59,58 +124,510 @@ func createDataDir(path string) (string, error) {
 	return dataDir, os.MkdirAll(dataDir, 0770)
 }
 
-func indexDataDir(objectMap map[string]bool, expHeap *ExpirationHeap, dataDir *string) error {
-	logger.Infof("Indexing data directory for existing objects")
+// indexObjects adds the objects with data of their own to the object index, by the time their data was stored, and
+// counts them against the quotas of their owners.
+func indexObjects(
+	objectMap map[string]bool,
+	expHeap *ExpirationHeap,
+	store objectStore,
+	metas metaStore,
+	quotas *quotas,
+	ttl time.Duration,
+) error {
+	logger.Infof("Indexing %s for existing objects", store)
+
+	return store.list(func(oid string, modified time.Time) {
+		objectTTL := time.Duration(0)
+		if meta, err := metas.read(oid); err == nil && meta != nil {
+			objectTTL = meta.TTL
+
+			size := meta.Size
+			if size == 0 {
+				// Metadata written before sizes were recorded.
+				size, _, _ = store.stat(oid)
+			}
+			quotas.add(meta.Owner, meta.Namespace, size)
+		}
+
+		objectMap[oid] = true
+		expHeap.Push(newObjectInfo(oid, modified, objectTTL, ttl))
+	})
+}
+
+type Database struct {
+	lock                  *sync.RWMutex
+	objectMap             map[string]bool
+	expHeap               *ExpirationHeap
+	heapCleanCond         *sync.Cond
+	dirtyHeapBlocks       uint
+	heapCleanPending      bool
+	dataDir               string
+	metas                 metaStore
+	metaLock              sync.Mutex
+	ttlMin                uint
+	expiryInterval        time.Duration
+	destructiveRead       bool
+	accessLogRetentionMin uint
+	logRequesters         bool
+	inlineThreshold       int
+	store                 objectStore
+	quotas                *quotas
+	clock                 Clock
+	clockGuard            *ClockGuard
+	// oids is how the oids of new objects are picked.
+	oids *oidScheme
+	// aliases indexes the objects dropped under an alias by their version.
+	aliases *aliases
+	// claimedPulls counts the pulls in progress of objects which allow a limited number of pulls, by oid, under
+	// metaLock.
+	claimedPulls map[string]int
+	// expiryLock serializes removing expired objects.
+	expiryLock sync.Mutex
+	// webhooks are sent for object events, such as expiry, or are nil if there are none.
+	webhooks *webhooks
+	// reclaimedObjects and reclaimedBytes count the objects removed by the expiry job, and the size of their data.
+	reclaimedObjects uint64
+	reclaimedBytes   uint64
+	// expiryRunCount counts the runs of the expiry job which weren't paused, and expiryNanos is how long the last took.
+	expiryRunCount uint64
+	expiryNanos    int64
+}
+
+// ObjectReader reads a stored object, whether it is inline or has data of its own in the object store.
+type ObjectReader interface {
+	io.ReadSeeker
+	io.Closer
+}
 
-	files, err := ioutil.ReadDir(*dataDir)
+type inlineObject struct {
+	*bytes.Reader
+}
+
+func (inlineObject) Close() error {
+	return nil
+}
+
+// pull opens an object on behalf of the named key, returning nil if it does not exist or has no pulls left, its size,
+// and the claim of the pull (see claimPull), which is taken before any of the object is sent.
+// The pull is recorded in the object's access log, with the offset it starts from if it resumes an earlier one.
+// The reader must be closed, and the pull finished with pulled once it has been sent, or given back with unpulled if
+// sending it failed or it was refused.
+func (db *Database) pull(oid string, keyName string, offset int64) (ObjectReader, int64, *pullClaim, error) {
+	if !db.hasObject(oid) {
+		return nil, 0, nil, nil
+	}
+	claim, err := db.claimPull(oid)
+	if err != nil || claim == nil {
+		return nil, 0, nil, err
+	}
+
+	object, size, err := db.openObject(oid)
 	if err != nil {
-		return err
+		db.unpulled(claim)
+		return nil, 0, nil, err
 	}
 
-	for _, file := range files {
-		oid := file.Name()
+	// Requests for nothing past the end of the object are refused, so are not pulls.
+	if offset < size {
+		db.recordPull(oid, keyName, offset)
+	}
+	return object, size, claim, nil
+}
 
-		objectMap[oid] = true
-		expHeap.Push(&ObjectInfo{
-			created: file.ModTime(),
-			oid:     oid,
-		})
+// pulled finishes a pull which was sent, destroying the object if it was its last pull. The object stays claimed until
+// it is destroyed, so that no other pull can start in between.
+func (db *Database) pulled(claim *pullClaim) {
+	if claim.last {
+		if db.destroyObject(claim.oid) {
+			db.webhooks.notify(auditObjectRemoved, "", claim.oid, "destroyed on pull")
+		}
 	}
+	db.completePull(claim)
+}
 
-	return nil
+// unpulled gives back the claim of a pull which was refused, or failed to be sent, which leaves the object as it was so
+// that the pull can be resumed with a pull of the rest of the object.
+func (db *Database) unpulled(claim *pullClaim) {
+	if !claim.limited {
+		return
+	}
+
+	db.metaLock.Lock()
+	defer db.metaLock.Unlock()
+	db.releaseClaim(claim.oid)
 }
 
-type Database struct {
-	lock             *sync.RWMutex
-	objectMap        map[string]bool
-	expHeap          *ExpirationHeap
-	heapCleanCond    *sync.Cond
-	dirtyHeapBlocks  uint
-	heapCleanPending bool
-	dataDir          string
-	ttlMin           uint
-	destructiveRead  bool
-}
-
-func (db *Database) pull(oid string) ([]byte, error) {
-	db.lock.RLock()
-	_, ok := db.objectMap[oid]
-	db.lock.RUnlock()
-	if !ok {
+// stat describes an object on behalf of the named key of a namespace, returning nil if it does not exist.
+func (db *Database) stat(oid string, keyName string, namespace string) (*lib.ObjectStatPayload, error) {
+	if !db.hasObject(oid) {
 		return nil, nil
 	}
 
-	data, err := db.readObject(oid)
+	meta, err := db.objectMeta(oid)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		// Objects dropped before metadata was kept are indexed by the time their data was stored.
+		_, modified, err := db.store.stat(oid)
+		if err != nil {
+			return nil, nil
+		}
+		meta = &ObjectMeta{Created: modified}
+	}
 
-	if db.destructiveRead {
-		go db.destroyObject(oid)
+	size, err := db.objectSize(oid, meta)
+	if err != nil {
+		return nil, nil
 	}
 
-	return data, err
+	expires := meta.expires(db.ttl())
+	payload := &lib.ObjectStatPayload{
+		Oid:       oid,
+		Size:      size,
+		Created:   meta.Created,
+		Expires:   expires,
+		Remaining: expires.Sub(db.clock.Now()),
+	}
+	if payload.Remaining < 0 {
+		payload.Remaining = 0
+	}
+	if db.accessLogEnabled() && meta.ownedBy(keyName, namespace) {
+		pulls := len(meta.Pulls)
+		payload.Pulls = &pulls
+	}
+	if meta.ownedBy(keyName, namespace) {
+		payload.Labels = meta.Labels
+	}
+	payload.ReleaseAt = meta.ReleaseAt
+	payload.Burn = db.destructiveRead || meta.pullsLeft() == 1
+	if left := meta.pullsLeft(); left >= 0 {
+		payload.PullsLeft = &left
+	}
+	return payload, nil
+}
+
+// checksum computes the checksum of an object with an algorithm, returning nil if it does not exist.
+func (db *Database) checksum(oid string, algorithm string) (*lib.ObjectChecksumPayload, error) {
+	if !db.hasObject(oid) {
+		return nil, nil
+	}
+	// Objects with no pulls left are about to be destroyed, and can't be pulled any more.
+	if meta, err := db.objectMeta(oid); err == nil && meta != nil && meta.pullsLeft() == 0 {
+		return nil, nil
+	}
+
+	hash, err := lib.NewChecksumHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	object, _, err := db.openObject(oid)
+	if err != nil {
+		// The object may have expired since it was looked up.
+		if !db.hasObject(oid) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer object.Close()
+
+	// Content oids are checked while the data is read anyway, skipping objects dropped before the server used them.
+	var sum io.Writer = hash
+	content := sha256.New()
+	if db.oids.content {
+		sum = io.MultiWriter(hash, content)
+	}
+	size, err := io.Copy(sum, object)
+	if err != nil {
+		logger.Errorf("Failed to read object %s: %v", oid, err)
+		return nil, err
+	}
+	if db.oids.content && len(oid) == sha256.Size*2 && hex.EncodeToString(content.Sum(nil)) != oid {
+		logger.Errorf("Stored data of object %s doesn't match its oid", oid)
+		return nil, CorruptObjectErr
+	}
+
+	payload := &lib.ObjectChecksumPayload{
+		Oid:       oid,
+		Size:      size,
+		Algorithm: algorithm,
+		Checksum:  lib.EncodeChecksum(hash.Sum(nil)),
+	}
+	return payload, nil
+}
+
+// remove destroys an object on behalf of the named key of a namespace, which must have dropped it.
+// It returns false if there is no such object, or it belongs to another key.
+func (db *Database) remove(oid string, keyName string, namespace string) (bool, error) {
+	if !db.hasObject(oid) {
+		return false, nil
+	}
+
+	meta, err := db.objectMeta(oid)
+	if err != nil {
+		return false, err
+	}
+	if meta == nil || !meta.ownedBy(keyName, namespace) {
+		return false, nil
+	}
+
+	return db.destroyObject(oid), nil
+}
+
+// dropPolicy is how the dropper of an object asked for it to be destroyed.
+type dropPolicy struct {
+	// ttl is how long after the drop the object expires, or 0 for the server's ttl, which is also the longest allowed.
+	ttl time.Duration
+	// burn destroys the object once it has been pulled, even if the server doesn't destroy every pull.
+	burn bool
+	// maxPulls destroys the object once it has been pulled this many times, unless it is 0.
+	maxPulls int
+	// labels are stored with the object, for its owner to list objects by.
+	labels map[string]string
+	// alias makes the object the next version of the objects dropped under it, unless it is empty. version is the
+	// version number the server gives it.
+	alias   string
+	version int
+	// releaseTo are the keys the object is released to once its owner hasn't checked in for checkinInterval, unless it
+	// is empty.
+	releaseTo       []string
+	checkinInterval time.Duration
+	// releaseAt is the time before which the object can't be pulled, unless it is zero.
+	releaseAt time.Time
+	// canary raises an alert whenever the object is pulled.
+	canary bool
+}
+
+// releaseAtTime returns the release time to record for an object, or nil if it has none.
+func (policy dropPolicy) releaseAtTime() *time.Time {
+	if policy.releaseAt.IsZero() {
+		return nil
+	}
+	releaseAt := policy.releaseAt.UTC()
+	return &releaseAt
+}
+
+// drop stores an object owned by the named key, in the key's namespace, returning its oid, or a quotaError if it would
+// take the key or its namespace over their quota.
+//
+// With content oids, dropping data which is already stored returns the oid of the stored object, as it is, if the key
+// dropped it, or DuplicateObjectErr otherwise.
+//
+// Objects dropped under an alias are its next version, unless another key owns it (AliasOwnedErr).
+func (db *Database) drop(bytes []byte, owner string, namespace string, policy dropPolicy) (string, error) {
+	if err := db.checkRelease(owner, policy); err != nil {
+		return "", err
+	}
+	oid := ""
+	if db.oids.content {
+		oid = contentOid(bytes)
+		if db.hasObject(oid) {
+			return db.redrop(oid, owner, namespace)
+		}
+	}
+	if err := db.reserveVersion(owner, namespace, &policy); err != nil {
+		return "", err
+	}
+	if err := db.quotas.reserve(owner, namespace, int64(len(bytes))); err != nil {
+		db.cancelVersion(namespace, policy)
+		return "", err
+	}
+
+	policy.ttl = db.objectTTL(policy.ttl)
+	oid, created, ok := db.allocateOid(oid, policy.ttl)
+	if !ok {
+		db.quotas.release(owner, namespace, int64(len(bytes)))
+		db.cancelVersion(namespace, policy)
+		return db.redrop(oid, owner, namespace)
+	}
+	db.storeObject(oid, owner, namespace, created, policy, bytes)
+	db.addVersion(oid, namespace, policy)
+	return oid, nil
+}
+
+// dropFile is drop for an object in a file inside the data directory, which is moved into place, or removed if the
+// object is refused.
+func (db *Database) dropFile(path string, owner string, namespace string, policy dropPolicy) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if err := db.checkRelease(owner, policy); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	oid := ""
+	if db.oids.content {
+		if oid, err = fileContentOid(path); err != nil {
+			os.Remove(path)
+			return "", err
+		}
+		if db.hasObject(oid) {
+			os.Remove(path)
+			return db.redrop(oid, owner, namespace)
+		}
+	}
+	if err := db.reserveVersion(owner, namespace, &policy); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	if err := db.quotas.reserve(owner, namespace, info.Size()); err != nil {
+		os.Remove(path)
+		db.cancelVersion(namespace, policy)
+		return "", err
+	}
+
+	policy.ttl = db.objectTTL(policy.ttl)
+	oid, created, ok := db.allocateOid(oid, policy.ttl)
+	if !ok {
+		os.Remove(path)
+		db.quotas.release(owner, namespace, info.Size())
+		db.cancelVersion(namespace, policy)
+		return db.redrop(oid, owner, namespace)
+	}
+	db.storeObjectFile(oid, owner, namespace, created, policy, path)
+	db.addVersion(oid, namespace, policy)
+	return oid, nil
+}
+
+// checkRelease returns an error unless an object dropped to be released to other keys has an owner to check in, and
+// unless an object which is released later, to other keys or at a release time, is kept long enough to be released.
+func (db *Database) checkRelease(owner string, policy dropPolicy) error {
+	if len(policy.releaseTo) == 0 && policy.releaseAt.IsZero() {
+		return nil
+	}
+	if owner == "" && len(policy.releaseTo) > 0 {
+		return AnonymousReleaseErr
+	}
+	ttl := db.ttl()
+	if requested := db.objectTTL(policy.ttl); requested > 0 {
+		ttl = requested
+	}
+	if len(policy.releaseTo) > 0 && policy.checkinInterval >= ttl {
+		return ReleaseAfterExpiryErr
+	}
+	if !policy.releaseAt.IsZero() && !policy.releaseAt.Before(db.clock.Now().Add(ttl)) {
+		return EmbargoAfterExpiryErr
+	}
+	return nil
+}
+
+// reserveVersion gives an object dropped under an alias its version number.
+func (db *Database) reserveVersion(owner string, namespace string, policy *dropPolicy) error {
+	if policy.alias == "" {
+		return nil
+	}
+	version, err := db.aliases.reserve(namespace, policy.alias, owner)
+	policy.version = version
+	return err
+}
+
+func (db *Database) cancelVersion(namespace string, policy dropPolicy) {
+	if policy.alias != "" {
+		db.aliases.cancel(namespace, policy.alias)
+	}
+}
+
+// addVersion indexes a stored object dropped under an alias, and removes the versions of the alias which are no longer
+// retained.
+func (db *Database) addVersion(oid string, namespace string, policy dropPolicy) {
+	if policy.alias == "" {
+		return
+	}
+	for _, pruned := range db.aliases.add(namespace, policy.alias, policy.version, oid) {
+		if db.destroyObject(pruned) {
+			logger.Infof("Removed object %s, an old version of alias %s", pruned, policy.alias)
+			db.webhooks.notify(auditObjectRemoved, "", pruned, "replaced by a newer version")
+		}
+	}
+}
+
+// version returns a stored version of an alias of a namespace by its number, or its latest version if number is 0, or
+// nil if there is no such version.
+func (db *Database) version(namespace string, alias string, number int) *lib.AliasVersion {
+	versions := db.versions(namespace, alias)
+	for i := len(versions) - 1; i >= 0; i-- {
+		if number == 0 || versions[i].Version == number {
+			return &versions[i]
+		}
+	}
+	return nil
+}
+
+// versions lists the stored versions of an alias of a namespace, oldest first.
+func (db *Database) versions(namespace string, alias string) []lib.AliasVersion {
+	versions := make([]lib.AliasVersion, 0)
+	for _, version := range db.aliases.versions(namespace, alias) {
+		meta, err := db.objectMeta(version.oid)
+		if err != nil || meta == nil {
+			continue
+		}
+		size, err := db.objectSize(version.oid, meta)
+		if err != nil {
+			// The object was removed since it was listed.
+			continue
+		}
+		versions = append(versions, lib.AliasVersion{
+			Version: version.version,
+			Oid:     version.oid,
+			Size:    size,
+			Created: meta.Created,
+		})
+	}
+	return versions
+}
+
+// redrop returns the oid of a stored object whose data was dropped again, if the dropping key of a namespace dropped
+// it, or DuplicateObjectErr otherwise. Objects which are still being stored by another drop have no owner yet.
+func (db *Database) redrop(oid string, owner string, namespace string) (string, error) {
+	meta, err := db.objectMeta(oid)
+	if err != nil {
+		return "", err
+	}
+	if meta == nil || meta.Owner != owner || meta.Namespace != namespace {
+		return "", DuplicateObjectErr
+	}
+	return oid, nil
+}
+
+// quotaRemaining returns the bytes a key may still store in its namespace, and false if there is no limit. Drops are
+// checked against it before they are read, so that keys over quota can't make the server buffer large bodies.
+func (db *Database) quotaRemaining(keyName string, namespace string) (int64, bool) {
+	return db.quotas.remaining(keyName, namespace)
+}
+
+// checkQuota returns a quotaError if an object of the given size would take a key or its namespace over its quota.
+func (db *Database) checkQuota(keyName string, namespace string, size int64) error {
+	return db.quotas.check(keyName, namespace, size)
+}
+
+// quotaUsage returns the bytes of object data stored by a key, and its quota, or 0 if it has none.
+func (db *Database) quotaUsage(keyName string) (int64, int64) {
+	return db.quotas.usage(keyName)
+}
+
+// namespaceQuotaUsage returns the bytes of object data stored in a namespace, and its quota, or 0 if it has none.
+func (db *Database) namespaceQuotaUsage(namespace string) (int64, int64) {
+	return db.quotas.namespaceUsage(namespace)
 }
 
-func (db *Database) drop(bytes []byte) string {
-	const oidLen = 16
+func (db *Database) ttl() time.Duration {
+	return time.Duration(db.ttlMin) * time.Minute
+}
+
+// objectTTL returns the ttl to record for an object dropped with the requested ttl: 0, meaning the server's ttl,
+// unless the requested one is sooner.
+func (db *Database) objectTTL(requested time.Duration) time.Duration {
+	if requested <= 0 || requested >= db.ttl() {
+		return 0
+	}
+	return requested
+}
+
+// allocateOid picks an oid for a new object expiring after ttl, unless it is given one, and indexes it, returning false
+// if a given oid is already indexed. The object must be stored straight after.
+func (db *Database) allocateOid(oid string, ttl time.Duration) (string, time.Time, bool) {
 	const maxOidAttempts = 16
 
 	db.lock.Lock()
@@ -119,62 +636,293 @@ func (db *Database) drop(bytes []byte) string {
 		db.heapCleanCond.Wait()
 	}
 
-	oid := ""
-	attempt := 1
-	for {
-		oid = db.randomOid(oidLen)
-		if _, ok := db.objectMap[oid]; !ok {
-			break
+	if oid != "" {
+		if _, ok := db.objectMap[oid]; ok {
+			db.lock.Unlock()
+			return oid, time.Time{}, false
 		}
-		attempt++
-		if attempt > maxOidAttempts {
-			logger.Error("Key-space is very full, data is being overwritten")
-			break
+	} else {
+		attempt := 1
+		for {
+			oid = db.oids.random()
+			if _, ok := db.objectMap[oid]; !ok {
+				break
+			}
+			attempt++
+			if attempt > maxOidAttempts {
+				logger.Error("Key-space is very full, data is being overwritten")
+				break
+			}
 		}
 	}
 
+	created := db.clock.Now()
 	db.objectMap[oid] = true
-	heap.Push(db.expHeap, &ObjectInfo{
-		created: time.Now(),
-		oid:     oid,
-	})
+	heap.Push(db.expHeap, newObjectInfo(oid, created, ttl, db.ttl()))
 
 	db.lock.Unlock()
 
-	db.writeObject(oid, bytes)
+	return oid, created, true
+}
 
-	return oid
+// objects lists the stored objects and their creation times, oldest first.
+func (db *Database) objects() []ObjectInfo {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	objects := make([]ObjectInfo, 0, len(db.objectMap))
+	for _, oi := range *db.expHeap {
+		if _, ok := db.objectMap[oi.oid]; ok {
+			objects = append(objects, *oi)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].created.Equal(objects[j].created) {
+			return objects[i].oid < objects[j].oid
+		}
+		return objects[i].created.Before(objects[j].created)
+	})
+	return objects
 }
 
-func (db *Database) expiryJob() {
+// ownedObjects lists the objects owned by the named key of a namespace which a filter selects, oldest first, starting
+// after the cursor of an earlier page. It returns at most limit objects, and the cursor of the next page, or "" if there
+// are no more.
+func (db *Database) ownedObjects(owner string, namespace string, filter listFilter, after string, limit int) (
+	[]lib.ObjectSummary, string, error) {
+	afterCreated, afterOid, err := parseListCursor(after)
+	if err != nil {
+		return nil, "", err
+	}
+	afterCreated, afterOid = filter.start(afterCreated, afterOid)
+
+	summaries := make([]lib.ObjectSummary, 0)
 	for {
-		time.Sleep(time.Minute)
+		// Metadata outlives removed objects for the access log retention period, and filters leave objects out, so the
+		// metadata of more objects than are listed may have to be read. One more than the limit is read to find out
+		// whether there is another page.
+		owned, err := db.metas.owned(owner, afterCreated, afterOid, limit+1)
+		if err != nil {
+			return nil, "", err
+		}
 
-		expired := make([]*ObjectInfo, 0)
+		for _, listed := range owned {
+			afterCreated, afterOid = listed.meta.Created, listed.oid
+			if filter.ended(listed.meta.Created) {
+				return summaries, "", nil
+			}
+			if listed.meta.Namespace != namespace || !db.hasObject(listed.oid) {
+				continue
+			}
 
-		db.lock.Lock()
+			size, err := db.objectSize(listed.oid, listed.meta)
+			if err != nil {
+				// The object was removed since it was listed.
+				continue
+			}
+			if !filter.matches(owner, listed.meta.Created, size, listed.meta.Labels) {
+				continue
+			}
 
-		for db.heapCleanPending {
-			db.heapCleanCond.Wait()
+			if len(summaries) == limit {
+				last := summaries[len(summaries)-1]
+				return summaries, listCursor(last.Created, last.Oid), nil
+			}
+			summaries = append(summaries, lib.ObjectSummary{
+				Oid:     listed.oid,
+				Size:    size,
+				Created: listed.meta.Created,
+				Labels:  listed.meta.Labels,
+			})
 		}
 
-		for !db.expHeap.IsEmpty() && db.expHeap.Peek().IsExpired(db.ttlMin) {
-			oi := heap.Pop(db.expHeap).(*ObjectInfo)
+		if len(owned) <= limit {
+			return summaries, "", nil
+		}
+	}
+}
 
-			if _, ok := db.objectMap[oi.oid]; ok {
-				delete(db.objectMap, oi.oid)
-				expired = append(expired, oi)
-			} else {
-				db.dirtyHeapBlocks -= 1
-			}
+// listCursor encodes the position of an object in a listing, which is ordered by creation time and then oid.
+func listCursor(created time.Time, oid string) string {
+	return fmt.Sprintf("%d.%s", created.UnixNano(), oid)
+}
+
+func parseListCursor(cursor string) (time.Time, string, error) {
+	if cursor == "" {
+		return time.Time{}, "", nil
+	}
+
+	parts := strings.SplitN(cursor, ".", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", InvalidCursorErr
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, "", InvalidCursorErr
+	}
+	return time.Unix(0, nanos), parts[1], nil
+}
+
+// objectSize returns the size of a stored object, given its metadata.
+func (db *Database) objectSize(oid string, meta *ObjectMeta) (int64, error) {
+	if meta.Inline {
+		if meta.Data == nil {
+			return 0, fmt.Errorf("object %s was removed", oid)
+		}
+		return int64(len(meta.Data)), nil
+	}
+
+	if meta.Size > 0 {
+		return meta.Size, nil
+	}
+	size, _, err := db.store.stat(oid)
+	return size, err
+}
+
+// reclaimed returns the number of objects removed by the expiry job since the server started, and the size of their
+// data.
+func (db *Database) reclaimed() (uint64, uint64) {
+	return atomic.LoadUint64(&db.reclaimedObjects), atomic.LoadUint64(&db.reclaimedBytes)
+}
+
+// close waits for metadata writes in progress, and closes the metadata store. Metadata can't be written afterwards,
+// so background jobs which try block until the process exits.
+func (db *Database) close() {
+	db.metaLock.Lock()
+
+	if closer, ok := db.metas.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Errorf("Failed to close %s: %v", db.metas, err)
 		}
+	}
+}
+
+// expiryRuns returns the number of times the expiry job has run since the server started.
+func (db *Database) expiryRuns() uint64 {
+	return atomic.LoadUint64(&db.expiryRunCount)
+}
+
+// lastExpiryDuration returns how long the last run of the expiry job took.
+func (db *Database) lastExpiryDuration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&db.expiryNanos))
+}
+
+// storedBytes returns the total size of the stored objects.
+func (db *Database) storedBytes() int64 {
+	return db.quotas.total()
+}
+
+// stats returns the number of stored objects, and the creation time of the oldest one.
+func (db *Database) stats() (int, time.Time) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var oldest time.Time
+	for _, oi := range *db.expHeap {
+		if _, ok := db.objectMap[oi.oid]; ok && (oldest.IsZero() || oi.created.Before(oldest)) {
+			oldest = oi.created
+		}
+	}
+	return len(db.objectMap), oldest
+}
+
+func (db *Database) hasObject(oid string) bool {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	_, ok := db.objectMap[oid]
+	return ok
+}
+
+// insert stores an object under a known oid, e.g. one replicated from another server.
+// Objects which already exist are left alone.
+func (db *Database) insert(oid string, data []byte, owner string, namespace string, created time.Time,
+	policy dropPolicy) {
+	policy.ttl = db.objectTTL(policy.ttl)
+
+	db.lock.Lock()
+
+	for db.heapCleanPending {
+		db.heapCleanCond.Wait()
+	}
+
+	if _, ok := db.objectMap[oid]; ok {
 		db.lock.Unlock()
+		return
+	}
+
+	db.objectMap[oid] = true
+	heap.Push(db.expHeap, newObjectInfo(oid, created, policy.ttl, db.ttl()))
+
+	db.lock.Unlock()
+
+	// The primary enforced the quota when the object was dropped, and pruned the versions of its alias.
+	db.quotas.add(owner, namespace, int64(len(data)))
+	db.storeObject(oid, owner, namespace, created, policy, data)
+	if policy.alias != "" {
+		db.aliases.record(namespace, policy.alias, owner, policy.version, oid)
+	}
+}
+
+// expiryJob removes expired objects every expiry interval, and the metadata of removed objects once their access log
+// retention has passed.
+func (db *Database) expiryJob() {
+	for {
+		db.clock.Sleep(db.expiryInterval)
 
-		for _, oi := range expired {
-			logger.Infof("Removing expired object %s", oi.oid)
-			db.removeObject(oi.oid)
+		if !db.clockGuard.allowGC() {
+			continue
 		}
+
+		db.expire()
+	}
+}
+
+// expire removes the objects which have expired, and the metadata whose access log retention has passed, returning
+// the number of objects removed and the size of their data. Runs are serialized, so that admins forcing one don't
+// race the expiry job.
+func (db *Database) expire() (int, uint64) {
+	db.expiryLock.Lock()
+	defer db.expiryLock.Unlock()
+
+	now := db.clock.Now()
+	expired := make([]*ObjectInfo, 0)
+
+	db.lock.Lock()
+
+	for db.heapCleanPending {
+		db.heapCleanCond.Wait()
+	}
+
+	for !db.expHeap.IsEmpty() && db.expHeap.Peek().IsExpired(now) {
+		oi := heap.Pop(db.expHeap).(*ObjectInfo)
+
+		if _, ok := db.objectMap[oi.oid]; ok {
+			delete(db.objectMap, oi.oid)
+			expired = append(expired, oi)
+		} else {
+			db.dirtyHeapBlocks -= 1
+		}
+	}
+	db.lock.Unlock()
+
+	reclaimedBytes := uint64(0)
+	for _, oi := range expired {
+		logger.Infof("Removing expired object %s", oi.oid)
+		reclaimedBytes += uint64(db.removeObject(oi.oid))
+		db.webhooks.notify(webhookObjectExpired, "", oi.oid, "")
 	}
+	if len(expired) > 0 {
+		atomic.AddUint64(&db.reclaimedObjects, uint64(len(expired)))
+		atomic.AddUint64(&db.reclaimedBytes, reclaimedBytes)
+		logger.Infof("Reclaimed %d expired objects of %d bytes", len(expired), reclaimedBytes)
+	}
+
+	db.removeExpiredMeta(now)
+
+	atomic.AddUint64(&db.expiryRunCount, 1)
+	atomic.StoreInt64(&db.expiryNanos, int64(db.clock.Now().Sub(now)))
+	return len(expired), reclaimedBytes
 }
 
 func (db *Database) heapCleanerJob() {
@@ -217,11 +965,16 @@ func (db *Database) heapCleanerJob() {
 	logger.Infof("Finished swap to compacted heap")
 }
 
-func (db *Database) destroyObject(oid string) {
+// destroyObject removes an object before it expires, returning false if it was already removed.
+func (db *Database) destroyObject(oid string) bool {
 	shouldStartHeapCleaner := false
 
 	db.lock.Lock()
 
+	if _, ok := db.objectMap[oid]; !ok {
+		db.lock.Unlock()
+		return false
+	}
 	delete(db.objectMap, oid)
 	db.dirtyHeapBlocks += 1
 
@@ -239,54 +992,111 @@ func (db *Database) destroyObject(oid string) {
 	}
 
 	db.removeObject(oid)
+	return true
 }
 
-func (db *Database) randomOid(length int) string {
-	const characters = "abcdefghijklmnopqrstuvwxyz"
-
-	bytes := make([]byte, length)
-	if _, err := rand.Read(bytes); err != nil {
-		logger.Fatalf("Failed to generate random oid: %v", err)
+func (db *Database) writeObject(oid string, data []byte) {
+	if err := db.store.put(oid, data); err != nil {
+		logger.Errorf("Failed to write object %s: %v", oid, err)
 	}
+}
 
-	modulo := byte(len(characters))
-	for i, b := range bytes {
-		bytes[i] = characters[b%modulo]
+func (db *Database) readObject(oid string) ([]byte, error) {
+	meta, err := db.objectMeta(oid)
+	if err != nil {
+		return nil, err
+	}
+	if meta != nil && meta.Inline {
+		if meta.Data == nil {
+			return nil, fmt.Errorf("object %s was removed", oid)
+		}
+		return meta.Data, nil
 	}
-	return string(bytes)
-}
 
-func (db *Database) writeObject(oid string, data []byte) {
-	if err := ioutil.WriteFile(db.objectPath(oid), data, lib.ObjectPerms); err != nil {
-		logger.Errorf("Failed to write object %s to disk: %v", oid, err)
+	object, _, err := db.store.open(oid)
+	if err != nil {
+		logger.Errorf("Failed to read object %s: %v", oid, err)
+		return nil, err
 	}
-}
+	defer object.Close()
 
-func (db *Database) readObject(oid string) ([]byte, error) {
-	data, err := ioutil.ReadFile(db.objectPath(oid))
+	data, err := ioutil.ReadAll(object)
 	if err != nil {
-		logger.Errorf("Failed to read object %s from disk: %v", oid, err)
+		logger.Errorf("Failed to read object %s: %v", oid, err)
 	}
 	return data, err
 }
 
-func (db *Database) removeObject(oid string) {
-	if err := os.Remove(db.objectPath(oid)); err != nil {
-		logger.Errorf("Failed to remove object %s: %v", oid, err)
+// openObject opens an object for reading, returning its size.
+func (db *Database) openObject(oid string) (ObjectReader, int64, error) {
+	meta, err := db.objectMeta(oid)
+	if err != nil {
+		return nil, 0, err
 	}
+	if meta != nil && meta.Inline {
+		if meta.Data == nil {
+			return nil, 0, fmt.Errorf("object %s was removed", oid)
+		}
+		return inlineObject{bytes.NewReader(meta.Data)}, int64(len(meta.Data)), nil
+	}
+
+	object, size, err := db.store.open(oid)
+	if err != nil {
+		logger.Errorf("Failed to read object %s: %v", oid, err)
+		return nil, 0, err
+	}
+	return object, size, nil
 }
 
-func (db *Database) objectPath(oid string) string {
-	return filepath.Join(db.dataDir, oid)
+// removeObject removes an object's data, and releases it from its owner's quota, returning its size.
+func (db *Database) removeObject(oid string) int64 {
+	meta := db.releaseMeta(oid)
+	if meta != nil && meta.Alias != "" {
+		db.aliases.remove(meta.Namespace, meta.Alias, oid)
+	}
+	if meta != nil && meta.Inline {
+		db.quotas.release(meta.Owner, meta.Namespace, int64(len(meta.Data)))
+		return int64(len(meta.Data))
+	}
+
+	size := int64(0)
+	if meta != nil {
+		size = meta.Size
+	}
+	if size == 0 {
+		// Metadata written before sizes were recorded, if there is any.
+		size, _, _ = db.store.stat(oid)
+	}
+	if meta != nil {
+		db.quotas.release(meta.Owner, meta.Namespace, size)
+	}
+
+	if err := db.store.remove(oid); err != nil {
+		logger.Errorf("Failed to remove object %s: %v", oid, err)
+	}
+	return size
 }
 
 type ObjectInfo struct {
 	created time.Time
+	expires time.Time
 	oid     string
 }
 
-func (oi *ObjectInfo) IsExpired(ttlMin uint) bool {
-	return oi.created.Add(time.Duration(ttlMin) * time.Minute).Before(time.Now())
+// newObjectInfo indexes an object expiring after ttl, or defaultTTL if ttl is 0.
+func newObjectInfo(oid string, created time.Time, ttl time.Duration, defaultTTL time.Duration) *ObjectInfo {
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	return &ObjectInfo{
+		created: created,
+		expires: created.Add(ttl),
+		oid:     oid,
+	}
+}
+
+func (oi *ObjectInfo) IsExpired(now time.Time) bool {
+	return oi.expires.Before(now)
 }
 
 type ExpirationHeap []*ObjectInfo
@@ -304,7 +1114,7 @@ func (ttlQ ExpirationHeap) Len() int {
 }
 
 func (ttlQ ExpirationHeap) Less(i, j int) bool {
-	return ttlQ[i].created.Before(ttlQ[j].created)
+	return ttlQ[i].expires.Before(ttlQ[j].expires)
 }
 
 func (ttlQ ExpirationHeap) Swap(i, j int) {
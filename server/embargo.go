@@ -0,0 +1,20 @@
+package server
+
+import (
+	"time"
+)
+
+const EmbargoAfterExpiryErr = Error("the object would expire before its release time")
+
+// embargoedUntil returns the time until which an object dropped with a release time can't be pulled, by any key, or
+// the zero time if it can be pulled now.
+func (handler *Handler) embargoedUntil(oid string) (time.Time, error) {
+	meta, err := handler.db.objectMeta(oid)
+	if err != nil || meta == nil || meta.ReleaseAt == nil {
+		return time.Time{}, err
+	}
+	if !handler.db.clock.Now().Before(*meta.ReleaseAt) {
+		return time.Time{}, nil
+	}
+	return *meta.ReleaseAt, nil
+}
@@ -0,0 +1,421 @@
+package server
+
+import (
+	"context"
+	"dead-drop/rpc"
+	"fmt"
+	"github.com/google/logger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// supportedProtocolVersions are the versions of the gRPC protocol the server speaks.
+var supportedProtocolVersions = map[uint32]bool{rpc.ProtocolVersion: true}
+
+// Pulled objects are streamed in messages of this size, well under gRPC's default maximum message size.
+const grpcChunkSize = 64 * 1024
+
+// grpcServer serves the gRPC API, which offers drops and pulls as streams, with the same authentication, roles,
+// scopes and namespaces as the HTTP API. Failures are reported with gRPC status codes rather than HTTP statuses.
+type grpcServer struct {
+	rpc.UnimplementedDeadDropServer
+	handler *Handler
+}
+
+// newGRPCServer returns a gRPC server of the API with the tls certificate of the HTTP API.
+func newGRPCServer(handler *Handler, tlsCert string, tlsKey string) (*grpc.Server, error) {
+	creds, err := credentials.NewServerTLSFromFile(tlsCert, tlsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	server := grpc.NewServer(grpc.Creds(creds))
+	rpc.RegisterDeadDropServer(server, &grpcServer{handler: handler})
+	return server, nil
+}
+
+// serveGRPC serves the gRPC API on addr in the background.
+func serveGRPC(server *grpc.Server, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Starting gRPC server on %s", addr)
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logger.Errorf("gRPC server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// stopGRPC waits for calls in flight to finish until ctx is done, and then cuts them short.
+func stopGRPC(ctx context.Context, server *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		logger.Warningf("Closing gRPC calls still in flight")
+		server.Stop()
+	}
+}
+
+func (server *grpcServer) Negotiate(ctx context.Context, req *rpc.NegotiateRequest) (*rpc.NegotiateResponse, error) {
+	version := uint32(0)
+	for _, offered := range req.Versions {
+		if supportedProtocolVersions[offered] && offered > version {
+			version = offered
+		}
+	}
+	if version == 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "none of the protocol versions %v is supported, only %d",
+			req.Versions, rpc.ProtocolVersion)
+	}
+	return &rpc.NegotiateResponse{Version: version}, nil
+}
+
+func (server *grpcServer) Drop(stream rpc.DeadDrop_DropServer) error {
+	handler := server.handler
+	ctx := stream.Context()
+	claims, err := server.authorize(ctx, permissionWrite, "")
+	if err != nil {
+		return err
+	}
+	if err := rateLimitedCall(handler.ipLimiter, peerIP(ctx)); err != nil {
+		return err
+	}
+	if err := rateLimitedCall(handler.keyLimiter, claims.keyName); err != nil {
+		return err
+	}
+
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	policy, err := grpcDropPolicy(first.GetPolicy())
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Join(handler.db.dataDir, uploadsDirName), ".grpc-")
+	if err != nil {
+		logger.Errorf("Failed to store gRPC drop: %v", err)
+		return status.Error(codes.Internal, "failed to store the object")
+	}
+	defer os.Remove(file.Name())
+
+	size, err := server.receiveObject(stream, file, claims)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		logger.Errorf("Failed to store gRPC drop: %v", closeErr)
+		err = status.Error(codes.Internal, "failed to store the object")
+	}
+	if err != nil {
+		return err
+	}
+
+	oid, err := handler.db.dropFile(file.Name(), claims.keyName, claims.namespace, policy)
+	if _, overQuota := err.(*quotaError); overQuota {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	} else if err == DuplicateObjectErr {
+		return status.Error(codes.AlreadyExists, err.Error())
+	} else if err != nil {
+		logger.Errorf("Failed to store gRPC drop: %v", err)
+		return status.Error(codes.Internal, "failed to store the object")
+	}
+	handler.auditFrom(peerIP(ctx), auditObjectDropped, claims.keyName, oid, fmt.Sprintf("%d bytes over gRPC", size))
+
+	return stream.SendAndClose(&rpc.DropResponse{Oid: oid, Size: size})
+}
+
+// receiveObject writes the data messages of a drop to w, up to the remaining quota of the key, returning its size.
+func (server *grpcServer) receiveObject(stream rpc.DeadDrop_DropServer, w io.Writer, claims tokenClaims) (int64,
+	error) {
+	remaining, limited := server.handler.db.quotaRemaining(claims.keyName, claims.namespace)
+
+	size := int64(0)
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return size, nil
+		} else if err != nil {
+			return size, err
+		}
+		if msg.GetPolicy() != nil {
+			return size, status.Error(codes.InvalidArgument, "only the first message of a drop may be its policy")
+		}
+
+		size += int64(len(msg.GetData()))
+		if limited && size > remaining {
+			return size, status.Errorf(codes.ResourceExhausted,
+				"over quota: the object exceeds the %d bytes left of the quota", remaining)
+		}
+		if _, err := w.Write(msg.GetData()); err != nil {
+			logger.Errorf("Failed to store gRPC drop: %v", err)
+			return size, status.Error(codes.Internal, "failed to store the object")
+		}
+	}
+}
+
+// grpcDropPolicy returns the drop policy asked for by the first message of a drop, which must be one.
+func grpcDropPolicy(requested *rpc.DropPolicy) (dropPolicy, error) {
+	if requested == nil {
+		return dropPolicy{}, status.Error(codes.InvalidArgument, "the first message of a drop must be its policy")
+	}
+	// Labels, aliases, releases and canaries can only be set over HTTP. Policies with fields this server's DropPolicy
+	// doesn't have are refused, rather than dropping the object without them.
+	if len(requested.ProtoReflect().GetUnknown()) > 0 {
+		return dropPolicy{}, status.Error(codes.InvalidArgument,
+			"gRPC drops may only set a ttl, burn or max pulls, drop over HTTP for labels, aliases, releases or canaries")
+	}
+	if requested.MaxPulls > math.MaxUint16 {
+		return dropPolicy{}, status.Errorf(codes.InvalidArgument, "max pulls may be at most %d", math.MaxUint16)
+	}
+
+	return dropPolicy{
+		ttl:      time.Duration(requested.TtlSec) * time.Second,
+		burn:     requested.Burn,
+		maxPulls: int(requested.MaxPulls),
+	}, nil
+}
+
+func (server *grpcServer) Pull(req *rpc.PullRequest, stream rpc.DeadDrop_PullServer) error {
+	handler := server.handler
+	ctx := stream.Context()
+	claims, err := server.authorize(ctx, permissionRead, req.Oid)
+	if err != nil {
+		return err
+	}
+	if req.Offset < 0 {
+		return status.Error(codes.InvalidArgument, "the offset must not be negative")
+	}
+
+	handler.alertCanary(req.Oid, claims.keyName, peerIP(ctx), grpcUserAgent(ctx))
+	if until, err := handler.embargoedUntil(req.Oid); err != nil {
+		return status.Error(codes.Internal, "failed to read the object")
+	} else if !until.IsZero() {
+		return status.Errorf(codes.PermissionDenied, "the object is embargoed until %s",
+			until.UTC().Format(time.RFC3339))
+	}
+	if released, err := handler.releasedTo(req.Oid, claims.keyName, claims.namespace); err == HeldObjectErr {
+		return status.Error(codes.PermissionDenied, err.Error())
+	} else if err != nil {
+		return status.Error(codes.Internal, "failed to read the object")
+	} else if !released {
+		return status.Error(codes.NotFound, "no such object")
+	}
+
+	object, size, claim, err := handler.db.pull(req.Oid, claims.keyName, req.Offset)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to read the object")
+	} else if object == nil {
+		return status.Error(codes.NotFound, "no such object")
+	}
+	// The claim is settled once the object is closed, since the last pull of an object destroys it.
+	sent := false
+	defer func() {
+		if sent {
+			handler.db.pulled(claim)
+		} else {
+			handler.db.unpulled(claim)
+		}
+	}()
+	defer object.Close()
+
+	if req.Offset > 0 && req.Offset >= size {
+		return status.Errorf(codes.OutOfRange, "the offset is past the end of the %d byte object", size)
+	}
+	if _, err := object.Seek(req.Offset, io.SeekStart); err != nil {
+		logger.Errorf("Failed to seek object %s: %v", req.Oid, err)
+		return status.Error(codes.Internal, "failed to read the object")
+	}
+	detail := "over gRPC"
+	if req.Offset > 0 {
+		detail = fmt.Sprintf("over gRPC from byte %d", req.Offset)
+	}
+	handler.auditFrom(peerIP(ctx), auditObjectPulled, claims.keyName, req.Oid, detail)
+
+	start := &rpc.PullStart{Size: size, Burn: claim.last}
+	if err := stream.Send(&rpc.PullResponse{Message: &rpc.PullResponse_Start{Start: start}}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, grpcChunkSize)
+	for {
+		n, err := object.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&rpc.PullResponse{Message: &rpc.PullResponse_Data{Data: buf[:n]}}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			logger.Errorf("Failed to read object %s: %v", req.Oid, err)
+			return status.Error(codes.Internal, "failed to read the object")
+		}
+	}
+
+	sent = true
+	return nil
+}
+
+func (server *grpcServer) Stat(ctx context.Context, req *rpc.StatRequest) (*rpc.StatResponse, error) {
+	claims, err := server.authorize(ctx, permissionRead, req.Oid)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := server.handler.db.stat(req.Oid, claims.keyName, claims.namespace)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to read the object")
+	} else if payload == nil {
+		return nil, status.Error(codes.NotFound, "no such object")
+	}
+
+	resp := &rpc.StatResponse{
+		Oid:         payload.Oid,
+		Size:        payload.Size,
+		CreatedUnix: payload.Created.Unix(),
+		ExpiresUnix: payload.Expires.Unix(),
+		Burn:        payload.Burn,
+	}
+	if payload.Pulls != nil {
+		pulls := int32(*payload.Pulls)
+		resp.Pulls = &pulls
+	}
+	if payload.PullsLeft != nil {
+		left := int32(*payload.PullsLeft)
+		resp.PullsLeft = &left
+	}
+	return resp, nil
+}
+
+func (server *grpcServer) Remove(ctx context.Context, req *rpc.RemoveRequest) (*rpc.RemoveResponse, error) {
+	claims, err := server.authorize(ctx, permissionWrite, req.Oid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Objects of other keys get the same response as missing ones, so that keys can't probe for oids.
+	removed, err := server.handler.db.remove(req.Oid, claims.keyName, claims.namespace)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to remove the object")
+	} else if !removed {
+		return nil, status.Error(codes.NotFound, "no such object")
+	}
+
+	logger.Infof("Removed object %s on request of its owner", req.Oid)
+	server.handler.auditFrom(peerIP(ctx), auditObjectRemoved, claims.keyName, req.Oid, "over gRPC")
+	return &rpc.RemoveResponse{}, nil
+}
+
+// authorize checks a call as the client middleware checks HTTP requests: the server must be active, the call must
+// speak a supported protocol version, and its token must be valid, of a key whose role has the permission, and not
+// scoped to another permission or object. Objects of other namespaces are reported as not found.
+func (server *grpcServer) authorize(ctx context.Context, permission string, oid string) (tokenClaims, error) {
+	handler := server.handler
+	if !handler.replication.isActive() {
+		return tokenClaims{}, status.Error(codes.Unavailable, "the server is not the active primary")
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	if !supportedProtocolVersion(md.Get(rpc.ProtocolMetadataKey)) {
+		return tokenClaims{}, status.Errorf(codes.FailedPrecondition,
+			"calls must name a supported protocol version in %s metadata, as agreed with Negotiate",
+			rpc.ProtocolMetadataKey)
+	}
+
+	ip := peerIP(ctx)
+	token := ""
+	if values := md.Get(rpc.AuthorizationMetadataKey); len(values) == 1 {
+		token = values[0]
+	}
+	claims, ok := handler.auth.validateToken(token)
+	if !ok {
+		handler.metrics.authFailed(authFailureToken)
+		handler.auditFrom(ip, auditAuthFailure, "", "", "invalid or expired token")
+		return tokenClaims{}, status.Error(codes.Unauthenticated, "invalid or expired token")
+	}
+
+	if !keyRoleAllows(claims.role, permission) {
+		logger.Warningf("Refused %s call of %s key %s", permission, claims.role, claims.keyName)
+		handler.auditFrom(ip, auditAuthFailure, claims.keyName, "",
+			fmt.Sprintf("%s key refused %s permission", claims.role, permission))
+		return tokenClaims{}, status.Errorf(codes.PermissionDenied,
+			"key %s has the %s role, which doesn't have %s permission", claims.keyName, claims.role, permission)
+	}
+	if claims.scope != "" && scopePermission(claims.scope) != permission {
+		logger.Warningf("Refused %s call of key %s with a %s token", permission, claims.keyName, claims.scope)
+		handler.auditFrom(ip, auditAuthFailure, claims.keyName, "",
+			fmt.Sprintf("%s token refused %s permission", claims.scope, permission))
+		return tokenClaims{}, status.Errorf(codes.PermissionDenied,
+			"token is scoped to %s, which doesn't have %s permission", claims.scope, permission)
+	}
+	if claims.oid != "" && claims.oid != oid {
+		logger.Warningf("Refused call of key %s with a token for another object", claims.keyName)
+		handler.auditFrom(ip, auditAuthFailure, claims.keyName, oid, "token scoped to another object")
+		return tokenClaims{}, status.Error(codes.PermissionDenied, "token is scoped to another object")
+	}
+	if oid != "" && !handler.db.inNamespace(oid, claims.namespace) {
+		return tokenClaims{}, status.Error(codes.NotFound, "no such object")
+	}
+	return claims, nil
+}
+
+func supportedProtocolVersion(values []string) bool {
+	if len(values) != 1 {
+		return false
+	}
+	version, err := strconv.ParseUint(values[0], 10, 32)
+	return err == nil && supportedProtocolVersions[uint32(version)]
+}
+
+// rateLimitedCall returns a ResourceExhausted error if the client's limit is exhausted.
+func rateLimitedCall(limiter *rateLimiter, client string) error {
+	if allowed, wait := limiter.allow(client); !allowed {
+		logger.Warningf("Rate limited requests of %s %s", limiter.name, client)
+		return status.Errorf(codes.ResourceExhausted, "rate limited, retry in %d seconds",
+			int64(math.Ceil(math.Max(wait.Seconds(), 1))))
+	}
+	return nil
+}
+
+// peerIP returns the IP address a call came from.
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// grpcUserAgent returns the user agent a gRPC call was made with, or "" if it has none.
+func grpcUserAgent(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if agents := md.Get("user-agent"); len(agents) > 0 {
+		return agents[0]
+	}
+	return ""
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"dead-drop/lib"
+	"dead-drop/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// testGRPC is the gRPC API of a server with a data directory of its own, served over an in-memory connection.
+type testGRPC struct {
+	client  rpc.DeadDropClient
+	handler *Handler
+	close   func()
+}
+
+func newTestGRPC(t *testing.T) *testGRPC {
+	server, shutdown := newTestServer(t)
+
+	listener := bufconn.Listen(1024 * 1024)
+	rpcServer := grpc.NewServer()
+	rpc.RegisterDeadDropServer(rpcServer, &grpcServer{handler: server.handler})
+	go rpcServer.Serve(listener)
+
+	conn, err := grpc.Dial("bufconn", grpc.WithInsecure(), grpc.WithContextDialer(
+		func(ctx context.Context, addr string) (net.Conn, error) {
+			return listener.Dial()
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testGRPC{
+		client:  rpc.NewDeadDropClient(conn),
+		handler: server.handler,
+		close: func() {
+			conn.Close()
+			rpcServer.Stop()
+			shutdown()
+		},
+	}
+}
+
+// context returns a context of calls authenticated with a token of a key with a role.
+func (api *testGRPC) context(t *testing.T, keyName string, role string) context.Context {
+	token := testToken(t, api.handler.auth, &lib.TokenRequestPayload{KeyName: keyName}, role, "")
+	return metadata.AppendToOutgoingContext(context.Background(),
+		rpc.AuthorizationMetadataKey, token,
+		rpc.ProtocolMetadataKey, strconv.Itoa(rpc.ProtocolVersion))
+}
+
+func (api *testGRPC) drop(ctx context.Context, policy *rpc.DropPolicy, data []byte) (*rpc.DropResponse, error) {
+	stream, err := api.client.Drop(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if policy != nil {
+		if err := stream.Send(&rpc.DropRequest{Message: &rpc.DropRequest_Policy{Policy: policy}}); err != nil {
+			return nil, err
+		}
+	}
+	if err := stream.Send(&rpc.DropRequest{Message: &rpc.DropRequest_Data{Data: data}}); err != nil {
+		return nil, err
+	}
+	return stream.CloseAndRecv()
+}
+
+func (api *testGRPC) pull(ctx context.Context, oid string) (*rpc.PullStart, []byte, error) {
+	stream, err := api.client.Pull(ctx, &rpc.PullRequest{Oid: oid})
+	if err != nil {
+		return nil, nil, err
+	}
+	var start *rpc.PullStart
+	var data []byte
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return start, data, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if msg.GetStart() != nil {
+			start = msg.GetStart()
+		}
+		data = append(data, msg.GetData()...)
+	}
+}
+
+func TestGRPCDropPull(t *testing.T) {
+	api := newTestGRPC(t)
+	defer api.close()
+
+	ctx := api.context(t, "alice", lib.KeyRoleAdmin)
+	dropped, err := api.drop(ctx, &rpc.DropPolicy{TtlSec: 60}, []byte("over gRPC"))
+	if err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+	if dropped.Size != int64(len("over gRPC")) {
+		t.Errorf("dropped %d bytes, expected %d", dropped.Size, len("over gRPC"))
+	}
+
+	start, data, err := api.pull(ctx, dropped.Oid)
+	if err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	if string(data) != "over gRPC" || start.Size != dropped.Size || !start.Burn {
+		t.Errorf("pulled %q of %+v, expected the whole object as its last pull", data, start)
+	}
+	if _, _, err := api.pull(ctx, dropped.Oid); status.Code(err) != codes.NotFound {
+		t.Errorf("pull of a destroyed object failed with %v, expected NotFound", err)
+	}
+}
+
+func TestGRPCDropPolicy(t *testing.T) {
+	api := newTestGRPC(t)
+	defer api.close()
+
+	// A field a newer DropPolicy might have, e.g. labels.
+	unknown := &rpc.DropPolicy{TtlSec: 60}
+	field := protowire.AppendTag(nil, 4, protowire.BytesType)
+	unknown.ProtoReflect().SetUnknown(protowire.AppendBytes(field, []byte("case=1")))
+
+	ctx := api.context(t, "alice", lib.KeyRoleAdmin)
+	for _, test := range []struct {
+		name   string
+		policy *rpc.DropPolicy
+		code   codes.Code
+	}{
+		{"ttl", &rpc.DropPolicy{TtlSec: 60}, codes.OK},
+		{"burn", &rpc.DropPolicy{Burn: true}, codes.OK},
+		{"max pulls", &rpc.DropPolicy{MaxPulls: 3}, codes.OK},
+		{"no policy", nil, codes.InvalidArgument},
+		{"too many pulls", &rpc.DropPolicy{MaxPulls: 1 << 16}, codes.InvalidArgument},
+		{"unknown field", unknown, codes.InvalidArgument},
+	} {
+		if _, err := api.drop(ctx, test.policy, []byte("policy")); status.Code(err) != test.code {
+			t.Errorf("drop with %s failed with %v, expected %s", test.name, err, test.code)
+		}
+	}
+}
+
+func TestGRPCRoles(t *testing.T) {
+	api := newTestGRPC(t)
+	defer api.close()
+
+	dropped, err := api.drop(api.context(t, "writer", lib.KeyRoleWriteOnly), &rpc.DropPolicy{}, []byte("roles"))
+	if err != nil {
+		t.Fatalf("drop of a write-only key failed: %v", err)
+	}
+	if _, _, err := api.pull(api.context(t, "writer", lib.KeyRoleWriteOnly), dropped.Oid); status.Code(err) !=
+		codes.PermissionDenied {
+		t.Errorf("pull of a write-only key failed with %v, expected PermissionDenied", err)
+	}
+	_, err = api.drop(api.context(t, "reader", lib.KeyRoleReadOnly), &rpc.DropPolicy{}, []byte("roles"))
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("drop of a read-only key failed with %v, expected PermissionDenied", err)
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(),
+		rpc.AuthorizationMetadataKey, "forged",
+		rpc.ProtocolMetadataKey, strconv.Itoa(rpc.ProtocolVersion))
+	if _, _, err := api.pull(ctx, dropped.Oid); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("pull with a forged token failed with %v, expected Unauthenticated", err)
+	}
+}
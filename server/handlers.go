@@ -1,53 +1,316 @@
-package main
+package server
 
 import (
+	"context"
+	"crypto/subtle"
 	"dead-drop/lib"
 	"encoding/json"
+	"fmt"
 	"github.com/google/logger"
 	"github.com/gorilla/mux"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Handler struct {
-	db   *Database
-	auth *Authenticator
+	db            *Database
+	auth          *Authenticator
+	replication   *Replicator
+	observability *ObservabilityConfig
+	sessions      *UploadSessions
+	adminToken    string
+	// ipLimiter and keyLimiter limit the requests made from each IP address, and with each key, to the endpoints
+	// which are open to brute-force and abuse. Either is nil if its limit is disabled.
+	ipLimiter  *rateLimiter
+	keyLimiter *rateLimiter
+	metrics    *serverMetrics
+	auditLog   *auditLog
+	shares     *shareSigner
+	// anonymous configures drops without a key, or is nil if they are disabled.
+	anonymous *anonymousDrops
+	// canaryMailer emails alerts of canary pulls, or is nil if they aren't emailed.
+	canaryMailer *canaryMailer
 }
 
 var keyNameRegex = regexp.MustCompile(lib.KeyNameRegex)
 
+type contextKey string
+
+// keyNameContextKey holds the name of the key an authenticated request was made with.
+const keyNameContextKey = contextKey("key-name")
+
+func requestKeyName(req *http.Request) string {
+	keyName, _ := req.Context().Value(keyNameContextKey).(string)
+	return keyName
+}
+
 func (handler *Handler) handlePull(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
 	oid := params["oid"]
 
-	data, err := handler.db.pull(oid)
-	if err != nil {
+	// Pulls are resumed by requesting the rest of the object, so only a single range is supported.
+	// Anything else is ignored, as HTTP allows, and the whole object is sent. Every request is a pull of its own,
+	// however little of the object it asks for.
+	start, end, ranged := parseRange(req.Header.Get("Range"))
+
+	handler.alertCanary(oid, requestKeyName(req), remoteIP(req), req.UserAgent())
+	if until, err := handler.embargoedUntil(oid); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
-	} else if data == nil {
+	} else if !until.IsZero() {
+		w.Header().Set("Retry-After", until.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = fmt.Fprintf(w, "the object is embargoed until %s", until.UTC().Format(time.RFC3339))
+		return
+	}
+	if released, err := handler.releasedTo(oid, requestKeyName(req), requestKeyNamespace(req)); err == HeldObjectErr {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = io.WriteString(w, err.Error())
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if !released {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	_, err = w.Write(data)
+	object, size, claim, err := handler.db.pull(oid, requestKeyName(req), start)
 	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if object == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// The claim is settled once the object is closed, since the last pull of an object destroys it.
+	sent := false
+	defer func() {
+		if sent {
+			handler.db.pulled(claim)
+		} else {
+			handler.db.unpulled(claim)
+		}
+	}()
+	defer object.Close()
+
+	if end < 0 || end >= size {
+		end = size - 1
+	}
+	if start >= size || start > end {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if _, err := object.Seek(start, io.SeekStart); err != nil {
+		logger.Errorf("Failed to seek object %s: %v", oid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	detail := ""
+	if ranged {
+		detail = fmt.Sprintf("bytes %d-%d", start, end)
+	}
+	handler.audit(req, auditObjectPulled, requestKeyName(req), oid, detail)
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	if claim.last {
+		w.Header().Set(lib.BurnHeader, "true")
+	}
+	if ranged {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+
+	if _, err := io.CopyN(w, object, end-start+1); err != nil {
 		logger.Errorf("Failed to write object response: %v", err)
+		return
+	}
+	sent = true
+}
+
+// parseRange parses a Range header of a single range of bytes, returning its first and last byte, or -1 as the last
+// byte if the range is open. Suffix ranges, multiple ranges and malformed headers are reported as no range at all.
+func parseRange(header string) (int64, int64, bool) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return 0, -1, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(header, "bytes="), "-", 2)
+	if len(parts) != 2 {
+		return 0, -1, false
+	}
+
+	start, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+	if err != nil || start < 0 {
+		return 0, -1, false
+	}
+	if strings.TrimSpace(parts[1]) == "" {
+		return start, -1, true
+	}
+	end, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+	if err != nil || end < start {
+		return 0, -1, false
+	}
+	return start, end, true
+}
+
+// handleStat describes an object without sending its data, or recording a pull. Any key which could pull the object
+// may stat it, but only the key which dropped it sees how many times it was pulled.
+func (handler *Handler) handleStat(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	oid := params["oid"]
+
+	payload, err := handler.db.stat(oid, requestKeyName(req), requestKeyNamespace(req))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if payload == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if req.Method == "HEAD" {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.FormatInt(payload.Size, 10))
+		w.Header().Set("Last-Modified", payload.Created.UTC().Format(http.TimeFormat))
+		w.Header().Set("Expires", payload.Expires.UTC().Format(http.TimeFormat))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		logger.Errorf("Failed to write stat response: %v", err)
+	}
+}
+
+// handleChecksum computes the checksum of a stored object, so that clients can verify it without pulling it.
+// It is not a pull, so it isn't logged, and doesn't use up the object's pulls.
+func (handler *Handler) handleChecksum(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	oid := params["oid"]
+
+	algorithm := req.URL.Query().Get("algorithm")
+	if algorithm == "" {
+		algorithm = lib.ChecksumSHA256
+	}
+	if _, err := lib.NewChecksumHash(algorithm); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	payload, err := handler.db.checksum(oid, algorithm)
+	if err == CorruptObjectErr {
 		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = io.WriteString(w, err.Error())
 		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if payload == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		logger.Errorf("Failed to write checksum response: %v", err)
 	}
 }
 
+func (handler *Handler) handleRemove(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	oid := params["oid"]
+
+	// Objects of other keys get the same response as missing ones, so that keys can't probe for oids.
+	removed, err := handler.db.remove(oid, requestKeyName(req), requestKeyNamespace(req))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if !removed {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	logger.Infof("Removed object %s on request of its owner", oid)
+	handler.audit(req, auditObjectRemoved, requestKeyName(req), oid, "")
+}
+
 func (handler *Handler) handleDrop(w http.ResponseWriter, req *http.Request) {
+	keyName := requestKeyName(req)
+
+	policy, ok := requestDropPolicy(req)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	session := req.Header.Get(lib.UploadSessionHeader)
+	if session != "" {
+		oid, err := handler.sessions.begin(session, keyName)
+		if err != nil {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = io.WriteString(w, err.Error())
+			return
+		}
+		if oid != "" {
+			// A retry of an upload which was stored, but whose response was lost.
+			_, _ = io.WriteString(w, oid)
+			return
+		}
+	}
+
+	oid := ""
+	defer func() {
+		if session != "" {
+			handler.sessions.finish(session, oid)
+		}
+	}()
+
+	// Keys over quota are refused before the body is read, including chunked bodies of unknown length, and the body is
+	// cut off at the quota left, so that the object never has to be buffered beyond it.
+	namespace := requestKeyNamespace(req)
+	size := req.ContentLength
+	if size < 0 {
+		size = 0
+	}
+	if err := handler.db.checkQuota(keyName, namespace, size); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = io.WriteString(w, err.Error())
+		return
+	}
+	remaining, limited := handler.db.quotaRemaining(keyName, namespace)
+	if limited {
+		req.Body = http.MaxBytesReader(w, req.Body, remaining)
+	}
+
 	bytes, err := ioutil.ReadAll(req.Body)
-	if err != nil {
+	if err != nil && limited && int64(len(bytes)) >= remaining {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_, _ = fmt.Fprintf(w, "over quota: the object exceeds the %d bytes left of the quota", remaining)
+		return
+	} else if err != nil {
 		logger.Errorf("Failed to read object body: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	oid := handler.db.drop(bytes)
+	oid, err = handler.db.drop(bytes, keyName, namespace, policy)
+	if dropRefused(err) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = io.WriteString(w, err.Error())
+		return
+	} else if err != nil {
+		logger.Errorf("Failed to store object: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	handler.audit(req, auditObjectDropped, keyName, oid, fmt.Sprintf("%d bytes", len(bytes)))
 
 	_, err = io.WriteString(w, oid)
 	if err != nil {
@@ -57,6 +320,338 @@ func (handler *Handler) handleDrop(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// dropRefused returns whether a drop failed because the object was refused, e.g. for taking its key over quota, which is
+// explained to the dropper, rather than because it couldn't be stored.
+func dropRefused(err error) bool {
+	_, overQuota := err.(*quotaError)
+	return overQuota || err == DuplicateObjectErr || err == AliasOwnedErr || err == AnonymousReleaseErr ||
+		err == ReleaseAfterExpiryErr || err == EmbargoAfterExpiryErr
+}
+
+// requestDropPolicy returns how the dropper asked for an object to be destroyed, and false if the request is invalid.
+func requestDropPolicy(req *http.Request) (dropPolicy, bool) {
+	policy := dropPolicy{}
+
+	if rawTTL := req.Header.Get(lib.ObjectTTLHeader); rawTTL != "" {
+		seconds, err := strconv.ParseUint(rawTTL, 10, 32)
+		if err != nil || seconds == 0 {
+			return policy, false
+		}
+		policy.ttl = time.Duration(seconds) * time.Second
+	}
+
+	if rawBurn := req.Header.Get(lib.BurnHeader); rawBurn != "" {
+		burn, err := strconv.ParseBool(rawBurn)
+		if err != nil {
+			return policy, false
+		}
+		policy.burn = burn
+	}
+
+	if rawMaxPulls := req.Header.Get(lib.MaxPullsHeader); rawMaxPulls != "" {
+		maxPulls, err := strconv.ParseUint(rawMaxPulls, 10, 16)
+		if err != nil || maxPulls == 0 {
+			return policy, false
+		}
+		policy.maxPulls = int(maxPulls)
+	}
+
+	if rawLabels := req.Header.Get(lib.LabelsHeader); rawLabels != "" {
+		labels, err := lib.ParseLabels(rawLabels)
+		if err != nil {
+			return policy, false
+		}
+		policy.labels = labels
+	}
+
+	if alias := req.Header.Get(lib.AliasHeader); alias != "" {
+		if lib.CheckAlias(alias) != nil {
+			return policy, false
+		}
+		policy.alias = alias
+	}
+
+	rawReleaseTo, rawInterval := req.Header.Get(lib.ReleaseToHeader), req.Header.Get(lib.CheckinIntervalHeader)
+	if rawReleaseTo != "" || rawInterval != "" {
+		seconds, err := strconv.ParseUint(rawInterval, 10, 32)
+		if err != nil || seconds == 0 {
+			return policy, false
+		}
+		policy.releaseTo = strings.Split(rawReleaseTo, ",")
+		for _, keyName := range policy.releaseTo {
+			if !keyNameRegex.MatchString(keyName) {
+				return policy, false
+			}
+		}
+		policy.checkinInterval = time.Duration(seconds) * time.Second
+	}
+	if rawReleaseAt := req.Header.Get(lib.ReleaseAtHeader); rawReleaseAt != "" {
+		releaseAt, err := time.Parse(time.RFC3339, rawReleaseAt)
+		if err != nil {
+			return policy, false
+		}
+		policy.releaseAt = releaseAt
+	}
+	policy.canary = req.Header.Get(lib.CanaryHeader) == "true"
+	return policy, true
+}
+
+func (handler *Handler) handleCreateUploadSession(w http.ResponseWriter, req *http.Request) {
+	_, _ = io.WriteString(w, handler.sessions.create(requestKeyName(req)))
+}
+
+// handleUploadSession reports the oid stored in an upload session (200), that nothing was stored so the upload
+// is safe to retry (204), or that an upload is still in progress (409).
+func (handler *Handler) handleUploadSession(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+
+	oid, uploading, err := handler.sessions.lookup(params["id"], requestKeyName(req))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case oid != "":
+		_, _ = io.WriteString(w, oid)
+	case uploading:
+		w.WriteHeader(http.StatusConflict)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleUploadPart stores a part of a multipart upload. Parts may be sent in any order, and sent again to retry them.
+func (handler *Handler) handleUploadPart(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+
+	index, err := strconv.Atoi(params["index"])
+	if err != nil || index < 0 || index >= maxUploadParts {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = handler.sessions.storePart(params["id"], requestKeyName(req), index, req.Body)
+	switch err {
+	case nil:
+	case UnknownSessionErr:
+		w.WriteHeader(http.StatusNotFound)
+	case PartTooLargeErr:
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	case SessionBusyErr, SessionDoneErr:
+		w.WriteHeader(http.StatusConflict)
+		_, _ = io.WriteString(w, err.Error())
+	default:
+		logger.Errorf("Failed to store upload part: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// handleCompleteUpload assembles the parts of a multipart upload into an object, returning its oid. Like drops in
+// a session, completing an upload again returns the same oid.
+func (handler *Handler) handleCompleteUpload(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	id := params["id"]
+	keyName := requestKeyName(req)
+
+	payload := &lib.CompleteUploadPayload{}
+	if err := json.NewDecoder(req.Body).Decode(payload); err != nil ||
+		payload.Parts <= 0 || payload.Parts > maxUploadParts {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	policy, ok := requestDropPolicy(req)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	oid, err := handler.sessions.begin(id, keyName)
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = io.WriteString(w, err.Error())
+		return
+	}
+	if oid != "" {
+		_, _ = io.WriteString(w, oid)
+		return
+	}
+
+	path, err := handler.sessions.assemble(id, payload.Parts)
+	if err != nil {
+		handler.sessions.finish(id, "")
+		if err == MissingPartErr {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = io.WriteString(w, err.Error())
+		} else {
+			logger.Errorf("Failed to assemble upload parts: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	oid, err = handler.db.dropFile(path, keyName, requestKeyNamespace(req), policy)
+	handler.sessions.finish(id, oid)
+	if dropRefused(err) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = io.WriteString(w, err.Error())
+		return
+	} else if err != nil {
+		logger.Errorf("Failed to store upload: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	handler.audit(req, auditObjectDropped, keyName, oid, fmt.Sprintf("multipart upload of %d parts", payload.Parts))
+
+	if _, err := io.WriteString(w, oid); err != nil {
+		logger.Errorf("Failed to write object response: %v", err)
+	}
+}
+
+func (handler *Handler) handleAccessLog(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	oid := params["oid"]
+
+	if !handler.db.accessLogEnabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	meta, err := handler.db.objectMeta(oid)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if meta == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Only the owner may see who pulled an object. Other keys get the same response as for a missing object,
+	// so that they can't probe for oids.
+	if !meta.ownedBy(requestKeyName(req), requestKeyNamespace(req)) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	payload := lib.AccessLogPayload{
+		Oid:     oid,
+		Owner:   meta.Owner,
+		Dropped: meta.Created,
+		Pulls:   meta.Pulls,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		logger.Errorf("Failed to write access log response: %v", err)
+	}
+}
+
+// Listings are paged, so that a key with many objects can't make the server read all of their metadata at once.
+const defaultListLimit = 100
+const maxListLimit = 1000
+
+// handleList lists the objects owned by the requesting key which the request's filter selects, in pages of up to the
+// requested limit.
+func (handler *Handler) handleList(w http.ResponseWriter, req *http.Request) {
+	limit, filter, ok := parseListRequest(req)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	objects, next, err := handler.db.ownedObjects(requestKeyName(req), requestKeyNamespace(req), filter,
+		req.URL.Query().Get("after"), limit)
+	if err == InvalidCursorErr {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	payload := lib.ListObjectsPayload{
+		Objects: objects,
+		Next:    next,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		logger.Errorf("Failed to write listing response: %v", err)
+	}
+}
+
+// handleAlias lists the stored versions of an alias of the requesting key's namespace.
+func (handler *Handler) handleAlias(w http.ResponseWriter, req *http.Request) {
+	alias := mux.Vars(req)["alias"]
+	if lib.CheckAlias(alias) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	versions := handler.db.versions(requestKeyNamespace(req), alias)
+	if len(versions) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	payload := lib.AliasPayload{
+		Alias:    alias,
+		Versions: versions,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		logger.Errorf("Failed to write alias response: %v", err)
+	}
+}
+
+// handleAliasVersion resolves a version of an alias of the requesting key's namespace, given by its number or as
+// lib.LatestVersion, to the object dropped as it.
+func (handler *Handler) handleAliasVersion(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	alias := params["alias"]
+	if lib.CheckAlias(alias) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	number := 0
+	if params["version"] != lib.LatestVersion {
+		var err error
+		if number, err = strconv.Atoi(params["version"]); err != nil || number <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	version := handler.db.version(requestKeyNamespace(req), alias, number)
+	if version == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(version); err != nil {
+		logger.Errorf("Failed to write alias version response: %v", err)
+	}
+}
+
+// handleQuota reports how many bytes of objects the requesting key stores, and its quota.
+func (handler *Handler) handleQuota(w http.ResponseWriter, req *http.Request) {
+	keyName, namespace := requestKeyName(req), requestKeyNamespace(req)
+	used, quota := handler.db.quotaUsage(keyName)
+
+	payload := lib.QuotaPayload{
+		KeyName: keyName,
+		Used:    used,
+		Quota:   quota,
+	}
+	if namespace != "" {
+		payload.Namespace = namespace
+		payload.NamespaceUsed, payload.NamespaceQuota = handler.db.namespaceQuotaUsage(namespace)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		logger.Errorf("Failed to write quota response: %v", err)
+	}
+}
+
 func (handler *Handler) handleAddKey(w http.ResponseWriter, req *http.Request) {
 	var payload lib.AddKeyPayload
 	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
@@ -69,13 +664,97 @@ func (handler *Handler) handleAddKey(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if payload.Role != "" && !validKeyRole(payload.Role) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintf(w, "unknown role '%s'", payload.Role)
+		return
+	}
+	if payload.Namespace != "" && !namespaceRegex.MatchString(payload.Namespace) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Admin keys of the default namespace may add keys to any namespace, and those of other namespaces only to their
+	// own, without replacing keys of other namespaces.
+	namespace := requestKeyNamespace(req)
+	if namespace != "" {
+		if payload.Namespace != "" && payload.Namespace != namespace {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = fmt.Fprintf(w, "keys of namespace %s can't add keys to namespace %s", namespace, payload.Namespace)
+			return
+		}
+		if _, err := handler.auth.getAuthorizedKey(payload.KeyName); err == nil {
+			if existing, err := handler.auth.keyNamespace(payload.KeyName); err != nil || existing != namespace {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = fmt.Fprintf(w, "key %s exists in another namespace", payload.KeyName)
+				return
+			}
+		}
+		payload.Namespace = namespace
+	}
 
 	logger.Infof("Adding public key %s", payload.KeyName)
 
 	if err := handler.auth.addAuthorizedKey(payload.Key, payload.KeyName); err != nil {
 		logger.Errorf("Failed to add authorized key: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := handler.auth.setKeyRole(payload.KeyName, payload.Role); err != nil {
+		logger.Errorf("Failed to set the role of authorized key: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+	if err := handler.auth.setKeyNamespace(payload.KeyName, payload.Namespace); err != nil {
+		logger.Errorf("Failed to set the namespace of authorized key: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	handler.audit(req, auditKeyAdded, requestKeyName(req), "", payload.KeyName)
+}
+
+// handleRemoveKey removes an authorized key, so that it can't authenticate any more, and revokes the tokens it was
+// issued. Like adding keys, it takes an admin key, which may remove any key including itself, but not the last one.
+func (handler *Handler) handleRemoveKey(w http.ResponseWriter, req *http.Request) {
+	var payload lib.RemoveKeyPayload
+	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+		logger.Errorf("Failed to decode payload: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !keyNameRegex.Match([]byte(payload.KeyName)) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Admin keys of namespaces other than the default one may only remove keys of their own namespace.
+	if namespace := requestKeyNamespace(req); namespace != "" {
+		if existing, err := handler.auth.keyNamespace(payload.KeyName); err != nil || existing != namespace {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
+	removed, err := handler.auth.removeAuthorizedKey(payload.KeyName)
+	if err == LastKeyErr {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = io.WriteString(w, err.Error())
+		return
+	} else if err != nil {
+		logger.Errorf("Failed to remove authorized key: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if !removed {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := handler.db.disownObjects(payload.KeyName); err != nil {
+		logger.Errorf("Failed to disown the objects of removed key %s: %v", payload.KeyName, err)
+	}
+
+	logger.Infof("Removed public key %s", payload.KeyName)
+	handler.audit(req, auditKeyRemoved, requestKeyName(req), "", payload.KeyName)
 }
 
 func (handler *Handler) handleToken(w http.ResponseWriter, req *http.Request) {
@@ -86,20 +765,53 @@ func (handler *Handler) handleToken(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if !keyNameRegex.Match([]byte(payload.KeyName)) {
+	if !keyNameRegex.Match([]byte(payload.KeyName)) || len(payload.Oid) > maxTokenOidLen || payload.TTL < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if payload.Scope != "" && scopePermission(payload.Scope) == "" {
 		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintf(w, "unknown token scope '%s'", payload.Scope)
+		return
+	}
+	// Token requests are limited by the key they are for, so that guessing at one key is slowed from any address.
+	if rateLimited(w, handler.keyLimiter, payload.KeyName) {
+		return
+	}
+	if err := handler.auth.answerChallenge(&payload); err != nil {
+		logger.Warningf("Rejected token request for %s: %v", payload.KeyName, err)
+		handler.metrics.authFailed(authFailureTokenRequest)
+		handler.audit(req, auditAuthFailure, payload.KeyName, "", err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
 	storedKey, err := handler.auth.getAuthorizedKey(payload.KeyName)
 	if err != nil {
 		logger.Errorf("Failed to load authorized key: %v", err)
+		handler.metrics.authFailed(authFailureTokenRequest)
+		handler.audit(req, auditAuthFailure, payload.KeyName, "", "token requested for unknown key")
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	token, err := handler.auth.generateToken(storedKey)
+	role, err := handler.auth.keyRole(payload.KeyName)
+	if err != nil {
+		logger.Errorf("Failed to load the role of authorized key: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	namespace, err := handler.auth.keyNamespace(payload.KeyName)
+	if err != nil {
+		logger.Errorf("Failed to load the namespace of authorized key: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	token, err := handler.auth.generateToken(&payload, storedKey, role, namespace)
 	if err == UnauthorizedErr {
+		handler.metrics.authFailed(authFailureTokenRequest)
+		handler.audit(req, auditAuthFailure, payload.KeyName, "", "token request rejected")
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	} else if err != nil {
@@ -108,6 +820,9 @@ func (handler *Handler) handleToken(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	handler.metrics.tokenIssued()
+	handler.audit(req, auditTokenIssued, payload.KeyName, "", "")
+
 	_, err = io.WriteString(w, token)
 	if err != nil {
 		logger.Errorf("Failed to write authorization token response: %v", err)
@@ -116,15 +831,335 @@ func (handler *Handler) handleToken(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// handleTokenChallenge issues a challenge for a token request. Challenges are issued for any key name, so they don't
+// reveal which keys are authorized.
+func (handler *Handler) handleTokenChallenge(w http.ResponseWriter, req *http.Request) {
+	var payload lib.TokenChallengePayload
+	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+		logger.Errorf("Failed to decode token challenge payload: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !keyNameRegex.Match([]byte(payload.KeyName)) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Challenges aren't charged to the key's rate limit, which would let anyone who knows a key's name keep it from
+	// getting tokens, but to the requester's IP address, which can only have a few outstanding.
+	nonce, err := handler.auth.challenges.issue(payload.KeyName, remoteIP(req))
+	if err != nil {
+		logger.Warningf("Refused token challenge for %s from %s: %v", payload.KeyName, remoteIP(req), err)
+		w.Header().Set("Retry-After", "1")
+		if err == IPChallengesExhaustedErr {
+			w.WriteHeader(http.StatusTooManyRequests)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_, _ = io.WriteString(w, err.Error())
+		return
+	}
+	payload.Nonce = nonce
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		logger.Errorf("Failed to write token challenge response: %v", err)
+	}
+}
+
 func (handler *Handler) authenticate(h http.HandlerFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		token := req.Header.Get("Authorization")
 
-		if !handler.auth.validateToken(token) {
+		claims, ok := handler.auth.validateToken(token)
+		if !ok {
+			handler.metrics.authFailed(authFailureToken)
+			handler.audit(req, auditAuthFailure, "", "", "invalid or expired token")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), keyNameContextKey, claims.keyName)
+		ctx = context.WithValue(ctx, keyRoleContextKey, claims.role)
+		ctx = context.WithValue(ctx, tokenScopeContextKey, claims.scope)
+		ctx = context.WithValue(ctx, tokenOidContextKey, claims.oid)
+		h.ServeHTTP(w, req.WithContext(context.WithValue(ctx, keyNamespaceContextKey, claims.namespace)))
+	})
+}
+
+// client authenticates client requests to active servers, and scopes them to the role and namespace of their key, and
+// the scope of their token.
+func (handler *Handler) client(permission string, h http.HandlerFunc) http.Handler {
+	return handler.requireActive(handler.authenticate(
+		handler.requireRole(permission, handler.requireScope(permission, handler.requireNamespace(h)))))
+}
+
+// requireActive refuses client requests on standbys and fenced primaries, so clients fail over to the active primary.
+func (handler *Handler) requireActive(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !handler.replication.isActive() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
+
+// authenticateReplication checks the replication token, and exchanges epochs with the peer so stale primaries get fenced.
+func (handler *Handler) authenticateReplication(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !handler.replication.validToken(req.Header.Get(replicationTokenHeader)) {
+			handler.metrics.authFailed(authFailureReplication)
+			handler.audit(req, auditAuthFailure, "", "", "invalid replication token")
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
+		if epoch, err := strconv.ParseUint(req.Header.Get(epochHeader), 10, 64); err == nil {
+			handler.replication.fence(epoch)
+		}
+		w.Header().Set(epochHeader, strconv.FormatUint(handler.replication.epoch(), 10))
+
 		h.ServeHTTP(w, req)
 	})
 }
+
+func (handler *Handler) handleReplicationObjects(w http.ResponseWriter, req *http.Request) {
+	objects := make([]replicatedObject, 0)
+	for _, oi := range handler.db.objects() {
+		objects = append(objects, replicatedObject{Oid: oi.oid, Created: oi.created, TTL: oi.expires.Sub(oi.created)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(objects); err != nil {
+		logger.Errorf("Failed to write replication object listing: %v", err)
+	}
+}
+
+// handleReplicationObject serves an object to a standby. Unlike a pull, it is neither logged nor destructive.
+func (handler *Handler) handleReplicationObject(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	oid := params["oid"]
+
+	if !handler.db.hasObject(oid) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	data, err := handler.db.readObject(oid)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if meta, err := handler.db.objectMeta(oid); err == nil && meta != nil {
+		w.Header().Set(ownerHeader, meta.Owner)
+		w.Header().Set(namespaceHeader, meta.Namespace)
+		// Standbys replicate the pulls the object has left, rather than those it was dropped with.
+		if left := meta.pullsLeft(); left > 0 {
+			w.Header().Set(lib.MaxPullsHeader, strconv.Itoa(left))
+		}
+		if len(meta.Labels) > 0 {
+			w.Header().Set(lib.LabelsHeader, lib.FormatLabels(meta.Labels))
+		}
+		if meta.Alias != "" {
+			w.Header().Set(lib.AliasHeader, meta.Alias)
+			w.Header().Set(versionHeader, strconv.Itoa(meta.Version))
+		}
+		if len(meta.ReleaseTo) > 0 {
+			w.Header().Set(lib.ReleaseToHeader, strings.Join(meta.ReleaseTo, ","))
+			w.Header().Set(lib.CheckinIntervalHeader, strconv.FormatInt(int64(meta.CheckinInterval/time.Second), 10))
+		}
+		if meta.ReleaseAt != nil {
+			w.Header().Set(lib.ReleaseAtHeader, meta.ReleaseAt.Format(time.RFC3339Nano))
+		}
+		if meta.Canary {
+			w.Header().Set(lib.CanaryHeader, "true")
+		}
+	}
+
+	if _, err := w.Write(data); err != nil {
+		logger.Errorf("Failed to write replicated object response: %v", err)
+	}
+}
+
+func (handler *Handler) handleReplicationKeys(w http.ResponseWriter, req *http.Request) {
+	keys, err := handler.auth.authorizedKeys()
+	if err != nil {
+		logger.Errorf("Failed to list authorized keys: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(keys); err != nil {
+		logger.Errorf("Failed to write replication key listing: %v", err)
+	}
+}
+
+// handleReplicationKeyRoles lists the roles keys were added with, for standbys to give their copies of the keys.
+func (handler *Handler) handleReplicationKeyRoles(w http.ResponseWriter, req *http.Request) {
+	handler.writeKeyAttributes(w, "roles", handler.auth.keyRoles)
+}
+
+// handleReplicationKeyNamespaces lists the namespaces of keys, for standbys to put their copies of the keys in.
+func (handler *Handler) handleReplicationKeyNamespaces(w http.ResponseWriter, req *http.Request) {
+	handler.writeKeyAttributes(w, "namespaces", handler.auth.keyNamespaces)
+}
+
+// handleReplicationKeyCheckins lists the times keys last checked in, for standbys to hold their objects until the same
+// time.
+func (handler *Handler) handleReplicationKeyCheckins(w http.ResponseWriter, req *http.Request) {
+	handler.writeKeyAttributes(w, "check-ins", handler.auth.keyCheckins)
+}
+
+func (handler *Handler) writeKeyAttributes(w http.ResponseWriter, name string, list func() (map[string]string, error)) {
+	attributes, err := list()
+	if err != nil {
+		logger.Errorf("Failed to list key %s: %v", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(attributes); err != nil {
+		logger.Errorf("Failed to write replication key %s listing: %v", name, err)
+	}
+}
+
+func (handler *Handler) handleReplicationStatus(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(handler.replication.status()); err != nil {
+		logger.Errorf("Failed to write replication status: %v", err)
+	}
+}
+
+func (handler *Handler) handleFence(w http.ResponseWriter, req *http.Request) {
+	var payload fencePayload
+	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	handler.replication.fence(payload.Epoch)
+}
+
+func (handler *Handler) handlePromote(w http.ResponseWriter, req *http.Request) {
+	if err := handler.replication.promote(); err != nil {
+		logger.Errorf("Failed to promote to primary: %v", err)
+		w.WriteHeader(http.StatusConflict)
+		_, _ = io.WriteString(w, err.Error())
+	}
+}
+
+// authenticateAdmin checks the admin bearer token. Admin endpoints are disabled if no token is configured.
+func (handler *Handler) authenticateAdmin(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if handler.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(handler.adminToken)) != 1 {
+			handler.metrics.authFailed(authFailureAdmin)
+			handler.audit(req, auditAuthFailure, "", "", "invalid admin token")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
+
+func (handler *Handler) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	count, oldest := handler.db.stats()
+	oldestAge := 0.0
+	if !oldest.IsZero() {
+		oldestAge = handler.db.clock.Now().Sub(oldest).Seconds()
+	}
+
+	status := handler.replication.status()
+	roles := make(map[string]float64)
+	for _, role := range []string{rolePrimary, roleStandby, roleFenced} {
+		value := 0.0
+		if role == status.Role {
+			value = 1
+		}
+		roles[`{role="`+role+`"}`] = value
+	}
+	lastSeenAge := 0.0
+	if status.Role == roleStandby && !status.PrimaryLastSeen.IsZero() {
+		lastSeenAge = handler.db.clock.Now().Sub(status.PrimaryLastSeen).Seconds()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	gauges := []struct {
+		name    string
+		help    string
+		samples map[string]float64
+	}{
+		{objectsMetric, "Number of stored objects.", map[string]float64{"": float64(count)}},
+		{oldestObjectAgeMetric, "Age of the oldest stored object.", map[string]float64{"": oldestAge}},
+		{ttlMetric, "Configured object time to live.", map[string]float64{"": handler.observability.ttl().Seconds()}},
+		{replicationRoleMetric, "Current replication role.", roles},
+		{replicationEpochMetric, "Current replication epoch.", map[string]float64{"": float64(status.Epoch)}},
+		{primaryLastSeenAgeMetric, "Time since a standby last synced with its primary.", map[string]float64{"": lastSeenAge}},
+		{storedBytesMetric, "Bytes of stored objects.", map[string]float64{"": float64(handler.db.storedBytes())}},
+		{expiryDurationMetric, "Time taken by the last run of the expiry job.",
+			map[string]float64{"": handler.db.lastExpiryDuration().Seconds()}},
+	}
+	for _, gauge := range gauges {
+		if err := writeGauge(w, gauge.name, gauge.help, gauge.samples); err != nil {
+			logger.Errorf("Failed to write metrics response: %v", err)
+			return
+		}
+	}
+
+	expiredObjects, expiredBytes := handler.db.reclaimed()
+	expiryRuns := handler.db.expiryRuns()
+	counters := []struct {
+		name    string
+		help    string
+		samples map[string]float64
+	}{
+		{expiredObjectsMetric, "Objects removed by the expiry job.", map[string]float64{"": float64(expiredObjects)}},
+		{expiredBytesMetric, "Bytes of objects removed by the expiry job.", map[string]float64{"": float64(expiredBytes)}},
+		{expiryRunsMetric, "Runs of the expiry job.", map[string]float64{"": float64(expiryRuns)}},
+	}
+	for _, counter := range counters {
+		if err := writeCounter(w, counter.name, counter.help, counter.samples); err != nil {
+			logger.Errorf("Failed to write metrics response: %v", err)
+			return
+		}
+	}
+
+	if err := handler.metrics.write(w); err != nil {
+		logger.Errorf("Failed to write metrics response: %v", err)
+	}
+}
+
+// handleObservabilityBundle serves alerting rules and a dashboard matching the current configuration.
+// Pass ?part=prometheus-rules or ?part=grafana-dashboard to fetch just one of them, e.g. for provisioning scripts.
+func (handler *Handler) handleObservabilityBundle(w http.ResponseWriter, req *http.Request) {
+	bundle := newObservabilityBundle(handler.observability)
+
+	var body interface{} = bundle
+	switch req.URL.Query().Get("part") {
+	case "":
+	case "prometheus-rules":
+		body = bundle.PrometheusRules
+	case "grafana-dashboard":
+		body = bundle.GrafanaDashboard
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Keep expressions like "a > b" readable when the rules are saved as-is.
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := encoder.Encode(body); err != nil {
+		logger.Errorf("Failed to write observability bundle: %v", err)
+	}
+}
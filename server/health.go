@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/logger"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Readiness checks look up this oid, which no object has since oids are 16 letters, so that they reach the object and
+// metadata stores without depending on any object.
+const healthCheckOid = "healthz"
+
+// Readiness checks which take longer than this fail, so that probes get an answer before they time out themselves.
+const healthCheckTimeout = 5 * time.Second
+
+// handleHealth answers liveness probes: the server is serving requests, and can issue tokens.
+func (handler *Handler) handleHealth(w http.ResponseWriter, req *http.Request) {
+	if !handler.auth.ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, "token secret not initialized\n")
+		return
+	}
+	_, _ = io.WriteString(w, "ok\n")
+}
+
+// handleReady answers readiness probes: besides being live, the server accepts client requests, which standbys and
+// fenced primaries refuse, and can reach its object and metadata stores. Failed checks are listed in the response.
+func (handler *Handler) handleReady(w http.ResponseWriter, req *http.Request) {
+	failures := make([]string, 0)
+	if !handler.auth.ready() {
+		failures = append(failures, "token secret not initialized")
+	}
+	if !handler.replication.isActive() {
+		failures = append(failures, "not the active primary")
+	}
+	if err := handler.db.checkStores(healthCheckTimeout); err != nil {
+		failures = append(failures, err.Error())
+	}
+
+	if len(failures) > 0 {
+		logger.Warningf("Readiness check failed: %v", failures)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, failure := range failures {
+			_, _ = io.WriteString(w, failure+"\n")
+		}
+		return
+	}
+	_, _ = io.WriteString(w, "ok\n")
+}
+
+// checkStores checks that the object and metadata stores can be reached, giving up on them after timeout.
+func (db *Database) checkStores(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := db.store.ping(ctx); err != nil {
+		return fmt.Errorf("%s unavailable: %v", db.store, err)
+	}
+	if err := db.metas.ping(ctx); err != nil {
+		return fmt.Errorf("%s unavailable: %v", db.metas, err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"dead-drop/lib"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeyStore keeps the public keys authorized to use a server, by key name, and attributes of the keys such as their
+// role and namespace. Key names are made of letters, digits, dashes and underscores, as are attribute names.
+type KeyStore interface {
+	// Key returns an authorized key, or an error if there is no such key.
+	Key(keyName string) ([]byte, error)
+	// Keys returns every authorized key by name.
+	Keys() (map[string][]byte, error)
+	// AddKey authorizes a key, replacing any key of the same name.
+	AddKey(keyName string, key []byte) error
+	// RemoveKey removes an authorized key, if there is one. Its attributes are removed separately.
+	RemoveKey(keyName string) error
+	// Attribute returns an attribute of a key, or "" if the key doesn't have it.
+	Attribute(keyName string, attribute string) (string, error)
+	// SetAttribute sets an attribute of a key, or removes it if value is empty.
+	SetAttribute(keyName string, attribute string, value string) error
+	// Attributes returns an attribute of every key which has it, by key name.
+	Attributes(attribute string) (map[string]string, error)
+	// String describes where keys are kept, for the log.
+	String() string
+}
+
+// dirKeyStore keeps each authorized key in a file of its own in the authorized-keys directory, named after the key.
+// Attributes are kept in files next to the key, named after the key with a dot and the attribute. Key names can't
+// contain dots, so attribute files are never taken for keys.
+type dirKeyStore struct {
+	dir string
+}
+
+func newDirKeyStore(dir string) *dirKeyStore {
+	return &dirKeyStore{dir: dir}
+}
+
+func (store *dirKeyStore) Key(keyName string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(store.dir, keyName))
+}
+
+func (store *dirKeyStore) Keys() (map[string][]byte, error) {
+	files, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string][]byte)
+	for _, file := range files {
+		if file.IsDir() || !keyNameRegex.MatchString(file.Name()) {
+			continue
+		}
+		key, err := store.Key(file.Name())
+		if err != nil {
+			return nil, err
+		}
+		keys[file.Name()] = key
+	}
+	return keys, nil
+}
+
+func (store *dirKeyStore) AddKey(keyName string, key []byte) error {
+	return ioutil.WriteFile(filepath.Join(store.dir, keyName), key, lib.PublicKeyPerms)
+}
+
+func (store *dirKeyStore) RemoveKey(keyName string) error {
+	if err := os.Remove(filepath.Join(store.dir, keyName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (store *dirKeyStore) Attribute(keyName string, attribute string) (string, error) {
+	value, err := ioutil.ReadFile(store.attributePath(keyName, attribute))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+func (store *dirKeyStore) SetAttribute(keyName string, attribute string, value string) error {
+	if value == "" {
+		if err := os.Remove(store.attributePath(keyName, attribute)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(store.attributePath(keyName, attribute), []byte(value+"\n"), lib.PublicKeyPerms)
+}
+
+func (store *dirKeyStore) Attributes(attribute string) (map[string]string, error) {
+	files, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	suffix := "." + attribute
+	values := make(map[string]string)
+	for _, file := range files {
+		keyName := strings.TrimSuffix(file.Name(), suffix)
+		if file.IsDir() || keyName == file.Name() || !keyNameRegex.MatchString(keyName) {
+			continue
+		}
+		value, err := store.Attribute(keyName, attribute)
+		if err != nil {
+			return nil, err
+		}
+		values[keyName] = value
+	}
+	return values, nil
+}
+
+func (store *dirKeyStore) String() string {
+	return "authorized-keys directory " + store.dir
+}
+
+func (store *dirKeyStore) attributePath(keyName string, attribute string) string {
+	return filepath.Join(store.dir, keyName+"."+attribute)
+}
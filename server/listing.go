@@ -0,0 +1,115 @@
+package server
+
+import (
+	"dead-drop/lib"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// listStartOid sorts after every oid, so that a listing starting after it at a creation time starts with the objects
+// created after that time.
+const listStartOid = "\xff"
+
+// listFilter selects the objects of a listing by when they were created and by their size, and in admin listings by
+// the key which dropped them. Zero fields select every object.
+type listFilter struct {
+	// since and until select the objects created from since, and before until.
+	since   time.Time
+	until   time.Time
+	minSize int64
+	maxSize int64
+	owner   string
+	// labels select the objects which have every one of them.
+	labels map[string]string
+}
+
+// parseListRequest parses the limit and filter of a listing request, returning false if either is invalid.
+//
+// Times are RFC 3339, sizes in bytes, and labels <key>=<value>, which may be repeated, e.g.
+// ?since=2024-05-01T00:00:00Z&min-size=1048576&label=env%3Dprod.
+func parseListRequest(req *http.Request) (int, listFilter, bool) {
+	query := req.URL.Query()
+
+	limit := defaultListLimit
+	if rawLimit := query.Get("limit"); rawLimit != "" {
+		var err error
+		if limit, err = strconv.Atoi(rawLimit); err != nil || limit <= 0 {
+			return 0, listFilter{}, false
+		}
+		if limit > maxListLimit {
+			limit = maxListLimit
+		}
+	}
+
+	var filter listFilter
+	var err error
+	if filter.since, err = parseListTime(query.Get("since")); err != nil {
+		return 0, listFilter{}, false
+	}
+	if filter.until, err = parseListTime(query.Get("until")); err != nil {
+		return 0, listFilter{}, false
+	}
+	if filter.minSize, err = parseListSize(query.Get("min-size")); err != nil {
+		return 0, listFilter{}, false
+	}
+	if filter.maxSize, err = parseListSize(query.Get("max-size")); err != nil {
+		return 0, listFilter{}, false
+	}
+	filter.owner = query.Get("owner")
+	if labels := query["label"]; len(labels) > 0 {
+		filter.labels = lib.SplitLabels(labels)
+		if lib.CheckLabels(filter.labels) != nil {
+			return 0, listFilter{}, false
+		}
+	}
+	return limit, filter, true
+}
+
+func parseListTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+func parseListSize(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err == nil && size < 0 {
+		err = strconv.ErrRange
+	}
+	return size, err
+}
+
+// start returns the position a listing starts after: the cursor of an earlier page, unless the filter's since is
+// later, so that listings of recent objects skip the older ones in stores indexed by creation time.
+func (filter listFilter) start(afterCreated time.Time, afterOid string) (time.Time, string) {
+	if filter.since.IsZero() || afterOid != "" && !afterCreated.Before(filter.since) {
+		return afterCreated, afterOid
+	}
+	return filter.since.Add(-time.Nanosecond), listStartOid
+}
+
+// ended returns whether objects created at a time, and every object created after, are past the filter's until.
+func (filter listFilter) ended(created time.Time) bool {
+	return !filter.until.IsZero() && !created.Before(filter.until)
+}
+
+// matches returns whether the filter selects an object of an owner, created at a time, of a size and with labels.
+func (filter listFilter) matches(owner string, created time.Time, size int64, labels map[string]string) bool {
+	if filter.owner != "" && owner != filter.owner {
+		return false
+	}
+	for key, value := range filter.labels {
+		if labelValue, ok := labels[key]; !ok || labelValue != value {
+			return false
+		}
+	}
+	if !filter.since.IsZero() && created.Before(filter.since) || filter.ended(created) {
+		return false
+	}
+	return size >= filter.minSize && (filter.maxSize == 0 || size <= filter.maxSize)
+}
@@ -0,0 +1,398 @@
+package server
+
+import (
+	"dead-drop/lib"
+	"github.com/google/logger"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// ObjectMeta is what the server knows about an object besides its data.
+// It outlives the object itself for the access log retention period, so owners can confirm pulls of destroyed objects.
+type ObjectMeta struct {
+	// Owner is the name of the key which dropped the object, and Namespace is the namespace the key was in, which is
+	// empty for the default namespace.
+	Owner     string
+	Namespace string `json:",omitempty"`
+	Created   time.Time
+	// TTL is how long after Created the object expires, if it was dropped with a ttl sooner than the server's.
+	TTL time.Duration `json:",omitempty"`
+	// Burn is set if the object is destroyed by its first pull, even if the server doesn't destroy every pull.
+	Burn bool `json:",omitempty"`
+	// MaxPulls is how many pulls destroy the object, or 0 if there is no limit. Completed counts the pulls which were
+	// sent, whether or not they reached the end of the object.
+	MaxPulls  int `json:",omitempty"`
+	Completed int `json:",omitempty"`
+	Pulls     []lib.AccessRecord
+	// Size is the size of the object's data, which metadata written before it was recorded lacks.
+	Size int64 `json:",omitempty"`
+	// Inline is set for objects up to the inline threshold, whose data is kept in Data rather than a file of its own.
+	// Data is cleared when the object is removed, while the rest of the metadata is retained.
+	Inline bool   `json:",omitempty"`
+	Data   []byte `json:",omitempty"`
+	// ShareUses counts the uses of the object's shared urls which have a maximum, by their id.
+	ShareUses map[string]int `json:",omitempty"`
+	// Labels are the labels the object was dropped with, which its owner can list objects by.
+	Labels map[string]string `json:",omitempty"`
+	// Alias is the alias the object was dropped under, and Version its version number under it.
+	Alias   string `json:",omitempty"`
+	Version int    `json:",omitempty"`
+	// ReleaseTo are the keys the object is released to once its owner hasn't checked in for CheckinInterval. Until
+	// then, only its owner may pull it.
+	ReleaseTo       []string      `json:",omitempty"`
+	CheckinInterval time.Duration `json:",omitempty"`
+	// ReleaseAt is the time before which the object can't be pulled by any key, if it was dropped with one.
+	ReleaseAt *time.Time `json:",omitempty"`
+	// Canary is set for decoy objects, any pull of which raises an alert. It is never revealed to clients, so that
+	// whoever pulls a canary can't tell it from other objects.
+	Canary bool `json:",omitempty"`
+	// Sealed is the rest of the metadata, encrypted, when metadata is sealed at rest. Only Owner, which is then a
+	// pseudonym, and Created are set alongside it.
+	Sealed []byte `json:",omitempty"`
+}
+
+// ownedBy returns whether the object was dropped by the named key of a namespace. Key names are unique across
+// namespaces, but a removed key's name may be reused in another one, whose key mustn't get the removed key's objects.
+func (meta *ObjectMeta) ownedBy(keyName string, namespace string) bool {
+	return meta.Owner != "" && meta.Owner == keyName && meta.Namespace == namespace
+}
+
+// expires returns when the object expires, given the server's ttl.
+func (meta *ObjectMeta) expires(defaultTTL time.Duration) time.Time {
+	if meta.TTL > 0 {
+		return meta.Created.Add(meta.TTL)
+	}
+	return meta.Created.Add(defaultTTL)
+}
+
+// pullsLeft returns how many more pulls the object allows, or -1 if there is no limit.
+func (meta *ObjectMeta) pullsLeft() int {
+	if meta.Burn {
+		return 1 - meta.Completed
+	}
+	if meta.MaxPulls > 0 {
+		return meta.MaxPulls - meta.Completed
+	}
+	return -1
+}
+
+func (meta *ObjectMeta) isExpired(defaultTTL time.Duration, retentionMin uint, now time.Time) bool {
+	return meta.expires(defaultTTL).Add(time.Duration(retentionMin) * time.Minute).Before(now)
+}
+
+func (db *Database) accessLogEnabled() bool {
+	return db.accessLogRetentionMin > 0
+}
+
+// objectMeta returns the metadata of an object, or nil if there is none.
+func (db *Database) objectMeta(oid string) (*ObjectMeta, error) {
+	db.metaLock.Lock()
+	defer db.metaLock.Unlock()
+
+	return db.readMeta(oid)
+}
+
+// storeObject writes a new object and its metadata. Objects up to the inline threshold are stored in the metadata,
+// which saves a file per object for workloads of many small secrets.
+func (db *Database) storeObject(oid string, owner string, namespace string, created time.Time, policy dropPolicy,
+	data []byte) {
+	meta := &ObjectMeta{
+		Owner:     owner,
+		Namespace: namespace,
+		Created:   created,
+		TTL:       policy.ttl,
+		Burn:      policy.burn,
+		MaxPulls:  policy.maxPulls,
+		Pulls:     make([]lib.AccessRecord, 0),
+		Size:      int64(len(data)),
+		Labels:    policy.labels,
+		Alias:     policy.alias,
+		Version:   policy.version,
+
+		ReleaseTo:       policy.releaseTo,
+		CheckinInterval: policy.checkinInterval,
+		ReleaseAt:       policy.releaseAtTime(),
+		Canary:          policy.canary,
+	}
+	if db.inlineThreshold > 0 && len(data) <= db.inlineThreshold {
+		meta.Inline = true
+		meta.Data = data
+	}
+
+	db.metaLock.Lock()
+	db.writeMeta(oid, meta)
+	db.metaLock.Unlock()
+
+	if !meta.Inline {
+		db.writeObject(oid, data)
+	}
+}
+
+// storeObjectFile is storeObject for data in a file inside the data directory, which is moved into the object store.
+func (db *Database) storeObjectFile(oid string, owner string, namespace string, created time.Time, policy dropPolicy,
+	path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		logger.Errorf("Failed to read object %s: %v", oid, err)
+		return
+	}
+
+	if db.inlineThreshold > 0 && info.Size() <= int64(db.inlineThreshold) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			logger.Errorf("Failed to read object %s: %v", oid, err)
+			return
+		}
+		db.storeObject(oid, owner, namespace, created, policy, data)
+		os.Remove(path)
+		return
+	}
+
+	db.metaLock.Lock()
+	db.writeMeta(oid, &ObjectMeta{
+		Owner:     owner,
+		Namespace: namespace,
+		Created:   created,
+		TTL:       policy.ttl,
+		Burn:      policy.burn,
+		MaxPulls:  policy.maxPulls,
+		Pulls:     make([]lib.AccessRecord, 0),
+		Size:      info.Size(),
+		Labels:    policy.labels,
+		Alias:     policy.alias,
+		Version:   policy.version,
+
+		ReleaseTo:       policy.releaseTo,
+		CheckinInterval: policy.checkinInterval,
+		ReleaseAt:       policy.releaseAtTime(),
+		Canary:          policy.canary,
+	})
+	db.metaLock.Unlock()
+
+	if err := db.store.putFile(oid, path); err != nil {
+		logger.Errorf("Failed to write object %s: %v", oid, err)
+	}
+}
+
+// The metadata of the objects of a removed key is read this many objects at a time.
+const disownBatchSize = 1000
+
+// disownObjects clears the owner of the objects of a removed key, so that a key added later with its name doesn't own
+// them, and moves their data from the key's quota usage to that of no key. They still count against their namespace.
+func (db *Database) disownObjects(keyName string) error {
+	var oids []string
+	afterCreated, afterOid := time.Time{}, ""
+	for {
+		owned, err := db.metas.owned(keyName, afterCreated, afterOid, disownBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, listed := range owned {
+			oids = append(oids, listed.oid)
+			afterCreated, afterOid = listed.meta.Created, listed.oid
+		}
+		if len(owned) < disownBatchSize {
+			break
+		}
+	}
+
+	for _, oid := range oids {
+		db.metaLock.Lock()
+		meta, err := db.readMeta(oid)
+		if err == nil && meta != nil && meta.Owner == keyName {
+			meta.Owner = ""
+			db.writeMeta(oid, meta)
+			if db.hasObject(oid) {
+				size := meta.Size
+				if meta.Inline {
+					size = int64(len(meta.Data))
+				}
+				db.quotas.transfer(keyName, "", meta.Namespace, size)
+			}
+		}
+		db.metaLock.Unlock()
+	}
+	return nil
+}
+
+// releaseMeta drops an object's inline data, or all of its metadata if there is no access log to retain,
+// returning the metadata as it was before, or nil if there was none.
+func (db *Database) releaseMeta(oid string) *ObjectMeta {
+	db.metaLock.Lock()
+	defer db.metaLock.Unlock()
+
+	meta, err := db.readMeta(oid)
+	if err != nil || meta == nil {
+		return nil
+	}
+
+	if !db.accessLogEnabled() {
+		db.removeMeta(oid)
+	} else if meta.Inline {
+		released := *meta
+		released.Data = nil
+		db.writeMeta(oid, &released)
+	}
+	return meta
+}
+
+// recordPull appends a pull to the object's access log. The requester is only recorded if the server is configured to.
+// Pulls which resume an interrupted one are recorded with the offset they resume from.
+func (db *Database) recordPull(oid string, keyName string, offset int64) {
+	if !db.accessLogEnabled() {
+		return
+	}
+
+	db.metaLock.Lock()
+	defer db.metaLock.Unlock()
+
+	meta, err := db.readMeta(oid)
+	if err != nil || meta == nil {
+		return
+	}
+
+	record := lib.AccessRecord{Time: db.clock.Now(), Offset: offset}
+	if db.logRequesters {
+		record.KeyName = keyName
+	}
+	meta.Pulls = append(meta.Pulls, record)
+
+	db.writeMeta(oid, meta)
+}
+
+// pullClaim is a pull of an object reserved before any of it is sent, so that concurrent pulls can't all take the
+// object's last pull. It must be finished with pulled once the pull was sent, or given back with unpulled if
+// sending it failed.
+type pullClaim struct {
+	oid string
+	// limited is set if the object allows a limited number of pulls, and last if this is the last of them, which
+	// destroys the object once it has been sent.
+	limited bool
+	last    bool
+}
+
+// claimPull reserves a pull of an object, returning nil if it has no pulls left. Objects allow one pull on
+// destructive servers, and their policy's otherwise. Every pull counts, whether or not it reaches the end of the
+// object, so that ranges stopping short of the end can't be pulled any number of times.
+func (db *Database) claimPull(oid string) (*pullClaim, error) {
+	db.metaLock.Lock()
+	defer db.metaLock.Unlock()
+
+	meta, err := db.readMeta(oid)
+	if err != nil {
+		return nil, err
+	}
+	left := -1
+	if meta != nil {
+		left = meta.pullsLeft()
+	}
+	if db.destructiveRead && (left < 0 || left > 1) {
+		left = 1
+	}
+	if left < 0 {
+		return &pullClaim{oid: oid}, nil
+	}
+
+	left -= db.claimedPulls[oid]
+	if left <= 0 {
+		return nil, nil
+	}
+	db.claimedPulls[oid]++
+	return &pullClaim{oid: oid, limited: true, last: left == 1}, nil
+}
+
+// completePull counts a claimed pull which was sent.
+func (db *Database) completePull(claim *pullClaim) {
+	if !claim.limited {
+		return
+	}
+
+	db.metaLock.Lock()
+	defer db.metaLock.Unlock()
+
+	db.releaseClaim(claim.oid)
+	meta, err := db.readMeta(claim.oid)
+	if err != nil || meta == nil || meta.pullsLeft() < 0 {
+		return
+	}
+	meta.Completed++
+	db.writeMeta(claim.oid, meta)
+}
+
+// releaseClaim drops a claimed pull of an object. metaLock must be held.
+func (db *Database) releaseClaim(oid string) {
+	if db.claimedPulls[oid] <= 1 {
+		delete(db.claimedPulls, oid)
+	} else {
+		db.claimedPulls[oid]--
+	}
+}
+
+// removeExpiredMeta removes the metadata of removed objects whose access log retention period has passed.
+func (db *Database) removeExpiredMeta(now time.Time) {
+	// Candidates are collected first, since the metadata store may not allow other queries while it lists. The
+	// metadata of an object expires the retention period after the object does at the earliest, so only that of objects
+	// created before then is read.
+	var oids []string
+	before := now.Add(-time.Duration(db.accessLogRetentionMin) * time.Minute)
+	err := db.metas.createdBefore(before, func(oid string, meta *ObjectMeta) {
+		if !db.hasObject(oid) && meta.isExpired(db.ttl(), db.accessLogRetentionMin, now) {
+			oids = append(oids, oid)
+		}
+	})
+	if err != nil {
+		logger.Errorf("Failed to list object metadata: %v", err)
+		return
+	}
+
+	for _, oid := range oids {
+		db.metaLock.Lock()
+		meta, err := db.readMeta(oid)
+		if err == nil && (meta == nil || meta.isExpired(db.ttl(), db.accessLogRetentionMin, now)) {
+			db.removeMeta(oid)
+		}
+		db.metaLock.Unlock()
+	}
+}
+
+// indexInlineObjects adds the inline objects which have not been removed to the object index, and counts them against
+// the quotas of their owners.
+func indexInlineObjects(
+	objectMap map[string]bool,
+	expHeap *ExpirationHeap,
+	metas metaStore,
+	quotas *quotas,
+	ttl time.Duration,
+) error {
+	return metas.each(func(oid string, meta *ObjectMeta) {
+		if !meta.Inline || meta.Data == nil || objectMap[oid] {
+			return
+		}
+
+		objectMap[oid] = true
+		expHeap.Push(newObjectInfo(oid, meta.Created, meta.TTL, ttl))
+		quotas.add(meta.Owner, meta.Namespace, int64(len(meta.Data)))
+	})
+}
+
+func (db *Database) readMeta(oid string) (*ObjectMeta, error) {
+	meta, err := db.metas.read(oid)
+	if err != nil {
+		logger.Errorf("Failed to read metadata of object %s: %v", oid, err)
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (db *Database) writeMeta(oid string, meta *ObjectMeta) {
+	if err := db.metas.write(oid, meta); err != nil {
+		logger.Errorf("Failed to write metadata of object %s: %v", oid, err)
+	}
+}
+
+func (db *Database) removeMeta(oid string) {
+	if err := db.metas.remove(oid); err != nil {
+		logger.Errorf("Failed to remove metadata of object %s: %v", oid, err)
+	}
+}
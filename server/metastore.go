@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"dead-drop/lib"
+	"encoding/json"
+	"github.com/google/logger"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const metaStoreFile = "file"
+const metaStoreSQLite = "sqlite"
+const metaStorePostgres = "postgres"
+
+// Object metadata is kept in a hidden directory inside the data directory by default, one json file per object.
+const metaDirName = ".meta"
+const metaFileExt = ".json"
+
+// Metadata directories are renamed with this suffix once they are imported into another store.
+const importedMetaDirSuffix = ".imported"
+
+// metaStore keeps the metadata of objects.
+type metaStore interface {
+	// read returns the metadata of an object, or nil if there is none.
+	read(oid string) (*ObjectMeta, error)
+	write(oid string, meta *ObjectMeta) error
+	// remove removes the metadata of an object, if there is any.
+	remove(oid string) error
+	// each calls fn with the metadata of every object, skipping metadata which can't be read.
+	each(fn func(oid string, meta *ObjectMeta)) error
+	// owned returns the metadata of up to limit objects owned by a key, ordered by creation time and then oid, starting
+	// after the object created at afterCreated with afterOid, or from the oldest if afterOid is empty.
+	owned(owner string, afterCreated time.Time, afterOid string, limit int) ([]listedMeta, error)
+	// createdBefore calls fn with the metadata of every object created before a time, skipping metadata which can't be
+	// read.
+	createdBefore(before time.Time, fn func(oid string, meta *ObjectMeta)) error
+	// ping checks that the store can be reached, giving up once ctx is done.
+	ping(ctx context.Context) error
+	// String describes where metadata is stored, for the log.
+	String() string
+}
+
+// listedMeta is the metadata of an object listed by a metaStore.
+type listedMeta struct {
+	oid  string
+	meta *ObjectMeta
+}
+
+// fileMetaStore keeps the metadata of each object in a json file of its own.
+type fileMetaStore struct {
+	dir string
+}
+
+func newFileMetaStore(dir string) (*fileMetaStore, error) {
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, err
+	}
+	return &fileMetaStore{dir: dir}, nil
+}
+
+func (store *fileMetaStore) read(oid string) (*ObjectMeta, error) {
+	meta, err := readMetaFile(store.path(oid))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return meta, err
+}
+
+func (store *fileMetaStore) write(oid string, meta *ObjectMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(store.path(oid), data, lib.ObjectPerms)
+}
+
+func (store *fileMetaStore) remove(oid string) error {
+	if err := os.Remove(store.path(oid)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (store *fileMetaStore) each(fn func(oid string, meta *ObjectMeta)) error {
+	files, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), metaFileExt) {
+			continue
+		}
+		oid := strings.TrimSuffix(file.Name(), metaFileExt)
+
+		meta, err := readMetaFile(filepath.Join(store.dir, file.Name()))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.Warningf("Skipping unreadable metadata of object %s: %v", oid, err)
+			}
+			continue
+		}
+		fn(oid, meta)
+	}
+	return nil
+}
+
+// owned reads the metadata of every object, since files aren't indexed by owner.
+func (store *fileMetaStore) owned(owner string, afterCreated time.Time, afterOid string, limit int) ([]listedMeta,
+	error) {
+	return scanOwned(store.each, owner, afterCreated, afterOid, limit)
+}
+
+func (store *fileMetaStore) createdBefore(before time.Time, fn func(oid string, meta *ObjectMeta)) error {
+	return scanCreatedBefore(store.each, before, fn)
+}
+
+// scanOwned lists the objects owned by a key from the metadata of every object, for stores which aren't indexed by
+// owner.
+func scanOwned(each func(fn func(oid string, meta *ObjectMeta)) error, owner string, afterCreated time.Time,
+	afterOid string, limit int) ([]listedMeta, error) {
+	owned := make([]listedMeta, 0)
+	err := each(func(oid string, meta *ObjectMeta) {
+		if meta.Owner == owner && (afterOid == "" || listedAfter(meta.Created, oid, afterCreated, afterOid)) {
+			owned = append(owned, listedMeta{oid: oid, meta: meta})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(owned, func(i, j int) bool {
+		return listedAfter(owned[j].meta.Created, owned[j].oid, owned[i].meta.Created, owned[i].oid)
+	})
+	if len(owned) > limit {
+		owned = owned[:limit]
+	}
+	return owned, nil
+}
+
+// scanCreatedBefore calls fn with the metadata of every object created before a time, for stores which aren't
+// indexed by creation time.
+func scanCreatedBefore(each func(fn func(oid string, meta *ObjectMeta)) error, before time.Time,
+	fn func(oid string, meta *ObjectMeta)) error {
+	return each(func(oid string, meta *ObjectMeta) {
+		if meta.Created.Before(before) {
+			fn(oid, meta)
+		}
+	})
+}
+
+// listedAfter returns whether an object created at created with oid comes after another in listings, which are
+// ordered by creation time and then oid.
+func listedAfter(created time.Time, oid string, otherCreated time.Time, otherOid string) bool {
+	if created.Equal(otherCreated) {
+		return oid > otherOid
+	}
+	return created.After(otherCreated)
+}
+
+func (store *fileMetaStore) ping(ctx context.Context) error {
+	_, err := os.Stat(store.dir)
+	return err
+}
+
+func (store *fileMetaStore) String() string {
+	return "metadata directory " + store.dir
+}
+
+func (store *fileMetaStore) path(oid string) string {
+	return filepath.Join(store.dir, oid+metaFileExt)
+}
+
+// importFileMeta copies the metadata in a metadata directory into another store, and renames the directory so that it
+// is only imported once, e.g. when a server which kept metadata in its data directory is configured with a database.
+func importFileMeta(dir string, store metaStore) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	files, err := newFileMetaStore(dir)
+	if err != nil {
+		return err
+	}
+
+	imported := 0
+	var writeErr error
+	err = files.each(func(oid string, meta *ObjectMeta) {
+		if writeErr == nil {
+			writeErr = store.write(oid, meta)
+			imported++
+		}
+	})
+	if err != nil {
+		return err
+	} else if writeErr != nil {
+		return writeErr
+	}
+
+	logger.Infof("Imported the metadata of %d objects from %s into %s", imported, dir, store)
+	return os.Rename(dir, dir+importedMetaDirSuffix)
+}
+
+func readMetaFile(path string) (*ObjectMeta, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &ObjectMeta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/google/logger"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The database/sql drivers of the sql metadata stores. The SQLite driver needs cgo, without which it fails to open
+// databases.
+var metaStoreDrivers = map[string]string{
+	metaStoreSQLite:   "sqlite3",
+	metaStorePostgres: "postgres",
+}
+
+// The metadata of each object is kept in a row of object_meta, with the fields operators query on, e.g. to list the
+// objects of a key or those about to expire, in columns of their own alongside the json of the whole of it. Times are
+// unix nanoseconds, and a ttl of 0 is the server's.
+var metaSchema = []string{
+	`CREATE TABLE IF NOT EXISTS object_meta (
+		oid TEXT PRIMARY KEY,
+		owner TEXT NOT NULL,
+		created BIGINT NOT NULL,
+		ttl BIGINT NOT NULL,
+		size BIGINT NOT NULL,
+		pulls INTEGER NOT NULL,
+		completed INTEGER NOT NULL,
+		meta TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS object_meta_owner ON object_meta (owner, created)`,
+	`CREATE INDEX IF NOT EXISTS object_meta_created ON object_meta (created)`,
+}
+
+// sqlMetaStore keeps metadata in a SQLite or Postgres database. Postgres lets servers keep no state of their own when
+// objects are stored in the cloud too, and lets metadata be queried while they run.
+type sqlMetaStore struct {
+	kind string
+	db   *sql.DB
+}
+
+func newSQLMetaStore(kind string, dsn string) (*sqlMetaStore, error) {
+	driver, ok := metaStoreDrivers[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown metadata store '%s'", kind)
+	}
+	registered := false
+	for _, name := range sql.Drivers() {
+		registered = registered || name == driver
+	}
+	if !registered {
+		return nil, fmt.Errorf("the server was built without the %s driver", kind)
+	}
+	if dsn == "" {
+		return nil, fmt.Errorf("no data source configured")
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if kind == metaStoreSQLite {
+		// SQLite allows a single writer, which would otherwise fail with "database is locked" under load.
+		db.SetMaxOpenConns(1)
+	}
+	for _, statement := range metaSchema {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error creating schema: %v", err)
+		}
+	}
+
+	return &sqlMetaStore{kind: kind, db: db}, nil
+}
+
+func (store *sqlMetaStore) read(oid string) (*ObjectMeta, error) {
+	var data string
+	err := store.db.QueryRow(store.bind("SELECT meta FROM object_meta WHERE oid = ?"), oid).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	meta := &ObjectMeta{}
+	if err := json.Unmarshal([]byte(data), meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (store *sqlMetaStore) write(oid string, meta *ObjectMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	// Both SQLite and Postgres support upserts with this syntax.
+	_, err = store.db.Exec(store.bind(`INSERT INTO object_meta (oid, owner, created, ttl, size, pulls, completed, meta)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (oid) DO UPDATE SET owner = excluded.owner, created = excluded.created, ttl = excluded.ttl,
+			size = excluded.size, pulls = excluded.pulls, completed = excluded.completed, meta = excluded.meta`),
+		oid, meta.Owner, meta.Created.UnixNano(), int64(meta.TTL), meta.Size, len(meta.Pulls), meta.Completed,
+		string(data))
+	return err
+}
+
+func (store *sqlMetaStore) remove(oid string) error {
+	_, err := store.db.Exec(store.bind("DELETE FROM object_meta WHERE oid = ?"), oid)
+	return err
+}
+
+func (store *sqlMetaStore) each(fn func(oid string, meta *ObjectMeta)) error {
+	return store.query(fn, "SELECT oid, meta FROM object_meta")
+}
+
+// owned is served by the object_meta_owner index.
+func (store *sqlMetaStore) owned(owner string, afterCreated time.Time, afterOid string, limit int) ([]listedMeta,
+	error) {
+	query := "SELECT oid, meta FROM object_meta WHERE owner = ? ORDER BY created, oid LIMIT ?"
+	args := []interface{}{owner, limit}
+	if afterOid != "" {
+		query = `SELECT oid, meta FROM object_meta WHERE owner = ? AND (created > ? OR (created = ? AND oid > ?))
+			ORDER BY created, oid LIMIT ?`
+		args = []interface{}{owner, afterCreated.UnixNano(), afterCreated.UnixNano(), afterOid, limit}
+	}
+
+	owned := make([]listedMeta, 0)
+	err := store.query(func(oid string, meta *ObjectMeta) {
+		owned = append(owned, listedMeta{oid: oid, meta: meta})
+	}, query, args...)
+	return owned, err
+}
+
+// createdBefore is served by the object_meta_created index.
+func (store *sqlMetaStore) createdBefore(before time.Time, fn func(oid string, meta *ObjectMeta)) error {
+	return store.query(fn, "SELECT oid, meta FROM object_meta WHERE created < ?", before.UnixNano())
+}
+
+// query calls fn with the metadata of the rows a query of oid and meta selects, in order. It reads all the rows before
+// calling fn, so that fn can query the store, which SQLite's single connection would otherwise not allow.
+func (store *sqlMetaStore) query(fn func(oid string, meta *ObjectMeta), query string, args ...interface{}) error {
+	rows, err := store.db.Query(store.bind(query), args...)
+	if err != nil {
+		return err
+	}
+
+	var metas []listedMeta
+	for rows.Next() {
+		var oid, data string
+		if err := rows.Scan(&oid, &data); err != nil {
+			rows.Close()
+			return err
+		}
+
+		meta := &ObjectMeta{}
+		if err := json.Unmarshal([]byte(data), meta); err != nil {
+			logger.Warningf("Skipping unreadable metadata of object %s: %v", oid, err)
+			continue
+		}
+		metas = append(metas, listedMeta{oid: oid, meta: meta})
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, listed := range metas {
+		fn(listed.oid, listed.meta)
+	}
+	return nil
+}
+
+// ping looks up an oid no object has, so that it checks the table can be queried as well as the connection.
+func (store *sqlMetaStore) ping(ctx context.Context) error {
+	var oid string
+	err := store.db.QueryRowContext(ctx, store.bind("SELECT oid FROM object_meta WHERE oid = ?"), healthCheckOid).Scan(&oid)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+func (store *sqlMetaStore) Close() error {
+	return store.db.Close()
+}
+
+func (store *sqlMetaStore) String() string {
+	return store.kind + " database"
+}
+
+// bind rewrites the ? placeholders of a query to the $n placeholders of Postgres.
+func (store *sqlMetaStore) bind(query string) string {
+	if store.kind != metaStorePostgres {
+		return query
+	}
+
+	var bound strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			bound.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		bound.WriteRune(c)
+	}
+	return bound.String()
+}
@@ -0,0 +1,5 @@
+package server
+
+// SQLite is the default metadata store. Its driver needs cgo, so servers built without it must be configured with
+// another store.
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Request durations are counted in these buckets, in seconds, which span token requests to pulls of large objects.
+var requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Kinds of authentication failure, which label the auth failures counter.
+const authFailureTokenRequest = "token_request"
+const authFailureToken = "token"
+const authFailureReplication = "replication"
+const authFailureAdmin = "admin"
+
+// serverMetrics counts the requests the server handles, for /metrics. Its methods do nothing on a nil serverMetrics.
+type serverMetrics struct {
+	mutex sync.Mutex
+	// requests counts requests by their labels, and durations times them by endpoint and method.
+	requests     map[string]float64
+	durations    map[string]*histogram
+	authFailures map[string]float64
+	tokensIssued uint64
+}
+
+// histogram counts observations in cumulative buckets, as Prometheus histograms do.
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newServerMetrics() *serverMetrics {
+	authFailures := make(map[string]float64)
+	for _, kind := range []string{authFailureTokenRequest, authFailureToken, authFailureReplication, authFailureAdmin} {
+		authFailures[labels("kind", kind)] = 0
+	}
+
+	return &serverMetrics{
+		requests:     make(map[string]float64),
+		durations:    make(map[string]*histogram),
+		authFailures: authFailures,
+	}
+}
+
+// instrument is router middleware which counts and times requests by the route they matched.
+func (metrics *serverMetrics) instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if metrics == nil {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		// Endpoints are labelled by route, e.g. /d/{oid}, so that every oid doesn't make a series of its own.
+		endpoint := "other"
+		if route := mux.CurrentRoute(req); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				endpoint = template
+			}
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		h.ServeHTTP(recorder, req)
+		metrics.observeRequest(endpoint, req.Method, recorder.status, time.Since(start))
+	})
+}
+
+func (metrics *serverMetrics) observeRequest(endpoint string, method string, status int, duration time.Duration) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.requests[labels("endpoint", endpoint, "method", method, "code", strconv.Itoa(status))]++
+
+	key := labels("endpoint", endpoint, "method", method)
+	hist, ok := metrics.durations[key]
+	if !ok {
+		hist = &histogram{buckets: make([]uint64, len(requestDurationBuckets))}
+		metrics.durations[key] = hist
+	}
+	seconds := duration.Seconds()
+	for i, bound := range requestDurationBuckets {
+		if seconds <= bound {
+			hist.buckets[i]++
+		}
+	}
+	hist.count++
+	hist.sum += seconds
+}
+
+// authFailed counts a request which failed to authenticate, of one of the authFailure kinds.
+func (metrics *serverMetrics) authFailed(kind string) {
+	if metrics == nil {
+		return
+	}
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.authFailures[labels("kind", kind)]++
+}
+
+func (metrics *serverMetrics) tokenIssued() {
+	if metrics == nil {
+		return
+	}
+	atomic.AddUint64(&metrics.tokensIssued, 1)
+}
+
+// write writes the request metrics in the Prometheus text exposition format.
+func (metrics *serverMetrics) write(w io.Writer) error {
+	if metrics == nil {
+		return nil
+	}
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	if err := writeCounter(w, requestsMetric, "Requests handled, by endpoint, method and status code.",
+		metrics.requests); err != nil {
+		return err
+	}
+	if err := writeHistogram(w, requestDurationMetric, "Time taken to handle requests, by endpoint and method.",
+		metrics.durations); err != nil {
+		return err
+	}
+	if err := writeCounter(w, authFailuresMetric, "Requests which failed to authenticate, by kind.",
+		metrics.authFailures); err != nil {
+		return err
+	}
+	return writeCounter(w, tokensIssuedMetric, "Tokens issued to authorized keys.",
+		map[string]float64{"": float64(atomic.LoadUint64(&metrics.tokensIssued))})
+}
+
+// writeHistogram writes histograms in the Prometheus text exposition format, by their labels.
+func writeHistogram(w io.Writer, name string, help string, samples map[string]*histogram) error {
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(samples))
+	for key := range samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hist := samples[key]
+		// Bucket labels are added to the histogram's, e.g. {endpoint="/d",le="0.5"}.
+		prefix := "{"
+		if key != "" {
+			prefix = key[:len(key)-1] + ","
+		}
+		for i, bound := range requestDurationBuckets {
+			if _, err := fmt.Fprintf(w, "%s_bucket%sle=\"%g\"} %d\n", name, prefix, bound, hist.buckets[i]); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%sle=\"+Inf\"} %d\n%s_sum%s %g\n%s_count%s %d\n",
+			name, prefix, hist.count, name, key, hist.sum, name, key, hist.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// labels formats pairs of label names and values as the labels of a sample, e.g. {kind="token"}.
+func labels(pairs ...string) string {
+	formatted := "{"
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			formatted += ","
+		}
+		formatted += pairs[i] + "=" + strconv.Quote(pairs[i+1])
+	}
+	return formatted + "}"
+}
+
+// statusRecorder records the status of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"github.com/google/logger"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+// The namespace of an authorized key is kept in an attribute of this name, unless the key is in the default namespace,
+// which is empty.
+const keyNamespaceAttribute = "namespace"
+
+// keyNamespaceContextKey holds the namespace of the key an authenticated request was made with.
+const keyNamespaceContextKey = contextKey("key-namespace")
+
+// Namespaces are named like keys.
+var namespaceRegex = keyNameRegex
+
+func requestKeyNamespace(req *http.Request) string {
+	namespace, _ := req.Context().Value(keyNamespaceContextKey).(string)
+	return namespace
+}
+
+// keyNamespace returns the namespace of an authorized key, which is empty for the default namespace.
+func (auth *Authenticator) keyNamespace(keyName string) (string, error) {
+	return auth.keyAttribute(keyName, keyNamespaceAttribute, "")
+}
+
+// setKeyNamespace moves an authorized key into a namespace, or into the default namespace if namespace is empty.
+func (auth *Authenticator) setKeyNamespace(keyName string, namespace string) error {
+	return auth.setKeyAttribute(keyName, keyNamespaceAttribute, namespace)
+}
+
+// keyNamespaces returns the namespaces of keys by name, for replication. Keys in the default namespace are left out.
+func (auth *Authenticator) keyNamespaces() (map[string]string, error) {
+	return auth.keyAttributes(keyNamespaceAttribute)
+}
+
+// requireNamespace scopes authenticated requests to the namespace of their key. Requests to routes under
+// /ns/{namespace} are refused unless it is the key's namespace, and requests for objects of other namespaces are
+// answered as if there were no such object.
+func (handler *Handler) requireNamespace(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		keyName, namespace := requestKeyName(req), requestKeyNamespace(req)
+		params := mux.Vars(req)
+
+		if routeNamespace, ok := params["namespace"]; ok && routeNamespace != namespace {
+			logger.Warningf("Refused request of key %s to namespace %s", keyName, routeNamespace)
+			handler.audit(req, auditAuthFailure, keyName, "", "key not in namespace "+routeNamespace)
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = fmt.Fprintf(w, "key %s is not in namespace %s", keyName, routeNamespace)
+			return
+		}
+		if oid, ok := params["oid"]; ok && !handler.db.inNamespace(oid, namespace) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		h(w, req)
+	}
+}
+
+// inNamespace returns whether an object is in a namespace, or is not stored at all.
+func (db *Database) inNamespace(oid string, namespace string) bool {
+	if !db.hasObject(oid) {
+		return true
+	}
+
+	meta, err := db.objectMeta(oid)
+	if err != nil {
+		return false
+	}
+	if meta == nil {
+		return namespace == ""
+	}
+	return meta.Namespace == namespace
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Metric names exported on /metrics, and referenced by the generated alerts and dashboard.
+const objectsMetric = "deaddrop_objects"
+const oldestObjectAgeMetric = "deaddrop_oldest_object_age_seconds"
+const ttlMetric = "deaddrop_ttl_seconds"
+const replicationRoleMetric = "deaddrop_replication_role"
+const replicationEpochMetric = "deaddrop_replication_epoch"
+const primaryLastSeenAgeMetric = "deaddrop_replication_primary_last_seen_age_seconds"
+const expiredObjectsMetric = "deaddrop_expired_objects_total"
+const expiredBytesMetric = "deaddrop_expired_bytes_total"
+const storedBytesMetric = "deaddrop_stored_bytes"
+const expiryRunsMetric = "deaddrop_expiry_runs_total"
+const expiryDurationMetric = "deaddrop_expiry_duration_seconds"
+const requestsMetric = "deaddrop_requests_total"
+const requestDurationMetric = "deaddrop_request_duration_seconds"
+const authFailuresMetric = "deaddrop_auth_failures_total"
+const tokensIssuedMetric = "deaddrop_tokens_issued_total"
+
+// Objects may outlive the ttl by up to the expiry interval, and by this much more before an alert should fire.
+const expiryJobSlack = 5 * time.Minute
+
+// ObservabilityConfig holds the settings alert thresholds are derived from.
+type ObservabilityConfig struct {
+	TtlMin              uint
+	ExpiryInterval      time.Duration
+	ReplicationInterval time.Duration
+	FailoverTimeout     time.Duration
+}
+
+// ObservabilityBundle holds Prometheus alerting rules and a Grafana dashboard, generated from the server configuration.
+// Both are plain JSON: the rules can be saved as a Prometheus rules file as-is, since JSON is valid YAML,
+// and the dashboard can be dropped into a Grafana provisioning directory.
+type ObservabilityBundle struct {
+	PrometheusRules  *prometheusRules       `json:"prometheusRules"`
+	GrafanaDashboard map[string]interface{} `json:"grafanaDashboard"`
+}
+
+type prometheusRules struct {
+	Groups []prometheusRuleGroup `json:"groups"`
+}
+
+type prometheusRuleGroup struct {
+	Name  string           `json:"name"`
+	Rules []prometheusRule `json:"rules"`
+}
+
+type prometheusRule struct {
+	Alert       string            `json:"alert"`
+	Expr        string            `json:"expr"`
+	For         string            `json:"for,omitempty"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+func newObservabilityBundle(config *ObservabilityConfig) *ObservabilityBundle {
+	return &ObservabilityBundle{
+		PrometheusRules:  config.alertRules(),
+		GrafanaDashboard: config.dashboard(),
+	}
+}
+
+func (config *ObservabilityConfig) ttl() time.Duration {
+	return time.Duration(config.TtlMin) * time.Minute
+}
+
+// maxObjectAge is the age past which objects should have been removed by the expiry job.
+func (config *ObservabilityConfig) maxObjectAge() time.Duration {
+	return config.ttl() + config.ExpiryInterval + expiryJobSlack
+}
+
+func (config *ObservabilityConfig) alertRules() *prometheusRules {
+	rules := []prometheusRule{
+		{
+			Alert: "DeadDropObjectsOutlivingTtl",
+			Expr:  fmt.Sprintf("%s > %d", oldestObjectAgeMetric, int64(config.maxObjectAge().Seconds())),
+			For:   "5m",
+			Labels: map[string]string{
+				"severity": "critical",
+			},
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("Objects are older than the %d minute ttl, expiry may be stuck", config.TtlMin),
+			},
+		},
+		{
+			Alert: "DeadDropPrimaryFenced",
+			Expr:  fmt.Sprintf("%s{role=\"%s\"} == 1", replicationRoleMetric, roleFenced),
+			Labels: map[string]string{
+				"severity": "critical",
+			},
+			Annotations: map[string]string{
+				"summary": "A fenced primary is refusing requests, restart it as a standby of the new primary",
+			},
+		},
+		{
+			Alert: "DeadDropNoPrimary",
+			Expr:  fmt.Sprintf("sum(%s{role=\"%s\"}) < 1", replicationRoleMetric, rolePrimary),
+			For:   "1m",
+			Labels: map[string]string{
+				"severity": "critical",
+			},
+			Annotations: map[string]string{
+				"summary": "No dead-drop server is accepting drops",
+			},
+		},
+	}
+
+	if config.ReplicationInterval > 0 {
+		// Warn before automatic failover would kick in, or after a few missed syncs if it is disabled.
+		threshold := 3 * config.ReplicationInterval
+		if config.FailoverTimeout > 0 && config.FailoverTimeout/2 > threshold {
+			threshold = config.FailoverTimeout / 2
+		}
+
+		rules = append(rules, prometheusRule{
+			Alert: "DeadDropStandbyLagging",
+			Expr: fmt.Sprintf("%s{role=\"%s\"} == 1 and on(instance) %s > %d",
+				replicationRoleMetric, roleStandby, primaryLastSeenAgeMetric, int64(threshold.Seconds())),
+			Labels: map[string]string{
+				"severity": "warning",
+			},
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("A standby has not synced with its primary for over %s", threshold),
+			},
+		})
+	}
+
+	return &prometheusRules{
+		Groups: []prometheusRuleGroup{{Name: "dead-drop", Rules: rules}},
+	}
+}
+
+func (config *ObservabilityConfig) dashboard() map[string]interface{} {
+	panel := func(id int, title string, expr string, y int, thresholds ...float64) map[string]interface{} {
+		steps := []map[string]interface{}{{"color": "green", "value": nil}}
+		for _, threshold := range thresholds {
+			steps = append(steps, map[string]interface{}{"color": "red", "value": threshold})
+		}
+
+		return map[string]interface{}{
+			"id":      id,
+			"type":    "timeseries",
+			"title":   title,
+			"gridPos": map[string]int{"h": 8, "w": 24, "x": 0, "y": y},
+			"targets": []map[string]string{{"expr": expr, "refId": "A"}},
+			"fieldConfig": map[string]interface{}{
+				"defaults": map[string]interface{}{
+					"thresholds": map[string]interface{}{"mode": "absolute", "steps": steps},
+				},
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"uid":           "dead-drop",
+		"title":         "dead-drop",
+		"schemaVersion": 27,
+		"refresh":       "1m",
+		"time":          map[string]string{"from": "now-24h", "to": "now"},
+		"panels": []map[string]interface{}{
+			panel(1, "Stored objects", objectsMetric, 0),
+			panel(2, "Oldest object age", oldestObjectAgeMetric, 8, config.maxObjectAge().Seconds()),
+			panel(3, "Replication role", replicationRoleMetric, 16),
+			panel(4, "Time since standby synced", primaryLastSeenAgeMetric, 24, config.FailoverTimeout.Seconds()),
+			panel(5, "Stored bytes", storedBytesMetric, 32),
+			panel(6, "Requests per second", fmt.Sprintf("sum by (endpoint) (rate(%s[5m]))", requestsMetric), 40),
+			panel(7, "99th percentile request duration",
+				fmt.Sprintf("histogram_quantile(0.99, sum by (endpoint, le) (rate(%s_bucket[5m])))",
+					requestDurationMetric), 48),
+			panel(8, "Auth failures per second", fmt.Sprintf("sum by (kind) (rate(%s[5m]))", authFailuresMetric), 56),
+		},
+	}
+}
+
+// writeGauge writes a gauge in the Prometheus text exposition format.
+func writeGauge(w io.Writer, name string, help string, samples map[string]float64) error {
+	return writeMetric(w, "gauge", name, help, samples)
+}
+
+// writeCounter writes a counter in the Prometheus text exposition format.
+func writeCounter(w io.Writer, name string, help string, samples map[string]float64) error {
+	return writeMetric(w, "counter", name, help, samples)
+}
+
+func writeMetric(w io.Writer, metricType string, name string, help string, samples map[string]float64) error {
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType); err != nil {
+		return err
+	}
+	for labels, value := range samples {
+		if _, err := fmt.Fprintf(w, "%s%s %g\n", name, labels, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
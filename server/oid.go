@@ -0,0 +1,143 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"dead-drop/lib"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/logger"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// Modes of picking the oids of new objects.
+const (
+	// oidModeRandom picks oids at random.
+	oidModeRandom = "random"
+	// oidModeContent derives oids from the data which is stored, i.e. the ciphertext of encrypted drops, so that
+	// dropping the same ciphertext again returns the same object rather than storing a copy, and stored data can be
+	// checked against its oid.
+	oidModeContent = "content"
+)
+
+// Alphabets of random oids.
+const (
+	// oidAlphabetLetters is lowercase letters, as servers always picked.
+	oidAlphabetLetters = "letters"
+	oidAlphabetHex     = "hex"
+	// oidAlphabetBase32 is Crockford's base32, in lowercase, which leaves out letters mistaken for digits.
+	oidAlphabetBase32 = "base32"
+	// oidAlphabetWords is the words of lib.Words, joined by oidWordSeparator.
+	oidAlphabetWords = "words"
+)
+
+const oidWordSeparator = "-"
+
+// Random oids have at least minOidBits bits of entropy, so that picking one which isn't taken stays cheap, and at most
+// maxOidLength symbols.
+const minOidBits = 32
+const maxOidLength = 128
+
+const DuplicateObjectErr = Error("an identical object was already dropped with another key")
+const CorruptObjectErr = Error("the object's data doesn't match its oid")
+
+// oidScheme is how the oids of new objects are picked: from their data, or length random symbols of an alphabet.
+type oidScheme struct {
+	content   bool
+	alphabet  string
+	symbols   []string
+	separator string
+	length    int
+}
+
+// newOidScheme returns the scheme of a mode, and for random oids an alphabet and length, or 0 for the alphabet's
+// default length.
+func newOidScheme(mode string, alphabet string, length int) (*oidScheme, error) {
+	if mode != oidModeRandom && mode != oidModeContent {
+		return nil, fmt.Errorf("unknown oid mode '%s', which must be %s or %s", mode, oidModeRandom, oidModeContent)
+	}
+
+	scheme := &oidScheme{content: mode == oidModeContent, alphabet: alphabet, length: length}
+	defaultLength := 0
+	switch alphabet {
+	case oidAlphabetLetters:
+		scheme.symbols = strings.Split("abcdefghijklmnopqrstuvwxyz", "")
+		defaultLength = 16
+	case oidAlphabetHex:
+		scheme.symbols = strings.Split("0123456789abcdef", "")
+		defaultLength = 32
+	case oidAlphabetBase32:
+		scheme.symbols = strings.Split("0123456789abcdefghjkmnpqrstvwxyz", "")
+		defaultLength = 26
+	case oidAlphabetWords:
+		scheme.symbols = lib.Words
+		scheme.separator = oidWordSeparator
+		defaultLength = 8
+	default:
+		return nil, fmt.Errorf("unknown oid alphabet '%s', which must be %s, %s, %s or %s", alphabet,
+			oidAlphabetLetters, oidAlphabetHex, oidAlphabetBase32, oidAlphabetWords)
+	}
+
+	if scheme.length == 0 {
+		scheme.length = defaultLength
+	}
+	if scheme.length < 0 || scheme.length > maxOidLength {
+		return nil, fmt.Errorf("invalid oid length %d, which must be at most %d", length, maxOidLength)
+	}
+	if scheme.bits() < minOidBits {
+		return nil, fmt.Errorf("oids of %d %s have %.1f bits of entropy, and must have at least %d", scheme.length,
+			alphabet, scheme.bits(), minOidBits)
+	}
+	return scheme, nil
+}
+
+// bits returns the entropy of random oids.
+func (scheme *oidScheme) bits() float64 {
+	return float64(scheme.length) * math.Log2(float64(len(scheme.symbols)))
+}
+
+func (scheme *oidScheme) String() string {
+	if scheme.content {
+		return "SHA-256 of their data"
+	}
+	return fmt.Sprintf("%d random %s, of %.1f bits of entropy", scheme.length, scheme.alphabet, scheme.bits())
+}
+
+// random returns a random oid.
+func (scheme *oidScheme) random() string {
+	count := big.NewInt(int64(len(scheme.symbols)))
+	symbols := make([]string, scheme.length)
+	for i := range symbols {
+		index, err := rand.Int(rand.Reader, count)
+		if err != nil {
+			logger.Fatalf("Failed to generate random oid: %v", err)
+		}
+		symbols[i] = scheme.symbols[index.Int64()]
+	}
+	return strings.Join(symbols, scheme.separator)
+}
+
+// contentOid returns the oid of an object in content mode: the hex SHA-256 of its data.
+func contentOid(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// fileContentOid is contentOid for data in a file.
+func fileContentOid(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
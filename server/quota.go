@@ -0,0 +1,226 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// quotas tracks the bytes of object data stored by each key, and in each namespace, and limits them. Objects count
+// against the key which dropped them, and its namespace, until they are removed, whether they are pulled, expire or are
+// removed by their owner.
+type quotas struct {
+	mutex sync.Mutex
+	// limit is the quota of keys without one of their own, or 0 if they have none.
+	limit     int64
+	keyLimits map[string]int64
+	used      map[string]int64
+	// namespaceLimits are the quotas of namespaces, which have none unless they are configured. The default namespace
+	// never has one.
+	namespaceLimits map[string]int64
+	namespaceUsed   map[string]int64
+}
+
+// quotaError is the error of a drop which would take its key, or its namespace, over its quota.
+type quotaError struct {
+	size  int64
+	used  int64
+	quota int64
+	// namespace is set if the namespace's quota was exceeded, rather than the key's.
+	namespace string
+}
+
+func (err *quotaError) Error() string {
+	if err.namespace != "" {
+		return fmt.Sprintf("over quota: an object of %d bytes would exceed the quota of namespace %s of %d bytes, "+
+			"of which %d are used", err.size, err.namespace, err.quota, err.used)
+	}
+	return fmt.Sprintf("over quota: an object of %d bytes would exceed the quota of %d bytes, of which %d are used",
+		err.size, err.quota, err.used)
+}
+
+func newQuotas(limit int64, keyLimits map[string]int64, namespaceLimits map[string]int64) *quotas {
+	if keyLimits == nil {
+		keyLimits = make(map[string]int64)
+	}
+	if namespaceLimits == nil {
+		namespaceLimits = make(map[string]int64)
+	}
+	return &quotas{
+		limit:           limit,
+		keyLimits:       keyLimits,
+		used:            make(map[string]int64),
+		namespaceLimits: namespaceLimits,
+		namespaceUsed:   make(map[string]int64),
+	}
+}
+
+// parseKeyQuotas parses quotas of the form <key name>=<bytes>, where 0 bytes lifts the default quota from the key.
+func parseKeyQuotas(entries []string) (map[string]int64, error) {
+	return parseQuotas(entries, "key", keyNameRegex)
+}
+
+// parseNamespaceQuotas parses quotas of the form <namespace>=<bytes>, where 0 bytes is no limit.
+func parseNamespaceQuotas(entries []string) (map[string]int64, error) {
+	return parseQuotas(entries, "namespace", namespaceRegex)
+}
+
+func parseQuotas(entries []string, kind string, nameRegex *regexp.Regexp) (map[string]int64, error) {
+	limits := make(map[string]int64)
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !nameRegex.MatchString(strings.TrimSpace(parts[0])) {
+			return nil, fmt.Errorf("invalid %s quota '%s', which must be <%s name>=<bytes>", kind, entry, kind)
+		}
+		limit, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid %s quota '%s', which must be <%s name>=<bytes>", kind, entry, kind)
+		}
+		limits[strings.TrimSpace(parts[0])] = limit
+	}
+	return limits, nil
+}
+
+// quota returns the quota of a key, or 0 if it has none.
+func (q *quotas) quota(keyName string) int64 {
+	if limit, ok := q.keyLimits[keyName]; ok {
+		return limit
+	}
+	return q.limit
+}
+
+// reserve counts an object of the given size against a key and its namespace, returning a quotaError instead if it
+// would take either over its quota.
+func (q *quotas) reserve(keyName string, namespace string, size int64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if err := q.checkLocked(keyName, namespace, size); err != nil {
+		return err
+	}
+	q.used[keyName] += size
+	q.namespaceUsed[namespace] += size
+	return nil
+}
+
+// check returns a quotaError if an object of the given size would take a key or its namespace over its quota, without
+// counting it against them.
+func (q *quotas) check(keyName string, namespace string, size int64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.checkLocked(keyName, namespace, size)
+}
+
+func (q *quotas) checkLocked(keyName string, namespace string, size int64) error {
+	quota := q.quota(keyName)
+	if quota > 0 && q.used[keyName]+size > quota {
+		return &quotaError{size: size, used: q.used[keyName], quota: quota}
+	}
+	if quota := q.namespaceLimits[namespace]; namespace != "" && quota > 0 && q.namespaceUsed[namespace]+size > quota {
+		return &quotaError{size: size, used: q.namespaceUsed[namespace], quota: quota, namespace: namespace}
+	}
+	return nil
+}
+
+// remaining returns the bytes a key may still store, which are also limited by its namespace's quota, and false if
+// neither has a quota.
+func (q *quotas) remaining(keyName string, namespace string) (int64, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	remaining, limited := int64(0), false
+	if quota := q.quota(keyName); quota > 0 {
+		remaining, limited = quota-q.used[keyName], true
+	}
+	if quota := q.namespaceLimits[namespace]; namespace != "" && quota > 0 {
+		if left := quota - q.namespaceUsed[namespace]; !limited || left < remaining {
+			remaining, limited = left, true
+		}
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, limited
+}
+
+// add counts an object against a key and its namespace even if it takes them over their quota, e.g. one which was
+// indexed on startup or replicated from a primary which already accepted it.
+func (q *quotas) add(keyName string, namespace string, size int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.used[keyName] += size
+	q.namespaceUsed[namespace] += size
+}
+
+// transfer counts an object against another key of the same namespace instead.
+func (q *quotas) transfer(fromKey string, toKey string, namespace string, size int64) {
+	q.release(fromKey, namespace, size)
+	q.add(toKey, namespace, size)
+}
+
+// release stops counting a removed object against a key and its namespace.
+func (q *quotas) release(keyName string, namespace string, size int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.used[keyName] -= size
+	if q.used[keyName] <= 0 {
+		delete(q.used, keyName)
+	}
+	q.namespaceUsed[namespace] -= size
+	if q.namespaceUsed[namespace] <= 0 {
+		delete(q.namespaceUsed, namespace)
+	}
+}
+
+// total returns the bytes stored by every key.
+func (q *quotas) total() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	total := int64(0)
+	for _, used := range q.used {
+		total += used
+	}
+	return total
+}
+
+// usage returns the bytes stored by a key, and its quota, or 0 if it has none.
+func (q *quotas) usage(keyName string) (int64, int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.used[keyName], q.quota(keyName)
+}
+
+// namespaceUsage returns the bytes stored in a namespace, and its quota, or 0 if it has none.
+func (q *quotas) namespaceUsage(namespace string) (int64, int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if namespace == "" {
+		return q.namespaceUsed[namespace], 0
+	}
+	return q.namespaceUsed[namespace], q.namespaceLimits[namespace]
+}
+
+// snapshot returns the bytes stored by each key, and in each namespace, by name. Keys and namespaces which store
+// nothing are left out.
+func (q *quotas) snapshot() (map[string]int64, map[string]int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	keys := make(map[string]int64, len(q.used))
+	for keyName, used := range q.used {
+		keys[keyName] = used
+	}
+	namespaces := make(map[string]int64, len(q.namespaceUsed))
+	for namespace, used := range q.namespaceUsed {
+		namespaces[namespace] = used
+	}
+	return keys, namespaces
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"github.com/google/logger"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Idle buckets are forgotten once they have refilled, at most this often, so that the limiter doesn't grow with every
+// address it has seen.
+const rateLimitPruneInterval = time.Minute
+
+// rateLimiter limits the requests of each client, e.g. an IP address or key, with a token bucket per client: each
+// request takes a token, and buckets refill at the limiter's rate up to its burst.
+type rateLimiter struct {
+	mutex   sync.Mutex
+	name    string
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+	clock   Clock
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// newRateLimiter returns a limiter allowing perMin requests a minute, and bursts of up to burst requests, or nil if
+// perMin is 0, which allows every request. The name describes the clients in the log, e.g. "ip".
+func newRateLimiter(name string, perMin uint, burst uint, clock Clock) *rateLimiter {
+	if perMin == 0 {
+		return nil
+	}
+	if burst == 0 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		name:    name,
+		rate:    float64(perMin) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		pruned:  clock.Now(),
+		clock:   clock,
+	}
+}
+
+// allow takes a token from the client's bucket, returning false and how long until there is one if it is empty.
+func (limiter *rateLimiter) allow(client string) (bool, time.Duration) {
+	if limiter == nil {
+		return true, 0
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := limiter.clock.Now()
+	if now.Sub(limiter.pruned) >= rateLimitPruneInterval {
+		limiter.prune(now)
+	}
+
+	bucket, ok := limiter.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: limiter.burst, updated: now}
+		limiter.buckets[client] = bucket
+	}
+	bucket.tokens = limiter.refilled(bucket, now)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / limiter.rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+func (limiter *rateLimiter) refilled(bucket *tokenBucket, now time.Time) float64 {
+	elapsed := now.Sub(bucket.updated).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(limiter.burst, bucket.tokens+elapsed*limiter.rate)
+}
+
+// prune forgets the buckets which have refilled, which behave the same as new ones.
+func (limiter *rateLimiter) prune(now time.Time) {
+	for client, bucket := range limiter.buckets {
+		if limiter.refilled(bucket, now) >= limiter.burst {
+			delete(limiter.buckets, client)
+		}
+	}
+	limiter.pruned = now
+}
+
+// rateLimited responds 429 with a Retry-After header if the client's limit is exhausted, returning whether it did.
+func rateLimited(w http.ResponseWriter, limiter *rateLimiter, client string) bool {
+	allowed, wait := limiter.allow(client)
+	if allowed {
+		return false
+	}
+
+	logger.Warningf("Rate limited requests of %s %s", limiter.name, client)
+	seconds := int64(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	w.WriteHeader(http.StatusTooManyRequests)
+	_, _ = fmt.Fprintf(w, "rate limited, retry in %d seconds", seconds)
+	return true
+}
+
+// remoteIP returns the IP address a request came from. Behind a reverse proxy this is the proxy's.
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// limitIP refuses requests from IP addresses which have exhausted their rate limit.
+func (handler *Handler) limitIP(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if rateLimited(w, handler.ipLimiter, remoteIP(req)) {
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
+
+// limitKey refuses authenticated requests of keys which have exhausted their rate limit.
+func (handler *Handler) limitKey(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if rateLimited(w, handler.keyLimiter, requestKeyName(req)) {
+			return
+		}
+
+		h(w, req)
+	}
+}
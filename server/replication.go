@@ -0,0 +1,512 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"dead-drop/lib"
+	"encoding/json"
+	"fmt"
+	"github.com/google/logger"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rolePrimary = "primary"
+const roleStandby = "standby"
+
+// A fenced server was a primary until a standby was promoted over it. It refuses client requests until an operator
+// restarts it as a standby of the new primary, so that two primaries never accept drops at once.
+const roleFenced = "fenced"
+
+const replicationTokenHeader = "X-Replication-Token"
+const epochHeader = "X-Dead-Drop-Epoch"
+const ownerHeader = "X-Dead-Drop-Owner"
+const namespaceHeader = "X-Dead-Drop-Namespace"
+const versionHeader = "X-Dead-Drop-Version"
+
+// The replication state is kept in the data directory, next to the objects it describes.
+const replicationStateName = ".replication"
+
+// replicationState is persisted across restarts. The epoch increases with every promotion, and is used to fence
+// primaries which were replaced while they were unreachable.
+type replicationState struct {
+	Epoch  uint64
+	Fenced bool
+}
+
+// replicatedObject is an entry of the primary's object listing.
+type replicatedObject struct {
+	Oid     string
+	Created time.Time
+	// TTL is how long after Created the object expires on the primary.
+	TTL time.Duration `json:",omitempty"`
+}
+
+// ReplicationStatus is served to operators and witnesses.
+type ReplicationStatus struct {
+	Role  string
+	Epoch uint64
+	// PrimaryLastSeen is when a standby last synced with its primary.
+	PrimaryLastSeen time.Time `json:",omitempty"`
+}
+
+type fencePayload struct {
+	Epoch uint64
+}
+
+// Replicator keeps a standby in sync with its primary, and promotes it when the primary fails.
+type Replicator struct {
+	lock            sync.RWMutex
+	role            string
+	state           replicationState
+	statePath       string
+	primaryLastSeen time.Time
+
+	db              *Database
+	auth            *Authenticator
+	token           string
+	primaryURL      string
+	interval        time.Duration
+	failoverTimeout time.Duration
+	witnessURLs     []string
+	httpClient      *http.Client
+}
+
+func newReplicator(
+	db *Database,
+	auth *Authenticator,
+	role string,
+	token string,
+	primaryURL string,
+	interval time.Duration,
+	failoverTimeout time.Duration,
+	witnessURLs []string,
+	caCertPath string,
+) (*Replicator, error) {
+	if role != rolePrimary && role != roleStandby {
+		return nil, fmt.Errorf("unknown replication role %s, expected %s or %s", role, rolePrimary, roleStandby)
+	}
+	if role == roleStandby && (primaryURL == "" || token == "") {
+		return nil, fmt.Errorf("a standby requires a primary url and a replication token")
+	}
+
+	httpClient, err := newReplicationClient(caCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load replication ca certificate: %v", err)
+	}
+
+	replicator := &Replicator{
+		role:            role,
+		statePath:       filepath.Join(db.dataDir, replicationStateName),
+		db:              db,
+		auth:            auth,
+		token:           token,
+		primaryURL:      primaryURL,
+		interval:        interval,
+		failoverTimeout: failoverTimeout,
+		witnessURLs:     witnessURLs,
+		httpClient:      httpClient,
+	}
+
+	if err := replicator.loadState(); err != nil {
+		return nil, fmt.Errorf("failed to load replication state: %v", err)
+	}
+
+	switch {
+	case role == rolePrimary && replicator.state.Fenced:
+		logger.Errorf("This server was fenced by a promoted standby, restart it as a standby of the new primary")
+		replicator.role = roleFenced
+	case role == roleStandby && replicator.state.Fenced:
+		replicator.state.Fenced = false
+		if err := replicator.saveState(); err != nil {
+			return nil, fmt.Errorf("failed to save replication state: %v", err)
+		}
+	}
+
+	logger.Infof("Starting replication as %s at epoch %d", replicator.role, replicator.state.Epoch)
+
+	if replicator.role == roleStandby {
+		go replicator.standbyJob()
+	}
+
+	return replicator, nil
+}
+
+func newReplicationClient(caCertPath string) (*http.Client, error) {
+	if caCertPath == "" {
+		return &http.Client{Timeout: time.Minute}, nil
+	}
+
+	caCert, err := ioutil.ReadFile(caCertPath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates found in %s", caCertPath)
+	}
+
+	return &http.Client{
+		Timeout:   time.Minute,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}, nil
+}
+
+// isActive reports whether this server should serve client requests.
+func (replicator *Replicator) isActive() bool {
+	replicator.lock.RLock()
+	defer replicator.lock.RUnlock()
+
+	return replicator.role == rolePrimary
+}
+
+func (replicator *Replicator) status() ReplicationStatus {
+	replicator.lock.RLock()
+	defer replicator.lock.RUnlock()
+
+	return ReplicationStatus{
+		Role:            replicator.role,
+		Epoch:           replicator.state.Epoch,
+		PrimaryLastSeen: replicator.primaryLastSeen,
+	}
+}
+
+func (replicator *Replicator) epoch() uint64 {
+	replicator.lock.RLock()
+	defer replicator.lock.RUnlock()
+
+	return replicator.state.Epoch
+}
+
+// promote makes a standby the primary, at an epoch above any primary it has seen, and fences the old primary.
+func (replicator *Replicator) promote() error {
+	replicator.lock.Lock()
+
+	if replicator.role != roleStandby {
+		replicator.lock.Unlock()
+		return fmt.Errorf("only a standby can be promoted, this server is %s", replicator.role)
+	}
+
+	replicator.state.Epoch++
+	if err := replicator.saveState(); err != nil {
+		replicator.state.Epoch--
+		replicator.lock.Unlock()
+		return err
+	}
+	replicator.role = rolePrimary
+	epoch := replicator.state.Epoch
+
+	replicator.lock.Unlock()
+
+	logger.Infof("Promoted to primary at epoch %d", epoch)
+
+	// The old primary is probably unreachable, but if it is only partitioned from this server, other standbys
+	// still syncing with it will fence it once they learn the new epoch.
+	go func() {
+		if err := replicator.fencePrimary(epoch); err != nil {
+			logger.Warningf("Failed to fence the old primary, make sure it stays down or is restarted as a standby: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// fence demotes this server if a higher epoch has been reached elsewhere.
+func (replicator *Replicator) fence(epoch uint64) {
+	replicator.lock.Lock()
+	defer replicator.lock.Unlock()
+
+	if epoch <= replicator.state.Epoch {
+		return
+	}
+
+	replicator.state.Epoch = epoch
+	if replicator.role == rolePrimary {
+		replicator.role = roleFenced
+		replicator.state.Fenced = true
+		logger.Errorf("Fenced by a primary at epoch %d, refusing client requests", epoch)
+	}
+	if err := replicator.saveState(); err != nil {
+		logger.Errorf("Failed to save replication state: %v", err)
+	}
+}
+
+func (replicator *Replicator) standbyJob() {
+	replicator.lock.Lock()
+	replicator.primaryLastSeen = replicator.db.clock.Now()
+	replicator.lock.Unlock()
+
+	for {
+		replicator.db.clock.Sleep(replicator.interval)
+
+		replicator.lock.RLock()
+		role := replicator.role
+		lastSeen := replicator.primaryLastSeen
+		replicator.lock.RUnlock()
+
+		if role != roleStandby {
+			return
+		}
+
+		if err := replicator.sync(); err != nil {
+			logger.Warningf("Failed to sync with primary: %v", err)
+		} else {
+			replicator.lock.Lock()
+			replicator.primaryLastSeen = replicator.db.clock.Now()
+			replicator.lock.Unlock()
+			continue
+		}
+
+		if replicator.failoverTimeout > 0 && replicator.db.clock.Now().Sub(lastSeen) > replicator.failoverTimeout {
+			if !replicator.witnessesAgree() {
+				logger.Warningf("Primary unreachable, but witnesses do not agree that it is down")
+				continue
+			}
+			if err := replicator.promote(); err != nil {
+				logger.Errorf("Failed to promote to primary: %v", err)
+			}
+		}
+	}
+}
+
+// witnessesAgree reports whether a majority of this standby and its witnesses (other standbys of the same primary)
+// have lost contact with the primary, so that a standby which is merely partitioned from the primary doesn't promote itself.
+func (replicator *Replicator) witnessesAgree() bool {
+	agree := 1
+	for _, witnessURL := range replicator.witnessURLs {
+		status := ReplicationStatus{}
+		if _, err := replicator.getJSON(witnessURL, "/replication/status", &status); err != nil {
+			logger.Warningf("Failed to reach witness %s: %v", witnessURL, err)
+			continue
+		}
+
+		if status.Role == rolePrimary && status.Epoch > replicator.epoch() {
+			// Another standby already won, so follow it rather than racing it.
+			replicator.fence(status.Epoch)
+			return false
+		}
+		if status.Role == roleStandby && replicator.db.clock.Now().Sub(status.PrimaryLastSeen) > replicator.failoverTimeout {
+			agree++
+		}
+	}
+
+	return agree > (len(replicator.witnessURLs)+1)/2
+}
+
+// sync copies new objects and keys from the primary, and removes objects and keys the primary no longer has.
+func (replicator *Replicator) sync() error {
+	objects := make([]replicatedObject, 0)
+	epoch, err := replicator.getJSON(replicator.primaryURL, "/replication/objects", &objects)
+	if err != nil {
+		return err
+	}
+	if epoch < replicator.epoch() {
+		return fmt.Errorf("primary is at epoch %d, behind this server", epoch)
+	}
+
+	keys := make(map[string][]byte)
+	if _, err := replicator.getJSON(replicator.primaryURL, "/replication/keys", &keys); err != nil {
+		return err
+	}
+	for keyName, key := range keys {
+		if !keyNameRegex.MatchString(keyName) {
+			continue
+		}
+		if existing, err := replicator.auth.getAuthorizedKey(keyName); err == nil && bytes.Equal(existing, key) {
+			continue
+		}
+		if err := replicator.auth.addAuthorizedKey(key, keyName); err != nil {
+			return fmt.Errorf("failed to store authorized key %s: %v", keyName, err)
+		}
+	}
+	if err := replicator.syncKeyAttributes(keys, "/replication/key-roles", keyRoleAttribute); err != nil {
+		return err
+	}
+	if err := replicator.syncKeyAttributes(keys, "/replication/key-namespaces", keyNamespaceAttribute); err != nil {
+		return err
+	}
+	if err := replicator.syncKeyAttributes(keys, "/replication/key-checkins", keyCheckinAttribute); err != nil {
+		return err
+	}
+	existingKeys, err := replicator.auth.authorizedKeys()
+	if err != nil {
+		return fmt.Errorf("failed to list authorized keys: %v", err)
+	}
+	for keyName := range existingKeys {
+		if _, ok := keys[keyName]; ok {
+			continue
+		}
+		removed, err := replicator.auth.removeAuthorizedKey(keyName)
+		if err != nil && err != LastKeyErr {
+			return fmt.Errorf("failed to remove authorized key %s: %v", keyName, err)
+		}
+		if removed {
+			logger.Infof("Removed authorized key %s, which was removed from the primary", keyName)
+			if err := replicator.db.disownObjects(keyName); err != nil {
+				return fmt.Errorf("failed to disown the objects of removed key %s: %v", keyName, err)
+			}
+		}
+	}
+
+	onPrimary := make(map[string]bool)
+	for _, object := range objects {
+		onPrimary[object.Oid] = true
+		if replicator.db.hasObject(object.Oid) {
+			continue
+		}
+
+		if err := replicator.fetchObject(object); err != nil {
+			return err
+		}
+	}
+
+	for _, oi := range replicator.db.objects() {
+		if !onPrimary[oi.oid] {
+			replicator.db.destroyObject(oi.oid)
+		}
+	}
+
+	return nil
+}
+
+// syncKeyAttributes copies an attribute of the given keys, such as their role, from the primary.
+func (replicator *Replicator) syncKeyAttributes(keys map[string][]byte, path string, attribute string) error {
+	values := make(map[string]string)
+	if _, err := replicator.getJSON(replicator.primaryURL, path, &values); err != nil {
+		return err
+	}
+	existing, err := replicator.auth.keyAttributes(attribute)
+	if err != nil {
+		return fmt.Errorf("failed to list key attribute %s: %v", attribute, err)
+	}
+	for keyName := range keys {
+		if !keyNameRegex.MatchString(keyName) || existing[keyName] == values[keyName] {
+			continue
+		}
+		if err := replicator.auth.setKeyAttribute(keyName, attribute, values[keyName]); err != nil {
+			return fmt.Errorf("failed to store attribute %s of authorized key %s: %v", attribute, keyName, err)
+		}
+	}
+	return nil
+}
+
+func (replicator *Replicator) fetchObject(object replicatedObject) error {
+	resp, err := replicator.request("GET", replicator.primaryURL, "/replication/objects/"+object.Oid, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		// Pulled or expired since the listing.
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching object %s failed with status: %s", object.Oid, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	policy := dropPolicy{ttl: object.TTL}
+	policy.maxPulls, _ = strconv.Atoi(resp.Header.Get(lib.MaxPullsHeader))
+	if rawLabels := resp.Header.Get(lib.LabelsHeader); rawLabels != "" {
+		policy.labels, _ = lib.ParseLabels(rawLabels)
+	}
+	if alias := resp.Header.Get(lib.AliasHeader); lib.CheckAlias(alias) == nil {
+		policy.alias = alias
+		policy.version, _ = strconv.Atoi(resp.Header.Get(versionHeader))
+	}
+	if rawReleaseTo := resp.Header.Get(lib.ReleaseToHeader); rawReleaseTo != "" {
+		seconds, _ := strconv.ParseInt(resp.Header.Get(lib.CheckinIntervalHeader), 10, 64)
+		policy.releaseTo = strings.Split(rawReleaseTo, ",")
+		policy.checkinInterval = time.Duration(seconds) * time.Second
+	}
+	if rawReleaseAt := resp.Header.Get(lib.ReleaseAtHeader); rawReleaseAt != "" {
+		policy.releaseAt, _ = time.Parse(time.RFC3339Nano, rawReleaseAt)
+	}
+	policy.canary = resp.Header.Get(lib.CanaryHeader) == "true"
+	replicator.db.insert(object.Oid, data, resp.Header.Get(ownerHeader), resp.Header.Get(namespaceHeader), object.Created,
+		policy)
+	return nil
+}
+
+func (replicator *Replicator) fencePrimary(epoch uint64) error {
+	body, err := json.Marshal(fencePayload{Epoch: epoch})
+	if err != nil {
+		return err
+	}
+
+	resp, err := replicator.request("POST", replicator.primaryURL, "/replication/fence", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("response status: %s", resp.Status)
+	}
+	return nil
+}
+
+// getJSON decodes a replication response, returning the epoch of the server which sent it.
+func (replicator *Replicator) getJSON(baseURL string, path string, v interface{}) (uint64, error) {
+	resp, err := replicator.request("GET", baseURL, path, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("response status: %s", resp.Status)
+	}
+
+	epoch, _ := strconv.ParseUint(resp.Header.Get(epochHeader), 10, 64)
+	replicator.fence(epoch)
+
+	return epoch, json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (replicator *Replicator) request(method string, baseURL string, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(replicationTokenHeader, replicator.token)
+	req.Header.Set(epochHeader, strconv.FormatUint(replicator.epoch(), 10))
+
+	return replicator.httpClient.Do(req)
+}
+
+func (replicator *Replicator) loadState() error {
+	data, err := ioutil.ReadFile(replicator.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &replicator.state)
+}
+
+func (replicator *Replicator) saveState() error {
+	data, err := json.Marshal(replicator.state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(replicator.statePath, data, lib.ObjectPerms)
+}
+
+// validToken checks a replication token in constant time. Replication is disabled if no token is configured.
+func (replicator *Replicator) validToken(token string) bool {
+	return replicator.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(replicator.token)) == 1
+}
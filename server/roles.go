@@ -0,0 +1,72 @@
+package server
+
+import (
+	"dead-drop/lib"
+	"fmt"
+	"github.com/google/logger"
+	"net/http"
+)
+
+// Permissions which endpoints require of the role of the key a request is made with.
+const permissionRead = "read"
+const permissionWrite = "write"
+const permissionAdmin = "admin"
+
+// The role of an authorized key is kept in an attribute of this name, unless the key has the default role.
+const keyRoleAttribute = "role"
+
+// keyRoleContextKey holds the role of the key an authenticated request was made with.
+const keyRoleContextKey = contextKey("key-role")
+
+func validKeyRole(role string) bool {
+	return role == lib.KeyRoleReadOnly || role == lib.KeyRoleWriteOnly || role == lib.KeyRoleAdmin
+}
+
+// keyRoleAllows returns whether keys of a role have a permission.
+func keyRoleAllows(role string, permission string) bool {
+	switch role {
+	case lib.KeyRoleAdmin:
+		return true
+	case lib.KeyRoleReadOnly:
+		return permission == permissionRead
+	case lib.KeyRoleWriteOnly:
+		return permission == permissionWrite
+	}
+	return false
+}
+
+func requestKeyRole(req *http.Request) string {
+	role, _ := req.Context().Value(keyRoleContextKey).(string)
+	return role
+}
+
+// requireRole refuses authenticated requests made with keys whose role doesn't have the permission.
+func (handler *Handler) requireRole(permission string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		keyName, role := requestKeyName(req), requestKeyRole(req)
+		if !keyRoleAllows(role, permission) {
+			logger.Warningf("Refused %s request of %s key %s", permission, role, keyName)
+			handler.audit(req, auditAuthFailure, keyName, "", fmt.Sprintf("%s key refused %s permission", role, permission))
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = fmt.Fprintf(w, "key %s has the %s role, which doesn't have %s permission", keyName, role, permission)
+			return
+		}
+
+		h(w, req)
+	}
+}
+
+// keyRole returns the role of an authorized key: the one it was added with, or else the default role.
+func (auth *Authenticator) keyRole(keyName string) (string, error) {
+	return auth.keyAttribute(keyName, keyRoleAttribute, auth.defaultKeyRole)
+}
+
+// setKeyRole sets the role of an authorized key, or gives it the default role if role is empty.
+func (auth *Authenticator) setKeyRole(keyName string, role string) error {
+	return auth.setKeyAttribute(keyName, keyRoleAttribute, role)
+}
+
+// keyRoles returns the roles keys were added with by name, for replication. Keys with the default role are left out.
+func (auth *Authenticator) keyRoles() (map[string]string, error) {
+	return auth.keyAttributes(keyRoleAttribute)
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"dead-drop/lib"
+	"fmt"
+	"github.com/google/logger"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+)
+
+// Oids are far shorter than this, which bounds what a token request can make the server sign.
+const maxTokenOidLen = 128
+
+// tokenScopeContextKey and tokenOidContextKey hold the scope and object the token of an authenticated request was
+// limited to, which are empty for unscoped tokens.
+const tokenScopeContextKey = contextKey("token-scope")
+const tokenOidContextKey = contextKey("token-oid")
+
+// scopePermission returns the permission a token scope is limited to, or "" if the scope is unknown.
+func scopePermission(scope string) string {
+	switch scope {
+	case lib.TokenScopePull:
+		return permissionRead
+	case lib.TokenScopeDrop:
+		return permissionWrite
+	case lib.TokenScopeAdmin:
+		return permissionAdmin
+	}
+	return ""
+}
+
+func requestTokenScope(req *http.Request) (string, string) {
+	scope, _ := req.Context().Value(tokenScopeContextKey).(string)
+	oid, _ := req.Context().Value(tokenOidContextKey).(string)
+	return scope, oid
+}
+
+// requireScope refuses authenticated requests whose token is scoped to another permission, or to another object.
+// Requests which aren't about an object are refused to tokens scoped to one.
+func (handler *Handler) requireScope(permission string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		keyName := requestKeyName(req)
+		scope, oid := requestTokenScope(req)
+		if scope != "" && scopePermission(scope) != permission {
+			logger.Warningf("Refused %s request of key %s with a %s token", permission, keyName, scope)
+			handler.audit(req, auditAuthFailure, keyName, "", fmt.Sprintf("%s token refused %s permission", scope, permission))
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = fmt.Fprintf(w, "token is scoped to %s, which doesn't have %s permission", scope, permission)
+			return
+		}
+		if requested := mux.Vars(req)["oid"]; oid != "" && requested != oid {
+			logger.Warningf("Refused request of key %s with a token for another object", keyName)
+			handler.audit(req, auditAuthFailure, keyName, requested, "token scoped to another object")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = io.WriteString(w, "token is scoped to another object")
+			return
+		}
+
+		h(w, req)
+	}
+}
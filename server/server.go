@@ -1,28 +1,109 @@
-package main
+package server
 
 import (
+	"context"
 	"crypto/tls"
 	"dead-drop/lib"
+	"fmt"
 	"github.com/google/logger"
 	"github.com/gorilla/mux"
 	"github.com/mitchellh/go-homedir"
-	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/urfave/negroni"
+	"google.golang.org/grpc"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 const ttlMinFlag = "ttl-min"
+const expiryIntervalSecFlag = "expiry-interval-sec"
 const dataDirFlag = "data-dir"
 const keysDirFlag = "keys-dir"
 const addrFlag = "addr"
 const destructiveReadFlag = "destructive-read"
 const tlsCertFlag = "tls-cert"
 const tlsKeyFlag = "tls-key"
-
-var confFile string
+const accessLogRetentionMinFlag = "access-log-retention-min"
+const accessLogRequestersFlag = "access-log-requesters"
+const roleFlag = "role"
+const replicationTokenFlag = "replication-token"
+const primaryURLFlag = "primary-url"
+const replicationIntervalSecFlag = "replication-interval-sec"
+const failoverTimeoutSecFlag = "failover-timeout-sec"
+const witnessURLsFlag = "witness-urls"
+const replicationCACertFlag = "replication-ca-cert"
+const adminTokenFlag = "admin-token"
+const inlineThresholdBytesFlag = "inline-threshold-bytes"
+const clockMaxJumpSecFlag = "clock-max-jump-sec"
+const ntpServerFlag = "ntp-server"
+const ntpMaxOffsetSecFlag = "ntp-max-offset-sec"
+const tokenTTLSecFlag = "token-ttl-sec"
+const storageFlag = "storage"
+const storageConnectTimeoutSecFlag = "storage-connect-timeout-sec"
+const storageTLSTimeoutSecFlag = "storage-tls-timeout-sec"
+const storageResponseTimeoutSecFlag = "storage-response-timeout-sec"
+const s3EndpointFlag = "s3-endpoint"
+const s3RegionFlag = "s3-region"
+const s3BucketFlag = "s3-bucket"
+const s3PrefixFlag = "s3-prefix"
+const s3AccessKeyFlag = "s3-access-key"
+const s3SecretKeyFlag = "s3-secret-key"
+const s3PathStyleFlag = "s3-path-style"
+const gcsEndpointFlag = "gcs-endpoint"
+const gcsBucketFlag = "gcs-bucket"
+const gcsPrefixFlag = "gcs-prefix"
+const gcsCredentialsFlag = "gcs-credentials"
+const gcsStorageClassFlag = "gcs-storage-class"
+const azureAccountFlag = "azure-account"
+const azureEndpointFlag = "azure-endpoint"
+const azureContainerFlag = "azure-container"
+const azurePrefixFlag = "azure-prefix"
+const azureSASTokenFlag = "azure-sas-token"
+const azureClientIDFlag = "azure-client-id"
+const azureAccessTierFlag = "azure-access-tier"
+const metaStoreFlag = "meta-store"
+const metaStoreDSNFlag = "meta-store-dsn"
+const quotaBytesFlag = "quota-bytes"
+const keyQuotasFlag = "key-quotas"
+const namespaceQuotasFlag = "namespace-quotas"
+const rateLimitIPPerMinFlag = "rate-limit-ip-per-min"
+const rateLimitIPBurstFlag = "rate-limit-ip-burst"
+const rateLimitKeyPerMinFlag = "rate-limit-key-per-min"
+const rateLimitKeyBurstFlag = "rate-limit-key-burst"
+const auditLogFlag = "audit-log"
+const auditLogMaxMBFlag = "audit-log-max-mb"
+const auditLogBackupsFlag = "audit-log-backups"
+const shutdownGraceSecFlag = "shutdown-grace-sec"
+const defaultKeyRoleFlag = "default-key-role"
+const legacyTokenRequestsFlag = "legacy-token-requests"
+const shareKeyFlag = "share-key"
+const anonymousDropsFlag = "anonymous-drops"
+const anonymousDropMaxBytesFlag = "anonymous-drop-max-bytes"
+const anonymousDropsPerMinFlag = "anonymous-drops-per-min"
+const anonymousDropNamespaceFlag = "anonymous-drop-namespace"
+const anonymousQuotaBytesFlag = "anonymous-quota-bytes"
+const webUIFlag = "web-ui"
+const webhookURLsFlag = "webhook-urls"
+const webhookSecretFlag = "webhook-secret"
+const webhookEventsFlag = "webhook-events"
+const webhookTimeoutSecFlag = "webhook-timeout-sec"
+const canarySMTPAddrFlag = "canary-smtp-addr"
+const canarySMTPUsernameFlag = "canary-smtp-username"
+const canarySMTPPasswordFlag = "canary-smtp-password"
+const canaryEmailFromFlag = "canary-email-from"
+const canaryEmailToFlag = "canary-email-to"
+const grpcAddrFlag = "grpc-addr"
+const oidModeFlag = "oid-mode"
+const oidAlphabetFlag = "oid-alphabet"
+const oidLengthFlag = "oid-length"
+const aliasVersionsFlag = "alias-versions"
+const atRestKeyFlag = "at-rest-key"
+const atRestKMSFlag = "at-rest-kms"
 
 type Error string
 
@@ -30,108 +111,626 @@ func (e Error) Error() string {
 	return string(e)
 }
 
-func main() {
-	showGreeting()
-	log := logger.Init("Logger", true, true, ioutil.Discard)
-	defer log.Close()
+// Config configures a server, e.g. one embedded in another program.
+type Config struct {
+	// Settings are named as in the config file, e.g. "data-dir", and take their defaults when left out.
+	Settings map[string]interface{}
+	// Store and Metas keep the data and metadata of objects, instead of those configured by the storage and meta-store
+	// settings.
+	Store ObjectStore
+	Metas MetaStore
+	// Keys keeps the authorized keys, instead of the keys-dir setting.
+	Keys KeyStore
+	// Clock is the source of time, which defaults to the system clock.
+	Clock Clock
+}
 
-	cobra.OnInitialize(loadConfig)
+// Server serves a dead-drop endpoint, either on its own addresses with ListenAndServe, or as part of another http
+// server with Handler.
+type Server struct {
+	settings *viper.Viper
+	handler  *Handler
+	router   http.Handler
+	// err is the error the server was configured with, if any, which ListenAndServe and Handler return.
+	err error
 
-	var rootCmd = &cobra.Command{
-		Use: "deadd",
-		Run: func(cmd *cobra.Command, args []string) {
-			startServer()
-		},
+	lock      sync.Mutex
+	server    *http.Server
+	rpcServer *grpc.Server
+	shutdown  bool
+}
+
+// New returns a server with a config, starting its database and background jobs. Invalid configs are reported by
+// ListenAndServe and Handler.
+func New(config Config) *Server {
+	settings := newSettings(config.Settings)
+	handler, err := newHandler(settings, config)
+	if err != nil {
+		return &Server{settings: settings, err: err}
+	}
+	return &Server{settings: settings, handler: handler, router: handler.router(settings)}
+}
+
+// newSettings returns the defaults of every setting, overridden by values.
+func newSettings(values map[string]interface{}) *viper.Viper {
+	settings := viper.New()
+	settings.SetDefault(addrFlag, ":4444")
+	settings.SetDefault(dataDirFlag, "~/dead-drop")
+	settings.SetDefault(keysDirFlag, filepath.Join("~", lib.DefaultConfigDir, "keys"))
+	settings.SetDefault(ttlMinFlag, 1440)
+	settings.SetDefault(expiryIntervalSecFlag, 60)
+	settings.SetDefault(destructiveReadFlag, true)
+	settings.SetDefault(accessLogRetentionMinFlag, 10080)
+	settings.SetDefault(accessLogRequestersFlag, true)
+	settings.SetDefault(inlineThresholdBytesFlag, 4096)
+	settings.SetDefault(oidModeFlag, oidModeRandom)
+	settings.SetDefault(oidAlphabetFlag, oidAlphabetLetters)
+	settings.SetDefault(oidLengthFlag, 0)
+	settings.SetDefault(aliasVersionsFlag, 0)
+	settings.SetDefault(clockMaxJumpSecFlag, 300)
+	settings.SetDefault(ntpMaxOffsetSecFlag, 60)
+	settings.SetDefault(tokenTTLSecFlag, 10)
+	settings.SetDefault(shutdownGraceSecFlag, 30)
+	settings.SetDefault(defaultKeyRoleFlag, lib.KeyRoleAdmin)
+	settings.SetDefault(anonymousDropMaxBytesFlag, 10*1024*1024)
+	settings.SetDefault(anonymousDropsPerMinFlag, 10)
+	settings.SetDefault(webhookTimeoutSecFlag, 10)
+	settings.SetDefault(auditLogMaxMBFlag, 100)
+	settings.SetDefault(auditLogBackupsFlag, 10)
+	settings.SetDefault(storageFlag, storageFile)
+	settings.SetDefault(storageConnectTimeoutSecFlag, 30)
+	settings.SetDefault(storageTLSTimeoutSecFlag, 15)
+	settings.SetDefault(storageResponseTimeoutSecFlag, 60)
+	settings.SetDefault(metaStoreFlag, metaStoreSQLite)
+	settings.SetDefault(s3RegionFlag, "us-east-1")
+	settings.SetDefault(roleFlag, rolePrimary)
+	settings.SetDefault(replicationIntervalSecFlag, 5)
+	settings.SetDefault(failoverTimeoutSecFlag, 0)
+	settings.SetDefault(tlsCertFlag, filepath.Join("~", lib.DefaultConfigDir, "server.crt"))
+	settings.SetDefault(tlsKeyFlag, filepath.Join("~", lib.DefaultConfigDir, "server.key"))
+
+	for name, value := range values {
+		settings.Set(name, value)
+	}
+	return settings
+}
+
+// PromoteStandby asks a standby to promote itself, using the replication settings of a config.
+func PromoteStandby(config Config, standbyURL string) error {
+	settings := newSettings(config.Settings)
+	caCert, err := expandPath(settings.GetString(replicationCACertFlag))
+	if err != nil {
+		return err
+	}
+	httpClient, err := newReplicationClient(caCert)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(standbyURL, "/")+"/replication/promote", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(replicationTokenHeader, settings.GetString(replicationTokenFlag))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
 	}
-	rootCmd.PersistentFlags().StringVar(&confFile, "config", "",
-		"config file (default is "+filepath.Join("~", lib.DefaultConfigDir, lib.DefaultConfigName)+".yml)")
+	defer resp.Body.Close()
 
-	if err := rootCmd.Execute(); err != nil {
-		logger.Fatalf("Failed to execute command: %v", err)
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("response status: %s %s", resp.Status, message)
 	}
+	return nil
 }
 
-func showGreeting() {
+// Greeting returns the banner servers show when they start, or "" if it isn't available.
+func Greeting() string {
 	data, err := Asset("data/greeting.txt")
 	if err != nil {
-		return
+		return ""
 	}
+	return string(data)
+}
 
-	println(string(data))
+func expiryInterval(settings *viper.Viper) (time.Duration, error) {
+	interval := time.Duration(settings.GetUint(expiryIntervalSecFlag)) * time.Second
+	if interval <= 0 {
+		return 0, fmt.Errorf("invalid %s, which must be at least 1", expiryIntervalSecFlag)
+	}
+	return interval, nil
 }
 
-func loadConfig() {
-	if confFile != "" {
-		viper.SetConfigFile(confFile)
-		logger.Infof("Loading configuration from %s", confFile)
-	} else {
-		dir := filepath.Join("$HOME", lib.DefaultConfigDir)
-		viper.AddConfigPath(dir)
-		viper.SetConfigName(lib.DefaultConfigName)
-		viper.SetConfigType(lib.DefaultConfigType)
-		logger.Infof(
-			"Searching for configuration at %s.%s\n",
-			filepath.Join(dir, lib.DefaultConfigName),
-			lib.DefaultConfigType,
-		)
+// newObjectStore returns the configured object store, or nil to store objects in the data directory.
+// Credentials fall back to the standard AWS, Google and Azure environment variables.
+func newObjectStore(settings *viper.Viper) (objectStore, error) {
+	switch storage := settings.GetString(storageFlag); storage {
+	case storageFile, "":
+		return nil, nil
+	case storageS3:
+		config := s3Config{
+			Endpoint:     settings.GetString(s3EndpointFlag),
+			Region:       settings.GetString(s3RegionFlag),
+			Bucket:       settings.GetString(s3BucketFlag),
+			Prefix:       settings.GetString(s3PrefixFlag),
+			AccessKey:    settings.GetString(s3AccessKeyFlag),
+			SecretKey:    settings.GetString(s3SecretKeyFlag),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			PathStyle:    settings.GetBool(s3PathStyleFlag),
+			Timeouts:     storageTimeoutsFromConfig(settings),
+		}
+		if config.AccessKey == "" && config.SecretKey == "" {
+			config.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+			config.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		}
+
+		store, err := newS3Store(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure s3 storage: %v", err)
+		}
+		return store, nil
+	case storageGCS:
+		credentials, err := expandPath(settings.GetString(gcsCredentialsFlag))
+		if err != nil {
+			return nil, err
+		}
+		config := gcsConfig{
+			Endpoint:     settings.GetString(gcsEndpointFlag),
+			Bucket:       settings.GetString(gcsBucketFlag),
+			Prefix:       settings.GetString(gcsPrefixFlag),
+			Credentials:  credentials,
+			StorageClass: settings.GetString(gcsStorageClassFlag),
+			Timeouts:     storageTimeoutsFromConfig(settings),
+		}
+		if config.Credentials == "" {
+			config.Credentials = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+		}
+
+		store, err := newGCSStore(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure gcs storage: %v", err)
+		}
+		return store, nil
+	case storageAzure:
+		config := azureConfig{
+			Endpoint:   settings.GetString(azureEndpointFlag),
+			Container:  settings.GetString(azureContainerFlag),
+			Prefix:     settings.GetString(azurePrefixFlag),
+			SASToken:   settings.GetString(azureSASTokenFlag),
+			ClientID:   settings.GetString(azureClientIDFlag),
+			AccessTier: settings.GetString(azureAccessTierFlag),
+			Timeouts:   storageTimeoutsFromConfig(settings),
+		}
+		if config.Endpoint == "" && settings.GetString(azureAccountFlag) != "" {
+			config.Endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", settings.GetString(azureAccountFlag))
+		}
+		if config.SASToken == "" {
+			config.SASToken = os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+		}
+		if config.ClientID == "" {
+			config.ClientID = os.Getenv("AZURE_CLIENT_ID")
+		}
+
+		store, err := newAzureStore(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure azure storage: %v", err)
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown storage '%s', which must be %s, %s, %s or %s",
+			storage, storageFile, storageS3, storageGCS, storageAzure)
 	}
+}
 
-	viper.SetDefault(addrFlag, ":4444")
-	viper.SetDefault(dataDirFlag, "~/dead-drop")
-	viper.SetDefault(keysDirFlag, filepath.Join("~", lib.DefaultConfigDir, "keys"))
-	viper.SetDefault(ttlMinFlag, 1440)
-	viper.SetDefault(destructiveReadFlag, true)
-	viper.SetDefault(tlsCertFlag, filepath.Join("~", lib.DefaultConfigDir, "server.crt"))
-	viper.SetDefault(tlsKeyFlag, filepath.Join("~", lib.DefaultConfigDir, "server.key"))
+// storageTimeoutsFromConfig returns the configured timeouts of requests to cloud object stores.
+func storageTimeoutsFromConfig(settings *viper.Viper) storageTimeouts {
+	return storageTimeouts{
+		Dial:           time.Duration(settings.GetUint(storageConnectTimeoutSecFlag)) * time.Second,
+		TLSHandshake:   time.Duration(settings.GetUint(storageTLSTimeoutSecFlag)) * time.Second,
+		ResponseHeader: time.Duration(settings.GetUint(storageResponseTimeoutSecFlag)) * time.Second,
+	}
+}
+
+// newMetaStore returns the configured metadata store, or nil to store metadata in the data directory.
+// SQLite databases default to a file in the data directory. Metadata kept in the data directory by a server which
+// used to store it there is imported into the database.
+func newMetaStore(settings *viper.Viper) (metaStore, error) {
+	kind := settings.GetString(metaStoreFlag)
+	if kind == metaStoreFile {
+		return nil, nil
+	}
 
-	err := viper.ReadInConfig()
+	dataDir, err := expandPath(settings.GetString(dataDirFlag))
 	if err != nil {
-		switch err.(type) {
-		case viper.ConfigFileNotFoundError:
-			logger.Info("No config file found, using the default configuration")
-			break
-		default:
-			logger.Warningf("Failed to load config file: %v", err)
+		return nil, err
+	}
+	dsn := settings.GetString(metaStoreDSNFlag)
+	if kind == metaStoreSQLite {
+		if dsn == "" {
+			dsn = filepath.Join(dataDir, "meta.db")
+		}
+		if dsn, err = expandPath(dsn); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(dsn), 0770); err != nil {
+			return nil, fmt.Errorf("failed to create the directory of the metadata database: %v", err)
 		}
-	} else {
-		logger.Infof("Successfully loaded configuration")
 	}
+
+	store, err := newSQLMetaStore(kind, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s metadata store: %v", kind, err)
+	}
+	if err := importFileMeta(filepath.Join(dataDir, metaDirName), store); err != nil {
+		return nil, fmt.Errorf("failed to import metadata into %s: %v", store, err)
+	}
+	return store, nil
+}
+
+// newQuotasFromConfig returns the configured quotas: quota-bytes for every key, except those given their own in
+// key-quotas, and namespace-quotas for namespaces.
+func newQuotasFromConfig(settings *viper.Viper) (*quotas, error) {
+	keyLimits, err := parseKeyQuotas(settings.GetStringSlice(keyQuotasFlag))
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure quotas: %v", err)
+	}
+	namespaceLimits, err := parseNamespaceQuotas(settings.GetStringSlice(namespaceQuotasFlag))
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure quotas: %v", err)
+	}
+	// Objects of no key, which anonymous drops are, are limited by the key quota of no name.
+	if anonymousQuota := settings.GetInt64(anonymousQuotaBytesFlag); anonymousQuota > 0 {
+		keyLimits[""] = anonymousQuota
+	}
+	return newQuotas(settings.GetInt64(quotaBytesFlag), keyLimits, namespaceLimits), nil
+}
+
+// newAnonymousDropsFromConfig returns the configuration of anonymous drops, or nil if they are disabled.
+func newAnonymousDropsFromConfig(settings *viper.Viper, clock Clock) (*anonymousDrops, error) {
+	if !settings.GetBool(anonymousDropsFlag) {
+		return nil, nil
+	}
+
+	namespace := settings.GetString(anonymousDropNamespaceFlag)
+	if namespace != "" && !namespaceRegex.MatchString(namespace) {
+		return nil, fmt.Errorf("invalid %s '%s'", anonymousDropNamespaceFlag, namespace)
+	}
+	maxBytes := settings.GetInt64(anonymousDropMaxBytesFlag)
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("invalid %s %d, which must be positive", anonymousDropMaxBytesFlag, maxBytes)
+	}
+	perMin := settings.GetUint(anonymousDropsPerMinFlag)
+	logger.Infof("Accepting anonymous drops of up to %d bytes into namespace '%s'", maxBytes, namespace)
+	return &anonymousDrops{
+		maxBytes:  maxBytes,
+		namespace: namespace,
+		limiter:   newRateLimiter("anonymous drop ip", perMin, perMin, clock),
+	}, nil
+}
+
+// newAuditLogFromConfig opens the configured audit log, or returns nil if there is none.
+func newAuditLogFromConfig(settings *viper.Viper, clock Clock) (*auditLog, error) {
+	path, err := expandPath(settings.GetString(auditLogFlag))
+	if err != nil {
+		return nil, err
+	}
+	audit, err := newAuditLog(
+		path,
+		int64(settings.GetUint(auditLogMaxMBFlag))*1024*1024,
+		settings.GetInt(auditLogBackupsFlag),
+		clock,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	return audit, nil
+}
+
+// newWebhooksFromConfig starts sending the configured webhooks, or returns nil if there are none.
+func newWebhooksFromConfig(settings *viper.Viper, clock Clock) (*webhooks, error) {
+	hooks, err := newWebhooks(
+		settings.GetStringSlice(webhookURLsFlag),
+		settings.GetString(webhookSecretFlag),
+		settings.GetStringSlice(webhookEventsFlag),
+		time.Duration(settings.GetUint(webhookTimeoutSecFlag))*time.Second,
+		clock,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure webhooks: %v", err)
+	}
+	return hooks, nil
+}
+
+// newCanaryMailerFromConfig starts emailing canary alerts, or returns nil if they aren't emailed.
+func newCanaryMailerFromConfig(settings *viper.Viper) (*canaryMailer, error) {
+	mailer, err := newCanaryMailer(
+		settings.GetString(canarySMTPAddrFlag),
+		settings.GetString(canarySMTPUsernameFlag),
+		settings.GetString(canarySMTPPasswordFlag),
+		settings.GetString(canaryEmailFromFlag),
+		settings.GetStringSlice(canaryEmailToFlag),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure canary emails: %v", err)
+	}
+	return mailer, nil
 }
 
-func startServer() {
-	db := initDatabase(viper.GetString(dataDirFlag), viper.GetUint(ttlMinFlag), viper.GetBool(destructiveReadFlag))
-	auth := newAuthenticator(viper.GetString(keysDirFlag))
-	handler := &Handler{db, auth}
+func newOidSchemeFromConfig(settings *viper.Viper) (*oidScheme, error) {
+	oids, err := newOidScheme(
+		settings.GetString(oidModeFlag),
+		settings.GetString(oidAlphabetFlag),
+		settings.GetInt(oidLengthFlag),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure oids: %v", err)
+	}
+	return oids, nil
+}
+
+func expandPath(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	expanded, err := homedir.Expand(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to expand path %s: %v", path, err)
+	}
+	return expanded, nil
+}
+
+// clientRoutes registers the endpoints of clients on a router.
+func (handler *Handler) clientRoutes(router *mux.Router) {
+	router.Handle("/d/{oid}", handler.client(permissionRead, handler.handlePull)).Methods("GET")
+	router.Handle("/d/{oid}", handler.client(permissionWrite, handler.handleRemove)).Methods("DELETE")
+	router.Handle("/d/{oid}", handler.client(permissionRead, handler.handleStat)).Methods("HEAD")
+	router.Handle("/d/{oid}/stat", handler.client(permissionRead, handler.handleStat)).Methods("GET")
+	router.Handle("/d/{oid}/checksum", handler.client(permissionRead, handler.handleChecksum)).Methods("GET")
+	router.Handle("/d/{oid}/access-log", handler.client(permissionWrite, handler.handleAccessLog)).Methods("GET")
+	router.Handle("/d/{oid}/share", handler.client(permissionWrite, handler.handleShare)).Methods("POST")
+	router.Handle("/d", handler.limitIP(handler.client(permissionWrite, handler.limitKey(handler.handleDrop)))).Methods("POST")
+	router.Handle("/d", handler.limitIP(handler.client(permissionWrite, handler.limitKey(handler.handleList)))).Methods("GET")
+	router.Handle("/alias/{alias}", handler.client(permissionRead, handler.handleAlias)).Methods("GET")
+	router.Handle("/alias/{alias}/{version}", handler.client(permissionRead, handler.handleAliasVersion)).Methods("GET")
+	router.Handle("/quota", handler.client(permissionWrite, handler.handleQuota)).Methods("GET")
+	router.Handle("/checkin", handler.client(permissionWrite, handler.handleCheckin)).Methods("POST")
+	router.Handle("/d/session", handler.client(permissionWrite, handler.handleCreateUploadSession)).Methods("POST")
+	router.Handle("/d/session/{id}", handler.client(permissionWrite, handler.handleUploadSession)).Methods("GET")
+	router.Handle("/d/session/{id}/parts/{index}", handler.client(permissionWrite, handler.handleUploadPart)).Methods("PUT")
+	router.Handle("/d/session/{id}/complete", handler.client(permissionWrite, handler.handleCompleteUpload)).Methods("POST")
+	router.Handle("/add-key", handler.limitIP(handler.client(permissionAdmin, handler.limitKey(handler.handleAddKey)))).Methods("POST")
+	router.Handle("/remove-key", handler.limitIP(handler.client(permissionAdmin, handler.limitKey(handler.handleRemoveKey)))).Methods("POST")
+}
+
+// newHandler starts the database and background jobs of a server, with the backends of config in place of the
+// configured ones.
+func newHandler(settings *viper.Viper, config Config) (*Handler, error) {
+	clock := config.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+	clockGuard := newClockGuard(
+		clock,
+		time.Duration(settings.GetUint(clockMaxJumpSecFlag))*time.Second,
+		settings.GetString(ntpServerFlag),
+		time.Duration(settings.GetUint(ntpMaxOffsetSecFlag))*time.Second,
+	)
+
+	interval, err := expiryInterval(settings)
+	if err != nil {
+		return nil, err
+	}
+	var store objectStore = &embeddedObjectStore{store: config.Store}
+	if config.Store == nil {
+		if store, err = newObjectStore(settings); err != nil {
+			return nil, err
+		}
+	}
+	var metas metaStore = &embeddedMetaStore{store: config.Metas}
+	if config.Metas == nil {
+		if metas, err = newMetaStore(settings); err != nil {
+			return nil, err
+		}
+	}
+	quotas, err := newQuotasFromConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+	hooks, err := newWebhooksFromConfig(settings, clock)
+	if err != nil {
+		return nil, err
+	}
+	oids, err := newOidSchemeFromConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+	aliasVersions := settings.GetInt(aliasVersionsFlag)
+	if aliasVersions < 0 {
+		return nil, fmt.Errorf("invalid %s %d, which must be at least 0", aliasVersionsFlag, aliasVersions)
+	}
+	sealer, err := newAtRestSealerFromConfig(settings.GetString(atRestKeyFlag), settings.GetString(atRestKMSFlag))
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure sealing at rest: %v", err)
+	}
+	db, err := initDatabase(
+		settings.GetString(dataDirFlag),
+		settings.GetUint(ttlMinFlag),
+		interval,
+		settings.GetBool(destructiveReadFlag),
+		settings.GetUint(accessLogRetentionMinFlag),
+		settings.GetBool(accessLogRequestersFlag),
+		settings.GetInt(inlineThresholdBytesFlag),
+		oids,
+		aliasVersions,
+		store,
+		metas,
+		sealer,
+		quotas,
+		clock,
+		clockGuard,
+		hooks,
+	)
+	if err != nil {
+		return nil, err
+	}
 
+	defaultKeyRole := settings.GetString(defaultKeyRoleFlag)
+	if !validKeyRole(defaultKeyRole) {
+		return nil, fmt.Errorf("unknown %s '%s', which must be %s, %s or %s", defaultKeyRoleFlag, defaultKeyRole,
+			lib.KeyRoleReadOnly, lib.KeyRoleWriteOnly, lib.KeyRoleAdmin)
+	}
+	keys := config.Keys
+	if keys == nil {
+		keysDir, err := expandPath(settings.GetString(keysDirFlag))
+		if err != nil {
+			return nil, err
+		}
+		keys = newDirKeyStore(keysDir)
+	}
+	auth := newAuthenticator(
+		keys,
+		time.Duration(settings.GetUint(tokenTTLSecFlag))*time.Second,
+		defaultKeyRole,
+		settings.GetBool(legacyTokenRequestsFlag),
+		clock,
+	)
+
+	caCert, err := expandPath(settings.GetString(replicationCACertFlag))
+	if err != nil {
+		return nil, err
+	}
+	replication, err := newReplicator(
+		db,
+		auth,
+		settings.GetString(roleFlag),
+		settings.GetString(replicationTokenFlag),
+		settings.GetString(primaryURLFlag),
+		time.Duration(settings.GetUint(replicationIntervalSecFlag))*time.Second,
+		time.Duration(settings.GetUint(failoverTimeoutSecFlag))*time.Second,
+		settings.GetStringSlice(witnessURLsFlag),
+		caCert,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := newUploadSessions(clock, db.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	audit, err := newAuditLogFromConfig(settings, clock)
+	if err != nil {
+		return nil, err
+	}
+	shares, err := newShareSigner(settings.GetString(shareKeyFlag), db.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	anonymous, err := newAnonymousDropsFromConfig(settings, clock)
+	if err != nil {
+		return nil, err
+	}
+	canaryMailer, err := newCanaryMailerFromConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Handler{
+		db:          db,
+		auth:        auth,
+		replication: replication,
+		observability: &ObservabilityConfig{
+			TtlMin:              settings.GetUint(ttlMinFlag),
+			ExpiryInterval:      interval,
+			ReplicationInterval: time.Duration(settings.GetUint(replicationIntervalSecFlag)) * time.Second,
+			FailoverTimeout:     time.Duration(settings.GetUint(failoverTimeoutSecFlag)) * time.Second,
+		},
+		sessions:   sessions,
+		adminToken: settings.GetString(adminTokenFlag),
+		ipLimiter: newRateLimiter("ip", settings.GetUint(rateLimitIPPerMinFlag), settings.GetUint(rateLimitIPBurstFlag),
+			clock),
+		keyLimiter: newRateLimiter("key", settings.GetUint(rateLimitKeyPerMinFlag),
+			settings.GetUint(rateLimitKeyBurstFlag), clock),
+		metrics:   newServerMetrics(),
+		auditLog:  audit,
+		shares:    shares,
+		anonymous: anonymous,
+
+		canaryMailer: canaryMailer,
+	}, nil
+}
+
+// router routes requests to the endpoints of the handler.
+func (handler *Handler) router(settings *viper.Viper) http.Handler {
 	router := mux.NewRouter()
+	router.Use(handler.metrics.instrument)
+
+	handler.clientRoutes(router)
+	// Clients of namespaces may address them explicitly, e.g. /ns/team-a/d/{oid}.
+	handler.clientRoutes(router.PathPrefix("/ns/{namespace}").Subrouter())
+	router.Handle("/token/challenge", handler.limitIP(http.HandlerFunc(handler.handleTokenChallenge))).Methods("POST")
+	router.Handle("/token", handler.limitIP(http.HandlerFunc(handler.handleToken))).Methods("POST")
+	if handler.anonymous != nil {
+		router.Handle("/anonymous/d", handler.requireActive(http.HandlerFunc(handler.handleAnonymousDrop))).
+			Methods("POST")
+	}
+	router.Handle("/s/{oid}/{share}", handler.limitIP(handler.requireActive(http.HandlerFunc(handler.handleSharedPull)))).
+		Methods("GET")
+	if settings.GetBool(webUIFlag) {
+		router.Handle("/ui", http.RedirectHandler("/ui/", http.StatusMovedPermanently)).Methods("GET")
+		router.HandleFunc("/ui/{asset:.*}", handler.handleUI).Methods("GET")
+	}
+
+	router.Handle("/replication/objects", handler.authenticateReplication(handler.handleReplicationObjects)).Methods("GET")
+	router.Handle("/replication/objects/{oid}", handler.authenticateReplication(handler.handleReplicationObject)).Methods("GET")
+	router.Handle("/replication/keys", handler.authenticateReplication(handler.handleReplicationKeys)).Methods("GET")
+	router.Handle("/replication/key-roles", handler.authenticateReplication(handler.handleReplicationKeyRoles)).Methods("GET")
+	router.Handle("/replication/key-namespaces", handler.authenticateReplication(handler.handleReplicationKeyNamespaces)).Methods("GET")
+	router.Handle("/replication/key-checkins", handler.authenticateReplication(handler.handleReplicationKeyCheckins)).Methods("GET")
+	router.Handle("/replication/status", handler.authenticateReplication(handler.handleReplicationStatus)).Methods("GET")
+	router.Handle("/replication/fence", handler.authenticateReplication(handler.handleFence)).Methods("POST")
+	router.Handle("/replication/promote", handler.authenticateReplication(handler.handlePromote)).Methods("POST")
 
-	router.Handle("/d/{oid}", handler.authenticate(handler.handlePull)).Methods("GET")
-	router.Handle("/d", handler.authenticate(handler.handleDrop)).Methods("POST")
-	router.Handle("/add-key", handler.authenticate(handler.handleAddKey)).Methods("POST")
-	router.HandleFunc("/token", handler.handleToken).Methods("POST")
+	router.HandleFunc("/metrics", handler.handleMetrics).Methods("GET")
+	router.HandleFunc("/healthz", handler.handleHealth).Methods("GET")
+	router.HandleFunc("/readyz", handler.handleReady).Methods("GET")
+	handler.adminRoutes(router)
+	router.Handle("/admin/observability-bundle", handler.authenticateAdmin(handler.handleObservabilityBundle)).Methods("GET")
 
 	negroniServer := negroni.Classic()
 	negroniServer.UseHandler(router)
+	return negroniServer
+}
 
-	tlsCert := viper.GetString(tlsCertFlag)
-	if len(tlsCert) == 0 {
-		logger.Fatalf("A tls certificate must be specified")
-	}
-	tlsCert, err := homedir.Expand(tlsCert)
-	if err != nil {
-		logger.Fatalf("Failed to load tls certificate: %v", err)
+// Handler returns the handler of the server's endpoints, for serving them from another http server, which must serve
+// them at its root over tls.
+func (server *Server) Handler() (http.Handler, error) {
+	return server.router, server.err
+}
+
+// ListenAndServe serves the server's endpoints over tls on the configured address, and its gRPC service on the
+// configured gRPC address if there is one. It returns http.ErrServerClosed once Shutdown is called.
+func (server *Server) ListenAndServe() error {
+	if server.err != nil {
+		return server.err
 	}
 
-	tlsKey := viper.GetString(tlsKeyFlag)
-	if len(tlsKey) == 0 {
-		logger.Fatalf("A tls key must be specified")
+	tlsCert, err := expandPath(server.settings.GetString(tlsCertFlag))
+	if err != nil {
+		return fmt.Errorf("failed to load tls certificate: %v", err)
+	} else if tlsCert == "" {
+		return fmt.Errorf("a tls certificate must be specified")
 	}
-	tlsKey, err = homedir.Expand(tlsKey)
+	tlsKey, err := expandPath(server.settings.GetString(tlsKeyFlag))
 	if err != nil {
-		logger.Fatalf("Failed to load tls key: %v", err)
+		return fmt.Errorf("failed to load tls key: %v", err)
+	} else if tlsKey == "" {
+		return fmt.Errorf("a tls key must be specified")
 	}
 
-	addr := viper.GetString(addrFlag)
+	addr := server.settings.GetString(addrFlag)
 	logger.Infof("Starting server on %s", addr)
 
 	tlsConfig := &tls.Config{
@@ -146,14 +745,69 @@ func startServer() {
 		},
 	}
 
-	server := &http.Server{
+	httpServer := &http.Server{
 		Addr:         addr,
-		Handler:      negroniServer,
+		Handler:      server.router,
 		TLSConfig:    tlsConfig,
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0),
 	}
 
-	if err := server.ListenAndServeTLS(tlsCert, tlsKey); err != nil {
-		logger.Fatalf("Failed to start server: %v", err)
+	var rpcServer *grpc.Server
+	if grpcAddr := server.settings.GetString(grpcAddrFlag); grpcAddr != "" {
+		if rpcServer, err = newGRPCServer(server.handler, tlsCert, tlsKey); err != nil {
+			return fmt.Errorf("failed to configure gRPC server: %v", err)
+		}
+		if err := serveGRPC(rpcServer, grpcAddr); err != nil {
+			return fmt.Errorf("failed to start gRPC server: %v", err)
+		}
+	}
+
+	server.lock.Lock()
+	if server.shutdown {
+		server.lock.Unlock()
+		if rpcServer != nil {
+			rpcServer.Stop()
+		}
+		return http.ErrServerClosed
 	}
+	server.server, server.rpcServer = httpServer, rpcServer
+	server.lock.Unlock()
+	return httpServer.ListenAndServeTLS(tlsCert, tlsKey)
+}
+
+// Shutdown stops accepting connections, and waits up to the shutdown grace period for requests in flight, e.g.
+// uploads and pulls, to finish before closing their connections, as well as for gRPC calls. Metadata being written is
+// then flushed, and the metadata store and audit log are closed.
+func (server *Server) Shutdown() {
+	if server.err != nil {
+		return
+	}
+
+	server.lock.Lock()
+	httpServer, rpcServer := server.server, server.rpcServer
+	server.shutdown = true
+	server.lock.Unlock()
+
+	grace := time.Duration(server.settings.GetUint(shutdownGraceSecFlag)) * time.Second
+	logger.Infof("Draining requests for up to %v", grace)
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	rpcStopped := make(chan struct{})
+	go func() {
+		if rpcServer != nil {
+			stopGRPC(ctx, rpcServer)
+		}
+		close(rpcStopped)
+	}()
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			logger.Warningf("Closing connections with requests still in flight: %v", err)
+			httpServer.Close()
+		}
+	}
+	<-rpcStopped
+
+	server.handler.db.close()
+	server.handler.auditLog.close()
+	logger.Infof("Shut down")
 }
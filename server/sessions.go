@@ -0,0 +1,265 @@
+package server
+
+import (
+	"crypto/rand"
+	"dead-drop/lib"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/logger"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Upload sessions outlive any reasonable retry window, but are only kept in memory, so they don't survive restarts.
+const uploadSessionTtl = time.Hour
+
+const (
+	sessionPending = iota
+	sessionUploading
+	sessionDone
+)
+
+// Parts of multipart uploads are streamed to disk, so they only need bounding to keep objects to a sane size.
+const maxUploadPartSize = 64 * 1024 * 1024
+const maxUploadParts = 10000
+
+// Parts are kept in a hidden directory inside the data directory, so that they can be moved into it once assembled.
+const uploadsDirName = ".uploads"
+
+const UnknownSessionErr = Error("unknown or expired upload session")
+const SessionBusyErr = Error("upload session already has an upload in progress")
+const SessionDoneErr = Error("upload session already holds an object")
+const PartTooLargeErr = Error("upload part is too large")
+const MissingPartErr = Error("upload is missing parts")
+
+type uploadSession struct {
+	keyName string
+	state   int
+	oid     string
+	expires time.Time
+}
+
+// UploadSessions lets clients recover the oid of a drop whose response was lost, instead of uploading it again.
+// Sessions are also the upload ids of multipart uploads, which send an object in parts that can be retried on their
+// own, so that an interrupted upload resumes from the part it was sending rather than starting over.
+type UploadSessions struct {
+	lock     sync.Mutex
+	sessions map[string]*uploadSession
+	clock    Clock
+	dir      string
+}
+
+func newUploadSessions(clock Clock, dataDir string) (*UploadSessions, error) {
+	// Sessions don't survive restarts, so neither do their parts.
+	dir := filepath.Join(dataDir, uploadsDirName)
+	if err := os.RemoveAll(dir); err != nil {
+		logger.Errorf("Failed to remove upload parts left from before restart: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, fmt.Errorf("failed to create upload parts directory: %v", err)
+	}
+
+	sessions := &UploadSessions{
+		sessions: make(map[string]*uploadSession),
+		clock:    clock,
+		dir:      dir,
+	}
+
+	go sessions.expiryJob()
+
+	return sessions, nil
+}
+
+// create starts a session for the named key, returning its id.
+func (sessions *UploadSessions) create(keyName string) string {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		logger.Fatalf("Failed to generate random upload session id: %v", err)
+	}
+	id := hex.EncodeToString(bytes)
+
+	sessions.lock.Lock()
+	sessions.sessions[id] = &uploadSession{
+		keyName: keyName,
+		state:   sessionPending,
+		expires: sessions.clock.Now().Add(uploadSessionTtl),
+	}
+	sessions.lock.Unlock()
+
+	return id
+}
+
+// lookup returns the oid stored in a session, or "" if nothing has been stored yet,
+// and whether an upload is in progress in the session.
+func (sessions *UploadSessions) lookup(id string, keyName string) (string, bool, error) {
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+
+	session, err := sessions.get(id, keyName)
+	if err != nil {
+		return "", false, err
+	}
+	return session.oid, session.state == sessionUploading, nil
+}
+
+// begin claims a session for an upload. If an object was already stored in the session, its oid is returned
+// and nothing should be stored again.
+func (sessions *UploadSessions) begin(id string, keyName string) (string, error) {
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+
+	session, err := sessions.get(id, keyName)
+	if err != nil {
+		return "", err
+	}
+
+	switch session.state {
+	case sessionDone:
+		return session.oid, nil
+	case sessionUploading:
+		return "", SessionBusyErr
+	}
+
+	session.state = sessionUploading
+	return "", nil
+}
+
+// finish records the oid of an upload claimed with begin, or releases the session if the upload failed.
+func (sessions *UploadSessions) finish(id string, oid string) {
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+
+	session, ok := sessions.sessions[id]
+	if !ok {
+		return
+	}
+
+	if oid == "" {
+		session.state = sessionPending
+	} else {
+		session.state = sessionDone
+		session.oid = oid
+		sessions.removeParts(id)
+	}
+}
+
+// storePart stores a part of a multipart upload, replacing any earlier attempt to send it.
+func (sessions *UploadSessions) storePart(id string, keyName string, index int, r io.Reader) error {
+	sessions.lock.Lock()
+	session, err := sessions.get(id, keyName)
+	if err == nil {
+		switch session.state {
+		case sessionUploading:
+			err = SessionBusyErr
+		case sessionDone:
+			err = SessionDoneErr
+		}
+	}
+	sessions.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	partsDir := filepath.Join(sessions.dir, id)
+	if err := os.MkdirAll(partsDir, 0770); err != nil {
+		return err
+	}
+
+	// Parts are written under a temporary name, so that a part is either missing or complete when it is assembled.
+	file, err := ioutil.TempFile(partsDir, ".part-")
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(file, io.LimitReader(r, maxUploadPartSize+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && written > maxUploadPartSize {
+		err = PartTooLargeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), sessions.partPath(id, index))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
+
+// assemble concatenates the parts of a multipart upload claimed with begin, returning the path of the object.
+func (sessions *UploadSessions) assemble(id string, parts int) (string, error) {
+	path := filepath.Join(sessions.dir, id, ".object")
+	object, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, lib.ObjectPerms)
+	if err != nil {
+		return "", err
+	}
+
+	err = sessions.appendParts(object, id, parts)
+	if closeErr := object.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+func (sessions *UploadSessions) appendParts(object io.Writer, id string, parts int) error {
+	for i := 0; i < parts; i++ {
+		part, err := os.Open(sessions.partPath(id, i))
+		if os.IsNotExist(err) {
+			return MissingPartErr
+		} else if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(object, part)
+		part.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sessions *UploadSessions) partPath(id string, index int) string {
+	return filepath.Join(sessions.dir, id, strconv.Itoa(index))
+}
+
+func (sessions *UploadSessions) removeParts(id string) {
+	if err := os.RemoveAll(filepath.Join(sessions.dir, id)); err != nil {
+		logger.Errorf("Failed to remove parts of upload session %s: %v", id, err)
+	}
+}
+
+// get returns a live session owned by the named key. Sessions of other keys are reported as unknown.
+func (sessions *UploadSessions) get(id string, keyName string) (*uploadSession, error) {
+	session, ok := sessions.sessions[id]
+	if !ok || session.keyName != keyName || session.expires.Before(sessions.clock.Now()) {
+		return nil, UnknownSessionErr
+	}
+	return session, nil
+}
+
+func (sessions *UploadSessions) expiryJob() {
+	for {
+		sessions.clock.Sleep(time.Minute)
+
+		now := sessions.clock.Now()
+		sessions.lock.Lock()
+		for id, session := range sessions.sessions {
+			if session.expires.Before(now) {
+				delete(sessions.sessions, id)
+				sessions.removeParts(id)
+			}
+		}
+		sessions.lock.Unlock()
+	}
+}
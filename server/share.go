@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"dead-drop/lib"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/logger"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Shared urls are signed with a key which, unless configured, is generated into a file of this name in the data
+// directory, so that urls stay valid across restarts.
+const shareKeyFileName = "share.key"
+
+const shareKeyLen = 32
+const shareIDLen = 16
+
+// shareSigner signs and verifies the urls of shared objects, which pull an object without authenticating.
+// A url names its object, expiry and maximum uses along with a random id, which uses are counted under.
+type shareSigner struct {
+	key []byte
+}
+
+// newShareSigner returns the signer of shared urls with the configured key, or else the key kept in the data
+// directory, which is generated if there is none.
+func newShareSigner(configuredKey string, dataDir string) (*shareSigner, error) {
+	if configuredKey != "" {
+		return &shareSigner{key: []byte(configuredKey)}, nil
+	}
+
+	path := filepath.Join(dataDir, shareKeyFileName)
+	key, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key = make([]byte, shareKeyLen)
+		if _, err := rand.Read(key); err != nil {
+			logger.Fatalf("Failed to generate share key: %v", err)
+		}
+		err = ioutil.WriteFile(path, key, 0600)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load share key %s: %v", path, err)
+	}
+	return &shareSigner{key: key}, nil
+}
+
+func (signer *shareSigner) signature(oid string, id string, expires int64, maxUses int) []byte {
+	mac := hmac.New(sha256.New, signer.key)
+	_, _ = fmt.Fprintf(mac, "dead-drop share %s %s %d %d", oid, id, expires, maxUses)
+	return mac.Sum(nil)
+}
+
+// path returns the path of a new shared url of an object.
+func (signer *shareSigner) path(oid string, expires time.Time, maxUses int) string {
+	idBytes := make([]byte, shareIDLen)
+	if _, err := rand.Read(idBytes); err != nil {
+		logger.Fatalf("Failed to generate share id: %v", err)
+	}
+	id := hex.EncodeToString(idBytes)
+
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	if maxUses > 0 {
+		query.Set("uses", strconv.Itoa(maxUses))
+	}
+	query.Set("sig", base64.RawURLEncoding.EncodeToString(signer.signature(oid, id, expires.Unix(), maxUses)))
+	return fmt.Sprintf("/s/%s/%s?%s", oid, id, query.Encode())
+}
+
+// verify returns the maximum uses of a shared url, and whether it is genuine and hasn't expired.
+func (signer *shareSigner) verify(oid string, id string, query url.Values, now time.Time) (int, bool) {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	maxUses := 0
+	if uses := query.Get("uses"); uses != "" {
+		if maxUses, err = strconv.Atoi(uses); err != nil || maxUses <= 0 {
+			return 0, false
+		}
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(query.Get("sig"))
+	if err != nil || !hmac.Equal(signature, signer.signature(oid, id, expires, maxUses)) {
+		return 0, false
+	}
+	return maxUses, now.Before(time.Unix(expires, 0))
+}
+
+// handleShare creates a shared url of an object, which only the key which dropped it may do. Other keys get the same
+// response as for a missing object, so that they can't probe for oids.
+func (handler *Handler) handleShare(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	oid := params["oid"]
+
+	var payload lib.ShareRequestPayload
+	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil || payload.TTL <= 0 || payload.MaxUses < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !handler.db.hasObject(oid) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	meta, err := handler.db.objectMeta(oid)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if meta == nil || !meta.ownedBy(requestKeyName(req), requestKeyNamespace(req)) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Urls can't outlive their object, so they are cut short at its expiry.
+	expires := handler.db.clock.Now().Add(time.Duration(payload.TTL) * time.Second)
+	if objectExpires := meta.expires(handler.db.ttl()); objectExpires.Before(expires) {
+		expires = objectExpires
+	}
+	share := lib.SharePayload{
+		Oid:     oid,
+		Path:    handler.shares.path(oid, expires, payload.MaxUses),
+		Expires: expires.Truncate(time.Second),
+		MaxUses: payload.MaxUses,
+	}
+	handler.audit(req, auditObjectShared, requestKeyName(req), oid, fmt.Sprintf("until %s", share.Expires.UTC()))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(share); err != nil {
+		logger.Errorf("Failed to write share response: %v", err)
+	}
+}
+
+// handleSharedPull pulls an object through a shared url, without authenticating. Each request uses the url once,
+// whether or not it reaches the end of the object. Pulls through shared urls are recorded under the url's id.
+func (handler *Handler) handleSharedPull(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	oid, id := params["oid"], params["share"]
+
+	maxUses, ok := handler.shares.verify(oid, id, req.URL.Query(), handler.db.clock.Now())
+	if !ok {
+		handler.audit(req, auditAuthFailure, "", oid, "invalid or expired shared url")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !handler.db.useShare(oid, id, maxUses) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ctx := context.WithValue(req.Context(), keyNameContextKey, sharedPullKeyName(id))
+	handler.handlePull(w, req.WithContext(ctx))
+}
+
+// sharedPullKeyName is what pulls through a shared url are recorded as pulled by.
+func sharedPullKeyName(id string) string {
+	return "share:" + id
+}
+
+// useShare counts a use of a shared url of an object, returning whether the object exists and the url has uses left.
+// Uses are only counted for urls with a maximum, and are kept in the object's metadata.
+func (db *Database) useShare(oid string, id string, maxUses int) bool {
+	if !db.hasObject(oid) {
+		return false
+	}
+	if maxUses == 0 {
+		return true
+	}
+
+	db.metaLock.Lock()
+	defer db.metaLock.Unlock()
+
+	meta, err := db.readMeta(oid)
+	if err != nil || meta == nil || meta.ShareUses[id] >= maxUses {
+		return false
+	}
+	if meta.ShareUses == nil {
+		meta.ShareUses = make(map[string]int)
+	}
+	meta.ShareUses[id]++
+	db.writeMeta(oid, meta)
+	return true
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"dead-drop/lib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const storageFile = "file"
+const storageS3 = "s3"
+const storageGCS = "gcs"
+const storageAzure = "azure"
+
+// Access tokens of cloud stores are refreshed this long before they expire, so that they don't expire in flight.
+const tokenRefreshMargin = time.Minute
+
+// storageTimeouts bound the phases of requests to cloud object stores which don't depend on the size of the object, so
+// that a store which stops responding fails drops, pulls and the expiry job instead of hanging them. Transfers
+// themselves are never timed out; zero values disable a timeout.
+type storageTimeouts struct {
+	Dial         time.Duration
+	TLSHandshake time.Duration
+	// ResponseHeader bounds the wait for the response once a request is sent, e.g. while the store commits an upload.
+	ResponseHeader time.Duration
+}
+
+// newStorageHTTPClient creates the http client of a cloud object store, whose transport keeps connections to it alive.
+func newStorageHTTPClient(timeouts storageTimeouts) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   timeouts.Dial,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   timeouts.TLSHandshake,
+		ResponseHeaderTimeout: timeouts.ResponseHeader,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}}
+}
+
+// objectStore keeps the data of the objects which are not stored inline. Their metadata is kept in the data directory
+// whichever store holds the data.
+type objectStore interface {
+	// put stores the data of an object.
+	put(oid string, data []byte) error
+	// putFile stores the data of an object from a file inside the data directory, which is removed.
+	putFile(oid string, path string) error
+	// open opens an object for reading, returning its size.
+	open(oid string) (ObjectReader, int64, error)
+	// stat returns the size of an object, and when it was stored.
+	stat(oid string) (int64, time.Time, error)
+	remove(oid string) error
+	// list calls fn with every stored object, and when it was stored.
+	list(fn func(oid string, modified time.Time)) error
+	// ping checks that the store can be reached, giving up once ctx is done.
+	ping(ctx context.Context) error
+	// String describes where objects are stored, for the log.
+	String() string
+}
+
+// fileStore keeps each object in a file of its own in the data directory.
+type fileStore struct {
+	dir string
+}
+
+func newFileStore(dir string) *fileStore {
+	return &fileStore{dir: dir}
+}
+
+func (store *fileStore) put(oid string, data []byte) error {
+	return ioutil.WriteFile(store.path(oid), data, lib.ObjectPerms)
+}
+
+func (store *fileStore) putFile(oid string, path string) error {
+	return os.Rename(path, store.path(oid))
+}
+
+func (store *fileStore) open(oid string) (ObjectReader, int64, error) {
+	file, err := os.Open(store.path(oid))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+func (store *fileStore) ping(ctx context.Context) error {
+	_, err := os.Stat(store.dir)
+	return err
+}
+
+func (store *fileStore) stat(oid string) (int64, time.Time, error) {
+	info, err := os.Stat(store.path(oid))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return info.Size(), info.ModTime(), nil
+}
+
+func (store *fileStore) remove(oid string) error {
+	return os.Remove(store.path(oid))
+}
+
+// list skips directories and hidden files, which hold metadata, upload parts and replication state.
+func (store *fileStore) list(fn func(oid string, modified time.Time)) error {
+	files, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		fn(file.Name(), file.ModTime())
+	}
+	return nil
+}
+
+func (store *fileStore) String() string {
+	return "data directory " + store.dir
+}
+
+func (store *fileStore) path(oid string) string {
+	return filepath.Join(store.dir, oid)
+}
+
+// rangedObject reads an object from a remote store, fetching the rest of it from the offset on the first read after a
+// seek, so that resumed pulls only transfer what they send.
+type rangedObject struct {
+	size   int64
+	offset int64
+	body   io.ReadCloser
+	// fetch requests the object from an offset to its end.
+	fetch func(offset int64) (io.ReadCloser, error)
+}
+
+func (object *rangedObject) Read(p []byte) (int, error) {
+	if object.offset >= object.size {
+		return 0, io.EOF
+	}
+	if object.body == nil {
+		body, err := object.fetch(object.offset)
+		if err != nil {
+			return 0, err
+		}
+		object.body = body
+	}
+
+	n, err := object.body.Read(p)
+	object.offset += int64(n)
+	if err == io.EOF && object.offset < object.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (object *rangedObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += object.offset
+	case io.SeekEnd:
+		offset += object.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek to negative offset %d", offset)
+	}
+
+	if offset != object.offset && object.body != nil {
+		object.body.Close()
+		object.body = nil
+	}
+	object.offset = offset
+	return offset, nil
+}
+
+func (object *rangedObject) Close() error {
+	if object.body == nil {
+		return nil
+	}
+	err := object.body.Close()
+	object.body = nil
+	return err
+}
+
+// accessToken is an OAuth 2 access token response. Some token endpoints send expires_in as a string.
+type accessToken struct {
+	AccessToken string          `json:"access_token"`
+	ExpiresIn   json.RawMessage `json:"expires_in"`
+}
+
+// tokenSource caches the access token of a cloud store, fetching a new one when it is about to expire.
+type tokenSource struct {
+	mutex   sync.Mutex
+	value   string
+	expires time.Time
+	// fetch builds a request for a new token.
+	fetch  func() (*http.Request, error)
+	client *http.Client
+}
+
+func (source *tokenSource) token() (string, error) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	if source.value != "" && time.Now().Add(tokenRefreshMargin).Before(source.expires) {
+		return source.value, nil
+	}
+
+	req, err := source.fetch()
+	if err != nil {
+		return "", err
+	}
+	resp, err := source.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("token request failed with status: %s %s", resp.Status, message)
+	}
+	token := &accessToken{}
+	if err := json.NewDecoder(resp.Body).Decode(token); err != nil {
+		return "", fmt.Errorf("invalid token response: %v", err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("token response has no access token")
+	}
+	// Tokens without an expiry are used for a single request.
+	expiresIn := int64(0)
+	if len(token.ExpiresIn) > 0 {
+		if expiresIn, err = strconv.ParseInt(strings.Trim(string(token.ExpiresIn), `"`), 10, 64); err != nil {
+			return "", fmt.Errorf("invalid token expiry %s", token.ExpiresIn)
+		}
+	}
+
+	source.value = token.AccessToken
+	source.expires = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	return source.value, nil
+}
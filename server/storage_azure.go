@@ -0,0 +1,371 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Blob service version requests are made with, the first to support managed identities and the Cold tier.
+const azureAPIVersion = "2021-12-02"
+
+const azureResource = "https://storage.azure.com/"
+
+// Objects larger than this are uploaded in blocks of this size, which are committed together, rather than in one
+// request.
+const azureBlockSize = 16 * 1024 * 1024
+
+// azureConfig configures an azureStore.
+type azureConfig struct {
+	// Endpoint is the url of the storage account's Blob service, e.g. https://account.blob.core.windows.net.
+	Endpoint  string
+	Container string
+	// Prefix is prepended to the oid of each object to make its name, e.g. "dead-drop/".
+	Prefix string
+	// SASToken is a shared access signature for the container, or empty to authenticate with the managed identity of
+	// the VM or AKS pod the server runs as.
+	SASToken string
+	// ClientID selects a user assigned managed identity, if there is more than one.
+	ClientID string
+	// AccessTier is the tier blobs are created in, e.g. Cool, or empty for the account's default.
+	AccessTier string
+	// Timeouts apply to token requests too.
+	Timeouts storageTimeouts
+}
+
+// azureStore keeps objects in a container of Azure Blob Storage, using its REST API directly.
+type azureStore struct {
+	config     azureConfig
+	endpoint   string
+	sas        url.Values
+	tokens     *tokenSource
+	httpClient *http.Client
+}
+
+func newAzureStore(config azureConfig) (*azureStore, error) {
+	if config.Container == "" {
+		return nil, fmt.Errorf("no container configured")
+	}
+
+	switch config.AccessTier {
+	case "", "Hot", "Cool", "Cold":
+	default:
+		// Archived blobs can't be read until they are rehydrated, which takes hours.
+		return nil, fmt.Errorf("invalid access tier '%s', which must be Hot, Cool or Cold", config.AccessTier)
+	}
+
+	endpoint := strings.TrimSuffix(config.Endpoint, "/")
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("invalid endpoint '%s', which must be an http or https url", config.Endpoint)
+	}
+
+	store := &azureStore{config: config, endpoint: endpoint, httpClient: newStorageHTTPClient(config.Timeouts)}
+	if config.SASToken != "" {
+		sas, err := url.ParseQuery(strings.TrimPrefix(config.SASToken, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid sas token: %v", err)
+		}
+		store.sas = sas
+	} else {
+		store.tokens = newAzureTokenSource(store.httpClient, config.ClientID)
+	}
+	return store, nil
+}
+
+// newAzureTokenSource returns tokens for the managed identity of the VM, or of the AKS pod with workload identity,
+// from the instance metadata service.
+func newAzureTokenSource(client *http.Client, clientID string) *tokenSource {
+	fetch := func() (*http.Request, error) {
+		query := url.Values{}
+		query.Set("api-version", "2018-02-01")
+		query.Set("resource", azureResource)
+		if clientID != "" {
+			query.Set("client_id", clientID)
+		}
+		req, err := http.NewRequest("GET", "http://169.254.169.254/metadata/identity/oauth2/token?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata", "true")
+		return req, nil
+	}
+	return &tokenSource{fetch: fetch, client: client}
+}
+
+func (store *azureStore) put(oid string, data []byte) error {
+	return store.upload(oid, bytes.NewReader(data), int64(len(data)))
+}
+
+func (store *azureStore) putFile(oid string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := store.upload(oid, file, info.Size()); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func (store *azureStore) open(oid string) (ObjectReader, int64, error) {
+	size, _, err := store.stat(oid)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fetch := func(offset int64) (io.ReadCloser, error) {
+		header := http.Header{}
+		header.Set("X-Ms-Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		resp, err := store.do("GET", oid, nil, nil, 0, header)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+	return &rangedObject{size: size, fetch: fetch}, size, nil
+}
+
+func (store *azureStore) stat(oid string) (int64, time.Time, error) {
+	resp, err := store.do("HEAD", oid, nil, nil, 0, nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	resp.Body.Close()
+
+	created, err := http.ParseTime(resp.Header.Get("X-Ms-Creation-Time"))
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("invalid creation time of object %s: %v", oid, err)
+	}
+	return resp.ContentLength, created, nil
+}
+
+func (store *azureStore) ping(ctx context.Context) error {
+	resp, err := store.doContext(ctx, "HEAD", healthCheckOid, nil, nil, 0, nil)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (store *azureStore) remove(oid string) error {
+	resp, err := store.do("DELETE", oid, nil, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// azureListResult is the part of a List Blobs response needed to index a container.
+type azureListResult struct {
+	Blobs []struct {
+		Name         string
+		CreationTime string `xml:"Properties>Creation-Time"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string
+}
+
+// list skips names under the prefix which contain a slash, which dead-drop doesn't store.
+func (store *azureStore) list(fn func(oid string, modified time.Time)) error {
+	query := url.Values{}
+	query.Set("restype", "container")
+	query.Set("comp", "list")
+	query.Set("prefix", store.config.Prefix)
+
+	for {
+		resp, err := store.do("GET", "", query, nil, 0, nil)
+		if err != nil {
+			return err
+		}
+		result := &azureListResult{}
+		err = xml.NewDecoder(resp.Body).Decode(result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("invalid listing of container %s: %v", store.config.Container, err)
+		}
+
+		for _, blob := range result.Blobs {
+			oid := strings.TrimPrefix(blob.Name, store.config.Prefix)
+			if oid == "" || strings.Contains(oid, "/") {
+				continue
+			}
+			created, err := http.ParseTime(blob.CreationTime)
+			if err != nil {
+				return fmt.Errorf("invalid creation time of object %s: %v", oid, err)
+			}
+			fn(oid, created)
+		}
+
+		if result.NextMarker == "" {
+			return nil
+		}
+		query.Set("marker", result.NextMarker)
+	}
+}
+
+func (store *azureStore) String() string {
+	return fmt.Sprintf("azure container %s at %s", store.config.Container, store.endpoint)
+}
+
+// upload creates a blob, in a single request if it is small enough, or as blocks committed with a block list
+// otherwise.
+func (store *azureStore) upload(oid string, data io.Reader, size int64) error {
+	header := http.Header{}
+	if store.config.AccessTier != "" {
+		header.Set("X-Ms-Access-Tier", store.config.AccessTier)
+	}
+
+	if size <= azureBlockSize {
+		header.Set("X-Ms-Blob-Type", "BlockBlob")
+		resp, err := store.do("PUT", oid, nil, data, size, header)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	var blockList bytes.Buffer
+	blockList.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	block := make([]byte, azureBlockSize)
+	for offset, n := int64(0), 0; offset < size; offset += int64(n) {
+		var err error
+		n, err = io.ReadFull(data, block)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		if n == 0 || offset+int64(n) > size {
+			return fmt.Errorf("object changed size while it was uploaded")
+		}
+
+		// Block ids must all be the same length.
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%016x", offset)))
+		query := url.Values{}
+		query.Set("comp", "block")
+		query.Set("blockid", id)
+		resp, err := store.do("PUT", oid, query, bytes.NewReader(block[:n]), int64(n), nil)
+		if err != nil {
+			return fmt.Errorf("error uploading bytes %d-%d: %v", offset, offset+int64(n)-1, err)
+		}
+		resp.Body.Close()
+		blockList.WriteString("<Latest>" + id + "</Latest>")
+	}
+	blockList.WriteString("</BlockList>")
+
+	query := url.Values{}
+	query.Set("comp", "blocklist")
+	resp, err := store.do("PUT", oid, query, &blockList, int64(blockList.Len()), header)
+	if err != nil {
+		return fmt.Errorf("error committing blocks: %v", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// azureError is the body of a Blob service error response.
+type azureError struct {
+	Code    string
+	Message string
+}
+
+// do sends an authorized request for the blob of an oid, or for the container if the oid is empty, returning an
+// error if the response status isn't a success. Objects which don't exist are reported with an error satisfying
+// os.IsNotExist.
+func (store *azureStore) do(
+	method string,
+	oid string,
+	query url.Values,
+	body io.Reader,
+	size int64,
+	header http.Header,
+) (*http.Response, error) {
+	return store.doContext(context.Background(), method, oid, query, body, size, header)
+}
+
+// doContext is do for a request which is given up once ctx is done.
+func (store *azureStore) doContext(
+	ctx context.Context,
+	method string,
+	oid string,
+	query url.Values,
+	body io.Reader,
+	size int64,
+	header http.Header,
+) (*http.Response, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	for name, values := range store.sas {
+		query[name] = values
+	}
+	rawURL := store.endpoint + "/" + url.PathEscape(store.config.Container)
+	if oid != "" {
+		rawURL += "/" + strings.Replace(url.PathEscape(store.config.Prefix+oid), "%2F", "/", -1)
+	}
+
+	if len(query) > 0 {
+		rawURL += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, rawURL, body)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		// Stores refuse chunked uploads, which is how empty bodies of unknown type would be sent.
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("X-Ms-Version", azureAPIVersion)
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	if store.tokens != nil {
+		token, err := store.tokens.token()
+		if err != nil {
+			return nil, fmt.Errorf("error authenticating to azure: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := store.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && oid != "" {
+		return nil, os.ErrNotExist
+	}
+	azureErr := &azureError{}
+	if err := xml.NewDecoder(resp.Body).Decode(azureErr); err != nil || azureErr.Code == "" {
+		return nil, fmt.Errorf("azure responded with status: %s", resp.Status)
+	}
+	return nil, fmt.Errorf("azure responded with status: %s %s: %s", resp.Status, azureErr.Code, azureErr.Message)
+}
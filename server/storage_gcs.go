@@ -0,0 +1,413 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const gcsDefaultEndpoint = "https://storage.googleapis.com"
+
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// Objects larger than this are uploaded in chunks of this size with a resumable upload, rather than in one request.
+// Chunks must be a multiple of 256 KiB.
+const gcsChunkSize = 16 * 1024 * 1024
+
+// gcsConfig configures a gcsStore.
+type gcsConfig struct {
+	// Endpoint is the url of the GCS API, or empty for Google's, e.g. to use an emulator.
+	Endpoint string
+	Bucket   string
+	// Prefix is prepended to the oid of each object to make its name, e.g. "dead-drop/".
+	Prefix string
+	// Credentials is the path of a service account key file, or empty to use the credentials of the instance or
+	// workload the server runs as, from the metadata server.
+	Credentials string
+	// StorageClass is the storage class objects are created with, e.g. NEARLINE, or empty for the bucket's default.
+	StorageClass string
+	// Timeouts apply to token requests too.
+	Timeouts storageTimeouts
+}
+
+// gcsStore keeps objects in a bucket of Google Cloud Storage, using its JSON API directly.
+type gcsStore struct {
+	config     gcsConfig
+	endpoint   string
+	tokens     *tokenSource
+	httpClient *http.Client
+}
+
+func newGCSStore(config gcsConfig) (*gcsStore, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("no bucket configured")
+	}
+
+	endpoint := strings.TrimSuffix(config.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = gcsDefaultEndpoint
+	}
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("invalid endpoint '%s', which must be an http or https url", config.Endpoint)
+	}
+
+	httpClient := newStorageHTTPClient(config.Timeouts)
+	tokens, err := newGCSTokenSource(httpClient, config.Credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gcsStore{config: config, endpoint: endpoint, tokens: tokens, httpClient: httpClient}, nil
+}
+
+func (store *gcsStore) put(oid string, data []byte) error {
+	return store.upload(oid, bytes.NewReader(data), int64(len(data)))
+}
+
+func (store *gcsStore) putFile(oid string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := store.upload(oid, file, info.Size()); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// gcsObject is the part of the metadata of a GCS object the store uses.
+type gcsObject struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size,string"`
+	TimeCreated time.Time `json:"timeCreated"`
+}
+
+func (store *gcsStore) open(oid string) (ObjectReader, int64, error) {
+	size, _, err := store.stat(oid)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fetch := func(offset int64) (io.ReadCloser, error) {
+		header := http.Header{}
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		resp, err := store.do("GET", store.objectURL(oid)+"?alt=media", nil, header)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+	return &rangedObject{size: size, fetch: fetch}, size, nil
+}
+
+func (store *gcsStore) stat(oid string) (int64, time.Time, error) {
+	resp, err := store.do("GET", store.objectURL(oid), nil, nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	object := &gcsObject{}
+	if err := json.NewDecoder(resp.Body).Decode(object); err != nil {
+		return 0, time.Time{}, fmt.Errorf("invalid metadata of object %s: %v", oid, err)
+	}
+	return object.Size, object.TimeCreated, nil
+}
+
+func (store *gcsStore) ping(ctx context.Context) error {
+	resp, err := store.doContext(ctx, "GET", store.objectURL(healthCheckOid), nil, nil)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (store *gcsStore) remove(oid string) error {
+	resp, err := store.do("DELETE", store.objectURL(oid), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// gcsListResult is a page of a listing of a bucket.
+type gcsListResult struct {
+	Items         []gcsObject `json:"items"`
+	NextPageToken string      `json:"nextPageToken"`
+}
+
+// list skips names under the prefix which contain a slash, which dead-drop doesn't store.
+func (store *gcsStore) list(fn func(oid string, modified time.Time)) error {
+	query := url.Values{}
+	query.Set("prefix", store.config.Prefix)
+	query.Set("fields", "items(name,timeCreated),nextPageToken")
+
+	for {
+		resp, err := store.do("GET", store.bucketURL()+"/o?"+query.Encode(), nil, nil)
+		if err != nil {
+			return err
+		}
+		result := &gcsListResult{}
+		err = json.NewDecoder(resp.Body).Decode(result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("invalid listing of bucket %s: %v", store.config.Bucket, err)
+		}
+
+		for _, object := range result.Items {
+			oid := strings.TrimPrefix(object.Name, store.config.Prefix)
+			if oid == "" || strings.Contains(oid, "/") {
+				continue
+			}
+			fn(oid, object.TimeCreated)
+		}
+
+		if result.NextPageToken == "" {
+			return nil
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
+
+func (store *gcsStore) String() string {
+	return fmt.Sprintf("gcs bucket %s at %s", store.config.Bucket, store.endpoint)
+}
+
+// upload creates an object, in a single multipart request if it is small enough, or in chunks with a resumable upload
+// otherwise.
+func (store *gcsStore) upload(oid string, data io.Reader, size int64) error {
+	fields := map[string]string{"name": store.config.Prefix + oid}
+	if store.config.StorageClass != "" {
+		fields["storageClass"] = store.config.StorageClass
+	}
+	metadata, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	if size > gcsChunkSize {
+		return store.uploadResumable(metadata, data, size)
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json; charset=UTF-8"}})
+	if err != nil {
+		return err
+	}
+	part.Write(metadata)
+	if part, err = writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/octet-stream"}}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, data); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "multipart/related; boundary="+writer.Boundary())
+	resp, err := store.do("POST", store.uploadURL("multipart"), &body, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// uploadResumable uploads an object in chunks, each of which is confirmed before the next is sent.
+func (store *gcsStore) uploadResumable(metadata []byte, data io.Reader, size int64) error {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json; charset=UTF-8")
+	header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	resp, err := store.do("POST", store.uploadURL("resumable"), bytes.NewReader(metadata), header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return fmt.Errorf("gcs started a resumable upload without a session url")
+	}
+
+	chunk := make([]byte, gcsChunkSize)
+	for offset := int64(0); offset < size; {
+		n, err := io.ReadFull(data, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		if n == 0 || offset+int64(n) > size {
+			return fmt.Errorf("object changed size while it was uploaded")
+		}
+
+		header := http.Header{}
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(n)-1, size))
+		resp, err := store.do("PUT", session, bytes.NewReader(chunk[:n]), header)
+		if err != nil {
+			return fmt.Errorf("error uploading bytes %d-%d: %v", offset, offset+int64(n)-1, err)
+		}
+		resp.Body.Close()
+		offset += int64(n)
+	}
+	return nil
+}
+
+// gcsError is the body of a GCS error response.
+type gcsError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// do sends an authorized request, returning an error if the response status isn't a success, or 308, which confirms
+// a chunk of a resumable upload. Objects which don't exist are reported with an error satisfying os.IsNotExist.
+func (store *gcsStore) do(method string, rawURL string, body io.Reader, header http.Header) (*http.Response, error) {
+	return store.doContext(context.Background(), method, rawURL, body, header)
+}
+
+// doContext is do for a request which is given up once ctx is done.
+func (store *gcsStore) doContext(ctx context.Context, method string, rawURL string, body io.Reader,
+	header http.Header) (*http.Response, error) {
+	token, err := store.tokens.token()
+	if err != nil {
+		return nil, fmt.Errorf("error authenticating to gcs: %v", err)
+	}
+
+	req, err := http.NewRequest(method, rawURL, body)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := store.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 || resp.StatusCode == http.StatusPermanentRedirect {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	gcsErr := &gcsError{}
+	if err := json.NewDecoder(resp.Body).Decode(gcsErr); err != nil || gcsErr.Error.Message == "" {
+		return nil, fmt.Errorf("gcs responded with status: %s", resp.Status)
+	}
+	return nil, fmt.Errorf("gcs responded with status: %s: %s", resp.Status, gcsErr.Error.Message)
+}
+
+func (store *gcsStore) bucketURL() string {
+	return store.endpoint + "/storage/v1/b/" + url.PathEscape(store.config.Bucket)
+}
+
+func (store *gcsStore) objectURL(oid string) string {
+	return store.bucketURL() + "/o/" + url.PathEscape(store.config.Prefix+oid)
+}
+
+func (store *gcsStore) uploadURL(uploadType string) string {
+	return store.endpoint + "/upload/storage/v1/b/" + url.PathEscape(store.config.Bucket) + "/o?uploadType=" +
+		uploadType
+}
+
+// gcsServiceAccount is the part of a service account key file needed to authenticate as the service account.
+type gcsServiceAccount struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// newGCSTokenSource returns tokens for a service account key file, or from the metadata server of the instance or
+// workload, which is what workload identity provides on GKE, if there is no key file.
+func newGCSTokenSource(client *http.Client, credentialsPath string) (*tokenSource, error) {
+	if credentialsPath == "" {
+		host := os.Getenv("GCE_METADATA_HOST")
+		if host == "" {
+			host = "metadata.google.internal"
+		}
+		fetch := func() (*http.Request, error) {
+			req, err := http.NewRequest("GET",
+				"http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Metadata-Flavor", "Google")
+			return req, nil
+		}
+		return &tokenSource{fetch: fetch, client: client}, nil
+	}
+
+	data, err := ioutil.ReadFile(credentialsPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading credentials: %v", err)
+	}
+	account := &gcsServiceAccount{}
+	if err := json.Unmarshal(data, account); err != nil {
+		return nil, fmt.Errorf("invalid credentials: %v", err)
+	}
+	if account.ClientEmail == "" || account.TokenURI == "" {
+		return nil, fmt.Errorf("invalid credentials, which are not a service account key")
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in credentials: %v", err)
+	}
+
+	fetch := func() (*http.Request, error) {
+		now := time.Now()
+		assertion := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":   account.ClientEmail,
+			"scope": gcsScope,
+			"aud":   account.TokenURI,
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+		})
+		assertion.Header["kid"] = account.PrivateKeyID
+		signed, err := assertion.SignedString(key)
+		if err != nil {
+			return nil, err
+		}
+
+		form := url.Values{}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", signed)
+		req, err := http.NewRequest("POST", account.TokenURI, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	}
+	return &tokenSource{fetch: fetch, client: client}, nil
+}
@@ -0,0 +1,386 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Requests are signed without hashing their payload, which S3 allows, so that objects are streamed from disk as they
+// are uploaded. Endpoints should use https, as AWS and MinIO do by default, to protect objects in transit.
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+const s3TimeFormat = "20060102T150405Z"
+const s3DateFormat = "20060102"
+
+// s3Config configures an s3Store.
+type s3Config struct {
+	// Endpoint is the url of the S3 API, e.g. https://minio.internal:9000, or empty for AWS in Region.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to the oid of each object to make its key, e.g. "dead-drop/".
+	Prefix       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// PathStyle addresses the bucket in the path of requests rather than the host name, as MinIO usually requires.
+	PathStyle bool
+	Timeouts  storageTimeouts
+}
+
+// s3Store keeps objects in a bucket of S3, or an S3 compatible store such as MinIO, so that servers can be replaced
+// without losing the objects they stored. It speaks the S3 REST API with signature version 4 directly.
+type s3Store struct {
+	config     s3Config
+	endpoint   *url.URL
+	httpClient *http.Client
+}
+
+func newS3Store(config s3Config) (*s3Store, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("no bucket configured")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.AccessKey == "" || config.SecretKey == "" {
+		return nil, fmt.Errorf("no credentials configured")
+	}
+
+	rawEndpoint := config.Endpoint
+	if rawEndpoint == "" {
+		rawEndpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", config.Region)
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(rawEndpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %v", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("invalid endpoint '%s', which must be an http or https url", rawEndpoint)
+	}
+
+	return &s3Store{config: config, endpoint: endpoint, httpClient: newStorageHTTPClient(config.Timeouts)}, nil
+}
+
+func (store *s3Store) put(oid string, data []byte) error {
+	resp, err := store.do("PUT", oid, nil, bytes.NewReader(data), int64(len(data)), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (store *s3Store) putFile(oid string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	resp, err := store.do("PUT", oid, nil, file, info.Size(), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return os.Remove(path)
+}
+
+func (store *s3Store) open(oid string) (ObjectReader, int64, error) {
+	size, _, err := store.stat(oid)
+	if err != nil {
+		return nil, 0, err
+	}
+	fetch := func(offset int64) (io.ReadCloser, error) {
+		header := http.Header{}
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		resp, err := store.do("GET", oid, nil, nil, 0, header)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+	return &rangedObject{size: size, fetch: fetch}, size, nil
+}
+
+func (store *s3Store) stat(oid string) (int64, time.Time, error) {
+	resp, err := store.do("HEAD", oid, nil, nil, 0, nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	resp.Body.Close()
+
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("invalid modification time of object %s: %v", oid, err)
+	}
+	return resp.ContentLength, modified, nil
+}
+
+func (store *s3Store) ping(ctx context.Context) error {
+	resp, err := store.doContext(ctx, "HEAD", healthCheckOid, nil, nil, 0, nil)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (store *s3Store) remove(oid string) error {
+	resp, err := store.do("DELETE", oid, nil, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3ListResult is the part of a ListObjectsV2 response needed to index a bucket.
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list skips keys under the prefix which contain a slash, which dead-drop doesn't store.
+func (store *s3Store) list(fn func(oid string, modified time.Time)) error {
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", store.config.Prefix)
+
+	for {
+		resp, err := store.do("GET", "", query, nil, 0, nil)
+		if err != nil {
+			return err
+		}
+		result := &s3ListResult{}
+		err = xml.NewDecoder(resp.Body).Decode(result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("invalid listing of bucket %s: %v", store.config.Bucket, err)
+		}
+
+		for _, object := range result.Contents {
+			oid := strings.TrimPrefix(object.Key, store.config.Prefix)
+			if oid == "" || strings.Contains(oid, "/") {
+				continue
+			}
+			fn(oid, object.LastModified)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (store *s3Store) String() string {
+	return fmt.Sprintf("s3 bucket %s at %s", store.config.Bucket, store.endpoint)
+}
+
+// s3Error is the body of an S3 error response.
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+// do sends a signed request for the object with an oid, or for the bucket if the oid is empty, returning an error if
+// the response status isn't a success. Objects which don't exist are reported with an error satisfying os.IsNotExist.
+func (store *s3Store) do(
+	method string,
+	oid string,
+	query url.Values,
+	body io.Reader,
+	size int64,
+	header http.Header,
+) (*http.Response, error) {
+	return store.doContext(context.Background(), method, oid, query, body, size, header)
+}
+
+// doContext is do for a request which is given up once ctx is done.
+func (store *s3Store) doContext(
+	ctx context.Context,
+	method string,
+	oid string,
+	query url.Values,
+	body io.Reader,
+	size int64,
+	header http.Header,
+) (*http.Response, error) {
+	req, err := http.NewRequest(method, store.url(oid, query), body)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		// Stores refuse chunked uploads, which is how empty bodies of unknown type would be sent.
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	store.sign(req, time.Now().UTC())
+
+	resp, err := store.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && oid != "" {
+		return nil, os.ErrNotExist
+	}
+	s3Err := &s3Error{}
+	if err := xml.NewDecoder(resp.Body).Decode(s3Err); err != nil || s3Err.Code == "" {
+		return nil, fmt.Errorf("s3 responded with status: %s", resp.Status)
+	}
+	return nil, fmt.Errorf("s3 responded with status: %s %s: %s", resp.Status, s3Err.Code, s3Err.Message)
+}
+
+// url returns the url of an object, or of the bucket if the oid is empty.
+func (store *s3Store) url(oid string, query url.Values) string {
+	u := *store.endpoint
+	path := ""
+	if oid != "" {
+		path = "/" + store.config.Prefix + oid
+	}
+	if store.config.PathStyle {
+		path = "/" + store.config.Bucket + path
+	} else {
+		u.Host = store.config.Bucket + "." + u.Host
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	u.Path = u.Path + path
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+	return u.String()
+}
+
+// sign adds an AWS signature version 4 to a request.
+func (store *s3Store) sign(req *http.Request, now time.Time) {
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	if store.config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", store.config.SessionToken)
+	}
+
+	// Only the host and the X-Amz headers are signed, since proxies may rewrite the others.
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+
+	scope := strings.Join([]string{now.Format(s3DateFormat), store.config.Region, "s3", "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format(s3TimeFormat),
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + store.config.SecretKey)
+	for _, part := range []string{now.Format(s3DateFormat), store.config.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		store.config.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the unreserved characters of RFC 3986, and slashes unless escapeSlash is
+// set, as signature version 4 requires.
+func s3Escape(s string, escapeSlash bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', strings.IndexByte("-_.~", b) >= 0:
+			escaped.WriteByte(b)
+		case b == '/' && !escapeSlash:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// s3Query encodes a query sorted by name, as signature version 4 requires.
+func s3Query(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
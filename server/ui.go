@@ -0,0 +1,46 @@
+package server
+
+import (
+	"github.com/google/logger"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+// uiAssets maps the paths of the web interface under /ui/ to their embedded assets and content types.
+var uiAssets = map[string]struct {
+	asset       string
+	contentType string
+}{
+	"":       {"data/ui/index.html", "text/html; charset=utf-8"},
+	"app.js": {"data/ui/app.js", "text/javascript; charset=utf-8"},
+}
+
+// uiContentSecurityPolicy only lets the interface run its own script and talk to this server, so that it can't be
+// made to send keys or plaintext anywhere else.
+const uiContentSecurityPolicy = "default-src 'none'; script-src 'self'; style-src 'self' 'unsafe-inline'; " +
+	"connect-src 'self'; img-src 'self'; form-action 'none'; frame-ancestors 'none'; base-uri 'none'"
+
+// handleUI serves the web interface, which encrypts and decrypts objects in the browser, dropping them anonymously
+// and pulling them from shared urls. Keys never reach the server.
+func (handler *Handler) handleUI(w http.ResponseWriter, req *http.Request) {
+	ui, ok := uiAssets[mux.Vars(req)["asset"]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	data, err := Asset(ui.asset)
+	if err != nil {
+		logger.Errorf("Failed to load web interface asset %s: %v", ui.asset, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", ui.contentType)
+	w.Header().Set("Content-Security-Policy", uiContentSecurityPolicy)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if _, err := w.Write(data); err != nil {
+		logger.Errorf("Failed to write web interface asset: %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/logger"
+	"net/http"
+	"time"
+)
+
+// Kinds of object event which webhooks are sent for, besides those audited, which they share their names with.
+const webhookObjectExpired = "object_expired"
+
+// webhookEvents are the events webhooks may be sent for.
+var webhookEvents = map[string]bool{
+	auditObjectDropped:   true,
+	auditObjectPulled:    true,
+	auditObjectRemoved:   true,
+	webhookObjectExpired: true,
+	auditCanaryPulled:    true,
+}
+
+// webhookSignatureHeader carries the HMAC-SHA-256 of a webhook's body with the webhook secret, as sha256=<hex>.
+const webhookSignatureHeader = "X-Dead-Drop-Signature"
+
+// Webhooks are queued up to this many events, beyond which events are discarded until the queue drains, so that a
+// slow receiver doesn't hold up requests.
+const webhookQueueLen = 1024
+
+// Failed webhooks are retried this many times, waiting twice as long each time.
+const webhookRetries = 3
+const webhookRetryDelay = time.Second
+
+// webhooks posts object events to configured urls as json, signed with a shared secret so receivers can tell they
+// came from the server. Events are sent in the background, in order, and are lost if the server stops with some still
+// queued. Its methods do nothing on a nil webhooks, which disables them.
+type webhooks struct {
+	urls   []string
+	secret []byte
+	events map[string]bool
+	client *http.Client
+	queue  chan auditEvent
+	clock  Clock
+}
+
+// newWebhooks starts sending the given events to urls, or returns nil if there are no urls. The events default to
+// every event webhooks can be sent for.
+func newWebhooks(urls []string, secret string, events []string, timeout time.Duration, clock Clock) (*webhooks,
+	error) {
+	if len(urls) == 0 {
+		return nil, nil
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("webhooks need a secret to sign them with")
+	}
+
+	enabled := webhookEvents
+	if len(events) > 0 {
+		enabled = make(map[string]bool)
+		for _, event := range events {
+			if !webhookEvents[event] {
+				return nil, fmt.Errorf("unknown webhook event '%s'", event)
+			}
+			enabled[event] = true
+		}
+	}
+
+	hooks := &webhooks{
+		urls:   urls,
+		secret: []byte(secret),
+		events: enabled,
+		client: &http.Client{Timeout: timeout},
+		queue:  make(chan auditEvent, webhookQueueLen),
+		clock:  clock,
+	}
+	go hooks.sendJob()
+	return hooks, nil
+}
+
+// notify queues an event for the webhooks, if they are sent for its kind.
+func (hooks *webhooks) notify(event string, keyName string, oid string, detail string) {
+	if hooks == nil || !hooks.events[event] {
+		return
+	}
+
+	queued := auditEvent{Time: hooks.clock.Now().UTC(), Event: event, KeyName: keyName, Oid: oid, Detail: detail}
+	select {
+	case hooks.queue <- queued:
+	default:
+		logger.Errorf("Discarding %s webhook of object %s, since too many are queued", event, oid)
+	}
+}
+
+func (hooks *webhooks) sendJob() {
+	for event := range hooks.queue {
+		body, err := json.Marshal(event)
+		if err != nil {
+			logger.Errorf("Failed to encode webhook: %v", err)
+			continue
+		}
+		for _, url := range hooks.urls {
+			hooks.send(url, body)
+		}
+	}
+}
+
+// send posts a webhook to url, retrying with backoff until it is accepted with a 2xx response.
+func (hooks *webhooks) send(url string, body []byte) {
+	delay := webhookRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := hooks.post(url, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookRetries {
+			logger.Errorf("Failed to send webhook to %s: %v", url, err)
+			return
+		}
+		hooks.clock.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (hooks *webhooks) post(url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHeader, "sha256="+hooks.sign(body))
+
+	resp, err := hooks.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (hooks *webhooks) sign(body []byte) string {
+	mac := hmac.New(sha256.New, hooks.secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}